@@ -1,53 +1,15 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
-	"strings"
 
-	"tunneling/internal/control"
+	"tunneling/internal/cli"
 )
 
 func main() {
-	var (
-		addr = flag.String("addr", ":18100", "control api listen address")
-	)
-	flag.Parse()
-
-	supabaseURL := envOr("SUPABASE_URL", "")
-	supabaseKey := envOr("SUPABASE_SERVICE_ROLE_KEY", "")
-	publicBaseURL := envOr("PUBLIC_BASE_URL", "")
-	agentServerWS := envOr("AGENT_SERVER_WS", "")
-	agentConfigURL := envOr("AGENT_CONFIG_URL", "")
-	defaultAdminAddr := envOr("DEFAULT_AGENT_ADMIN_ADDR", "127.0.0.1:17001")
-	adminKey := envOr("TUNNELING_ADMIN_KEY", "")
-
-	client, err := control.NewSupabaseClient(supabaseURL, supabaseKey)
-	if err != nil {
-		log.Fatalf("supabase init failed: %v", err)
-	}
-
-	srv := control.NewServer(
-		client,
-		strings.TrimSpace(publicBaseURL),
-		strings.TrimSpace(agentServerWS),
-		strings.TrimSpace(agentConfigURL),
-		strings.TrimSpace(defaultAdminAddr),
-		adminKey,
-	)
-
-	log.Printf("control api listening on %s", *addr)
-	if err := http.ListenAndServe(*addr, srv.Handler()); err != nil {
-		log.Fatalf("control api failed: %v", err)
-	}
-}
-
-func envOr(key, fallback string) string {
-	v := strings.TrimSpace(os.Getenv(key))
-	if v == "" {
-		return fallback
+	if err := cli.Run(cli.Control, os.Args[1:]); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
-	return v
 }
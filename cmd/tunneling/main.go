@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"tunneling/internal/cli"
+)
+
+var commands = map[string]func(context.Context, []string) error{
+	"server":  cli.Server,
+	"agent":   cli.Agent,
+	"control": cli.Control,
+	"dev":     cli.Dev,
+}
+
+const usage = `usage: tunneling <command> [flags]
+
+commands:
+  server   public gateway and agent websocket endpoint
+  agent    local agent (agent http <port> exposes one port ad hoc;
+           agent routes|status|logs manage a running agent)
+  control  control plane api
+  dev      control, server and agent in one process for local testing
+
+run "tunneling <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		if arg := os.Args[1]; arg == "help" || arg == "-h" || arg == "--help" {
+			fmt.Print(usage)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err := cli.Run(run, os.Args[2:]); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
@@ -126,3 +126,9 @@ export function parseIds(value: unknown) {
 export function getControlAPIBase() {
     return CONTROL_API_BASE
 }
+
+// Headers for control API calls; CONTROL_API_KEY matches the control plane's -api-keys.
+export function controlAPIHeaders(): Record<string, string> {
+    const key = process.env.CONTROL_API_KEY?.trim()
+    return key ? { Authorization: `Bearer ${key}` } : {}
+}
@@ -1,5 +1,5 @@
 import { NextRequest, NextResponse } from 'next/server'
-import { getControlAPIBase, requireAdmin } from '../../../_lib'
+import { controlAPIHeaders, getControlAPIBase, requireAdmin } from '../../../_lib'
 
 export async function GET(
     _req: NextRequest,
@@ -18,6 +18,7 @@ export async function GET(
     const controlBase = getControlAPIBase()
     const response = await fetch(`${controlBase}/api/tunnels/${encodeURIComponent(tunnelId)}/command`, {
         cache: 'no-store',
+        headers: controlAPIHeaders(),
     })
     const payload = await response.json().catch(() => null)
 
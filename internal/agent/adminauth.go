@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminSessionCookie = "agent_admin_session"
+	// adminCSRFCookie is readable by the admin pages, which echo it in
+	// adminCSRFHeader on every POST, PUT and DELETE.
+	adminCSRFCookie = "agent_admin_csrf"
+	adminCSRFHeader = "X-CSRF-Token"
+	adminSessionTTL = 12 * time.Hour
+	// adminLoginDelay slows down password guessing.
+	adminLoginDelay = time.Second
+)
+
+// adminAuth guards the admin UI and API with a password. Browsers sign in
+// at /login and get a session cookie; scripts send the password as
+// "Authorization: Bearer <password>".
+type adminAuth struct {
+	password string
+
+	mu       sync.Mutex
+	sessions map[string]adminSession
+}
+
+type adminSession struct {
+	csrf    string
+	expires time.Time
+}
+
+// SetAdminPassword makes the admin UI and API ask for password; empty
+// leaves them open to anyone who can reach -admin-addr.
+func (s *Service) SetAdminPassword(password string) {
+	s.adminAuth = newAdminAuth(password)
+}
+
+func newAdminAuth(password string) *adminAuth {
+	if password == "" {
+		return nil
+	}
+	return &adminAuth{password: password, sessions: make(map[string]adminSession)}
+}
+
+// protectAdmin refuses cross-site writes in every mode, and with a
+// password also requests that are not signed in or, for cookie sessions,
+// lack the CSRF token.
+func (s *Service) protectAdmin(next http.Handler) http.Handler {
+	return guardAdmin(s.adminAuth, s.adminAddr, next)
+}
+
+func guardAdmin(a *adminAuth, addr string, next http.Handler) http.Handler {
+	if a == nil && !isLoopbackAddr(addr) {
+		slog.Warn("agent admin UI is reachable from the network without a password; set -admin-password", "addr", addr)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unsafeMethod(r.Method) && crossSite(r) {
+			errorJSON(w, http.StatusForbidden, "cross-site request refused")
+			return
+		}
+		if a == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/login":
+			a.handleLogin(w, r)
+			return
+		case "/logout":
+			a.handleLogout(w, r)
+			return
+		}
+		if a.bearer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sess, ok := a.session(r)
+		if !ok {
+			if r.Method != http.MethodGet || isAdminAPI(r.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="agent admin"`)
+				errorJSON(w, http.StatusUnauthorized, "login required")
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if unsafeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(adminCSRFHeader)), []byte(sess.csrf)) != 1 {
+			errorJSON(w, http.StatusForbidden, "missing or invalid csrf token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdminAPI reports a path answered with JSON rather than a page, also
+// under a Supervisor's /t/<name>/ prefix.
+func isAdminAPI(path string) bool {
+	if rest, ok := strings.CutPrefix(path, "/t/"); ok {
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			path = rest[i:]
+		}
+	}
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+func (a *adminAuth) bearer(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.checkPassword(token)
+}
+
+func (a *adminAuth) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+}
+
+func (a *adminAuth) session(r *http.Request) (adminSession, bool) {
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return adminSession{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sess, ok := a.sessions[c.Value]
+	if !ok || time.Now().After(sess.expires) {
+		delete(a.sessions, c.Value)
+		return adminSession{}, false
+	}
+	return sess, true
+}
+
+func (a *adminAuth) newSession() (string, adminSession) {
+	id, csrf := randomHex(32), randomHex(16)
+	sess := adminSession{csrf: csrf, expires: time.Now().Add(adminSessionTTL)}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, v := range a.sessions {
+		if now.After(v.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[id] = sess
+	return id, sess
+}
+
+func (a *adminAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	switch r.Method {
+	case http.MethodGet:
+		renderLogin(w, http.StatusOK, next, "")
+	case http.MethodPost:
+		if !a.checkPassword(r.PostFormValue("password")) {
+			time.Sleep(adminLoginDelay)
+			slog.Warn("agent admin login failed", "remote", r.RemoteAddr)
+			renderLogin(w, http.StatusUnauthorized, next, "密码错误")
+			return
+		}
+		id, sess := a.newSession()
+		maxAge := int(adminSessionTTL / time.Second)
+		http.SetCookie(w, &http.Cookie{Name: adminSessionCookie, Value: id, Path: "/", MaxAge: maxAge, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+		http.SetCookie(w, &http.Cookie{Name: adminCSRFCookie, Value: sess.csrf, Path: "/", MaxAge: maxAge, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(adminSessionCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, c.Value)
+		a.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: adminSessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: adminCSRFCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// crossSite reports a browser request sent by a page other than the admin
+// UI itself. Requests without Sec-Fetch-Site or Origin (curl, scripts) pass.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "cross-site", "same-site":
+		return true
+	case "same-origin", "none":
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func renderLogin(w http.ResponseWriter, status int, next, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = loginPage.Execute(w, map[string]string{"Next": next, "Error": errMsg})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html lang="zh-CN">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width, initial-scale=1" />
+  <title>Tunnel Agent 登录</title>
+  <style>
+    body { margin: 0; font-family: "PingFang SC", "Noto Sans SC", "Microsoft YaHei", sans-serif; background: #f4f7fb; color: #0f172a; }
+    .card { max-width: 360px; margin: 12vh auto 0; background: #fff; border: 1px solid #dbe2ea; border-radius: 14px; padding: 24px; box-shadow: 0 10px 28px rgba(8, 36, 90, 0.08); }
+    h1 { margin: 0 0 16px; font-size: 22px; }
+    input { width: 100%; box-sizing: border-box; border: 1px solid #dbe2ea; border-radius: 10px; padding: 10px 12px; font-size: 14px; margin-bottom: 12px; }
+    button { width: 100%; border: none; border-radius: 10px; padding: 10px 14px; color: #fff; background: linear-gradient(135deg, #0b5fff, #0a49c9); font-weight: 600; cursor: pointer; }
+    .error { color: #d94848; font-size: 13px; margin-bottom: 12px; }
+  </style>
+</head>
+<body>
+  <form class="card" method="post" action="/login">
+    <h1>Tunnel Agent</h1>
+    {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+    <input type="hidden" name="next" value="{{.Next}}" />
+    <input type="password" name="password" placeholder="管理密码" autofocus required />
+    <button type="submit">登录</button>
+  </form>
+</body>
+</html>`))
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func adminTestHandler(password string) http.Handler {
+	return guardAdmin(newAdminAuth(password), "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+func postLogin(h http.Handler, password, next string) *httptest.ResponseRecorder {
+	form := url.Values{"password": {password}, "next": {next}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestAdminLogin(t *testing.T) {
+	h := adminTestHandler("secret")
+
+	rec := postLogin(h, "wrong", "/")
+	if rec.Code != http.StatusUnauthorized || responseCookie(rec, adminSessionCookie) != nil {
+		t.Fatalf("wrong password: status %d, cookies %v", rec.Code, rec.Result().Cookies())
+	}
+
+	rec = postLogin(h, "secret", "/routes")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/routes" {
+		t.Fatalf("login: status %d, location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	session, csrf := responseCookie(rec, adminSessionCookie), responseCookie(rec, adminCSRFCookie)
+	if session == nil || !session.HttpOnly || csrf == nil || csrf.Value == "" {
+		t.Fatalf("login cookies = %v", rec.Result().Cookies())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("signed-in GET: status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(session)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("GET after logout: status %d", rec.Code)
+	}
+}
+
+func TestAdminLoginRedirectStaysLocal(t *testing.T) {
+	h := adminTestHandler("secret")
+	for _, next := range []string{"//evil.example/", "/\\evil.example", "https://evil.example/", ""} {
+		rec := postLogin(h, "secret", next)
+		if loc := rec.Header().Get("Location"); loc != "/" {
+			t.Errorf("next %q redirected to %q", next, loc)
+		}
+	}
+}
+
+func TestAdminRequiresLogin(t *testing.T) {
+	h := adminTestHandler("secret")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		want   int
+	}{
+		{"page redirects to login", http.MethodGet, "/", "", http.StatusSeeOther},
+		{"api is refused", http.MethodGet, "/api/status", "", http.StatusUnauthorized},
+		{"write is refused", http.MethodPost, "/api/routes", "", http.StatusUnauthorized},
+		{"wrong bearer", http.MethodGet, "/api/status", "Bearer nope", http.StatusUnauthorized},
+		{"bearer password", http.MethodPost, "/api/routes", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminCSRF(t *testing.T) {
+	h := adminTestHandler("secret")
+	rec := postLogin(h, "secret", "/")
+	session, csrf := responseCookie(rec, adminSessionCookie), responseCookie(rec, adminCSRFCookie)
+	if session == nil || csrf == nil {
+		t.Fatalf("login cookies = %v", rec.Result().Cookies())
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		headers map[string]string
+		want    int
+	}{
+		{name: "missing token", want: http.StatusForbidden},
+		{name: "wrong token", token: "0123456789abcdef", want: http.StatusForbidden},
+		{name: "matching token", token: csrf.Value, want: http.StatusOK},
+		{name: "cross-site fetch", token: csrf.Value, headers: map[string]string{"Sec-Fetch-Site": "cross-site"}, want: http.StatusForbidden},
+		{name: "same-site fetch", token: csrf.Value, headers: map[string]string{"Sec-Fetch-Site": "same-site"}, want: http.StatusForbidden},
+		{name: "foreign origin", token: csrf.Value, headers: map[string]string{"Origin": "https://evil.example"}, want: http.StatusForbidden},
+		{name: "own origin", token: csrf.Value, headers: map[string]string{"Origin": "http://example.com"}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/routes", nil)
+		req.AddCookie(session)
+		if tt.token != "" {
+			req.Header.Set(adminCSRFHeader, tt.token)
+		}
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminWithoutPasswordRefusesCrossSiteWrites(t *testing.T) {
+	h := adminTestHandler("")
+	req := httptest.NewRequest(http.MethodPost, "/api/routes", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("cross-site POST: status %d, want 403", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/routes", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("script POST: status %d, want 200", rec.Code)
+	}
+}
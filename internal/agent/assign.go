@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServerAuto in place of a server url asks the control plane which tunnel
+// servers to use.
+const ServerAuto = "auto"
+
+// assignRefresh is how often a reconnect may ask for a new assignment.
+const assignRefresh = time.Minute
+
+// SetRegion names the region the agent prefers servers in under -server auto.
+func (s *Service) SetRegion(region string) {
+	s.assignRegion = strings.ToLower(strings.TrimSpace(region))
+}
+
+// refreshAssignment asks the control plane for servers when none are known
+// yet, and again on reconnects once assignRefresh has passed.
+func (s *Service) refreshAssignment(ctx context.Context) error {
+	if !s.assign {
+		return nil
+	}
+	s.serverMu.Lock()
+	due := len(s.servers) == 0 || time.Since(s.assignedAt) >= assignRefresh
+	if due {
+		s.assignedAt = time.Now()
+	}
+	s.serverMu.Unlock()
+	if !due {
+		return nil
+	}
+	servers, err := s.fetchAssignment(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	// Stay on the current server if it is still offered: it may be where
+	// failover just moved us away from a server the control plane still
+	// ranks first.
+	idx := 0
+	if len(s.servers) > 0 {
+		current := s.servers[s.serverIdx]
+		for i, server := range servers {
+			if server == current {
+				idx = i
+			}
+		}
+	}
+	if strings.Join(servers, ",") != strings.Join(s.servers, ",") {
+		slog.Info("control plane assigned servers", "servers", strings.Join(servers, ","))
+	}
+	s.servers, s.serverIdx = servers, idx
+	return nil
+}
+
+func (s *Service) fetchAssignment(ctx context.Context) ([]string, error) {
+	endpoint, err := siblingURL(s.routeSyncURL, "assign")
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{
+		"tunnel_id": s.tunnelID,
+		"token":     s.tunnelToken,
+		"region":    s.assignRegion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Servers []string `json:"servers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode assignment: %w", err)
+	}
+	if len(out.Servers) == 0 {
+		return nil, errors.New("control plane assigned no servers")
+	}
+	return parseServerURLs(strings.Join(out.Servers, ","))
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// restartDelay is how soon the agent comes back after the server announced
+// a restart, before jitter.
+const restartDelay = 300 * time.Millisecond
+
+// Reconnect controls how the agent retries its server connection.
+type Reconnect struct {
+	// Initial is the wait after the first failure; it doubles up to Max.
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter shortens every wait by a random fraction of up to this much
+	// (0 to 1), so agents dropped together do not return together.
+	Jitter float64
+	// MaxRetries gives up after this many failures in a row; 0 never does.
+	MaxRetries int
+	// HealthyAfter is how long a connection must last before the backoff
+	// starts over.
+	HealthyAfter time.Duration
+}
+
+var defaultReconnect = Reconnect{
+	Initial:      time.Second,
+	Max:          10 * time.Second,
+	Jitter:       0.5,
+	HealthyAfter: time.Minute,
+}
+
+// SetReconnect replaces the reconnect policy; zero durations keep their
+// defaults.
+func (s *Service) SetReconnect(r Reconnect) error {
+	if r.Initial <= 0 {
+		r.Initial = defaultReconnect.Initial
+	}
+	if r.Max <= 0 {
+		r.Max = defaultReconnect.Max
+	}
+	if r.HealthyAfter <= 0 {
+		r.HealthyAfter = defaultReconnect.HealthyAfter
+	}
+	switch {
+	case r.Max < r.Initial:
+		return errors.New("reconnect max backoff must not be below the initial backoff")
+	case r.Jitter < 0 || r.Jitter > 1:
+		return errors.New("reconnect jitter must be between 0 and 1")
+	case r.MaxRetries < 0:
+		return errors.New("reconnect max retries must not be negative")
+	}
+	s.reconnect = r
+	return nil
+}
+
+func (r Reconnect) next(backoff time.Duration) time.Duration {
+	return min(backoff*2, r.Max)
+}
+
+// exhausted reports whether failures in a row have used up MaxRetries.
+func (r Reconnect) exhausted(failures int) bool {
+	return r.MaxRetries > 0 && failures >= r.MaxRetries
+}
+
+// healthy reports whether a connection that lasted this long resets the
+// backoff.
+func (r Reconnect) healthy(lasted time.Duration) bool {
+	return lasted > r.HealthyAfter
+}
+
+func (r Reconnect) jittered(d time.Duration) time.Duration {
+	return d - time.Duration(rand.Float64()*r.Jitter*float64(d))
+}
+
+// afterRestart spreads the quick return after a server restart over up to
+// the jittered part of the initial backoff.
+func (r Reconnect) afterRestart() time.Duration {
+	return restartDelay + time.Duration(rand.Float64()*r.Jitter*float64(r.Initial))
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffGrowth(t *testing.T) {
+	r := Reconnect{Initial: time.Second, Max: 10 * time.Second}
+	tests := []struct {
+		backoff, want time.Duration
+	}{
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{8 * time.Second, 10 * time.Second},
+		{10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := r.next(tt.backoff); got != tt.want {
+			t.Errorf("next(%s) = %s, want %s", tt.backoff, got, tt.want)
+		}
+	}
+}
+
+func TestReconnectJitterBounds(t *testing.T) {
+	tests := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0, time.Second, time.Second},
+		{0.5, 500 * time.Millisecond, time.Second},
+		{1, 0, time.Second},
+	}
+	for _, tt := range tests {
+		r := Reconnect{Initial: time.Second, Jitter: tt.jitter}
+		for range 1000 {
+			if got := r.jittered(time.Second); got < tt.min || got > tt.max {
+				t.Fatalf("jitter %v: jittered(1s) = %s, want within [%s, %s]", tt.jitter, got, tt.min, tt.max)
+			}
+			if got := r.afterRestart(); got < restartDelay || got > restartDelay+tt.max-tt.min {
+				t.Fatalf("jitter %v: afterRestart() = %s", tt.jitter, got)
+			}
+		}
+	}
+}
+
+func TestReconnectRetriesAndReset(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int
+		exhausted  bool
+	}{
+		{"unlimited", 0, 1000, false},
+		{"below the limit", 3, 2, false},
+		{"at the limit", 3, 3, true},
+		{"past the limit", 3, 4, true},
+	}
+	for _, tt := range tests {
+		r := Reconnect{MaxRetries: tt.maxRetries}
+		if got := r.exhausted(tt.failures); got != tt.exhausted {
+			t.Errorf("%s: exhausted(%d) = %v, want %v", tt.name, tt.failures, got, tt.exhausted)
+		}
+	}
+
+	r := Reconnect{HealthyAfter: time.Minute}
+	for lasted, want := range map[time.Duration]bool{
+		time.Second:     false,
+		time.Minute:     false,
+		2 * time.Minute: true,
+	} {
+		if got := r.healthy(lasted); got != want {
+			t.Errorf("healthy(%s) = %v, want %v", lasted, got, want)
+		}
+	}
+}
+
+func TestSetReconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      Reconnect
+		wantErr string
+	}{
+		{name: "defaults", in: Reconnect{}},
+		{name: "max below initial", in: Reconnect{Initial: 5 * time.Second, Max: time.Second}, wantErr: "max backoff"},
+		{name: "jitter too large", in: Reconnect{Jitter: 1.5}, wantErr: "jitter"},
+		{name: "negative jitter", in: Reconnect{Jitter: -0.1}, wantErr: "jitter"},
+		{name: "negative retries", in: Reconnect{MaxRetries: -1}, wantErr: "max retries"},
+	}
+	for _, tt := range tests {
+		svc := newTestService(t, fileConfig{})
+		err := svc.SetReconnect(tt.in)
+		if tt.wantErr == "" {
+			if err != nil || svc.reconnect.Initial != defaultReconnect.Initial || svc.reconnect.Max != defaultReconnect.Max || svc.reconnect.HealthyAfter != defaultReconnect.HealthyAfter {
+				t.Errorf("%s: reconnect = %+v, err = %v", tt.name, svc.reconnect, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConnectLoopGivesUpAfterMaxRetries(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	if err := svc.SetReconnect(Reconnect{Initial: time.Millisecond, Max: time.Millisecond, MaxRetries: 3}); err != nil {
+		t.Fatalf("SetReconnect: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := svc.connectLoop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 failed connection attempts") {
+		t.Fatalf("connectLoop = %v", err)
+	}
+}
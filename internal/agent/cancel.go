@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+)
+
+// beginRequest returns the context a proxied request runs under until
+// endRequest, so a proxy_cancel from the server can abort the local call.
+func (s *Service) beginRequest(requestID string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.requestsMu.Lock()
+	defer s.requestsMu.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]context.CancelFunc)
+	}
+	s.requests[requestID] = cancel
+	return ctx
+}
+
+func (s *Service) endRequest(requestID string) {
+	s.requestsMu.Lock()
+	cancel := s.requests[requestID]
+	delete(s.requests, requestID)
+	s.requestsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (s *Service) cancelRequest(requestID string) {
+	s.requestsMu.Lock()
+	cancel := s.requests[requestID]
+	s.requestsMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	slog.Debug("proxy request canceled by server", "request_id", requestID)
+	cancel()
+	if st := s.stream(requestID); st != nil {
+		st.inbound.Abort(context.Canceled)
+	}
+}
@@ -0,0 +1,22 @@
+package agent
+
+import (
+	"slices"
+
+	"tunneling/internal/protocol"
+)
+
+// SetCompression sets the smallest response body the agent gzips on its way
+// to the server. Zero turns compression off and stops offering the compress
+// capability, so the server sends request bodies uncompressed too.
+func (s *Service) SetCompression(minBytes int) {
+	s.compressMin = minBytes
+}
+
+// caps lists the capabilities the agent offers the server.
+func (s *Service) caps() []string {
+	if s.compressMin > 0 {
+		return protocol.SupportedCaps
+	}
+	return slices.DeleteFunc(slices.Clone(protocol.SupportedCaps), func(c string) bool { return c == protocol.CapCompress })
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"tunneling/internal/protocol"
 )
@@ -18,16 +20,37 @@ type ConfigStore struct {
 	mu   sync.RWMutex
 
 	routes map[string]protocol.Route
+	// checks are the health checks by hostname. They live next to the routes
+	// rather than in them, so a control-plane sync never drops them.
+	checks map[string]HealthCheck
+	// stamp identifies the file version last read or written, so Reload only
+	// picks up edits made by someone else.
+	stamp fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
 }
 
 type fileConfig struct {
-	Routes []protocol.Route `json:"routes"`
+	Routes       []protocol.Route       `json:"routes"`
+	HealthChecks map[string]HealthCheck `json:"health_checks,omitempty"`
 }
 
 func NewConfigStore(path string) (*ConfigStore, error) {
 	store := &ConfigStore{
 		path:   path,
 		routes: make(map[string]protocol.Route),
+		checks: make(map[string]HealthCheck),
 	}
 	if err := store.load(); err != nil {
 		return nil, err
@@ -52,24 +75,24 @@ func (s *ConfigStore) load() error {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return fmt.Errorf("parse config: %w", err)
 	}
+	s.stamp = statFile(s.path)
 
 	for _, route := range cfg.Routes {
-		host, err := NormalizeHostname(route.Hostname)
-		if err != nil {
-			continue
+		if route, err := normalizeRoute(route); err == nil {
+			s.routes[route.Hostname] = route
 		}
-		target, err := NormalizeTarget(route.Target)
-		if err != nil {
-			continue
-		}
-		s.routes[host] = protocol.Route{Hostname: host, Target: target}
 	}
+	checks, err := normalizeHealthChecks(cfg.HealthChecks)
+	if err != nil {
+		return fmt.Errorf("health_checks: %w", err)
+	}
+	s.checks = checks
 
 	return nil
 }
 
 func (s *ConfigStore) saveLocked() error {
-	cfg := fileConfig{Routes: s.snapshotLocked()}
+	cfg := fileConfig{Routes: s.snapshotLocked(), HealthChecks: s.checks}
 	data, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return fmt.Errorf("encode config: %w", err)
@@ -87,9 +110,65 @@ func (s *ConfigStore) saveLocked() error {
 	if err := os.Rename(tmp, s.path); err != nil {
 		return fmt.Errorf("replace config: %w", err)
 	}
+	s.stamp = statFile(s.path)
 	return nil
 }
 
+// Reload re-reads the file if it changed on disk since the store last read or
+// wrote it. A file that does not parse, or names an invalid route, is
+// rejected as a whole and the current routes stay in place.
+func (s *ConfigStore) Reload() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stamp := statFile(s.path)
+	if stamp == (fileStamp{}) || stamp == s.stamp {
+		return false, nil
+	}
+	// Remember the version even if it is broken so it is reported once, not
+	// on every poll.
+	s.stamp = stamp
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("read config: %w", err)
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return false, fmt.Errorf("parse config: %w", err)
+	}
+	next := make(map[string]protocol.Route, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		route, err := normalizeRoute(route)
+		if err != nil {
+			return false, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		next[route.Hostname] = route
+	}
+	checks, err := normalizeHealthChecks(cfg.HealthChecks)
+	if err != nil {
+		return false, fmt.Errorf("health_checks: %w", err)
+	}
+	if sameRoutes(s.routes, next) && reflect.DeepEqual(s.checks, checks) {
+		return false, nil
+	}
+	s.routes, s.checks = next, checks
+	return true, nil
+}
+
+func sameRoutes(a, b map[string]protocol.Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for host, route := range b {
+		current, ok := a[host]
+		if !ok || !protocol.RouteEqual(current, route) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *ConfigStore) snapshotLocked() []protocol.Route {
 	out := make([]protocol.Route, 0, len(s.routes))
 	for _, route := range s.routes {
@@ -114,6 +193,18 @@ func (s *ConfigStore) List() []protocol.Route {
 	return out
 }
 
+// HealthChecks returns the configured checks by hostname; a check whose
+// hostname has no route is kept but never run.
+func (s *ConfigStore) HealthChecks() map[string]HealthCheck {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]HealthCheck, len(s.checks))
+	for host, check := range s.checks {
+		out[host] = check
+	}
+	return out
+}
+
 func (s *ConfigStore) Upsert(hostname, target string) error {
 	host, err := NormalizeHostname(hostname)
 	if err != nil {
@@ -126,7 +217,12 @@ func (s *ConfigStore) Upsert(hostname, target string) error {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.routes[host] = protocol.Route{Hostname: host, Target: normalizedTarget}
+	// Route policies (rate limits, splits, request limits, IP filters,
+	// auth) come from the control plane or the file; editing the target
+	// locally keeps them.
+	route := s.routes[host]
+	route.Hostname, route.Target = host, normalizedTarget
+	s.routes[host] = route
 	return s.saveLocked()
 }
 
@@ -145,32 +241,18 @@ func (s *ConfigStore) Delete(hostname string) error {
 func (s *ConfigStore) ReplaceAll(routes []protocol.Route) (bool, error) {
 	next := make(map[string]protocol.Route, len(routes))
 	for _, route := range routes {
-		host, err := NormalizeHostname(route.Hostname)
+		route, err := normalizeRoute(route)
 		if err != nil {
 			return false, err
 		}
-		target, err := NormalizeTarget(route.Target)
-		if err != nil {
-			return false, err
-		}
-		next[host] = protocol.Route{Hostname: host, Target: target}
+		next[route.Hostname] = route
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(next) == len(s.routes) {
-		same := true
-		for host, route := range next {
-			current, ok := s.routes[host]
-			if !ok || current.Target != route.Target {
-				same = false
-				break
-			}
-		}
-		if same {
-			return false, nil
-		}
+	if sameRoutes(s.routes, next) {
+		return false, nil
 	}
 
 	s.routes = next
@@ -180,6 +262,56 @@ func (s *ConfigStore) ReplaceAll(routes []protocol.Route) (bool, error) {
 	return true, nil
 }
 
+// normalizeRoute canonicalises every field of a route read from the file or
+// handed over by the control plane.
+func normalizeRoute(route protocol.Route) (protocol.Route, error) {
+	host, err := NormalizeHostname(route.Hostname)
+	if err != nil {
+		return route, err
+	}
+	target, err := NormalizeTarget(route.Target)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	split, err := protocol.NormalizeSplit(route.Split)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	timeout, err := protocol.NormalizeRouteLimits(route.Timeout, route.MaxBodyBytes)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	filter, err := protocol.NormalizeIPFilter(route.IPFilter)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	auth, err := protocol.NormalizeRouteAuth(route.Auth)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	rewrite, err := protocol.NormalizeRewrite(route.Rewrite)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	headerRules, err := protocol.NormalizeHeaderRules(route.HeaderRules)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	aliases, err := protocol.NormalizeAliases(host, route.Aliases)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	cache, err := protocol.NormalizeCache(route.Cache)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	mirror, err := protocol.NormalizeMirror(route.Mirror)
+	if err != nil {
+		return route, fmt.Errorf("%s: %w", host, err)
+	}
+	return protocol.Route{Hostname: host, Target: target, RateLimit: route.RateLimit, Split: split, Timeout: timeout, MaxBodyBytes: route.MaxBodyBytes, IPFilter: filter, Auth: auth, Rewrite: rewrite, HeaderRules: headerRules, ACMEPassthrough: route.ACMEPassthrough, Aliases: aliases, Cache: cache, Mirror: mirror}, nil
+}
+
 func NormalizeHostname(hostname string) (string, error) {
 	host := strings.TrimSpace(strings.ToLower(hostname))
 	host = strings.TrimSuffix(host, ".")
@@ -198,16 +330,8 @@ func NormalizeHostname(hostname string) (string, error) {
 	return host, nil
 }
 
+// NormalizeTarget accepts host:port, http(s)://host:port and
+// unix:///path/to.sock targets.
 func NormalizeTarget(target string) (string, error) {
-	t := strings.TrimSpace(target)
-	if t == "" {
-		return "", errors.New("target is required")
-	}
-	if strings.Contains(t, "http://") || strings.Contains(t, "https://") {
-		return "", errors.New("target should be host:port, e.g. 127.0.0.1:3000")
-	}
-	if !strings.Contains(t, ":") {
-		return "", errors.New("target must include port, e.g. 127.0.0.1:3000")
-	}
-	return t, nil
+	return protocol.NormalizeTarget(target)
 }
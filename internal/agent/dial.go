@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+
+	"tunneling/internal/muxconn"
+	"tunneling/internal/wsconn"
+)
+
+// Transports the connection to the tunnel server can be carried over.
+const (
+	TransportWebSocket = "websocket"
+	TransportYamux     = muxconn.TransportYamux
+	TransportQUIC      = muxconn.TransportQUIC
+)
+
+// ServerTLS configures how the agent verifies a wss:// tunnel server.
+type ServerTLS struct {
+	// CAFile holds PEM certificates trusted on top of the system pool, for
+	// servers behind a private CA.
+	CAFile string
+	// InsecureSkipVerify accepts any certificate; only for labs.
+	InsecureSkipVerify bool
+	// ServerName overrides the name sent in SNI and checked against the
+	// certificate, e.g. when dialing the server by IP address.
+	ServerName string
+	// MinVersion is "1.2" or "1.3"; empty keeps the Go default.
+	MinVersion string
+}
+
+// SetServerTLS applies opts to every later connection to the tunnel server.
+func (s *Service) SetServerTLS(opts ServerTLS) error {
+	cfg := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify, ServerName: strings.TrimSpace(opts.ServerName)}
+	switch strings.TrimSpace(opts.MinVersion) {
+	case "":
+	case "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("unsupported tls min version %q (want 1.2 or 1.3)", opts.MinVersion)
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCAPool(opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("server ca file: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	s.serverTLS = cfg
+	return nil
+}
+
+// SetProxy sends the tunnel server connection and control plane calls
+// through proxyURL (http://, https:// or socks5://) instead of the proxy
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY name.
+func (s *Service) SetProxy(proxyURL string) error {
+	u, err := url.Parse(strings.TrimSpace(proxyURL))
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy url %q", proxyURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	s.proxy = http.ProxyURL(u)
+	s.httpClient, s.streamClient = s.controlClients()
+	return nil
+}
+
+// SetTransport picks how the connection to the tunnel server is carried.
+// TransportWebSocket sends every envelope over one websocket.
+// TransportYamux runs a yamux session on that websocket and gets a stream
+// per request from the server, so a request whose reader is slow holds up
+// only its own stream; servers without yamux keep the plain websocket.
+// TransportQUIC gets the same streams over QUIC, where a lost packet only
+// holds up its own stream, and needs a server listening for QUIC. QUIC
+// always uses TLS, verified as set with SetServerTLS, and never goes
+// through a proxy.
+func (s *Service) SetTransport(name string) error {
+	switch name = strings.TrimSpace(name); name {
+	case "", TransportWebSocket:
+		s.transport = TransportWebSocket
+	case TransportYamux:
+		s.transport = name
+	case TransportQUIC:
+		s.transport = name
+		s.quicSessions = tls.NewLRUClientSessionCache(4)
+	default:
+		return fmt.Errorf("unsupported transport %q (want %s, %s or %s)", name, TransportWebSocket, TransportYamux, TransportQUIC)
+	}
+	return nil
+}
+
+// dialServer connects to the tunnel server at connectURL over the
+// configured transport.
+func (s *Service) dialServer(ctx context.Context, connectURL string) (wsconn.Conn, error) {
+	header := http.Header{"Authorization": {"Bearer " + s.token}}
+	if s.transport == TransportQUIC {
+		conn, err := s.dialQUIC(ctx, connectURL, header)
+		if err != nil {
+			return nil, fmt.Errorf("connect server over quic: %w", err)
+		}
+		return conn, nil
+	}
+	ws, resp, err := s.serverDialer().DialContext(ctx, connectURL, header)
+	if err != nil && resp != nil && resp.StatusCode == http.StatusBadRequest && !s.queryToken.Load() {
+		slog.Info("server predates header auth, sending the token in the url")
+		s.queryToken.Store(true)
+		if connectURL, err = s.buildConnectURL(); err != nil {
+			return nil, err
+		}
+		ws, resp, err = s.serverDialer().DialContext(ctx, connectURL, header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect server: %w", err)
+	}
+	conn, err := s.wrapConn(ws, resp)
+	if err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialQUIC connects over QUIC to the UDP port of connectURL, which the
+// server's QUIC listener shares with its websocket one by default, and
+// sends the connect request on the first stream.
+func (s *Service) dialQUIC(ctx context.Context, connectURL string, header http.Header) (wsconn.Conn, error) {
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	tlsConf := &tls.Config{}
+	if s.serverTLS != nil {
+		tlsConf = s.serverTLS.Clone()
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = u.Hostname()
+	}
+	tlsConf.NextProtos = []string{muxconn.QUICProto}
+	// Reconnects resume the TLS session instead of a full handshake.
+	tlsConf.ClientSessionCache = s.quicSessions
+	qc, err := quic.DialAddr(ctx, net.JoinHostPort(u.Hostname(), port), tlsConf, muxconn.QUICConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	httpURL := *u
+	httpURL.Scheme = "https"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL.String(), nil)
+	if err != nil {
+		_ = qc.CloseWithError(0, "")
+		return nil, err
+	}
+	req.Header = header
+	conn, resp, err := muxconn.DialQUIC(ctx, qc, req)
+	if err == nil && conn == nil {
+		err = fmt.Errorf("server answered %s", resp.Status)
+	}
+	if err != nil {
+		_ = qc.CloseWithError(0, "")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// wrapConn starts the transport the server agreed to in its upgrade
+// response on ws.
+func (s *Service) wrapConn(ws *websocket.Conn, resp *http.Response) (wsconn.Conn, error) {
+	if s.transport != TransportYamux {
+		return ws, nil
+	}
+	if resp == nil || resp.Header.Get(muxconn.TransportHeader) != muxconn.TransportYamux {
+		slog.Info("server does not support yamux, staying on the plain websocket", "server", s.currentServer())
+		return ws, nil
+	}
+	conn, err := muxconn.DialYamux(ws)
+	if err != nil {
+		return nil, fmt.Errorf("start yamux session: %w", err)
+	}
+	return conn, nil
+}
+
+// serverDialer returns the dialer for the tunnel server connection.
+func (s *Service) serverDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = s.proxy
+	dialer.TLSClientConfig = s.serverTLS
+	return &dialer
+}
+
+// controlClients returns the client for control plane requests and the one
+// for its long-lived route stream.
+func (s *Service) controlClients() (*http.Client, *http.Client) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = s.proxy
+	stream := transport.Clone()
+	stream.ResponseHeaderTimeout = 45 * time.Second
+	return &http.Client{Transport: transport, Timeout: 45 * time.Second}, &http.Client{Transport: stream}
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	discoveryRetry    = 5 * time.Second
+	discoveryDebounce = 500 * time.Millisecond
+)
+
+// routeSource holds the routes one discovery mechanism (Docker, Kubernetes)
+// currently sees.
+type routeSource struct {
+	name string
+
+	mu     sync.Mutex
+	routes []protocol.Route
+}
+
+func (r *routeSource) discovered() []protocol.Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]protocol.Route(nil), r.routes...)
+}
+
+// discoveredRoute is a discovered route as shown by GET /api/routes.
+type discoveredRoute struct {
+	protocol.Route
+	Source string `json:"source"`
+}
+
+func (s *Service) routeSources() []*routeSource {
+	var out []*routeSource
+	if s.docker != nil {
+		out = append(out, &s.docker.routeSource)
+	}
+	if s.kube != nil {
+		out = append(out, &s.kube.routeSource)
+	}
+	return out
+}
+
+// allRoutes is what the agent registers: its configured routes plus the
+// discovered ones.
+func (s *Service) allRoutes() []protocol.Route {
+	routes := s.store.List()
+	extra := s.discoveredRoutes(routes)
+	if len(extra) == 0 {
+		return routes
+	}
+	for _, r := range extra {
+		routes = append(routes, r.Route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Hostname < routes[j].Hostname })
+	return routes
+}
+
+// discoveredRoutes returns the discovered routes whose hostname is not
+// already configured; a configured route wins, then the first source.
+func (s *Service) discoveredRoutes(configured []protocol.Route) []discoveredRoute {
+	taken := make(map[string]bool, len(configured))
+	for _, r := range configured {
+		taken[r.Hostname] = true
+	}
+	var out []discoveredRoute
+	for _, src := range s.routeSources() {
+		for _, r := range src.discovered() {
+			if taken[r.Hostname] {
+				continue
+			}
+			taken[r.Hostname] = true
+			out = append(out, discoveredRoute{Route: r, Source: src.name})
+		}
+	}
+	return out
+}
+
+// setDiscovered replaces the routes of src and publishes them if they
+// changed.
+func (s *Service) setDiscovered(src *routeSource, routes []protocol.Route) {
+	src.mu.Lock()
+	changed := protocol.RoutesVersion(routes) != protocol.RoutesVersion(src.routes)
+	src.routes = routes
+	src.mu.Unlock()
+	if !changed {
+		return
+	}
+	slog.Info("discovered routes changed", "source", src.name, "routes", len(routes))
+	if err := s.SyncRoutes(); err != nil {
+		slog.Debug("publish discovered routes deferred until connected", "source", src.name, "err", err)
+	}
+}
+
+// discoveryLoop runs watch until ctx is done, retrying after failures. A
+// watch that ends without an error is restarted right away.
+func discoveryLoop(ctx context.Context, name string, watch func(context.Context) error) {
+	for ctx.Err() == nil {
+		err := watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		slog.Warn("route discovery failed, retrying", "source", name, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryRetry):
+		}
+	}
+}
+
+// debounce calls refresh after every burst of signals on events until
+// errc yields or ctx is done. Objects come and go in bursts (compose up,
+// kubectl apply), so it waits for them to settle first.
+func debounce(ctx context.Context, events <-chan struct{}, errc <-chan error, refresh func()) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case <-events:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(discoveryDebounce):
+			}
+			refresh()
+		}
+	}
+}
+
+// notify signals events without blocking; one pending signal is enough.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// withScheme turns a host:port and the scheme a label or annotation asks
+// for into a route target.
+func withScheme(addr, scheme string) (string, error) {
+	switch scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme {
+	case "", "http":
+		return addr, nil
+	case "https":
+		return "https://" + addr, nil
+	default:
+		return "", fmt.Errorf("invalid scheme %q", scheme)
+	}
+}
@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tunneling/internal/protocol"
+)
+
+// Container labels read by Docker discovery. tunneling.port may be left
+// out when the container exposes a single port; tunneling.scheme is http
+// (default) or https; tunneling.network picks the network whose address is
+// used when the port is not published on the host.
+const (
+	dockerLabelHostname = "tunneling.hostname"
+	dockerLabelPort     = "tunneling.port"
+	dockerLabelScheme   = "tunneling.scheme"
+	dockerLabelNetwork  = "tunneling.network"
+
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+// dockerDiscovery turns running containers labelled with tunneling.hostname
+// into routes, following Docker's event stream to add and remove them.
+type dockerDiscovery struct {
+	routeSource
+	client *http.Client
+	base   string
+}
+
+// EnableDocker makes the agent publish a route for every running container
+// labelled tunneling.hostname. host is a Docker endpoint such as
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375; empty uses
+// DOCKER_HOST or the local socket.
+func (s *Service) EnableDocker(host string) error {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	d := &dockerDiscovery{routeSource: routeSource{name: "docker"}}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		d.base = "http://docker"
+		d.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+	case "tcp", "http":
+		d.base = "http://" + u.Host
+		d.client = &http.Client{}
+	default:
+		return fmt.Errorf("docker host %q: only unix:// and tcp:// are supported", host)
+	}
+	s.docker = d
+	return nil
+}
+
+// watchDocker lists the containers, then again after every burst of
+// container events, until the event stream fails.
+func (s *Service) watchDocker(ctx context.Context) error {
+	d := s.docker
+	filters, _ := json.Marshal(map[string][]string{"type": {"container"}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+"/events?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker events: %s", resp.Status)
+	}
+
+	// The stream is open, so no change can slip in between.
+	refresh := func() {
+		routes, err := d.list(ctx)
+		if err != nil {
+			slog.Warn("list docker containers failed", "err", err)
+			return
+		}
+		s.setDiscovered(&d.routeSource, routes)
+	}
+	refresh()
+	events := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go func() {
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev struct {
+				Action string `json:"Action"`
+			}
+			if err := dec.Decode(&ev); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = errors.New("docker closed the event stream")
+				}
+				errc <- err
+				return
+			}
+			switch strings.SplitN(ev.Action, ":", 2)[0] {
+			case "start", "die", "destroy", "rename", "update", "pause", "unpause":
+				notify(events)
+			}
+		}
+	}()
+	return debounce(ctx, events, errc, refresh)
+}
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (c dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// list returns a route per hostname label of the running containers.
+func (d *dockerDiscovery) list(ctx context.Context) ([]protocol.Route, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {dockerLabelHostname}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+"/containers/json?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker containers: %s", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("decode docker containers: %w", err)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].name() < containers[j].name() })
+
+	seen := make(map[string]string)
+	var routes []protocol.Route
+	for _, c := range containers {
+		target, err := c.target()
+		if err != nil {
+			slog.Warn("docker container skipped", "container", c.name(), "err", err)
+			continue
+		}
+		for _, raw := range strings.Split(c.Labels[dockerLabelHostname], ",") {
+			host, err := NormalizeHostname(raw)
+			if err != nil {
+				slog.Warn("docker container skipped", "container", c.name(), "hostname", raw, "err", err)
+				continue
+			}
+			if owner, dup := seen[host]; dup {
+				slog.Warn("hostname claimed by two containers", "hostname", host, "container", c.name(), "kept", owner)
+				continue
+			}
+			seen[host] = c.name()
+			routes = append(routes, protocol.Route{Hostname: host, Target: target})
+		}
+	}
+	return routes, nil
+}
+
+// target is the address the agent reaches the container at: the host port
+// the container port is published on, or else the container's own address.
+func (c dockerContainer) target() (string, error) {
+	port := 0
+	if v := strings.TrimSpace(c.Labels[dockerLabelPort]); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p <= 0 || p > 65535 {
+			return "", fmt.Errorf("invalid %s label %q", dockerLabelPort, v)
+		}
+		port = p
+	} else {
+		exposed := map[int]bool{}
+		for _, p := range c.Ports {
+			if p.Type == "tcp" {
+				exposed[p.PrivatePort] = true
+			}
+		}
+		if len(exposed) != 1 {
+			return "", fmt.Errorf("set the %s label: the container exposes %d tcp ports", dockerLabelPort, len(exposed))
+		}
+		for p := range exposed {
+			port = p
+		}
+	}
+
+	addr := ""
+	for _, p := range c.Ports {
+		if p.Type != "tcp" || p.PrivatePort != port || p.PublicPort == 0 {
+			continue
+		}
+		ip := p.IP
+		if ip == "" || ip == "0.0.0.0" || ip == "::" {
+			ip = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(ip, strconv.Itoa(p.PublicPort))
+		if ip == "127.0.0.1" {
+			break
+		}
+	}
+	if addr == "" {
+		network := c.Labels[dockerLabelNetwork]
+		names := make([]string, 0, len(c.NetworkSettings.Networks))
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" && (network == "" || network == name) {
+				addr = net.JoinHostPort(ip, strconv.Itoa(port))
+				break
+			}
+		}
+	}
+	if addr == "" {
+		return "", fmt.Errorf("port %d is not published and the container has no reachable address", port)
+	}
+	return withScheme(addr, c.Labels[dockerLabelScheme])
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tunneling/internal/protocol"
+)
+
+func decodeContainer(t *testing.T, raw string) dockerContainer {
+	t.Helper()
+	var c dockerContainer
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		t.Fatalf("decode container: %v", err)
+	}
+	return c
+}
+
+func TestDockerContainerTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "single published port",
+			raw:  `{"Labels":{"tunneling.hostname":"a.test"},"Ports":[{"IP":"0.0.0.0","PrivatePort":80,"PublicPort":8080,"Type":"tcp"}]}`,
+			want: "127.0.0.1:8080",
+		},
+		{
+			name: "port label picks among several",
+			raw:  `{"Labels":{"tunneling.port":"443"},"Ports":[{"PrivatePort":80,"PublicPort":8080,"Type":"tcp"},{"IP":"10.0.0.5","PrivatePort":443,"PublicPort":8443,"Type":"tcp"}]}`,
+			want: "10.0.0.5:8443",
+		},
+		{
+			name: "loopback binding preferred",
+			raw:  `{"Labels":{"tunneling.port":"80"},"Ports":[{"IP":"10.0.0.5","PrivatePort":80,"PublicPort":9000,"Type":"tcp"},{"IP":"::","PrivatePort":80,"PublicPort":9001,"Type":"tcp"}]}`,
+			want: "127.0.0.1:9001",
+		},
+		{
+			name: "unpublished port uses the container address",
+			raw:  `{"Labels":{"tunneling.port":"3000"},"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2"}}}}`,
+			want: "172.17.0.2:3000",
+		},
+		{
+			name: "network label",
+			raw:  `{"Labels":{"tunneling.port":"3000","tunneling.network":"web"},"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2"},"web":{"IPAddress":"172.20.0.3"}}}}`,
+			want: "172.20.0.3:3000",
+		},
+		{
+			name: "https scheme",
+			raw:  `{"Labels":{"tunneling.port":"8443","tunneling.scheme":"HTTPS"},"Ports":[{"PrivatePort":8443,"PublicPort":8443,"Type":"tcp"}]}`,
+			want: "https://127.0.0.1:8443",
+		},
+		{
+			name:    "port label not a number",
+			raw:     `{"Labels":{"tunneling.port":"http"}}`,
+			wantErr: "invalid tunneling.port",
+		},
+		{
+			name:    "port label out of range",
+			raw:     `{"Labels":{"tunneling.port":"70000"}}`,
+			wantErr: "invalid tunneling.port",
+		},
+		{
+			name:    "several ports without a label",
+			raw:     `{"Ports":[{"PrivatePort":80,"Type":"tcp"},{"PrivatePort":443,"Type":"tcp"},{"PrivatePort":53,"Type":"udp"}]}`,
+			wantErr: "exposes 2 tcp ports",
+		},
+		{
+			name:    "no ports without a label",
+			raw:     `{}`,
+			wantErr: "exposes 0 tcp ports",
+		},
+		{
+			name:    "unknown network",
+			raw:     `{"Labels":{"tunneling.port":"3000","tunneling.network":"missing"},"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2"}}}}`,
+			wantErr: "no reachable address",
+		},
+		{
+			name:    "bad scheme",
+			raw:     `{"Labels":{"tunneling.port":"80","tunneling.scheme":"ftp"},"Ports":[{"PrivatePort":80,"PublicPort":80,"Type":"tcp"}]}`,
+			wantErr: "invalid scheme",
+		},
+	}
+	for _, tt := range tests {
+		got, err := decodeContainer(t, tt.raw).target()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: target() = %q, %v; want error %q", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: target() = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDockerListSkipsMalformedContainers(t *testing.T) {
+	containers := `[
+		{"Id":"0123456789abcdef","Names":["/web"],"Labels":{"tunneling.hostname":"Web.Test, api.test"},"Ports":[{"PrivatePort":80,"PublicPort":8080,"Type":"tcp"}]},
+		{"Names":["/broken"],"Labels":{"tunneling.hostname":"broken.test","tunneling.port":"nope"}},
+		{"Names":["/zz-dup"],"Labels":{"tunneling.hostname":"web.test","tunneling.port":"81"},"Ports":[{"PrivatePort":81,"PublicPort":8081,"Type":"tcp"}]},
+		{"Names":["/empty"],"Labels":{"tunneling.hostname":" , "},"Ports":[{"PrivatePort":80,"PublicPort":8082,"Type":"tcp"}]}
+	]`
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(containers))
+	}))
+	defer docker.Close()
+
+	svc := newTestService(t, fileConfig{})
+	if err := svc.EnableDocker("tcp://" + strings.TrimPrefix(docker.URL, "http://")); err != nil {
+		t.Fatalf("EnableDocker: %v", err)
+	}
+	got, err := svc.docker.list(context.Background())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	want := []protocol.Route{
+		{Hostname: "web.test", Target: "127.0.0.1:8080"},
+		{Hostname: "api.test", Target: "127.0.0.1:8080"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("routes = %+v, want %+v", got, want)
+	}
+}
+
+func TestEnableDockerHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		wantBase string
+		wantErr  bool
+	}{
+		{host: "unix:///var/run/docker.sock", wantBase: "http://docker"},
+		{host: "tcp://127.0.0.1:2375", wantBase: "http://127.0.0.1:2375"},
+		{host: "ssh://user@host", wantErr: true},
+		{host: "://bad", wantErr: true},
+	}
+	for _, tt := range tests {
+		svc := newTestService(t, fileConfig{})
+		err := svc.EnableDocker(tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("EnableDocker(%q) accepted", tt.host)
+			}
+			continue
+		}
+		if err != nil || svc.docker.base != tt.wantBase {
+			t.Errorf("EnableDocker(%q): base %q, err %v", tt.host, svc.docker.base, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	drainPoll           = 100 * time.Millisecond
+)
+
+// SetDrainTimeout bounds how long shutdown waits for in-flight requests;
+// zero or less closes the connection right away.
+func (s *Service) SetDrainTimeout(d time.Duration) {
+	s.drainTimeout = d
+}
+
+func (s *Service) pendingRequests() int {
+	s.requestsMu.Lock()
+	defer s.requestsMu.Unlock()
+	return len(s.requests)
+}
+
+// drain runs on shutdown before the connection is closed: the server is
+// told to stop sending requests, and those already taken get up to
+// drainTimeout to finish and have their responses written.
+func (s *Service) drain(conn wsconn.Conn, writer *wsconn.Writer) {
+	s.draining.Store(true)
+	if s.drainTimeout <= 0 {
+		return
+	}
+	if s.serverDrain.Load() {
+		if err := s.writeEnvelope(protocol.Envelope{Type: protocol.TypeDraining}); err != nil {
+			slog.Warn("announce draining failed", "err", err)
+		}
+	}
+	deadline := time.Now().Add(s.drainTimeout)
+	if n := s.pendingRequests(); n > 0 {
+		slog.Info("draining in-flight requests", "requests", n, "timeout", s.drainTimeout)
+	}
+	for (s.pendingRequests() > 0 || writer.Depth() > 0) && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	if n := s.pendingRequests(); n > 0 {
+		slog.Warn("drain timed out, abandoning requests", "requests", n)
+	}
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "agent shutting down"), time.Now().Add(time.Second))
+}
+
+// refuse answers req with a 503 without forwarding it, e.g. when it reached
+// the agent after it started draining.
+func (s *Service) refuse(req protocol.Envelope, msg string) {
+	resp := localError(http.StatusServiceUnavailable, msg)
+	resp.Type = protocol.TypeProxyResponse
+	resp.RequestID = req.RequestID
+	if err := s.writeEnvelope(*resp); err != nil {
+		slog.Warn("write proxy response failed", "request_id", req.RequestID, "err", err)
+	}
+}
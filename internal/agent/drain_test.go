@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestDrainFinishesInFlightAndRefusesNew(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	target := strings.TrimPrefix(backend.URL, "http://")
+	svc := newTestService(t, fileConfig{})
+	svc.SetDrainTimeout(5 * time.Second)
+	conns := startFakeServer(t, svc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- svc.run(ctx) }()
+
+	conn := <-conns
+	sendEnvelope(t, conn, protocol.Envelope{Type: protocol.TypeProxyRequest, RequestID: "in-flight",
+		Method: http.MethodGet, Path: "/", Hostname: "app.test", Target: target})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the backend")
+	}
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for !svc.draining.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not start draining")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sendEnvelope(t, conn, protocol.Envelope{Type: protocol.TypeProxyRequest, RequestID: "late",
+		Method: http.MethodGet, Path: "/", Hostname: "app.test", Target: target})
+	if resp := readResponse(t, conn, "late"); resp.Status != http.StatusServiceUnavailable {
+		t.Fatalf("request during drain: status %d, want 503", resp.Status)
+	}
+
+	close(release)
+	resp := readResponse(t, conn, "in-flight")
+	if resp.Status != http.StatusOK || string(resp.Payload) != "done" {
+		t.Fatalf("in-flight response: status %d, body %q", resp.Status, resp.Payload)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after draining")
+	}
+}
+
+func TestDrainWithoutTimeoutClosesRightAway(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	svc.SetDrainTimeout(0)
+	conns := startFakeServer(t, svc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- svc.run(ctx) }()
+	<-conns
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	if !svc.draining.Load() {
+		t.Fatal("agent did not mark itself draining")
+	}
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	liveBuffer       = 256
+	liveWriteTimeout = 10 * time.Second
+	livePingInterval = 30 * time.Second
+)
+
+// TrafficEvent is one finished request as the admin UI's live view shows
+// it. Dropped counts the events this subscriber missed just before it
+// because it was reading too slowly.
+type TrafficEvent struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Replay     bool      `json:"replay,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Dropped    int       `json:"dropped,omitempty"`
+}
+
+// eventBus fans traffic events out to live subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses events instead of
+// slowing requests down.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	ch      chan TrafficEvent
+	dropped int
+}
+
+func (b *eventBus) subscribe() (<-chan TrafficEvent, func()) {
+	sub := &subscriber{ch: make(chan TrafficEvent, liveBuffer)}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscriber]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub.ch, func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) publish(ev TrafficEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		ev.Dropped = sub.dropped
+		select {
+		case sub.ch <- ev:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// record files a finished exchange with the inspector and tells live
+// viewers about it.
+func (s *Service) record(ex *Exchange) {
+	s.inspector.add(ex)
+	s.events.publish(TrafficEvent{
+		ID:         ex.ID,
+		Time:       ex.Time,
+		Hostname:   ex.Hostname,
+		Method:     ex.Method,
+		Path:       ex.Path,
+		Status:     ex.Status,
+		DurationMS: ex.DurationMS,
+		BytesIn:    ex.ReqBytes,
+		BytesOut:   ex.RespBytes,
+		Replay:     ex.Replay,
+		Error:      ex.Error,
+	})
+}
+
+// liveUpgrader keeps gorilla's default origin check, so only the admin UI's
+// own pages can open the live view.
+var liveUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// handleLive streams a TrafficEvent per finished request over a websocket
+// until the viewer goes away.
+func (s *Service) handleLive(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	events, cancel := s.events.subscribe()
+	defer cancel()
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-r.Context().Done():
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "agent shutting down"), time.Now().Add(time.Second))
+			return
+		case ev := <-events:
+			_ = conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteJSON(ev); err != nil {
+				slog.Debug("live view closed", "remote", r.RemoteAddr, "err", err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
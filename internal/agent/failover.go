@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	failbackInterval = 30 * time.Second
+	// failbackStreak is how many health checks in a row a preferred server
+	// must pass before the agent moves back to it.
+	failbackStreak     = 2
+	serverProbeTimeout = 5 * time.Second
+)
+
+// parseServerURLs splits a comma separated list of websocket server URLs,
+// most preferred first.
+func parseServerURLs(list string) ([]string, error) {
+	var servers []string
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server url: %w", err)
+		}
+		if parsed.Scheme != "ws" && parsed.Scheme != "wss" {
+			return nil, errors.New("server url must start with ws:// or wss://")
+		}
+		servers = append(servers, raw)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("server url is required")
+	}
+	return servers, nil
+}
+
+func (s *Service) serverState() ([]string, int) {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	return s.servers, s.serverIdx
+}
+
+// currentServer is the server the next connection goes to; empty until
+// the control plane has assigned one under -server auto.
+func (s *Service) currentServer() string {
+	servers, i := s.serverState()
+	if len(servers) == 0 {
+		return ""
+	}
+	return servers[i]
+}
+
+// useServer switches to servers[i] unless the list changed meanwhile.
+func (s *Service) useServer(servers []string, i int) bool {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	if len(s.servers) != len(servers) || len(servers) == 0 || &s.servers[0] != &servers[0] {
+		return false
+	}
+	s.serverIdx = i
+	return true
+}
+
+// failover moves to the most preferred other server that passes its health
+// check, or simply the next one when none does.
+func (s *Service) failover(ctx context.Context) {
+	servers, cur := s.serverState()
+	if len(servers) < 2 {
+		return
+	}
+	next := (cur + 1) % len(servers)
+	for i, server := range servers {
+		if i == cur {
+			continue
+		}
+		if err := s.probeServer(ctx, server); err == nil {
+			next = i
+			break
+		}
+	}
+	if s.useServer(servers, next) {
+		slog.Warn("failing over", "from", servers[cur], "server", servers[next])
+	}
+}
+
+// failbackLoop watches the servers preferred over the current one and
+// reconnects to the first that stays healthy, checking every interval.
+func (s *Service) failbackLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	candidate, streak := "", 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		servers, cur := s.serverState()
+		healthy := -1
+		for i := 0; i < cur; i++ {
+			if s.probeServer(ctx, servers[i]) == nil {
+				healthy = i
+				break
+			}
+		}
+		if healthy < 0 {
+			candidate, streak = "", 0
+			continue
+		}
+		if servers[healthy] != candidate {
+			candidate, streak = servers[healthy], 0
+		}
+		if streak++; streak < failbackStreak {
+			continue
+		}
+		candidate, streak = "", 0
+		if !s.useServer(servers, healthy) {
+			continue
+		}
+		slog.Info("preferred server is healthy again, moving back", "from", servers[cur], "server", servers[healthy])
+		if conn := s.getConn(); conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// probeServer GETs the /healthz next to the server's /connect path.
+func (s *Service) probeServer(ctx context.Context, server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = path.Join(path.Dir(u.Path), "healthz")
+	u.RawQuery = ""
+	ctx, cancel := context.WithTimeout(ctx, serverProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = s.proxy
+	transport.TLSClientConfig = s.serverTLS
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
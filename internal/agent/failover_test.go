@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func healthzServer(t *testing.T, ln net.Listener) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	if ln != nil {
+		srv.Listener.Close()
+		srv.Listener = ln
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect"
+}
+
+func TestFailoverSwitchesAndReturnsToPrimary(t *testing.T) {
+	primary := healthzServer(t, nil)
+	secondary := healthzServer(t, nil)
+	addr := primary.Listener.Addr().String()
+	servers := []string{wsURL(primary), wsURL(secondary)}
+
+	svc := newTestService(t, fileConfig{})
+	svc.serverMu.Lock()
+	svc.servers, svc.serverIdx = servers, 0
+	svc.serverMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary.Close()
+	svc.failover(ctx)
+	if got := svc.currentServer(); got != servers[1] {
+		t.Fatalf("after primary went away, server = %q, want %q", got, servers[1])
+	}
+
+	// Nothing preferred is healthy, so the loop must stay put.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		svc.failbackLoop(ctx, 10*time.Millisecond)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if got := svc.currentServer(); got != servers[1] {
+		t.Fatalf("failed back to a dead primary: %q", got)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot reopen primary address %s: %v", addr, err)
+	}
+	healthzServer(t, ln)
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.currentServer() != servers[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("did not return to the primary, server = %q", svc.currentServer())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestFailoverWithNoHealthyServerTakesTheNext(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	servers := []string{"ws://127.0.0.1:1/connect", "ws://127.0.0.1:2/connect", "ws://127.0.0.1:3/connect"}
+	svc.serverMu.Lock()
+	svc.servers, svc.serverIdx = servers, 1
+	svc.serverMu.Unlock()
+
+	svc.failover(context.Background())
+	if got := svc.currentServer(); got != servers[2] {
+		t.Fatalf("server = %q, want %q", got, servers[2])
+	}
+}
+
+func TestParseServerURLs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "ws://a/connect", want: 1},
+		{in: " wss://a/connect , ws://b/connect ,", want: 2},
+		{in: "", wantErr: true},
+		{in: "http://a/connect", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseServerURLs(tt.in)
+		if (err != nil) != tt.wantErr || len(got) != tt.want {
+			t.Errorf("parseServerURLs(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
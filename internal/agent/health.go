@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+const (
+	healthTick             = time.Second
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 2 * time.Second
+	defaultHealthThreshold = 3
+)
+
+// HealthCheck probes the local service of one route. A TCP check only
+// connects to the target; an HTTP check GETs Path and wants a status below
+// 400. The route turns unhealthy after Threshold failures in a row and
+// healthy again on the first success. With Report set the state is sent to
+// the tunnel server, which then answers public requests with a 503 page
+// instead of forwarding them.
+type HealthCheck struct {
+	Type      string `json:"type"`
+	Path      string `json:"path,omitempty"`
+	Interval  string `json:"interval,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
+	Report    bool   `json:"report,omitempty"`
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func normalizeHealthChecks(in map[string]HealthCheck) (map[string]HealthCheck, error) {
+	out := make(map[string]HealthCheck, len(in))
+	for hostname, check := range in {
+		host, err := NormalizeHostname(hostname)
+		if err != nil {
+			return nil, err
+		}
+		if check, err = check.normalize(); err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		out[host] = check
+	}
+	return out, nil
+}
+
+func (c HealthCheck) normalize() (HealthCheck, error) {
+	c.Type = strings.ToLower(strings.TrimSpace(c.Type))
+	c.Path = strings.TrimSpace(c.Path)
+	if c.Type == "" {
+		c.Type = "tcp"
+		if c.Path != "" {
+			c.Type = "http"
+		}
+	}
+	switch c.Type {
+	case "tcp":
+		c.Path = ""
+	case "http":
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			return c, errors.New("health check path must start with /")
+		}
+	default:
+		return c, fmt.Errorf("unknown health check type %q (want tcp or http)", c.Type)
+	}
+	var err error
+	if c.interval, err = parseHealthDuration(c.Interval, defaultHealthInterval); err != nil {
+		return c, fmt.Errorf("health check interval: %w", err)
+	}
+	if c.timeout, err = parseHealthDuration(c.Timeout, defaultHealthTimeout); err != nil {
+		return c, fmt.Errorf("health check timeout: %w", err)
+	}
+	if c.Threshold < 0 {
+		return c, errors.New("health check threshold cannot be negative")
+	}
+	if c.Threshold == 0 {
+		c.Threshold = defaultHealthThreshold
+	}
+	return c, nil
+}
+
+func parseHealthDuration(v string, def time.Duration) (time.Duration, error) {
+	if strings.TrimSpace(v) == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, errors.New("must be at least 1s")
+	}
+	return d, nil
+}
+
+// RouteHealth is the health check state of one route, as shown in
+// /api/status.
+type RouteHealth struct {
+	Hostname  string    `json:"hostname"`
+	Check     string    `json:"check"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Reported  bool      `json:"reported"`
+
+	running bool
+}
+
+// healthReport remembers what route_health last told a connection.
+type healthReport struct {
+	conn  wsconn.Conn
+	hosts []string
+}
+
+// healthLoop runs the configured checks until ctx is done, picking up
+// config changes on every tick.
+func (s *Service) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(healthTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.startDueChecks(ctx)
+		s.reportHealth()
+	}
+}
+
+func (s *Service) startDueChecks(ctx context.Context) {
+	checks := s.store.HealthChecks()
+	routes := make(map[string]protocol.Route)
+	for _, route := range s.store.List() {
+		if _, ok := checks[route.Hostname]; ok {
+			routes[route.Hostname] = route
+		}
+	}
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	for host := range s.health {
+		if _, ok := routes[host]; !ok {
+			delete(s.health, host)
+		}
+	}
+	if s.health == nil {
+		s.health = make(map[string]*RouteHealth)
+	}
+	for host, route := range routes {
+		check := checks[host]
+		st := s.health[host]
+		if st == nil {
+			st = &RouteHealth{Hostname: host, Healthy: true}
+			s.health[host] = st
+		}
+		st.Check, st.Reported = strings.TrimSpace(check.Type+" "+check.Path), check.Report
+		if st.running || time.Since(st.LastCheck) < check.interval {
+			continue
+		}
+		st.running = true
+		go s.runHealthCheck(ctx, route, check)
+	}
+}
+
+func (s *Service) runHealthCheck(ctx context.Context, route protocol.Route, check HealthCheck) {
+	err := s.probe(ctx, route, check)
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	st := s.health[route.Hostname]
+	if st == nil {
+		return
+	}
+	st.running = false
+	st.LastCheck = time.Now()
+	if err == nil {
+		if !st.Healthy {
+			slog.Info("health check recovered", "hostname", route.Hostname)
+		}
+		st.Healthy, st.Failures, st.LastError = true, 0, ""
+		return
+	}
+	st.Failures++
+	st.LastError = err.Error()
+	if st.Healthy && st.Failures >= check.Threshold {
+		slog.Warn("health check failing, marking unhealthy", "hostname", route.Hostname, "failures", st.Failures, "err", err)
+		st.Healthy = false
+	}
+}
+
+// probe runs one check against the route's target.
+func (s *Service) probe(ctx context.Context, route protocol.Route, check HealthCheck) error {
+	target, err := protocol.ParseTarget(route.Target)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	if check.Type == "tcp" {
+		network := "tcp"
+		if target.Scheme == "unix" {
+			network = "unix"
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, target.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	checkURL := target.Scheme + "://" + target.Addr + check.Path
+	if target.Scheme == "unix" {
+		checkURL = "http://" + route.Hostname + check.Path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = route.Hostname
+	resp, err := s.clientFor(target.Scheme, target.Addr).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RouteHealth lists the health state of every route with a check.
+func (s *Service) RouteHealth() []RouteHealth {
+	s.healthMu.Lock()
+	out := make([]RouteHealth, 0, len(s.health))
+	for _, st := range s.health {
+		out = append(out, *st)
+	}
+	s.healthMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+// reportHealth sends the unhealthy reported hostnames to the server when
+// they changed since the last report on this connection. Servers without
+// the health capability are never told.
+func (s *Service) reportHealth() {
+	conn := s.getConn()
+	if conn == nil || !s.serverHealth.Load() {
+		return
+	}
+	var hosts []string
+	for _, st := range s.RouteHealth() {
+		if st.Reported && !st.Healthy {
+			hosts = append(hosts, st.Hostname)
+		}
+	}
+
+	s.healthReportMu.Lock()
+	defer s.healthReportMu.Unlock()
+	if s.healthReport.conn == conn && slices.Equal(s.healthReport.hosts, hosts) {
+		return
+	}
+	// A fresh session starts out with every route healthy.
+	if s.healthReport.conn != conn && len(hosts) == 0 {
+		s.healthReport = healthReport{conn: conn}
+		return
+	}
+	if err := s.writeEnvelope(protocol.Envelope{Type: protocol.TypeRouteHealth, UnhealthyHosts: hosts}); err != nil {
+		slog.Warn("report route health failed", "err", err)
+		return
+	}
+	s.healthReport = healthReport{conn: conn, hosts: hosts}
+}
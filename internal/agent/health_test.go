@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"tunneling/internal/protocol"
+)
+
+func TestHealthCheckMarksUnhealthyAndRecovers(t *testing.T) {
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "app.test" {
+			t.Errorf("probe went to %s %s", r.Host, r.URL.Path)
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	svc := newTestService(t, fileConfig{
+		Routes:       []protocol.Route{{Hostname: "app.test", Target: backend.URL}},
+		HealthChecks: map[string]HealthCheck{"app.test": {Path: "/healthz", Threshold: 2, Report: true}},
+	})
+	route := svc.store.List()[0]
+	check := svc.store.HealthChecks()["app.test"]
+	if check.Type != "http" {
+		t.Fatalf("check type = %q, want http", check.Type)
+	}
+	svc.health = map[string]*RouteHealth{"app.test": {Hostname: "app.test", Healthy: true}}
+	ctx := context.Background()
+	state := func() RouteHealth {
+		t.Helper()
+		health := svc.RouteHealth()
+		if len(health) != 1 {
+			t.Fatalf("health = %+v", health)
+		}
+		return health[0]
+	}
+
+	svc.runHealthCheck(ctx, route, check)
+	if st := state(); !st.Healthy || st.Failures != 0 || st.LastCheck.IsZero() {
+		t.Fatalf("after a passing probe: %+v", st)
+	}
+
+	failing.Store(true)
+	svc.runHealthCheck(ctx, route, check)
+	if st := state(); !st.Healthy || st.Failures != 1 || !strings.Contains(st.LastError, "500") {
+		t.Fatalf("one failure under the threshold: %+v", st)
+	}
+	svc.runHealthCheck(ctx, route, check)
+	if st := state(); st.Healthy || st.Failures != 2 {
+		t.Fatalf("failures at the threshold: %+v", st)
+	}
+
+	failing.Store(false)
+	svc.runHealthCheck(ctx, route, check)
+	if st := state(); !st.Healthy || st.Failures != 0 || st.LastError != "" {
+		t.Fatalf("after recovering: %+v", st)
+	}
+}
+
+func TestHealthCheckTCPFailsOnClosedPort(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+
+	svc := newTestService(t, fileConfig{
+		Routes:       []protocol.Route{{Hostname: "db.test", Target: addr}},
+		HealthChecks: map[string]HealthCheck{"db.test": {Type: "tcp", Threshold: 1}},
+	})
+	route := svc.store.List()[0]
+	check := svc.store.HealthChecks()["db.test"]
+	svc.health = map[string]*RouteHealth{"db.test": {Hostname: "db.test", Healthy: true}}
+
+	svc.runHealthCheck(context.Background(), route, check)
+	if st := svc.RouteHealth()[0]; st.Healthy || st.LastError == "" {
+		t.Fatalf("closed port: %+v", st)
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const heartbeatInterval = 30 * time.Second
+
+// heartbeatLoop tells the control API whether this agent currently holds a
+// tunnel server connection: every heartbeatInterval, right after the
+// connection state changes, and once more on shutdown.
+func (s *Service) heartbeatLoop(ctx context.Context) {
+	endpoint, err := heartbeatURL(s.routeSyncURL)
+	if err != nil {
+		slog.Warn("heartbeat disabled", "err", err)
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	failing := false
+	beat := func(ctx context.Context) {
+		err := s.sendHeartbeat(ctx, endpoint)
+		if err != nil && !failing {
+			slog.Warn("heartbeat failed", "err", err)
+		} else if err == nil && failing {
+			slog.Info("heartbeat recovered")
+		}
+		failing = err != nil
+	}
+
+	beat(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			// Say goodbye so the tunnel shows offline immediately instead of
+			// after the online TTL.
+			byeCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			s.setConnected(false)
+			beat(byeCtx)
+			cancel()
+			return
+		case <-s.heartbeatNow:
+			beat(ctx)
+		case <-ticker.C:
+			beat(ctx)
+		}
+	}
+}
+
+func (s *Service) sendHeartbeat(ctx context.Context, endpoint string) error {
+	sessionID, _ := s.getSession()
+	connected := s.GetStatus().Connected
+	beat := map[string]any{
+		"tunnel_id":  s.tunnelID,
+		"token":      s.tunnelToken,
+		"connected":  connected,
+		"session_id": sessionID,
+	}
+	if connected {
+		beat["server"] = s.currentServer()
+	}
+	body, err := json.Marshal(beat)
+	if err != nil {
+		return err
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// heartbeatURL puts the heartbeat endpoint next to the route sync endpoint:
+// .../agent/routes becomes .../agent/heartbeat, both on the control API and
+// behind the tunnel server's route sync proxy.
+func heartbeatURL(routeSyncURL string) (string, error) {
+	return siblingURL(routeSyncURL, "heartbeat")
+}
+
+func siblingURL(routeSyncURL, name string) (string, error) {
+	u, err := url.Parse(routeSyncURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(strings.TrimRight(u.Path, "/")), name)
+	u.RawQuery = ""
+	return u.String(), nil
+}
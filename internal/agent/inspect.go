@@ -0,0 +1,379 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	inspectCapacity = 100
+	// inspectBodyLimit caps how much of each body is kept; replay needs the
+	// full request body, so truncated requests cannot be replayed.
+	inspectBodyLimit = 16 << 10
+)
+
+// Exchange is one proxied request as shown by the inspector.
+type Exchange struct {
+	ID         uint64              `json:"id"`
+	Time       time.Time           `json:"time"`
+	DurationMS float64             `json:"duration_ms"`
+	Replay     bool                `json:"replay,omitempty"`
+	Hostname   string              `json:"hostname"`
+	Target     string              `json:"target"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      string              `json:"query,omitempty"`
+	ReqHeaders map[string][]string `json:"request_headers"`
+	ReqBody    string              `json:"request_body"`
+	ReqCut     bool                `json:"request_body_truncated,omitempty"`
+	ReqBytes   int64               `json:"request_bytes"`
+	Status     int                 `json:"status"`
+	RespHeader map[string][]string `json:"response_headers,omitempty"`
+	RespBody   string              `json:"response_body"`
+	RespCut    bool                `json:"response_body_truncated,omitempty"`
+	RespBytes  int64               `json:"response_bytes"`
+	Error      string              `json:"error,omitempty"`
+
+	reqBuf  capBuffer
+	respBuf capBuffer
+	timing  localTiming
+}
+
+// capBuffer keeps the first inspectBodyLimit bytes written to it and counts
+// all of them. A request
+// body may still be read by the transport after the response is in, hence
+// the lock.
+type capBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	cut bool
+	n   int64
+}
+
+func (b *capBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.n += int64(len(p))
+	if room := inspectBodyLimit - b.buf.Len(); room < len(p) {
+		b.cut = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+func (b *capBuffer) take() (string, bool, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, cut := b.buf.String(), b.cut
+	b.buf = bytes.Buffer{}
+	return s, cut, b.n
+}
+
+// inspector is a ring buffer of the most recent exchanges.
+type inspector struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries []*Exchange
+}
+
+func (in *inspector) begin(req protocol.Envelope) *Exchange {
+	ex := &Exchange{
+		Time:       time.Now(),
+		Hostname:   req.Hostname,
+		Target:     req.Target,
+		Method:     req.Method,
+		Path:       req.Path,
+		Query:      req.Query,
+		ReqHeaders: protocol.CloneHeaders(req.Headers),
+	}
+	if !req.Stream {
+		_, _ = ex.reqBuf.Write(req.Payload)
+	}
+	return ex
+}
+
+// captureRequest tees a streamed request body into the exchange.
+func (ex *Exchange) captureRequest(body io.Reader) io.Reader {
+	return io.TeeReader(body, &ex.reqBuf)
+}
+
+// captureResponse records a streamed response; body is the reader to send
+// instead of the original.
+func (ex *Exchange) captureResponse(status int, headers map[string][]string, body io.Reader) io.Reader {
+	ex.Status = status
+	ex.RespHeader = protocol.CloneHeaders(headers)
+	return io.TeeReader(body, &ex.respBuf)
+}
+
+func (ex *Exchange) setResponse(resp *protocol.Envelope) {
+	ex.Status = resp.Status
+	ex.RespHeader = protocol.CloneHeaders(resp.Headers)
+	_, _ = ex.respBuf.Write(resp.Payload)
+}
+
+func (in *inspector) add(ex *Exchange) {
+	ex.DurationMS = float64(time.Since(ex.Time).Microseconds()) / 1000
+	ex.ReqBody, ex.ReqCut, ex.ReqBytes = ex.reqBuf.take()
+	ex.RespBody, ex.RespCut, ex.RespBytes = ex.respBuf.take()
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.seq++
+	ex.ID = in.seq
+	if len(in.entries) == inspectCapacity {
+		copy(in.entries, in.entries[1:])
+		in.entries = in.entries[:inspectCapacity-1]
+	}
+	in.entries = append(in.entries, ex)
+}
+
+// list returns the captured exchanges, newest first.
+func (in *inspector) list() []*Exchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]*Exchange, 0, len(in.entries))
+	for i := len(in.entries) - 1; i >= 0; i-- {
+		out = append(out, in.entries[i])
+	}
+	return out
+}
+
+func (in *inspector) get(id uint64) (*Exchange, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, ex := range in.entries {
+		if ex.ID == id {
+			return ex, true
+		}
+	}
+	return nil, false
+}
+
+// replay sends a captured request to its local target again and records the
+// result as a new exchange.
+func (s *Service) replay(ctx context.Context, original *Exchange) *Exchange {
+	req := protocol.Envelope{
+		Method:   original.Method,
+		Path:     original.Path,
+		Query:    original.Query,
+		Headers:  protocol.CloneHeaders(original.ReqHeaders),
+		Hostname: original.Hostname,
+		Target:   original.Target,
+		Payload:  []byte(original.ReqBody),
+	}
+	ex := s.inspector.begin(req)
+	ex.Replay = true
+	resp := s.forwardToLocal(ctx, req, nil, ex)
+	ex.setResponse(resp)
+	s.record(ex)
+	return ex
+}
+
+func (s *Service) handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"exchanges": s.inspector.list()})
+}
+
+// handleInspectReplay serves POST /api/inspect/{id}/replay.
+func (s *Service) handleInspectReplay(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/inspect/")
+	rawID, action, _ := strings.Cut(rest, "/")
+	if action != "replay" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid exchange id")
+		return
+	}
+	original, ok := s.inspector.get(id)
+	if !ok {
+		errorJSON(w, http.StatusNotFound, "exchange not found")
+		return
+	}
+	if original.ReqCut {
+		errorJSON(w, http.StatusConflict, "request body was truncated and cannot be replayed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+	writeJSON(w, http.StatusOK, map[string]any{"exchange": s.replay(ctx, original)})
+}
+
+func (s *Service) handleInspectPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(inspectHTML))
+}
+
+const inspectHTML = `<!doctype html>
+<html lang="zh-CN">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width, initial-scale=1" />
+  <title>Tunnel Agent · Inspect</title>
+  <style>
+    :root {
+      --bg: #f4f7fb;
+      --card: #ffffff;
+      --text: #0f172a;
+      --muted: #475569;
+      --line: #dbe2ea;
+      --brand: #0b5fff;
+      --brand2: #0a49c9;
+      --danger: #d94848;
+      --ok: #0f9d58;
+    }
+    * { box-sizing: border-box; }
+    body {
+      margin: 0;
+      font-family: "PingFang SC", "Noto Sans SC", "Microsoft YaHei", sans-serif;
+      background: radial-gradient(circle at top right, #e8f0ff, var(--bg) 45%);
+      color: var(--text);
+      min-height: 100vh;
+      padding: 28px;
+    }
+    .wrap { max-width: 1180px; margin: 0 auto; }
+    .card {
+      background: var(--card);
+      border: 1px solid var(--line);
+      border-radius: 14px;
+      padding: 20px;
+      box-shadow: 0 10px 28px rgba(8, 36, 90, 0.08);
+    }
+    h1 { margin: 0 0 6px; font-size: 28px; }
+    .sub { color: var(--muted); margin: 0 0 18px; }
+    a { color: var(--brand); }
+    .layout { display: grid; grid-template-columns: 420px 1fr; gap: 16px; }
+    .list { border: 1px solid var(--line); border-radius: 10px; overflow: auto; max-height: 70vh; }
+    .item { padding: 10px 12px; border-bottom: 1px solid var(--line); cursor: pointer; font-size: 13px; }
+    .item:hover, .item.active { background: #f1f5ff; }
+    .item .meta { color: var(--muted); font-size: 12px; margin-top: 2px; }
+    .s2 { color: var(--ok); font-weight: 600; }
+    .s4, .s5 { color: var(--danger); font-weight: 600; }
+    .detail { border: 1px solid var(--line); border-radius: 10px; padding: 14px; min-height: 200px; overflow: auto; max-height: 70vh; }
+    pre { background: #f8fafc; border: 1px solid var(--line); border-radius: 8px; padding: 10px; white-space: pre-wrap; word-break: break-all; font-size: 12px; }
+    button {
+      border: none;
+      border-radius: 10px;
+      padding: 8px 14px;
+      color: #fff;
+      background: linear-gradient(135deg, var(--brand), var(--brand2));
+      cursor: pointer;
+      font-weight: 600;
+    }
+    button:disabled { opacity: 0.6; cursor: not-allowed; }
+    .hint { color: var(--muted); font-size: 13px; margin-top: 10px; min-height: 20px; }
+  </style>
+</head>
+<body>
+  <div class="wrap">
+    <div class="card">
+      <h1>请求检查</h1>
+      <p class="sub">最近 100 个经过隧道的请求（请求体和响应体各保留前 16KB）。<a href="./">返回映射配置</a></p>
+      <div class="layout">
+        <div id="list" class="list"></div>
+        <div id="detail" class="detail"><span class="sub">选择左侧的请求查看详情</span></div>
+      </div>
+      <div id="hint" class="hint"></div>
+    </div>
+  </div>
+
+<script>
+  const list = document.getElementById('list');
+  const detail = document.getElementById('detail');
+  const hint = document.getElementById('hint');
+  let selected = null;
+
+  function esc(s) {
+    return String(s == null ? '' : s).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+  }
+
+  function headersText(h) {
+    return Object.keys(h || {}).sort().map(k => h[k].map(v => k + ': ' + v).join('\n')).join('\n');
+  }
+
+  function statusClass(code) {
+    return 's' + String(code || 0).charAt(0);
+  }
+
+  function showDetail(ex) {
+    selected = ex.id;
+    const url = ex.path + (ex.query ? '?' + ex.query : '');
+    detail.innerHTML =
+      '<div style="display:flex;justify-content:space-between;align-items:center">' +
+      '<strong>' + esc(ex.method) + ' ' + esc(ex.hostname) + esc(url) + '</strong>' +
+      '<button id="replayBtn"' + (ex.request_body_truncated ? ' disabled title="请求体过大，无法重放"' : '') + '>重放</button></div>' +
+      '<p class="sub">' + new Date(ex.time).toLocaleString() + ' · ' + esc(ex.target) + ' · ' + ex.duration_ms + 'ms' +
+      (ex.replay ? ' · 重放' : '') + (ex.error ? ' · ' + esc(ex.error) : '') + '</p>' +
+      '<h3>请求</h3><pre>' + esc(headersText(ex.request_headers)) + '</pre>' +
+      (ex.request_body ? '<pre>' + esc(ex.request_body) + (ex.request_body_truncated ? '\n…(已截断)' : '') + '</pre>' : '') +
+      '<h3>响应 <span class="' + statusClass(ex.status) + '">' + ex.status + '</span></h3><pre>' + esc(headersText(ex.response_headers)) + '</pre>' +
+      (ex.response_body ? '<pre>' + esc(ex.response_body) + (ex.response_body_truncated ? '\n…(已截断)' : '') + '</pre>' : '');
+    document.getElementById('replayBtn').addEventListener('click', async () => {
+      try {
+        const m = document.cookie.match(/(?:^|; )agent_admin_csrf=([^;]*)/);
+        const resp = await fetch('api/inspect/' + ex.id + '/replay', { method: 'POST', headers: { 'X-CSRF-Token': m ? m[1] : '' } });
+        const data = await resp.json();
+        if (!resp.ok) throw new Error(data.error || ('HTTP ' + resp.status));
+        hint.textContent = '重放完成，状态码 ' + data.exchange.status;
+        await load();
+        showDetail(data.exchange);
+      } catch (e) {
+        hint.textContent = e.message;
+      }
+    });
+  }
+
+  async function load() {
+    try {
+      const resp = await fetch('api/inspect');
+      if (resp.status === 401) {
+        location.href = '/login?next=' + encodeURIComponent(location.pathname);
+        return;
+      }
+      const data = await resp.json();
+      list.innerHTML = '';
+      const items = data.exchanges || [];
+      if (items.length === 0) {
+        list.innerHTML = '<div class="item sub">暂无请求</div>';
+        return;
+      }
+      for (const ex of items) {
+        const div = document.createElement('div');
+        div.className = 'item' + (ex.id === selected ? ' active' : '');
+        div.innerHTML = '<span class="' + statusClass(ex.status) + '">' + ex.status + '</span> ' +
+          esc(ex.method) + ' ' + esc(ex.path) +
+          '<div class="meta">' + esc(ex.hostname) + ' · ' + ex.duration_ms + 'ms' + (ex.replay ? ' · 重放' : '') + '</div>';
+        div.addEventListener('click', () => { showDetail(ex); load(); });
+        list.appendChild(div);
+      }
+    } catch (e) {
+      hint.textContent = e.message;
+    }
+  }
+
+  load();
+  setInterval(load, 3000);
+</script>
+</body>
+</html>`
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	"tunneling/internal/protocol"
+)
+
+// interimRelay passes the local service's 1xx responses to the server. The
+// server holds back an Expect: 100-continue body until it hears 100 Continue,
+// so one is made up as soon as the local request starts reading the body,
+// which also covers services that never send 100 themselves.
+type interimRelay struct {
+	s         *Service
+	requestID string
+	continued sync.Once
+}
+
+func (s *Service) newInterimRelay(req protocol.Envelope) *interimRelay {
+	if !s.serverInterim.Load() {
+		return nil
+	}
+	return &interimRelay{s: s, requestID: req.RequestID}
+}
+
+func (r *interimRelay) send(status int, headers map[string][]string) {
+	env := protocol.Envelope{Type: protocol.TypeProxyInterim, RequestID: r.requestID, Status: status, Headers: headers}
+	if err := r.s.writeEnvelope(env); err != nil {
+		slog.Warn("write interim response failed", "request_id", r.requestID, "err", err)
+	}
+}
+
+func (r *interimRelay) sendContinue() {
+	r.continued.Do(func() { r.send(http.StatusContinue, nil) })
+}
+
+// trace hooks the relay into the local request.
+func (r *interimRelay) trace(ctx context.Context) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			switch code {
+			case http.StatusSwitchingProtocols:
+			case http.StatusContinue:
+				r.sendContinue()
+			default:
+				headers := protocol.CloneHeaders(header)
+				stripHopHeaders(headers)
+				r.send(code, headers)
+			}
+			return nil
+		},
+	})
+}
+
+// body asks the server for a streamed request body before its first read.
+func (r *interimRelay) body(body io.Reader) io.Reader {
+	if r == nil {
+		return body
+	}
+	return &continueReader{Reader: body, relay: r}
+}
+
+type continueReader struct {
+	io.Reader
+	relay *interimRelay
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	c.relay.sendContinue()
+	return c.Reader.Read(p)
+}
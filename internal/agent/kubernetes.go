@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tunneling/internal/protocol"
+)
+
+// Annotations read by Kubernetes discovery. On a Service,
+// tunneling.io/hostname (a comma list) exposes it; tunneling.io/port names
+// or numbers the service port and may be left out when there is only one.
+// An Ingress is served when its class is kubernetesIngressClass.
+// tunneling.io/scheme is http (default) or https on either.
+const (
+	kubeAnnotationHostname = "tunneling.io/hostname"
+	kubeAnnotationPort     = "tunneling.io/port"
+	kubeAnnotationScheme   = "tunneling.io/scheme"
+	kubernetesIngressClass = "tunneling"
+
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kubeDiscovery turns annotated Services and Ingresses of class
+// "tunneling" into routes to their cluster addresses, following the API
+// server's watch streams to keep them current.
+type kubeDiscovery struct {
+	routeSource
+	client *http.Client
+	base   string
+	// tokenFile is re-read on every request: kubelet rotates it.
+	tokenFile string
+	namespace string
+}
+
+// EnableKubernetes makes the agent publish routes for the Services and
+// Ingresses it finds in the cluster. apiURL empty uses the in-cluster
+// service account; otherwise it is an unauthenticated endpoint such as
+// `kubectl proxy` (http://127.0.0.1:8001). namespace "*" watches all
+// namespaces; empty means the agent's own namespace inside the cluster and
+// all of them outside.
+func (s *Service) EnableKubernetes(apiURL, namespace string) error {
+	k := &kubeDiscovery{routeSource: routeSource{name: "kubernetes"}, namespace: namespace}
+	if namespace == "*" {
+		k.namespace = ""
+	}
+	if apiURL != "" {
+		u, err := url.Parse(apiURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid kubernetes api url %q", apiURL)
+		}
+		k.base = strings.TrimRight(apiURL, "/")
+		k.client = &http.Client{}
+		s.kube = k
+		return nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return errors.New("not running inside a kubernetes cluster; set the api url (e.g. kubectl proxy)")
+	}
+	ca, err := os.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return fmt.Errorf("read service account ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.New("service account ca.crt holds no certificates")
+	}
+	k.base = "https://" + net.JoinHostPort(host, port)
+	k.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}}
+	k.tokenFile = kubeServiceAccountDir + "/token"
+	if namespace == "" {
+		// Without a ClusterRole the service account can only see its own
+		// namespace; watching it is the safer default.
+		if ns, err := os.ReadFile(kubeServiceAccountDir + "/namespace"); err == nil {
+			k.namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	s.kube = k
+	return nil
+}
+
+func (k *kubeDiscovery) path(group, resource string) string {
+	if k.namespace == "" {
+		return group + "/" + resource
+	}
+	return group + "/namespaces/" + url.PathEscape(k.namespace) + "/" + resource
+}
+
+func (k *kubeDiscovery) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list fetches a collection into items and returns its resourceVersion.
+func (k *kubeDiscovery) list(ctx context.Context, path string, items any) (string, error) {
+	resp, err := k.get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var payload struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("decode %s: %w", path, err)
+	}
+	if len(payload.Items) > 0 && string(payload.Items) != "null" {
+		if err := json.Unmarshal(payload.Items, items); err != nil {
+			return "", fmt.Errorf("decode %s: %w", path, err)
+		}
+	}
+	return payload.Metadata.ResourceVersion, nil
+}
+
+// watchKube lists Services and Ingresses, then watches both and lists
+// again after every burst of changes, until a watch stream fails.
+func (s *Service) watchKube(ctx context.Context) error {
+	k := s.kube
+	servicesPath := k.path("/api/v1", "services")
+	ingressesPath := k.path("/apis/networking.k8s.io/v1", "ingresses")
+
+	var versions [2]string
+	load := func() error {
+		var services []kubeService
+		var ingresses []kubeIngress
+		var err error
+		if versions[0], err = k.list(ctx, servicesPath, &services); err != nil {
+			return err
+		}
+		if versions[1], err = k.list(ctx, ingressesPath, &ingresses); err != nil {
+			return err
+		}
+		s.setDiscovered(&k.routeSource, kubeRoutes(services, ingresses))
+		return nil
+	}
+	if err := load(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := make(chan struct{}, 1)
+	errc := make(chan error, 2)
+	for i, path := range []string{servicesPath, ingressesPath} {
+		resp, err := k.get(ctx, path+"?watch=1&resourceVersion="+url.QueryEscape(versions[i]))
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer resp.Body.Close()
+			errc <- readKubeWatch(resp.Body, events)
+		}()
+	}
+	return debounce(ctx, events, errc, func() {
+		if err := load(); err != nil {
+			slog.Warn("list kubernetes services failed", "err", err)
+		}
+	})
+}
+
+// readKubeWatch signals events for every change on a watch stream. It
+// returns nil when the API server ends the stream, which it does every
+// so often, so the caller starts over.
+func readKubeWatch(body io.Reader, events chan<- struct{}) error {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var ev struct {
+			Type   string `json:"type"`
+			Object struct {
+				Message string `json:"message"`
+			} `json:"object"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return fmt.Errorf("decode kubernetes watch event: %w", err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			notify(events)
+		case "ERROR":
+			return fmt.Errorf("kubernetes watch: %s", ev.Object.Message)
+		}
+	}
+	return sc.Err()
+}
+
+type kubeMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (m kubeMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Type         string `json:"type"`
+		ClusterIP    string `json:"clusterIP"`
+		ExternalName string `json:"externalName"`
+		Ports        []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeIngress struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName string `json:"ingressClassName"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path    string `json:"path"`
+					Backend struct {
+						Service *struct {
+							Name string `json:"name"`
+							Port struct {
+								Name   string `json:"name"`
+								Number int    `json:"number"`
+							} `json:"port"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// kubeRoutes builds the routes for annotated Services first, then for
+// Ingresses; the first object to claim a hostname keeps it.
+func kubeRoutes(services []kubeService, ingresses []kubeIngress) []protocol.Route {
+	sort.Slice(services, func(i, j int) bool { return services[i].Metadata.key() < services[j].Metadata.key() })
+	sort.Slice(ingresses, func(i, j int) bool { return ingresses[i].Metadata.key() < ingresses[j].Metadata.key() })
+	byKey := make(map[string]kubeService, len(services))
+	for _, svc := range services {
+		byKey[svc.Metadata.key()] = svc
+	}
+
+	seen := make(map[string]string)
+	var routes []protocol.Route
+	add := func(owner, raw, target string) {
+		host, err := NormalizeHostname(raw)
+		if err != nil {
+			slog.Warn("kubernetes hostname skipped", "object", owner, "hostname", raw, "err", err)
+			return
+		}
+		if prev, dup := seen[host]; dup {
+			slog.Warn("hostname claimed twice in kubernetes", "hostname", host, "object", owner, "kept", prev)
+			return
+		}
+		seen[host] = owner
+		routes = append(routes, protocol.Route{Hostname: host, Target: target})
+	}
+
+	for _, svc := range services {
+		hosts := svc.Metadata.Annotations[kubeAnnotationHostname]
+		if hosts == "" {
+			continue
+		}
+		owner := "service/" + svc.Metadata.key()
+		target, err := svc.target(svc.Metadata.Annotations[kubeAnnotationPort], 0, svc.Metadata.Annotations[kubeAnnotationScheme])
+		if err != nil {
+			slog.Warn("kubernetes service skipped", "object", owner, "err", err)
+			continue
+		}
+		for _, raw := range strings.Split(hosts, ",") {
+			add(owner, raw, target)
+		}
+	}
+
+	for _, ing := range ingresses {
+		if ing.class() != kubernetesIngressClass {
+			continue
+		}
+		owner := "ingress/" + ing.Metadata.key()
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || rule.HTTP == nil || len(rule.HTTP.Paths) == 0 {
+				slog.Warn("kubernetes ingress rule skipped: it needs a host and a path", "object", owner)
+				continue
+			}
+			// Routes are per hostname, so one backend serves the whole host:
+			// the one for "/", else the first.
+			path := rule.HTTP.Paths[0]
+			for _, p := range rule.HTTP.Paths {
+				if p.Path == "/" || p.Path == "" {
+					path = p
+					break
+				}
+			}
+			if len(rule.HTTP.Paths) > 1 {
+				slog.Warn("kubernetes ingress has several paths for one host; only one backend is used", "object", owner, "hostname", rule.Host, "path", path.Path)
+			}
+			backend := path.Backend.Service
+			if backend == nil {
+				slog.Warn("kubernetes ingress rule skipped: only service backends are supported", "object", owner, "hostname", rule.Host)
+				continue
+			}
+			svc, ok := byKey[ing.Metadata.Namespace+"/"+backend.Name]
+			if !ok {
+				slog.Warn("kubernetes ingress rule skipped: backend service not found", "object", owner, "service", backend.Name)
+				continue
+			}
+			target, err := svc.target(backend.Port.Name, backend.Port.Number, ing.Metadata.Annotations[kubeAnnotationScheme])
+			if err != nil {
+				slog.Warn("kubernetes ingress rule skipped", "object", owner, "hostname", rule.Host, "err", err)
+				continue
+			}
+			add(owner, rule.Host, target)
+		}
+	}
+	return routes
+}
+
+func (ing kubeIngress) class() string {
+	if ing.Spec.IngressClassName != "" {
+		return ing.Spec.IngressClassName
+	}
+	return ing.Metadata.Annotations["kubernetes.io/ingress.class"]
+}
+
+// target is the in-cluster address of the service port called portName
+// (a name or a number) or numbered port; both empty picks the only port.
+func (svc kubeService) target(portName string, port int, scheme string) (string, error) {
+	portName = strings.TrimSpace(portName)
+	if n, err := strconv.Atoi(portName); err == nil {
+		port, portName = n, ""
+	}
+	if port == 0 {
+		switch {
+		case portName != "":
+			for _, p := range svc.Spec.Ports {
+				if p.Name == portName {
+					port = p.Port
+				}
+			}
+			if port == 0 {
+				return "", fmt.Errorf("service has no port named %q", portName)
+			}
+		case len(svc.Spec.Ports) == 1:
+			port = svc.Spec.Ports[0].Port
+		default:
+			return "", fmt.Errorf("set the %s annotation: the service has %d ports", kubeAnnotationPort, len(svc.Spec.Ports))
+		}
+	}
+	if port <= 0 || port > 65535 {
+		return "", fmt.Errorf("invalid port %d", port)
+	}
+
+	host := svc.Spec.ClusterIP
+	switch {
+	case svc.Spec.Type == "ExternalName":
+		host = svc.Spec.ExternalName
+	case host == "" || host == "None":
+		// Headless: let cluster DNS pick a pod.
+		host = svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc"
+	}
+	return withScheme(net.JoinHostPort(host, strconv.Itoa(port)), scheme)
+}
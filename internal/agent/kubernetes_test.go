@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tunneling/internal/protocol"
+)
+
+func decodeKube[T any](t *testing.T, raw string) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	return v
+}
+
+func TestKubeServiceTarget(t *testing.T) {
+	const twoPorts = `{"metadata":{"name":"web","namespace":"prod"},"spec":{"clusterIP":"10.0.0.7","ports":[{"name":"http","port":80},{"name":"metrics","port":9090}]}}`
+	tests := []struct {
+		name     string
+		raw      string
+		portName string
+		port     int
+		scheme   string
+		want     string
+		wantErr  string
+	}{
+		{name: "only port", raw: `{"spec":{"clusterIP":"10.0.0.7","ports":[{"port":8080}]}}`, want: "10.0.0.7:8080"},
+		{name: "port by name", raw: twoPorts, portName: "metrics", want: "10.0.0.7:9090"},
+		{name: "port by number annotation", raw: twoPorts, portName: " 80 ", want: "10.0.0.7:80"},
+		{name: "ingress port number", raw: twoPorts, port: 9090, want: "10.0.0.7:9090"},
+		{name: "https scheme", raw: twoPorts, portName: "http", scheme: "https", want: "https://10.0.0.7:80"},
+		{name: "headless", raw: `{"metadata":{"name":"db","namespace":"prod"},"spec":{"clusterIP":"None","ports":[{"port":5432}]}}`, want: "db.prod.svc:5432"},
+		{name: "external name", raw: `{"spec":{"type":"ExternalName","externalName":"api.example.com","ports":[{"port":443}]}}`, want: "api.example.com:443"},
+		{name: "several ports without annotation", raw: twoPorts, wantErr: "the service has 2 ports"},
+		{name: "no ports", raw: `{"spec":{"clusterIP":"10.0.0.7"}}`, wantErr: "the service has 0 ports"},
+		{name: "unknown port name", raw: twoPorts, portName: "grpc", wantErr: `no port named "grpc"`},
+		{name: "port out of range", raw: twoPorts, portName: "70000", wantErr: "invalid port 70000"},
+		{name: "bad scheme", raw: twoPorts, portName: "http", scheme: "gopher", wantErr: "invalid scheme"},
+	}
+	for _, tt := range tests {
+		svc := decodeKube[kubeService](t, tt.raw)
+		got, err := svc.target(tt.portName, tt.port, tt.scheme)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: target() = %q, %v; want error %q", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: target() = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestKubeRoutes(t *testing.T) {
+	services := []kubeService{
+		decodeKube[kubeService](t, `{"metadata":{"name":"web","namespace":"prod","annotations":{"tunneling.io/hostname":"Web.Test, www.test"}},"spec":{"clusterIP":"10.0.0.1","ports":[{"port":80}]}}`),
+		decodeKube[kubeService](t, `{"metadata":{"name":"api","namespace":"prod","annotations":{"tunneling.io/hostname":"api.test","tunneling.io/port":"grpc"}},"spec":{"clusterIP":"10.0.0.2","ports":[{"name":"http","port":80}]}}`),
+		decodeKube[kubeService](t, `{"metadata":{"name":"plain","namespace":"prod"},"spec":{"clusterIP":"10.0.0.3","ports":[{"name":"http","port":8080},{"name":"admin","port":9000}]}}`),
+		decodeKube[kubeService](t, `{"metadata":{"name":"zz","namespace":"prod","annotations":{"tunneling.io/hostname":"web.test"}},"spec":{"clusterIP":"10.0.0.4","ports":[{"port":80}]}}`),
+	}
+	ingresses := []kubeIngress{
+		decodeKube[kubeIngress](t, `{"metadata":{"name":"site","namespace":"prod","annotations":{"tunneling.io/scheme":"https"}},"spec":{"ingressClassName":"tunneling","rules":[
+			{"host":"shop.test","http":{"paths":[{"path":"/static","backend":{"service":{"name":"plain","port":{"name":"admin"}}}},{"path":"/","backend":{"service":{"name":"plain","port":{"number":8080}}}}]}},
+			{"host":"nohttp.test"},
+			{"host":"missing.test","http":{"paths":[{"path":"/","backend":{"service":{"name":"gone","port":{"number":80}}}}]}},
+			{"host":"resource.test","http":{"paths":[{"path":"/","backend":{}}]}},
+			{"host":"www.test","http":{"paths":[{"path":"/","backend":{"service":{"name":"plain","port":{"number":8080}}}}]}}
+		]}}`),
+		decodeKube[kubeIngress](t, `{"metadata":{"name":"legacy","namespace":"prod","annotations":{"kubernetes.io/ingress.class":"tunneling"}},"spec":{"rules":[
+			{"host":"legacy.test","http":{"paths":[{"backend":{"service":{"name":"plain","port":{"name":"admin"}}}}]}}
+		]}}`),
+		decodeKube[kubeIngress](t, `{"metadata":{"name":"other","namespace":"prod"},"spec":{"ingressClassName":"nginx","rules":[
+			{"host":"nginx.test","http":{"paths":[{"path":"/","backend":{"service":{"name":"plain","port":{"number":8080}}}}]}}
+		]}}`),
+		decodeKube[kubeIngress](t, `{"metadata":{"name":"elsewhere","namespace":"dev"},"spec":{"ingressClassName":"tunneling","rules":[
+			{"host":"dev.test","http":{"paths":[{"path":"/","backend":{"service":{"name":"plain","port":{"number":8080}}}}]}}
+		]}}`),
+	}
+
+	got := kubeRoutes(services, ingresses)
+	want := []protocol.Route{
+		{Hostname: "web.test", Target: "10.0.0.1:80"},
+		{Hostname: "www.test", Target: "10.0.0.1:80"},
+		{Hostname: "legacy.test", Target: "10.0.0.3:9000"},
+		{Hostname: "shop.test", Target: "https://10.0.0.3:8080"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("routes = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestReadKubeWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		events  int
+		wantErr string
+	}{
+		{name: "changes", stream: `{"type":"ADDED","object":{}}` + "\n" + `{"type":"DELETED","object":{}}` + "\n", events: 1},
+		{name: "bookmark only", stream: `{"type":"BOOKMARK","object":{}}` + "\n"},
+		{name: "error event", stream: `{"type":"ERROR","object":{"message":"too old resource version"}}` + "\n", wantErr: "too old resource version"},
+		{name: "malformed", stream: "not json\n", wantErr: "decode kubernetes watch event"},
+	}
+	for _, tt := range tests {
+		events := make(chan struct{}, 1)
+		err := readKubeWatch(strings.NewReader(tt.stream), events)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if len(events) != tt.events {
+			t.Errorf("%s: %d change notifications, want %d", tt.name, len(events), tt.events)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"os"
+	"runtime"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/version"
+)
+
+// SetLabels sets the key=value labels the agent reports to the server with
+// its version and platform, e.g. env=staging.
+func (s *Service) SetLabels(items []string) error {
+	labels, err := protocol.ParseAgentLabels(items)
+	if err != nil {
+		return err
+	}
+	s.labels = labels
+	return nil
+}
+
+// meta describes the agent and its machine for the server's hello.
+func (s *Service) meta() *protocol.AgentMeta {
+	hostname, _ := os.Hostname()
+	return &protocol.AgentMeta{
+		Version:  version.Version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Hostname: hostname,
+		Labels:   s.labels,
+	}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"strconv"
+	"time"
+
+	"tunneling/internal/metrics"
+)
+
+// registerMetrics sets up what the admin listener serves on /metrics.
+func (s *Service) registerMetrics() {
+	s.metrics = metrics.NewRegistry()
+	s.metrics.NewGaugeFunc("agent_connected", "1 while the agent holds a tunnel server connection.", func() float64 {
+		if s.GetStatus().Connected {
+			return 1
+		}
+		return 0
+	})
+	s.metrics.NewGaugeFunc("agent_routes", "Routes the agent currently serves.", func() float64 {
+		return float64(len(s.allRoutes()))
+	})
+	s.metrics.NewGaugeFunc("agent_requests_running", "Local requests in progress.", func() float64 {
+		running, _, _ := s.pool.stats()
+		return float64(running)
+	})
+	s.metrics.NewGaugeFunc("agent_requests_queued", "Requests waiting for a concurrency slot.", func() float64 {
+		_, queued, _ := s.pool.stats()
+		return float64(queued)
+	})
+	s.metrics.NewGaugeFunc("agent_write_queue_depth", "Envelopes waiting in the tunnel connection's write queue.", func() float64 {
+		if writer := s.getWriter(); writer != nil {
+			return float64(writer.Depth())
+		}
+		return 0
+	})
+	s.proxiedRequests = s.metrics.NewCounter("agent_proxied_requests_total", "Tunneled requests answered, by status class.", "code")
+	s.requestDuration = s.metrics.NewHistogram("agent_proxied_request_duration_seconds", "Time from receiving a tunneled request to finishing its response, by status class.", nil, "code")
+	s.localErrors = s.metrics.NewCounter("agent_local_errors_total", "Local requests that failed before a response came back, by reason.", "reason")
+	s.reconnects = s.metrics.NewCounter("agent_reconnects_total", "Tunnel server connections lost and retried, by reason.", "reason")
+	s.routeSyncs = s.metrics.NewCounter("agent_route_sync_total", "Route syncs with the control API, by result.", "result")
+	s.writeFailures = s.metrics.NewCounter("agent_ws_write_failures_total", "Envelopes that could not be queued on the tunnel connection, by reason.", "reason")
+}
+
+func (s *Service) observeRequest(status int, started time.Time) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status/100) + "xx"
+	}
+	s.proxiedRequests.Inc(code)
+	s.requestDuration.Observe(time.Since(started).Seconds(), code)
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// requestPool bounds the requests forwarded to local services: limit run at
+// once, up to queue more wait for a slot, and the rest are turned away.
+type requestPool struct {
+	slots    chan struct{}
+	queue    int64
+	admitted atomic.Int64
+	rejected atomic.Uint64
+}
+
+// SetConcurrency limits how many requests are forwarded to local services at
+// once; up to queue more wait and the rest are answered with 503. A limit of
+// zero or less removes the bound.
+func (s *Service) SetConcurrency(limit, queue int) error {
+	if limit <= 0 {
+		s.pool = nil
+		return nil
+	}
+	if queue < 0 {
+		return errors.New("request queue must not be negative")
+	}
+	s.pool = &requestPool{slots: make(chan struct{}, limit), queue: int64(queue)}
+	return nil
+}
+
+// admit reserves a running or queued place; every admitted request must
+// reach release, through acquire or not.
+func (p *requestPool) admit() bool {
+	if p == nil {
+		return true
+	}
+	if p.admitted.Add(1) > int64(cap(p.slots))+p.queue {
+		p.admitted.Add(-1)
+		p.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// acquire waits for a slot; it fails when ctx ends first, e.g. because the
+// server canceled the request.
+func (p *requestPool) acquire(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		p.admitted.Add(-1)
+		return false
+	}
+}
+
+func (p *requestPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.slots
+	p.admitted.Add(-1)
+}
+
+// stats returns the requests running and waiting, and how many were
+// turned away so far.
+func (p *requestPool) stats() (running, queued int, rejected uint64) {
+	if p == nil {
+		return 0, 0, 0
+	}
+	running = len(p.slots)
+	queued = max(int(p.admitted.Load())-running, 0)
+	return running, queued, p.rejected.Load()
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestPool(limit, queue int) *requestPool {
+	return &requestPool{slots: make(chan struct{}, limit), queue: int64(queue)}
+}
+
+func TestPoolRejectsPastLimitAndQueue(t *testing.T) {
+	p := newTestPool(1, 1)
+	if !p.admit() || !p.acquire(context.Background()) {
+		t.Fatal("first request was not admitted")
+	}
+	if !p.admit() {
+		t.Fatal("second request should wait in the queue")
+	}
+	if p.admit() {
+		t.Fatal("third request should be turned away")
+	}
+	if running, queued, rejected := p.stats(); running != 1 || queued != 1 || rejected != 1 {
+		t.Fatalf("stats = %d running, %d queued, %d rejected", running, queued, rejected)
+	}
+}
+
+func TestPoolReleaseFreesSlot(t *testing.T) {
+	p := newTestPool(1, 1)
+	if !p.admit() || !p.acquire(context.Background()) {
+		t.Fatal("first request was not admitted")
+	}
+	if !p.admit() {
+		t.Fatal("second request was not queued")
+	}
+	got := make(chan bool, 1)
+	go func() { got <- p.acquire(context.Background()) }()
+	select {
+	case <-got:
+		t.Fatal("queued request ran while the slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.release()
+	select {
+	case ok := <-got:
+		if !ok {
+			t.Fatal("queued request failed to acquire the freed slot")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("release did not hand the slot on")
+	}
+	p.release()
+	if running, queued, _ := p.stats(); running != 0 || queued != 0 {
+		t.Fatalf("after both released: %d running, %d queued", running, queued)
+	}
+}
+
+func TestPoolCanceledWaitDoesNotLeak(t *testing.T) {
+	p := newTestPool(1, 1)
+	if !p.admit() || !p.acquire(context.Background()) {
+		t.Fatal("first request was not admitted")
+	}
+	if !p.admit() {
+		t.Fatal("second request was not queued")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan bool, 1)
+	go func() { got <- p.acquire(ctx) }()
+	cancel()
+	if <-got {
+		t.Fatal("canceled request acquired a slot")
+	}
+	if running, queued, _ := p.stats(); running != 1 || queued != 0 {
+		t.Fatalf("after cancel: %d running, %d queued", running, queued)
+	}
+
+	// The canceled request's queue place is free again, and so is the
+	// slot once the running request ends.
+	p.release()
+	for i := range 2 {
+		if !p.admit() {
+			t.Fatalf("request %d was turned away after the cancel", i)
+		}
+	}
+	if !p.acquire(context.Background()) {
+		t.Fatal("slot leaked by the canceled request")
+	}
+}
+
+func TestNilPoolIsUnbounded(t *testing.T) {
+	var p *requestPool
+	for range 100 {
+		if !p.admit() || !p.acquire(context.Background()) {
+			t.Fatal("nil pool turned a request away")
+		}
+	}
+	p.release()
+	if running, queued, rejected := p.stats(); running != 0 || queued != 0 || rejected != 0 {
+		t.Fatalf("nil pool stats = %d, %d, %d", running, queued, rejected)
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	if err := svc.SetConcurrency(2, -1); err == nil {
+		t.Fatal("negative queue accepted")
+	}
+	if err := svc.SetConcurrency(2, 3); err != nil || cap(svc.pool.slots) != 2 || svc.pool.queue != 3 {
+		t.Fatalf("SetConcurrency(2, 3): pool %+v, err %v", svc.pool, err)
+	}
+	if err := svc.SetConcurrency(0, 3); err != nil || svc.pool != nil {
+		t.Fatalf("SetConcurrency(0, 3) kept a pool: %+v, err %v", svc.pool, err)
+	}
+}
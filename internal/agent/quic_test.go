@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tunneling/internal/muxconn"
+	"tunneling/internal/protocol"
+	"tunneling/internal/server"
+)
+
+// startQUICServer serves ts to QUIC agents with a certificate for
+// 127.0.0.1 and returns the agent's server URL and the certificate file.
+func startQUICServer(t *testing.T, ts *server.TunnelServer) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tunnel test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+
+	ln, err := server.ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatalf("ListenQUIC: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ts.ServeQUIC(ctx, ln) }()
+	return "wss://" + ln.Addr().String() + "/connect", certFile
+}
+
+func newQUICService(t *testing.T, cfg fileConfig, serverURL, certFile string) *Service {
+	t.Helper()
+	svc := newTestService(t, cfg)
+	if err := svc.SetTransport(TransportQUIC); err != nil {
+		t.Fatalf("SetTransport: %v", err)
+	}
+	if err := svc.SetServerTLS(ServerTLS{CAFile: certFile}); err != nil {
+		t.Fatalf("SetServerTLS: %v", err)
+	}
+	svc.serverMu.Lock()
+	svc.servers, svc.serverIdx = []string{serverURL}, 0
+	svc.serverMu.Unlock()
+	return svc
+}
+
+func TestQUICTransportCarriesRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	ts := server.New(server.Options{RequestTimeout: 10 * time.Second})
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	serverURL, certFile := startQUICServer(t, ts)
+
+	svc := newQUICService(t, fileConfig{Routes: []protocol.Route{{Hostname: "app.test", Target: strings.TrimPrefix(backend.URL, "http://")}}}, serverURL, certFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatal("route was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := svc.getConn().(*muxconn.Conn); !ok {
+		t.Fatalf("agent connection is %T, want a quic session", svc.getConn())
+	}
+
+	bodies := []string{"", "ping", strings.Repeat("0123456789", 200_000)}
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		body := bodies[i%len(bodies)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, public.URL+"/", strings.NewReader(body))
+			req.Host = "app.test"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("public request: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(got, []byte(body)) {
+				t.Errorf("response %d with %d bytes, want 200 with %d", resp.StatusCode, len(got), len(body))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestQUICTransportRejectedToken(t *testing.T) {
+	ts := server.New(server.Options{TokenValidator: server.TokenValidatorFunc(func(context.Context, string, string) error {
+		return server.ErrAgentUnauthorized
+	})})
+	serverURL, certFile := startQUICServer(t, ts)
+	svc := newQUICService(t, fileConfig{}, serverURL, certFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := svc.connectOnce(ctx)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("connectOnce = %v, want the server's 401", err)
+	}
+}
+
+func TestQUICTransportSeesServerRestart(t *testing.T) {
+	ts := server.New(server.Options{})
+	serverURL, certFile := startQUICServer(t, ts)
+	svc := newQUICService(t, fileConfig{Routes: []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:1"}}}, serverURL, certFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- svc.connectOnce(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatal("route was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ts.Shutdown()
+	select {
+	case err := <-done:
+		if !isServerRestart(err) {
+			t.Fatalf("connectOnce = %v, want the server's restart close frame", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not notice the restart")
+	}
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	// The control API sends a comment every 25s; two missed beats means the
+	// stream is dead even if the TCP connection has not noticed yet.
+	routeStreamIdleTimeout = 60 * time.Second
+	routeStreamMaxBackoff  = time.Minute
+	maxRouteStreamEvent    = 1 << 20
+)
+
+// routeStreamLoop keeps the push channel to the control API open. While it is
+// connected routeSyncLoop skips its polls; whenever it drops, polling takes
+// over again until the stream reconnects.
+func (s *Service) routeStreamLoop(ctx context.Context) {
+	backoff := time.Second
+	for {
+		connected, err := s.streamRoutesOnce(ctx)
+		s.routeStreamUp.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second
+			slog.Warn("route stream disconnected, falling back to polling", "err", err, "interval", s.routeSyncInterval)
+		} else {
+			slog.Warn("route stream unavailable", "err", err, "retry_in", backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if !connected {
+			backoff = min(backoff*2, routeStreamMaxBackoff)
+		}
+	}
+}
+
+func (s *Service) streamRoutesOnce(ctx context.Context) (bool, error) {
+	reqURL, err := url.Parse(s.routeSyncURL)
+	if err != nil {
+		return false, err
+	}
+	reqURL.Path = strings.TrimRight(reqURL.Path, "/") + "/stream"
+	q := reqURL.Query()
+	q.Set("tunnel_id", s.tunnelID)
+	q.Set("token", s.tunnelToken)
+	if !s.forceFullRouteSync.Load() {
+		q.Set("since", protocol.RoutesVersion(s.store.List()))
+	}
+	reqURL.RawQuery = q.Encode()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(routeStreamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// streamClient only bounds the wait for headers, which is what a
+	// long-lived stream needs.
+	resp, err := s.streamClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return false, fmt.Errorf("status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	s.routeStreamUp.Store(true)
+	slog.Info("route stream connected", "tunnel_id", s.tunnelID)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxRouteStreamEvent)
+	var event string
+	var data strings.Builder
+	for scanner.Scan() {
+		idle.Reset(routeStreamIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "routes" && data.Len() > 0 {
+				s.handleRouteStreamEvent(ctx, data.String())
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() == nil && streamCtx.Err() != nil {
+			return true, errors.New("no heartbeat from control api")
+		}
+		return true, err
+	}
+	return true, io.EOF
+}
+
+func (s *Service) handleRouteStreamEvent(ctx context.Context, data string) {
+	var payload syncedRoutesPayload
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		slog.Warn("route stream decode failed", "err", err)
+		s.routeSyncs.Inc("error")
+		return
+	}
+	if !s.applySyncedRoutes(payload) {
+		s.syncRoutesFromControl(ctx)
+	}
+}
+
+func (s *Service) routeSyncMode() string {
+	if s.routeSyncURL == "" {
+		return ""
+	}
+	if s.routeStreamUp.Load() {
+		return "push"
+	}
+	return "poll"
+}
@@ -3,70 +3,190 @@ package agent
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"tunneling/internal/logging"
+	"tunneling/internal/metrics"
 	"tunneling/internal/protocol"
+	"tunneling/internal/tracing"
+	"tunneling/internal/version"
+	"tunneling/internal/wsconn"
 )
 
 const (
-	maxProxyBodySize = 10 << 20 // 10MB
+	maxProxyBodySize    = 10 << 20 // 10MB
+	writeQueueWait      = 5 * time.Second
+	configWatchInterval = 2 * time.Second
 )
 
 type Service struct {
-	serverURL string
-	token     string
-	adminAddr string
-	store     *ConfigStore
+	// servers are the tunnel servers in order of preference; serverIdx
+	// is the one connections go to. Under -server auto the control plane
+	// fills in the list.
+	serverMu     sync.Mutex
+	servers      []string
+	serverIdx    int
+	assign       bool
+	assignRegion string
+	assignedAt   time.Time
+	token        string
+	adminAddr    string
+	store        *ConfigStore
 
 	routeSyncURL      string
 	tunnelID          string
 	tunnelToken       string
 	routeSyncInterval time.Duration
 
-	httpClient *http.Client
+	routeSyncMu        sync.Mutex
+	forceFullRouteSync atomic.Bool
+	routeStreamUp      atomic.Bool
+	heartbeatNow       chan struct{}
+
+	// httpClient and streamClient reach the control plane, through proxy
+	// like the tunnel server connection; route targets never use it.
+	httpClient   *http.Client
+	streamClient *http.Client
+	proxy        func(*http.Request) (*url.URL, error)
+	serverTLS    *tls.Config
+	transport    string
+	quicSessions tls.ClientSessionCache
+
+	targetMu     sync.Mutex
+	targetClient *http.Client
+	unixClients  map[string]*http.Client
+	targetTLS    *tls.Config
+	local        LocalTransport
+
+	streamsMu       sync.Mutex
+	streams         map[string]*agentStream
+	serverStreaming atomic.Bool
+
+	requestsMu sync.Mutex
+	requests   map[string]context.CancelFunc
+	inspector  inspector
+	events     eventBus
 
 	connMu sync.RWMutex
-	conn   *websocket.Conn
-
-	writeMu sync.Mutex
+	conn   wsconn.Conn
+	writer *wsconn.Writer
+
+	writeDropped atomic.Uint64
+	pool         *requestPool
+
+	metrics         *metrics.Registry
+	proxiedRequests *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	localErrors     *metrics.CounterVec
+	reconnects      *metrics.CounterVec
+	routeSyncs      *metrics.CounterVec
+	writeFailures   *metrics.CounterVec
+
+	publishMu sync.Mutex
+	published publishedRoutes
+
+	healthMu       sync.Mutex
+	health         map[string]*RouteHealth
+	serverHealth   atomic.Bool
+	healthReportMu sync.Mutex
+	healthReport   healthReport
+
+	reconnect Reconnect
+
+	// draining is set on shutdown; requests still arriving are refused
+	// while those in flight finish, for up to drainTimeout.
+	draining     atomic.Bool
+	drainTimeout time.Duration
+	serverDrain  atomic.Bool
+
+	compressMin    int
+	serverCompress atomic.Bool
+	serverInterim  atomic.Bool
+	tracer         *tracing.Tracer
+	// labels are reported to the server with the agent's hello.
+	labels map[string]string
+
+	// adminAuth, when set, puts the admin UI and API behind a password.
+	adminAuth *adminAuth
+	// docker, when set, adds routes for labelled containers.
+	docker *dockerDiscovery
+	// kube, when set, adds routes for annotated Services and Ingresses.
+	kube *kubeDiscovery
+
+	// queryToken is set once a server has turned away the Authorization
+	// header; such old servers only read the token from the URL.
+	queryToken atomic.Bool
+
+	sessionMu    sync.RWMutex
+	sessionID    string
+	sessionToken string
 
 	statusMu  sync.RWMutex
 	connected bool
 	lastError string
+	// Filled from the server's hello; empty against servers that predate it.
+	serverVersion   string
+	protocolVersion int
+}
+
+type publishedRoutes struct {
+	conn    wsconn.Conn
+	routes  []protocol.Route
+	version string
 }
 
 type Status struct {
-	Connected bool   `json:"connected"`
-	LastError string `json:"last_error,omitempty"`
-	ServerURL string `json:"server_url"`
-	AdminAddr string `json:"admin_addr"`
-	TokenHint string `json:"token_hint"`
+	Connected bool     `json:"connected"`
+	LastError string   `json:"last_error,omitempty"`
+	ServerURL string   `json:"server_url"`
+	Servers   []string `json:"servers"`
+	AdminAddr string   `json:"admin_addr"`
+	TokenHint string   `json:"token_hint"`
+	SessionID string   `json:"session_id,omitempty"`
+
+	AgentVersion    string `json:"agent_version"`
+	ServerVersion   string `json:"server_version,omitempty"`
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+
+	WriteQueueDepth   int    `json:"write_queue_depth"`
+	WriteQueueDropped uint64 `json:"write_queue_dropped"`
+
+	RequestsRunning  int    `json:"requests_running"`
+	RequestsQueued   int    `json:"requests_queued"`
+	RequestsRejected uint64 `json:"requests_rejected"`
 
 	RouteSyncURL      string `json:"route_sync_url,omitempty"`
 	TunnelID          string `json:"tunnel_id,omitempty"`
 	ManagedByControl  bool   `json:"managed_by_control"`
 	RouteSyncInterval string `json:"route_sync_interval,omitempty"`
+	RouteSyncMode     string `json:"route_sync_mode,omitempty"`
+
+	Health []RouteHealth `json:"health,omitempty"`
 }
 
 func NewService(serverURL, token, adminAddr, routeSyncURL, tunnelID, tunnelToken string, routeSyncInterval time.Duration, store *ConfigStore) (*Service, error) {
-	parsed, err := url.Parse(serverURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid server url: %w", err)
-	}
-	if parsed.Scheme != "ws" && parsed.Scheme != "wss" {
-		return nil, errors.New("server url must start with ws:// or wss://")
+	var servers []string
+	assign := strings.TrimSpace(serverURL) == ServerAuto
+	if !assign {
+		var err error
+		if servers, err = parseServerURLs(serverURL); err != nil {
+			return nil, err
+		}
 	}
 
 	routeSyncURL = strings.TrimSpace(routeSyncURL)
@@ -85,12 +205,16 @@ func NewService(serverURL, token, adminAddr, routeSyncURL, tunnelID, tunnelToken
 			return nil, errors.New("tunnel-token is required when route sync url is set")
 		}
 	}
+	if assign && routeSyncURL == "" {
+		return nil, errors.New("server auto needs a route sync url to ask the control plane")
+	}
 	if routeSyncInterval <= 0 {
 		routeSyncInterval = 5 * time.Second
 	}
 
-	return &Service{
-		serverURL:         serverURL,
+	s := &Service{
+		servers:           servers,
+		assign:            assign,
 		token:             token,
 		adminAddr:         adminAddr,
 		store:             store,
@@ -98,16 +222,32 @@ func NewService(serverURL, token, adminAddr, routeSyncURL, tunnelID, tunnelToken
 		tunnelID:          strings.TrimSpace(tunnelID),
 		tunnelToken:       strings.TrimSpace(tunnelToken),
 		routeSyncInterval: routeSyncInterval,
-		httpClient: &http.Client{
-			Timeout: 45 * time.Second,
-		},
-	}, nil
+		proxy:             http.ProxyFromEnvironment,
+		local:             defaultLocalTransport,
+		heartbeatNow:      make(chan struct{}, 1),
+		compressMin:       protocol.DefaultCompressMinBytes,
+		reconnect:         defaultReconnect,
+		drainTimeout:      defaultDrainTimeout,
+	}
+	s.httpClient, s.streamClient = s.controlClients()
+	s.targetClient = s.newLocalClientLocked()
+	s.registerMetrics()
+	return s, nil
 }
 
 func (s *Service) Run(ctx context.Context) error {
+	go serveAdmin(ctx, s.adminAddr, s.adminMux())
+	return s.run(ctx)
+}
+
+// serveAdmin serves the admin UI on addr until ctx is done.
+func serveAdmin(ctx context.Context, addr string, handler http.Handler) {
 	adminSrv := &http.Server{
-		Addr:    s.adminAddr,
-		Handler: s.adminMux(),
+		Addr:    addr,
+		Handler: handler,
+		// Ends live views with the agent; Shutdown does not reach
+		// hijacked websocket connections.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
 	go func() {
@@ -117,22 +257,44 @@ func (s *Service) Run(ctx context.Context) error {
 		_ = adminSrv.Shutdown(shutdownCtx)
 	}()
 
-	go func() {
-		log.Printf("agent admin UI listening on http://%s", s.adminAddr)
-		if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("admin server error: %v", err)
-		}
-	}()
+	slog.Info("agent admin UI listening", "url", "http://"+addr)
+	if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin server error", "err", err)
+	}
+}
 
+// run keeps the tunnel connected, without the admin UI, until ctx is done.
+func (s *Service) run(ctx context.Context) error {
+	go s.configWatchLoop(ctx)
+	if s.docker != nil {
+		go discoveryLoop(ctx, "docker", s.watchDocker)
+	}
+	if s.kube != nil {
+		go discoveryLoop(ctx, "kubernetes", s.watchKube)
+	}
+	go s.healthLoop(ctx)
+	if servers, _ := s.serverState(); len(servers) > 1 || s.assign {
+		go s.failbackLoop(ctx, failbackInterval)
+	}
 	if s.routeSyncURL != "" {
 		go s.routeSyncLoop(ctx)
+		go s.routeStreamLoop(ctx)
+		heartbeatDone := make(chan struct{})
+		go func() {
+			defer close(heartbeatDone)
+			s.heartbeatLoop(ctx)
+		}()
+		// Let the final heartbeat out before the process exits.
+		defer func() { <-heartbeatDone }()
 	}
 
 	return s.connectLoop(ctx)
 }
 
 func (s *Service) connectLoop(ctx context.Context) error {
-	backoff := time.Second
+	policy := s.reconnect
+	backoff := policy.Initial
+	failures := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -140,82 +302,256 @@ func (s *Service) connectLoop(ctx context.Context) error {
 		default:
 		}
 
+		wait := policy.jittered(backoff)
+		started := time.Now()
+		server := s.currentServer()
 		if err := s.connectOnce(ctx); err != nil {
 			s.setLastError(err.Error())
-			log.Printf("agent disconnected: %v", err)
+			slog.Warn("agent disconnected", "server", server, "err", err)
+			failures++
+			switch {
+			case server != "" && s.currentServer() != server:
+				// failbackLoop moved us to a preferred server.
+				s.reconnects.Inc("failback")
+				backoff, failures = policy.Initial, 0
+				wait = restartDelay
+			case isServerRestart(err):
+				// The server is being redeployed; come back soon and resume
+				// the session on the next process, spread out so that all
+				// its agents do not arrive at once.
+				s.reconnects.Inc("server_restart")
+				backoff, failures = policy.Initial, 0
+				wait = policy.afterRestart()
+			case policy.healthy(time.Since(started)):
+				// A connection that had been working, e.g. until a NAT
+				// dropped it and the pongs stopped, is retried after a short
+				// pause instead of the grown backoff.
+				s.reconnects.Inc("connection_lost")
+				backoff, failures = policy.Initial, 0
+				wait = policy.jittered(backoff)
+			default:
+				s.reconnects.Inc("connect_failed")
+				if policy.exhausted(failures) {
+					return fmt.Errorf("giving up after %d failed connection attempts: %w", failures, err)
+				}
+				s.failover(ctx)
+			}
 		}
 
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-time.After(backoff):
+		case <-time.After(wait):
 		}
 
-		if backoff < 10*time.Second {
-			backoff *= 2
-			if backoff > 10*time.Second {
-				backoff = 10 * time.Second
-			}
-		}
+		backoff = policy.next(backoff)
 	}
 }
 
 func (s *Service) connectOnce(ctx context.Context) error {
+	if err := s.refreshAssignment(ctx); err != nil {
+		if s.currentServer() == "" {
+			return fmt.Errorf("assign server: %w", err)
+		}
+		slog.Warn("refresh server assignment failed, keeping the current server", "server", s.currentServer(), "err", err)
+	}
 	wsURL, err := s.buildConnectURL()
 	if err != nil {
 		return err
 	}
 
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	conn, err := s.dialServer(ctx, wsURL)
 	if err != nil {
-		return fmt.Errorf("connect server: %w", err)
+		return err
 	}
 	conn.SetReadLimit(maxProxyBodySize + (2 << 20))
-	s.setConn(conn)
+	writer := wsconn.NewWriter(conn, wsconn.DefaultQueueSize, wsconn.DefaultWriteTimeout)
+	wsconn.Keepalive(conn, wsconn.DefaultPingInterval, writer.Done())
+	s.setConn(conn, writer)
 	s.setConnected(true)
 	s.setLastError("")
+	s.statusMu.Lock()
+	s.serverVersion, s.protocolVersion = "", 0
+	s.statusMu.Unlock()
+	stopCloser := context.AfterFunc(ctx, func() {
+		s.drain(conn, writer)
+		_ = conn.Close()
+	})
+	s.serverStreaming.Store(false)
+	s.serverHealth.Store(false)
+	s.serverCompress.Store(false)
+	s.serverInterim.Store(false)
+	s.serverDrain.Store(false)
 	defer func() {
+		stopCloser()
 		s.setConnected(false)
 		s.clearConn(conn)
+		writer.Close()
 		_ = conn.Close()
+		s.abortStreams(errors.New("tunnel disconnected"))
 	}()
 
+	hello := protocol.Envelope{
+		Type:            protocol.TypeHello,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Version:         version.Version,
+		Caps:            s.caps(),
+		Agent:           s.meta(),
+	}
+	if err := s.writeEnvelope(hello); err != nil {
+		return fmt.Errorf("send hello: %w", err)
+	}
 	if err := s.publishRoutes(); err != nil {
 		return fmt.Errorf("sync routes on connect: %w", err)
 	}
-	log.Printf("agent connected to %s", s.serverURL)
+	slog.Info("agent connected", "server", s.currentServer())
 
 	for {
-		var env protocol.Envelope
-		if err := conn.ReadJSON(&env); err != nil {
+		env, err := wsconn.ReadEnvelope(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if wsconn.IsKeepaliveTimeout(err) {
+				return fmt.Errorf("server stopped answering pings: %w", err)
+			}
 			return fmt.Errorf("read server message: %w", err)
 		}
 		switch env.Type {
 		case protocol.TypeProxyRequest:
-			go s.handleProxyRequest(env)
+			if s.draining.Load() {
+				s.refuse(env, "agent shutting down")
+				continue
+			}
+			if !s.pool.admit() {
+				s.refuse(env, "agent busy: too many concurrent requests")
+				continue
+			}
+			if s.serverStreaming.Load() {
+				s.openStream(env.RequestID)
+			}
+			// Registered before the goroutine starts so an early
+			// proxy_cancel cannot miss it.
+			go s.handleProxyRequest(s.beginRequest(env.RequestID), env)
+		case protocol.TypeProxyRequestData, protocol.TypeProxyWindow:
+			s.handleStreamFrame(env)
+		case protocol.TypeProxyCancel:
+			s.cancelRequest(env.RequestID)
+		case protocol.TypeSession:
+			s.setSession(env.SessionID, env.SessionToken)
+			s.serverStreaming.Store(protocol.HasCap(env.Caps, protocol.CapStream))
+			s.serverHealth.Store(protocol.HasCap(env.Caps, protocol.CapHealth))
+			s.serverCompress.Store(protocol.HasCap(env.Caps, protocol.CapCompress))
+			s.serverInterim.Store(protocol.HasCap(env.Caps, protocol.CapInterim))
+			s.serverDrain.Store(protocol.HasCap(env.Caps, protocol.CapDrain))
+			writer.SetBinary(protocol.HasCap(env.Caps, protocol.CapBinary))
+		case protocol.TypeHello:
+			s.serverStreaming.Store(protocol.HasCap(env.Caps, protocol.CapStream))
+			s.serverHealth.Store(protocol.HasCap(env.Caps, protocol.CapHealth))
+			s.serverCompress.Store(protocol.HasCap(env.Caps, protocol.CapCompress))
+			s.serverInterim.Store(protocol.HasCap(env.Caps, protocol.CapInterim))
+			s.serverDrain.Store(protocol.HasCap(env.Caps, protocol.CapDrain))
+			writer.SetBinary(protocol.HasCap(env.Caps, protocol.CapBinary))
+			s.statusMu.Lock()
+			s.serverVersion = env.Version
+			s.protocolVersion = env.ProtocolVersion
+			s.statusMu.Unlock()
+			slog.Info("server hello", "version", env.Version, "protocol", env.ProtocolVersion, "caps", env.Caps)
+		case protocol.TypeRouteResync:
+			slog.Info("server requested full route resync")
+			if err := s.resyncRoutes(); err != nil {
+				slog.Warn("route resync failed", "err", err)
+			}
 		case protocol.TypeError:
-			log.Printf("server error: %s", env.Message)
+			slog.Warn("server error", "message", env.Message)
 		default:
-			log.Printf("unknown server message type=%s", env.Type)
+			slog.Warn("unknown server message", "type", env.Type)
 		}
 	}
 }
 
+func isServerRestart(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code == websocket.CloseServiceRestart
+}
+
 func (s *Service) buildConnectURL() (string, error) {
-	parsed, err := url.Parse(s.serverURL)
+	parsed, err := url.Parse(s.currentServer())
 	if err != nil {
 		return "", err
 	}
 	q := parsed.Query()
-	q.Set("token", s.token)
+	if s.queryToken.Load() {
+		q.Set("token", s.token)
+	}
+	if s.tunnelID != "" {
+		q.Set("tunnel_id", s.tunnelID)
+	}
+	// Servers that predate the hello only learn the caps from here.
+	q.Set("caps", strings.Join(s.caps(), ","))
+	if s.transport == TransportYamux {
+		q.Set("transport", TransportYamux)
+	}
+	if _, resumeToken := s.getSession(); resumeToken != "" {
+		q.Set("resume", resumeToken)
+	}
 	parsed.RawQuery = q.Encode()
 	return parsed.String(), nil
 }
 
+func (s *Service) setSession(id, token string) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	s.sessionID = id
+	s.sessionToken = token
+}
+
+func (s *Service) getSession() (string, string) {
+	s.sessionMu.RLock()
+	defer s.sessionMu.RUnlock()
+	return s.sessionID, s.sessionToken
+}
+
+// publishRoutes sends the full route set on a fresh connection and only the
+// changes since the last publish afterwards.
 func (s *Service) publishRoutes() error {
-	routes := s.store.List()
-	env := protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}
-	return s.writeEnvelope(env)
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	conn := s.getConn()
+	routes := s.allRoutes()
+	version := protocol.RoutesVersion(routes)
+
+	if conn != nil && s.published.conn == conn && s.published.version != "" {
+		if s.published.version == version {
+			return nil
+		}
+		added, removed := protocol.DiffRoutes(s.published.routes, routes)
+		env := protocol.Envelope{
+			Type:          protocol.TypeRouteDelta,
+			Routes:        added,
+			RemovedHosts:  removed,
+			BaseVersion:   s.published.version,
+			RoutesVersion: version,
+		}
+		if err := s.writeEnvelope(env); err != nil {
+			return err
+		}
+	} else {
+		env := protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes, RoutesVersion: version}
+		if err := s.writeEnvelope(env); err != nil {
+			return err
+		}
+	}
+	s.published = publishedRoutes{conn: conn, routes: routes, version: version}
+	return nil
+}
+
+func (s *Service) resyncRoutes() error {
+	s.publishMu.Lock()
+	s.published = publishedRoutes{}
+	s.publishMu.Unlock()
+	return s.publishRoutes()
 }
 
 func (s *Service) SyncRoutes() error {
@@ -223,55 +559,144 @@ func (s *Service) SyncRoutes() error {
 }
 
 func (s *Service) writeEnvelope(env protocol.Envelope) error {
-	conn := s.getConn()
-	if conn == nil {
+	writer := s.getWriter()
+	if writer == nil {
 		return errors.New("tunnel is offline")
 	}
-	s.writeMu.Lock()
-	defer s.writeMu.Unlock()
-	if err := conn.WriteJSON(env); err != nil {
+	if err := writer.Send(env, writeQueueWait); err != nil {
+		if errors.Is(err, wsconn.ErrQueueFull) {
+			s.writeDropped.Add(1)
+			s.writeFailures.Inc("queue_full")
+		} else {
+			s.writeFailures.Inc("closed")
+		}
 		return fmt.Errorf("write websocket: %w", err)
 	}
 	return nil
 }
 
-func (s *Service) handleProxyRequest(req protocol.Envelope) {
-	status, headers, body := s.forwardToLocal(req)
-
-	resp := protocol.Envelope{
-		Type:      protocol.TypeProxyResponse,
-		RequestID: req.RequestID,
-		Status:    status,
-		Headers:   headers,
-		Body:      base64.StdEncoding.EncodeToString(body),
+func (s *Service) handleProxyRequest(ctx context.Context, req protocol.Envelope) {
+	received := time.Now()
+	st := s.stream(req.RequestID)
+	if st != nil {
+		defer s.closeStream(req.RequestID)
+	}
+	defer s.endRequest(req.RequestID)
+	if !s.pool.acquire(ctx) {
+		return
+	}
+	defer s.pool.release()
+
+	decodeErr := protocol.DecompressPayload(&req, maxProxyBodySize)
+	span := s.startSpan(&req)
+	ex := s.inspector.begin(req)
+	ex.timing.received = received
+	var resp *protocol.Envelope
+	if decodeErr != nil {
+		resp = localError(http.StatusBadRequest, decodeErr.Error())
+	} else {
+		resp = s.forwardToLocal(ctx, req, st, ex)
+	}
+	if resp != nil {
+		ex.setResponse(resp)
+	}
+	if ctx.Err() != nil {
+		ex.Error = "canceled by server"
+	}
+	s.record(ex)
+	s.observeRequest(ex.Status, ex.Time)
+	endSpan(span, ex)
+	if resp == nil || ctx.Err() != nil {
+		return
+	}
+	resp.Type = protocol.TypeProxyResponse
+	resp.RequestID = req.RequestID
+	resp.Timing = ex.timing.report(resp.Status)
+	if s.serverCompress.Load() {
+		protocol.CompressPayload(resp, s.compressMin)
+	}
+	if err := s.writeEnvelope(*resp); err != nil {
+		slog.Warn("write proxy response failed", "request_id", req.RequestID, "err", err)
 	}
-	if err := s.writeEnvelope(resp); err != nil {
-		log.Printf("write proxy response failed req=%s err=%v", req.RequestID, err)
+}
+
+func localError(status int, msg string) *protocol.Envelope {
+	return &protocol.Envelope{
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Payload: []byte(msg),
 	}
 }
 
-func (s *Service) forwardToLocal(req protocol.Envelope) (int, map[string][]string, []byte) {
+// forwardToLocal performs req against the local target. It returns the
+// response envelope to send, or nil when the response was already streamed.
+func (s *Service) forwardToLocal(ctx context.Context, req protocol.Envelope, st *agentStream, ex *Exchange) *protocol.Envelope {
 	if req.Target == "" {
-		return http.StatusBadGateway, map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("missing target")
+		s.localErrors.Inc("invalid_target")
+		return localError(http.StatusBadGateway, "missing target")
 	}
 
-	body, err := base64.StdEncoding.DecodeString(req.Body)
-	if err != nil {
-		return http.StatusBadRequest, map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("invalid request body")
+	var body io.Reader
+	relay := s.newInterimRelay(req)
+	if req.Stream {
+		if st == nil {
+			return localError(http.StatusBadGateway, "streamed request without stream state")
+		}
+		body = relay.body(ex.captureRequest(st.inbound))
+	} else {
+		body = bytes.NewReader(req.Payload)
 	}
 
-	fullURL := "http://" + req.Target + req.Path
+	target, err := protocol.ParseTarget(req.Target)
+	if err != nil {
+		s.localErrors.Inc("invalid_target")
+		return localError(http.StatusBadGateway, "invalid target: "+err.Error())
+	}
+	// A unix socket has no URL host; the public hostname stands in for it.
+	reqPath := req.Rewrite.Path(req.Path)
+	fullURL := target.Scheme + "://" + target.Addr + reqPath
+	if target.Scheme == "unix" {
+		host := req.Hostname
+		if host == "" {
+			host = "localhost"
+		}
+		fullURL = "http://" + host + reqPath
+	}
 	if req.Query != "" {
 		fullURL += "?" + req.Query
 	}
 
-	localReq, err := http.NewRequest(req.Method, fullURL, bytes.NewReader(body))
+	// With a route timeout the gateway gives up waiting for the response
+	// head after it, so stop waiting on the local service then too. Other
+	// routes get the transport's response header timeout.
+	stopTimeout := func() bool { return true }
+	stopHeader := func() bool { return true }
+	if d, err := time.ParseDuration(req.Timeout); err == nil && d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stopTimeout = time.AfterFunc(d, cancel).Stop
+	} else if d := s.headerTimeout(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, stopHeader, cancel = withHeaderTimeout(ctx, d)
+		defer cancel()
+	}
+
+	localReq, err := http.NewRequestWithContext(ex.timing.trace(relay.trace(ctx)), req.Method, fullURL, body)
 	if err != nil {
-		return http.StatusBadGateway, map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("build local request failed")
+		return localError(http.StatusBadGateway, "build local request failed")
 	}
 	if req.Hostname != "" {
 		localReq.Host = req.Hostname
 	}
+	if rw := req.Rewrite; rw != nil && rw.Host != "" {
+		switch {
+		case rw.Host != protocol.RewriteHostTarget:
+			localReq.Host = rw.Host
+		case target.Scheme != "unix":
+			localReq.Host = target.Addr
+		}
+	}
 
 	for k, v := range req.Headers {
 		for _, item := range v {
@@ -279,17 +704,47 @@ func (s *Service) forwardToLocal(req protocol.Envelope) (int, map[string][]strin
 		}
 	}
 	stripHopHeaders(localReq.Header)
-
-	localResp, err := s.httpClient.Do(localReq)
-	if err != nil {
-		return http.StatusBadGateway, map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("local request failed: " + err.Error())
+	if req.HeaderRules != nil {
+		req.HeaderRules.Request.Apply(localReq.Header)
+	}
+	// HTML can only be rewritten uncompressed; the transport then asks for
+	// gzip itself and undoes it.
+	rewriteOrigins := req.Rewrite != nil && (req.Rewrite.Redirects || req.Rewrite.HTML) && req.Hostname != ""
+	if rewriteOrigins && req.Rewrite.HTML {
+		localReq.Header.Del("Accept-Encoding")
+	}
+	if req.Stream {
+		localReq.ContentLength = -1
+		if n, err := strconv.ParseInt(localReq.Header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+			localReq.ContentLength = n
+		}
+	}
+	if len(req.Trailers) > 0 {
+		localReq.Trailer = http.Header(protocol.CloneHeaders(req.Trailers))
 	}
-	defer localResp.Body.Close()
 
-	respBody, err := io.ReadAll(io.LimitReader(localResp.Body, maxProxyBodySize))
+	localResp, err := s.clientFor(target.Scheme, target.Addr).Do(localReq)
+	if !stopTimeout() {
+		if err == nil {
+			localResp.Body.Close()
+		}
+		s.localErrors.Inc("timeout")
+		return localError(http.StatusGatewayTimeout, "local request timed out after "+req.Timeout)
+	}
+	if !stopHeader() {
+		if err == nil {
+			localResp.Body.Close()
+		}
+		s.localErrors.Inc("timeout")
+		return localError(http.StatusGatewayTimeout, "local service sent no response within "+s.headerTimeout().String())
+	}
 	if err != nil {
-		return http.StatusBadGateway, map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("read local response failed")
+		if ctx.Err() == nil {
+			s.localErrors.Inc("request_failed")
+		}
+		return localError(http.StatusBadGateway, "local request failed: "+err.Error())
 	}
+	defer localResp.Body.Close()
 
 	headers := make(map[string][]string, len(localResp.Header))
 	for k, v := range localResp.Header {
@@ -298,11 +753,68 @@ func (s *Service) forwardToLocal(req protocol.Envelope) (int, map[string][]strin
 		headers[k] = copied
 	}
 	stripHopHeaders(headers)
+	var localOrigins []string
+	var publicOrigin string
+	if rewriteOrigins {
+		localOrigins = protocol.LocalOrigins(target, localReq.Host)
+		publicOrigin = publicScheme(req) + "://" + req.Hostname
+	}
+	if loc := headers["Location"]; len(loc) == 1 && req.Rewrite != nil {
+		if rewriteOrigins && req.Rewrite.Redirects {
+			headers["Location"] = []string{req.Rewrite.PublicLocation(loc[0], localOrigins, publicOrigin)}
+		} else {
+			headers["Location"] = []string{req.Rewrite.Location(loc[0])}
+		}
+	}
+	if req.HeaderRules != nil {
+		req.HeaderRules.Response.Apply(headers)
+	}
+	rewriteHTML := rewriteOrigins && req.Rewrite.HTML && isPlainHTML(headers)
+
+	if !rewriteHTML && shouldStreamResponse(req, st, localResp) {
+		s.streamResponse(req, st, localResp, headers, ex)
+		return nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(localResp.Body, maxProxyBodySize))
+	if err != nil {
+		s.localErrors.Inc("read_failed")
+		return localError(http.StatusBadGateway, "read local response failed")
+	}
+	if rewriteHTML {
+		respBody = []byte(protocol.ReplaceOrigins(string(respBody), localOrigins, publicOrigin))
+		delete(headers, "Content-Length")
+	}
+
+	return &protocol.Envelope{
+		Status:   localResp.StatusCode,
+		Headers:  headers,
+		Payload:  respBody,
+		Trailers: presentTrailers(localResp.Trailer),
+	}
+}
+
+// publicScheme is the scheme the public client used, as the gateway
+// reported it.
+func publicScheme(req protocol.Envelope) string {
+	if proto := req.Headers["X-Forwarded-Proto"]; len(proto) > 0 && proto[0] == "https" {
+		return "https"
+	}
+	return "http"
+}
 
-	return localResp.StatusCode, headers, respBody
+// isPlainHTML reports whether headers describe an HTML body without a
+// content encoding, the only kind whose origins the agent rewrites.
+func isPlainHTML(headers map[string][]string) bool {
+	if enc := headers["Content-Encoding"]; len(enc) > 0 && !strings.EqualFold(enc[0], "identity") {
+		return false
+	}
+	ct := headers["Content-Type"]
+	return len(ct) > 0 && strings.HasPrefix(strings.ToLower(strings.TrimSpace(ct[0])), "text/html")
 }
 
 func stripHopHeaders(headers map[string][]string) {
+	keepTE := wantsTrailers(headers["Te"]) || wantsTrailers(headers["te"])
 	for _, key := range []string{
 		"Connection",
 		"Proxy-Connection",
@@ -317,23 +829,46 @@ func stripHopHeaders(headers map[string][]string) {
 		delete(headers, key)
 		delete(headers, strings.ToLower(key))
 	}
+	// "TE: trailers" is hop-by-hop on paper but gRPC servers require it.
+	if keepTE {
+		headers["Te"] = []string{"trailers"}
+	}
+}
+
+func wantsTrailers(values []string) bool {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (s *Service) setConn(conn *websocket.Conn) {
+func (s *Service) setConn(conn wsconn.Conn, writer *wsconn.Writer) {
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
 	s.conn = conn
+	s.writer = writer
 }
 
-func (s *Service) clearConn(conn *websocket.Conn) {
+func (s *Service) clearConn(conn wsconn.Conn) {
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
 	if s.conn == conn {
 		s.conn = nil
+		s.writer = nil
 	}
 }
 
-func (s *Service) getConn() *websocket.Conn {
+func (s *Service) getWriter() *wsconn.Writer {
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	return s.writer
+}
+
+func (s *Service) getConn() wsconn.Conn {
 	s.connMu.RLock()
 	defer s.connMu.RUnlock()
 	return s.conn
@@ -341,8 +876,12 @@ func (s *Service) getConn() *websocket.Conn {
 
 func (s *Service) setConnected(v bool) {
 	s.statusMu.Lock()
-	defer s.statusMu.Unlock()
 	s.connected = v
+	s.statusMu.Unlock()
+	select {
+	case s.heartbeatNow <- struct{}{}:
+	default:
+	}
 }
 
 func (s *Service) setLastError(msg string) {
@@ -352,28 +891,80 @@ func (s *Service) setLastError(msg string) {
 }
 
 func (s *Service) GetStatus() Status {
+	sessionID, _ := s.getSession()
+	queueDepth := 0
+	if writer := s.getWriter(); writer != nil {
+		queueDepth = writer.Depth()
+	}
+	health := s.RouteHealth()
+	servers, _ := s.serverState()
+	serverURL := s.currentServer()
+	running, queued, rejected := s.pool.stats()
 	s.statusMu.RLock()
 	defer s.statusMu.RUnlock()
 	return Status{
 		Connected:         s.connected,
 		LastError:         s.lastError,
-		ServerURL:         s.serverURL,
+		ServerURL:         serverURL,
+		Servers:           servers,
 		AdminAddr:         s.adminAddr,
 		TokenHint:         tokenHint(s.token),
+		SessionID:         sessionID,
+		AgentVersion:      version.Version,
+		ServerVersion:     s.serverVersion,
+		ProtocolVersion:   s.protocolVersion,
+		WriteQueueDepth:   queueDepth,
+		WriteQueueDropped: s.writeDropped.Load(),
+		RequestsRunning:   running,
+		RequestsQueued:    queued,
+		RequestsRejected:  rejected,
 		RouteSyncURL:      s.routeSyncURL,
 		TunnelID:          s.tunnelID,
 		ManagedByControl:  s.routeSyncURL != "",
 		RouteSyncInterval: s.routeSyncInterval.String(),
+		RouteSyncMode:     s.routeSyncMode(),
+		Health:            health,
 	}
 }
 
 type syncedRoutesPayload struct {
 	TunnelID string           `json:"tunnel_id"`
+	Version  string           `json:"version"`
 	Routes   []protocol.Route `json:"routes"`
+
+	BaseVersion string           `json:"base_version"`
+	Added       []protocol.Route `json:"added"`
+	Removed     []string         `json:"removed"`
+}
+
+// configWatchLoop picks up hand edits to the config file and republishes
+// the routes.
+func (s *Service) configWatchLoop(ctx context.Context) {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.store.Reload()
+		if err != nil {
+			slog.Warn("config file change ignored", "err", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		slog.Info("config file changed, routes reloaded", "routes", len(s.store.List()))
+		if err := s.publishRoutes(); err != nil {
+			slog.Warn("publish reloaded routes failed", "err", err)
+		}
+	}
 }
 
 func (s *Service) routeSyncLoop(ctx context.Context) {
-	log.Printf("route sync enabled tunnel_id=%s source=%s interval=%s", s.tunnelID, s.routeSyncURL, s.routeSyncInterval)
+	slog.Info("route sync enabled", "tunnel_id", s.tunnelID, "source", s.routeSyncURL, "interval", s.routeSyncInterval)
 	ticker := time.NewTicker(s.routeSyncInterval)
 	defer ticker.Stop()
 
@@ -384,6 +975,9 @@ func (s *Service) routeSyncLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			if s.routeStreamUp.Load() {
+				continue
+			}
 			s.syncRoutesFromControl(ctx)
 		}
 	}
@@ -392,52 +986,111 @@ func (s *Service) routeSyncLoop(ctx context.Context) {
 func (s *Service) syncRoutesFromControl(ctx context.Context) {
 	reqURL, err := url.Parse(s.routeSyncURL)
 	if err != nil {
-		log.Printf("route sync parse url failed: %v", err)
+		slog.Error("route sync parse url failed", "err", err)
 		return
 	}
+	currentVersion := ""
+	if !s.forceFullRouteSync.Load() {
+		currentVersion = protocol.RoutesVersion(s.store.List())
+	}
 	q := reqURL.Query()
 	q.Set("tunnel_id", s.tunnelID)
 	q.Set("token", s.tunnelToken)
+	if currentVersion != "" {
+		q.Set("since", currentVersion)
+	}
 	reqURL.RawQuery = q.Encode()
 
 	reqCtx, cancel := context.WithTimeout(ctx, 12*time.Second)
 	defer cancel()
 	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, reqURL.String(), nil)
 	if err != nil {
-		log.Printf("route sync build request failed: %v", err)
+		slog.Error("route sync build request failed", "err", err)
 		return
 	}
+	if currentVersion != "" {
+		req.Header.Set("If-None-Match", strconv.Quote(currentVersion))
+	}
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		log.Printf("route sync request failed: %v", err)
+		slog.Warn("route sync request failed", "err", err)
+		s.routeSyncs.Inc("error")
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		s.routeSyncs.Inc("unchanged")
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
-		log.Printf("route sync failed status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+		slog.Warn("route sync failed", "status", resp.StatusCode, "body", strings.TrimSpace(string(body)))
+		s.routeSyncs.Inc("error")
 		return
 	}
 
 	var payload syncedRoutesPayload
 	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&payload); err != nil {
-		log.Printf("route sync decode failed: %v", err)
+		slog.Warn("route sync decode failed", "err", err)
+		s.routeSyncs.Inc("error")
 		return
 	}
-	changed, err := s.store.ReplaceAll(payload.Routes)
+	s.applySyncedRoutes(payload)
+}
+
+// applySyncedRoutes installs a full set or delta from the control API, whether
+// it arrived through a poll or the route stream. It reports false when a delta
+// did not apply cleanly and a full set has to be fetched.
+func (s *Service) applySyncedRoutes(payload syncedRoutesPayload) bool {
+	s.routeSyncMu.Lock()
+	defer s.routeSyncMu.Unlock()
+
+	routes := payload.Routes
+	if payload.BaseVersion != "" {
+		currentVersion := protocol.RoutesVersion(s.store.List())
+		if payload.BaseVersion != currentVersion {
+			slog.Warn("route sync delta base mismatch, requesting full set", "base", payload.BaseVersion, "local", currentVersion)
+			s.routeSyncs.Inc("mismatch")
+			s.forceFullRouteSync.Store(true)
+			return false
+		}
+		routes = protocol.ApplyRouteDelta(s.store.List(), payload.Added, payload.Removed)
+	}
+	changed, err := s.store.ReplaceAll(routes)
 	if err != nil {
-		log.Printf("route sync apply failed: %v", err)
-		return
+		slog.Error("route sync apply failed", "err", err)
+		s.routeSyncs.Inc("error")
+		return true
+	}
+	ok := true
+	if payload.Version != "" && protocol.RoutesVersion(s.store.List()) != payload.Version {
+		slog.Warn("route sync version mismatch after apply, requesting full set")
+		s.routeSyncs.Inc("mismatch")
+		s.forceFullRouteSync.Store(true)
+		ok = false
+	} else {
+		s.forceFullRouteSync.Store(false)
 	}
 	if !changed {
-		return
+		if ok {
+			s.routeSyncs.Inc("unchanged")
+		}
+		return ok
+	}
+	if ok {
+		s.routeSyncs.Inc("applied")
+	}
+	if payload.BaseVersion != "" {
+		slog.Info("route sync applied delta", "added", len(payload.Added), "removed", len(payload.Removed))
+	} else {
+		slog.Info("route sync applied", "routes", len(routes))
 	}
-	log.Printf("route sync applied %d routes", len(payload.Routes))
 	if err := s.publishRoutes(); err != nil {
-		log.Printf("route sync publish deferred: %v", err)
+		slog.Info("route sync publish deferred", "err", err)
 	}
+	return ok
 }
 
 func tokenHint(token string) string {
@@ -463,11 +1116,24 @@ func errorJSON(w http.ResponseWriter, status int, msg string) {
 }
 
 func (s *Service) adminMux() http.Handler {
+	return s.protectAdmin(s.adminRoutes())
+}
+
+// adminRoutes is the admin UI and API of this tunnel without the password
+// check, for mounting under a Supervisor.
+func (s *Service) adminRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleIndex)
 	mux.HandleFunc("/api/status", s.handleStatus)
 	mux.HandleFunc("/api/routes", s.handleRoutes)
 	mux.HandleFunc("/api/routes/", s.handleRouteByHost)
+	mux.HandleFunc("/inspect", s.handleInspectPage)
+	mux.HandleFunc("/api/inspect", s.handleInspect)
+	mux.HandleFunc("/api/inspect/", s.handleInspectReplay)
+	mux.HandleFunc("/api/live", s.handleLive)
+	mux.Handle("/metrics", s.metrics.Handler())
+	mux.Handle("/api/log-level", logging.Handler())
+	mux.Handle("/api/logs", logging.TailHandler())
 	return mux
 }
 
@@ -491,7 +1157,8 @@ func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 func (s *Service) handleRoutes(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		writeJSON(w, http.StatusOK, map[string]any{"routes": s.store.List()})
+		routes := s.store.List()
+		writeJSON(w, http.StatusOK, map[string]any{"routes": routes, "discovered": s.discoveredRoutes(routes)})
 	case http.MethodPost:
 		if s.routeSyncURL != "" {
 			errorJSON(w, http.StatusForbidden, "routes are managed by control plane")
@@ -639,13 +1306,23 @@ const indexHTML = `<!doctype html>
       font-size: 13px;
     }
     .hint { color: var(--muted); font-size: 13px; margin-top: 10px; min-height: 20px; }
+    .live { margin-top: 18px; }
+    .live-head { display: flex; justify-content: space-between; align-items: center; margin-bottom: 10px; }
+    .live-head h2 { margin: 0; font-size: 18px; }
+    .live-scroll { max-height: 420px; overflow-y: auto; }
+    .live td { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: 12px; padding: 6px 10px; white-space: nowrap; }
+    .live td.path { white-space: normal; word-break: break-all; }
+    .s2 { color: var(--ok); } .s3 { color: #0b5fff; } .s4 { color: #c77700; } .s5, .s0 { color: var(--danger); }
   </style>
 </head>
 <body>
   <div class="wrap">
     <div class="card">
+      <form id="logoutForm" method="post" action="/logout" style="display:none;float:right">
+        <button class="danger" type="submit">退出登录</button>
+      </form>
       <h1>Tunnel Agent</h1>
-      <p class="sub">配置 域名 -> 本地 IP:端口 映射。公网请求会通过隧道转发到本地服务。</p>
+      <p class="sub">配置 域名 -> 本地 IP:端口 映射。公网请求会通过隧道转发到本地服务。<a href="inspect">查看最近请求</a></p>
       <div class="status">
         <span id="statusDot" class="dot offline"></span>
         <strong id="statusText">连接中...</strong>
@@ -663,6 +1340,7 @@ const indexHTML = `<!doctype html>
           <tr>
             <th>域名</th>
             <th>本地目标</th>
+            <th>健康</th>
             <th>操作</th>
           </tr>
         </thead>
@@ -670,6 +1348,28 @@ const indexHTML = `<!doctype html>
       </table>
       <div id="hint" class="hint"></div>
     </div>
+
+    <div class="card live">
+      <div class="live-head">
+        <h2>实时请求 <span id="liveState" class="sub"></span></h2>
+        <button id="livePause" type="button">暂停</button>
+      </div>
+      <div class="live-scroll">
+        <table>
+          <thead>
+            <tr>
+              <th>时间</th>
+              <th>方法</th>
+              <th>地址</th>
+              <th>状态</th>
+              <th>耗时</th>
+              <th>收 / 发</th>
+            </tr>
+          </thead>
+          <tbody id="liveBody"></tbody>
+        </table>
+      </div>
+    </div>
   </div>
 
 <script>
@@ -678,9 +1378,22 @@ const indexHTML = `<!doctype html>
   const statusDot = document.getElementById('statusDot');
   const statusText = document.getElementById('statusText');
   const statusMeta = document.getElementById('statusMeta');
+  let lastRoutes = [];
+  let discovered = [];
+  let healthByHost = {};
+
+  function csrfToken() {
+    const m = document.cookie.match(/(?:^|; )agent_admin_csrf=([^;]*)/);
+    return m ? m[1] : '';
+  }
 
   async function fetchJSON(url, options = {}) {
+    options.headers = Object.assign({ 'X-CSRF-Token': csrfToken() }, options.headers || {});
     const resp = await fetch(url, options);
+    if (resp.status === 401) {
+      location.href = '/login?next=' + encodeURIComponent(location.pathname);
+      throw new Error('请先登录');
+    }
     const data = await resp.json().catch(() => ({}));
     if (!resp.ok) throw new Error(data.error || ('HTTP ' + resp.status));
     return data;
@@ -691,21 +1404,30 @@ const indexHTML = `<!doctype html>
     hint.style.color = isError ? '#d94848' : '#475569';
   }
 
+  function healthCell(hostname) {
+    const h = healthByHost[hostname];
+    if (!h) return '<span style="color:#94a3b8">未配置</span>';
+    if (h.healthy) return '<span style="color:#0f9d58">健康</span>';
+    return '<span style="color:#d94848" title="' + (h.last_error || '').replace(/"/g, '&quot;') + '">异常 (' + h.failures + ')</span>';
+  }
+
   function renderRoutes(routes) {
+    lastRoutes = routes || [];
     routeBody.innerHTML = '';
-    if (!routes || routes.length === 0) {
-      routeBody.innerHTML = '<tr><td colspan="3" style="color:#64748b">暂无映射</td></tr>';
+    if (lastRoutes.length === 0 && discovered.length === 0) {
+      routeBody.innerHTML = '<tr><td colspan="4" style="color:#64748b">暂无映射</td></tr>';
       return;
     }
 
 	for (const r of routes) {
 	  const tr = document.createElement('tr');
 	  tr.innerHTML = '<td>' + r.hostname + '</td>' +
-	    '<td>' + r.target + '</td>' +
+	    '<td>' + r.target + (r.split ? ' / ' + r.split.target + ' (' + r.split.weight + '%)' : '') + '</td>' +
+	    '<td>' + healthCell(r.hostname) + '</td>' +
 	    '<td><button class="danger" data-host="' + encodeURIComponent(r.hostname) + '">删除</button></td>';
       tr.querySelector('button').addEventListener('click', async () => {
         try {
-          const data = await fetchJSON('/api/routes/' + encodeURIComponent(r.hostname), { method: 'DELETE' });
+          const data = await fetchJSON('api/routes/' + encodeURIComponent(r.hostname), { method: 'DELETE' });
           renderRoutes(data.routes || []);
           showHint(data.sync_ok ? '删除成功并已同步。' : ('删除成功，但同步失败：' + (data.warning || 'unknown')));
         } catch (e) {
@@ -714,11 +1436,19 @@ const indexHTML = `<!doctype html>
       });
       routeBody.appendChild(tr);
     }
+    for (const r of discovered) {
+      if (lastRoutes.some(c => c.hostname === r.hostname)) continue;
+      const tr = document.createElement('tr');
+      tr.innerHTML = '<td>' + r.hostname + '</td><td>' + r.target + '</td>' +
+        '<td>' + healthCell(r.hostname) + '</td><td><span class="sub">' + (r.source === 'kubernetes' ? 'Kubernetes' : 'Docker') + '</span></td>';
+      routeBody.appendChild(tr);
+    }
   }
 
   async function loadRoutes() {
     try {
-      const data = await fetchJSON('/api/routes');
+      const data = await fetchJSON('api/routes');
+      discovered = data.discovered || [];
       renderRoutes(data.routes || []);
     } catch (e) {
       showHint(e.message, true);
@@ -727,11 +1457,14 @@ const indexHTML = `<!doctype html>
 
   async function loadStatus() {
     try {
-      const st = await fetchJSON('/api/status');
+      const st = await fetchJSON('api/status');
       const online = !!st.connected;
       statusDot.className = 'dot ' + (online ? 'online' : 'offline');
       statusText.textContent = online ? '隧道已连接' : '隧道未连接';
 	  statusMeta.textContent = '服务器: ' + st.server_url + ' 令牌: ' + st.token_hint;
+      healthByHost = {};
+      for (const h of (st.health || [])) healthByHost[h.hostname] = h;
+      renderRoutes(lastRoutes);
       if (!online && st.last_error) {
         showHint('最近错误: ' + st.last_error, true);
       }
@@ -747,7 +1480,7 @@ const indexHTML = `<!doctype html>
     if (!hostname || !target) return;
 
     try {
-      const data = await fetchJSON('/api/routes', {
+      const data = await fetchJSON('api/routes', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ hostname, target })
@@ -761,9 +1494,64 @@ const indexHTML = `<!doctype html>
     }
   });
 
+  const liveBody = document.getElementById('liveBody');
+  const liveState = document.getElementById('liveState');
+  const livePause = document.getElementById('livePause');
+  let livePaused = false;
+
+  function esc(s) {
+    return String(s == null ? '' : s).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+  }
+
+  function size(n) {
+    if (n < 1024) return n + 'B';
+    if (n < 1024 * 1024) return (n / 1024).toFixed(1) + 'KB';
+    return (n / 1024 / 1024).toFixed(1) + 'MB';
+  }
+
+  function addLive(ev) {
+    if (livePaused) return;
+    if (ev.dropped) {
+      const gap = document.createElement('tr');
+      gap.innerHTML = '<td colspan="6" class="sub">… 跳过 ' + ev.dropped + ' 条</td>';
+      liveBody.prepend(gap);
+    }
+    const tr = document.createElement('tr');
+    tr.title = ev.error || '';
+    tr.innerHTML = '<td>' + new Date(ev.time).toLocaleTimeString() + '</td>' +
+      '<td>' + esc(ev.method) + '</td>' +
+      '<td class="path">' + esc(ev.hostname) + esc(ev.path) + (ev.replay ? ' (重放)' : '') + '</td>' +
+      '<td class="s' + String(ev.status || 0).charAt(0) + '">' + (ev.status || '-') + '</td>' +
+      '<td>' + ev.duration_ms.toFixed(1) + 'ms</td>' +
+      '<td>' + size(ev.bytes_in) + ' / ' + size(ev.bytes_out) + '</td>';
+    liveBody.prepend(tr);
+    while (liveBody.children.length > 200) liveBody.lastChild.remove();
+  }
+
+  function connectLive() {
+    // Relative, so the page also works under /t/<name>/ of a multi-tunnel agent.
+    const url = new URL('api/live', location.href);
+    url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+    const ws = new WebSocket(url);
+    ws.onopen = () => { liveState.textContent = '· 已连接'; };
+    ws.onmessage = (m) => addLive(JSON.parse(m.data));
+    ws.onclose = () => {
+      liveState.textContent = '· 已断开，重连中...';
+      setTimeout(connectLive, 3000);
+    };
+  }
+
+  livePause.addEventListener('click', () => {
+    livePaused = !livePaused;
+    livePause.textContent = livePaused ? '继续' : '暂停';
+  });
+
+  if (csrfToken()) document.getElementById('logoutForm').style.display = '';
+  connectLive();
   loadRoutes();
   loadStatus();
   setInterval(loadStatus, 5000);
+  setInterval(loadRoutes, 5000);
 </script>
 </body>
 </html>`
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+const streamIdleTimeout = 45 * time.Second
+
+// agentStream tracks a request while the server streams its body to us and
+// while we stream the response back.
+type agentStream struct {
+	inbound *wsconn.Inbound
+	credit  wsconn.Credit
+}
+
+func (s *Service) openStream(requestID string) *agentStream {
+	st := &agentStream{
+		inbound: wsconn.NewInbound(streamIdleTimeout, func() {
+			if err := s.writeEnvelope(protocol.Envelope{Type: protocol.TypeProxyWindow, RequestID: requestID}); err != nil {
+				slog.Warn("write stream window failed", "request_id", requestID, "err", err)
+			}
+		}),
+		credit: wsconn.NewCredit(),
+	}
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if s.streams == nil {
+		s.streams = make(map[string]*agentStream)
+	}
+	s.streams[requestID] = st
+	return st
+}
+
+func (s *Service) stream(requestID string) *agentStream {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	return s.streams[requestID]
+}
+
+func (s *Service) closeStream(requestID string) {
+	s.streamsMu.Lock()
+	st := s.streams[requestID]
+	delete(s.streams, requestID)
+	s.streamsMu.Unlock()
+	if st != nil {
+		st.inbound.Abort(nil)
+	}
+}
+
+// abortStreams releases every request still reading a streamed body once the
+// connection it arrives on is gone.
+func (s *Service) abortStreams(err error) {
+	s.streamsMu.Lock()
+	streams := s.streams
+	s.streams = nil
+	s.streamsMu.Unlock()
+	for _, st := range streams {
+		st.inbound.Abort(err)
+	}
+}
+
+func (s *Service) handleStreamFrame(env protocol.Envelope) {
+	st := s.stream(env.RequestID)
+	if st == nil {
+		return
+	}
+	switch env.Type {
+	case protocol.TypeProxyRequestData:
+		if !st.inbound.Push(env) {
+			slog.Warn("server overran stream window", "request_id", env.RequestID)
+			st.inbound.Abort(errors.New("stream window exceeded"))
+		}
+	case protocol.TypeProxyWindow:
+		st.credit.Release()
+	}
+}
+
+// shouldStreamResponse keeps small, known-length bodies inline so the common
+// case stays a single envelope.
+func shouldStreamResponse(req protocol.Envelope, st *agentStream, resp *http.Response) bool {
+	if st == nil || req.Method == http.MethodHead {
+		return false
+	}
+	return resp.ContentLength < 0 || resp.ContentLength > protocol.InlineBodyLimit
+}
+
+func (s *Service) streamResponse(req protocol.Envelope, st *agentStream, localResp *http.Response, headers map[string][]string, ex *Exchange) {
+	head := protocol.Envelope{
+		Type:      protocol.TypeProxyResponse,
+		RequestID: req.RequestID,
+		Status:    localResp.StatusCode,
+		Headers:   headers,
+		Stream:    true,
+		Timing:    ex.timing.report(localResp.StatusCode),
+	}
+	if err := s.writeEnvelope(head); err != nil {
+		slog.Warn("write proxy response failed", "request_id", req.RequestID, "err", err)
+		return
+	}
+
+	writer := s.getWriter()
+	if writer == nil {
+		return
+	}
+	body := ex.captureResponse(localResp.StatusCode, headers, localResp.Body)
+	// A body of unknown length is usually flushed as it is written (SSE,
+	// long polling, NDJSON), so pass each read on without waiting for a
+	// full chunk.
+	send := wsconn.SendBody
+	if localResp.ContentLength < 0 {
+		send = wsconn.SendBodyLive
+	}
+	err := send(body, st.credit, streamIdleTimeout, writer.Done(),
+		func(end bool) protocol.Envelope {
+			return protocol.Envelope{Type: protocol.TypeProxyResponseData, RequestID: req.RequestID, End: end}
+		},
+		s.writeEnvelope,
+		func() map[string][]string { return presentTrailers(localResp.Trailer) },
+	)
+	if err != nil {
+		slog.Warn("stream proxy response failed", "request_id", req.RequestID, "err", err)
+	}
+}
+
+func presentTrailers(trailer http.Header) map[string][]string {
+	var out map[string][]string
+	for k, v := range trailer {
+		if len(v) == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string][]string, len(trailer))
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"tunneling/internal/logging"
+)
+
+// Supervisor runs several tunnels in one agent process. Each tunnel keeps
+// its own connection, reconnect loop and routes; they share one admin UI
+// that lists them all and serves each tunnel's own pages under /t/<name>/.
+type Supervisor struct {
+	adminAddr string
+	adminAuth *adminAuth
+	names     []string
+	tunnels   map[string]*Service
+}
+
+// TunnelStatus is one entry of the Supervisor's /api/tunnels.
+type TunnelStatus struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+}
+
+func NewSupervisor(adminAddr string) *Supervisor {
+	return &Supervisor{adminAddr: adminAddr, tunnels: make(map[string]*Service)}
+}
+
+// Add registers a tunnel under name, which appears in its admin path.
+func (sv *Supervisor) Add(name string, svc *Service) error {
+	if name == "" || strings.ContainsAny(name, "/?#% ") {
+		return fmt.Errorf("invalid tunnel name %q", name)
+	}
+	if _, ok := sv.tunnels[name]; ok {
+		return fmt.Errorf("duplicate tunnel name %q", name)
+	}
+	sv.names = append(sv.names, name)
+	sv.tunnels[name] = svc
+	return nil
+}
+
+// SetAdminPassword protects the combined admin UI; the tunnels' own
+// passwords are not used under a Supervisor.
+func (sv *Supervisor) SetAdminPassword(password string) {
+	sv.adminAuth = newAdminAuth(password)
+}
+
+// Run keeps every tunnel connected until ctx is done. A tunnel that gives
+// up (see Reconnect.MaxRetries) is logged and leaves the others running;
+// Run returns once all of them have stopped.
+func (sv *Supervisor) Run(ctx context.Context) error {
+	if len(sv.names) == 0 {
+		return errors.New("no tunnels configured")
+	}
+	go serveAdmin(ctx, sv.adminAddr, guardAdmin(sv.adminAuth, sv.adminAddr, sv.adminMux()))
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, name := range sv.names {
+		svc := sv.tunnels[name]
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			slog.Info("tunnel started", "tunnel", name, "server", svc.currentServer())
+			if err := svc.run(ctx); err != nil {
+				slog.Error("tunnel stopped", "tunnel", name, "err", err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("tunnel %s: %w", name, err))
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Statuses reports every tunnel in the order they were added.
+func (sv *Supervisor) Statuses() []TunnelStatus {
+	out := make([]TunnelStatus, 0, len(sv.names))
+	for _, name := range sv.names {
+		out = append(out, TunnelStatus{Name: name, Status: sv.tunnels[name].GetStatus()})
+	}
+	return out
+}
+
+func (sv *Supervisor) adminMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", sv.handleIndex)
+	mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"tunnels": sv.Statuses()})
+	})
+	mux.Handle("/api/log-level", logging.Handler())
+	mux.Handle("/api/logs", logging.TailHandler())
+	for _, name := range sv.names {
+		prefix := "/t/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, sv.tunnels[name].adminRoutes()))
+	}
+	return mux
+}
+
+func (sv *Supervisor) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = supervisorPage.Execute(w, map[string]any{"Tunnels": sv.Statuses(), "Login": sv.adminAuth != nil})
+}
+
+var supervisorPage = template.Must(template.New("tunnels").Parse(`<!doctype html>
+<html lang="zh-CN">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width, initial-scale=1" />
+  <meta http-equiv="refresh" content="5" />
+  <title>Tunnel Agent</title>
+  <style>
+    body { margin: 0; font-family: "PingFang SC", "Noto Sans SC", "Microsoft YaHei", sans-serif; background: #f4f7fb; color: #0f172a; }
+    .wrap { max-width: 980px; margin: 32px auto; padding: 0 16px; }
+    .card { background: #fff; border: 1px solid #dbe2ea; border-radius: 14px; padding: 20px; box-shadow: 0 10px 28px rgba(8, 36, 90, 0.08); }
+    h1 { margin: 0 0 6px; font-size: 24px; }
+    .sub { margin: 0 0 16px; color: #5b6b82; font-size: 14px; }
+    table { width: 100%; border-collapse: collapse; font-size: 14px; }
+    th, td { text-align: left; padding: 10px 8px; border-bottom: 1px solid #eef2f7; }
+    th { color: #5b6b82; font-weight: 600; }
+    a { color: #0b5fff; text-decoration: none; }
+    .ok { color: #16a34a; }
+    .bad { color: #d94848; }
+    button { border: 1px solid #dbe2ea; border-radius: 8px; background: #fff; padding: 4px 10px; cursor: pointer; }
+  </style>
+</head>
+<body>
+  <div class="wrap">
+    <div class="card">
+      {{if .Login}}<form method="post" action="/logout" style="float:right"><button type="submit">退出</button></form>{{end}}
+      <h1>Tunnel Agent</h1>
+      <p class="sub">本进程运行的隧道，各自独立连接和重连。点击名称管理该隧道的映射和请求。</p>
+      <table>
+        <thead><tr><th>名称</th><th>状态</th><th>服务器</th><th>Token</th><th>路由来源</th></tr></thead>
+        <tbody>
+        {{range .Tunnels}}
+          <tr>
+            <td><a href="t/{{.Name}}/">{{.Name}}</a></td>
+            <td>{{if .Status.Connected}}<span class="ok">已连接</span>{{else}}<span class="bad" title="{{.Status.LastError}}">未连接</span>{{end}}</td>
+            <td>{{.Status.ServerURL}}</td>
+            <td>{{.Status.TokenHint}}</td>
+            <td>{{if .Status.ManagedByControl}}控制台 {{.Status.TunnelID}}{{else}}本地配置{{end}}</td>
+          </tr>
+        {{end}}
+        </tbody>
+      </table>
+    </div>
+  </div>
+</body>
+</html>`))
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// SetTargetTLS configures how the agent verifies https:// route targets:
+// skip verification entirely, or trust the PEM certificates in caFile on
+// top of the system pool.
+func (s *Service) SetTargetTLS(insecureSkipVerify bool, caFile string) error {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pool, err := loadCAPool(caFile)
+		if err != nil {
+			return fmt.Errorf("target ca file: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	s.targetMu.Lock()
+	s.targetTLS = cfg
+	s.resetTargetClientsLocked()
+	s.targetMu.Unlock()
+	return nil
+}
+
+// loadCAPool returns the system pool plus the PEM certificates in file.
+func loadCAPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates in " + file)
+	}
+	return pool, nil
+}
+
+// clientFor returns the client that reaches target: one per unix socket,
+// and the shared target client for http and https.
+func (s *Service) clientFor(scheme, addr string) *http.Client {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	if scheme != "unix" {
+		return s.targetClient
+	}
+	if c := s.unixClients[addr]; c != nil {
+		return c
+	}
+	client := s.newLocalClientLocked()
+	dialer := net.Dialer{Timeout: s.local.DialTimeout}
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", addr)
+	}
+	if s.unixClients == nil {
+		s.unixClients = make(map[string]*http.Client)
+	}
+	s.unixClients[addr] = client
+	return client
+}
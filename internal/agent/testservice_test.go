@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+// newTestService returns a Service whose config file holds cfg. The server
+// URL points nowhere; tests drive the parts they need directly.
+func newTestService(t *testing.T, cfg fileConfig) *Service {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("encode config: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	store, err := NewConfigStore(path)
+	if err != nil {
+		t.Fatalf("NewConfigStore: %v", err)
+	}
+	svc, err := NewService("ws://127.0.0.1:1/connect", "tok", "127.0.0.1:0", "", "", "", 0, store)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	return svc
+}
+
+// startFakeServer points svc at a websocket server standing in for the
+// gateway and returns the agent connections it accepts.
+func startFakeServer(t *testing.T, svc *Service) <-chan *websocket.Conn {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	svc.serverMu.Lock()
+	svc.servers, svc.serverIdx = []string{"ws" + strings.TrimPrefix(srv.URL, "http") + "/connect"}, 0
+	svc.serverMu.Unlock()
+	return conns
+}
+
+// sendEnvelope writes env to the agent as the gateway would.
+func sendEnvelope(t *testing.T, conn *websocket.Conn, env protocol.Envelope) {
+	t.Helper()
+	frame, err := protocol.EncodeJSON(env)
+	if err != nil {
+		t.Fatalf("encode %s: %v", env.Type, err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		t.Fatalf("send %s: %v", env.Type, err)
+	}
+}
+
+// readResponse reads from the agent until the proxy_response for requestID.
+func readResponse(t *testing.T, conn *websocket.Conn, requestID string) protocol.Envelope {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		env, err := wsconn.ReadEnvelope(conn)
+		if err != nil {
+			t.Fatalf("read response for %s: %v", requestID, err)
+		}
+		if env.Type == protocol.TypeProxyResponse && env.RequestID == requestID {
+			return env
+		}
+	}
+}
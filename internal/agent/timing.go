@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// localTiming records the dial and time to first byte of one local request.
+// The transport may run the trace hooks on its own goroutines.
+type localTiming struct {
+	mu sync.Mutex
+	// received is when the request reached the agent, before it waited
+	// for a free slot in the pool.
+	received  time.Time
+	started   time.Time
+	dialStart time.Time
+	dial      time.Duration
+	ttfb      time.Duration
+}
+
+// trace starts the clock and hooks t into the local request.
+func (t *localTiming) trace(ctx context.Context) context.Context {
+	t.mu.Lock()
+	t.started = time.Now()
+	t.mu.Unlock()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.dialStart.IsZero() {
+				t.dialStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.dialStart.IsZero() && t.dial == 0 {
+				t.dial = time.Since(t.dialStart)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.ttfb = time.Since(t.started)
+		},
+	})
+}
+
+// report builds the Timing of a request answered with status. Without a
+// local response head the agent answered itself.
+func (t *localTiming) report(status int) *protocol.Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := &protocol.Timing{
+		DialMS:  protocol.Millis(t.dial),
+		TTFBMS:  protocol.Millis(t.ttfb),
+		TotalMS: protocol.Millis(time.Since(t.received)),
+		Status:  protocol.StatusClass(status),
+	}
+	if t.ttfb == 0 {
+		out.Status = protocol.StatusError
+	}
+	return out
+}
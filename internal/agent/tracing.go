@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"net/http"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/tracing"
+)
+
+// SetTracer records a client span around every call to the local service,
+// continuing the trace the server started; nil turns tracing off.
+func (s *Service) SetTracer(t *tracing.Tracer) {
+	s.tracer = t
+}
+
+// startSpan opens the span for req and points the traceparent the local
+// service sees at it.
+func (s *Service) startSpan(req *protocol.Envelope) *tracing.Span {
+	if s.tracer == nil {
+		return nil
+	}
+	var parent tracing.SpanContext
+	if v := req.Headers["Traceparent"]; len(v) > 0 {
+		parent, _ = tracing.ParseTraceparent(v[0])
+	}
+	span := s.tracer.Start(parent, req.Method, tracing.KindClient)
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("url.path", req.Path)
+	span.SetAttr("server.address", req.Target)
+	span.SetAttr("tunnel.hostname", req.Hostname)
+	span.SetAttr("tunnel.request_id", req.RequestID)
+	if req.Headers == nil {
+		req.Headers = map[string][]string{}
+	}
+	req.Headers["Traceparent"] = []string{span.Context().Traceparent()}
+	return span
+}
+
+func endSpan(span *tracing.Span, ex *Exchange) {
+	if span == nil {
+		return
+	}
+	if ex.Status > 0 {
+		span.SetAttr("http.response.status_code", ex.Status)
+	}
+	switch {
+	case ex.Error != "":
+		span.SetError(ex.Error)
+	case ex.Status == 0:
+		span.SetError("no response")
+	case ex.Status >= 500:
+		span.SetError(http.StatusText(ex.Status))
+	}
+	span.End()
+}
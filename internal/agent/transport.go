@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// LocalTransport tunes the connections to route targets.
+type LocalTransport struct {
+	// MaxIdleConnsPerHost keeps this many connections per target open for
+	// reuse.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	// ResponseHeaderTimeout bounds the wait for a response head once the
+	// request has been written; a route's own timeout replaces it.
+	ResponseHeaderTimeout time.Duration
+}
+
+var defaultLocalTransport = LocalTransport{
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	DialTimeout:           10 * time.Second,
+	ResponseHeaderTimeout: 45 * time.Second,
+}
+
+// SetLocalTransport replaces the target transport settings; zero fields
+// keep their defaults.
+func (s *Service) SetLocalTransport(t LocalTransport) error {
+	if t.MaxIdleConnsPerHost < 0 || t.IdleConnTimeout < 0 || t.DialTimeout < 0 || t.ResponseHeaderTimeout < 0 {
+		return errors.New("local transport settings must not be negative")
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = defaultLocalTransport.MaxIdleConnsPerHost
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = defaultLocalTransport.IdleConnTimeout
+	}
+	if t.DialTimeout == 0 {
+		t.DialTimeout = defaultLocalTransport.DialTimeout
+	}
+	if t.ResponseHeaderTimeout == 0 {
+		t.ResponseHeaderTimeout = defaultLocalTransport.ResponseHeaderTimeout
+	}
+	s.targetMu.Lock()
+	s.local = t
+	s.resetTargetClientsLocked()
+	s.targetMu.Unlock()
+	return nil
+}
+
+// newLocalClientLocked builds a client for route targets. It has no overall
+// timeout, since streamed bodies may legitimately take longer than any fixed
+// limit, and the response head deadline is applied per request by
+// forwardToLocal. Local services are reached directly, whatever proxy the
+// environment names.
+func (s *Service) newLocalClientLocked() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.TLSClientConfig = s.targetTLS
+	transport.MaxIdleConnsPerHost = s.local.MaxIdleConnsPerHost
+	transport.MaxIdleConns = max(transport.MaxIdleConns, s.local.MaxIdleConnsPerHost)
+	transport.IdleConnTimeout = s.local.IdleConnTimeout
+	dialer := &net.Dialer{Timeout: s.local.DialTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
+
+func (s *Service) resetTargetClientsLocked() {
+	if s.targetClient != nil {
+		s.targetClient.CloseIdleConnections()
+	}
+	for _, c := range s.unixClients {
+		c.CloseIdleConnections()
+	}
+	s.targetClient = s.newLocalClientLocked()
+	s.unixClients = nil
+}
+
+// withHeaderTimeout cancels the request when no response head arrived
+// within d of it being fully written. stop reports false if it fired.
+func withHeaderTimeout(ctx context.Context, d time.Duration) (_ context.Context, stop func() bool, cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(ctx)
+	var (
+		mu    sync.Mutex
+		timer *time.Timer
+		done  bool
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !done && timer == nil {
+				timer = time.AfterFunc(d, cancel)
+			}
+		},
+	})
+	stop = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		return timer == nil || timer.Stop()
+	}
+	return ctx, stop, cancel
+}
+
+func (s *Service) headerTimeout() time.Duration {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	return s.local.ResponseHeaderTimeout
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/muxconn"
+	"tunneling/internal/protocol"
+	"tunneling/internal/server"
+)
+
+func TestYamuxTransportCarriesRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	ts := server.New(server.Options{RequestTimeout: 10 * time.Second})
+	connects := make(chan url.Values, 4)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connects <- r.URL.Query()
+		ts.HandleConnect(w, r)
+	}))
+	defer gateway.Close()
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+
+	svc := newTestService(t, fileConfig{Routes: []protocol.Route{{Hostname: "app.test", Target: strings.TrimPrefix(backend.URL, "http://")}}})
+	if err := svc.SetTransport(TransportYamux); err != nil {
+		t.Fatalf("SetTransport: %v", err)
+	}
+	svc.serverMu.Lock()
+	svc.servers, svc.serverIdx = []string{"ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect"}, 0
+	svc.serverMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatal("route was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if q := <-connects; q.Get("transport") != TransportYamux {
+		t.Fatalf("connect query %v does not ask for yamux", q)
+	}
+	if _, ok := svc.getConn().(*muxconn.Conn); !ok {
+		t.Fatalf("agent connection is %T, want a yamux session", svc.getConn())
+	}
+
+	// Small bodies go inline, the large one is streamed in data frames.
+	bodies := []string{"", "ping", strings.Repeat("0123456789", 200_000)}
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		body := bodies[i%len(bodies)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, public.URL+"/", strings.NewReader(body))
+			req.Host = "app.test"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("public request: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(got, []byte(body)) {
+				t.Errorf("response %d with %d bytes, want 200 with %d", resp.StatusCode, len(got), len(body))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestYamuxFallsBackToWebSocket(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	if err := svc.SetTransport(TransportYamux); err != nil {
+		t.Fatalf("SetTransport: %v", err)
+	}
+	conns := startFakeServer(t, svc)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.run(ctx) }()
+
+	conn := <-conns
+	var env protocol.Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != protocol.TypeHello {
+		t.Fatalf("first envelope = %+v, %v; want the hello on the plain websocket", env, err)
+	}
+	if _, ok := svc.getConn().(*websocket.Conn); !ok {
+		t.Fatalf("agent connection is %T, want the websocket", svc.getConn())
+	}
+}
+
+func TestSetTransport(t *testing.T) {
+	svc := newTestService(t, fileConfig{})
+	for _, name := range []string{"", "websocket", "yamux", "quic"} {
+		if err := svc.SetTransport(name); err != nil {
+			t.Errorf("SetTransport(%q) = %v", name, err)
+		}
+	}
+	if err := svc.SetTransport("smux"); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", "smux")) {
+		t.Errorf("SetTransport(smux) = %v, want unsupported", err)
+	}
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"tunneling/internal/server"
+)
+
+// newACMEManager issues certificates on demand for every hostname that is
+// routed at handshake time, plus the statically configured extra hosts.
+// HTTP-01 is answered by wrapping the plain HTTP handler and TLS-ALPN-01 by
+// the manager's TLS config, so either challenge type works.
+func newACMEManager(ts *server.TunnelServer, cacheDir, email, directoryURL string, extraHosts []string) *autocert.Manager {
+	static := make(map[string]bool, len(extraHosts))
+	for _, host := range extraHosts {
+		static[strings.ToLower(host)] = true
+	}
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		Email:  email,
+		HostPolicy: func(_ context.Context, host string) error {
+			if static[host] || ts.HasRoute(host) {
+				return nil
+			}
+			return fmt.Errorf("acme: host %q is not routed", host)
+		},
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m
+}
+
+func serveHTTPS(srv *http.Server, m *autocert.Manager) error {
+	srv.TLSConfig = m.TLSConfig()
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	if http2Disabled(srv) {
+		srv.TLSConfig.NextProtos = withoutH2(srv.TLSConfig.NextProtos)
+	}
+	slog.Info("https gateway listening", "addr", srv.Addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("https gateway failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"tunneling/internal/agent"
+	"tunneling/internal/protocol"
+)
+
+// agentEnv names the environment variables that take precedence over the
+// config file for agent flags.
+var agentEnv = map[string]string{
+	"admin-password": "TUNNEL_AGENT_ADMIN_PASSWORD",
+}
+
+// Agent runs the tunnel agent until ctx is done. `agent http <port>` exposes a
+// single local port through a throwaway session instead, `agent routes`,
+// `agent status` and `agent logs` manage a running agent through its admin
+// API, and `agent service` installs it as a system service.
+func Agent(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "http":
+			return agentHTTP(ctx, args[1:])
+		case "routes":
+			return agentRoutes(ctx, args[1:])
+		case "status":
+			return agentStatus(ctx, args[1:])
+		case "logs":
+			return agentLogs(ctx, args[1:])
+		case "service":
+			return agentService(ctx, args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	var (
+		serverURL         = fs.String("server", "ws://127.0.0.1:9000/connect", "websocket server url, e.g. ws://your-server:9000/connect; a comma separated list fails over between servers, most preferred first; \"auto\" asks the control plane at -route-sync-url")
+		token             = fs.String("token", "", "agent token used to connect tunnel server")
+		adminAddr         = fs.String("admin-addr", "127.0.0.1:7000", "local admin ui address")
+		adminPassword     = fs.String("admin-password", os.Getenv("TUNNEL_AGENT_ADMIN_PASSWORD"), "password for the admin ui; scripts send it as a bearer token (empty leaves the admin ui open)")
+		config            = fs.String("config", defaultConfigPath(), "config file path")
+		routeSyncURL      = fs.String("route-sync-url", "", "control plane endpoint, e.g. http://your-server:18100/agent/routes")
+		tunnelID          = fs.String("tunnel-id", "", "tunnel id for route sync")
+		tunnelToken       = fs.String("tunnel-token", "", "tunnel token for route sync auth")
+		routeSyncInterval = fs.Duration("route-sync-interval", 5*time.Second, "route sync polling interval")
+		maxConcurrent     = fs.Int("max-concurrent-requests", 0, "forward at most this many requests to local services at once (0 is unlimited)")
+		requestQueue      = fs.Int("request-queue", 100, "requests that may wait for a free slot under -max-concurrent-requests; the rest get a 503")
+		localIdlePerHost  = fs.Int("local-max-idle-conns-per-host", 32, "idle connections kept open per route target for reuse")
+		localIdleTimeout  = fs.Duration("local-idle-conn-timeout", 90*time.Second, "close idle connections to route targets after this long")
+		localDialTimeout  = fs.Duration("local-dial-timeout", 10*time.Second, "timeout for connecting to a route target")
+		localHeadTimeout  = fs.Duration("local-response-header-timeout", 45*time.Second, "how long a route target may take to start its response once the request is sent; a route's timeout replaces it")
+		drainTimeout      = fs.Duration("drain-timeout", 30*time.Second, "on shutdown, how long to let in-flight requests finish before closing the connection (0 closes at once)")
+		region            = fs.String("region", "", "region whose tunnel servers are preferred with -server auto")
+		targetInsecure    = fs.Bool("target-insecure-skip-verify", false, "do not verify certificates of https:// route targets (self-signed local services)")
+		targetCAFile      = fs.String("target-ca-file", "", "PEM file with extra CA certificates trusted for https:// route targets")
+		compressMin       = fs.Int("compress-min-bytes", protocol.DefaultCompressMinBytes, "gzip response bodies of at least this size inside the tunnel when the server supports it (0 disables compression both ways)")
+		docker            = fs.Bool("docker", false, "publish a route for every running container labelled tunneling.hostname (and tunneling.port), following container starts and stops")
+		dockerHost        = fs.String("docker-host", "", "docker endpoint for -docker, unix:///path or tcp://host:port (empty uses DOCKER_HOST or /var/run/docker.sock)")
+		kubernetes        = fs.Bool("kubernetes", false, "publish routes for Services annotated tunneling.io/hostname and Ingresses of class tunneling")
+		kubeAPI           = fs.String("kubernetes-api", "", "kubernetes api for -kubernetes without the in-cluster service account, e.g. http://127.0.0.1:8001 from kubectl proxy")
+		kubeNamespace     = fs.String("kubernetes-namespace", "", "namespace to watch with -kubernetes, * for all (empty: the agent's own namespace in the cluster, all via -kubernetes-api)")
+		configFile        = fs.String("config-file", "", "YAML file with defaults for these flags, keyed by flag name")
+	)
+	var labels stringList
+	fs.Var(&labels, "label", "key=value reported to the tunnel server and control plane with the agent's version and platform, e.g. env=staging; repeatable")
+	serverConn := addServerConnFlags(fs)
+	logs := addLogFlags(fs)
+	traces := addTraceFlags(fs, "tunnel-agent")
+	_ = fs.Parse(args)
+	var tunnels []tunnelConfig
+	if err := applyConfigFileSections(fs, *configFile, agentEnv, map[string]any{"tunnels": &tunnels}); err != nil {
+		return err
+	}
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	if len(tunnels) == 0 && *token == "" {
+		return errors.New("-token is required")
+	}
+	if len(tunnels) > 0 {
+		if *token != "" {
+			return errors.New("-token and tunnels in the config file are exclusive; give each tunnel its own token")
+		}
+		if *docker || *kubernetes {
+			return errors.New("-docker and -kubernetes publish to a single tunnel; they cannot be used with tunnels in the config file")
+		}
+	}
+
+	tracer, err := traces.start(ctx)
+	if err != nil {
+		return err
+	}
+	newService := func(serverURL, token, routeSyncURL, tunnelID, tunnelToken, configPath string) (*agent.Service, error) {
+		store, err := agent.NewConfigStore(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("load config failed: %w", err)
+		}
+		svc, err := agent.NewService(serverURL, token, *adminAddr, routeSyncURL, tunnelID, tunnelToken, *routeSyncInterval, store)
+		if err != nil {
+			return nil, fmt.Errorf("create service failed: %w", err)
+		}
+		svc.SetCompression(*compressMin)
+		svc.SetRegion(*region)
+		svc.SetDrainTimeout(*drainTimeout)
+		if err := svc.SetLabels(labels); err != nil {
+			return nil, fmt.Errorf("-label: %w", err)
+		}
+		svc.SetAdminPassword(*adminPassword)
+		if *docker {
+			if err := svc.EnableDocker(*dockerHost); err != nil {
+				return nil, err
+			}
+		}
+		if *kubernetes {
+			if err := svc.EnableKubernetes(*kubeAPI, *kubeNamespace); err != nil {
+				return nil, err
+			}
+		}
+		svc.SetTracer(tracer)
+		if err := svc.SetConcurrency(*maxConcurrent, *requestQueue); err != nil {
+			return nil, err
+		}
+		if err := svc.SetLocalTransport(agent.LocalTransport{
+			MaxIdleConnsPerHost:   *localIdlePerHost,
+			IdleConnTimeout:       *localIdleTimeout,
+			DialTimeout:           *localDialTimeout,
+			ResponseHeaderTimeout: *localHeadTimeout,
+		}); err != nil {
+			return nil, err
+		}
+		if err := serverConn.apply(svc); err != nil {
+			return nil, err
+		}
+		if *targetInsecure || *targetCAFile != "" {
+			if err := svc.SetTargetTLS(*targetInsecure, *targetCAFile); err != nil {
+				return nil, err
+			}
+		}
+		return svc, nil
+	}
+
+	if len(tunnels) > 0 {
+		sv := agent.NewSupervisor(*adminAddr)
+		sv.SetAdminPassword(*adminPassword)
+		for _, t := range tunnels {
+			if t.Name == "" {
+				return errors.New("every tunnel in the config file needs a name")
+			}
+			if t.Token == "" {
+				return fmt.Errorf("tunnel %q: token is required", t.Name)
+			}
+			t.defaults(*serverURL, *routeSyncURL, *config)
+			svc, err := newService(t.Server, t.Token, t.RouteSyncURL, t.TunnelID, t.TunnelToken, t.Config)
+			if err != nil {
+				return fmt.Errorf("tunnel %q: %w", t.Name, err)
+			}
+			if err := sv.Add(t.Name, svc); err != nil {
+				return err
+			}
+		}
+		slog.Info("agent started", "tunnels", len(tunnels))
+		if err := sv.Run(ctx); err != nil {
+			return fmt.Errorf("agent exited with error: %w", err)
+		}
+		slog.Info("agent exited")
+		return nil
+	}
+
+	svc, err := newService(*serverURL, *token, *routeSyncURL, *tunnelID, *tunnelToken, *config)
+	if err != nil {
+		return err
+	}
+	slog.Info("agent started", "config", *config)
+	if err := svc.Run(ctx); err != nil {
+		return fmt.Errorf("agent exited with error: %w", err)
+	}
+	slog.Info("agent exited")
+	return nil
+}
+
+// tunnelConfig is one entry of the tunnels list in the agent's config
+// file. Every tunnel gets its own connection, reconnect loop and route
+// store; the agent flags apply to all of them.
+type tunnelConfig struct {
+	Name         string `yaml:"name"`
+	Server       string `yaml:"server"`
+	Token        string `yaml:"token"`
+	Config       string `yaml:"config"`
+	RouteSyncURL string `yaml:"route-sync-url"`
+	TunnelID     string `yaml:"tunnel-id"`
+	TunnelToken  string `yaml:"tunnel-token"`
+}
+
+// defaults fills what the entry leaves out from the agent flags. The
+// route store defaults to <name>.json next to -config, so tunnels never
+// share one.
+func (t *tunnelConfig) defaults(serverURL, routeSyncURL, config string) {
+	if t.Server == "" {
+		t.Server = serverURL
+	}
+	if t.RouteSyncURL == "" {
+		t.RouteSyncURL = routeSyncURL
+	}
+	if t.Config == "" {
+		t.Config = filepath.Join(filepath.Dir(config), t.Name+".json")
+	}
+}
+
+// serverConnFlags are the flags for reaching a tunnel server and control
+// plane: TLS verification of wss:// servers, an egress proxy, the
+// transport and the reconnect policy.
+type serverConnFlags struct {
+	caFile     *string
+	insecure   *bool
+	serverName *string
+	minVersion *string
+	proxy      *string
+	transport  *string
+
+	reconnectInitial *time.Duration
+	reconnectMax     *time.Duration
+	reconnectJitter  *float64
+	reconnectRetries *int
+	reconnectHealthy *time.Duration
+}
+
+func addServerConnFlags(fs *flag.FlagSet) *serverConnFlags {
+	return &serverConnFlags{
+		caFile:     fs.String("server-ca-file", "", "PEM file with extra CA certificates trusted for a wss:// or quic server"),
+		insecure:   fs.Bool("server-insecure-skip-verify", false, "do not verify the wss:// or quic server certificate (labs only)"),
+		serverName: fs.String("server-name", "", "TLS server name (SNI) to send and verify instead of the -server host"),
+		minVersion: fs.String("server-tls-min-version", "", "lowest TLS version accepted from the server: 1.2 or 1.3"),
+		proxy:      fs.String("proxy", "", "http://, https:// or socks5:// proxy for the server and control plane (empty uses HTTPS_PROXY / HTTP_PROXY / NO_PROXY)"),
+		transport:  fs.String("transport", agent.TransportWebSocket, "how to carry the server connection: websocket; yamux for a stream per request on top of it (servers without yamux stay on websocket); or quic to the UDP port of -server, for servers run with -transport quic"),
+
+		reconnectInitial: fs.Duration("reconnect-initial", time.Second, "wait before the first reconnect; doubles after every failure"),
+		reconnectMax:     fs.Duration("reconnect-max", 10*time.Second, "longest wait between reconnects"),
+		reconnectJitter:  fs.Float64("reconnect-jitter", 0.5, "shorten each reconnect wait by a random fraction of up to this much (0-1)"),
+		reconnectRetries: fs.Int("reconnect-max-retries", 0, "exit after this many failed connection attempts in a row (0 retries forever)"),
+		reconnectHealthy: fs.Duration("reconnect-healthy-after", time.Minute, "how long a connection must last before the reconnect backoff starts over"),
+	}
+}
+
+func (f *serverConnFlags) apply(svc *agent.Service) error {
+	if err := svc.SetReconnect(agent.Reconnect{
+		Initial:      *f.reconnectInitial,
+		Max:          *f.reconnectMax,
+		Jitter:       *f.reconnectJitter,
+		MaxRetries:   *f.reconnectRetries,
+		HealthyAfter: *f.reconnectHealthy,
+	}); err != nil {
+		return err
+	}
+	if err := svc.SetTransport(*f.transport); err != nil {
+		return fmt.Errorf("-transport: %w", err)
+	}
+	if *f.transport == agent.TransportQUIC && *f.proxy != "" {
+		return errors.New("-proxy does not apply to -transport quic")
+	}
+	if *f.proxy != "" {
+		if err := svc.SetProxy(*f.proxy); err != nil {
+			return err
+		}
+	}
+	opts := agent.ServerTLS{CAFile: *f.caFile, InsecureSkipVerify: *f.insecure, ServerName: *f.serverName, MinVersion: *f.minVersion}
+	if opts == (agent.ServerTLS{}) {
+		return nil
+	}
+	return svc.SetServerTLS(opts)
+}
+
+// client returns the client for control plane calls made outside the
+// agent service.
+func (f *serverConnFlags) client() (*http.Client, error) {
+	if *f.proxy == "" {
+		return http.DefaultClient, nil
+	}
+	u, err := url.Parse(*f.proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q", *f.proxy)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return &http.Client{Transport: transport}, nil
+}
+
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "./agent-config.json"
+	}
+	legacy := filepath.Join(home, ".tunneling-agent", "config.json")
+	// Windows keeps application data under %APPDATA%; a route file from
+	// before that change stays where it is.
+	if runtime.GOOS == "windows" {
+		if _, err := os.Stat(legacy); err != nil {
+			if dir, err := os.UserConfigDir(); err == nil {
+				return filepath.Join(dir, "tunneling-agent", "config.json")
+			}
+		}
+	}
+	return legacy
+}
@@ -0,0 +1,257 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"tunneling/internal/agent"
+	"tunneling/internal/protocol"
+)
+
+// adminFlags locate the admin API of a running agent.
+type adminFlags struct {
+	addr     *string
+	password *string
+	tunnel   *string
+}
+
+func addAdminFlags(fs *flag.FlagSet) *adminFlags {
+	return &adminFlags{
+		addr:     fs.String("admin-addr", envOr("TUNNEL_AGENT_ADMIN_ADDR", "127.0.0.1:7000"), "admin address of the running agent"),
+		password: fs.String("admin-password", os.Getenv("TUNNEL_AGENT_ADMIN_PASSWORD"), "the agent's -admin-password, if it has one"),
+		tunnel:   fs.String("tunnel", "", "name of the tunnel to manage when the agent runs several (tunnels in its config file)"),
+	}
+}
+
+// adminClient calls the admin API of a running agent.
+type adminClient struct {
+	base     string
+	password string
+	http     *http.Client
+}
+
+func (f *adminFlags) client() *adminClient {
+	base := strings.TrimRight(strings.TrimSpace(*f.addr), "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	if *f.tunnel != "" {
+		base += "/t/" + url.PathEscape(*f.tunnel)
+	}
+	return &adminClient{base: base, password: *f.password, http: &http.Client{}}
+}
+
+func (c *adminClient) request(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.password != "" {
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reach agent admin api at %s (is the agent running? see -admin-addr): %w", c.base, err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	msg := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error != "" {
+		msg = apiErr.Error
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("agent admin api: %s; pass -admin-password or set TUNNEL_AGENT_ADMIN_PASSWORD", msg)
+	}
+	return nil, fmt.Errorf("agent admin api: %s (%s)", msg, resp.Status)
+}
+
+func (c *adminClient) getJSON(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// agentRoutes runs `agent routes list|add|rm`.
+func agentRoutes(ctx context.Context, args []string) error {
+	usage := "usage: agent routes list [flags] | add [flags] <hostname> <target> | rm [flags] <hostname>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	verb := args[0]
+	fs := flag.NewFlagSet("agent routes "+verb, flag.ExitOnError)
+	admin := addAdminFlags(fs)
+	asJSON := fs.Bool("json", false, "print the api response as JSON")
+	_ = fs.Parse(args[1:])
+	c := admin.client()
+
+	var result struct {
+		Routes     []protocol.Route `json:"routes"`
+		Discovered []struct {
+			protocol.Route
+			Source string `json:"source"`
+		} `json:"discovered,omitempty"`
+		SyncOK  *bool  `json:"sync_ok"`
+		Warning string `json:"warning"`
+	}
+	switch verb {
+	case "list", "ls":
+		if fs.NArg() != 0 {
+			return errors.New(usage)
+		}
+		if err := c.getJSON(ctx, http.MethodGet, "/api/routes", nil, &result); err != nil {
+			return err
+		}
+	case "add":
+		if fs.NArg() != 2 {
+			return errors.New(usage)
+		}
+		body := map[string]string{"hostname": fs.Arg(0), "target": fs.Arg(1)}
+		if err := c.getJSON(ctx, http.MethodPost, "/api/routes", body, &result); err != nil {
+			return err
+		}
+	case "rm", "remove":
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		if err := c.getJSON(ctx, http.MethodDelete, "/api/routes/"+url.PathEscape(fs.Arg(0)), nil, &result); err != nil {
+			return err
+		}
+	default:
+		return errors.New(usage)
+	}
+
+	if *asJSON {
+		return printJSON(result)
+	}
+	if result.SyncOK != nil && !*result.SyncOK {
+		fmt.Fprintf(os.Stderr, "saved, but syncing with the server failed: %s\n", result.Warning)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tTARGET\tTIMEOUT")
+	for _, r := range result.Routes {
+		target := r.Target
+		if r.Split != nil {
+			target += fmt.Sprintf(", %d%% to %s", r.Split.Weight, r.Split.Target)
+		}
+		if r.Mirror != nil {
+			target += fmt.Sprintf(", mirror %d%% to %s", r.Mirror.Percent, r.Mirror.Target)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Hostname, target, orDash(r.Timeout))
+	}
+	for _, r := range result.Discovered {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Hostname, r.Target+" ("+r.Source+")", orDash(r.Timeout))
+	}
+	return tw.Flush()
+}
+
+// agentStatus runs `agent status`.
+func agentStatus(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("agent status", flag.ExitOnError)
+	admin := addAdminFlags(fs)
+	asJSON := fs.Bool("json", false, "print the api response as JSON")
+	_ = fs.Parse(args)
+
+	var st agent.Status
+	if err := admin.client().getJSON(ctx, http.MethodGet, "/api/status", nil, &st); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(st)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	connected := "no"
+	if st.Connected {
+		connected = "yes"
+	}
+	fmt.Fprintf(tw, "connected\t%s\n", connected)
+	if st.LastError != "" {
+		fmt.Fprintf(tw, "last error\t%s\n", st.LastError)
+	}
+	fmt.Fprintf(tw, "server\t%s\n", st.ServerURL)
+	fmt.Fprintf(tw, "session\t%s\n", orDash(st.SessionID))
+	fmt.Fprintf(tw, "token\t%s\n", st.TokenHint)
+	fmt.Fprintf(tw, "tunnel\t%s\n", orDash(st.TunnelID))
+	fmt.Fprintf(tw, "version\tagent %s, server %s, protocol %s\n", st.AgentVersion, orDash(st.ServerVersion), orDash(strconv.Itoa(st.ProtocolVersion)))
+	routes := "local config"
+	if st.ManagedByControl {
+		routes = "control plane (" + st.RouteSyncMode + ")"
+	}
+	fmt.Fprintf(tw, "routes\t%s\n", routes)
+	fmt.Fprintf(tw, "requests\t%d running, %d queued, %d rejected\n", st.RequestsRunning, st.RequestsQueued, st.RequestsRejected)
+	for _, h := range st.Health {
+		state := "healthy"
+		if !h.Healthy {
+			state = fmt.Sprintf("unhealthy (%d failures): %s", h.Failures, h.LastError)
+		}
+		fmt.Fprintf(tw, "health %s\t%s\n", h.Hostname, state)
+	}
+	return tw.Flush()
+}
+
+// agentLogs runs `agent logs`.
+func agentLogs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("agent logs", flag.ExitOnError)
+	admin := addAdminFlags(fs)
+	lines := fs.Int("n", 100, "number of recent lines to print")
+	follow := fs.Bool("f", false, "keep printing new lines until interrupted")
+	_ = fs.Parse(args)
+
+	c := admin.client()
+	path := "/api/logs?lines=" + strconv.Itoa(*lines)
+	if *follow {
+		path += "&follow=1"
+	}
+	resp, err := c.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" || s == "0" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAgentRoutesTalksToAdminAPI(t *testing.T) {
+	type call struct{ method, path, auth, body string }
+	calls := make(chan call, 4)
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls <- call{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization"), string(body)}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true,"sync_ok":true,"routes":[{"hostname":"app.test","target":"127.0.0.1:3000"}]}`))
+	}))
+	defer admin.Close()
+
+	addr := strings.TrimPrefix(admin.URL, "http://")
+	ctx := context.Background()
+	if err := Agent(ctx, []string{"routes", "add", "-admin-addr", addr, "-admin-password", "pw", "app.test", "127.0.0.1:3000"}); err != nil {
+		t.Fatalf("routes add: %v", err)
+	}
+	got := <-calls
+	if got.method != http.MethodPost || got.path != "/api/routes" || got.auth != "Bearer pw" || !strings.Contains(got.body, `"hostname":"app.test"`) {
+		t.Fatalf("routes add sent %+v", got)
+	}
+	if err := Agent(ctx, []string{"routes", "rm", "-admin-addr", addr, "app.test"}); err != nil {
+		t.Fatalf("routes rm: %v", err)
+	}
+	if got := <-calls; got.method != http.MethodDelete || got.path != "/api/routes/app.test" || got.auth != "" {
+		t.Fatalf("routes rm sent %+v", got)
+	}
+	if err := Agent(ctx, []string{"routes", "add", "-admin-addr", addr, "app.test"}); err == nil {
+		t.Fatal("routes add with one argument should fail")
+	}
+}
+
+func TestAgentStatusReportsAuthFailure(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"login required"}`))
+	}))
+	defer admin.Close()
+
+	err := Agent(context.Background(), []string{"status", "-admin-addr", admin.URL})
+	if err == nil || !strings.Contains(err.Error(), "login required") || !strings.Contains(err.Error(), "-admin-password") {
+		t.Fatalf("status error = %v", err)
+	}
+}
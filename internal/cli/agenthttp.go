@@ -0,0 +1,229 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunneling/internal/agent"
+	"tunneling/internal/protocol"
+)
+
+// registeredSession is the part of /api/sessions/register we need to run the
+// agent for a throwaway tunnel.
+type registeredSession struct {
+	Tunnel struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	} `json:"tunnel"`
+	PublicURL    string `json:"public_url"`
+	AgentServer  string `json:"agent_server"`
+	RouteSyncURL string `json:"route_sync_url"`
+}
+
+// agentHTTP implements `agent http <port>`: register an ephemeral session,
+// serve it until ctx is done and delete the tunnel on the way out.
+func agentHTTP(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("http", flag.ExitOnError)
+	var (
+		controlAPI = fs.String("control", envOr("CONTROL_API_BASE", "http://152.32.214.95:18100"), "control plane base url")
+		domain     = fs.String("domain", envOr("BASE_DOMAIN", "vyibc.com"), "base domain for the generated hostname")
+		subdomain  = fs.String("subdomain", "", "subdomain label (random when empty)")
+		userID     = fs.String("user", currentUser(), "user id recorded with the session")
+		serverURL  = fs.String("server", "", "websocket server url (defaults to the one returned by the control plane)")
+		adminAddr  = fs.String("admin-addr", "127.0.0.1:7000", "local admin ui address")
+		adminPass  = fs.String("admin-password", os.Getenv("TUNNEL_AGENT_ADMIN_PASSWORD"), "password for the admin ui; scripts send it as a bearer token (empty leaves the admin ui open)")
+		insecure   = fs.Bool("target-insecure-skip-verify", false, "do not verify the certificate of an https:// target")
+		caFile     = fs.String("target-ca-file", "", "PEM file with extra CA certificates trusted for an https:// target")
+	)
+	serverConn := addServerConnFlags(fs)
+	logs := addLogFlags(fs)
+	traces := addTraceFlags(fs, "tunnel-agent")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: agent http [flags] <port|host:port|https://host:port|unix:///path.sock>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := logs.setup(); err != nil {
+		return err
+	}
+	target, err := localTarget(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	label := strings.TrimSpace(*subdomain)
+	if label == "" {
+		label = "http-" + randomLabel()
+	}
+	api := strings.TrimRight(strings.TrimSpace(*controlAPI), "/")
+	client, err := serverConn.client()
+	if err != nil {
+		return err
+	}
+
+	session, err := registerSession(ctx, client, api, map[string]any{
+		"user_id":     *userID,
+		"project":     label,
+		"target":      target,
+		"base_domain": *domain,
+		"subdomain":   label,
+		"os_type":     runtime.GOOS,
+	})
+	if err != nil {
+		return fmt.Errorf("register session failed: %w", err)
+	}
+	defer deleteTunnel(client, api, session.Tunnel.ID, session.Tunnel.Token)
+
+	dir, err := os.MkdirTemp("", "tunneling-http-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := agent.NewConfigStore(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return fmt.Errorf("load config failed: %w", err)
+	}
+	ws := strings.TrimSpace(*serverURL)
+	if ws == "" {
+		ws = session.AgentServer
+	}
+	svc, err := agent.NewService(ws, session.Tunnel.Token, *adminAddr, session.RouteSyncURL,
+		session.Tunnel.ID, session.Tunnel.Token, 5*time.Second, store)
+	if err != nil {
+		return fmt.Errorf("create service failed: %w", err)
+	}
+	if *insecure || *caFile != "" {
+		if err := svc.SetTargetTLS(*insecure, *caFile); err != nil {
+			return err
+		}
+	}
+	if err := serverConn.apply(svc); err != nil {
+		return err
+	}
+	svc.SetAdminPassword(*adminPass)
+	tracer, err := traces.start(ctx)
+	if err != nil {
+		return err
+	}
+	svc.SetTracer(tracer)
+
+	fmt.Printf("Forwarding %s -> %s\n", session.PublicURL, target)
+	fmt.Printf("Inspect    http://%s/inspect\n", *adminAddr)
+	fmt.Printf("Press Ctrl-C to stop.\n")
+	if err := svc.Run(ctx); err != nil {
+		return fmt.Errorf("agent exited with error: %w", err)
+	}
+	return nil
+}
+
+func registerSession(ctx context.Context, client *http.Client, api string, payload map[string]any) (registeredSession, error) {
+	var out registeredSession
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return out, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api+"/api/sessions/register", bytes.NewReader(body))
+	if err != nil {
+		return out, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return out, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return out, fmt.Errorf("status %d: %s", resp.StatusCode, e.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return out, err
+	}
+	if out.Tunnel.ID == "" || out.Tunnel.Token == "" {
+		return out, errors.New("control plane returned no tunnel")
+	}
+	if out.AgentServer == "" || out.RouteSyncURL == "" {
+		return out, errors.New("control plane did not return agent endpoints; upgrade the control plane")
+	}
+	return out, nil
+}
+
+// deleteTunnel authenticates with the tunnel's own token, which the control
+// plane accepts for operations on that tunnel when API auth is on.
+func deleteTunnel(client *http.Client, api, tunnelID, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, api+"/api/tunnels/"+tunnelID, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Warn("delete tunnel failed", "tunnel_id", tunnelID, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("delete tunnel failed", "tunnel_id", tunnelID, "status", resp.StatusCode)
+		return
+	}
+	slog.Info("tunnel removed", "tunnel_id", tunnelID)
+}
+
+// localTarget accepts a bare port, host:port, or any route target form such
+// as https://127.0.0.1:8443 or unix:///run/app.sock.
+func localTarget(arg string) (string, error) {
+	if strings.Contains(arg, "://") {
+		return protocol.NormalizeTarget(arg)
+	}
+	if port, err := strconv.Atoi(arg); err == nil {
+		if port <= 0 || port > 65535 {
+			return "", fmt.Errorf("invalid port %q", arg)
+		}
+		return net.JoinHostPort("127.0.0.1", arg), nil
+	}
+	if _, _, err := net.SplitHostPort(arg); err != nil {
+		return "", fmt.Errorf("invalid target %q: want port or host:port", arg)
+	}
+	return arg, nil
+}
+
+func randomLabel() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano()%1e8, 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "anonymous"
+}
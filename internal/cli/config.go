@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile fills every flag not given on the command line from the
+// YAML file at path. Keys are flag names and a list sets a repeatable flag
+// once per item. A flag whose environment variable (env[name]) is set keeps
+// the env value, so the order is command line, env, file, built-in default.
+func applyConfigFile(fs *flag.FlagSet, path string, env map[string]string) error {
+	return applyConfigFileSections(fs, path, env, nil)
+}
+
+// applyConfigFileSections is applyConfigFile for a file that also holds
+// structured settings: a key of sections is decoded into its value instead
+// of being read as a flag, and fields the value does not have are errors.
+func applyConfigFileSections(fs *flag.FlagSet, path string, env map[string]string, sections map[string]any) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: top level must be a mapping of flag names to values", path, root.Line)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		name := key.Value
+		if out, ok := sections[name]; ok {
+			if err := decodeSection(value, out); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, value.Line, name, err))
+			}
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil || name == "config-file" {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %q", path, key.Line, name))
+			continue
+		}
+		if explicit[name] || env[name] != "" && os.Getenv(env[name]) != "" {
+			continue
+		}
+		values, err := configValues(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, value.Line, name, err))
+			continue
+		}
+		if len(values) > 1 {
+			if _, ok := f.Value.(*stringList); !ok {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: takes a single value, not a list", path, value.Line, name))
+				continue
+			}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: invalid value %q: %w", path, value.Line, name, v, err))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func decodeSection(n *yaml.Node, out any) error {
+	// Node.Decode ignores unknown fields; a typo should not be.
+	raw, err := yaml.Marshal(n)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+func configValues(n *yaml.Node) ([]string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return []string{n.Value}, nil
+	case yaml.SequenceNode:
+		out := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, errors.New("list items must be plain values")
+			}
+			out = append(out, item.Value)
+		}
+		return out, nil
+	default:
+		return nil, errors.New("want a value or a list of values")
+	}
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyConfigFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	data := "public-addr: :8081\ncontrol-addr: :9001\nsession-secret: from-file\nrequest-timeout: 45s\nmiddleware:\n  - a\n  - b=1\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SESSION_SECRET", "from-env")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	publicAddr := fs.String("public-addr", ":8080", "")
+	controlAddr := fs.String("control-addr", ":9000", "")
+	secret := fs.String("session-secret", os.Getenv("TEST_SESSION_SECRET"), "")
+	timeout := fs.Duration("request-timeout", 30*time.Second, "")
+	var middlewares stringList
+	fs.Var(&middlewares, "middleware", "")
+	if err := fs.Parse([]string{"-control-addr", ":9999"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path, map[string]string{"session-secret": "TEST_SESSION_SECRET"}); err != nil {
+		t.Fatalf("applyConfigFile() error = %v", err)
+	}
+	if *publicAddr != ":8081" || *controlAddr != ":9999" || *secret != "from-env" || *timeout != 45*time.Second {
+		t.Fatalf("got public=%s control=%s secret=%s timeout=%s", *publicAddr, *controlAddr, *secret, *timeout)
+	}
+	if strings.Join(middlewares, ",") != "a,b=1" {
+		t.Fatalf("middlewares = %v", middlewares)
+	}
+}
+
+func TestApplyConfigFileReportsOffendingKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("public-adr: :8081\nrequest-timeout: soon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("public-addr", ":8080", "")
+	fs.Duration("request-timeout", 30*time.Second, "")
+	err := applyConfigFile(fs, path, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{`server.yaml:1: unknown key "public-adr"`, `server.yaml:2: request-timeout: invalid value "soon"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestApplyConfigFileSections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	data := "admin-addr: 127.0.0.1:7001\ntunnels:\n  - name: blog\n    token: t1\n  - name: shop\n    token: t2\n    server: wss://other/connect\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	adminAddr := fs.String("admin-addr", "127.0.0.1:7000", "")
+	var tunnels []tunnelConfig
+	if err := applyConfigFileSections(fs, path, nil, map[string]any{"tunnels": &tunnels}); err != nil {
+		t.Fatalf("applyConfigFileSections() error = %v", err)
+	}
+	if *adminAddr != "127.0.0.1:7001" || len(tunnels) != 2 || tunnels[0].Token != "t1" || tunnels[1].Server != "wss://other/connect" {
+		t.Fatalf("admin-addr=%s tunnels=%+v", *adminAddr, tunnels)
+	}
+
+	if err := os.WriteFile(path, []byte("tunnels:\n  - name: blog\n    tokn: t1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := applyConfigFileSections(fs, path, nil, map[string]any{"tunnels": &tunnels})
+	if err == nil || !strings.Contains(err.Error(), "tokn") {
+		t.Fatalf("error = %v, want the misspelt field reported", err)
+	}
+	if err := applyConfigFile(fs, path, nil); err == nil || !strings.Contains(err.Error(), `unknown key "tunnels"`) {
+		t.Fatalf("applyConfigFile() error = %v, want tunnels unknown outside the agent", err)
+	}
+}
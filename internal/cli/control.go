@@ -0,0 +1,234 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"tunneling/internal/control"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+var controlEnv = map[string]string{
+	"store":                    "CONTROL_STORE",
+	"store-dsn":                "CONTROL_STORE_DSN",
+	"public-base-url":          "PUBLIC_BASE_URL",
+	"agent-server-ws":          "AGENT_SERVER_WS",
+	"agent-config-url":         "AGENT_CONFIG_URL",
+	"gateways":                 "CONTROL_GATEWAYS",
+	"default-agent-admin-addr": "DEFAULT_AGENT_ADMIN_ADDR",
+	"admin-key":                "TUNNELING_ADMIN_KEY",
+	"api-keys":                 "CONTROL_API_KEYS",
+	"jwt-secret":               "SUPABASE_JWT_SECRET",
+	"max-tunnels-per-owner":    "CONTROL_MAX_TUNNELS_PER_OWNER",
+	"max-routes-per-tunnel":    "CONTROL_MAX_ROUTES_PER_TUNNEL",
+	"max-hostname-length":      "CONTROL_MAX_HOSTNAME_LENGTH",
+	"webhooks-file":            "CONTROL_WEBHOOKS_FILE",
+	"platform-domains":         "CONTROL_PLATFORM_DOMAINS",
+	"reserved-hostnames":       "CONTROL_RESERVED_HOSTNAMES",
+	"reserved-pattern":         "CONTROL_RESERVED_PATTERN",
+	"dns-provider":             "DNS_PROVIDER",
+	"dns-target":               "DNS_TARGET",
+	"dns-ttl":                  "DNS_TTL",
+}
+
+// Control runs the control plane API until ctx is done.
+func Control(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("control", flag.ExitOnError)
+	var (
+		addr             = fs.String("addr", ":18100", "control api listen address")
+		store            = fs.String("store", envOr("CONTROL_STORE", "supabase"), "storage backend: supabase|sqlite|postgres|memory")
+		storeDSN         = fs.String("store-dsn", envOr("CONTROL_STORE_DSN", ""), "sqlite file path, postgres connection string, or optional JSON snapshot path for memory")
+		publicBaseURL    = fs.String("public-base-url", envOr("PUBLIC_BASE_URL", ""), "public url of the gateway, used to build agent urls")
+		agentServerWS    = fs.String("agent-server-ws", envOr("AGENT_SERVER_WS", ""), "websocket url agents connect to")
+		gateways         = fs.String("gateways", envOr("CONTROL_GATEWAYS", ""), "comma separated tunnel servers agents started with -server auto are assigned to, as region=wss://host/connect (region optional); empty always hands out -agent-server-ws")
+		agentConfigURL   = fs.String("agent-config-url", envOr("AGENT_CONFIG_URL", ""), "route sync url handed to agents")
+		defaultAdminAddr = fs.String("default-agent-admin-addr", envOr("DEFAULT_AGENT_ADMIN_ADDR", "127.0.0.1:17001"), "agent admin address suggested in generated commands")
+		adminKey         = fs.String("admin-key", envOr("TUNNELING_ADMIN_KEY", ""), "admin key for privileged api calls")
+		apiKeys          = fs.String("api-keys", envOr("CONTROL_API_KEYS", ""), "comma separated bearer keys required by /api/tunnels, /api/routes and /api/logs (empty leaves them open unless -jwt-secret is set)")
+		jwtSecret        = fs.String("jwt-secret", envOr("SUPABASE_JWT_SECRET", ""), "Supabase JWT secret; signed user access tokens are then accepted by the management api")
+		maxTunnels       = fs.Int("max-tunnels-per-owner", envInt("CONTROL_MAX_TUNNELS_PER_OWNER", 0), "most tunnels one user may own, 0 for no limit")
+		maxRoutes        = fs.Int("max-routes-per-tunnel", envInt("CONTROL_MAX_ROUTES_PER_TUNNEL", 0), "most routes one tunnel may have, 0 for no limit")
+		maxHostnameLen   = fs.Int("max-hostname-length", envInt("CONTROL_MAX_HOSTNAME_LENGTH", 0), "longest hostname a route may use, 0 for no limit")
+		expiryInterval   = fs.Duration("expiry-interval", control.DefaultExpiryInterval, "how often expired tunnels and routes are deleted")
+		idleAfter        = fs.Duration("idle-after", 0, "mark tunnels idle after this long without traffic (needs tunnel servers with -usage-report-interval); servers then show a waking-up page and raise tunnel.wake.requested, 0 turns it off")
+		persistEvents    = fs.Bool("persist-events", false, "also write events to the sqlite, postgres or supabase store so /api/logs keeps history across restarts")
+		eventRetention   = fs.Duration("event-retention", 30*24*time.Hour, "delete persisted events older than this, 0 to keep them")
+		webhooksFile     = fs.String("webhooks-file", envOr("CONTROL_WEBHOOKS_FILE", ""), "YAML list of webhook subscriptions (url, secret, events) that receive control events")
+		platformDomains  = fs.String("platform-domains", envOr("CONTROL_PLATFORM_DOMAINS", ""), "comma separated base domains the platform owns; routes on other domains must pass a DNS or HTTP challenge before they are synced (empty accepts any hostname)")
+		reservedHosts    = fs.String("reserved-hostnames", envOr("CONTROL_RESERVED_HOSTNAMES", ""), "comma separated hostnames no route may use, *.example.com for every subdomain; the gateway's own hostnames, localhost and IP addresses are always refused")
+		reservedRegexp   = fs.String("reserved-pattern", envOr("CONTROL_RESERVED_PATTERN", ""), "regular expression; hostnames matching it in full are refused like -reserved-hostnames")
+		dnsProviderName  = fs.String("dns-provider", envOr("DNS_PROVIDER", ""), "cloudflare or route53: create and delete DNS records for routes on -platform-domains (credentials come from CLOUDFLARE_API_TOKEN/CLOUDFLARE_ZONE_ID or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/ROUTE53_HOSTED_ZONE_ID)")
+		dnsTarget        = fs.String("dns-target", envOr("DNS_TARGET", ""), "gateway hostname (CNAME) or IP address (A/AAAA) the route records point at")
+		dnsTTL           = fs.Int("dns-ttl", envInt("DNS_TTL", 300), "TTL in seconds of the route records")
+		configFile       = fs.String("config-file", "", "YAML file with defaults for these flags, keyed by flag name")
+	)
+	logs := addLogFlags(fs)
+	_ = fs.Parse(args)
+	if err := applyConfigFile(fs, *configFile, controlEnv); err != nil {
+		return err
+	}
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	hooks, err := loadWebhooks(*webhooksFile)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(*store, *storeDSN)
+	if err != nil {
+		return fmt.Errorf("%s store init failed: %w", *store, err)
+	}
+
+	api := control.NewServer(
+		st,
+		strings.TrimSpace(*publicBaseURL),
+		strings.TrimSpace(*agentServerWS),
+		strings.TrimSpace(*agentConfigURL),
+		strings.TrimSpace(*defaultAdminAddr),
+		*adminKey,
+	)
+	api.SetAPIAuth(strings.Split(*apiKeys, ","), *jwtSecret)
+	api.SetQuotas(control.Quotas{
+		MaxTunnelsPerOwner: *maxTunnels,
+		MaxRoutesPerTunnel: *maxRoutes,
+		MaxHostnameLength:  *maxHostnameLen,
+	})
+	gatewayList, err := control.ParseGateways(*gateways)
+	if err != nil {
+		return err
+	}
+	api.SetGateways(gatewayList)
+	api.SetPlatformDomains(strings.Split(*platformDomains, ","))
+	if err := api.SetReservedHostnames(strings.Split(*reservedHosts, ","), *reservedRegexp); err != nil {
+		return err
+	}
+	if *dnsProviderName != "" {
+		provider, err := dnsProvider(*dnsProviderName)
+		if err != nil {
+			return err
+		}
+		if err := api.SetDNS(provider, *dnsTarget, *dnsTTL); err != nil {
+			return err
+		}
+	}
+	if *apiKeys == "" && *jwtSecret == "" {
+		slog.Warn("no -api-keys or -jwt-secret set, the management api is open to anyone who can reach it", "addr", *addr)
+	}
+
+	go api.RunExpiry(ctx, *expiryInterval)
+	if *idleAfter > 0 {
+		if *idleAfter < time.Hour {
+			return errors.New("-idle-after must be at least 1h, usage is counted per hour")
+		}
+		api.SetIdleAfter(*idleAfter)
+		go api.RunIdle(ctx, control.DefaultIdleInterval)
+	}
+	if *persistEvents {
+		history, ok := st.(control.EventLog)
+		if !ok {
+			return fmt.Errorf("-persist-events is not supported by the %s store", *store)
+		}
+		go api.PersistEvents(ctx, history, *eventRetention)
+	}
+	if len(hooks) > 0 {
+		go api.RunWebhooks(ctx, hooks)
+	}
+	go api.RunDNS(ctx)
+
+	srv := &http.Server{Addr: *addr, Handler: api.Handler()}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+	slog.Info("control api listening", "addr", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control api failed: %w", err)
+	}
+	return nil
+}
+
+// dnsProvider builds the -dns-provider client from its environment
+// variables; credentials are never taken from flags or the config file.
+func dnsProvider(name string) (control.DNSProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "cloudflare":
+		return control.NewCloudflareDNS(os.Getenv("CLOUDFLARE_API_TOKEN"), os.Getenv("CLOUDFLARE_ZONE_ID"))
+	case "route53":
+		return control.NewRoute53DNS(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), os.Getenv("ROUTE53_HOSTED_ZONE_ID"))
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q, want cloudflare or route53", name)
+	}
+}
+
+// loadWebhooks reads the -webhooks-file subscriptions; no file means none.
+func loadWebhooks(path string) ([]control.Webhook, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read webhooks file: %w", err)
+	}
+	var hooks []control.Webhook
+	if err := yaml.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("parse webhooks file %s: %w", path, err)
+	}
+	for _, hook := range hooks {
+		if err := hook.Validate(); err != nil {
+			return nil, fmt.Errorf("webhooks file %s: %w", path, err)
+		}
+	}
+	return hooks, nil
+}
+
+func openStore(kind, dsn string) (control.Store, error) {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", "supabase":
+		return control.NewSupabaseClient(envOr("SUPABASE_URL", ""), envOr("SUPABASE_SERVICE_ROLE_KEY", ""))
+	case "memory":
+		return control.NewMemoryStore(dsn)
+	case "sqlite":
+		return control.OpenSQLStore("sqlite", dsn)
+	case "postgres", "postgresql":
+		return control.OpenSQLStore("postgres", dsn)
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+func envInt(key string, fallback int) int {
+	v := envOr(key, "")
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("ignoring environment variable: not a number", "name", key, "value", v)
+		return fallback
+	}
+	return n
+}
+
+func envOr(key, fallback string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	return v
+}
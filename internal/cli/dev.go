@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tunneling/internal/agent"
+)
+
+// Dev runs a control plane with an in-memory store, a server and an agent in
+// one process for local testing. Routes given with -route are served right
+// away; more can be added in the agent admin UI.
+func Dev(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	var (
+		publicAddr  = fs.String("public-addr", "127.0.0.1:8080", "public http address")
+		controlAddr = fs.String("control-addr", "127.0.0.1:9000", "agent websocket control address")
+		apiAddr     = fs.String("control-api-addr", "127.0.0.1:18100", "control plane api address")
+		adminAddr   = fs.String("admin-addr", "127.0.0.1:7000", "agent admin ui address")
+	)
+	var routes stringList
+	fs.Var(&routes, "route", "hostname=target served by the dev agent, e.g. app.localhost=127.0.0.1:3000; repeatable")
+	logs := addLogFlags(fs)
+	_ = fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "tunneling-dev-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store, err := agent.NewConfigStore(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return fmt.Errorf("load config failed: %w", err)
+	}
+	for _, spec := range routes {
+		host, target, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("-route %q: want hostname=target", spec)
+		}
+		if err := store.Upsert(strings.TrimSpace(host), strings.TrimSpace(target)); err != nil {
+			return fmt.Errorf("-route %q: %w", spec, err)
+		}
+	}
+
+	wsURL := "ws://" + *controlAddr + "/connect"
+	apiURL := "http://" + *apiAddr
+	svc, err := agent.NewService(wsURL, "dev", *adminAddr, "", "", "", 5*time.Second, store)
+	if err != nil {
+		return fmt.Errorf("create service failed: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errc := make(chan error, 3)
+	run := func(f func(context.Context) error) {
+		go func() { errc <- f(ctx) }()
+	}
+	run(func(ctx context.Context) error {
+		return Control(ctx, append([]string{"-addr", *apiAddr, "-store", "memory",
+			"-agent-server-ws", wsURL, "-agent-config-url", apiURL + "/agent/routes"}, logs.args()...))
+	})
+	run(func(ctx context.Context) error {
+		return Server(ctx, append([]string{"-public-addr", *publicAddr, "-control-addr", *controlAddr, "-control-api", apiURL}, logs.args()...))
+	})
+	run(svc.Run)
+	slog.Info("dev stack up", "public", "http://"+*publicAddr, "agent_ui", "http://"+*adminAddr, "control_api", apiURL)
+
+	// Whichever part stops first takes the others down with it.
+	err = <-errc
+	cancel()
+	for i := 0; i < 2; i++ {
+		if e := <-errc; err == nil {
+			err = e
+		}
+	}
+	return err
+}
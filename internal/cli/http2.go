@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"crypto/tls"
+	"net/http"
+	"slices"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 applies -h2c to the plain public listener and -https-http2
+// to the https one, which may be nil.
+func configureHTTP2(plain, https *http.Server, allowH2C, allowHTTP2 bool) {
+	if allowH2C {
+		enableH2C(plain)
+	}
+	if https != nil && !allowHTTP2 {
+		disableHTTP2(https)
+	}
+}
+
+// enableH2C lets a plain listener accept HTTP/2 without TLS, both with prior
+// knowledge and via Upgrade: h2c, for gRPC clients and proxies in front of
+// the gateway that speak h2c. HTTP/1.1 requests, websocket upgrades
+// included, are served as before.
+func enableH2C(srv *http.Server) {
+	srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+}
+
+// disableHTTP2 keeps a TLS listener on HTTP/1.1.
+func disableHTTP2(srv *http.Server) {
+	srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
+
+// http2Disabled reports whether disableHTTP2 was applied to srv.
+func http2Disabled(srv *http.Server) bool {
+	_, ok := srv.TLSNextProto["h2"]
+	return srv.TLSNextProto != nil && !ok
+}
+
+// withoutH2 drops h2 from ALPN so clients do not negotiate a protocol the
+// server will not speak.
+func withoutH2(protos []string) []string {
+	return slices.DeleteFunc(slices.Clone(protos), func(p string) bool { return p == "h2" })
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2CListenerServesBothProtocols(t *testing.T) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	})}
+	enableH2C(srv)
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Start()
+	defer ts.Close()
+
+	h2 := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	for name, client := range map[string]*http.Client{"h2c": h2, "http/1.1": http.DefaultClient} {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("%s request: %v", name, err)
+		}
+		resp.Body.Close()
+		want := 1
+		if name == "h2c" {
+			want = 2
+		}
+		if resp.ProtoMajor != want {
+			t.Fatalf("%s got %s", name, resp.Proto)
+		}
+	}
+}
+
+func TestDisableHTTP2DropsALPN(t *testing.T) {
+	srv := &http.Server{}
+	if http2Disabled(srv) {
+		t.Fatalf("fresh server reported http2 disabled")
+	}
+	disableHTTP2(srv)
+	if !http2Disabled(srv) {
+		t.Fatalf("http2 still enabled")
+	}
+	protos := []string{"h2", "http/1.1", "acme-tls/1"}
+	if got := withoutH2(protos); !slices.Equal(got, []string{"http/1.1", "acme-tls/1"}) || protos[0] != "h2" {
+		t.Fatalf("withoutH2 = %v, input %v", got, protos)
+	}
+}
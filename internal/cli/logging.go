@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+
+	"tunneling/internal/logging"
+)
+
+const (
+	logFileMaxBytes = 10 << 20
+	logFileBackups  = 3
+)
+
+// logFlags are the -log-level, -log-format and -log-file flags every
+// command takes.
+type logFlags struct {
+	level  *string
+	format *string
+	file   *string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:  fs.String("log-level", "info", "minimum log level: debug, info, warn or error; the admin api's /api/log-level changes it at runtime"),
+		format: fs.String("log-format", "text", "log line format: text or json"),
+		file:   fs.String("log-file", "", "write logs to this file, rotated at 10 MiB, instead of stderr (a Windows service defaults to %ProgramData%\\tunneling\\<binary>.log)"),
+	}
+}
+
+func (f *logFlags) setup() error {
+	path := *f.file
+	if path == "" && asService {
+		path = defaultServiceLogPath()
+	}
+	var w io.Writer = os.Stderr
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		rf, err := openRotatingFile(path, logFileMaxBytes, logFileBackups)
+		if err != nil {
+			return err
+		}
+		w = rf
+	}
+	return logging.Setup(*f.level, *f.format, w)
+}
+
+// args passes the same settings on to a command started in-process.
+func (f *logFlags) args() []string {
+	args := []string{"-log-level", *f.level, "-log-format", *f.format}
+	if *f.file != "" {
+		args = append(args, "-log-file", *f.file)
+	}
+	return args
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileFlag(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	path := filepath.Join(t.TempDir(), "logs", "agent.log")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	logs := addLogFlags(fs)
+	if err := fs.Parse([]string{"-log-file", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	slog.Info("written to the file")
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "written to the file") {
+		t.Fatalf("log file = %q, %v", data, err)
+	}
+	if args := strings.Join(logs.args(), " "); !strings.Contains(args, "-log-file "+path) {
+		t.Fatalf("args() = %s", args)
+	}
+}
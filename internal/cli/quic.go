@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"tunneling/internal/server"
+)
+
+// startQUIC accepts QUIC agents on the UDP address addr. The certificate
+// comes from certFile and keyFile, or else from the ACME manager m, which
+// then has to be willing to issue one for the name agents dial.
+func startQUIC(ctx context.Context, ts *server.TunnelServer, addr, certFile, keyFile string, m *autocert.Manager) error {
+	var tlsConf *tls.Config
+	switch {
+	case certFile != "" || keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load -quic-cert-file: %w", err)
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case m != nil:
+		tlsConf = &tls.Config{GetCertificate: m.GetCertificate}
+	default:
+		return errors.New("-transport quic needs -quic-cert-file and -quic-key-file, or -acme")
+	}
+	ln, err := server.ListenQUIC(addr, tlsConf)
+	if err != nil {
+		return fmt.Errorf("quic listener: %w", err)
+	}
+	slog.Info("quic agent listener listening", "addr", addr)
+	go func() {
+		if err := ts.ServeQUIC(ctx, ln); err != nil {
+			slog.Error("quic agent listener failed", "err", err)
+		}
+	}()
+	return nil
+}
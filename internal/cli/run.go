@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// asService is set when the Windows service manager started the process;
+// logs then go to a file, as there is no console.
+var asService bool
+
+// Run runs command with args until it returns or the process is asked to
+// stop: Ctrl-C, SIGTERM (on Windows also closing the console, logoff and
+// shutdown), or a stop request from the Windows service manager when it
+// started the process.
+func Run(command func(context.Context, []string) error, args []string) error {
+	return run(command, args)
+}
+
+func runConsole(command func(context.Context, []string) error, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return command(ctx, args)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package cli
+
+import "context"
+
+func run(command func(context.Context, []string) error, args []string) error {
+	return runConsole(command, args)
+}
+
+func defaultServiceLogPath() string {
+	return ""
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// stopWaitHint tells the service manager how long a stop may take: the
+// agent lets in-flight requests finish first.
+const stopWaitHint = 45 * time.Second
+
+func run(command func(context.Context, []string) error, args []string) error {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return runConsole(command, args)
+	}
+	asService = true
+	h := &serviceHandler{command: command, args: args}
+	// The name is ignored for services running in their own process.
+	if err := svc.Run("", h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+// serviceHandler runs the command under the service manager and turns its
+// stop and shutdown requests into a cancelled context.
+type serviceHandler struct {
+	command func(context.Context, []string) error
+	args    []string
+	err     error
+}
+
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.command(ctx, h.args) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil {
+				// A service-specific exit code lets the recovery actions
+				// restart the agent.
+				slog.Error(h.err.Error())
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				slog.Info("stop requested by the service manager")
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(stopWaitHint / time.Millisecond)}
+				cancel()
+				h.err = <-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// defaultServiceLogPath is %ProgramData%\tunneling\<binary>.log.
+func defaultServiceLogPath() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		return ""
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(filepath.Base(exe), filepath.Ext(exe))
+	return filepath.Join(dir, "tunneling", name+".log")
+}
@@ -0,0 +1,584 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"tunneling/internal/control"
+	"tunneling/internal/protocol"
+	"tunneling/internal/selftest"
+	"tunneling/internal/server"
+	_ "tunneling/internal/wasmfilter"
+	"tunneling/internal/wsconn"
+)
+
+// serverEnv names the environment variables that take precedence over the
+// config file for server flags.
+var serverEnv = map[string]string{
+	"session-secret":     "TUNNEL_SESSION_SECRET",
+	"admin-token":        "TUNNEL_ADMIN_TOKEN",
+	"cluster-secret":     "TUNNEL_CLUSTER_SECRET",
+	"control-api-key":    "CONTROL_API_KEY",
+	"oidc-client-secret": "TUNNEL_OIDC_CLIENT_SECRET",
+}
+
+// Server runs the public gateway and the agent websocket endpoint until ctx
+// is done.
+func Server(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	var (
+		addr           = fs.String("addr", "", "single address for both public and control, e.g. :80")
+		publicAddr     = fs.String("public-addr", ":8080", "public http address")
+		controlAddr    = fs.String("control-addr", ":9000", "agent websocket control address")
+		controlAPI     = fs.String("control-api", "http://127.0.0.1:18100", "internal control api address for route sync proxy")
+		routeSyncPath  = fs.String("route-sync-path", "/_tunnel/agent/routes", "public path to proxy agent route sync requests")
+		requestTimeout = fs.Duration("request-timeout", 30*time.Second, "timeout when waiting for agent response")
+		runSelftest    = fs.Bool("selftest", false, "run a loopback server/agent/target self-test and exit")
+		sessionSecret  = fs.String("session-secret", os.Getenv("TUNNEL_SESSION_SECRET"), "secret used to sign agent resume tokens; keep it stable across deploys")
+		resumeWindow   = fs.Duration("resume-window", server.DefaultResumeWindow, "how long routes of a disconnected agent answer 503 Retry-After before being dropped (0 disables)")
+		writeQueue     = fs.Int("write-queue", wsconn.DefaultQueueSize, "max envelopes buffered per agent session before requests fail with 503")
+		pingInterval   = fs.Duration("ping-interval", wsconn.DefaultPingInterval, "how often agents are pinged; sessions silent for three intervals are dropped (0 disables)")
+		maxInFlight    = fs.Int("max-inflight", 10000, "max public requests tunneled at once across all agents; the excess gets 503 (0 disables)")
+		maxAgentIn     = fs.Int("max-inflight-per-agent", 1000, "max requests one agent session handles at once; the excess gets 429 (0 disables)")
+		maxHeaderBytes = fs.Int("max-header-bytes", server.DefaultLimits.MaxHeaderBytes, "max total size of request header names and values")
+		maxHeaderCount = fs.Int("max-header-count", server.DefaultLimits.MaxHeaderCount, "max number of request header values")
+		maxHeaderValue = fs.Int("max-header-value", server.DefaultLimits.MaxHeaderValueBytes, "max size of a single request header value")
+		allowedMethods = fs.String("allowed-methods", strings.Join(server.DefaultLimits.AllowedMethods, ","), "comma separated HTTP methods accepted on the public gateway")
+		acmeEnabled    = fs.Bool("acme", false, "serve HTTPS with Let's Encrypt certificates issued on demand for routed hostnames")
+		acmeEmail      = fs.String("acme-email", "", "contact email for the ACME account")
+		acmeCacheDir   = fs.String("acme-cache-dir", "/var/lib/tunneling/acme", "directory where ACME account keys and certificates are cached")
+		acmeHosts      = fs.String("acme-hosts", "", "comma separated extra hostnames to issue certificates for, e.g. the console domain")
+		acmeDirectory  = fs.String("acme-directory", "", "ACME directory URL (default Let's Encrypt production)")
+		httpsAddr      = fs.String("https-addr", ":443", "https listen address when -acme is set")
+		httpsHTTP2     = fs.Bool("https-http2", true, "offer HTTP/2 on the https listener; false keeps it on HTTP/1.1")
+		publicH2C      = fs.Bool("h2c", false, "accept cleartext HTTP/2 (h2c) on the plain public or unified listener")
+		sessionPolicy  = fs.String("session-policy", server.SessionPolicyReplace, "when several agents serve the same token or hostname: replace (newest wins) or balance")
+		balance        = fs.String("balance", server.BalanceRoundRobin, "how -session-policy=balance picks an agent: round-robin or least-in-flight")
+		affinityCookie = fs.String("affinity-cookie", "", "cookie name that keeps a browser on the same agent session under -session-policy=balance (empty disables)")
+		adminAddr      = fs.String("admin-addr", "", "listen address of the admin API for live sessions and routes, e.g. 127.0.0.1:9100 (empty disables)")
+		adminToken     = fs.String("admin-token", os.Getenv("TUNNEL_ADMIN_TOKEN"), "bearer token required by the admin API")
+		verifyAgents   = fs.Bool("verify-agent-tokens", false, "check agent tunnel_id/token against -control-api before accepting the websocket")
+		verifyHosts    = fs.Bool("verify-agent-hostnames", false, "only accept routes for hostnames the agent's tunnel owns in -control-api")
+		rateLimitRPS   = fs.Float64("rate-limit-rps", 0, "default requests per second per hostname for routes without their own limit (0 disables)")
+		rateLimitBurst = fs.Int("rate-limit-burst", 0, "default burst size for -rate-limit-rps (0 means one second's worth)")
+		rateLimitPerIP = fs.Bool("rate-limit-per-ip", false, "apply the default rate limit per hostname and client IP instead of per hostname")
+		accessLogPath  = fs.String("access-log", "", "write one JSON line per public request to this file, or - for stdout (empty disables)")
+		accessLogMaxMB = fs.Int("access-log-max-mb", 100, "rotate the access log once it reaches this size in MiB (0 disables rotation)")
+		accessLogKeep  = fs.Int("access-log-backups", 5, "number of rotated access log files to keep")
+		clusterNode    = fs.String("cluster-node", "", "name of this node in a cluster (default the machine hostname)")
+		clusterURL     = fs.String("cluster-url", "", "URL peers use to reach this node's control address, e.g. http://10.0.0.1:9000")
+		clusterPeers   = fs.String("cluster-peers", "", "comma separated control URLs of the other servers; enables clustering")
+		clusterSecret  = fs.String("cluster-secret", os.Getenv("TUNNEL_CLUSTER_SECRET"), "shared secret authenticating traffic between cluster nodes")
+		usageInterval  = fs.Duration("usage-report-interval", 0, "how often to post per-hostname traffic to -control-api /api/usage (0 disables)")
+		gatewayRoutes  = fs.Duration("gateway-routes-interval", 0, "how often to fetch redirect, static-response, maintenance and idle routes from -control-api /api/gateway/routes (0 disables); requests for idle tunnels are reported to /api/gateway/wake")
+		controlAPIKey  = fs.String("control-api-key", os.Getenv("CONTROL_API_KEY"), "bearer key for the control api's management endpoints, used by usage reports, gateway routes and -verify-agent-tokens")
+		reservedHosts  = fs.String("reserved-hostnames", "", "comma separated hostnames no route may bind, *.example.com for every subdomain; localhost and IP addresses are always refused")
+		trustedProxies = fs.String("trusted-proxies", server.DefaultTrustedProxies, "comma separated CIDRs of upstream proxies whose X-Forwarded-For names the real client (empty trusts none)")
+		cfProxies      = fs.String("cloudflare-proxies", "", "comma separated CIDRs of Cloudflare's edge; CF-Connecting-IP is only believed on requests that came through them")
+		compressMin    = fs.Int("compress-min-bytes", protocol.DefaultCompressMinBytes, "gzip inline request bodies of at least this size for agents that support it (0 disables)")
+		edgeGzipMin    = fs.Int("edge-compress-min-bytes", 0, "brotli or gzip uncompressed responses of at least this size to public clients that accept it (0 disables)")
+		edgeGzipTypes  = fs.String("edge-compress-types", server.DefaultEdgeCompressTypes, "comma separated content types -edge-compress-min-bytes applies to, text/* for a whole family")
+		cacheMaxBytes  = fs.Int64("cache-max-bytes", 64<<20, "memory for the response caches of routes that enable one (0 disables caching)")
+		slowRequest    = fs.Duration("slow-request-threshold", 0, "log requests handed to an agent that take at least this long, with a timing breakdown (0 disables)")
+		transport      = fs.String("transport", "websocket", "websocket, or quic to also accept agents over QUIC on -quic-addr; websocket agents keep working")
+		quicAddr       = fs.String("quic-addr", "", "UDP address for -transport quic (empty uses the port of -addr or -control-addr)")
+		quicCertFile   = fs.String("quic-cert-file", "", "PEM certificate chain for -transport quic (empty uses the -acme certificates)")
+		quicKeyFile    = fs.String("quic-key-file", "", "PEM private key of -quic-cert-file")
+		sshAddr        = fs.String("ssh-addr", "", "accept ssh -R reverse forwards from users without the agent on this address, e.g. :2222 (empty disables)")
+		sshHostKey     = fs.String("ssh-host-key", "", "PEM private key the ssh listener identifies itself with (empty generates one per start)")
+		holdDepth      = fs.Int("hold-queue-depth", 0, "requests per hostname parked while its agent reconnects instead of getting 503 (0 disables)")
+		holdWait       = fs.Duration("hold-queue-wait", 2*time.Second, "how long a parked request waits for the agent to come back")
+		connectFails   = fs.Int("connect-auth-failures", 10, "rejected agent logins from one IP, or with one tunnel id and token, before /connect locks it out (0 disables)")
+		connectLock    = fs.Duration("connect-lockout", 30*time.Second, "first lockout after -connect-auth-failures; doubles with every further failure")
+		connectLockMax = fs.Duration("connect-lockout-max", 30*time.Minute, "longest /connect lockout")
+		breakerFails   = fs.Int("breaker-failures", 0, "agent timeouts in a row that open a hostname's circuit, serving the offline page for -breaker-cooldown (0 disables)")
+		breakerCool    = fs.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit serves the offline page before trying the agent again")
+		offlinePage    = fs.String("offline-page", "", "HTML template file shown to browsers when a tunnel is unavailable (empty uses the built-in page)")
+		offlineRefresh = fs.Duration("offline-refresh", 0, "make the offline page reload itself after this long (0 disables)")
+		reservedRegexp = fs.String("reserved-pattern", "", "regular expression; hostnames matching it in full are refused like -reserved-hostnames")
+		oidcProvider   = fs.String("oidc-provider", server.OIDCProviderGeneric, "single sign-on provider for routes with an auth login policy: oidc or github")
+		oidcIssuer     = fs.String("oidc-issuer", "", "OpenID Connect issuer URL for -oidc-provider oidc (empty uses Google)")
+		oidcClientID   = fs.String("oidc-client-id", "", "OAuth client id; empty disables login and routes with a login policy refuse every request")
+		oidcSecret     = fs.String("oidc-client-secret", os.Getenv("TUNNEL_OIDC_CLIENT_SECRET"), "OAuth client secret")
+		oidcRedirect   = fs.String("oidc-redirect-url", "", "callback URL registered with the provider, e.g. https://login.example.com/_tunnel/oidc/callback")
+		oidcSessionTTL = fs.Duration("oidc-session-ttl", 12*time.Hour, "how long a sign-in lasts before the browser is sent to the provider again")
+		configFile     = fs.String("config-file", "", "YAML file with defaults for these flags, keyed by flag name")
+	)
+	var middlewares stringList
+	fs.Var(&middlewares, "middleware", "enable a compiled-in middleware as name or name=config; repeatable, applied in order")
+	logs := addLogFlags(fs)
+	traces := addTraceFlags(fs, "tunnel-server")
+	_ = fs.Parse(args)
+	if err := applyConfigFile(fs, *configFile, serverEnv); err != nil {
+		return err
+	}
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	if *runSelftest {
+		if _, err := selftest.Run(ctx, os.Stdout); err != nil {
+			return fmt.Errorf("selftest failed: %w", err)
+		}
+		return nil
+	}
+
+	policy, err := server.ParseSessionPolicy(*sessionPolicy)
+	if err != nil {
+		return err
+	}
+	balanceStrategy, err := server.ParseBalance(*balance)
+	if err != nil {
+		return err
+	}
+
+	var (
+		validator      server.TokenValidator
+		hostAuthorizer server.HostnameAuthorizer
+	)
+	if *verifyAgents || *verifyHosts {
+		controlValidator := server.NewControlValidator(*controlAPI, *controlAPIKey)
+		if *verifyAgents {
+			validator = controlValidator
+		}
+		if *verifyHosts {
+			hostAuthorizer = controlValidator
+		}
+	}
+
+	var cluster *server.ClusterOptions
+	if peers := splitHosts(*clusterPeers); len(peers) > 0 {
+		if *clusterURL == "" || *clusterSecret == "" {
+			return errors.New("-cluster-peers needs -cluster-url and -cluster-secret")
+		}
+		node := *clusterNode
+		if node == "" {
+			if node, err = os.Hostname(); err != nil {
+				return fmt.Errorf("-cluster-node not set and hostname unavailable: %w", err)
+			}
+		}
+		cluster = &server.ClusterOptions{
+			NodeID: node,
+			URL:    strings.ToLower(strings.TrimSpace(*clusterURL)),
+			Peers:  peers,
+			Secret: *clusterSecret,
+		}
+	}
+
+	var rateLimit *protocol.RateLimit
+	if *rateLimitRPS > 0 {
+		rateLimit = &protocol.RateLimit{RPS: *rateLimitRPS, Burst: *rateLimitBurst, PerClientIP: *rateLimitPerIP}
+	}
+
+	var accessLog io.Writer
+	switch *accessLogPath {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		f, err := openRotatingFile(*accessLogPath, int64(*accessLogMaxMB)<<20, *accessLogKeep)
+		if err != nil {
+			return fmt.Errorf("open access log: %w", err)
+		}
+		accessLog = f
+	}
+
+	if *sessionSecret == "" {
+		slog.Warn("no -session-secret set, agents will not be able to resume sessions across restarts")
+	}
+	// The gateway's own internal hostnames are never routable.
+	reserved, err := protocol.NewReservedHostnames(append(strings.Split(*reservedHosts, ","), urlHostnames(*controlAPI, *clusterURL)...), *reservedRegexp)
+	if err != nil {
+		return err
+	}
+
+	trusted, err := server.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		return err
+	}
+	cloudflare, err := server.ParseTrustedProxies(*cfProxies)
+	if err != nil {
+		return err
+	}
+
+	var oidc *server.OIDCOptions
+	if *oidcClientID != "" {
+		oidc = &server.OIDCOptions{
+			Provider:     *oidcProvider,
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcSecret,
+			RedirectURL:  *oidcRedirect,
+			SessionTTL:   *oidcSessionTTL,
+		}
+		if err := oidc.Validate(); err != nil {
+			return err
+		}
+		if *sessionSecret == "" {
+			slog.Warn("oidc login without -session-secret: sign-ins are lost on restart and not shared across nodes")
+		}
+	}
+
+	var offlineTemplate *template.Template
+	if *offlinePage != "" {
+		source, err := os.ReadFile(*offlinePage)
+		if err != nil {
+			return fmt.Errorf("read offline page: %w", err)
+		}
+		if offlineTemplate, err = server.ParseOfflinePage(string(source)); err != nil {
+			return fmt.Errorf("offline page: %w", err)
+		}
+	}
+
+	tracer, err := traces.start(ctx)
+	if err != nil {
+		return err
+	}
+	ts := server.New(server.Options{
+		RequestTimeout:        *requestTimeout,
+		SessionSecret:         []byte(*sessionSecret),
+		ResumeWindow:          *resumeWindow,
+		WriteQueueSize:        *writeQueue,
+		PingInterval:          *pingInterval,
+		MaxInFlight:           *maxInFlight,
+		MaxInFlightPerSession: *maxAgentIn,
+		SessionPolicy:         policy,
+		Balance:               balanceStrategy,
+		AffinityCookie:        *affinityCookie,
+		TokenValidator:        validator,
+		HostnameAuthorizer:    hostAuthorizer,
+		RateLimit:             rateLimit,
+		AccessLog:             accessLog,
+		Tracer:                tracer,
+		Cluster:               cluster,
+		ReservedHostnames:     reserved,
+		CompressMinBytes:      *compressMin,
+		TrustedProxies:        trusted,
+		CloudflareProxies:     cloudflare,
+		OIDC:                  oidc,
+		HoldQueueDepth:        *holdDepth,
+		HoldQueueWait:         *holdWait,
+		BreakerFailures:       *breakerFails,
+		ConnectFailures:       *connectFails,
+		ConnectLockout:        *connectLock,
+		ConnectLockoutMax:     *connectLockMax,
+		BreakerCooldown:       *breakerCool,
+		OfflinePage:           offlineTemplate,
+		OfflineRefresh:        *offlineRefresh,
+		CacheMaxBytes:         *cacheMaxBytes,
+		EdgeCompressMinBytes:  *edgeGzipMin,
+		EdgeCompressTypes:     strings.Split(*edgeGzipTypes, ","),
+		SlowRequest:           *slowRequest,
+		Limits: server.Limits{
+			MaxHeaderBytes:      *maxHeaderBytes,
+			MaxHeaderCount:      *maxHeaderCount,
+			MaxHeaderValueBytes: *maxHeaderValue,
+			AllowedMethods:      splitMethods(*allowedMethods),
+		},
+	})
+	for _, spec := range middlewares {
+		name, config, _ := strings.Cut(spec, "=")
+		mw, err := server.NewMiddleware(strings.TrimSpace(name), config)
+		if err != nil {
+			return fmt.Errorf("middleware %q: %w", spec, err)
+		}
+		ts.Use(mw)
+	}
+
+	var certManager *autocert.Manager
+	if *acmeEnabled {
+		certManager = newACMEManager(ts, *acmeCacheDir, *acmeEmail, *acmeDirectory, splitHosts(*acmeHosts))
+	}
+
+	switch *transport {
+	case "websocket":
+	case "quic":
+		listenAddr := *quicAddr
+		if listenAddr == "" {
+			listenAddr = *controlAddr
+			if *addr != "" {
+				listenAddr = *addr
+			}
+		}
+		if err := startQUIC(ctx, ts, listenAddr, *quicCertFile, *quicKeyFile, certManager); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported -transport %q (want websocket or quic)", *transport)
+	}
+
+	controlMux := http.NewServeMux()
+	controlMux.HandleFunc("/connect", ts.HandleConnect)
+	controlMux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	controlMux.HandleFunc("/debug/state", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(ts.DebugState()))
+	})
+	controlMux.Handle("/metrics", ts.Metrics().Handler())
+	controlMux.Handle("/_cluster/", ts.ClusterHandler())
+	go ts.RunCluster(ctx)
+	if *usageInterval > 0 {
+		go ts.ReportUsage(ctx, strings.TrimRight(*controlAPI, "/")+"/api/usage", *controlAPIKey, *usageInterval)
+	}
+	if *gatewayRoutes > 0 {
+		go ts.SyncGatewayRoutes(ctx, strings.TrimRight(*controlAPI, "/")+"/api/gateway/routes", *controlAPIKey, *gatewayRoutes)
+		go ts.SignalWakes(ctx, strings.TrimRight(*controlAPI, "/")+"/api/gateway/wake", *controlAPIKey)
+	}
+	if *verifyAgents {
+		go ts.ReportAgents(ctx, strings.TrimRight(*controlAPI, "/")+"/api/gateway/agents", *controlAPIKey)
+	}
+	if *sshAddr != "" {
+		hostKey, err := server.SSHHostKey(*sshHostKey)
+		if err != nil {
+			return fmt.Errorf("load -ssh-host-key: %w", err)
+		}
+		ln, err := net.Listen("tcp", *sshAddr)
+		if err != nil {
+			return fmt.Errorf("ssh listener: %w", err)
+		}
+		slog.Info("ssh listener listening", "addr", *sshAddr)
+		go func() {
+			if err := ts.ServeSSH(ctx, ln, server.SSHOptions{HostKey: hostKey, ControlAPI: *controlAPI}); err != nil {
+				slog.Error("ssh listener failed", "err", err)
+			}
+		}()
+	}
+
+	var adminSrv *http.Server
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			slog.Warn("admin API has no -admin-token, keep it on a private address", "addr", *adminAddr)
+		}
+		adminSrv = &http.Server{Addr: *adminAddr, Handler: ts.AdminHandler(*adminToken)}
+	}
+
+	publicMux := http.NewServeMux()
+	if err := registerRouteSyncProxy(publicMux, *routeSyncPath, *controlAPI); err != nil {
+		return fmt.Errorf("register route sync proxy failed: %w", err)
+	}
+	if err := registerChallengeProxy(publicMux, *controlAPI); err != nil {
+		return fmt.Errorf("register domain challenge proxy failed: %w", err)
+	}
+	publicMux.HandleFunc("/", ts.HandlePublicHTTP)
+
+	if *addr != "" {
+		unified := http.NewServeMux()
+		unified.HandleFunc("/connect", ts.HandleConnect)
+		unified.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("ok"))
+		})
+		unified.HandleFunc("/debug/state", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(ts.DebugState()))
+		})
+		unified.Handle("/metrics", ts.Metrics().Handler())
+		unified.Handle("/_cluster/", ts.ClusterHandler())
+		if err := registerRouteSyncProxy(unified, *routeSyncPath, *controlAPI); err != nil {
+			return fmt.Errorf("register route sync proxy failed: %w", err)
+		}
+		if err := registerChallengeProxy(unified, *controlAPI); err != nil {
+			return fmt.Errorf("register domain challenge proxy failed: %w", err)
+		}
+		unified.HandleFunc("/", ts.HandlePublicHTTP)
+
+		unifiedSrv := &http.Server{Addr: *addr, Handler: unified, MaxHeaderBytes: *maxHeaderBytes}
+		var httpsSrv *http.Server
+		if certManager != nil {
+			unifiedSrv.Handler = ts.ACMEHandler(certManager.HTTPHandler(unified), unified)
+			httpsSrv = &http.Server{Addr: *httpsAddr, Handler: unified, MaxHeaderBytes: *maxHeaderBytes}
+		}
+		configureHTTP2(unifiedSrv, httpsSrv, *publicH2C, *httpsHTTP2)
+		return runServers(ctx, ts, certManager, httpsSrv, adminSrv, namedServer{"unified gateway", unifiedSrv})
+	}
+
+	controlSrv := &http.Server{Addr: *controlAddr, Handler: controlMux}
+	publicSrv := &http.Server{Addr: *publicAddr, Handler: publicMux, MaxHeaderBytes: *maxHeaderBytes}
+	var httpsSrv *http.Server
+	if certManager != nil {
+		publicSrv.Handler = ts.ACMEHandler(certManager.HTTPHandler(publicMux), publicMux)
+		httpsSrv = &http.Server{Addr: *httpsAddr, Handler: publicMux, MaxHeaderBytes: *maxHeaderBytes}
+	}
+	configureHTTP2(publicSrv, httpsSrv, *publicH2C, *httpsHTTP2)
+	return runServers(ctx, ts, certManager, httpsSrv, adminSrv,
+		namedServer{"control server", controlSrv}, namedServer{"public gateway", publicSrv})
+}
+
+type namedServer struct {
+	name string
+	srv  *http.Server
+}
+
+// runServers serves until ctx is done or one listener fails, then asks agents
+// to reconnect and shuts every server down.
+func runServers(ctx context.Context, ts *server.TunnelServer, m *autocert.Manager, httpsSrv, adminSrv *http.Server, plain ...namedServer) error {
+	if adminSrv != nil {
+		plain = append(plain, namedServer{"admin api", adminSrv})
+	}
+	errc := make(chan error, len(plain)+1)
+	all := make([]*http.Server, 0, len(plain)+1)
+	for _, ns := range plain {
+		ns := ns
+		all = append(all, ns.srv)
+		go func() {
+			slog.Info(ns.name+" listening", "addr", ns.srv.Addr)
+			if err := ns.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errc <- fmt.Errorf("%s failed: %w", ns.name, err)
+			}
+		}()
+	}
+	if httpsSrv != nil {
+		all = append(all, httpsSrv)
+		go func() {
+			if err := serveHTTPS(httpsSrv, m); err != nil {
+				errc <- err
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
+	slog.Info("shutting down, asking agents to reconnect")
+	ts.Shutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range all {
+		_ = srv.Shutdown(shutdownCtx)
+	}
+	return err
+}
+
+// urlHostnames returns the hostnames of the URLs that parse and have one.
+func urlHostnames(urls ...string) []string {
+	var out []string
+	for _, raw := range urls {
+		if u, err := url.Parse(strings.TrimSpace(raw)); err == nil && u.Hostname() != "" {
+			out = append(out, u.Hostname())
+		}
+	}
+	return out
+}
+
+func splitMethods(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToUpper(strings.TrimSpace(item)); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func splitHosts(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func registerRouteSyncProxy(mux *http.ServeMux, publicPath string, controlAPI string) error {
+	if publicPath == "" {
+		return nil
+	}
+	target, err := url.Parse(controlAPI)
+	if err != nil {
+		return err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	// Agents derive the stream, heartbeat and assign URLs from their route
+	// sync URL, so they all live next to publicPath.
+	heartbeatPath := path.Join(path.Dir(publicPath), "heartbeat")
+	assignPath := path.Join(path.Dir(publicPath), "assign")
+	upstreamPaths := map[string]string{
+		publicPath:             "/agent/routes",
+		publicPath + "/stream": "/agent/routes/stream",
+		heartbeatPath:          "/agent/heartbeat",
+		assignPath:             "/agent/assign",
+	}
+	proxy.Director = func(req *http.Request) {
+		upstream := upstreamPaths[req.URL.Path]
+		director(req)
+		req.URL.Path = upstream
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		http.Error(w, "route sync upstream error: "+err.Error(), http.StatusBadGateway)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}
+	mux.HandleFunc(publicPath, handler)
+	mux.HandleFunc(publicPath+"/stream", handler)
+	post := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}
+	mux.HandleFunc(heartbeatPath, post)
+	mux.HandleFunc(assignPath, post)
+	return nil
+}
+
+// registerChallengeProxy forwards domain verification challenges to the
+// control API with the original Host, so a custom domain pointed at this
+// gateway can be verified before any of its routes are synced.
+func registerChallengeProxy(mux *http.ServeMux, controlAPI string) error {
+	target, err := url.Parse(controlAPI)
+	if err != nil {
+		return err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		http.Error(w, "domain challenge upstream error: "+err.Error(), http.StatusBadGateway)
+	}
+	mux.HandleFunc(control.ChallengePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+	return nil
+}
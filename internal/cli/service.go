@@ -0,0 +1,200 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultServiceName = "tunnel-agent"
+
+// serviceSpec describes the agent as an operating system service.
+type serviceSpec struct {
+	Name string
+	// User installs for the current user only (systemd --user, a launchd
+	// LaunchAgent) instead of system-wide.
+	User bool
+	Exe  string
+	Args []string
+}
+
+// agentService runs `agent service install|uninstall|start|stop`. install
+// takes the flags the service should run the agent with, e.g.
+//
+//	agent service install -config-file /etc/tunneling/agent.yaml
+func agentService(ctx context.Context, args []string) error {
+	const usage = "usage: agent service install [-name NAME] [-user] <agent flags...> | uninstall|start|stop [-name NAME] [-user]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	verb := args[0]
+	spec, agentArgs, err := parseServiceFlags(args[1:])
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, usage)
+	}
+	if verb != "install" && len(agentArgs) > 0 {
+		return fmt.Errorf("agent service %s takes no agent flags\n%s", verb, usage)
+	}
+
+	switch verb {
+	case "install":
+		if spec.Exe, err = os.Executable(); err != nil {
+			return fmt.Errorf("locate the agent binary: %w", err)
+		}
+		if resolved, err := filepath.EvalSymlinks(spec.Exe); err == nil {
+			spec.Exe = resolved
+		}
+		spec.Args = append(agentPrefix(), absPathFlags(agentArgs)...)
+		if err := installService(spec); err != nil {
+			return err
+		}
+		fmt.Printf("installed service %s: %s %s\n", spec.Name, spec.Exe, strings.Join(redactArgs(spec.Args), " "))
+		fmt.Printf("start it with: agent service start%s\n", serviceFlagsHint(spec))
+	case "uninstall":
+		if err := uninstallService(spec); err != nil {
+			return err
+		}
+		fmt.Printf("removed service %s\n", spec.Name)
+	case "start":
+		return startService(spec)
+	case "stop":
+		return stopService(spec)
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
+
+// parseServiceFlags takes -name and -user out of args; everything else is
+// passed to the agent.
+func parseServiceFlags(args []string) (serviceSpec, []string, error) {
+	spec := serviceSpec{Name: defaultServiceName}
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") {
+			name = ""
+		}
+		switch name {
+		case "name":
+			if !hasValue {
+				if i+1 == len(args) {
+					return spec, nil, errors.New("-name needs a value")
+				}
+				i++
+				value = args[i]
+			}
+			spec.Name = strings.TrimSpace(value)
+		case "user":
+			spec.User = !hasValue || value == "true"
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if spec.Name == "" || strings.ContainsAny(spec.Name, `/\ `) {
+		return spec, nil, fmt.Errorf("invalid service name %q", spec.Name)
+	}
+	return spec, rest, nil
+}
+
+// agentPrefix is what the service has to pass before the agent flags: the
+// combined tunneling binary needs the agent command named.
+func agentPrefix() []string {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		return []string{"agent"}
+	}
+	return nil
+}
+
+// pathFlags are the agent flags naming files, made absolute on install
+// because services start in another working directory.
+var pathFlags = map[string]bool{
+	"config":         true,
+	"config-file":    true,
+	"server-ca-file": true,
+	"target-ca-file": true,
+}
+
+func absPathFlags(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		if !strings.HasPrefix(out[i], "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(out[i], "-"), "=")
+		if !pathFlags[name] {
+			continue
+		}
+		if hasValue {
+			out[i] = "-" + name + "=" + absPath(value)
+		} else if i+1 < len(out) {
+			i++
+			out[i] = absPath(out[i])
+		}
+	}
+	return out
+}
+
+// secretFlags are the agent flags carrying credentials. They end up in the
+// service definition, so that file is written owner-only, and they are
+// masked whenever the command line is printed.
+var secretFlags = map[string]bool{
+	"token":          true,
+	"tunnel-token":   true,
+	"admin-password": true,
+}
+
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		if !strings.HasPrefix(out[i], "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(out[i], "-"), "=")
+		if !secretFlags[name] {
+			continue
+		}
+		if hasValue {
+			out[i] = "-" + name + "=REDACTED"
+		} else if i+1 < len(out) {
+			i++
+			out[i] = "REDACTED"
+		}
+	}
+	return out
+}
+
+// writeServiceFile writes a unit or plist readable by its owner only, since
+// it may hold secretFlags. Chmod covers a file left by an older install.
+func writeServiceFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
+}
+
+func absPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+func serviceFlagsHint(spec serviceSpec) string {
+	var hint string
+	if spec.Name != defaultServiceName {
+		hint += " -name " + spec.Name
+	}
+	if spec.User {
+		hint += " -user"
+	}
+	return hint
+}
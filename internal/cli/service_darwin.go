@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdLabel is the job label; a bare name gets a reverse-DNS prefix.
+func launchdLabel(spec serviceSpec) string {
+	if strings.Contains(spec.Name, ".") {
+		return spec.Name
+	}
+	return "com.tunneling." + spec.Name
+}
+
+// A LaunchDaemon in /Library/LaunchDaemons, or with -user a LaunchAgent in
+// ~/Library/LaunchAgents.
+func plistPaths(spec serviceSpec) (plist, logFile string, err error) {
+	label := launchdLabel(spec)
+	if !spec.User {
+		return filepath.Join("/Library/LaunchDaemons", label+".plist"), filepath.Join("/Library/Logs", spec.Name+".log"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", label+".plist"), filepath.Join(home, "Library", "Logs", spec.Name+".log"), nil
+}
+
+func launchdPlist(spec serviceSpec, logFile string) string {
+	esc := func(s string) string {
+		var b bytes.Buffer
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var args strings.Builder
+	for _, arg := range append([]string{spec.Exe}, spec.Args...) {
+		args.WriteString("    <string>" + esc(arg) + "</string>\n")
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>Label</key>
+  <string>%s</string>
+  <key>ProgramArguments</key>
+  <array>
+%s  </array>
+  <key>RunAtLoad</key>
+  <true/>
+  <key>KeepAlive</key>
+  <true/>
+  <key>StandardOutPath</key>
+  <string>%s</string>
+  <key>StandardErrorPath</key>
+  <string>%s</string>
+</dict>
+</plist>
+`, esc(launchdLabel(spec)), args.String(), esc(logFile), esc(logFile))
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func installService(spec serviceSpec) error {
+	plist, logFile, err := plistPaths(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0o755); err != nil {
+		return err
+	}
+	if err := writeServiceFile(plist, []byte(launchdPlist(spec, logFile))); err != nil {
+		return fmt.Errorf("write %s (system-wide install needs root; -user installs for this user): %w", plist, err)
+	}
+	return nil
+}
+
+func uninstallService(spec serviceSpec) error {
+	plist, _, err := plistPaths(spec)
+	if err != nil {
+		return err
+	}
+	_ = launchctl("unload", plist)
+	return os.Remove(plist)
+}
+
+// The job loads at boot (or login) by itself; start and stop load and
+// unload it, since KeepAlive would restart a merely stopped job.
+func startService(spec serviceSpec) error {
+	plist, _, err := plistPaths(spec)
+	if err != nil {
+		return err
+	}
+	return launchctl("load", "-w", plist)
+}
+
+func stopService(spec serviceSpec) error {
+	plist, _, err := plistPaths(spec)
+	if err != nil {
+		return err
+	}
+	return launchctl("unload", plist)
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemd units: /etc/systemd/system, or ~/.config/systemd/user with -user.
+func unitPath(spec serviceSpec) (string, error) {
+	if !spec.User {
+		return filepath.Join("/etc/systemd/system", spec.Name+".service"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user", spec.Name+".service"), nil
+}
+
+func systemUnit(spec serviceSpec) string {
+	words := make([]string, 0, len(spec.Args)+1)
+	for _, arg := range append([]string{spec.Exe}, spec.Args...) {
+		words = append(words, systemdQuote(arg))
+	}
+	wantedBy := "multi-user.target"
+	if spec.User {
+		wantedBy = "default.target"
+	}
+	return fmt.Sprintf(`[Unit]
+Description=Tunnel Agent (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=always
+RestartSec=2
+
+[Install]
+WantedBy=%s
+`, spec.Name, strings.Join(words, " "), wantedBy)
+}
+
+// systemdQuote quotes one ExecStart word; % and $ would otherwise be
+// expanded by systemd.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func systemctl(spec serviceSpec, args ...string) error {
+	if spec.User {
+		args = append([]string{"--user"}, args...)
+	}
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func installService(spec serviceSpec) error {
+	path, err := unitPath(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeServiceFile(path, []byte(systemUnit(spec))); err != nil {
+		return fmt.Errorf("write %s (system-wide install needs root; -user installs for this user): %w", path, err)
+	}
+	if err := systemctl(spec, "daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl(spec, "enable", spec.Name)
+}
+
+func uninstallService(spec serviceSpec) error {
+	path, err := unitPath(spec)
+	if err != nil {
+		return err
+	}
+	_ = systemctl(spec, "disable", "--now", spec.Name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return systemctl(spec, "daemon-reload")
+}
+
+func startService(spec serviceSpec) error {
+	return systemctl(spec, "start", spec.Name)
+}
+
+func stopService(spec serviceSpec) error {
+	return systemctl(spec, "stop", spec.Name)
+}
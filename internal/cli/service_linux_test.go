@@ -0,0 +1,20 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSystemUnit(t *testing.T) {
+	unit := systemUnit(serviceSpec{Name: "tunnel-agent", Exe: "/opt/tunneling/bin/agent", Args: []string{"-config-file", "/etc/my agent.yaml", "-admin-password", "50%$off"}})
+	want := `ExecStart=/opt/tunneling/bin/agent -config-file "/etc/my agent.yaml" -admin-password 50%%$$off`
+	if !strings.Contains(unit, want+"\n") {
+		t.Fatalf("unit = %s\nwant line %s", unit, want)
+	}
+	if !strings.Contains(unit, "WantedBy=multi-user.target") {
+		t.Fatalf("system unit should be wanted by multi-user.target:\n%s", unit)
+	}
+	if user := systemUnit(serviceSpec{Name: "x", Exe: "/a", User: true}); !strings.Contains(user, "WantedBy=default.target") {
+		t.Fatalf("user unit = %s", user)
+	}
+}
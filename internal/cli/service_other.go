@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package cli
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func errServiceUnsupported() error {
+	return fmt.Errorf("agent service is not supported on %s; run the agent under your init system by hand", runtime.GOOS)
+}
+
+func installService(serviceSpec) error   { return errServiceUnsupported() }
+func uninstallService(serviceSpec) error { return errServiceUnsupported() }
+func startService(serviceSpec) error     { return errServiceUnsupported() }
+func stopService(serviceSpec) error      { return errServiceUnsupported() }
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestParseServiceFlags(t *testing.T) {
+	spec, rest, err := parseServiceFlags([]string{"-name", "tunnel-b", "-config-file", "agent.yaml", "--user", "-admin-addr=127.0.0.1:7001"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if spec.Name != "tunnel-b" || !spec.User {
+		t.Fatalf("spec = %+v", spec)
+	}
+	if want := []string{"-config-file", "agent.yaml", "-admin-addr=127.0.0.1:7001"}; !slices.Equal(rest, want) {
+		t.Fatalf("agent args = %q, want %q", rest, want)
+	}
+	if _, _, err := parseServiceFlags([]string{"-name", "a/b"}); err == nil {
+		t.Fatal("a name with a slash should be refused")
+	}
+	if _, _, err := parseServiceFlags([]string{"-name"}); err == nil {
+		t.Fatal("-name without a value should be refused")
+	}
+}
+
+func TestAbsPathFlags(t *testing.T) {
+	wd, _ := filepath.Abs(".")
+	ca := filepath.Join(wd, "certs", "ca.pem")
+	got := absPathFlags([]string{"-config-file", "agent.yaml", "--config=routes.json", "-token", "relative", "-target-ca-file", ca})
+	want := []string{"-config-file", filepath.Join(wd, "agent.yaml"), "-config=" + filepath.Join(wd, "routes.json"), "-token", "relative", "-target-ca-file", ca}
+	if !slices.Equal(got, want) {
+		t.Fatalf("absPathFlags = %q, want %q", got, want)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"-server-url", "wss://t.example", "-token", "s3cret", "--admin-password=pw", "-tunnel-token=tt", "-config-file", "agent.yaml"}
+	got := redactArgs(args)
+	want := []string{"-server-url", "wss://t.example", "-token", "REDACTED", "-admin-password=REDACTED", "-tunnel-token=REDACTED", "-config-file", "agent.yaml"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("redactArgs = %q, want %q", got, want)
+	}
+	if args[3] != "s3cret" {
+		t.Fatal("redactArgs modified its input")
+	}
+}
+
+func TestWriteServiceFileIsOwnerOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.service")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeServiceFile(path, []byte("ExecStart=agent -token s3cret\n")); err != nil {
+		t.Fatalf("writeServiceFile: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm != 0o600 {
+		t.Fatalf("mode = %v, want 0600", perm)
+	}
+}
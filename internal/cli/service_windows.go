@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func openService(spec serviceSpec) (*mgr.Mgr, *mgr.Service, error) {
+	if spec.User {
+		return nil, nil, errors.New("-user is not supported for windows services")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to the service manager (run as administrator): %w", err)
+	}
+	s, err := m.OpenService(spec.Name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, fmt.Errorf("open service %s: %w", spec.Name, err)
+	}
+	return m, s, nil
+}
+
+func installService(spec serviceSpec) error {
+	if spec.User {
+		return errors.New("-user is not supported for windows services")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists; uninstall it first", spec.Name)
+	}
+	s, err := m.CreateService(spec.Name, spec.Exe, mgr.Config{
+		DisplayName: "Tunnel Agent (" + spec.Name + ")",
+		Description: "Exposes local services through the tunneling gateway.",
+		StartType:   mgr.StartAutomatic,
+	}, spec.Args...)
+	if err != nil {
+		return fmt.Errorf("create service %s: %w", spec.Name, err)
+	}
+	defer s.Close()
+	// Restart after a crash like systemd's Restart=always.
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 2 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		return err
+	}
+	// Also when the agent exits with an error rather than crashing.
+	return s.SetRecoveryActionsOnNonCrashFailures(true)
+}
+
+func uninstallService(spec serviceSpec) error {
+	m, s, err := openService(spec)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	_ = stopAndWait(s)
+	return s.Delete()
+}
+
+func startService(spec serviceSpec) error {
+	m, s, err := openService(spec)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService(spec serviceSpec) error {
+	m, s, err := openService(spec)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return stopAndWait(s)
+}
+
+// stopAndWait asks the service to stop and waits for the agent to drain.
+func stopAndWait(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Minute)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return errors.New("service did not stop within a minute")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
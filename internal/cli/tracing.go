@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	"tunneling/internal/tracing"
+)
+
+// traceFlags are the OTLP tracing flags of the server and agent.
+type traceFlags struct {
+	endpoint *string
+	ratio    *float64
+	service  *string
+}
+
+func addTraceFlags(fs *flag.FlagSet, service string) *traceFlags {
+	return &traceFlags{
+		endpoint: fs.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector that receives request spans, e.g. http://127.0.0.1:4318; empty disables tracing"),
+		ratio:    fs.Float64("trace-sample-ratio", 1, "share of new traces that are recorded (0-1); a request carrying a traceparent keeps the caller's decision"),
+		service:  fs.String("trace-service-name", envOr("OTEL_SERVICE_NAME", service), "service.name reported with the spans"),
+	}
+}
+
+// start returns the tracer, exporting until ctx is done, or nil when no
+// endpoint is set.
+func (f *traceFlags) start(ctx context.Context) (*tracing.Tracer, error) {
+	if *f.endpoint == "" {
+		return nil, nil
+	}
+	t, err := tracing.New(*f.endpoint, *f.service, *f.ratio)
+	if err != nil {
+		return nil, err
+	}
+	go t.Run(ctx)
+	slog.Info("tracing enabled", "endpoint", *f.endpoint, "service", *f.service, "sample_ratio", *f.ratio)
+	return t, nil
+}
@@ -0,0 +1,63 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type agentAuthRequest struct {
+	TunnelID string `json:"tunnel_id"`
+	Token    string `json:"token"`
+}
+
+// handleAgentAuth lets the tunnel server check an agent's credentials before
+// it accepts the websocket, and tells it which hostnames the tunnel owns.
+func (s *Server) handleAgentAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req agentAuthRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	tunnelID := strings.TrimSpace(req.TunnelID)
+	token := strings.TrimSpace(req.Token)
+	if tunnelID == "" || token == "" {
+		errorJSON(w, http.StatusUnauthorized, "tunnel_id and token are required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	tunnel, err := s.store.ValidateTunnelToken(ctx, tunnelID, token)
+	if err != nil && !errors.Is(err, ErrInvalidTunnelToken) {
+		// Let the server retry rather than turn a storage hiccup into a
+		// rejected agent.
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if err != nil {
+		errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
+		s.events.Add("warn", "agent.auth.failed", tunnelID, "server rejected agent connect: invalid tunnel credentials")
+		return
+	}
+	routes, err := s.store.ListEnabledProtocolRoutesByTunnel(ctx, tunnel.ID)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	hostnames := make([]string, 0, len(routes))
+	for _, route := range routes {
+		if routePending(route) {
+			continue
+		}
+		hostnames = append(hostnames, route.Hostname)
+		hostnames = append(hostnames, route.Aliases...)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tunnel_id": tunnel.ID, "name": tunnel.Name, "hostnames": hostnames})
+}
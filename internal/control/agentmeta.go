@@ -0,0 +1,48 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// handleGatewayAgents takes what an agent reported about itself when it
+// connected to a tunnel server, {"tunnel_id": "...", "agent": {...}}, and
+// stores it on the tunnel for the dashboard.
+func (s *Server) handleGatewayAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !caller(r).Admin {
+		errorJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	var req struct {
+		TunnelID string              `json:"tunnel_id"`
+		Agent    *protocol.AgentMeta `json:"agent"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&req); err != nil || strings.TrimSpace(req.TunnelID) == "" || req.Agent == nil {
+		errorJSON(w, http.StatusBadRequest, "body must be {\"tunnel_id\": \"...\", \"agent\": {...}}")
+		return
+	}
+	agent := protocol.SanitizeAgentMeta(req.Agent)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	tunnelID := strings.TrimSpace(req.TunnelID)
+	if err := s.store.SetTunnelAgent(ctx, tunnelID, agent); errors.Is(err, ErrNotFound) {
+		errorJSON(w, http.StatusNotFound, "tunnel not found")
+		return
+	} else if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.events.Add("info", "agent.connected", tunnelID, "version="+agent.Version+" os="+agent.OS+"/"+agent.Arch+" hostname="+agent.Hostname)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
@@ -0,0 +1,71 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"tunneling/internal/protocol"
+)
+
+// errHostnameIsAlias is returned when a new route's hostname is already an
+// alias of another route.
+var errHostnameIsAlias = errors.New("hostname is already an alias of another route")
+
+// routeByAlias finds the route that lists hostname among its aliases.
+func (s *Server) routeByAlias(ctx context.Context, hostname string) (Route, bool, error) {
+	routes, err := s.store.SearchRoutes(ctx, ListOptions{})
+	if err != nil {
+		return Route{}, false, err
+	}
+	for _, route := range routes {
+		if slices.Contains(route.Aliases, hostname) {
+			return route, true, nil
+		}
+	}
+	return Route{}, false, nil
+}
+
+// parseAliases validates the aliases a PATCH sets on route: null or []
+// clears them. It returns the HTTP status to answer with on failure.
+func (s *Server) parseAliases(ctx context.Context, route Route, raw json.RawMessage) ([]string, int, error) {
+	var requested []string
+	if err := json.Unmarshal(raw, &requested); err != nil {
+		return nil, http.StatusBadRequest, errors.New("aliases must be a list of hostnames like [\"example.com\"]")
+	}
+	for i, alias := range requested {
+		host, err := normalizeHostname(alias, s.reserved)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("alias %q: %w", alias, err)
+		}
+		// Aliases skip domain verification, so they must be platform domains.
+		if len(s.platformDomains) > 0 && !s.platformHostname(host) {
+			return nil, http.StatusBadRequest, fmt.Errorf("alias %s needs domain verification; add it as a route of its own", host)
+		}
+		requested[i] = host
+	}
+	aliases, err := protocol.NormalizeAliases(route.Hostname, requested)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for _, alias := range aliases {
+		other, err := s.store.GetRouteByHostname(ctx, alias)
+		if err == nil && other.ID != route.ID {
+			return nil, http.StatusConflict, fmt.Errorf("%s is already a route", alias)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, http.StatusBadGateway, err
+		}
+		other, ok, err := s.routeByAlias(ctx, alias)
+		if err != nil {
+			return nil, http.StatusBadGateway, err
+		}
+		if ok && other.ID != route.ID {
+			return nil, http.StatusConflict, fmt.Errorf("%s is already an alias of %s", alias, other.Hostname)
+		}
+	}
+	return aliases, http.StatusOK, nil
+}
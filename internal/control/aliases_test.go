@@ -0,0 +1,58 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteAliasesAPI(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "t", "tok", "bob", "web", "", "", nil)
+	route, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "www.example.com", Target: "127.0.0.1:1", Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "api.example.com", Target: "127.0.0.1:2", Enabled: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	handler := srv.Handler()
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/routes/"+route.ID, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := patch(`{"aliases":["api.example.com"]}`); rec.Code != http.StatusConflict {
+		t.Fatalf("alias of an existing route status = %d", rec.Code)
+	}
+	if rec := patch(`{"aliases":["localhost"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid alias status = %d", rec.Code)
+	}
+	if rec := patch(`{"aliases":["Example.com","www.example.com"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("set aliases status = %d: %s", rec.Code, rec.Body)
+	}
+
+	mapped, _, err := srv.agentRoutes(ctx, tunnel.ID)
+	if err != nil || len(mapped) != 2 || mapped[1].Hostname != "www.example.com" || len(mapped[1].Aliases) != 1 || mapped[1].Aliases[0] != "example.com" {
+		t.Fatalf("agent routes = %+v, %v", mapped, err)
+	}
+	if _, err := srv.createRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "example.com", Target: "127.0.0.1:3", Enabled: true}); !isRouteConflictError(err) {
+		t.Fatalf("creating a route on an alias err = %v", err)
+	}
+
+	if rec := patch(`{"aliases":null}`); rec.Code != http.StatusOK {
+		t.Fatalf("clear aliases status = %d", rec.Code)
+	}
+	if got, _ := store.GetRouteByID(ctx, route.ID); len(got.Aliases) != 0 {
+		t.Fatalf("aliases after clearing = %v", got.Aliases)
+	}
+}
@@ -0,0 +1,104 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Gateway is a tunnel server agents may be sent to.
+type Gateway struct {
+	URL    string `json:"url"`
+	Region string `json:"region,omitempty"`
+}
+
+// ParseGateways reads a comma separated list of "region=wss://host/connect"
+// entries; the region is optional.
+func ParseGateways(list string) ([]Gateway, error) {
+	var out []Gateway
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var g Gateway
+		if region, rest, ok := strings.Cut(entry, "="); ok && !strings.Contains(region, "://") {
+			g.Region, entry = strings.ToLower(strings.TrimSpace(region)), strings.TrimSpace(rest)
+		}
+		u, err := url.Parse(entry)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return nil, fmt.Errorf("gateway %q must be a ws:// or wss:// url, optionally prefixed with region=", entry)
+		}
+		g.URL = entry
+		out = append(out, g)
+	}
+	return out, nil
+}
+
+// SetGateways lists the tunnel servers /agent/assign chooses from. Without
+// any, agents are always sent to the agent server url.
+func (s *Server) SetGateways(gateways []Gateway) {
+	s.gateways = gateways
+}
+
+type agentAssignRequest struct {
+	TunnelID string `json:"tunnel_id"`
+	Token    string `json:"token"`
+	Region   string `json:"region,omitempty"`
+}
+
+// handleAgentAssign tells an agent which tunnel servers to use, best first:
+// those in the region it asked for, then the rest, each group ordered by how
+// many online agents report being connected to them.
+func (s *Server) handleAgentAssign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req agentAssignRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	tunnelID := strings.TrimSpace(req.TunnelID)
+	token := strings.TrimSpace(req.Token)
+	if tunnelID == "" || token == "" {
+		errorJSON(w, http.StatusBadRequest, "tunnel_id and token are required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if _, err := s.store.ValidateTunnelToken(ctx, tunnelID, token); err != nil {
+		errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
+		s.events.Add("warn", "agent.assign.auth_failed", tunnelID, "invalid tunnel credentials")
+		return
+	}
+
+	servers := s.rankGateways(strings.ToLower(strings.TrimSpace(req.Region)), tunnelID)
+	writeJSON(w, http.StatusOK, map[string]any{"server": servers[0], "servers": servers})
+}
+
+func (s *Server) rankGateways(region, tunnelID string) []string {
+	if len(s.gateways) == 0 {
+		return []string{s.agentServerWS}
+	}
+	load := s.presence.gatewayLoad(tunnelID, time.Now())
+	ranked := make([]Gateway, len(s.gateways))
+	copy(ranked, s.gateways)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		inI, inJ := region != "" && ranked[i].Region == region, region != "" && ranked[j].Region == region
+		if inI != inJ {
+			return inI
+		}
+		return load[ranked[i].URL] < load[ranked[j].URL]
+	})
+	out := make([]string, len(ranked))
+	for i, g := range ranked {
+		out[i] = g.URL
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAgentAssignRanksGateways(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	var tunnels []Tunnel
+	for _, name := range []string{"a", "b", "c"} {
+		tunnel, err := store.CreateTunnel(ctx, name, "secret-"+name)
+		if err != nil {
+			t.Fatalf("CreateTunnel: %v", err)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	gateways, err := ParseGateways("eu=wss://eu1.test/connect, eu=wss://eu2.test/connect,us=wss://us1.test/connect")
+	if err != nil {
+		t.Fatalf("ParseGateways: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetGateways(gateways)
+	handler := srv.Handler()
+
+	post := func(path string, body any) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(raw))))
+		return rec
+	}
+	assign := func(tunnel Tunnel, region string) []string {
+		t.Helper()
+		rec := post("/agent/assign", agentAssignRequest{TunnelID: tunnel.ID, Token: "secret-" + tunnel.Name, Region: region})
+		var out struct {
+			Server  string   `json:"server"`
+			Servers []string `json:"servers"`
+		}
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &out) != nil || out.Server != out.Servers[0] {
+			t.Fatalf("assign = %d %s", rec.Code, rec.Body)
+		}
+		return out.Servers
+	}
+
+	// Two agents already sit on eu1, so eu2 is the lighter eu gateway.
+	for _, tunnel := range tunnels[:2] {
+		if rec := post("/agent/heartbeat", agentHeartbeatRequest{TunnelID: tunnel.ID, Token: "secret-" + tunnel.Name, Connected: true, Server: "wss://eu1.test/connect"}); rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat = %d", rec.Code)
+		}
+	}
+	if got := strings.Join(assign(tunnels[2], "EU"), " "); got != "wss://eu2.test/connect wss://eu1.test/connect wss://us1.test/connect" {
+		t.Fatalf("eu assignment = %s", got)
+	}
+	if got := assign(tunnels[2], "us"); got[0] != "wss://us1.test/connect" {
+		t.Fatalf("us assignment = %v", got)
+	}
+	if got := assign(tunnels[2], ""); got[0] != "wss://eu2.test/connect" && got[0] != "wss://us1.test/connect" {
+		t.Fatalf("least loaded assignment = %v", got)
+	}
+
+	if rec := post("/agent/assign", agentAssignRequest{TunnelID: tunnels[0].ID, Token: "wrong"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("bad credentials = %d", rec.Code)
+	}
+	if _, err := ParseGateways("eu=https://eu1.test/connect"); err == nil {
+		t.Fatalf("ParseGateways accepted an https url")
+	}
+}
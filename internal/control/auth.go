@@ -0,0 +1,228 @@
+package control
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Principal is who a management API request was authenticated as.
+type Principal struct {
+	// Admin is set for API keys and the admin key.
+	Admin bool
+	// UserID is the subject of a Supabase access token.
+	UserID string
+	// TunnelID is set when a tunnel's own token was presented for an
+	// operation on that tunnel.
+	TunnelID string
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the caller the auth middleware attached to ctx.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// SetAPIAuth turns on authentication of the management endpoints
+// (/api/tunnels, /api/routes, /api/logs, /api/usage, /api/gateway and the
+// paths below them, and /agent/auth) and scopes users to the tunnels they
+// own. Each of keys, and the admin key, is accepted as a bearer token with
+// full access; with jwtSecret, Supabase access tokens signed with it are
+// accepted as their user (service_role tokens as admin). A tunnel's own
+// token also works for requests on that tunnel. Without keys or a secret
+// the endpoints stay open.
+func (s *Server) SetAPIAuth(keys []string, jwtSecret string) {
+	s.apiKeys = nil
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			s.apiKeys = append(s.apiKeys, k)
+		}
+	}
+	s.jwtSecret = strings.TrimSpace(jwtSecret)
+}
+
+func (s *Server) authEnabled() bool {
+	return len(s.apiKeys) > 0 || s.jwtSecret != ""
+}
+
+// managementPath reports whether path belongs to the endpoints SetAPIAuth
+// protects. Agent, portal and session endpoints carry their own tunnel
+// credentials; /api/admin checks the admin key itself.
+func managementPath(path string) bool {
+	return path == "/api/tunnels" || strings.HasPrefix(path, "/api/tunnels/") ||
+		path == "/api/routes" || strings.HasPrefix(path, "/api/routes/") ||
+		path == "/api/logs" || path == "/api/logs/stream" || path == "/api/usage" || path == "/api/log-level" ||
+		path == "/api/gateway/routes" || path == "/api/gateway/wake" || path == "/api/gateway/agents" ||
+		path == "/agent/auth"
+}
+
+// adminOnly lists the management operations a user or tunnel may not run.
+func adminOnly(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/tunnels":
+		return r.Method == http.MethodDelete
+	case "/api/usage":
+		// Usage reports come from tunnel servers.
+		return r.Method == http.MethodPost
+	case "/api/log-level", "/api/gateway/routes", "/api/gateway/wake", "/api/gateway/agents":
+		return true
+	case "/agent/auth":
+		// Only tunnel servers may ask; to anyone else it would answer
+		// whether a guessed token is valid.
+		return true
+	}
+	return false
+}
+
+// caller returns who is making a management request. With API auth off
+// every caller is an admin, as before it existed.
+func caller(r *http.Request) Principal {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		return p
+	}
+	return Principal{Admin: true}
+}
+
+// canAccess reports whether p may read or change tunnel t: admins any,
+// users the tunnels they own, a tunnel token only its own tunnel.
+func (p Principal) canAccess(t Tunnel) bool {
+	switch {
+	case p.Admin:
+		return true
+	case p.TunnelID != "":
+		return p.TunnelID == t.ID
+	default:
+		return p.UserID != "" && p.UserID == t.OwnerID
+	}
+}
+
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() || !managementPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := s.authenticate(r)
+		if !ok || adminOnly(r) && !p.Admin {
+			s.writeAuthError(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authenticate checks the request's bearer token against, in order, the API
+// keys, Supabase tokens and the token of the tunnel named in the path.
+func (s *Server) authenticate(r *http.Request) (Principal, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return Principal{}, false
+	}
+	if s.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminKey)) == 1 {
+		return Principal{Admin: true}, true
+	}
+	for _, key := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return Principal{Admin: true}, true
+		}
+	}
+	if s.jwtSecret != "" && strings.Count(token, ".") == 2 {
+		claims, err := verifyJWT(token, []byte(s.jwtSecret), time.Now())
+		switch {
+		case err != nil:
+			return Principal{}, false
+		case claims.Role == "service_role":
+			return Principal{Admin: true}, true
+		case claims.Subject == "":
+			return Principal{}, false
+		}
+		return Principal{UserID: claims.Subject}, true
+	}
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/api/tunnels/"); ok && s.store != nil {
+		tunnelID, _, _ := strings.Cut(rest, "/")
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if tunnelID != "" {
+			if _, err := s.store.ValidateTunnelToken(ctx, tunnelID, token); err == nil {
+				return Principal{TunnelID: tunnelID}, true
+			}
+		}
+	}
+	return Principal{}, false
+}
+
+// writeAuthError answers 403 to a caller that authenticated but lacks the
+// rights for the request, and 401 to everyone else.
+func (s *Server) writeAuthError(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(r); ok {
+		errorJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	errorJSON(w, http.StatusUnauthorized, "unauthorized")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	return token, ok && token != ""
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// verifyJWT accepts an HS256 token signed with secret, the way Supabase
+// signs access tokens, that carries an expiry which has not passed.
+func verifyJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed token header")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return claims, errors.New("unsupported token algorithm")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errors.New("bad token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed token payload")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed token payload")
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return claims, errors.New("token not yet valid")
+	}
+	return claims, nil
+}
@@ -0,0 +1,141 @@
+package control
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signJWT(secret, payload string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestManagementAPIAuth(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, err := store.CreateTunnel(context.Background(), "dev", "tunnel-secret")
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "admin")
+	srv.SetAPIAuth([]string{"k1", " "}, "jwt-secret")
+	handler := srv.Handler()
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	user := signJWT("jwt-secret", `{"sub":"u1","role":"authenticated","exp":`+exp+`}`)
+	expired := signJWT("jwt-secret", `{"sub":"u1","exp":1}`)
+	forged := signJWT("other", `{"sub":"u1","exp":`+exp+`}`)
+
+	do := func(method, path, bearer string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, tc := range []struct {
+		method, path, bearer string
+		want                 int
+	}{
+		{"GET", "/api/tunnels", "", http.StatusUnauthorized},
+		{"GET", "/api/tunnels", "wrong", http.StatusUnauthorized},
+		{"GET", "/api/tunnels", "k1", http.StatusOK},
+		{"GET", "/api/tunnels", "admin", http.StatusOK},
+		{"GET", "/api/tunnels", user, http.StatusOK},
+		{"GET", "/api/tunnels", expired, http.StatusUnauthorized},
+		{"GET", "/api/tunnels", forged, http.StatusUnauthorized},
+		{"GET", "/api/logs", user, http.StatusForbidden},
+		{"GET", "/api/logs", "k1", http.StatusOK},
+		{"DELETE", "/api/tunnels", user, http.StatusForbidden},
+		{"GET", "/api/tunnels/" + tunnel.ID + "/routes", "tunnel-secret", http.StatusOK},
+		{"GET", "/api/tunnels", "tunnel-secret", http.StatusUnauthorized},
+		{"DELETE", "/api/admin/routes/x", user, http.StatusForbidden},
+		{"DELETE", "/api/admin/routes/x", "", http.StatusUnauthorized},
+		{"DELETE", "/api/admin/routes/x", "k1", http.StatusNotFound},
+		{"GET", "/healthz", "", http.StatusOK},
+		{"GET", "/api/log-level", user, http.StatusForbidden},
+		{"GET", "/api/log-level", "k1", http.StatusOK},
+		{"DELETE", "/api/tunnels/" + tunnel.ID, "tunnel-secret", http.StatusOK},
+	} {
+		if got := do(tc.method, tc.path, tc.bearer); got != tc.want {
+			t.Fatalf("%s %s with %q = %d, want %d", tc.method, tc.path, tc.bearer, got, tc.want)
+		}
+	}
+}
+
+func TestManagementAPIScopesUsersToTheirTunnels(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	alice, _ := store.CreateTunnelWithMeta(ctx, "a", "ta", "alice", "web", "", "", nil)
+	bob, _ := store.CreateTunnelWithMeta(ctx, "b", "tb", "bob", "web", "", "", nil)
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: bob.ID, Hostname: "bob.example.com", Target: "127.0.0.1:1", Enabled: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetAPIAuth([]string{"k1"}, "jwt-secret")
+	handler := srv.Handler()
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	asAlice := signJWT("jwt-secret", `{"sub":"alice","exp":`+exp+`}`)
+
+	do := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("GET", "/api/tunnels", asAlice, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), alice.ID) || strings.Contains(rec.Body.String(), bob.ID) {
+		t.Fatalf("alice's tunnel list = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("GET", "/api/tunnels", "k1", ""); !strings.Contains(rec.Body.String(), bob.ID) {
+		t.Fatalf("admin tunnel list misses bob: %s", rec.Body.String())
+	}
+	for _, path := range []string{"/api/tunnels/" + bob.ID + "/routes", "/api/tunnels/" + bob.ID + "/command", "/api/logs?tunnel_id=" + bob.ID} {
+		if rec := do("GET", path, asAlice, ""); rec.Code != http.StatusForbidden {
+			t.Fatalf("alice GET %s = %d, want 403", path, rec.Code)
+		}
+	}
+	if rec := do("GET", "/api/tunnels/"+alice.ID+"/routes", asAlice, ""); rec.Code != http.StatusOK {
+		t.Fatalf("alice GET own routes = %d", rec.Code)
+	}
+	if rec := do("DELETE", "/api/tunnels/"+bob.ID, asAlice, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice DELETE bob's tunnel = %d, want 403", rec.Code)
+	}
+
+	steal := `{"tunnel_id":"` + alice.ID + `","hostname":"bob.example.com","target":"127.0.0.1:2","force":true}`
+	if rec := do("POST", "/api/routes", asAlice, steal); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice force-rebinding bob's hostname = %d %s, want 403", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "/api/routes", "k1", steal); rec.Code != http.StatusOK {
+		t.Fatalf("admin force-rebinding = %d %s", rec.Code, rec.Body.String())
+	}
+	intoBob := `{"tunnel_id":"` + bob.ID + `","hostname":"new.example.com","target":"127.0.0.1:2"}`
+	if rec := do("POST", "/api/routes", asAlice, intoBob); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice adding a route to bob's tunnel = %d, want 403", rec.Code)
+	}
+
+	rec = do("POST", "/api/tunnels", asAlice, `{"name":"c"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"owner_id":"alice"`) {
+		t.Fatalf("alice creating a tunnel = %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,153 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const cloudflareRecordComment = "managed by tunneling"
+
+// CloudflareDNS manages records of one Cloudflare zone through the v4 API.
+type CloudflareDNS struct {
+	baseURL    string
+	apiToken   string
+	zoneID     string
+	httpClient *http.Client
+}
+
+// NewCloudflareDNS uses an API token with DNS edit permission on zoneID.
+func NewCloudflareDNS(apiToken, zoneID string) (*CloudflareDNS, error) {
+	apiToken, zoneID = strings.TrimSpace(apiToken), strings.TrimSpace(zoneID)
+	if apiToken == "" {
+		return nil, errors.New("CLOUDFLARE_API_TOKEN is required")
+	}
+	if zoneID == "" {
+		return nil, errors.New("CLOUDFLARE_ZONE_ID is required")
+	}
+	return &CloudflareDNS{
+		baseURL:  "https://api.cloudflare.com/client/v4",
+		apiToken: apiToken,
+		zoneID:   zoneID,
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}, nil
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func (c *CloudflareDNS) SetRecord(ctx context.Context, rec DNSRecord) error {
+	existing, err := c.find(ctx, rec)
+	if err != nil {
+		return err
+	}
+	payload := cloudflareRecord{Type: rec.Type, Name: rec.Name, Content: rec.Value, TTL: rec.TTL, Comment: cloudflareRecordComment}
+	if len(existing) == 0 {
+		return c.requestJSON(ctx, http.MethodPost, "/dns_records", nil, payload, nil)
+	}
+	return c.requestJSON(ctx, http.MethodPut, "/dns_records/"+existing[0].ID, nil, payload, nil)
+}
+
+// DeleteRecord only removes records still pointing at rec.Value, so a name
+// someone repointed by hand is left alone.
+func (c *CloudflareDNS) DeleteRecord(ctx context.Context, rec DNSRecord) error {
+	existing, err := c.find(ctx, rec)
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if !strings.EqualFold(strings.TrimSuffix(r.Content, "."), rec.Value) {
+			continue
+		}
+		if err := c.requestJSON(ctx, http.MethodDelete, "/dns_records/"+r.ID, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CloudflareDNS) find(ctx context.Context, rec DNSRecord) ([]cloudflareRecord, error) {
+	query := url.Values{}
+	query.Set("name", rec.Name)
+	query.Set("type", rec.Type)
+	var records []cloudflareRecord
+	if err := c.requestJSON(ctx, http.MethodGet, "/dns_records", query, nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// requestJSON calls path under the zone and decodes the result field of
+// Cloudflare's response envelope into out.
+func (c *CloudflareDNS) requestJSON(ctx context.Context, method, path string, query url.Values, payload any, out any) error {
+	endpoint := c.baseURL + "/zones/" + url.PathEscape(c.zoneID) + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal payload: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err := json.Unmarshal(respBody, &envelope); err != nil {
+		return fmt.Errorf("cloudflare error status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if !envelope.Success || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var msgs []string
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare error status=%d: %s", resp.StatusCode, strings.Join(msgs, "; "))
+	}
+	if out == nil || len(envelope.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(envelope.Result, out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
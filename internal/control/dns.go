@@ -0,0 +1,250 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsPending = "pending"
+	dnsActive  = "active"
+
+	dnsQueueSize      = 1024
+	dnsResyncInterval = 5 * time.Minute
+)
+
+// DNSRecord is the record pointing one route hostname at the gateway.
+type DNSRecord struct {
+	Name  string
+	Type  string // "A", "AAAA" or "CNAME"
+	Value string
+	TTL   int
+}
+
+// DNSProvider manages the records of the platform's DNS zone.
+type DNSProvider interface {
+	// SetRecord creates rec, or updates the record of the same name and type.
+	SetRecord(ctx context.Context, rec DNSRecord) error
+	// DeleteRecord removes rec; a record that is already gone is not an error.
+	DeleteRecord(ctx context.Context, rec DNSRecord) error
+}
+
+// dnsChange asks the sync loop to create or remove the record of a route.
+type dnsChange struct {
+	routeID  string
+	tunnelID string
+	hostname string
+	remove   bool
+}
+
+// dnsSync keeps a record pointing at the gateway for every route on a
+// platform domain. Route writes queue changes; RunDNS applies them and
+// periodically retries routes whose record is not active yet.
+type dnsSync struct {
+	provider DNSProvider
+	target   string
+	kind     string
+	ttl      int
+	manages  func(hostname string) bool
+	store    Store
+	events   *EventStore
+	queue    chan dnsChange
+}
+
+// SetDNS makes the control plane create and delete DNS records for routes
+// on the platform domains, pointing them at target: a CNAME to a hostname
+// or an A/AAAA record to an IP. The records are written by RunDNS.
+func (s *Server) SetDNS(provider DNSProvider, target string, ttl int) error {
+	target = strings.Trim(strings.TrimSpace(target), ".")
+	if target == "" {
+		return errors.New("dns target is required")
+	}
+	if len(s.platformDomains) == 0 {
+		return errors.New("dns automation needs the platform domains it manages")
+	}
+	if ttl <= 0 {
+		ttl = 300
+	}
+	kind := "CNAME"
+	if ip := net.ParseIP(target); ip != nil {
+		kind = "A"
+		if ip.To4() == nil {
+			kind = "AAAA"
+		}
+	}
+	ns := s.store.(notifyingStore)
+	s.dns = &dnsSync{
+		provider: provider,
+		target:   target,
+		kind:     kind,
+		ttl:      ttl,
+		manages:  s.platformHostname,
+		store:    ns.Store,
+		events:   s.events,
+		queue:    make(chan dnsChange, dnsQueueSize),
+	}
+	ns.Store = dnsStore{Store: ns.Store, dns: s.dns}
+	s.store = ns
+	return nil
+}
+
+// RunDNS applies queued record changes until ctx is done. Routes whose
+// record is missing or failed, including those created before SetDNS, are
+// retried every few minutes.
+func (s *Server) RunDNS(ctx context.Context) {
+	if s.dns == nil {
+		return
+	}
+	ticker := time.NewTicker(dnsResyncInterval)
+	defer ticker.Stop()
+	s.dns.resync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-s.dns.queue:
+			s.dns.apply(ctx, c)
+		case <-ticker.C:
+			s.dns.resync(ctx)
+		}
+	}
+}
+
+func (d *dnsSync) record(hostname string) DNSRecord {
+	return DNSRecord{Name: hostname, Type: d.kind, Value: d.target, TTL: d.ttl}
+}
+
+func (d *dnsSync) enqueue(c dnsChange) {
+	select {
+	case d.queue <- c:
+	default:
+		// Creations are caught up by the next resync; a dropped removal
+		// leaves a dangling record behind.
+		d.events.Add("warn", "dns.queue.full", c.tunnelID, c.hostname)
+	}
+}
+
+func (d *dnsSync) apply(ctx context.Context, c dnsChange) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	rec := d.record(c.hostname)
+	if c.remove {
+		if err := d.provider.DeleteRecord(ctx, rec); err != nil {
+			d.events.Add("error", "dns.delete.failed", c.tunnelID, c.hostname+": "+err.Error())
+			return
+		}
+		d.events.Add("info", "dns.deleted", c.tunnelID, c.hostname)
+		return
+	}
+	status := dnsActive
+	if err := d.provider.SetRecord(ctx, rec); err != nil {
+		status = "error: " + err.Error()
+		if len(status) > 200 {
+			status = status[:200]
+		}
+		d.events.Add("error", "dns.create.failed", c.tunnelID, c.hostname+": "+err.Error())
+	} else {
+		d.events.Add("info", "dns.created", c.tunnelID, c.hostname+" "+rec.Type+" "+rec.Value)
+	}
+	if _, err := d.store.SetRouteDNSStatus(ctx, c.routeID, status); err != nil && !errors.Is(err, ErrNotFound) {
+		d.events.Add("error", "dns.status.failed", c.tunnelID, err.Error())
+	}
+}
+
+// resync sets the records of managed routes that are not active.
+func (d *dnsSync) resync(ctx context.Context) {
+	scanCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	routes, err := d.store.SearchRoutes(scanCtx, ListOptions{})
+	cancel()
+	if err != nil {
+		d.events.Add("error", "dns.scan.failed", "", err.Error())
+		return
+	}
+	for _, r := range routes {
+		if ctx.Err() != nil {
+			return
+		}
+		if d.manages(r.Hostname) && r.DNSStatus != dnsActive {
+			d.apply(ctx, dnsChange{routeID: r.ID, tunnelID: r.TunnelID, hostname: r.Hostname})
+		}
+	}
+}
+
+func (d *dnsSync) remove(routes ...Route) {
+	for _, r := range routes {
+		if d.manages(r.Hostname) {
+			d.enqueue(dnsChange{routeID: r.ID, tunnelID: r.TunnelID, hostname: r.Hostname, remove: true})
+		}
+	}
+}
+
+// dnsStore wraps a Store so that every route created, renamed or deleted,
+// wherever it comes from in the API, queues the matching record change.
+type dnsStore struct {
+	Store
+	dns *dnsSync
+}
+
+func (s dnsStore) CreateRoute(ctx context.Context, route Route) (Route, error) {
+	route.DNSStatus = ""
+	if s.dns.manages(route.Hostname) {
+		route.DNSStatus = dnsPending
+	}
+	created, err := s.Store.CreateRoute(ctx, route)
+	if err == nil && created.DNSStatus == dnsPending {
+		s.dns.enqueue(dnsChange{routeID: created.ID, tunnelID: created.TunnelID, hostname: created.Hostname})
+	}
+	return created, err
+}
+
+func (s dnsStore) UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error) {
+	previous, _ := s.Store.GetRouteByID(ctx, routeID)
+	updated, err := s.Store.UpdateRouteHostname(ctx, routeID, hostname)
+	if err != nil || previous.Hostname == updated.Hostname {
+		return updated, err
+	}
+	s.dns.remove(previous)
+	status := ""
+	if s.dns.manages(updated.Hostname) {
+		status = dnsPending
+	}
+	if status != updated.DNSStatus {
+		if updated, err = s.Store.SetRouteDNSStatus(ctx, routeID, status); err != nil {
+			return updated, err
+		}
+	}
+	if status == dnsPending {
+		s.dns.enqueue(dnsChange{routeID: updated.ID, tunnelID: updated.TunnelID, hostname: updated.Hostname})
+	}
+	return updated, nil
+}
+
+func (s dnsStore) DeleteRouteByID(ctx context.Context, routeID string) error {
+	previous, _ := s.Store.GetRouteByID(ctx, routeID)
+	err := s.Store.DeleteRouteByID(ctx, routeID)
+	if err == nil && previous.ID != "" {
+		s.dns.remove(previous)
+	}
+	return err
+}
+
+func (s dnsStore) DeleteTunnelByID(ctx context.Context, tunnelID string) error {
+	routes, _ := s.Store.ListRoutesByTunnel(ctx, tunnelID)
+	err := s.Store.DeleteTunnelByID(ctx, tunnelID)
+	if err == nil {
+		s.dns.remove(routes...)
+	}
+	return err
+}
+
+func (s dnsStore) DeleteAllTunnels(ctx context.Context) error {
+	routes, _ := s.Store.SearchRoutes(ctx, ListOptions{})
+	err := s.Store.DeleteAllTunnels(ctx)
+	if err == nil {
+		s.dns.remove(routes...)
+	}
+	return err
+}
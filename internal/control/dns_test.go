@@ -0,0 +1,226 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string]DNSRecord
+	fail    error
+}
+
+func (f *fakeDNS) SetRecord(ctx context.Context, rec DNSRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != nil {
+		return f.fail
+	}
+	f.records[rec.Name] = rec
+	return nil
+}
+
+func (f *fakeDNS) DeleteRecord(ctx context.Context, rec DNSRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.records, rec.Name)
+	return nil
+}
+
+// drainDNS applies the queued record changes.
+func drainDNS(srv *Server) {
+	for {
+		select {
+		case c := <-srv.dns.queue:
+			srv.dns.apply(context.Background(), c)
+		default:
+			return
+		}
+	}
+}
+
+func TestDNSRecordsFollowRoutes(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "a", "ta", "alice", "web", "", "", nil)
+	srv := NewServer(store, "", "", "", "", "")
+	if err := srv.SetDNS(&fakeDNS{}, "gw.example.com", 0); err == nil {
+		t.Fatal("SetDNS without platform domains succeeded")
+	}
+	srv.SetPlatformDomains([]string{"example.com"})
+	provider := &fakeDNS{records: map[string]DNSRecord{}, fail: errors.New("zone is locked")}
+	if err := srv.SetDNS(provider, "gw.example.com.", 0); err != nil {
+		t.Fatalf("SetDNS: %v", err)
+	}
+
+	route, err := srv.store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:1", Enabled: true})
+	if err != nil || route.DNSStatus != dnsPending {
+		t.Fatalf("CreateRoute = %+v, %v", route, err)
+	}
+	custom, _ := srv.store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "shop.custom.org", Target: "127.0.0.1:1", Enabled: true})
+	if custom.DNSStatus != "" {
+		t.Fatalf("custom domain got dns status %q", custom.DNSStatus)
+	}
+	drainDNS(srv)
+	if got, _ := srv.store.GetRouteByID(ctx, route.ID); !strings.HasPrefix(got.DNSStatus, "error: zone is locked") {
+		t.Fatalf("dns status after a failure = %q", got.DNSStatus)
+	}
+
+	provider.fail = nil
+	srv.dns.resync(ctx)
+	want := DNSRecord{Name: "app.example.com", Type: "CNAME", Value: "gw.example.com", TTL: 300}
+	if provider.records["app.example.com"] != want || len(provider.records) != 1 {
+		t.Fatalf("records after resync = %+v", provider.records)
+	}
+	if got, _ := srv.store.GetRouteByID(ctx, route.ID); got.DNSStatus != dnsActive {
+		t.Fatalf("dns status after resync = %q", got.DNSStatus)
+	}
+
+	if _, err := srv.store.UpdateRouteHostname(ctx, route.ID, "web.example.com"); err != nil {
+		t.Fatalf("UpdateRouteHostname: %v", err)
+	}
+	drainDNS(srv)
+	if _, ok := provider.records["app.example.com"]; ok || provider.records["web.example.com"].Value != "gw.example.com" {
+		t.Fatalf("records after rename = %+v", provider.records)
+	}
+	if err := srv.store.DeleteTunnelByID(ctx, tunnel.ID); err != nil {
+		t.Fatalf("DeleteTunnelByID: %v", err)
+	}
+	drainDNS(srv)
+	if len(provider.records) != 0 {
+		t.Fatalf("records after deleting the tunnel = %+v", provider.records)
+	}
+}
+
+func TestCloudflareDNS(t *testing.T) {
+	var mu sync.Mutex
+	records := map[string]cloudflareRecord{"r0": {ID: "r0", Type: "CNAME", Name: "old.example.com", Content: "elsewhere.example.net"}}
+	nextID := 1
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer cf-token" || !strings.HasPrefix(r.URL.Path, "/zones/z1/dns_records") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`)
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/zones/z1/dns_records"), "/")
+		var result any
+		switch r.Method {
+		case http.MethodGet:
+			found := []cloudflareRecord{}
+			for _, rec := range records {
+				if rec.Name == r.URL.Query().Get("name") && rec.Type == r.URL.Query().Get("type") {
+					found = append(found, rec)
+				}
+			}
+			result = found
+		case http.MethodPost, http.MethodPut:
+			var rec cloudflareRecord
+			_ = json.NewDecoder(r.Body).Decode(&rec)
+			if id == "" {
+				id = "r" + string(rune('0'+nextID))
+				nextID++
+			}
+			rec.ID = id
+			records[id] = rec
+			result = rec
+		case http.MethodDelete:
+			delete(records, id)
+			result = map[string]string{"id": id}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "errors": []any{}, "result": result})
+	}))
+	defer api.Close()
+
+	cf, err := NewCloudflareDNS("cf-token", "z1")
+	if err != nil {
+		t.Fatalf("NewCloudflareDNS: %v", err)
+	}
+	cf.baseURL = api.URL
+	ctx := context.Background()
+	rec := DNSRecord{Name: "app.example.com", Type: "CNAME", Value: "gw.example.com", TTL: 300}
+	if err := cf.SetRecord(ctx, rec); err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	rec.TTL = 60
+	if err := cf.SetRecord(ctx, rec); err != nil {
+		t.Fatalf("SetRecord again: %v", err)
+	}
+	if len(records) != 2 || records["r1"].TTL != 60 || records["r1"].Comment != cloudflareRecordComment {
+		t.Fatalf("records = %+v", records)
+	}
+	if err := cf.DeleteRecord(ctx, rec); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	// A record pointing somewhere else is not ours to delete.
+	if err := cf.DeleteRecord(ctx, DNSRecord{Name: "old.example.com", Type: "CNAME", Value: "gw.example.com"}); err != nil {
+		t.Fatalf("DeleteRecord of a foreign record: %v", err)
+	}
+	if len(records) != 1 || records["r0"].Name != "old.example.com" {
+		t.Fatalf("records after delete = %+v", records)
+	}
+	cf.apiToken = "wrong"
+	if err := cf.SetRecord(ctx, rec); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Fatalf("SetRecord with a bad token = %v", err)
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite.
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", "us-east-1", "service", now)
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization = %s", got)
+	}
+}
+
+func TestRoute53DNS(t *testing.T) {
+	var bodies []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.URL.Path != "/2013-04-01/hostedzone/Z1/rrset" || !strings.Contains(r.Header.Get("Authorization"), "Credential=AK/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if strings.Contains(string(body), "<Action>DELETE</Action>") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidChangeBatch</Code><Message>[Tried to delete resource record set [name='app.example.com.', type='A'] but it was not found]</Message></Error></ErrorResponse>`)
+			return
+		}
+		_, _ = io.WriteString(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`)
+	}))
+	defer api.Close()
+
+	r53, err := NewRoute53DNS("AK", "secret", "", "/hostedzone/Z1")
+	if err != nil {
+		t.Fatalf("NewRoute53DNS: %v", err)
+	}
+	r53.endpoint = api.URL
+	ctx := context.Background()
+	rec := DNSRecord{Name: "app.example.com", Type: "A", Value: "203.0.113.7", TTL: 300}
+	if err := r53.SetRecord(ctx, rec); err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	if !strings.Contains(bodies[0], "<Action>UPSERT</Action><ResourceRecordSet><Name>app.example.com</Name><Type>A</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>203.0.113.7</Value>") {
+		t.Fatalf("change body = %s", bodies[0])
+	}
+	if err := r53.DeleteRecord(ctx, rec); err != nil {
+		t.Fatalf("DeleteRecord of a missing record: %v", err)
+	}
+}
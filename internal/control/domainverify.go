@@ -0,0 +1,196 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	VerificationPending  = "pending"
+	VerificationVerified = "verified"
+
+	// ChallengePath is where the HTTP challenge of a hostname is fetched. The
+	// tunnel server forwards it to the control API, so pointing the domain at
+	// the gateway is enough to pass it.
+	ChallengePath = "/.well-known/tunneling-challenge/"
+	// challengeDNSPrefix names the TXT record of the DNS challenge.
+	challengeDNSPrefix = "_tunneling-challenge."
+)
+
+// domainVerifier runs the DNS and HTTP challenges; tests swap both out.
+type domainVerifier struct {
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+	client    *http.Client
+}
+
+func newDomainVerifier() *domainVerifier {
+	return &domainVerifier{
+		lookupTXT: net.DefaultResolver.LookupTXT,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetPlatformDomains lists the base domains the platform owns. Routes for a
+// hostname outside them then stay pending until their owner proves control
+// of the domain. With none set every hostname is accepted as before.
+func (s *Server) SetPlatformDomains(domains []string) {
+	s.platformDomains = nil
+	for _, d := range domains {
+		if d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			s.platformDomains = append(s.platformDomains, d)
+		}
+	}
+}
+
+func (s *Server) platformHostname(hostname string) bool {
+	for _, d := range s.platformDomains {
+		if hostname == d || strings.HasSuffix(hostname, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// withVerification marks a new route pending, with a fresh token, when its
+// hostname needs verifying.
+func (s *Server) withVerification(route Route) (Route, error) {
+	route.Verification, route.VerifyToken = "", ""
+	if len(s.platformDomains) == 0 || s.platformHostname(route.Hostname) {
+		return route, nil
+	}
+	token, err := randomToken(24)
+	if err != nil {
+		return route, err
+	}
+	route.Verification, route.VerifyToken = VerificationPending, token
+	return route, nil
+}
+
+// createRoute stores a new route, pending verification if it needs one.
+func (s *Server) createRoute(ctx context.Context, route Route) (Route, error) {
+	route, err := s.withVerification(route)
+	if err != nil {
+		return Route{}, err
+	}
+	if _, taken, err := s.routeByAlias(ctx, route.Hostname); err != nil || taken {
+		if err == nil {
+			err = errHostnameIsAlias
+		}
+		return Route{}, err
+	}
+	return s.store.CreateRoute(ctx, route)
+}
+
+func routePending(r Route) bool {
+	return r.Verification == VerificationPending
+}
+
+// verificationInstructions tells the owner of a pending route how to prove
+// the domain.
+func verificationInstructions(route Route) map[string]any {
+	out := map[string]any{"route_id": route.ID, "hostname": route.Hostname, "verification": route.Verification}
+	if !routePending(route) {
+		return out
+	}
+	out["dns"] = map[string]string{"type": "TXT", "name": challengeDNSPrefix + route.Hostname, "value": route.VerifyToken}
+	out["http"] = map[string]string{"url": "http://" + route.Hostname + ChallengePath + route.VerifyToken, "body": route.VerifyToken}
+	return out
+}
+
+// handleRouteVerification serves /api/routes/{id}/verify: GET shows the
+// challenges of the route, POST checks them and verifies the route when
+// either passes.
+func (s *Server) handleRouteVerification(ctx context.Context, w http.ResponseWriter, r *http.Request, route Route) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, verificationInstructions(route))
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !routePending(route) {
+		writeJSON(w, http.StatusOK, map[string]any{"route": route})
+		return
+	}
+	if err := s.verifier.check(ctx, route); err != nil {
+		s.events.Add("warn", "route.verify.failed", route.TunnelID, route.Hostname+": "+err.Error())
+		resp := verificationInstructions(route)
+		resp["error"] = err.Error()
+		writeJSON(w, http.StatusUnprocessableEntity, resp)
+		return
+	}
+	verified, err := s.store.SetRouteVerification(ctx, route.ID, VerificationVerified, "")
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.events.Add("info", "route.verified", route.TunnelID, route.Hostname)
+	writeJSON(w, http.StatusOK, map[string]any{"route": verified})
+}
+
+// check passes when the DNS TXT record or the HTTP challenge carries the
+// route's token.
+func (v *domainVerifier) check(ctx context.Context, route Route) error {
+	records, dnsErr := v.lookupTXT(ctx, challengeDNSPrefix+route.Hostname)
+	for _, record := range records {
+		if strings.TrimSpace(record) == route.VerifyToken {
+			return nil
+		}
+	}
+	if dnsErr == nil {
+		dnsErr = errors.New("no TXT record with the token")
+	}
+	httpErr := v.fetchChallenge(ctx, route)
+	if httpErr == nil {
+		return nil
+	}
+	return fmt.Errorf("dns: %v; http: %v", dnsErr, httpErr)
+}
+
+func (v *domainVerifier) fetchChallenge(ctx context.Context, route Route) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+route.Hostname+ChallengePath+route.VerifyToken, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != route.VerifyToken {
+		return fmt.Errorf("status %d without the token", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleChallenge answers the HTTP challenge for pending routes, whose
+// requests the tunnel server forwards here with the original Host.
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, ChallengePath)
+	host, err := normalizeHostname(r.Host, nil)
+	if err != nil || token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	route, err := s.store.GetRouteByHostname(ctx, host)
+	if err != nil || !routePending(route) || route.VerifyToken != token {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, token)
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type handlerTransport struct{ h http.Handler }
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func TestCustomDomainVerification(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "a", "ta", "alice", "web", "", "", nil)
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetPlatformDomains([]string{" Example.com. "})
+	handler := srv.Handler()
+	var txt []string
+	srv.verifier.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name != "_tunneling-challenge.shop.custom.org" {
+			t.Errorf("looked up %q", name)
+		}
+		if txt == nil {
+			return nil, errors.New("no such host")
+		}
+		return txt, nil
+	}
+	srv.verifier.client = &http.Client{Transport: handlerTransport{http.NotFoundHandler()}}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	upsert := func(hostname string) Route {
+		rec := do("POST", "/api/routes", `{"tunnel_id":"`+tunnel.ID+`","hostname":"`+hostname+`","target":"127.0.0.1:3000"}`)
+		var resp struct{ Route Route }
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+			t.Fatalf("upsert %s = %d %s", hostname, rec.Code, rec.Body)
+		}
+		return resp.Route
+	}
+
+	platform := upsert("app.example.com")
+	custom := upsert("shop.custom.org")
+	if platform.Verification != "" || custom.Verification != VerificationPending || custom.VerifyToken == "" {
+		t.Fatalf("platform = %+v, custom = %+v", platform, custom)
+	}
+	routes, _, err := srv.agentRoutes(ctx, tunnel.ID)
+	if err != nil || len(routes) != 1 || routes[0].Hostname != "app.example.com" {
+		t.Fatalf("agent routes before verification = %+v, %v", routes, err)
+	}
+
+	rec := do("GET", "/api/routes/"+custom.ID+"/verify", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), custom.VerifyToken) {
+		t.Fatalf("verification instructions = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/api/routes/"+custom.ID+"/verify", ""); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("verify without challenge = %d %s", rec.Code, rec.Body)
+	}
+
+	// The HTTP challenge is answered by the control plane itself once the
+	// domain points at the gateway.
+	req := httptest.NewRequest("GET", "http://shop.custom.org"+ChallengePath+"wrong", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("challenge with a wrong token = %d", rec.Code)
+	}
+	srv.verifier.client = &http.Client{Transport: handlerTransport{handler}}
+	rec = do("POST", "/api/routes/"+custom.ID+"/verify", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"verification":"verified"`) {
+		t.Fatalf("verify over http = %d %s", rec.Code, rec.Body)
+	}
+	routes, _, _ = srv.agentRoutes(ctx, tunnel.ID)
+	if len(routes) != 2 {
+		t.Fatalf("agent routes after verification = %+v", routes)
+	}
+	if rec := do("GET", "/api/routes/"+custom.ID+"/verify", ""); strings.Contains(rec.Body.String(), `"dns"`) {
+		t.Fatalf("verified route still shows challenges: %s", rec.Body)
+	}
+}
+
+func TestDomainVerificationByDNS(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer(openTestSQLStore(t), "", "", "", "", "")
+	srv.SetPlatformDomains([]string{"example.com"})
+	tunnel, err := srv.store.CreateTunnelWithMeta(ctx, "a", "ta", "alice", "web", "", "", nil)
+	if err != nil {
+		t.Fatalf("CreateTunnelWithMeta: %v", err)
+	}
+	route, err := srv.createRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "custom.org", Target: "127.0.0.1:1", Enabled: true})
+	if err != nil {
+		t.Fatalf("createRoute: %v", err)
+	}
+	if stored, err := srv.store.GetRouteByID(ctx, route.ID); err != nil || !routePending(stored) || stored.VerifyToken != route.VerifyToken {
+		t.Fatalf("stored route = %+v, %v", stored, err)
+	}
+	srv.verifier.lookupTXT = func(context.Context, string) ([]string, error) {
+		return []string{"unrelated", route.VerifyToken}, nil
+	}
+	if err := srv.verifier.check(ctx, route); err != nil {
+		t.Fatalf("check with the TXT record: %v", err)
+	}
+}
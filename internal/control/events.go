@@ -1,6 +1,8 @@
 package control
 
 import (
+	"context"
+	"log/slog"
 	"sort"
 	"strings"
 	"sync"
@@ -17,22 +19,65 @@ type LogEntry struct {
 	Message  string `json:"message"`
 }
 
+// EventQuery selects events for /api/logs. Zero fields do not filter.
+type EventQuery struct {
+	TunnelID string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q EventQuery) match(e LogEntry) bool {
+	if q.TunnelID != "" && e.TunnelID != q.TunnelID {
+		return false
+	}
+	if q.Since.IsZero() && q.Until.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, e.Time)
+	if err != nil {
+		return false
+	}
+	return !t.Before(q.Since) && (q.Until.IsZero() || !t.After(q.Until))
+}
+
+// EventLog is implemented by stores that can keep events beyond the
+// in-memory ring.
+type EventLog interface {
+	AppendEvents(ctx context.Context, entries []LogEntry) error
+	// QueryEvents returns matching events newest first.
+	QueryEvents(ctx context.Context, q EventQuery) ([]LogEntry, error)
+	PruneEvents(ctx context.Context, before time.Time) error
+}
+
 type EventStore struct {
 	max int
 
-	seq atomic.Int64
-	mu  sync.RWMutex
-	buf []LogEntry
+	seq  atomic.Int64
+	mu   sync.RWMutex
+	buf  []LogEntry
+	subs map[chan LogEntry]struct{}
+
+	// With Persist running, new entries are queued for history and
+	// persisted is the highest ID already written there.
+	history   EventLog
+	queue     chan LogEntry
+	persisted atomic.Int64
+	dropped   atomic.Int64
 }
 
 func NewEventStore(max int) *EventStore {
 	if max <= 0 {
 		max = 500
 	}
-	return &EventStore{
+	s := &EventStore{
 		max: max,
 		buf: make([]LogEntry, 0, max),
 	}
+	// IDs start from the clock so they keep increasing across restarts and
+	// persisted events never collide.
+	s.seq.Store(time.Now().UnixMicro())
+	return s
 }
 
 func (s *EventStore) Add(level, event, tunnelID, message string) {
@@ -41,7 +86,6 @@ func (s *EventStore) Add(level, event, tunnelID, message string) {
 		level = "info"
 	}
 	entry := LogEntry{
-		ID:       s.seq.Add(1),
 		Time:     time.Now().UTC().Format(time.RFC3339),
 		Level:    level,
 		Event:    strings.TrimSpace(event),
@@ -51,6 +95,21 @@ func (s *EventStore) Add(level, event, tunnelID, message string) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	// Numbered under the lock so the queue and the ring are in ID order.
+	entry.ID = s.seq.Add(1)
+	if s.queue != nil {
+		select {
+		case s.queue <- entry:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
 	if len(s.buf) >= s.max {
 		copy(s.buf, s.buf[1:])
 		s.buf[len(s.buf)-1] = entry
@@ -59,14 +118,32 @@ func (s *EventStore) Add(level, event, tunnelID, message string) {
 	s.buf = append(s.buf, entry)
 }
 
-func (s *EventStore) List(tunnelID string, limit int) []LogEntry {
-	if limit <= 0 {
-		limit = 100
+// Subscribe returns a channel that receives every entry added from now on,
+// and a func that ends the subscription. A subscriber that falls buffer
+// entries behind misses entries instead of holding up Add.
+func (s *EventStore) Subscribe(buffer int) (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, buffer)
+	s.mu.Lock()
+	if s.subs == nil {
+		s.subs = make(map[chan LogEntry]struct{})
 	}
-	if limit > 500 {
-		limit = 500
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
 	}
-	filterTunnelID := strings.TrimSpace(tunnelID)
+}
+
+func (s *EventStore) List(tunnelID string, limit int) []LogEntry {
+	return s.list(EventQuery{TunnelID: strings.TrimSpace(tunnelID), Limit: limit}, 0)
+}
+
+// list returns the newest in-memory entries that match q and have an ID
+// above after.
+func (s *EventStore) list(q EventQuery, after int64) []LogEntry {
+	limit := clampEventLimit(q.Limit)
 
 	s.mu.RLock()
 	items := make([]LogEntry, len(s.buf))
@@ -75,7 +152,7 @@ func (s *EventStore) List(tunnelID string, limit int) []LogEntry {
 
 	out := make([]LogEntry, 0, len(items))
 	for _, item := range items {
-		if filterTunnelID != "" && item.TunnelID != filterTunnelID {
+		if item.ID <= after || !q.match(item) {
 			continue
 		}
 		out = append(out, item)
@@ -89,3 +166,104 @@ func (s *EventStore) List(tunnelID string, limit int) []LogEntry {
 	}
 	return out
 }
+
+func clampEventLimit(limit int) int {
+	if limit <= 0 {
+		return 100
+	}
+	return min(limit, 500)
+}
+
+// Query answers q from the persisted history when Persist is running, plus
+// the entries not written there yet, and from memory otherwise.
+func (s *EventStore) Query(ctx context.Context, q EventQuery) ([]LogEntry, error) {
+	s.mu.RLock()
+	history := s.history
+	s.mu.RUnlock()
+	if history == nil {
+		return s.list(q, 0), nil
+	}
+	q.Limit = clampEventLimit(q.Limit)
+	fresh := s.list(q, s.persisted.Load())
+	stored, err := history.QueryEvents(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	// Everything not yet written is newer than everything that was.
+	out := append(fresh, stored...)
+	if len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out, nil
+}
+
+// Persist writes every event added from now on to history in batches, and
+// every hour deletes persisted events older than retention (0 keeps them).
+// It returns when ctx is done.
+func (s *EventStore) Persist(ctx context.Context, history EventLog, retention time.Duration) {
+	queue := make(chan LogEntry, 4096)
+	s.mu.Lock()
+	s.history, s.queue = history, queue
+	s.mu.Unlock()
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	var batch []LogEntry
+	write := func() {
+		if n := s.dropped.Swap(0); n > 0 {
+			slog.Warn("events were not persisted: the store is too slow or unavailable", "events", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		wctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := history.AppendEvents(wctx, batch); err != nil {
+			// Keep the batch for the next tick unless it keeps growing.
+			slog.Warn("persist events failed", "events", len(batch), "err", err)
+			if len(batch) < cap(queue) {
+				return
+			}
+			s.dropped.Add(int64(len(batch)))
+		} else {
+			s.persisted.Store(batch[len(batch)-1].ID)
+		}
+		batch = batch[:0]
+	}
+	pruneOld := func() {
+		if retention <= 0 {
+			return
+		}
+		pctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		if err := history.PruneEvents(pctx, time.Now().Add(-retention)); err != nil {
+			slog.Warn("prune events failed", "err", err)
+		}
+	}
+	pruneOld()
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-queue:
+					batch = append(batch, e)
+				default:
+					write()
+					return
+				}
+			}
+		case e := <-queue:
+			if batch = append(batch, e); len(batch) >= 200 {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-prune.C:
+			pruneOld()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func startPersist(t *testing.T, events *EventStore, history EventLog) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		events.Persist(ctx, history, 0)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		events.mu.RLock()
+		ready := events.queue != nil
+		events.mu.RUnlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Persist did not start")
+		}
+	}
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestEventsPersistAcrossRestart(t *testing.T) {
+	store := openTestSQLStore(t)
+	ctx := context.Background()
+
+	first := NewEventStore(10)
+	stop := startPersist(t, first, store)
+	first.Add("info", "tunnel.created", "t1", "one")
+	first.Add("warn", "agent.heartbeat.auth_failed", "t1", "two")
+	first.Add("info", "tunnel.created", "t2", "three")
+	stop()
+
+	second := NewEventStore(10)
+	defer startPersist(t, second, store)()
+	second.Add("info", "route.upserted", "t1", "four")
+
+	got, err := second.Query(ctx, EventQuery{Limit: 10})
+	if err != nil || len(got) != 4 || got[0].Message != "four" || got[3].Message != "one" {
+		t.Fatalf("Query after restart = %+v, %v", got, err)
+	}
+	if got[0].ID <= got[1].ID {
+		t.Fatalf("ids went backwards across the restart: %d then %d", got[1].ID, got[0].ID)
+	}
+	if got, _ := second.Query(ctx, EventQuery{TunnelID: "t1", Limit: 2}); len(got) != 2 || got[0].Message != "four" || got[1].Message != "two" {
+		t.Fatalf("Query for t1 = %+v", got)
+	}
+	later := time.Now().Add(time.Hour)
+	if got, _ := second.Query(ctx, EventQuery{Since: later}); len(got) != 0 {
+		t.Fatalf("Query since an hour from now = %+v", got)
+	}
+	if got, _ := second.Query(ctx, EventQuery{Until: time.Now().Add(-time.Hour)}); len(got) != 0 {
+		t.Fatalf("Query until an hour ago = %+v", got)
+	}
+
+	if err := store.PruneEvents(ctx, later); err != nil {
+		t.Fatalf("PruneEvents: %v", err)
+	}
+	if got, _ := store.QueryEvents(ctx, EventQuery{}); len(got) != 0 {
+		t.Fatalf("events left after pruning = %+v", got)
+	}
+}
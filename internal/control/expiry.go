@@ -0,0 +1,102 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultExpiryInterval is how often the control server looks for expired
+// tunnels and routes.
+const DefaultExpiryInterval = time.Minute
+
+// formatStoredTime renders t the way expires_at and event times are stored,
+// so the SQL store can compare the text directly.
+func formatStoredTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// expired reports whether expiresAt is set and not after now.
+func expired(expiresAt string, now time.Time) bool {
+	if expiresAt == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	return err == nil && !t.After(now)
+}
+
+// parseExpiry turns an expires_at time or a ttl duration from a request into
+// the stored form; both empty means no expiry.
+func parseExpiry(expiresAt, ttl string, now time.Time) (string, error) {
+	expiresAt, ttl = strings.TrimSpace(expiresAt), strings.TrimSpace(ttl)
+	switch {
+	case expiresAt != "" && ttl != "":
+		return "", errors.New("set expires_at or ttl, not both")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return "", errors.New("ttl must be a positive duration such as 24h")
+		}
+		return formatStoredTime(now.Add(d)), nil
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return "", errors.New("expires_at must be an RFC 3339 time such as 2030-01-02T15:04:05Z")
+		}
+		if !t.After(now) {
+			return "", errors.New("expires_at is in the past")
+		}
+		return formatStoredTime(t), nil
+	}
+	return "", nil
+}
+
+// RunExpiry deletes expired routes and tunnels every interval until ctx is
+// done. Agents are told about the removed routes like any other route write.
+func (s *Server) RunExpiry(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.reapExpired(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) reapExpired(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	routes, err := s.store.SearchRoutes(ctx, ListOptions{ExpiredBy: now})
+	if err != nil {
+		s.events.Add("error", "expiry.scan.failed", "", err.Error())
+		return
+	}
+	for _, r := range routes {
+		if err := s.store.DeleteRouteByID(ctx, r.ID); err != nil {
+			s.events.Add("error", "route.expire.failed", r.TunnelID, err.Error())
+			continue
+		}
+		s.events.Add("info", "route.expired", r.TunnelID, r.Hostname)
+	}
+
+	tunnels, err := s.store.SearchTunnels(ctx, ListOptions{ExpiredBy: now})
+	if err != nil {
+		s.events.Add("error", "expiry.scan.failed", "", err.Error())
+		return
+	}
+	for _, t := range tunnels {
+		if err := s.store.DeleteTunnelByID(ctx, t.ID); err != nil {
+			s.events.Add("error", "tunnel.expire.failed", t.ID, err.Error())
+			continue
+		}
+		s.events.Add("info", "tunnel.expired", t.ID, t.Name)
+	}
+}
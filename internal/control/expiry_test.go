@@ -0,0 +1,73 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpiredRoutesAndTunnelsAreReaped(t *testing.T) {
+	ctx := context.Background()
+	mem, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	srv := NewServer(mem, "", "", "", "", "")
+	now := time.Now()
+	past, future := formatStoredTime(now.Add(-time.Minute)), formatStoredTime(now.Add(time.Hour))
+
+	keep, _ := mem.CreateTunnelWithMeta(ctx, "keep", "tk", "u1", "keep", "", "", nil)
+	gone, _ := mem.CreateTunnelWithMeta(ctx, "gone", "tg", "u1", "gone", "", "", nil)
+	if err := mem.SetTunnelExpiry(ctx, gone.ID, past); err != nil {
+		t.Fatalf("SetTunnelExpiry: %v", err)
+	}
+	for _, r := range []Route{
+		{TunnelID: keep.ID, Hostname: "live.example.com", Target: "127.0.0.1:1", Enabled: true, ExpiresAt: future},
+		{TunnelID: keep.ID, Hostname: "stale.example.com", Target: "127.0.0.1:2", Enabled: true, ExpiresAt: past},
+		{TunnelID: gone.ID, Hostname: "gone.example.com", Target: "127.0.0.1:3", Enabled: true},
+	} {
+		if _, err := mem.CreateRoute(ctx, r); err != nil {
+			t.Fatalf("CreateRoute: %v", err)
+		}
+	}
+
+	mapped, _, err := srv.agentRoutes(ctx, keep.ID)
+	if err != nil || len(mapped) != 1 || mapped[0].Hostname != "live.example.com" {
+		t.Fatalf("agent routes before reaping = %+v, %v", mapped, err)
+	}
+
+	srv.reapExpired(ctx, now)
+	if _, err := mem.GetRouteByHostname(ctx, "stale.example.com"); err == nil {
+		t.Fatalf("expired route was not deleted")
+	}
+	if _, err := mem.GetRouteByHostname(ctx, "live.example.com"); err != nil {
+		t.Fatalf("live route was deleted: %v", err)
+	}
+	if _, err := mem.GetTunnelByID(ctx, gone.ID); err == nil {
+		t.Fatalf("expired tunnel was not deleted")
+	}
+	if _, err := mem.GetRouteByHostname(ctx, "gone.example.com"); err == nil {
+		t.Fatalf("route of the expired tunnel was not deleted")
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		expiresAt, ttl, want string
+		wantErr              bool
+	}{
+		{"", "", "", false},
+		{"", "2h", "2030-01-02T05:04:05Z", false},
+		{"2030-01-03T00:00:00+08:00", "", "2030-01-02T16:00:00Z", false},
+		{"2030-01-01T00:00:00Z", "", "", true},
+		{"tomorrow", "", "", true},
+		{"", "-1h", "", true},
+		{"2030-01-03T00:00:00Z", "1h", "", true},
+	} {
+		got, err := parseExpiry(tc.expiresAt, tc.ttl, now)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Fatalf("parseExpiry(%q, %q) = %q, %v", tc.expiresAt, tc.ttl, got, err)
+		}
+	}
+}
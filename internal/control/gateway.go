@@ -0,0 +1,134 @@
+package control
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// gatewayRoute reports whether the tunnel server answers r itself instead
+// of proxying to an agent.
+func (r Route) gatewayRoute() bool {
+	return r.Redirect != nil || r.Static != nil
+}
+
+// parseRedirect decodes a route's redirect field; JSON null clears it.
+func parseRedirect(raw json.RawMessage) (*protocol.Redirect, error) {
+	var redirect *protocol.Redirect
+	if err := json.Unmarshal(raw, &redirect); err != nil {
+		return nil, errors.New("redirect must be an object like {\"url\": \"https://example.com\", \"status\": 301, \"keep_path\": true}")
+	}
+	return protocol.NormalizeRedirect(redirect)
+}
+
+// parseStaticResponse decodes a route's static_response field; JSON null
+// clears it.
+func parseStaticResponse(raw json.RawMessage) (*protocol.StaticResponse, error) {
+	var static *protocol.StaticResponse
+	if err := json.Unmarshal(raw, &static); err != nil {
+		return nil, errors.New("static_response must be an object like {\"status\": 200, \"content_type\": \"text/plain\", \"body\": \"ok\"}")
+	}
+	return protocol.NormalizeStaticResponse(static)
+}
+
+// handleGatewayRoutes serves GET /api/gateway/routes: the redirect,
+// static-response and maintenance routes tunnel servers answer without an
+// agent, disabled routes that still pass ACME challenges, and the routes of
+// idle tunnels. Only tunnel servers, with an admin key, read it.
+func (s *Server) handleGatewayRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !caller(r).Admin {
+		errorJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	routes, err := s.store.SearchRoutes(ctx, ListOptions{GatewayOnly: true})
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	out := make([]protocol.GatewayRoute, 0, len(routes))
+	now := time.Now()
+	for _, route := range routes {
+		if expired(route.ExpiresAt, now) || routePending(route) {
+			continue
+		}
+		var entry protocol.GatewayRoute
+		switch {
+		case !route.Enabled:
+			// Agents drop disabled routes, so the server forwards their
+			// ACME challenges by itself.
+			if !route.ACMEPassthrough || route.gatewayRoute() {
+				continue
+			}
+			entry = protocol.GatewayRoute{Disabled: true, TunnelID: route.TunnelID, Target: route.Target}
+		case route.Maintenance != nil:
+			// Maintenance wins over what the route normally answers.
+			entry = protocol.GatewayRoute{Maintenance: route.Maintenance, ACMEPassthrough: route.ACMEPassthrough}
+		case route.gatewayRoute():
+			entry = protocol.GatewayRoute{Redirect: route.Redirect, Static: route.Static}
+		default:
+			// An agent serves it, ACME challenges included.
+			continue
+		}
+		for _, host := range append([]string{route.Hostname}, route.Aliases...) {
+			entry.Hostname = host
+			out = append(out, entry)
+		}
+	}
+	idle, err := s.idleGatewayRoutes(ctx, now)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	out = append(out, idle...)
+	writeJSON(w, http.StatusOK, map[string]any{"routes": out, "version": gatewayRoutesVersion(out)})
+}
+
+// idleGatewayRoutes lists the hostnames of idle tunnels' agent routes.
+func (s *Server) idleGatewayRoutes(ctx context.Context, now time.Time) ([]protocol.GatewayRoute, error) {
+	if s.idle.after <= 0 {
+		return nil, nil
+	}
+	tunnels, err := s.store.ListTunnels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []protocol.GatewayRoute
+	for _, t := range tunnels {
+		if t.IdleSince == "" {
+			continue
+		}
+		routes, err := s.store.SearchRoutes(ctx, ListOptions{TunnelID: t.ID})
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			if !route.Enabled || route.gatewayRoute() || route.Maintenance != nil || expired(route.ExpiresAt, now) || routePending(route) {
+				continue
+			}
+			for _, host := range append([]string{route.Hostname}, route.Aliases...) {
+				out = append(out, protocol.GatewayRoute{Hostname: host, Idle: true})
+			}
+		}
+	}
+	return out, nil
+}
+
+// gatewayRoutesVersion hashes routes, in the order SearchRoutes returns
+// them, so servers can skip unchanged sets.
+func gatewayRoutesVersion(routes []protocol.GatewayRoute) string {
+	raw, _ := json.Marshal(routes)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,285 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestGatewayRoutesAPI(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	bob, _ := store.CreateTunnelWithMeta(ctx, "b", "tb", "bob", "web", "", "", nil)
+	route, err := store.CreateRoute(ctx, Route{TunnelID: bob.ID, Hostname: "old.example.com", Target: "127.0.0.1:1", Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: bob.ID, Hostname: "app.example.com", Target: "127.0.0.1:2", Enabled: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetAPIAuth([]string{"k1"}, "jwt-secret")
+	handler := srv.Handler()
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	asBob := signJWT("jwt-secret", `{"sub":"bob","exp":`+exp+`}`)
+
+	do := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"redirect":{"url":"ftp://example.org"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid redirect status = %d", rec.Code)
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"redirect":{"url":"https://example.org"},"static_response":{"body":"x"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("redirect and static status = %d", rec.Code)
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"static_response":{"body":"gone"}}`); rec.Code != http.StatusOK {
+		t.Fatalf("set static status = %d: %s", rec.Code, rec.Body)
+	}
+	rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"redirect":{"url":"https://example.org","status":301}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set redirect status = %d: %s", rec.Code, rec.Body)
+	}
+	var patched struct {
+		Route Route `json:"route"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &patched); err != nil || patched.Route.Redirect == nil || patched.Route.Static != nil {
+		t.Fatalf("patched route = %s, %v", rec.Body, err)
+	}
+
+	// Gateway routes are served by the tunnel server, not agents.
+	mapped, _, err := srv.agentRoutes(ctx, bob.ID)
+	if err != nil || len(mapped) != 1 || mapped[0].Hostname != "app.example.com" {
+		t.Fatalf("agent routes = %+v, %v", mapped, err)
+	}
+
+	if rec := do("GET", "/api/gateway/routes", asBob, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("user read gateway routes status = %d", rec.Code)
+	}
+	rec = do("GET", "/api/gateway/routes", "k1", "")
+	var got struct {
+		Routes []struct {
+			Hostname string `json:"hostname"`
+			Redirect *struct {
+				URL    string `json:"url"`
+				Status int    `json:"status"`
+			} `json:"redirect"`
+		} `json:"routes"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("gateway routes = %d %s, %v", rec.Code, rec.Body, err)
+	}
+	if len(got.Routes) != 1 || got.Routes[0].Hostname != "old.example.com" || got.Routes[0].Redirect == nil || got.Routes[0].Redirect.Status != 301 || got.Version == "" {
+		t.Fatalf("gateway routes = %s", rec.Body)
+	}
+
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"redirect":null}`); rec.Code != http.StatusOK {
+		t.Fatalf("clear redirect status = %d", rec.Code)
+	}
+	if mapped, _, _ := srv.agentRoutes(ctx, bob.ID); len(mapped) != 2 {
+		t.Fatalf("agent routes after clearing = %+v", mapped)
+	}
+}
+
+func TestRouteMaintenanceAPI(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "t", "tok", "bob", "web", "", "", nil)
+	route, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:1", Enabled: true, Aliases: []string{"example.com"}, ACMEPassthrough: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	handler := srv.Handler()
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/routes/"+route.ID+"/maintenance", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	gateway := func() []protocol.GatewayRoute {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/gateway/routes", nil))
+		var got struct {
+			Routes []protocol.GatewayRoute `json:"routes"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("gateway routes = %s, %v", rec.Body, err)
+		}
+		return got.Routes
+	}
+
+	if rec := do(http.MethodPost, `{"retry_after":-5}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid maintenance status = %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, `{"body":"back soon","retry_after":300}`); rec.Code != http.StatusOK {
+		t.Fatalf("start maintenance status = %d: %s", rec.Code, rec.Body)
+	}
+	got := gateway()
+	if len(got) != 2 || got[0].Maintenance == nil || got[0].Maintenance.Body != "back soon" || !got[0].ACMEPassthrough || got[1].Hostname != "example.com" {
+		t.Fatalf("gateway routes under maintenance = %+v", got)
+	}
+	// The agent keeps the route.
+	if mapped, _, _ := srv.agentRoutes(ctx, tunnel.ID); len(mapped) != 1 {
+		t.Fatalf("agent routes under maintenance = %+v", mapped)
+	}
+	if rec := do(http.MethodDelete, ""); rec.Code != http.StatusOK {
+		t.Fatalf("end maintenance status = %d", rec.Code)
+	}
+	if got := gateway(); len(got) != 0 {
+		t.Fatalf("gateway routes after maintenance = %+v", got)
+	}
+}
+
+func TestDisabledRouteKeepsACMEPassthrough(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "t", "tok", "bob", "web", "", "", nil)
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "tls.example.com", Target: "127.0.0.1:1", ACMEPassthrough: true, Aliases: []string{"www.tls.example.com"}}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "off.example.com", Target: "127.0.0.1:2"}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "on.example.com", Target: "127.0.0.1:3", Enabled: true, ACMEPassthrough: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/gateway/routes", nil))
+	var got struct {
+		Routes []protocol.GatewayRoute `json:"routes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("gateway routes = %s, %v", rec.Body, err)
+	}
+	want := []protocol.GatewayRoute{
+		{Hostname: "tls.example.com", Disabled: true, TunnelID: tunnel.ID, Target: "127.0.0.1:1"},
+		{Hostname: "www.tls.example.com", Disabled: true, TunnelID: tunnel.ID, Target: "127.0.0.1:1"},
+	}
+	if !reflect.DeepEqual(got.Routes, want) {
+		t.Fatalf("gateway routes = %+v, want %+v", got.Routes, want)
+	}
+	if mapped, _, _ := srv.agentRoutes(ctx, tunnel.ID); len(mapped) != 1 || mapped[0].Hostname != "on.example.com" {
+		t.Fatalf("agent routes = %+v", mapped)
+	}
+}
+
+func TestIdleTunnelsWake(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "t", "tok", "bob", "web", "", "", nil)
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:1", Enabled: true, Aliases: []string{"example.com"}}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetIdleAfter(2 * time.Hour)
+	handler := srv.Handler()
+	wake := func(host string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/gateway/wake", strings.NewReader(`{"hostname":"`+host+`"}`)))
+		return rec.Code
+	}
+	wakeEvents := func() int {
+		n := 0
+		for _, e := range srv.events.List(tunnel.ID, 100) {
+			if e.Event == "tunnel.wake.requested" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if code := wake("app.example.com"); code != http.StatusOK || wakeEvents() != 0 {
+		t.Fatalf("wake of a busy tunnel = %d, %d events", code, wakeEvents())
+	}
+	now := time.Now().Add(3 * time.Hour)
+	srv.markIdle(ctx, now)
+	if got, _ := store.GetTunnelByID(ctx, tunnel.ID); got.IdleSince == "" {
+		t.Fatal("tunnel without traffic was not marked idle")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/gateway/routes", nil))
+	var routes struct {
+		Routes []protocol.GatewayRoute `json:"routes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil || len(routes.Routes) != 2 || !routes.Routes[0].Idle || routes.Routes[1].Hostname != "example.com" {
+		t.Fatalf("gateway routes of idle tunnel = %s, %v", rec.Body, err)
+	}
+
+	for _, host := range []string{"example.com", "app.example.com"} {
+		if code := wake(host); code != http.StatusAccepted {
+			t.Fatalf("wake %s = %d", host, code)
+		}
+	}
+	if n := wakeEvents(); n != 1 {
+		t.Fatalf("wake events = %d, want 1", n)
+	}
+	if code := wake("other.example.com"); code != http.StatusNotFound {
+		t.Fatalf("wake of unknown hostname = %d", code)
+	}
+
+	hour := formatStoredTime(now.UTC().Truncate(time.Hour))
+	if err := store.AddUsage(ctx, []Usage{{TunnelID: tunnel.ID, Hostname: "app.example.com", HourStart: hour, Requests: 1}}); err != nil {
+		t.Fatalf("AddUsage: %v", err)
+	}
+	srv.markIdle(ctx, now)
+	if got, _ := store.GetTunnelByID(ctx, tunnel.ID); got.IdleSince != "" {
+		t.Fatalf("tunnel with traffic still idle since %s", got.IdleSince)
+	}
+}
+
+func TestGatewayAgentReport(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "t", "tok", "bob", "web", "", "", nil)
+	srv := NewServer(store, "", "", "", "", "")
+	handler := srv.Handler()
+	report := func(body string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/gateway/agents", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := report(`{"tunnel_id":"` + tunnel.ID + `"}`); code != http.StatusBadRequest {
+		t.Fatalf("report without agent = %d", code)
+	}
+	if code := report(`{"tunnel_id":"missing","agent":{"version":"v1"}}`); code != http.StatusNotFound {
+		t.Fatalf("report for missing tunnel = %d", code)
+	}
+	if code := report(`{"tunnel_id":"` + tunnel.ID + `","agent":{"version":"v0.4.2","os":"darwin","arch":"arm64","hostname":"mac-mini","labels":{"env":"staging"}}}`); code != http.StatusOK {
+		t.Fatalf("report = %d", code)
+	}
+	got, err := store.GetTunnelByID(ctx, tunnel.ID)
+	if err != nil || got.Agent == nil || got.Agent.Version != "v0.4.2" || got.Agent.Hostname != "mac-mini" || got.Agent.Labels["env"] != "staging" {
+		t.Fatalf("tunnel after report = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,157 @@
+package control
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AgentHeartbeatInterval is how often agents report in; a tunnel counts as
+	// online for three intervals after its last report.
+	AgentHeartbeatInterval = 30 * time.Second
+	agentOnlineTTL         = 3 * AgentHeartbeatInterval
+)
+
+type agentHeartbeatRequest struct {
+	TunnelID  string `json:"tunnel_id"`
+	Token     string `json:"token"`
+	Connected bool   `json:"connected"`
+	SessionID string `json:"session_id,omitempty"`
+	// Server is the tunnel server the agent is connected to.
+	Server string `json:"server,omitempty"`
+}
+
+// agentPresence remembers which tunnels report heartbeats and whether their
+// agent was last connected to the tunnel server. Agents that predate the
+// heartbeat are still marked online by their route syncs.
+type agentPresence struct {
+	mu        sync.Mutex
+	connected map[string]bool
+	servers   map[string]serverSeen
+}
+
+// serverSeen is the tunnel server a connected agent last reported.
+type serverSeen struct {
+	url string
+	at  time.Time
+}
+
+func newAgentPresence() *agentPresence {
+	return &agentPresence{connected: make(map[string]bool), servers: make(map[string]serverSeen)}
+}
+
+// report records a heartbeat and returns whether the connection state changed.
+// An agent that starts out disconnected is not a change worth reporting.
+func (p *agentPresence) report(tunnelID string, connected bool, server string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.connected[tunnelID]
+	p.connected[tunnelID] = connected
+	if connected && server != "" {
+		p.servers[tunnelID] = serverSeen{url: server, at: time.Now()}
+	} else {
+		delete(p.servers, tunnelID)
+	}
+	return previous != connected
+}
+
+// gatewayLoad counts the online agents on each tunnel server, leaving out
+// the tunnel asking.
+func (p *agentPresence) gatewayLoad(except string, now time.Time) map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	load := make(map[string]int)
+	for tunnelID, seen := range p.servers {
+		if now.Sub(seen.at) > agentOnlineTTL {
+			delete(p.servers, tunnelID)
+			continue
+		}
+		if tunnelID != except {
+			load[seen.url]++
+		}
+	}
+	return load
+}
+
+func (p *agentPresence) reportsHeartbeat(tunnelID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.connected[tunnelID]
+	return ok
+}
+
+func (s *Server) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req agentHeartbeatRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	tunnelID := strings.TrimSpace(req.TunnelID)
+	token := strings.TrimSpace(req.Token)
+	if tunnelID == "" || token == "" {
+		errorJSON(w, http.StatusBadRequest, "tunnel_id and token are required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if _, err := s.store.ValidateTunnelToken(ctx, tunnelID, token); err != nil {
+		errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
+		s.events.Add("warn", "agent.heartbeat.auth_failed", tunnelID, "invalid tunnel credentials")
+		return
+	}
+
+	update := s.store.UpdateTunnelOffline
+	if req.Connected {
+		update = s.store.UpdateTunnelOnline
+	}
+	if err := update(ctx, tunnelID); err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if s.presence.report(tunnelID, req.Connected, strings.TrimSpace(req.Server)) {
+		if req.Connected {
+			s.events.Add("info", "agent.connected", tunnelID, "agent connected session="+strings.TrimSpace(req.SessionID))
+		} else {
+			s.events.Add("warn", "agent.disconnected", tunnelID, "agent reports no tunnel server connection")
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ok":                 true,
+		"interval_seconds":   int(AgentHeartbeatInterval / time.Second),
+		"online_ttl_seconds": int(agentOnlineTTL / time.Second),
+	})
+}
+
+// markTunnelOnline is the route-sync fallback for agents without heartbeats.
+func (s *Server) markTunnelOnline(tunnelID string) {
+	if s.presence.reportsHeartbeat(tunnelID) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.store.UpdateTunnelOnline(ctx, tunnelID); err != nil {
+		slog.Warn("update tunnel status failed", "tunnel_id", tunnelID, "err", err)
+	}
+}
+
+// tunnelOnline derives live status: the stored status alone would stay
+// "online" forever after an agent dies without saying goodbye.
+func tunnelOnline(t Tunnel, now time.Time) bool {
+	if t.Status != "online" || t.LastSeenAt == "" {
+		return false
+	}
+	seen, err := time.Parse(time.RFC3339, t.LastSeenAt)
+	if err != nil {
+		return false
+	}
+	return now.Sub(seen) <= agentOnlineTTL
+}
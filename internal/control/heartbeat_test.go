@@ -0,0 +1,63 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentHeartbeatDrivesOnlineStatus(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, err := store.CreateTunnel(ctx, "dev", "secret")
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	handler := NewServer(store, "", "", "", "", "").Handler()
+
+	heartbeat := func(connected bool) int {
+		body, _ := json.Marshal(agentHeartbeatRequest{TunnelID: tunnel.ID, Token: "secret", Connected: connected})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/agent/heartbeat", strings.NewReader(string(body))))
+		return rec.Code
+	}
+	listed := func() Tunnel {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/tunnels", nil))
+		var payload struct {
+			Tunnels []Tunnel `json:"tunnels"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Tunnels) != 1 {
+			t.Fatalf("list tunnels = %s, %v", rec.Body.String(), err)
+		}
+		return payload.Tunnels[0]
+	}
+
+	if got := listed(); got.Online {
+		t.Fatalf("tunnel online before any heartbeat: %+v", got)
+	}
+	if code := heartbeat(true); code != http.StatusOK {
+		t.Fatalf("heartbeat status = %d", code)
+	}
+	if got := listed(); !got.Online || got.LastSeenAt == "" {
+		t.Fatalf("after connected heartbeat = %+v", got)
+	}
+	if code := heartbeat(false); code != http.StatusOK {
+		t.Fatalf("heartbeat status = %d", code)
+	}
+	if got := listed(); got.Online {
+		t.Fatalf("after disconnected heartbeat = %+v", got)
+	}
+
+	stale := Tunnel{Status: "online", LastSeenAt: time.Now().Add(-2 * agentOnlineTTL).UTC().Format(time.RFC3339)}
+	if tunnelOnline(stale, time.Now()) {
+		t.Fatalf("stale heartbeat still counted as online")
+	}
+}
@@ -0,0 +1,188 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdleInterval is how often the control server looks for tunnels
+// that went idle or came back.
+const DefaultIdleInterval = 10 * time.Minute
+
+// wakeNotifyEvery limits how often one idle tunnel raises
+// tunnel.wake.requested while visitors keep knocking.
+const wakeNotifyEvery = 10 * time.Minute
+
+// idleTracker holds the idle suspension settings and when each tunnel last
+// asked its owner to wake it.
+type idleTracker struct {
+	after    time.Duration
+	mu       sync.Mutex
+	notified map[string]time.Time
+}
+
+// SetIdleAfter marks tunnels idle once they served no traffic for d, as
+// reported by the tunnel servers' usage reports; 0 turns it off. Tunnel
+// servers show a "waking up" page for an idle tunnel whose agent is
+// offline and ask the control plane, which raises tunnel.wake.requested,
+// to get the owner to start it.
+func (s *Server) SetIdleAfter(d time.Duration) {
+	s.idle.after = d
+}
+
+// RunIdle updates which tunnels are idle every interval until ctx is done.
+// It does nothing unless SetIdleAfter is set.
+func (s *Server) RunIdle(ctx context.Context, interval time.Duration) {
+	if s.idle.after <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultIdleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.markIdle(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) markIdle(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tunnels, err := s.store.ListTunnels(ctx)
+	if err != nil {
+		s.events.Add("error", "idle.scan.failed", "", err.Error())
+		return
+	}
+	for _, t := range tunnels {
+		if t.IdleSince != "" {
+			since, err := time.Parse(time.RFC3339, t.IdleSince)
+			if err != nil {
+				continue
+			}
+			// Usage is counted per hour, so look from the start of the hour.
+			if active, err := s.servedSince(ctx, t.ID, since.Truncate(time.Hour)); err != nil || !active {
+				continue
+			}
+			if err := s.store.SetTunnelIdle(ctx, t.ID, ""); err != nil {
+				s.events.Add("error", "tunnel.idle.failed", t.ID, err.Error())
+				continue
+			}
+			s.idle.forget(t.ID)
+			s.events.Add("info", "tunnel.active", t.ID, t.Name)
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, t.CreatedAt)
+		if err != nil || now.Sub(created) < s.idle.after {
+			continue
+		}
+		if active, err := s.servedSince(ctx, t.ID, now.Add(-s.idle.after)); err != nil || active {
+			continue
+		}
+		if err := s.store.SetTunnelIdle(ctx, t.ID, formatStoredTime(now)); err != nil {
+			s.events.Add("error", "tunnel.idle.failed", t.ID, err.Error())
+			continue
+		}
+		s.events.Add("info", "tunnel.idle", t.ID, t.Name)
+	}
+}
+
+// servedSince reports whether tunnelID served any request from since on.
+func (s *Server) servedSince(ctx context.Context, tunnelID string, since time.Time) (bool, error) {
+	rows, err := s.store.QueryUsage(ctx, UsageQuery{TunnelID: tunnelID, Since: since})
+	if err != nil {
+		return false, err
+	}
+	for _, row := range rows {
+		if row.Requests > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// allow reports whether tunnelID may raise another wake request at now.
+func (t *idleTracker) allow(tunnelID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.notified[tunnelID]; ok && now.Sub(last) < wakeNotifyEvery {
+		return false
+	}
+	if t.notified == nil {
+		t.notified = make(map[string]time.Time)
+	}
+	t.notified[tunnelID] = now
+	return true
+}
+
+func (t *idleTracker) forget(tunnelID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.notified, tunnelID)
+}
+
+// handleGatewayWake serves POST /api/gateway/wake {"hostname": "..."}:
+// a tunnel server saw a request for an idle tunnel whose agent is offline.
+// The control plane raises tunnel.wake.requested, at most every
+// wakeNotifyEvery per tunnel, for webhooks to tell the owner.
+func (s *Server) handleGatewayWake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !caller(r).Admin {
+		errorJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || strings.TrimSpace(req.Hostname) == "" {
+		errorJSON(w, http.StatusBadRequest, "body must be {\"hostname\": \"...\"}")
+		return
+	}
+	host := strings.ToLower(strings.TrimSpace(req.Hostname))
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	route, err := s.store.GetRouteByHostname(ctx, host)
+	if errors.Is(err, ErrNotFound) {
+		var ok bool
+		route, ok, err = s.routeByAlias(ctx, host)
+		if err == nil && !ok {
+			err = ErrNotFound
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		errorJSON(w, http.StatusNotFound, "route not found")
+		return
+	}
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	tunnel, err := s.store.GetTunnelByID(ctx, route.TunnelID)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if tunnel.IdleSince == "" {
+		writeJSON(w, http.StatusOK, map[string]any{"idle": false})
+		return
+	}
+	if s.idle.allow(tunnel.ID, time.Now()) {
+		s.events.Add("warn", "tunnel.wake.requested", tunnel.ID, "name="+tunnel.Name+" hostname="+host+" owner="+tunnel.OwnerID)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"idle": true})
+}
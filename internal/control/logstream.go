@@ -0,0 +1,89 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleLogsStream pushes events as they are recorded over Server-Sent
+// Events, one "log" event per LogEntry with the entry ID as the SSE id.
+// tunnel_id and level (comma separated) filter the stream; a reconnecting
+// client that sends Last-Event-ID first gets the entries it missed that are
+// still in memory.
+func (s *Server) handleLogsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorJSON(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	tunnelID := strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
+	if !s.checkTunnelScope(w, r, tunnelID) {
+		return
+	}
+	var levels []string
+	for _, level := range strings.Split(r.URL.Query().Get("level"), ",") {
+		if level = strings.TrimSpace(strings.ToLower(level)); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	wanted := func(e LogEntry) bool {
+		return (tunnelID == "" || e.TunnelID == tunnelID) && (len(levels) == 0 || slices.Contains(levels, e.Level))
+	}
+
+	// Subscribe before the replay so nothing falls in between.
+	entries, unsubscribe := s.events.Subscribe(256)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var last int64
+	send := func(e LogEntry) error {
+		if e.ID <= last || !wanted(e) {
+			return nil
+		}
+		last = e.ID
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.ID); err != nil {
+			return err
+		}
+		return writeSSE(w, "log", e)
+	}
+	if after, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		missed := s.events.list(EventQuery{TunnelID: tunnelID, Limit: 500}, after)
+		for i := len(missed) - 1; i >= 0; i-- {
+			if err := send(missed[i]); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(routeStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-entries:
+			if err := send(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogsStreamFiltersAndResumes(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	open := func(query, lastID string) (*http.Response, <-chan LogEntry) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+"/api/logs/stream?"+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		entries := make(chan LogEntry, 16)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+					var e LogEntry
+					if json.Unmarshal([]byte(data), &e) == nil {
+						entries <- e
+					}
+				}
+			}
+		}()
+		return resp, entries
+	}
+	next := func(entries <-chan LogEntry) LogEntry {
+		t.Helper()
+		select {
+		case e := <-entries:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for log entry")
+			return LogEntry{}
+		}
+	}
+
+	resp, entries := open("tunnel_id=t1&level=warn,error", "")
+	defer resp.Body.Close()
+	// The handler subscribes before writing headers, so entries added now
+	// reach the stream.
+	srv.events.Add("warn", "a", "t2", "other tunnel")
+	srv.events.Add("info", "b", "t1", "filtered level")
+	srv.events.Add("error", "c", "t1", "wanted")
+	first := next(entries)
+	if first.Event != "c" || first.TunnelID != "t1" {
+		t.Fatalf("first entry = %+v", first)
+	}
+
+	srv.events.Add("warn", "d", "t1", "missed")
+	resumed, replay := open("tunnel_id=t1", strconv.FormatInt(first.ID, 10))
+	defer resumed.Body.Close()
+	if e := next(replay); e.Event != "d" {
+		t.Fatalf("replayed entry = %+v", e)
+	}
+	srv.events.Add("info", "e", "t1", "live")
+	if e := next(replay); e.Event != "e" {
+		t.Fatalf("live entry after replay = %+v", e)
+	}
+}
+
+func TestLogsStreamRequiresTunnelForUsers(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetAPIAuth([]string{"k1"}, "jwt-secret")
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	req := httptest.NewRequest("GET", "/api/logs/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+signJWT("jwt-secret", `{"sub":"alice","exp":`+exp+`}`))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("user streaming all logs = %d, want 403", rec.Code)
+	}
+	req = httptest.NewRequest("GET", "/api/logs/stream", nil)
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous stream = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"context"
+	"net/http"
+
+	"tunneling/internal/protocol"
+)
+
+// handleRouteMaintenance serves /api/routes/{id}/maintenance: POST puts the
+// route under maintenance, optionally with {"body", "content_type",
+// "retry_after"} for the 503 page, DELETE ends it and GET shows it. The
+// agent keeps serving the route meanwhile; tunnel servers stop sending it
+// requests once they next fetch the gateway routes.
+func (s *Server) handleRouteMaintenance(ctx context.Context, w http.ResponseWriter, r *http.Request, route Route) {
+	var maintenance *protocol.Maintenance
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"route_id": route.ID, "hostname": route.Hostname, "maintenance": route.Maintenance})
+		return
+	case http.MethodPost:
+		maintenance = &protocol.Maintenance{}
+		if r.ContentLength != 0 {
+			if err := decodeJSON(r.Body, maintenance); err != nil {
+				errorJSON(w, http.StatusBadRequest, "invalid json")
+				return
+			}
+		}
+		var err error
+		if maintenance, err = protocol.NormalizeMaintenance(maintenance); err != nil {
+			errorJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	updated, err := s.store.SetRouteMaintenance(ctx, route.ID, maintenance)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		s.events.Add("error", "route.update.failed", route.TunnelID, err.Error())
+		return
+	}
+	if maintenance != nil {
+		s.events.Add("warn", "route.maintenance.started", route.TunnelID, route.Hostname)
+	} else {
+		s.events.Add("info", "route.maintenance.ended", route.TunnelID, route.Hostname)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"route": updated})
+}
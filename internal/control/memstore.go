@@ -0,0 +1,631 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"tunneling/internal/protocol"
+)
+
+// MemoryStore keeps tunnels and routes in memory for local development. With
+// a snapshot path every change is written out as JSON and loaded back on the
+// next start.
+type MemoryStore struct {
+	mu       sync.Mutex
+	snapshot string
+	tunnels  map[string]Tunnel
+	routes   map[string]Route
+	usage    map[usageKey]Usage
+}
+
+type usageKey struct {
+	tunnelID, hostname, hourStart string
+}
+
+type memorySnapshot struct {
+	Tunnels []Tunnel `json:"tunnels"`
+	Routes  []Route  `json:"routes"`
+	Usage   []Usage  `json:"usage,omitempty"`
+}
+
+func NewMemoryStore(snapshotPath string) (*MemoryStore, error) {
+	s := &MemoryStore{
+		snapshot: strings.TrimSpace(snapshotPath),
+		tunnels:  make(map[string]Tunnel),
+		routes:   make(map[string]Route),
+		usage:    make(map[usageKey]Usage),
+	}
+	if s.snapshot == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(s.snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("decode snapshot %s: %w", s.snapshot, err)
+	}
+	for _, t := range snap.Tunnels {
+		s.tunnels[t.ID] = t
+	}
+	for _, r := range snap.Routes {
+		s.routes[r.ID] = r
+	}
+	for _, u := range snap.Usage {
+		s.usage[usageKey{u.TunnelID, u.Hostname, u.HourStart}] = u
+	}
+	return s, nil
+}
+
+// save writes the snapshot through a temp file so a crash never leaves a
+// half-written one behind. Callers hold s.mu.
+func (s *MemoryStore) save() error {
+	if s.snapshot == "" {
+		return nil
+	}
+	snap := memorySnapshot{Tunnels: make([]Tunnel, 0, len(s.tunnels)), Routes: make([]Route, 0, len(s.routes))}
+	for _, t := range s.tunnels {
+		snap.Tunnels = append(snap.Tunnels, t)
+	}
+	for _, r := range s.routes {
+		snap.Routes = append(snap.Routes, r)
+	}
+	sort.Slice(snap.Tunnels, func(i, j int) bool { return snap.Tunnels[i].ID < snap.Tunnels[j].ID })
+	sort.Slice(snap.Routes, func(i, j int) bool { return snap.Routes[i].ID < snap.Routes[j].ID })
+	for _, u := range s.usage {
+		snap.Usage = append(snap.Usage, u)
+	}
+	sortUsage(snap.Usage)
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.snapshot); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := s.snapshot + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.snapshot)
+}
+
+func (s *MemoryStore) ListTunnels(ctx context.Context) ([]Tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		t = copyTunnel(t)
+		t.Token = ""
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreatedAt != out[j].CreatedAt {
+			return out[i].CreatedAt > out[j].CreatedAt
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out, nil
+}
+
+func (s *MemoryStore) SearchTunnels(ctx context.Context, opts ListOptions) ([]Tunnel, error) {
+	all, err := s.ListTunnels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := strings.ToLower(opts.Query)
+	matched := map[string]bool{}
+	if query != "" {
+		s.mu.Lock()
+		for _, r := range s.routes {
+			if strings.Contains(r.Hostname, query) {
+				matched[r.TunnelID] = true
+			}
+		}
+		s.mu.Unlock()
+	}
+	out := make([]Tunnel, 0, len(all))
+	for _, t := range all {
+		if opts.OwnerID != "" && t.OwnerID != opts.OwnerID {
+			continue
+		}
+		if query != "" && !matched[t.ID] && !strings.Contains(strings.ToLower(t.Name), query) {
+			continue
+		}
+		if !opts.ExpiredBy.IsZero() && !expired(t.ExpiresAt, opts.ExpiredBy) {
+			continue
+		}
+		out = append(out, t)
+	}
+	return page(out, opts), nil
+}
+
+func (s *MemoryStore) CreateTunnel(ctx context.Context, name, token string) (Tunnel, error) {
+	return s.CreateTunnelWithMeta(ctx, name, token, "", "", "", "", nil)
+}
+
+func (s *MemoryStore) CreateTunnelWithMeta(ctx context.Context, name, token, ownerID, projectKey, clientIP, osType string, metadata map[string]any) (Tunnel, error) {
+	id, err := newRowID()
+	if err != nil {
+		return Tunnel{}, err
+	}
+	now := sqlNow()
+	t := Tunnel{
+		ID:         id,
+		Name:       name,
+		Token:      token,
+		OwnerID:    strings.TrimSpace(ownerID),
+		ProjectKey: strings.TrimSpace(projectKey),
+		ClientIP:   strings.TrimSpace(clientIP),
+		OSType:     strings.TrimSpace(osType),
+		Metadata:   maps.Clone(metadata),
+		Status:     "offline",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels[id] = t
+	return copyTunnel(t), s.save()
+}
+
+func (s *MemoryStore) GetTunnelByID(ctx context.Context, id string) (Tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[id]
+	if !ok {
+		return Tunnel{}, errors.New("tunnel not found")
+	}
+	return copyTunnel(t), nil
+}
+
+func (s *MemoryStore) GetTunnelByOwnerAndProject(ctx context.Context, ownerID, projectKey string) (Tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tunnels {
+		if t.OwnerID == ownerID && t.ProjectKey == projectKey {
+			return copyTunnel(t), nil
+		}
+	}
+	return Tunnel{}, ErrNotFound
+}
+
+func (s *MemoryStore) ValidateTunnelToken(ctx context.Context, tunnelID, token string) (Tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[tunnelID]
+	if !ok || t.Token != token {
+		return Tunnel{}, ErrInvalidTunnelToken
+	}
+	return copyTunnel(t), nil
+}
+
+func (s *MemoryStore) UpdateTunnelOnline(ctx context.Context, tunnelID string) error {
+	return s.updateTunnelStatus(tunnelID, "online")
+}
+
+func (s *MemoryStore) UpdateTunnelOffline(ctx context.Context, tunnelID string) error {
+	return s.updateTunnelStatus(tunnelID, "offline")
+}
+
+func (s *MemoryStore) updateTunnelStatus(tunnelID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[tunnelID]
+	if !ok {
+		return nil
+	}
+	now := sqlNow()
+	t.Status = status
+	t.LastSeenAt = now
+	t.UpdatedAt = now
+	s.tunnels[tunnelID] = t
+	return s.save()
+}
+
+func (s *MemoryStore) DeleteTunnelByID(ctx context.Context, tunnelID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tunnels, tunnelID)
+	for id, r := range s.routes {
+		if r.TunnelID == tunnelID {
+			delete(s.routes, id)
+		}
+	}
+	return s.save()
+}
+
+func (s *MemoryStore) DeleteAllTunnels(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.tunnels)
+	clear(s.routes)
+	return s.save()
+}
+
+func (s *MemoryStore) SetTunnelExpiry(ctx context.Context, tunnelID, expiresAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[tunnelID]
+	if !ok {
+		return ErrNotFound
+	}
+	t.ExpiresAt = expiresAt
+	t.UpdatedAt = sqlNow()
+	s.tunnels[tunnelID] = t
+	return s.save()
+}
+
+func (s *MemoryStore) SetTunnelIdle(ctx context.Context, tunnelID, idleSince string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[tunnelID]
+	if !ok {
+		return ErrNotFound
+	}
+	t.IdleSince = idleSince
+	t.UpdatedAt = sqlNow()
+	s.tunnels[tunnelID] = t
+	return s.save()
+}
+
+func (s *MemoryStore) SetTunnelAgent(ctx context.Context, tunnelID string, agent *protocol.AgentMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[tunnelID]
+	if !ok {
+		return ErrNotFound
+	}
+	t.Agent = clonePtr(agent)
+	t.UpdatedAt = sqlNow()
+	s.tunnels[tunnelID] = t
+	return s.save()
+}
+
+func (s *MemoryStore) CreateRoute(ctx context.Context, route Route) (Route, error) {
+	id, err := newRowID()
+	if err != nil {
+		return Route{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tunnels[route.TunnelID]; !ok {
+		return Route{}, fmt.Errorf("tunnel %s does not exist", route.TunnelID)
+	}
+	if s.hostnameTaken(route.Hostname, "") {
+		return Route{}, fmt.Errorf("hostname %s already exists", route.Hostname)
+	}
+	now := sqlNow()
+	route.ID = id
+	route.CreatedAt = now
+	route.UpdatedAt = now
+	s.routes[id] = route
+	return route, s.save()
+}
+
+func (s *MemoryStore) UpdateRoute(ctx context.Context, routeID string, patch RoutePatch) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	applyRoutePatch(&r, patch)
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+// applyRoutePatch copies the patched settings onto r so callers cannot
+// change them in place afterwards.
+func applyRoutePatch(r *Route, patch RoutePatch) {
+	p := patch.Route
+	if patch.has(RouteTarget) {
+		r.Target = p.Target
+	}
+	if patch.has(RouteEnabled) {
+		r.Enabled = p.Enabled
+	}
+	if patch.has(RouteExpiry) {
+		r.ExpiresAt = p.ExpiresAt
+	}
+	if patch.has(RouteRateLimit) {
+		r.RateLimit = clonePtr(p.RateLimit)
+	}
+	if patch.has(RouteSplit) {
+		r.Split = clonePtr(p.Split)
+	}
+	if patch.has(RouteLimits) {
+		r.Timeout, r.MaxBodyBytes = p.Timeout, p.MaxBodyBytes
+	}
+	if patch.has(RouteIPFilter) {
+		r.IPFilter = nil
+		if p.IPFilter != nil {
+			r.IPFilter = &protocol.IPFilter{Allow: slices.Clone(p.IPFilter.Allow), Deny: slices.Clone(p.IPFilter.Deny)}
+		}
+	}
+	if patch.has(RouteAuth) {
+		r.Auth = nil
+		if auth := p.Auth; auth != nil {
+			r.Auth = &protocol.RouteAuth{Basic: slices.Clone(auth.Basic), TokenSecret: auth.TokenSecret}
+			if auth.Login != nil {
+				r.Auth.Login = &protocol.LoginPolicy{Allow: slices.Clone(auth.Login.Allow)}
+			}
+			r.Auth.JWT = clonePtr(auth.JWT)
+		}
+	}
+	if patch.has(RouteRewrite) {
+		r.Rewrite = clonePtr(p.Rewrite)
+	}
+	if patch.has(RouteHeaderRules) {
+		r.HeaderRules = p.HeaderRules.Clone()
+	}
+	if patch.has(RouteACMEPassthrough) {
+		r.ACMEPassthrough = p.ACMEPassthrough
+	}
+	if patch.has(RouteType) {
+		r.Redirect, r.Static = clonePtr(p.Redirect), clonePtr(p.Static)
+	}
+	if patch.has(RouteAliases) {
+		r.Aliases = nil
+		if len(p.Aliases) > 0 {
+			r.Aliases = slices.Clone(p.Aliases)
+		}
+	}
+	if patch.has(RouteCache) {
+		r.Cache = clonePtr(p.Cache)
+	}
+	if patch.has(RouteMirror) {
+		r.Mirror = clonePtr(p.Mirror)
+	}
+}
+
+func (s *MemoryStore) UpdateRouteBinding(ctx context.Context, routeID string, tunnelID string, target string, enabled bool) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	if tunnelID = strings.TrimSpace(tunnelID); tunnelID != "" {
+		r.TunnelID = tunnelID
+	}
+	r.Target = target
+	r.Enabled = enabled
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+func (s *MemoryStore) UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	if s.hostnameTaken(hostname, routeID) {
+		return Route{}, fmt.Errorf("hostname %s already exists", hostname)
+	}
+	r.Hostname = hostname
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+func (s *MemoryStore) SetRouteMaintenance(ctx context.Context, routeID string, maintenance *protocol.Maintenance) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	r.Maintenance = clonePtr(maintenance)
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+// clonePtr copies a flat route setting so callers cannot change it in
+// place.
+func clonePtr[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+func (s *MemoryStore) SetRouteExpiry(ctx context.Context, routeID, expiresAt string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	r.ExpiresAt = expiresAt
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+func (s *MemoryStore) SetRouteVerification(ctx context.Context, routeID, status, token string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	r.Verification = status
+	r.VerifyToken = token
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+func (s *MemoryStore) SetRouteDNSStatus(ctx context.Context, routeID, status string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	r.DNSStatus = status
+	r.UpdatedAt = sqlNow()
+	s.routes[routeID] = r
+	return r, s.save()
+}
+
+func (s *MemoryStore) GetRouteByID(ctx context.Context, routeID string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[routeID]
+	if !ok {
+		return Route{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (s *MemoryStore) GetRouteByHostname(ctx context.Context, hostname string) (Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.routes {
+		if r.Hostname == hostname {
+			return r, nil
+		}
+	}
+	return Route{}, ErrNotFound
+}
+
+func (s *MemoryStore) ListRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
+	return s.listRoutes(tunnelID, false), nil
+}
+
+func (s *MemoryStore) ListEnabledProtocolRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
+	return s.listRoutes(tunnelID, true), nil
+}
+
+func (s *MemoryStore) SearchRoutes(ctx context.Context, opts ListOptions) ([]Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := strings.ToLower(opts.Query)
+	var out []Route
+	for _, r := range s.routes {
+		if opts.TunnelID != "" && r.TunnelID != opts.TunnelID ||
+			opts.OwnerID != "" && s.tunnels[r.TunnelID].OwnerID != opts.OwnerID ||
+			!strings.Contains(r.Hostname, query) ||
+			!opts.ExpiredBy.IsZero() && !expired(r.ExpiresAt, opts.ExpiredBy) ||
+			opts.GatewayOnly && !r.gatewayRoute() && r.Maintenance == nil && !r.ACMEPassthrough {
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return page(out, opts), nil
+}
+
+// page cuts the window opts asks for out of rows.
+func page[T any](rows []T, opts ListOptions) []T {
+	if opts.Offset >= len(rows) {
+		return rows[:0]
+	}
+	rows = rows[max(opts.Offset, 0):]
+	if opts.Limit > 0 && opts.Limit < len(rows) {
+		rows = rows[:opts.Limit]
+	}
+	return rows
+}
+
+func (s *MemoryStore) DeleteRouteByID(ctx context.Context, routeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.routes, routeID)
+	return s.save()
+}
+
+func (s *MemoryStore) AddUsage(ctx context.Context, rows []Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range rows {
+		key := usageKey{u.TunnelID, u.Hostname, u.HourStart}
+		cur := s.usage[key]
+		u.Requests += cur.Requests
+		u.BytesIn += cur.BytesIn
+		u.BytesOut += cur.BytesOut
+		s.usage[key] = u
+	}
+	return s.save()
+}
+
+func (s *MemoryStore) QueryUsage(ctx context.Context, q UsageQuery) ([]Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Usage
+	for _, u := range s.usage {
+		if q.TunnelID != "" && u.TunnelID != q.TunnelID ||
+			!q.Since.IsZero() && u.HourStart < formatStoredTime(q.Since) ||
+			!q.Until.IsZero() && u.HourStart > formatStoredTime(q.Until) {
+			continue
+		}
+		out = append(out, u)
+	}
+	sortUsage(out)
+	return out, nil
+}
+
+// sortUsage orders rows newest hour first, then by hostname and tunnel.
+func sortUsage(rows []Usage) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.HourStart != b.HourStart {
+			return a.HourStart > b.HourStart
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.TunnelID < b.TunnelID
+	})
+}
+
+func (s *MemoryStore) listRoutes(tunnelID string, enabledOnly bool) []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Route
+	for _, r := range s.routes {
+		if r.TunnelID != tunnelID || (enabledOnly && !r.Enabled) {
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+func (s *MemoryStore) hostnameTaken(hostname, exceptID string) bool {
+	for id, r := range s.routes {
+		if id != exceptID && r.Hostname == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func copyTunnel(t Tunnel) Tunnel {
+	t.Metadata = maps.Clone(t.Metadata)
+	return t
+}
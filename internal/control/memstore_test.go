@@ -0,0 +1,49 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStoreSnapshotSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "control.json")
+
+	store, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, err := store.CreateTunnelWithMeta(ctx, "dev", "secret", "u1", "web", "", "", map[string]any{"v": "1"})
+	if err != nil {
+		t.Fatalf("CreateTunnelWithMeta: %v", err)
+	}
+	route, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:3000", Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "x"}); err == nil {
+		t.Fatalf("CreateRoute accepted a duplicate hostname")
+	}
+
+	reopened, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, err := reopened.ValidateTunnelToken(ctx, tunnel.ID, "secret")
+	if err != nil || got.Metadata["v"] != "1" {
+		t.Fatalf("ValidateTunnelToken after reopen = %+v, %v", got, err)
+	}
+	routes, err := reopened.ListEnabledProtocolRoutesByTunnel(ctx, tunnel.ID)
+	if err != nil || len(routes) != 1 || routes[0].ID != route.ID {
+		t.Fatalf("routes after reopen = %+v, %v", routes, err)
+	}
+
+	if err := reopened.DeleteTunnelByID(ctx, tunnel.ID); err != nil {
+		t.Fatalf("DeleteTunnelByID: %v", err)
+	}
+	if _, err := reopened.GetRouteByHostname(ctx, "app.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("route survived tunnel deletion: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Quotas caps what the control API lets callers create, so the open
+// session-register endpoint cannot be used to create unlimited tunnels and
+// routes. A zero field leaves that limit off.
+type Quotas struct {
+	// MaxTunnelsPerOwner counts tunnels by owner_id; tunnels without an
+	// owner are not limited.
+	MaxTunnelsPerOwner int
+	MaxRoutesPerTunnel int
+	MaxHostnameLength  int
+}
+
+// SetQuotas sets the limits checked whenever a tunnel or route is created.
+func (s *Server) SetQuotas(q Quotas) {
+	s.quotas = q
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func (s *Server) checkTunnelQuota(ctx context.Context, ownerID string) error {
+	limit := s.quotas.MaxTunnelsPerOwner
+	if limit <= 0 || ownerID == "" {
+		return nil
+	}
+	rows, err := s.store.SearchTunnels(ctx, ListOptions{OwnerID: ownerID, Limit: limit})
+	if err != nil {
+		return err
+	}
+	if len(rows) >= limit {
+		return fmt.Errorf("%w: user %s already has the maximum of %d tunnels", errQuotaExceeded, ownerID, limit)
+	}
+	return nil
+}
+
+// checkRouteQuota is called before hostname is added to tunnelID.
+func (s *Server) checkRouteQuota(ctx context.Context, tunnelID, hostname string) error {
+	if err := s.checkHostnameLength(hostname); err != nil {
+		return err
+	}
+	limit := s.quotas.MaxRoutesPerTunnel
+	if limit <= 0 {
+		return nil
+	}
+	rows, err := s.store.SearchRoutes(ctx, ListOptions{TunnelID: tunnelID, Limit: limit})
+	if err != nil {
+		return err
+	}
+	if len(rows) >= limit {
+		return fmt.Errorf("%w: tunnel %s already has the maximum of %d routes", errQuotaExceeded, tunnelID, limit)
+	}
+	return nil
+}
+
+func (s *Server) checkHostnameLength(hostname string) error {
+	if limit := s.quotas.MaxHostnameLength; limit > 0 && len(hostname) > limit {
+		return fmt.Errorf("%w: hostname %s is longer than %d characters", errQuotaExceeded, hostname, limit)
+	}
+	return nil
+}
+
+// writeQuotaError answers a failed quota check: 422 when a limit was hit,
+// 502 when the store could not be asked.
+func (s *Server) writeQuotaError(w http.ResponseWriter, err error, tunnelID string) {
+	if errors.Is(err, errQuotaExceeded) {
+		errorJSON(w, http.StatusUnprocessableEntity, err.Error())
+		s.events.Add("warn", "quota.exceeded", tunnelID, err.Error())
+		return
+	}
+	errorJSON(w, http.StatusBadGateway, err.Error())
+}
@@ -0,0 +1,59 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotasRejectWith422(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetQuotas(Quotas{MaxTunnelsPerOwner: 1, MaxRoutesPerTunnel: 1, MaxHostnameLength: 20})
+	handler := srv.Handler()
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	register := `{"user_id":"alice","project":"%s","target":"127.0.0.1:3000","base_domain":"example.com"}`
+	rec := post("/api/sessions/register", strings.Replace(register, "%s", "web", 1))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first register = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = post("/api/sessions/register", strings.Replace(register, "%s", "api", 1))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "maximum of 1 tunnels") {
+		t.Fatalf("second tunnel for alice = %d %s, want 422", rec.Code, rec.Body.String())
+	}
+
+	tunnels, _ := store.SearchTunnels(context.Background(), ListOptions{OwnerID: "alice"})
+	if len(tunnels) != 1 {
+		t.Fatalf("alice has %d tunnels, want 1", len(tunnels))
+	}
+	tunnelID := tunnels[0].ID
+	rec = post("/api/routes", `{"tunnel_id":"`+tunnelID+`","hostname":"two.example.com","target":"127.0.0.1:1"}`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "maximum of 1 routes") {
+		t.Fatalf("second route = %d %s, want 422", rec.Code, rec.Body.String())
+	}
+	// Updating the route the tunnel already has is not limited.
+	rec = post("/api/routes", `{"tunnel_id":"`+tunnelID+`","hostname":"web.example.com","target":"127.0.0.1:2"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("updating the existing route = %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = post("/api/sessions/register", `{"user_id":"bob","project":"p","subdomain":"a-very-long-preview-name","target":"127.0.0.1:3000","base_domain":"example.com"}`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "longer than 20") {
+		t.Fatalf("long hostname = %d %s, want 422", rec.Code, rec.Body.String())
+	}
+	if tunnels, _ := store.SearchTunnels(context.Background(), ListOptions{OwnerID: "bob"}); len(tunnels) != 0 {
+		t.Fatalf("rejected registration left tunnels behind: %+v", tunnels)
+	}
+}
@@ -0,0 +1,188 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route53DNS manages records of one Route 53 hosted zone. Requests are
+// signed with AWS Signature Version 4, so no SDK is needed.
+type Route53DNS struct {
+	endpoint     string
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+	hostedZoneID string
+	httpClient   *http.Client
+	now          func() time.Time
+}
+
+// NewRoute53DNS uses credentials allowed route53:ChangeResourceRecordSets
+// on hostedZoneID; sessionToken is only needed for temporary credentials.
+func NewRoute53DNS(accessKeyID, secretKey, sessionToken, hostedZoneID string) (*Route53DNS, error) {
+	accessKeyID, secretKey = strings.TrimSpace(accessKeyID), strings.TrimSpace(secretKey)
+	hostedZoneID = strings.TrimPrefix(strings.TrimSpace(hostedZoneID), "/hostedzone/")
+	if accessKeyID == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if hostedZoneID == "" {
+		return nil, errors.New("ROUTE53_HOSTED_ZONE_ID is required")
+	}
+	return &Route53DNS{
+		endpoint:     "https://route53.amazonaws.com",
+		accessKeyID:  accessKeyID,
+		secretKey:    secretKey,
+		sessionToken: strings.TrimSpace(sessionToken),
+		hostedZoneID: hostedZoneID,
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+		now: time.Now,
+	}, nil
+}
+
+func (r *Route53DNS) SetRecord(ctx context.Context, rec DNSRecord) error {
+	return r.change(ctx, "UPSERT", rec)
+}
+
+func (r *Route53DNS) DeleteRecord(ctx context.Context, rec DNSRecord) error {
+	err := r.change(ctx, "DELETE", rec)
+	var apiErr *route53Error
+	if errors.As(err, &apiErr) && apiErr.Code == "InvalidChangeBatch" && strings.Contains(apiErr.Message, "not found") {
+		return nil
+	}
+	return err
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action  string   `xml:"Action"`
+	Name    string   `xml:"ResourceRecordSet>Name"`
+	Type    string   `xml:"ResourceRecordSet>Type"`
+	TTL     int      `xml:"ResourceRecordSet>TTL"`
+	Records []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (e *route53Error) Error() string {
+	return "route53 " + e.Code + ": " + e.Message
+}
+
+func (r *Route53DNS) change(ctx context.Context, action string, rec DNSRecord) error {
+	body := route53ChangeRequest{Changes: []route53Change{{
+		Action:  action,
+		Name:    rec.Name,
+		Type:    rec.Type,
+		TTL:     rec.TTL,
+		Records: []string{rec.Value},
+	}}}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal change: %w", err)
+	}
+	data = append([]byte(xml.Header), data...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint+"/2013-04-01/hostedzone/"+r.hostedZoneID+"/rrset", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	signV4(req, data, r.accessKeyID, r.secretKey, r.sessionToken, "us-east-1", "route53", r.now())
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	apiErr := &route53Error{}
+	if xml.Unmarshal(respBody, apiErr) != nil || apiErr.Code == "" {
+		return fmt.Errorf("route53 error status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return apiErr
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req. It
+// signs the host, the content type when set, and the x-amz headers.
+func signV4(req *http.Request, body []byte, accessKeyID, secretKey, sessionToken, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,236 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRouteLookupUpdateAndDelete(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	bob, _ := store.CreateTunnelWithMeta(ctx, "b", "tb", "bob", "web", "", "", nil)
+	route, err := store.CreateRoute(ctx, Route{TunnelID: bob.ID, Hostname: "bob.example.com", Target: "127.0.0.1:1", Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetAPIAuth([]string{"k1"}, "jwt-secret")
+	handler := srv.Handler()
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	asAlice := signJWT("jwt-secret", `{"sub":"alice","exp":`+exp+`}`)
+	asBob := signJWT("jwt-secret", `{"sub":"bob","exp":`+exp+`}`)
+
+	do := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) Route {
+		var resp struct {
+			Route Route `json:"route"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %s: %v", rec.Body.String(), err)
+		}
+		return resp.Route
+	}
+
+	rec := do("GET", "/api/routes?hostname=Bob.Example.com", asBob, "")
+	if rec.Code != http.StatusOK || decode(rec).ID != route.ID {
+		t.Fatalf("lookup = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("GET", "/api/routes?hostname=none.example.com", asBob, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("lookup of unknown hostname = %d, want 404", rec.Code)
+	}
+	if rec := do("GET", "/api/routes?hostname=bob.example.com", asAlice, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice looking up bob's route = %d, want 403", rec.Code)
+	}
+	if rec := do("GET", "/api/routes?q=bob", asAlice, ""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), route.ID) {
+		t.Fatalf("alice listing routes = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("GET", "/api/routes?q=bob&limit=1", asBob, ""); !strings.Contains(rec.Body.String(), route.ID) || strings.Contains(rec.Body.String(), "next_offset") {
+		t.Fatalf("bob listing routes = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("GET", "/api/tunnels?limit=-1", "k1", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("negative limit = %d, want 400", rec.Code)
+	}
+	store.CreateTunnelWithMeta(ctx, "b2", "tb2", "bob", "api", "", "", nil)
+	if rec := do("GET", "/api/tunnels?limit=1", asBob, ""); !strings.Contains(rec.Body.String(), `"next_offset":1`) {
+		t.Fatalf("first page of bob's tunnels = %s", rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asAlice, `{"enabled":false}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice patching bob's route = %d, want 403", rec.Code)
+	}
+
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"enabled":false}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Enabled || got.Target != "127.0.0.1:1" {
+		t.Fatalf("disable = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"target":"127.0.0.1:3000"}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Enabled || got.Target != "127.0.0.1:3000" {
+		t.Fatalf("retarget = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"target":""}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("empty target = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"split":{"target":"http://127.0.0.1:3001","weight":10,"sticky":"cookie"}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Split == nil || got.Split.Target != "127.0.0.1:3001" || got.Split.Weight != 10 {
+		t.Fatalf("split = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"split":{"target":"127.0.0.1:3001","weight":120}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("split weight 120 = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"split":null}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Split != nil || got.Target != "127.0.0.1:3000" {
+		t.Fatalf("clear split = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"timeout":"120s","max_body_bytes":1048576}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Timeout != "2m0s" || got.MaxBodyBytes != 1<<20 {
+		t.Fatalf("limits = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"timeout":""}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Timeout != "" || got.MaxBodyBytes != 1<<20 {
+		t.Fatalf("clear timeout = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"timeout":"2h"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("timeout 2h = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"ip_filter":{"allow":["10.1.0.0/16","192.0.2.7"]}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.IPFilter == nil || len(got.IPFilter.Allow) != 2 || got.IPFilter.Allow[1] != "192.0.2.7/32" {
+		t.Fatalf("ip filter = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"ip_filter":{"deny":["office"]}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad ip filter = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"ip_filter":null}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.IPFilter != nil {
+		t.Fatalf("clear ip filter = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "/api/routes/"+route.ID+"/token", asBob, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("token without secret = %d, want 409", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"auth":{"basic":["carol:hunter2"],"token_secret":"0123456789abcdef"}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Auth == nil || !got.Auth.CheckBasic("carol", "hunter2") || strings.Contains(got.Auth.Basic[0], "hunter2") {
+		t.Fatalf("auth = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do("POST", "/api/routes/"+route.ID+"/token", asBob, `{"ttl":"1h"}`)
+	var issued struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("token = %d %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := protocol.VerifyRouteToken("0123456789abcdef", route.Hostname, issued.Token, time.Now()); !ok || !strings.Contains(issued.URL, route.Hostname) {
+		t.Fatalf("issued token %+v does not verify", issued)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"auth":{"login":{"allow":["@example.com"]},"jwt":{"jwks_url":"https://idp.test/jwks","audience":"api"}}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Auth == nil || got.Auth.Login == nil || got.Auth.JWT == nil || got.Auth.JWT.Audience != "api" {
+		t.Fatalf("login and jwt auth = %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"auth":null}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Auth != nil {
+		t.Fatalf("clear auth = %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"rewrite":{"strip_prefix":"/app/","host":"target"}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Rewrite == nil || got.Rewrite.StripPrefix != "/app" {
+		t.Fatalf("rewrite = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"rewrite":{"add_prefix":"v2"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad rewrite = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"header_rules":{"request":{"set":{"x-env":"preview"}},"response":{"remove":["server"]}}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.HeaderRules == nil || got.HeaderRules.Request.Set["X-Env"] != "preview" {
+		t.Fatalf("header rules = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"header_rules":{"request":{"set":{"Host":"x"}}}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("host header rule = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"cache":{"default_ttl":"300s"}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Cache == nil || got.Cache.DefaultTTL != "5m0s" {
+		t.Fatalf("cache = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"cache":{"max_ttl":"30d"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad cache = %d, want 400", rec.Code)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"mirror":{"target":"http://127.0.0.1:3001","percent":25}}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Mirror == nil || got.Mirror.Target != "127.0.0.1:3001" || got.Mirror.Percent != 25 {
+		t.Fatalf("mirror = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"mirror":{"target":"127.0.0.1:3001","percent":0}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad mirror = %d, want 400", rec.Code)
+	}
+
+	// A bad field fails the whole patch before anything is written.
+	if rec := do("PATCH", "/api/routes/"+route.ID, asBob, `{"target":"127.0.0.1:4000","enabled":true,"mirror":{"target":"127.0.0.1:3001","percent":0}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch with a bad mirror = %d, want 400", rec.Code)
+	}
+	if got, _ := store.GetRouteByID(ctx, route.ID); got.Target != "127.0.0.1:3000" || got.Enabled {
+		t.Fatalf("rejected patch changed the route: %+v", got)
+	}
+	rec = do("PATCH", "/api/routes/"+route.ID, asBob, `{"target":"127.0.0.1:4000","enabled":true,"cache":null,"mirror":null}`)
+	if got := decode(rec); rec.Code != http.StatusOK || got.Target != "127.0.0.1:4000" || !got.Enabled || got.Cache != nil || got.Mirror != nil || got.HeaderRules == nil {
+		t.Fatalf("combined patch = %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do("DELETE", "/api/routes/"+route.ID, asAlice, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice deleting bob's route = %d, want 403", rec.Code)
+	}
+	if rec := do("DELETE", "/api/routes/"+route.ID, asBob, ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := store.GetRouteByID(ctx, route.ID); err == nil {
+		t.Fatalf("route still stored after delete")
+	}
+	if rec := do("DELETE", "/api/routes/"+route.ID, asBob, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("second delete = %d, want 404", rec.Code)
+	}
+}
+
+func TestReservedHostnamesAreRefused(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, _ := store.CreateTunnelWithMeta(ctx, "a", "ta", "alice", "web", "", "", nil)
+	srv := NewServer(store, "https://tunnel.example.com", "", "", "", "")
+	if err := srv.SetReservedHostnames([]string{"*.corp.example.com"}, `(www|mail)\..*`); err != nil {
+		t.Fatalf("SetReservedHostnames: %v", err)
+	}
+	handler := srv.Handler()
+	upsert := func(hostname string) int {
+		req := httptest.NewRequest("POST", "/api/routes", strings.NewReader(`{"tunnel_id":"`+tunnel.ID+`","hostname":"`+hostname+`","target":"127.0.0.1:3000"}`))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, host := range []string{"tunnel.example.com", "127.0.0.1", "git.corp.example.com", "www.example.org"} {
+		if code := upsert(host); code != http.StatusBadRequest {
+			t.Fatalf("route for %s = %d, want 400", host, code)
+		}
+	}
+	if code := upsert("app.example.com"); code != http.StatusOK {
+		t.Fatalf("route for app.example.com = %d", code)
+	}
+	req := httptest.NewRequest("POST", "/api/sessions/register", strings.NewReader(`{"user_id":"alice","project":"x","subdomain":"tunnel","target":"127.0.0.1:3000","base_domain":"example.com"}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("register for the gateway hostname = %d %s", rec.Code, rec.Body)
+	}
+}
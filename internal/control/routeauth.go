@@ -0,0 +1,84 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	defaultRouteTokenTTL = 24 * time.Hour
+	maxRouteTokenTTL     = 90 * 24 * time.Hour
+)
+
+// parseRouteAuth decodes a route's auth field; JSON null clears it. Basic
+// entries may carry a plain password, which is bcrypt-hashed here so only
+// the hash is stored and handed to the gateway.
+func parseRouteAuth(raw json.RawMessage) (*protocol.RouteAuth, error) {
+	var auth *protocol.RouteAuth
+	if err := json.Unmarshal(raw, &auth); err != nil {
+		return nil, errors.New("auth must be an object like {\"basic\": [\"user:password\"], \"token_secret\": \"...\"}")
+	}
+	if auth == nil {
+		return nil, nil
+	}
+	for i, entry := range auth.Basic {
+		user, password, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || password == "" {
+			return nil, errors.New("auth basic entries must look like \"user:password\"")
+		}
+		if _, err := bcrypt.Cost([]byte(password)); err == nil {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		auth.Basic[i] = user + ":" + string(hash)
+	}
+	return protocol.NormalizeRouteAuth(auth)
+}
+
+// handleRouteToken signs a preview link for a route with a token secret:
+// POST /api/routes/{id}/token with an optional {"ttl": "24h"}.
+func (s *Server) handleRouteToken(ctx context.Context, w http.ResponseWriter, r *http.Request, route Route) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if route.Auth == nil || route.Auth.TokenSecret == "" {
+		errorJSON(w, http.StatusConflict, "route has no auth token_secret")
+		return
+	}
+	var req struct {
+		TTL string `json:"ttl,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &req); err != nil {
+			errorJSON(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	ttl := defaultRouteTokenTTL
+	if strings.TrimSpace(req.TTL) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(req.TTL))
+		if err != nil || d <= 0 || d > maxRouteTokenTTL {
+			errorJSON(w, http.StatusBadRequest, "ttl must be a positive duration up to 2160h")
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token := protocol.SignRouteToken(route.Auth.TokenSecret, route.Hostname, expires)
+	link := "https://" + route.Hostname + "/?" + url.Values{protocol.RouteTokenParam: {token}}.Encode()
+	s.events.Add("info", "route.token.issued", route.TunnelID, route.Hostname+" until "+formatStoredTime(expires))
+	writeJSON(w, http.StatusOK, map[string]any{"token": token, "url": link, "expires_at": formatStoredTime(expires)})
+}
@@ -0,0 +1,112 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const routeStreamHeartbeat = 25 * time.Second
+
+// handleAgentRoutesStream is the push counterpart of /agent/routes: a
+// text/event-stream that sends a "routes" event (same body as the poll
+// response) whenever the tunnel's route set changes. Agents keep polling
+// /agent/routes only while this stream is unavailable.
+func (s *Server) handleAgentRoutesStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorJSON(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	tunnelID, token := agentCredentials(r)
+	if tunnelID == "" || token == "" {
+		errorJSON(w, http.StatusBadRequest, "tunnel_id and token are required")
+		return
+	}
+	if !s.validAgentCredentials(r.Context(), tunnelID, token) {
+		errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
+		s.events.Add("warn", "agent.routes.auth_failed", tunnelID, "invalid tunnel credentials")
+		return
+	}
+
+	// Subscribe before the first read so a change made in between is not lost.
+	wake, unsubscribe := s.routeHub.subscribe(tunnelID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	s.events.Add("info", "agent.routes.stream_open", tunnelID, "route stream connected")
+	defer s.events.Add("info", "agent.routes.stream_closed", tunnelID, "route stream disconnected")
+	go s.markTunnelOnline(tunnelID)
+
+	sent := strings.TrimSpace(r.URL.Query().Get("since"))
+	push := func() error {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		mapped, version, err := s.agentRoutes(ctx, tunnelID)
+		if err != nil {
+			return err
+		}
+		if version == sent {
+			return nil
+		}
+		if err := writeSSE(w, "routes", s.agentRoutesResponse(tunnelID, mapped, version, sent)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		sent = version
+		return nil
+	}
+	if err := push(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(routeStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+			// The tunnel may have been deleted or its token rotated.
+			if !s.validAgentCredentials(r.Context(), tunnelID, token) {
+				return
+			}
+			if err := push(); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			go s.markTunnelOnline(tunnelID)
+		}
+	}
+}
+
+func (s *Server) validAgentCredentials(ctx context.Context, tunnelID, token string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := s.store.ValidateTunnelToken(ctx, tunnelID, token)
+	return err == nil
+}
+
+func writeSSE(w http.ResponseWriter, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,75 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentRoutesStreamPushesChanges(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	tunnel, err := store.CreateTunnel(ctx, "dev", "secret")
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	q := url.Values{"tunnel_id": {tunnel.ID}, "token": {"secret"}}
+	resp, err := http.Get(ts.URL + "/agent/routes/stream?" + q.Encode())
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	events := make(chan AgentRoutesResponse, 4)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var payload AgentRoutesResponse
+				if json.Unmarshal([]byte(data), &payload) == nil {
+					events <- payload
+				}
+			}
+		}
+	}()
+	next := func() AgentRoutesResponse {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for route event")
+			return AgentRoutesResponse{}
+		}
+	}
+
+	initial := next()
+	if initial.Version == "" || len(initial.Routes) != 0 {
+		t.Fatalf("initial event = %+v", initial)
+	}
+
+	// Writes go through the server's store so any API handler triggers a push.
+	if _, err := srv.store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:3000", Enabled: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	delta := next()
+	if delta.BaseVersion != initial.Version || len(delta.Added) != 1 || delta.Added[0].Hostname != "app.example.com" {
+		t.Fatalf("delta event = %+v", delta)
+	}
+}
@@ -0,0 +1,187 @@
+package control
+
+import (
+	"context"
+	"sync"
+
+	"tunneling/internal/protocol"
+)
+
+const maxRouteSnapshotsPerTunnel = 8
+
+type routeSnapshot struct {
+	version string
+	routes  []protocol.Route
+}
+
+// routeSnapshotCache remembers the last few route sets served to each tunnel
+// so an agent that reports its current version can be sent a delta.
+type routeSnapshotCache struct {
+	mu       sync.Mutex
+	byTunnel map[string][]routeSnapshot
+}
+
+func newRouteSnapshotCache() *routeSnapshotCache {
+	return &routeSnapshotCache{byTunnel: make(map[string][]routeSnapshot)}
+}
+
+func (c *routeSnapshotCache) remember(tunnelID, version string, routes []protocol.Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshots := c.byTunnel[tunnelID]
+	for _, snap := range snapshots {
+		if snap.version == version {
+			return
+		}
+	}
+	snapshots = append(snapshots, routeSnapshot{version: version, routes: routes})
+	if len(snapshots) > maxRouteSnapshotsPerTunnel {
+		snapshots = snapshots[len(snapshots)-maxRouteSnapshotsPerTunnel:]
+	}
+	c.byTunnel[tunnelID] = snapshots
+}
+
+func (c *routeSnapshotCache) lookup(tunnelID, version string) ([]protocol.Route, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, snap := range c.byTunnel[tunnelID] {
+		if snap.version == version {
+			return snap.routes, true
+		}
+	}
+	return nil, false
+}
+
+// routeHub wakes the route streams of a tunnel when its routes change.
+type routeHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func newRouteHub() *routeHub {
+	return &routeHub{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+func (h *routeHub) subscribe(tunnelID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[tunnelID] == nil {
+		h.subs[tunnelID] = make(map[chan struct{}]struct{})
+	}
+	h.subs[tunnelID][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[tunnelID], ch)
+		if len(h.subs[tunnelID]) == 0 {
+			delete(h.subs, tunnelID)
+		}
+	}
+}
+
+// notify never blocks: a subscriber that has not consumed the previous wake-up
+// will re-read the full route set anyway.
+func (h *routeHub) notify(tunnelIDs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, id := range tunnelIDs {
+		for ch := range h.subs[id] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (h *routeHub) notifyAll() {
+	h.mu.Lock()
+	ids := make([]string, 0, len(h.subs))
+	for id := range h.subs {
+		ids = append(ids, id)
+	}
+	h.mu.Unlock()
+	h.notify(ids...)
+}
+
+// notifyingStore wraps a Store so that every route write, wherever it comes
+// from in the API, wakes the streams of the tunnels it touched.
+type notifyingStore struct {
+	Store
+	hub *routeHub
+}
+
+func (s notifyingStore) CreateRoute(ctx context.Context, route Route) (Route, error) {
+	created, err := s.Store.CreateRoute(ctx, route)
+	if err == nil {
+		s.hub.notify(created.TunnelID)
+	}
+	return created, err
+}
+
+func (s notifyingStore) UpdateRoute(ctx context.Context, routeID string, patch RoutePatch) (Route, error) {
+	updated, err := s.Store.UpdateRoute(ctx, routeID, patch)
+	if err == nil {
+		s.hub.notify(updated.TunnelID)
+	}
+	return updated, err
+}
+
+func (s notifyingStore) UpdateRouteBinding(ctx context.Context, routeID string, tunnelID string, target string, enabled bool) (Route, error) {
+	previous, _ := s.Store.GetRouteByID(ctx, routeID)
+	updated, err := s.Store.UpdateRouteBinding(ctx, routeID, tunnelID, target, enabled)
+	if err == nil {
+		s.hub.notify(previous.TunnelID, updated.TunnelID)
+	}
+	return updated, err
+}
+
+func (s notifyingStore) UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error) {
+	updated, err := s.Store.UpdateRouteHostname(ctx, routeID, hostname)
+	if err == nil {
+		s.hub.notify(updated.TunnelID)
+	}
+	return updated, err
+}
+
+func (s notifyingStore) SetRouteExpiry(ctx context.Context, routeID, expiresAt string) (Route, error) {
+	updated, err := s.Store.SetRouteExpiry(ctx, routeID, expiresAt)
+	if err == nil {
+		s.hub.notify(updated.TunnelID)
+	}
+	return updated, err
+}
+
+func (s notifyingStore) SetRouteVerification(ctx context.Context, routeID, status, token string) (Route, error) {
+	updated, err := s.Store.SetRouteVerification(ctx, routeID, status, token)
+	if err == nil {
+		s.hub.notify(updated.TunnelID)
+	}
+	return updated, err
+}
+
+func (s notifyingStore) DeleteRouteByID(ctx context.Context, routeID string) error {
+	previous, _ := s.Store.GetRouteByID(ctx, routeID)
+	err := s.Store.DeleteRouteByID(ctx, routeID)
+	if err == nil {
+		s.hub.notify(previous.TunnelID)
+	}
+	return err
+}
+
+func (s notifyingStore) DeleteTunnelByID(ctx context.Context, tunnelID string) error {
+	err := s.Store.DeleteTunnelByID(ctx, tunnelID)
+	if err == nil {
+		s.hub.notify(tunnelID)
+	}
+	return err
+}
+
+func (s notifyingStore) DeleteAllTunnels(ctx context.Context) error {
+	err := s.Store.DeleteAllTunnels(ctx)
+	if err == nil {
+		s.hub.notifyAll()
+	}
+	return err
+}
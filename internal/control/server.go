@@ -8,7 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -16,21 +16,34 @@ import (
 	"strings"
 	"time"
 
+	"tunneling/internal/logging"
 	"tunneling/internal/protocol"
 )
 
 type Server struct {
-	supabase        *SupabaseClient
+	store           Store
 	publicBaseURL   string
 	publicURLScheme string
 	agentServerWS   string
+	gateways        []Gateway
 	agentConfigURL  string
 	defaultAdminAPI string
 	adminKey        string
+	apiKeys         []string
+	jwtSecret       string
+	quotas          Quotas
 	events          *EventStore
+	routeSnapshots  *routeSnapshotCache
+	routeHub        *routeHub
+	presence        *agentPresence
+	platformDomains []string
+	verifier        *domainVerifier
+	reserved        *protocol.ReservedHostnames
+	dns             *dnsSync
+	idle            idleTracker
 }
 
-func NewServer(supabase *SupabaseClient, publicBaseURL, agentServerWS, agentConfigURL, defaultAdminAPI, adminKey string) *Server {
+func NewServer(store Store, publicBaseURL, agentServerWS, agentConfigURL, defaultAdminAPI, adminKey string) *Server {
 	publicBaseURL = strings.TrimSpace(strings.TrimRight(publicBaseURL, "/"))
 	agentServerWS = strings.TrimSpace(agentServerWS)
 	if agentServerWS == "" {
@@ -48,8 +61,9 @@ func NewServer(supabase *SupabaseClient, publicBaseURL, agentServerWS, agentConf
 		agentConfigURL = "http://127.0.0.1:18100/agent/routes"
 	}
 
-	return &Server{
-		supabase:        supabase,
+	hub := newRouteHub()
+	s := &Server{
+		store:           notifyingStore{Store: store, hub: hub},
 		publicBaseURL:   publicBaseURL,
 		publicURLScheme: publicURLScheme(publicBaseURL),
 		agentServerWS:   agentServerWS,
@@ -57,7 +71,40 @@ func NewServer(supabase *SupabaseClient, publicBaseURL, agentServerWS, agentConf
 		defaultAdminAPI: strings.TrimSpace(defaultAdminAPI),
 		adminKey:        strings.TrimSpace(adminKey),
 		events:          NewEventStore(2000),
+		routeSnapshots:  newRouteSnapshotCache(),
+		routeHub:        hub,
+		presence:        newAgentPresence(),
+		verifier:        newDomainVerifier(),
 	}
+	s.reserved, _ = protocol.NewReservedHostnames(s.gatewayHostnames(), "")
+	return s
+}
+
+// SetReservedHostnames adds an operator blocklist, entries and a pattern as
+// protocol.NewReservedHostnames takes them, to the hostnames no route may
+// claim. The gateway's own hostnames, from the public base URL and the agent
+// URLs, stay reserved either way.
+func (s *Server) SetReservedHostnames(entries []string, pattern string) error {
+	reserved, err := protocol.NewReservedHostnames(append(s.gatewayHostnames(), entries...), pattern)
+	if err != nil {
+		return err
+	}
+	s.reserved = reserved
+	return nil
+}
+
+func (s *Server) gatewayHostnames() []string {
+	var hosts []string
+	raws := []string{s.publicBaseURL, s.agentServerWS, s.agentConfigURL}
+	for _, g := range s.gateways {
+		raws = append(raws, g.URL)
+	}
+	for _, raw := range raws {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
 }
 
 func (s *Server) Handler() http.Handler {
@@ -65,17 +112,29 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/healthz", s.handleHealthz)
 	mux.HandleFunc("/api/tunnels", s.handleTunnels)
 	mux.HandleFunc("/api/routes", s.handleRoutes)
+	mux.HandleFunc("/api/routes/", s.handleRouteByID)
 	mux.HandleFunc("/api/sessions/register", s.handleSessionRegister)
 	mux.HandleFunc("/api/sessions/add-route", s.handleSessionAddRoute)
 	mux.HandleFunc("/api/tunnels/", s.handleTunnelByID)
 	mux.HandleFunc("/api/admin/tunnels/", s.handleAdminTunnelByID)
 	mux.HandleFunc("/api/admin/routes/", s.handleAdminRouteByID)
 	mux.HandleFunc("/api/logs", s.handleLogs)
+	mux.HandleFunc("/api/logs/stream", s.handleLogsStream)
+	mux.HandleFunc("/api/usage", s.handleUsage)
+	mux.HandleFunc("/api/gateway/routes", s.handleGatewayRoutes)
+	mux.HandleFunc("/api/gateway/wake", s.handleGatewayWake)
+	mux.HandleFunc("/api/gateway/agents", s.handleGatewayAgents)
+	mux.Handle("/api/log-level", logging.Handler())
 	mux.HandleFunc("/agent/routes", s.handleAgentRoutes)
+	mux.HandleFunc("/agent/routes/stream", s.handleAgentRoutesStream)
+	mux.HandleFunc("/agent/heartbeat", s.handleAgentHeartbeat)
+	mux.HandleFunc("/agent/auth", s.handleAgentAuth)
+	mux.HandleFunc("/agent/assign", s.handleAgentAssign)
 	mux.HandleFunc("/api/portal/login", s.handlePortalLogin)
 	mux.HandleFunc("/api/portal/routes/", s.handlePortalRouteByID)
 	mux.HandleFunc("/api/portal/routes", s.handlePortalRoutesAPI)
-	return corsMiddleware(mux)
+	mux.HandleFunc(ChallengePath, s.handleChallenge)
+	return corsMiddleware(s.authMiddleware(mux))
 }
 
 func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
@@ -96,14 +155,81 @@ func (s *Server) handleTunnels(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.TunnelID = ""
+	if p := caller(r); !p.Admin {
+		opts.OwnerID = p.UserID
+	}
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	rows, err := s.supabase.ListTunnels(ctx)
+	rows, err := s.store.SearchTunnels(ctx, fetchOptions(opts))
 	if err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"tunnels": rows})
+	rows, next := pageOf(rows, opts)
+	now := time.Now()
+	for i := range rows {
+		rows[i].Online = tunnelOnline(rows[i], now)
+	}
+	writeJSON(w, http.StatusOK, listResponse("tunnels", rows, next))
+}
+
+// maxListLimit caps the page size of the list endpoints.
+const maxListLimit = 1000
+
+// listOptions reads the filters and paging the list endpoints share:
+// q, owner_id, tunnel_id, limit and offset.
+func listOptions(r *http.Request) (ListOptions, error) {
+	q := r.URL.Query()
+	opts := ListOptions{
+		OwnerID:  strings.TrimSpace(q.Get("owner_id")),
+		TunnelID: strings.TrimSpace(q.Get("tunnel_id")),
+		Query:    strings.TrimSpace(q.Get("q")),
+	}
+	for name, dst := range map[string]*int{"limit": &opts.Limit, "offset": &opts.Offset} {
+		raw := strings.TrimSpace(q.Get(name))
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		*dst = n
+	}
+	opts.Limit = min(opts.Limit, maxListLimit)
+	return opts, nil
+}
+
+// fetchOptions asks for one row past the page, which tells pageOf whether
+// another page follows.
+func fetchOptions(opts ListOptions) ListOptions {
+	if opts.Limit > 0 {
+		opts.Limit++
+	}
+	return opts
+}
+
+// pageOf drops the extra row fetchOptions asked for and returns the offset
+// of the next page, 0 if this is the last.
+func pageOf[T any](rows []T, opts ListOptions) ([]T, int) {
+	if opts.Limit <= 0 || len(rows) <= opts.Limit {
+		return rows, 0
+	}
+	return rows[:opts.Limit], opts.Offset + opts.Limit
+}
+
+func listResponse[T any](key string, rows []T, next int) map[string]any {
+	resp := map[string]any{key: rows}
+	if next > 0 {
+		resp["next_offset"] = next
+	}
+	return resp
 }
 
 type createTunnelRequest struct {
@@ -130,7 +256,13 @@ func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	tunnel, err := s.supabase.CreateTunnel(ctx, req.Name, token)
+	// Tunnels created by a signed-in user belong to that user.
+	ownerID := caller(r).UserID
+	if err := s.checkTunnelQuota(ctx, ownerID); err != nil {
+		s.writeQuotaError(w, err, "")
+		return
+	}
+	tunnel, err := s.store.CreateTunnelWithMeta(ctx, req.Name, token, ownerID, "", "", "", nil)
 	if err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "tunnel.create.failed", "", err.Error())
@@ -150,14 +282,286 @@ type upsertRouteRequest struct {
 	Target   string `json:"target"`
 	Enabled  *bool  `json:"enabled,omitempty"`
 	Force    bool   `json:"force,omitempty"`
+	// ExpiresAt (RFC 3339) or TTL (e.g. "72h") sets when the route expires;
+	// leaving both out keeps an existing route's expiry.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
 }
 
 func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("hostname"):
+		s.handleLookupRoute(w, r)
+	case r.Method == http.MethodGet:
+		s.handleSearchRoutes(w, r)
+	case r.Method == http.MethodPost:
+		s.handleUpsertRoute(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSearchRoutes lists routes across tunnels; users only see the routes
+// of their own tunnels.
+func (s *Server) handleSearchRoutes(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if p := caller(r); !p.Admin {
+		opts.OwnerID = p.UserID
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	routes, err := s.store.SearchRoutes(ctx, fetchOptions(opts))
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	routes, next := pageOf(routes, opts)
+	writeJSON(w, http.StatusOK, listResponse("routes", routes, next))
+}
+
+// handleLookupRoute answers GET /api/routes?hostname=.
+func (s *Server) handleLookupRoute(w http.ResponseWriter, r *http.Request) {
+	hostname, err := normalizeHostname(r.URL.Query().Get("hostname"), nil)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	route, err := s.store.GetRouteByHostname(ctx, hostname)
+	if errors.Is(err, ErrNotFound) {
+		errorJSON(w, http.StatusNotFound, "route not found")
+		return
+	}
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if !s.checkTunnelAccess(ctx, w, r, route.TunnelID) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"route": route})
+}
+
+type patchRouteRequest struct {
+	Target  *string `json:"target,omitempty"`
+	Enabled *bool   `json:"enabled,omitempty"`
+	// ExpiresAt "" clears the expiry.
+	ExpiresAt *string `json:"expires_at,omitempty"`
+	TTL       string  `json:"ttl,omitempty"`
+	// Split is a split object to set, or null to clear it.
+	Split json.RawMessage `json:"split,omitempty"`
+	// Timeout "" and MaxBodyBytes 0 go back to the gateway defaults.
+	Timeout      *string `json:"timeout,omitempty"`
+	MaxBodyBytes *int64  `json:"max_body_bytes,omitempty"`
+	// IPFilter is an allow/deny object to set, or null to clear it.
+	IPFilter json.RawMessage `json:"ip_filter,omitempty"`
+	// Auth is an auth object to set, or null to clear it.
+	Auth json.RawMessage `json:"auth,omitempty"`
+	// Rewrite is a rewrite object to set, or null to clear it.
+	Rewrite json.RawMessage `json:"rewrite,omitempty"`
+	// HeaderRules is a header rules object to set, or null to clear it.
+	HeaderRules     json.RawMessage `json:"header_rules,omitempty"`
+	ACMEPassthrough *bool           `json:"acme_passthrough,omitempty"`
+	// Redirect or StaticResponse turn the route into one the tunnel server
+	// answers itself; setting one clears the other, null clears it.
+	Redirect       json.RawMessage `json:"redirect,omitempty"`
+	StaticResponse json.RawMessage `json:"static_response,omitempty"`
+	// Aliases is the full list of extra hostnames; null or [] clears it.
+	Aliases json.RawMessage `json:"aliases,omitempty"`
+	// Cache is a cache object to set, or null to clear it.
+	Cache json.RawMessage `json:"cache,omitempty"`
+	// Mirror is a mirror object to set, or null to stop mirroring.
+	Mirror json.RawMessage `json:"mirror,omitempty"`
+}
+
+// handleRouteByID serves PATCH and DELETE on /api/routes/{id}, domain
+// verification on /api/routes/{id}/verify, preview links on
+// /api/routes/{id}/token and maintenance on /api/routes/{id}/maintenance.
+func (s *Server) handleRouteByID(w http.ResponseWriter, r *http.Request) {
+	routeID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/routes/"), "/")
+	routeID, verify := strings.CutSuffix(routeID, "/verify")
+	routeID, token := strings.CutSuffix(routeID, "/token")
+	routeID, maintenance := strings.CutSuffix(routeID, "/maintenance")
+	if routeID == "" || strings.Contains(routeID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !verify && !token && !maintenance && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	existing, err := s.store.GetRouteByID(ctx, routeID)
+	if err != nil {
+		errorJSON(w, http.StatusNotFound, "route not found")
+		return
+	}
+	if !s.checkTunnelAccess(ctx, w, r, existing.TunnelID) {
+		return
+	}
+	if verify {
+		s.handleRouteVerification(ctx, w, r, existing)
+		return
+	}
+	if token {
+		s.handleRouteToken(ctx, w, r, existing)
+		return
+	}
+	if maintenance {
+		s.handleRouteMaintenance(ctx, w, r, existing)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.store.DeleteRouteByID(ctx, routeID); err != nil {
+			errorJSON(w, http.StatusBadGateway, err.Error())
+			s.events.Add("error", "route.delete.failed", existing.TunnelID, err.Error())
+			return
+		}
+		s.events.Add("info", "route.deleted", existing.TunnelID, existing.Hostname)
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "route_id": routeID})
+		return
+	}
+
+	var req patchRouteRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	patch, status, err := s.routePatch(ctx, existing, req)
+	if err != nil {
+		errorJSON(w, status, err.Error())
+		return
+	}
+	route, err := s.store.UpdateRoute(ctx, routeID, patch)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		s.events.Add("error", "route.update.failed", existing.TunnelID, err.Error())
+		return
+	}
+	s.events.Add("info", "route.updated", existing.TunnelID, fmt.Sprintf("%s => %s enabled=%t", route.Hostname, route.Target, route.Enabled))
+	writeJSON(w, http.StatusOK, map[string]any{"route": route})
+}
+
+// routePatch validates every field of req against the route it changes and
+// only then returns the patch, so a bad field leaves the route untouched. The
+// status goes with the error.
+func (s *Server) routePatch(ctx context.Context, existing Route, req patchRouteRequest) (RoutePatch, int, error) {
+	patch := RoutePatch{Fields: RouteTarget | RouteEnabled}
+	p := &patch.Route
+	p.Target, p.Enabled = existing.Target, existing.Enabled
+	var err error
+	if req.Target != nil {
+		if p.Target, err = normalizeTarget(*req.Target); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+	}
+	if req.Enabled != nil {
+		p.Enabled = *req.Enabled
+	}
+	if req.ExpiresAt != nil || req.TTL != "" {
+		var raw string
+		if req.ExpiresAt != nil {
+			raw = *req.ExpiresAt
+		}
+		if p.ExpiresAt, err = parseExpiry(raw, req.TTL, time.Now()); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteExpiry
+	}
+	if len(req.Split) > 0 {
+		if p.Split, err = parseSplit(req.Split); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteSplit
+	}
+	if req.Timeout != nil || req.MaxBodyBytes != nil {
+		if p.Timeout, p.MaxBodyBytes, err = mergeRouteLimits(existing, req.Timeout, req.MaxBodyBytes); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteLimits
+	}
+	if len(req.IPFilter) > 0 {
+		if p.IPFilter, err = parseIPFilter(req.IPFilter); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteIPFilter
+	}
+	if len(req.Auth) > 0 {
+		if p.Auth, err = parseRouteAuth(req.Auth); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteAuth
+	}
+	if len(req.Rewrite) > 0 {
+		if p.Rewrite, err = parseRewrite(req.Rewrite); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteRewrite
+	}
+	if len(req.HeaderRules) > 0 {
+		if p.HeaderRules, err = parseHeaderRules(req.HeaderRules); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteHeaderRules
+	}
+	if req.ACMEPassthrough != nil {
+		p.ACMEPassthrough = *req.ACMEPassthrough
+		patch.Fields |= RouteACMEPassthrough
+	}
+	if len(req.Cache) > 0 {
+		if p.Cache, err = parseCache(req.Cache); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteCache
+	}
+	if len(req.Mirror) > 0 {
+		if p.Mirror, err = parseMirror(req.Mirror); err != nil {
+			return patch, http.StatusBadRequest, err
+		}
+		patch.Fields |= RouteMirror
+	}
+	if len(req.Redirect) > 0 || len(req.StaticResponse) > 0 {
+		p.Redirect, p.Static = existing.Redirect, existing.Static
+		if len(req.Redirect) > 0 {
+			if p.Redirect, err = parseRedirect(req.Redirect); err != nil {
+				return patch, http.StatusBadRequest, err
+			}
+			if p.Redirect != nil {
+				p.Static = nil
+			}
+		}
+		if len(req.StaticResponse) > 0 {
+			if p.Static, err = parseStaticResponse(req.StaticResponse); err != nil {
+				return patch, http.StatusBadRequest, err
+			}
+			if p.Static != nil {
+				if len(req.Redirect) > 0 && p.Redirect != nil {
+					return patch, http.StatusBadRequest, errors.New("set redirect or static_response, not both")
+				}
+				p.Redirect = nil
+			}
+		}
+		patch.Fields |= RouteType
+	}
+	if len(req.Aliases) > 0 {
+		var status int
+		if p.Aliases, status, err = s.parseAliases(ctx, existing, req.Aliases); err != nil {
+			return patch, status, err
+		}
+		patch.Fields |= RouteAliases
+	}
+	return patch, 0, nil
+}
+
+func (s *Server) handleUpsertRoute(w http.ResponseWriter, r *http.Request) {
 	var req upsertRouteRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		errorJSON(w, http.StatusBadRequest, "invalid json")
@@ -170,7 +574,7 @@ func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hostname, err := normalizeHostname(req.Hostname)
+	hostname, err := normalizeHostname(req.Hostname, s.reserved)
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, err.Error())
 		return
@@ -184,16 +588,28 @@ func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
 	if req.Enabled != nil {
 		enabled = *req.Enabled
 	}
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.TTL, time.Now())
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	setExpiry := expiresAt != ""
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if _, err := s.supabase.GetTunnelByID(ctx, tunnelID); err != nil {
+	p := caller(r)
+	tunnel, err := s.store.GetTunnelByID(ctx, tunnelID)
+	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "invalid tunnel_id")
 		return
 	}
+	if !p.canAccess(tunnel) {
+		errorJSON(w, http.StatusForbidden, "tunnel belongs to another user")
+		return
+	}
 
-	existing, err := s.supabase.GetRouteByHostname(ctx, hostname)
+	existing, err := s.store.GetRouteByHostname(ctx, hostname)
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "route.lookup.failed", tunnelID, err.Error())
@@ -207,7 +623,23 @@ func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
 				errorJSON(w, http.StatusConflict, "hostname is already bound to another tunnel")
 				return
 			}
-			route, err = s.supabase.UpdateRouteBinding(ctx, existing.ID, tunnelID, target, enabled)
+			// Moving a hostname away from someone else's tunnel takes admin rights.
+			if !p.Admin {
+				owner, err := s.store.GetTunnelByID(ctx, existing.TunnelID)
+				if err == nil && !p.canAccess(owner) {
+					errorJSON(w, http.StatusForbidden, "hostname is bound to another user's tunnel")
+					s.events.Add("warn", "route.rebind.forbidden", tunnelID, hostname)
+					return
+				}
+			}
+			if err := s.checkRouteQuota(ctx, tunnelID, hostname); err != nil {
+				s.writeQuotaError(w, err, tunnelID)
+				return
+			}
+			route, err = s.store.UpdateRouteBinding(ctx, existing.ID, tunnelID, target, enabled)
+			if err == nil && setExpiry {
+				route, err = s.store.SetRouteExpiry(ctx, route.ID, expiresAt)
+			}
 			if err != nil {
 				errorJSON(w, http.StatusBadGateway, err.Error())
 				s.events.Add("error", "route.rebind.failed", tunnelID, err.Error())
@@ -217,18 +649,27 @@ func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusOK, map[string]any{"route": route})
 			return
 		}
-		route, err = s.supabase.UpdateRoute(ctx, existing.ID, target, enabled)
+		patch := RoutePatch{Fields: RouteTarget | RouteEnabled, Route: Route{Target: target, Enabled: enabled, ExpiresAt: expiresAt}}
+		if setExpiry {
+			patch.Fields |= RouteExpiry
+		}
+		route, err = s.store.UpdateRoute(ctx, existing.ID, patch)
 		if err != nil {
 			errorJSON(w, http.StatusBadGateway, err.Error())
 			s.events.Add("error", "route.update.failed", tunnelID, err.Error())
 			return
 		}
 	} else {
-		route, err = s.supabase.CreateRoute(ctx, Route{
-			TunnelID: tunnelID,
-			Hostname: hostname,
-			Target:   target,
-			Enabled:  enabled,
+		if err := s.checkRouteQuota(ctx, tunnelID, hostname); err != nil {
+			s.writeQuotaError(w, err, tunnelID)
+			return
+		}
+		route, err = s.createRoute(ctx, Route{
+			TunnelID:  tunnelID,
+			Hostname:  hostname,
+			Target:    target,
+			Enabled:   enabled,
+			ExpiresAt: expiresAt,
 		})
 		if err != nil {
 			status := http.StatusBadGateway
@@ -258,6 +699,14 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 
 	userID := strings.TrimSpace(req.UserID)
 	project := strings.TrimSpace(req.Project)
+	// A signed-in user registers for themselves only.
+	if p, ok := s.authenticate(r); ok && p.UserID != "" {
+		if userID != "" && userID != p.UserID {
+			errorJSON(w, http.StatusForbidden, "user_id does not match the access token")
+			return
+		}
+		userID = p.UserID
+	}
 	if userID == "" {
 		errorJSON(w, http.StatusBadRequest, "user_id is required")
 		return
@@ -283,6 +732,11 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 	if req.Enabled != nil {
 		enabled = *req.Enabled
 	}
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.TTL, time.Now())
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	requestedSubdomain := strings.TrimSpace(req.Subdomain)
 	requestedTunnelID := strings.TrimSpace(req.TunnelID)
@@ -321,6 +775,10 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusBadRequest, "subdomain is invalid")
 		return
 	}
+	if _, err := normalizeHostname(label+"."+baseDomain, s.reserved); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if (requestedTunnelID == "") != (requestedTunnelToken == "") {
 		errorJSON(w, http.StatusBadRequest, "tunnel_id and tunnel_token must be provided together")
 		return
@@ -329,7 +787,7 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 	var tunnel Tunnel
 	reuseExistingTunnel := requestedTunnelID != "" && requestedTunnelToken != ""
 	if reuseExistingTunnel {
-		tunnel, err = s.supabase.ValidateTunnelToken(ctx, requestedTunnelID, requestedTunnelToken)
+		tunnel, err = s.store.ValidateTunnelToken(ctx, requestedTunnelID, requestedTunnelToken)
 		if err != nil {
 			errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
 			return
@@ -342,12 +800,12 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if userID != "" && projectKey != "" {
-			existing, err := s.supabase.GetTunnelByOwnerAndProject(ctx, userID, projectKey)
+			existing, err := s.store.GetTunnelByOwnerAndProject(ctx, userID, projectKey)
 			if err == nil {
 				// Tunnel already exists
 				if isAdminAuthed {
 					// Admin authenticated, allow idempotent registration
-					if err := s.supabase.DeleteTunnelByID(ctx, existing.ID); err != nil {
+					if err := s.store.DeleteTunnelByID(ctx, existing.ID); err != nil {
 						s.events.Add("warn", "session.register.cleanup_failed", existing.ID, err.Error())
 					}
 				} else {
@@ -364,8 +822,18 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 			// else: tunnel doesn't exist, proceed with creation
 		}
 
-		tunnel, err = s.supabase.CreateTunnelWithMeta(ctx, tunnelName, token, userID, projectKey,
+		if err := s.checkTunnelQuota(ctx, userID); err != nil {
+			s.writeQuotaError(w, err, "")
+			return
+		}
+		tunnel, err = s.store.CreateTunnelWithMeta(ctx, tunnelName, token, userID, projectKey,
 			strings.TrimSpace(req.ClientIP), strings.TrimSpace(req.OSType), req.Metadata)
+		if err == nil && expiresAt != "" {
+			if err = s.store.SetTunnelExpiry(ctx, tunnel.ID, expiresAt); err != nil {
+				_ = s.store.DeleteTunnelByID(ctx, tunnel.ID)
+			}
+			tunnel.ExpiresAt = expiresAt
+		}
 		if err != nil {
 			errorJSON(w, http.StatusBadGateway, err.Error())
 			s.events.Add("error", "session.register.tunnel_failed", "", err.Error())
@@ -373,27 +841,35 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	newRoute := func(hostname string) (Route, error) {
+		if err := s.checkRouteQuota(ctx, tunnel.ID, hostname); err != nil {
+			return Route{}, err
+		}
+		return s.createRoute(ctx, Route{
+			TunnelID:  tunnel.ID,
+			Hostname:  hostname,
+			Target:    target,
+			Enabled:   enabled,
+			ExpiresAt: expiresAt,
+		})
+	}
 	var route Route
 	var hostname string
 	createErr := error(nil)
 	baseHostname := fmt.Sprintf("%s.%s", label, baseDomain)
 	hostname = baseHostname
-	existingRoute, err := s.supabase.GetRouteByHostname(ctx, hostname)
+	existingRoute, err := s.store.GetRouteByHostname(ctx, hostname)
 	if err == nil {
-		if existingRoute.TunnelID == tunnel.ID {
-			route, createErr = s.supabase.UpdateRouteBinding(ctx, existingRoute.ID, tunnel.ID, target, enabled)
-		} else if isAdminAuthed {
-			route, createErr = s.supabase.UpdateRouteBinding(ctx, existingRoute.ID, tunnel.ID, target, enabled)
+		if existingRoute.TunnelID == tunnel.ID || isAdminAuthed {
+			route, createErr = s.store.UpdateRouteBinding(ctx, existingRoute.ID, tunnel.ID, target, enabled)
+			if createErr == nil && expiresAt != "" {
+				route, createErr = s.store.SetRouteExpiry(ctx, route.ID, expiresAt)
+			}
 		} else {
 			const maxRouteAttempts = 6
 			for i := 0; i < maxRouteAttempts; i++ {
 				hostname = fmt.Sprintf("%s-%s.%s", label, randomSuffix(6), baseDomain)
-				route, createErr = s.supabase.CreateRoute(ctx, Route{
-					TunnelID: tunnel.ID,
-					Hostname: hostname,
-					Target:   target,
-					Enabled:  enabled,
-				})
+				route, createErr = newRoute(hostname)
 				if createErr == nil {
 					break
 				}
@@ -403,18 +879,13 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	} else if errors.Is(err, ErrNotFound) {
-		route, createErr = s.supabase.CreateRoute(ctx, Route{
-			TunnelID: tunnel.ID,
-			Hostname: hostname,
-			Target:   target,
-			Enabled:  enabled,
-		})
+		route, createErr = newRoute(hostname)
 	} else {
 		createErr = err
 	}
 	if createErr != nil {
 		if !reuseExistingTunnel {
-			_ = s.supabase.DeleteTunnelByID(ctx, tunnel.ID)
+			_ = s.store.DeleteTunnelByID(ctx, tunnel.ID)
 		}
 		status := http.StatusBadGateway
 		if strings.Contains(strings.ToLower(createErr.Error()), "hostname already exists") {
@@ -423,6 +894,10 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 		if isRouteConflictError(createErr) {
 			status = http.StatusConflict
 		}
+		if errors.Is(createErr, errQuotaExceeded) {
+			s.writeQuotaError(w, createErr, tunnel.ID)
+			return
+		}
 		errorJSON(w, status, createErr.Error())
 		s.events.Add("error", "session.register.route_failed", tunnel.ID, createErr.Error())
 		return
@@ -433,6 +908,8 @@ func (s *Server) handleSessionRegister(w http.ResponseWriter, r *http.Request) {
 		"tunnel":         tunnel,
 		"route":          route,
 		"public_url":     s.publicURL(hostname),
+		"agent_server":   s.agentServerWS,
+		"route_sync_url": s.agentConfigURL,
 		"agent_command":  s.agentCommand(tunnel.ID, tunnel.Token),
 		"docker_command": s.dockerCommand(tunnel.ID, tunnel.Token),
 	})
@@ -467,11 +944,16 @@ func (s *Server) handleDeleteTunnel(w http.ResponseWriter, r *http.Request, tunn
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if _, err := s.supabase.GetTunnelByID(ctx, tunnelID); err != nil {
+	tunnel, err := s.store.GetTunnelByID(ctx, tunnelID)
+	if err != nil {
 		errorJSON(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
-	if err := s.supabase.DeleteTunnelByID(ctx, tunnelID); err != nil {
+	if !caller(r).canAccess(tunnel) {
+		errorJSON(w, http.StatusForbidden, "tunnel belongs to another user")
+		return
+	}
+	if err := s.store.DeleteTunnelByID(ctx, tunnelID); err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "tunnel.delete.failed", tunnelID, err.Error())
 		return
@@ -484,7 +966,7 @@ func (s *Server) handleDeleteAllTunnels(w http.ResponseWriter, r *http.Request)
 	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
 	defer cancel()
 
-	if err := s.supabase.DeleteAllTunnels(ctx); err != nil {
+	if err := s.store.DeleteAllTunnels(ctx); err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "tunnel.delete_all.failed", "", err.Error())
 		return
@@ -509,7 +991,7 @@ func (s *Server) handleAdminTunnelByID(w http.ResponseWriter, r *http.Request) {
 
 	// Verify admin authorization
 	if !s.isAdminAuthorized(r) {
-		errorJSON(w, http.StatusUnauthorized, "unauthorized")
+		s.writeAuthError(w, r)
 		s.events.Add("warn", "admin.delete_tunnel.unauthorized", tunnelID, "unauthorized delete attempt")
 		return
 	}
@@ -517,11 +999,11 @@ func (s *Server) handleAdminTunnelByID(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if _, err := s.supabase.GetTunnelByID(ctx, tunnelID); err != nil {
+	if _, err := s.store.GetTunnelByID(ctx, tunnelID); err != nil {
 		errorJSON(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
-	if err := s.supabase.DeleteTunnelByID(ctx, tunnelID); err != nil {
+	if err := s.store.DeleteTunnelByID(ctx, tunnelID); err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "admin.tunnel.delete.failed", tunnelID, err.Error())
 		return
@@ -546,7 +1028,7 @@ func (s *Server) handleAdminRouteByID(w http.ResponseWriter, r *http.Request) {
 
 	// Verify admin authorization
 	if !s.isAdminAuthorized(r) {
-		errorJSON(w, http.StatusUnauthorized, "unauthorized")
+		s.writeAuthError(w, r)
 		s.events.Add("warn", "admin.delete_route.unauthorized", routeID, "unauthorized delete attempt")
 		return
 	}
@@ -554,11 +1036,11 @@ func (s *Server) handleAdminRouteByID(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if _, err := s.supabase.GetRouteByID(ctx, routeID); err != nil {
+	if _, err := s.store.GetRouteByID(ctx, routeID); err != nil {
 		errorJSON(w, http.StatusNotFound, "route not found")
 		return
 	}
-	if err := s.supabase.DeleteRouteByID(ctx, routeID); err != nil {
+	if err := s.store.DeleteRouteByID(ctx, routeID); err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		s.events.Add("error", "admin.route.delete.failed", routeID, err.Error())
 		return
@@ -569,53 +1051,78 @@ func (s *Server) handleAdminRouteByID(w http.ResponseWriter, r *http.Request) {
 
 // isAdminAuthorized checks if request is authorized for admin operations
 func (s *Server) isAdminAuthorized(r *http.Request) bool {
-	if s.adminKey == "" {
-		return false
-	}
-
 	// Try to read admin_key from request body
-	var req struct {
-		AdminKey string `json:"admin_key"`
-	}
-	_ = decodeJSON(r.Body, &req)
-	if strings.TrimSpace(req.AdminKey) == s.adminKey {
-		return true
-	}
-
-	// Try to read admin_key from Authorization header (format: "Bearer {key}")
-	authHeader := r.Header.Get("Authorization")
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		key := strings.TrimPrefix(authHeader, "Bearer ")
-		if strings.TrimSpace(key) == s.adminKey {
+	if s.adminKey != "" {
+		var req struct {
+			AdminKey string `json:"admin_key"`
+		}
+		_ = decodeJSON(r.Body, &req)
+		if strings.TrimSpace(req.AdminKey) == s.adminKey {
 			return true
 		}
 	}
 
-	return false
+	// Then the Authorization header: the admin key or an API key
+	p, ok := s.authenticate(r)
+	return ok && p.Admin
 }
 
 func (s *Server) handleListTunnelRoutes(w http.ResponseWriter, r *http.Request, tunnelID string) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	routes, err := s.supabase.ListRoutesByTunnel(ctx, tunnelID)
+	if !s.checkTunnelAccess(ctx, w, r, tunnelID) {
+		return
+	}
+
+	opts, err := listOptions(r)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.OwnerID, opts.TunnelID = "", tunnelID
+	routes, err := s.store.SearchRoutes(ctx, fetchOptions(opts))
 	if err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"routes": routes})
+	routes, next := pageOf(routes, opts)
+	writeJSON(w, http.StatusOK, listResponse("routes", routes, next))
+}
+
+// checkTunnelAccess answers 404 or 403 and returns false unless the caller
+// may act on tunnelID. Admins skip the lookup.
+func (s *Server) checkTunnelAccess(ctx context.Context, w http.ResponseWriter, r *http.Request, tunnelID string) bool {
+	p := caller(r)
+	if p.Admin {
+		return true
+	}
+	tunnel, err := s.store.GetTunnelByID(ctx, tunnelID)
+	if err != nil {
+		errorJSON(w, http.StatusNotFound, "tunnel not found")
+		return false
+	}
+	if !p.canAccess(tunnel) {
+		errorJSON(w, http.StatusForbidden, "tunnel belongs to another user")
+		return false
+	}
+	return true
 }
 
 func (s *Server) handleTunnelCommand(w http.ResponseWriter, r *http.Request, tunnelID string) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	tunnel, err := s.supabase.GetTunnelByID(ctx, tunnelID)
+	tunnel, err := s.store.GetTunnelByID(ctx, tunnelID)
 	if err != nil {
 		errorJSON(w, http.StatusNotFound, err.Error())
 		s.events.Add("error", "tunnel.command.failed", tunnelID, err.Error())
 		return
 	}
+	if !caller(r).canAccess(tunnel) {
+		errorJSON(w, http.StatusForbidden, "tunnel belongs to another user")
+		return
+	}
 	s.events.Add("info", "tunnel.command.requested", tunnelID, "generated startup command")
 
 	writeJSON(w, http.StatusOK, map[string]any{
@@ -626,13 +1133,22 @@ func (s *Server) handleTunnelCommand(w http.ResponseWriter, r *http.Request, tun
 	})
 }
 
+// agentCredentials reads the tunnel id and token of an agent call. The
+// token is taken from "Authorization: Bearer" first and ?token= otherwise.
+func agentCredentials(r *http.Request) (tunnelID, token string) {
+	tunnelID = strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return tunnelID, strings.TrimSpace(bearer)
+	}
+	return tunnelID, strings.TrimSpace(r.URL.Query().Get("token"))
+}
+
 func (s *Server) handleAgentRoutes(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	tunnelID := strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
-	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	tunnelID, token := agentCredentials(r)
 	if tunnelID == "" || token == "" {
 		errorJSON(w, http.StatusBadRequest, "tunnel_id and token are required")
 		return
@@ -640,29 +1156,67 @@ func (s *Server) handleAgentRoutes(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	if _, err := s.supabase.ValidateTunnelToken(ctx, tunnelID, token); err != nil {
+	if _, err := s.store.ValidateTunnelToken(ctx, tunnelID, token); err != nil {
 		errorJSON(w, http.StatusUnauthorized, "invalid tunnel credentials")
 		s.events.Add("warn", "agent.routes.auth_failed", tunnelID, "invalid tunnel credentials")
 		return
 	}
 
-	routes, err := s.supabase.ListEnabledProtocolRoutesByTunnel(ctx, tunnelID)
+	mapped, version, err := s.agentRoutes(ctx, tunnelID)
 	if err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		return
 	}
+	go s.markTunnelOnline(tunnelID)
+
+	etag := strconv.Quote(version)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.agentRoutesResponse(tunnelID, mapped, version, strings.TrimSpace(r.URL.Query().Get("since"))))
+}
+
+// agentRoutes loads the enabled routes of a tunnel in the form agents apply
+// them and remembers the set so later requests can be answered with a delta.
+func (s *Server) agentRoutes(ctx context.Context, tunnelID string) ([]protocol.Route, string, error) {
+	routes, err := s.store.ListEnabledProtocolRoutesByTunnel(ctx, tunnelID)
+	if err != nil {
+		return nil, "", err
+	}
 	mapped := make([]protocol.Route, 0, len(routes))
+	now := time.Now()
 	for _, item := range routes {
-		mapped = append(mapped, protocol.Route{Hostname: item.Hostname, Target: item.Target})
-	}
-	writeJSON(w, http.StatusOK, AgentRoutesResponse{TunnelID: tunnelID, Routes: mapped})
-	go func() {
-		updateCtx, updateCancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer updateCancel()
-		if err := s.supabase.UpdateTunnelOnline(updateCtx, tunnelID); err != nil {
-			log.Printf("failed to update tunnel status online: %v", err)
+		// The expiry loop deletes these shortly; stop serving them already.
+		if expired(item.ExpiresAt, now) {
+			continue
+		}
+		if routePending(item) || item.gatewayRoute() {
+			continue
+		}
+		mapped = append(mapped, protocol.Route{Hostname: item.Hostname, Target: item.Target, RateLimit: item.RateLimit, Split: item.Split, Timeout: item.Timeout, MaxBodyBytes: item.MaxBodyBytes, IPFilter: item.IPFilter, Auth: item.Auth, Rewrite: item.Rewrite, HeaderRules: item.HeaderRules, ACMEPassthrough: item.ACMEPassthrough, Aliases: item.Aliases, Cache: item.Cache, Mirror: item.Mirror})
+	}
+	mapped = protocol.SortRoutes(mapped)
+	version := protocol.RoutesVersion(mapped)
+	s.routeSnapshots.remember(tunnelID, version, mapped)
+	return mapped, version, nil
+}
+
+func (s *Server) agentRoutesResponse(tunnelID string, mapped []protocol.Route, version, since string) AgentRoutesResponse {
+	if since != "" && since != version {
+		if previous, ok := s.routeSnapshots.lookup(tunnelID, since); ok {
+			added, removed := protocol.DiffRoutes(previous, mapped)
+			return AgentRoutesResponse{
+				TunnelID:    tunnelID,
+				Version:     version,
+				BaseVersion: since,
+				Added:       added,
+				Removed:     removed,
+			}
 		}
-	}()
+	}
+	return AgentRoutesResponse{TunnelID: tunnelID, Version: version, Routes: mapped}
 }
 
 func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
@@ -671,17 +1225,68 @@ func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tunnelID := strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
-	limit := 100
+	if !s.checkTunnelScope(w, r, tunnelID) {
+		return
+	}
+	q := EventQuery{TunnelID: tunnelID, Limit: 100}
 	if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
 		if n, err := strconv.Atoi(raw); err == nil {
-			limit = n
+			q.Limit = n
 		}
 	}
+	var err error
+	if q.Since, q.Until, err = timeRange(r); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	logs, err := s.events.Query(ctx, q)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]any{
-		"logs": s.events.List(tunnelID, limit),
+		"logs": logs,
 	})
 }
 
+// timeRange parses the optional since and until query parameters.
+func timeRange(r *http.Request) (since, until time.Time, err error) {
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		raw := strings.TrimSpace(r.URL.Query().Get(name))
+		if raw == "" {
+			continue
+		}
+		if *dst, err = time.Parse(time.RFC3339, raw); err != nil {
+			return since, until, errors.New(name + " must be an RFC 3339 time such as 2030-01-02T15:04:05Z")
+		}
+	}
+	return since, until, nil
+}
+
+// checkTunnelScope lets users query only a tunnel they own: the events or
+// usage of one tunnel.
+func (s *Server) checkTunnelScope(w http.ResponseWriter, r *http.Request, tunnelID string) bool {
+	if caller(r).Admin {
+		return true
+	}
+	if tunnelID == "" {
+		errorJSON(w, http.StatusForbidden, "tunnel_id is required")
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	return s.checkTunnelAccess(ctx, w, r, tunnelID)
+}
+
+// PersistEvents keeps events in history as well as in memory, so /api/logs
+// can answer beyond the in-memory ring and across restarts. Events older than
+// retention are deleted (0 keeps them). It returns when ctx is done.
+func (s *Server) PersistEvents(ctx context.Context, history EventLog, retention time.Duration) {
+	s.events.Persist(ctx, history, retention)
+}
+
 func (s *Server) agentCommand(tunnelID, token string) string {
 	adminAddr := s.defaultAdminAPI
 	if adminAddr == "" {
@@ -738,7 +1343,9 @@ func randomToken(n int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(buf), nil
 }
 
-func normalizeHostname(hostname string) (string, error) {
+// normalizeHostname validates a route hostname and rejects the reserved
+// ones: localhost, IP literals, and whatever reserved lists.
+func normalizeHostname(hostname string, reserved *protocol.ReservedHostnames) (string, error) {
 	host := strings.TrimSpace(strings.ToLower(hostname))
 	host = strings.TrimSuffix(host, ".")
 	if host == "" {
@@ -753,21 +1360,100 @@ func normalizeHostname(hostname string) (string, error) {
 	if !strings.Contains(host, ".") {
 		return "", errors.New("hostname must be a domain, e.g. app.example.com")
 	}
+	if err := reserved.Check(host); err != nil {
+		return "", err
+	}
 	return host, nil
 }
 
 func normalizeTarget(target string) (string, error) {
-	t := strings.TrimSpace(target)
-	if t == "" {
-		return "", errors.New("target is required")
+	return protocol.NormalizeTarget(target)
+}
+
+// parseRateLimit decodes a route's rate_limit field; JSON null clears it.
+func parseRateLimit(raw json.RawMessage) (*protocol.RateLimit, error) {
+	var limit *protocol.RateLimit
+	if err := json.Unmarshal(raw, &limit); err != nil {
+		return nil, errors.New("rate_limit must be an object like {\"rps\": 10, \"burst\": 20}")
 	}
-	if strings.HasPrefix(t, "http://") || strings.HasPrefix(t, "https://") {
-		return "", errors.New("target should be host:port, e.g. 127.0.0.1:3000")
+	if limit == nil {
+		return nil, nil
 	}
-	if !strings.Contains(t, ":") {
-		return "", errors.New("target must include port, e.g. 127.0.0.1:3000")
+	if limit.RPS <= 0 {
+		return nil, errors.New("rate_limit.rps must be positive")
 	}
-	return t, nil
+	if limit.Burst < 0 {
+		return nil, errors.New("rate_limit.burst cannot be negative")
+	}
+	return limit, nil
+}
+
+// mergeRouteLimits applies the timeout and body cap given in a PATCH to the
+// route's current ones; nil leaves a value as it is.
+func mergeRouteLimits(route Route, timeout *string, maxBodyBytes *int64) (string, int64, error) {
+	if timeout != nil {
+		route.Timeout = *timeout
+	}
+	if maxBodyBytes != nil {
+		route.MaxBodyBytes = *maxBodyBytes
+	}
+	normalized, err := protocol.NormalizeRouteLimits(route.Timeout, route.MaxBodyBytes)
+	return normalized, route.MaxBodyBytes, err
+}
+
+// parseIPFilter decodes a route's ip_filter field; JSON null clears it.
+func parseIPFilter(raw json.RawMessage) (*protocol.IPFilter, error) {
+	var filter *protocol.IPFilter
+	if err := json.Unmarshal(raw, &filter); err != nil {
+		return nil, errors.New("ip_filter must be an object like {\"allow\": [\"10.0.0.0/8\"], \"deny\": [\"10.0.0.9\"]}")
+	}
+	return protocol.NormalizeIPFilter(filter)
+}
+
+// parseRewrite decodes a route's rewrite field; JSON null clears it.
+func parseRewrite(raw json.RawMessage) (*protocol.Rewrite, error) {
+	var rewrite *protocol.Rewrite
+	if err := json.Unmarshal(raw, &rewrite); err != nil {
+		return nil, errors.New("rewrite must be an object like {\"strip_prefix\": \"/app\", \"host\": \"target\"}")
+	}
+	return protocol.NormalizeRewrite(rewrite)
+}
+
+// parseHeaderRules decodes a route's header_rules field; JSON null clears
+// them.
+func parseHeaderRules(raw json.RawMessage) (*protocol.HeaderRules, error) {
+	var rules *protocol.HeaderRules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, errors.New("header_rules must be an object like {\"request\": {\"set\": {\"X-Env\": \"preview\"}}, \"response\": {\"remove\": [\"Server\"]}}")
+	}
+	return protocol.NormalizeHeaderRules(rules)
+}
+
+// parseCache decodes a route's cache field; JSON null clears it.
+func parseCache(raw json.RawMessage) (*protocol.Cache, error) {
+	var cache *protocol.Cache
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return nil, errors.New("cache must be an object like {\"default_ttl\": \"5m\", \"max_ttl\": \"1h\", \"max_entry_bytes\": 1048576}")
+	}
+	return protocol.NormalizeCache(cache)
+}
+
+// parseMirror decodes a route's mirror field; JSON null clears it.
+func parseMirror(raw json.RawMessage) (*protocol.Mirror, error) {
+	var mirror *protocol.Mirror
+	if err := json.Unmarshal(raw, &mirror); err != nil {
+		return nil, errors.New("mirror must be an object like {\"target\": \"127.0.0.1:3001\", \"percent\": 10}")
+	}
+	return protocol.NormalizeMirror(mirror)
+}
+
+// parseSplit decodes a route's split field; JSON null clears it.
+func parseSplit(raw json.RawMessage) (*protocol.Split, error) {
+	var split *protocol.Split
+	if err := json.Unmarshal(raw, &split); err != nil {
+		return nil, errors.New("split must be an object like {\"target\": \"127.0.0.1:3001\", \"weight\": 10}")
+	}
+	return protocol.NormalizeSplit(split)
 }
 
 func normalizeBaseDomain(baseDomain string) (string, error) {
@@ -834,7 +1520,7 @@ func isRouteConflictError(err error) bool {
 		return false
 	}
 	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "status=409") || strings.Contains(msg, "duplicate key")
+	return errors.Is(err, errHostnameIsAlias) || strings.Contains(msg, "status=409") || strings.Contains(msg, "duplicate key")
 }
 
 // corsMiddleware adds CORS headers to all responses so the browser-based portal
@@ -875,7 +1561,7 @@ func (s *Server) handlePortalLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	tunnel, err := s.supabase.GetTunnelByID(ctx, req.TunnelID)
+	tunnel, err := s.store.GetTunnelByID(ctx, req.TunnelID)
 	if err != nil {
 		errorJSON(w, http.StatusNotFound, "tunnel not found")
 		return
@@ -911,11 +1597,11 @@ func (s *Server) handlePortalListRoutes(w http.ResponseWriter, r *http.Request)
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 	// Verify tunnel exists
-	if _, err := s.supabase.GetTunnelByID(ctx, tunnelID); err != nil {
+	if _, err := s.store.GetTunnelByID(ctx, tunnelID); err != nil {
 		errorJSON(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
-	routes, err := s.supabase.ListRoutesByTunnel(ctx, tunnelID)
+	routes, err := s.store.ListRoutesByTunnel(ctx, tunnelID)
 	if err != nil {
 		errorJSON(w, http.StatusBadGateway, err.Error())
 		return
@@ -938,6 +1624,22 @@ func (s *Server) handlePortalRouteByID(w http.ResponseWriter, r *http.Request) {
 		Token    string `json:"token"`
 		Hostname string `json:"hostname"`
 		Enabled  *bool  `json:"is_enabled,omitempty"`
+		// RateLimit is a limit object to set, or null to clear it.
+		RateLimit json.RawMessage `json:"rate_limit,omitempty"`
+		// Split is a split object to set, or null to clear it.
+		Split json.RawMessage `json:"split,omitempty"`
+		// Timeout "" and MaxBodyBytes 0 go back to the gateway defaults.
+		Timeout      *string `json:"timeout,omitempty"`
+		MaxBodyBytes *int64  `json:"max_body_bytes,omitempty"`
+		// IPFilter is an allow/deny object to set, or null to clear it.
+		IPFilter json.RawMessage `json:"ip_filter,omitempty"`
+		// Auth is an auth object to set, or null to clear it.
+		Auth json.RawMessage `json:"auth,omitempty"`
+		// Rewrite is a rewrite object to set, or null to clear it.
+		Rewrite json.RawMessage `json:"rewrite,omitempty"`
+		// HeaderRules is a header rules object to set, or null to clear it.
+		HeaderRules     json.RawMessage `json:"header_rules,omitempty"`
+		ACMEPassthrough *bool           `json:"acme_passthrough,omitempty"`
 	}
 	if err := decodeJSON(r.Body, &req); err != nil {
 		errorJSON(w, http.StatusBadRequest, "invalid json")
@@ -949,11 +1651,11 @@ func (s *Server) handlePortalRouteByID(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if _, err := s.supabase.ValidateTunnelToken(ctx, req.TunnelID, req.Token); err != nil {
+	if _, err := s.store.ValidateTunnelToken(ctx, req.TunnelID, req.Token); err != nil {
 		errorJSON(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
-	existing, err := s.supabase.GetRouteByID(ctx, routeID)
+	existing, err := s.store.GetRouteByID(ctx, routeID)
 	if err != nil {
 		errorJSON(w, http.StatusNotFound, "route not found")
 		return
@@ -965,20 +1667,30 @@ func (s *Server) handlePortalRouteByID(w http.ResponseWriter, r *http.Request) {
 
 	// Handle hostname update
 	if strings.TrimSpace(req.Hostname) != "" {
-		hostname, err := normalizeHostname(req.Hostname)
+		hostname, err := normalizeHostname(req.Hostname, s.reserved)
 		if err != nil {
 			errorJSON(w, http.StatusBadRequest, err.Error())
 			return
 		}
 		if hostname != existing.Hostname {
-			if _, checkErr := s.supabase.GetRouteByHostname(ctx, hostname); checkErr == nil {
+			if err := s.checkHostnameLength(hostname); err != nil {
+				s.writeQuotaError(w, err, req.TunnelID)
+				return
+			}
+			if _, checkErr := s.store.GetRouteByHostname(ctx, hostname); checkErr == nil {
 				errorJSON(w, http.StatusConflict, "hostname is already in use by another tunnel")
 				return
 			} else if !errors.Is(checkErr, ErrNotFound) {
 				errorJSON(w, http.StatusBadGateway, checkErr.Error())
 				return
 			}
-			updated, err := s.supabase.UpdateRouteHostname(ctx, routeID, hostname)
+			updated, err := s.store.UpdateRouteHostname(ctx, routeID, hostname)
+			if err == nil {
+				var v Route
+				if v, err = s.withVerification(updated); err == nil {
+					updated, err = s.store.SetRouteVerification(ctx, routeID, v.Verification, v.VerifyToken)
+				}
+			}
 			if err != nil {
 				errorJSON(w, http.StatusBadGateway, err.Error())
 				return
@@ -989,18 +1701,53 @@ func (s *Server) handlePortalRouteByID(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Handle enabled toggle (no hostname change)
-	if req.Enabled != nil {
-		updated, err := s.supabase.UpdateRoute(ctx, routeID, existing.Target, *req.Enabled)
-		if err != nil {
-			errorJSON(w, http.StatusBadGateway, err.Error())
+	patch, status, err := s.routePatch(ctx, existing, patchRouteRequest{
+		Enabled:         req.Enabled,
+		Split:           req.Split,
+		Timeout:         req.Timeout,
+		MaxBodyBytes:    req.MaxBodyBytes,
+		IPFilter:        req.IPFilter,
+		Auth:            req.Auth,
+		Rewrite:         req.Rewrite,
+		HeaderRules:     req.HeaderRules,
+		ACMEPassthrough: req.ACMEPassthrough,
+	})
+	if err != nil {
+		errorJSON(w, status, err.Error())
+		return
+	}
+	if len(req.RateLimit) > 0 {
+		if patch.Route.RateLimit, err = parseRateLimit(req.RateLimit); err != nil {
+			errorJSON(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, map[string]any{"route": updated})
+		patch.Fields |= RouteRateLimit
+	}
+	updated, err := s.store.UpdateRoute(ctx, routeID, patch)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
 		return
 	}
-
-	writeJSON(w, http.StatusOK, map[string]any{"route": existing})
+	for _, change := range []struct {
+		field RouteFields
+		event string
+	}{
+		{RouteRateLimit, "route.rate_limit.updated"},
+		{RouteSplit, "route.split.updated"},
+		{RouteIPFilter, "route.ip_filter.updated"},
+		{RouteAuth, "route.auth.updated"},
+		{RouteRewrite, "route.rewrite.updated"},
+		{RouteHeaderRules, "route.header_rules.updated"},
+		{RouteACMEPassthrough, "route.acme_passthrough.updated"},
+	} {
+		if patch.has(change.field) {
+			s.events.Add("info", change.event, req.TunnelID, existing.Hostname)
+		}
+	}
+	if patch.has(RouteLimits) {
+		s.events.Add("info", "route.limits.updated", req.TunnelID, fmt.Sprintf("%s timeout=%q max_body_bytes=%d", existing.Hostname, updated.Timeout, updated.MaxBodyBytes))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"route": updated})
 }
 
 // handlePortalAddRoute adds a new route to an existing tunnel (for multi-project support).
@@ -1041,7 +1788,7 @@ func (s *Server) handlePortalAddRoute(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
 	defer cancel()
-	if _, err := s.supabase.ValidateTunnelToken(ctx, req.TunnelID, req.Token); err != nil {
+	if _, err := s.store.ValidateTunnelToken(ctx, req.TunnelID, req.Token); err != nil {
 		errorJSON(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
@@ -1054,8 +1801,12 @@ func (s *Server) handlePortalAddRoute(w http.ResponseWriter, r *http.Request) {
 		label = "app"
 	}
 
-	hostname := fmt.Sprintf("%s.%s", label, baseDomain)
-	existingRoute, err := s.supabase.GetRouteByHostname(ctx, hostname)
+	hostname, err := normalizeHostname(label+"."+baseDomain, s.reserved)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	existingRoute, err := s.store.GetRouteByHostname(ctx, hostname)
 	var route Route
 	var createErr error
 	if err == nil {
@@ -1063,9 +1814,13 @@ func (s *Server) handlePortalAddRoute(w http.ResponseWriter, r *http.Request) {
 			errorJSON(w, http.StatusConflict, "hostname is already in use by another tunnel")
 			return
 		}
-		route, createErr = s.supabase.UpdateRouteBinding(ctx, existingRoute.ID, req.TunnelID, target, enabled)
+		route, createErr = s.store.UpdateRouteBinding(ctx, existingRoute.ID, req.TunnelID, target, enabled)
 	} else if errors.Is(err, ErrNotFound) {
-		route, createErr = s.supabase.CreateRoute(ctx, Route{
+		if err := s.checkRouteQuota(ctx, req.TunnelID, hostname); err != nil {
+			s.writeQuotaError(w, err, req.TunnelID)
+			return
+		}
+		route, createErr = s.createRoute(ctx, Route{
 			TunnelID: req.TunnelID,
 			Hostname: hostname,
 			Target:   target,
@@ -1109,7 +1864,7 @@ func mustWSURL(baseURL string) string {
 	}
 	u, err := url.Parse(baseURL)
 	if err != nil {
-		log.Printf("invalid url: %v", err)
+		slog.Warn("invalid url", "err", err)
 		return ""
 	}
 	if u.Scheme == "https" {
@@ -1129,7 +1884,7 @@ func mustHTTPURL(baseURL, path string) string {
 	}
 	u, err := url.Parse(baseURL)
 	if err != nil {
-		log.Printf("invalid url: %v", err)
+		slog.Warn("invalid url", "err", err)
 		return ""
 	}
 	switch u.Scheme {
@@ -1157,7 +1912,7 @@ func publicURLScheme(baseURL string) string {
 	}
 	u, err := url.Parse(baseURL)
 	if err != nil {
-		log.Printf("invalid url: %v", err)
+		slog.Warn("invalid url", "err", err)
 		return ""
 	}
 	switch u.Scheme {
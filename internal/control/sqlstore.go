@@ -0,0 +1,920 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// SQLStore implements Store on database/sql. The caller registers the driver
+// (e.g. modernc.org/sqlite as "sqlite", github.com/lib/pq as "postgres");
+// tables are created on open with the same names and columns as the
+// Supabase schema.
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+const (
+	// The schema only uses types both SQLite and Postgres accept; timestamps
+	// are RFC 3339 text so they sort and scan the same on either.
+	schema = `
+CREATE TABLE IF NOT EXISTS tunnel_instances (
+    id           TEXT PRIMARY KEY,
+    owner_id     TEXT,
+    project_key  TEXT,
+    name         TEXT NOT NULL,
+    token_hash   TEXT NOT NULL,
+    client_ip    TEXT,
+    os_type      TEXT,
+    metadata     TEXT,
+    expires_at   TEXT,
+    idle_since   TEXT,
+    agent        TEXT,
+    status       TEXT NOT NULL DEFAULT 'offline',
+    last_seen_at TEXT,
+    created_at   TEXT NOT NULL,
+    updated_at   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_tunnel_instances_owner ON tunnel_instances(owner_id, project_key);
+CREATE TABLE IF NOT EXISTS tunnel_routes (
+    id         TEXT PRIMARY KEY,
+    tunnel_id  TEXT NOT NULL REFERENCES tunnel_instances(id) ON DELETE CASCADE,
+    hostname   TEXT NOT NULL UNIQUE,
+    target     TEXT NOT NULL,
+    is_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    rate_limit TEXT,
+    split      TEXT,
+    timeout    TEXT,
+    max_body_bytes BIGINT,
+    ip_filter  TEXT,
+    auth       TEXT,
+    rewrite    TEXT,
+    header_rules TEXT,
+    acme_passthrough BOOLEAN NOT NULL DEFAULT FALSE,
+    redirect   TEXT,
+    static_response TEXT,
+    aliases    TEXT,
+    maintenance TEXT,
+    cache      TEXT,
+    mirror     TEXT,
+    expires_at TEXT,
+    verification TEXT,
+    verify_token TEXT,
+    dns_status TEXT,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_tunnel_routes_tunnel_id ON tunnel_routes(tunnel_id);
+CREATE TABLE IF NOT EXISTS tunnel_events (
+    id         BIGINT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    level      TEXT NOT NULL,
+    event      TEXT NOT NULL,
+    tunnel_id  TEXT,
+    message    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_tunnel_events_created_at ON tunnel_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_tunnel_events_tunnel_id ON tunnel_events(tunnel_id, created_at);
+CREATE TABLE IF NOT EXISTS tunnel_usage (
+    tunnel_id  TEXT NOT NULL,
+    hostname   TEXT NOT NULL,
+    hour_start TEXT NOT NULL,
+    requests   BIGINT NOT NULL DEFAULT 0,
+    bytes_in   BIGINT NOT NULL DEFAULT 0,
+    bytes_out  BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (tunnel_id, hostname, hour_start)
+);
+CREATE INDEX IF NOT EXISTS idx_tunnel_usage_hour_start ON tunnel_usage(hour_start);
+`
+	tunnelColumns = "id, name, token_hash, COALESCE(owner_id, ''), COALESCE(project_key, ''), COALESCE(client_ip, ''), COALESCE(os_type, ''), COALESCE(metadata, ''), status, COALESCE(last_seen_at, ''), COALESCE(expires_at, ''), COALESCE(idle_since, ''), COALESCE(agent, ''), created_at, updated_at"
+	routeColumns  = "id, tunnel_id, hostname, target, is_enabled, COALESCE(rate_limit, ''), COALESCE(split, ''), COALESCE(timeout, ''), COALESCE(max_body_bytes, 0), COALESCE(ip_filter, ''), COALESCE(auth, ''), COALESCE(rewrite, ''), COALESCE(header_rules, ''), acme_passthrough, COALESCE(redirect, ''), COALESCE(static_response, ''), COALESCE(aliases, ''), COALESCE(maintenance, ''), COALESCE(cache, ''), COALESCE(mirror, ''), COALESCE(expires_at, ''), COALESCE(verification, ''), COALESCE(verify_token, ''), COALESCE(dns_status, ''), created_at, updated_at"
+)
+
+// migrations bring databases created by older versions up to schema. Each
+// statement is additive; "already exists" failures are expected and ignored.
+var migrations = []string{
+	"ALTER TABLE tunnel_routes ADD COLUMN rate_limit TEXT",
+	"ALTER TABLE tunnel_instances ADD COLUMN expires_at TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN expires_at TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN verification TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN verify_token TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN dns_status TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN split TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN timeout TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN max_body_bytes BIGINT",
+	"ALTER TABLE tunnel_routes ADD COLUMN ip_filter TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN auth TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN rewrite TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN header_rules TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN acme_passthrough BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE tunnel_routes ADD COLUMN redirect TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN static_response TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN aliases TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN maintenance TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN cache TEXT",
+	"ALTER TABLE tunnel_routes ADD COLUMN mirror TEXT",
+	"ALTER TABLE tunnel_instances ADD COLUMN idle_since TEXT",
+	"ALTER TABLE tunnel_instances ADD COLUMN agent TEXT",
+}
+
+// OpenSQLStore opens driver/dsn and creates the tables if needed. driver is
+// "sqlite" or "postgres".
+func OpenSQLStore(driver, dsn string) (*SQLStore, error) {
+	if strings.TrimSpace(dsn) == "" {
+		return nil, errors.New("store dsn is required")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := &SQLStore{db: db, postgres: driver == "postgres"}
+	if !store.postgres {
+		// SQLite only enforces ON DELETE CASCADE with foreign keys enabled,
+		// which is a per-connection setting.
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("enable foreign keys: %w", err)
+		}
+	}
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil && !isDuplicateColumn(err) {
+			_ = db.Close()
+			return nil, fmt.Errorf("migrate schema: %w", err)
+		}
+	}
+	return store, nil
+}
+
+func isDuplicateColumn(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate column") || strings.Contains(msg, "already exists")
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind turns ? placeholders into $n for Postgres.
+func (s *SQLStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
+
+func (s *SQLStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) ListTunnels(ctx context.Context) ([]Tunnel, error) {
+	return s.listTunnels(ctx, "SELECT "+tunnelColumns+" FROM tunnel_instances ORDER BY created_at DESC")
+}
+
+func (s *SQLStore) SearchTunnels(ctx context.Context, opts ListOptions) ([]Tunnel, error) {
+	var where []string
+	var args []any
+	if opts.OwnerID != "" {
+		where = append(where, "owner_id = ?")
+		args = append(args, opts.OwnerID)
+	}
+	if opts.Query != "" {
+		like := likePattern(opts.Query)
+		where = append(where, `(LOWER(name) LIKE ? ESCAPE '\' OR id IN (SELECT tunnel_id FROM tunnel_routes WHERE hostname LIKE ? ESCAPE '\'))`)
+		args = append(args, like, like)
+	}
+	if !opts.ExpiredBy.IsZero() {
+		where = append(where, "expires_at <= ?")
+		args = append(args, formatStoredTime(opts.ExpiredBy))
+	}
+	query := "SELECT " + tunnelColumns + " FROM tunnel_instances" + whereClause(where) + " ORDER BY created_at DESC, id DESC"
+	paging, pageArgs := s.pageClause(opts)
+	return s.listTunnels(ctx, query+paging, append(args, pageArgs...)...)
+}
+
+func (s *SQLStore) listTunnels(ctx context.Context, query string, args ...any) ([]Tunnel, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Tunnel
+	for rows.Next() {
+		t, err := scanTunnel(rows)
+		if err != nil {
+			return nil, err
+		}
+		t.Token = ""
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLStore) CreateTunnel(ctx context.Context, name, token string) (Tunnel, error) {
+	return s.CreateTunnelWithMeta(ctx, name, token, "", "", "", "", nil)
+}
+
+func (s *SQLStore) CreateTunnelWithMeta(ctx context.Context, name, token, ownerID, projectKey, clientIP, osType string, metadata map[string]any) (Tunnel, error) {
+	id, err := newRowID()
+	if err != nil {
+		return Tunnel{}, err
+	}
+	var meta any
+	if len(metadata) > 0 {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return Tunnel{}, fmt.Errorf("marshal metadata: %w", err)
+		}
+		meta = string(data)
+	}
+	now := sqlNow()
+	_, err = s.exec(ctx, `INSERT INTO tunnel_instances
+		(id, owner_id, project_key, name, token_hash, client_ip, os_type, metadata, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'offline', ?, ?)`,
+		id, nullIfEmpty(ownerID), nullIfEmpty(projectKey), name, token, nullIfEmpty(clientIP), nullIfEmpty(osType), meta, now, now)
+	if err != nil {
+		return Tunnel{}, err
+	}
+	return s.GetTunnelByID(ctx, id)
+}
+
+func (s *SQLStore) GetTunnelByID(ctx context.Context, id string) (Tunnel, error) {
+	t, err := scanTunnel(s.queryRow(ctx, "SELECT "+tunnelColumns+" FROM tunnel_instances WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tunnel{}, errors.New("tunnel not found")
+	}
+	return t, err
+}
+
+func (s *SQLStore) GetTunnelByOwnerAndProject(ctx context.Context, ownerID, projectKey string) (Tunnel, error) {
+	t, err := scanTunnel(s.queryRow(ctx, "SELECT "+tunnelColumns+" FROM tunnel_instances WHERE owner_id = ? AND project_key = ? LIMIT 1", ownerID, projectKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tunnel{}, ErrNotFound
+	}
+	return t, err
+}
+
+func (s *SQLStore) ValidateTunnelToken(ctx context.Context, tunnelID, token string) (Tunnel, error) {
+	t, err := scanTunnel(s.queryRow(ctx, "SELECT "+tunnelColumns+" FROM tunnel_instances WHERE id = ? AND token_hash = ?", tunnelID, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tunnel{}, ErrInvalidTunnelToken
+	}
+	return t, err
+}
+
+func (s *SQLStore) UpdateTunnelOnline(ctx context.Context, tunnelID string) error {
+	return s.updateTunnelStatus(ctx, tunnelID, "online")
+}
+
+func (s *SQLStore) UpdateTunnelOffline(ctx context.Context, tunnelID string) error {
+	return s.updateTunnelStatus(ctx, tunnelID, "offline")
+}
+
+func (s *SQLStore) updateTunnelStatus(ctx context.Context, tunnelID, status string) error {
+	now := sqlNow()
+	_, err := s.exec(ctx, "UPDATE tunnel_instances SET status = ?, last_seen_at = ?, updated_at = ? WHERE id = ?", status, now, now, tunnelID)
+	return err
+}
+
+func (s *SQLStore) DeleteTunnelByID(ctx context.Context, tunnelID string) error {
+	_, err := s.exec(ctx, "DELETE FROM tunnel_instances WHERE id = ?", tunnelID)
+	return err
+}
+
+func (s *SQLStore) DeleteAllTunnels(ctx context.Context) error {
+	_, err := s.exec(ctx, "DELETE FROM tunnel_instances")
+	return err
+}
+
+func (s *SQLStore) SetTunnelExpiry(ctx context.Context, tunnelID, expiresAt string) error {
+	res, err := s.exec(ctx, "UPDATE tunnel_instances SET expires_at = ?, updated_at = ? WHERE id = ?", nullIfEmpty(expiresAt), sqlNow(), tunnelID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetTunnelIdle(ctx context.Context, tunnelID, idleSince string) error {
+	res, err := s.exec(ctx, "UPDATE tunnel_instances SET idle_since = ?, updated_at = ? WHERE id = ?", nullIfEmpty(idleSince), sqlNow(), tunnelID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetTunnelAgent(ctx context.Context, tunnelID string, agent *protocol.AgentMeta) error {
+	encoded, err := encodeJSONColumn(agent)
+	if err != nil {
+		return err
+	}
+	res, err := s.exec(ctx, "UPDATE tunnel_instances SET agent = ?, updated_at = ? WHERE id = ?", encoded, sqlNow(), tunnelID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateRoute(ctx context.Context, route Route) (Route, error) {
+	id, err := newRowID()
+	if err != nil {
+		return Route{}, err
+	}
+	now := sqlNow()
+	rateLimit, err := encodeJSONColumn(route.RateLimit)
+	if err != nil {
+		return Route{}, err
+	}
+	split, err := encodeJSONColumn(route.Split)
+	if err != nil {
+		return Route{}, err
+	}
+	ipFilter, err := encodeJSONColumn(route.IPFilter)
+	if err != nil {
+		return Route{}, err
+	}
+	auth, err := encodeJSONColumn(route.Auth)
+	if err != nil {
+		return Route{}, err
+	}
+	rewrite, err := encodeJSONColumn(route.Rewrite)
+	if err != nil {
+		return Route{}, err
+	}
+	headerRules, err := encodeJSONColumn(route.HeaderRules)
+	if err != nil {
+		return Route{}, err
+	}
+	redirect, err := encodeJSONColumn(route.Redirect)
+	if err != nil {
+		return Route{}, err
+	}
+	static, err := encodeJSONColumn(route.Static)
+	if err != nil {
+		return Route{}, err
+	}
+	aliases, err := encodeAliases(route.Aliases)
+	if err != nil {
+		return Route{}, err
+	}
+	maintenance, err := encodeJSONColumn(route.Maintenance)
+	if err != nil {
+		return Route{}, err
+	}
+	cache, err := encodeJSONColumn(route.Cache)
+	if err != nil {
+		return Route{}, err
+	}
+	mirror, err := encodeJSONColumn(route.Mirror)
+	if err != nil {
+		return Route{}, err
+	}
+	_, err = s.exec(ctx, "INSERT INTO tunnel_routes (id, tunnel_id, hostname, target, is_enabled, rate_limit, split, timeout, max_body_bytes, ip_filter, auth, rewrite, header_rules, acme_passthrough, redirect, static_response, aliases, maintenance, cache, mirror, expires_at, verification, verify_token, dns_status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		id, route.TunnelID, route.Hostname, route.Target, route.Enabled, rateLimit, split, nullIfEmpty(route.Timeout), nullIfZero(route.MaxBodyBytes), ipFilter, auth, rewrite, headerRules, route.ACMEPassthrough, redirect, static, aliases, maintenance, cache, mirror, nullIfEmpty(route.ExpiresAt), nullIfEmpty(route.Verification), nullIfEmpty(route.VerifyToken), nullIfEmpty(route.DNSStatus), now, now)
+	if err != nil {
+		return Route{}, err
+	}
+	return s.GetRouteByID(ctx, id)
+}
+
+func (s *SQLStore) UpdateRoute(ctx context.Context, routeID string, patch RoutePatch) (Route, error) {
+	columns, args, err := routePatchColumns(patch)
+	if err != nil {
+		return Route{}, err
+	}
+	columns = append(columns, "updated_at = ?")
+	args = append(args, sqlNow(), routeID)
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET "+strings.Join(columns, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+// routePatchColumns returns the SET assignments and their arguments for the
+// settings patch changes.
+func routePatchColumns(patch RoutePatch) ([]string, []any, error) {
+	p := patch.Route
+	columns := []struct {
+		field RouteFields
+		name  string
+		value func() (any, error)
+	}{
+		{RouteTarget, "target", func() (any, error) { return p.Target, nil }},
+		{RouteEnabled, "is_enabled", func() (any, error) { return p.Enabled, nil }},
+		{RouteExpiry, "expires_at", func() (any, error) { return nullIfEmpty(p.ExpiresAt), nil }},
+		{RouteRateLimit, "rate_limit", func() (any, error) { return encodeJSONColumn(p.RateLimit) }},
+		{RouteSplit, "split", func() (any, error) { return encodeJSONColumn(p.Split) }},
+		{RouteLimits, "timeout", func() (any, error) { return nullIfEmpty(p.Timeout), nil }},
+		{RouteLimits, "max_body_bytes", func() (any, error) { return nullIfZero(p.MaxBodyBytes), nil }},
+		{RouteIPFilter, "ip_filter", func() (any, error) { return encodeJSONColumn(p.IPFilter) }},
+		{RouteAuth, "auth", func() (any, error) { return encodeJSONColumn(p.Auth) }},
+		{RouteRewrite, "rewrite", func() (any, error) { return encodeJSONColumn(p.Rewrite) }},
+		{RouteHeaderRules, "header_rules", func() (any, error) { return encodeJSONColumn(p.HeaderRules) }},
+		{RouteACMEPassthrough, "acme_passthrough", func() (any, error) { return p.ACMEPassthrough, nil }},
+		{RouteType, "redirect", func() (any, error) { return encodeJSONColumn(p.Redirect) }},
+		{RouteType, "static_response", func() (any, error) { return encodeJSONColumn(p.Static) }},
+		{RouteAliases, "aliases", func() (any, error) { return encodeAliases(p.Aliases) }},
+		{RouteCache, "cache", func() (any, error) { return encodeJSONColumn(p.Cache) }},
+		{RouteMirror, "mirror", func() (any, error) { return encodeJSONColumn(p.Mirror) }},
+	}
+	var (
+		sets []string
+		args []any
+	)
+	for _, c := range columns {
+		if !patch.has(c.field) {
+			continue
+		}
+		value, err := c.value()
+		if err != nil {
+			return nil, nil, err
+		}
+		sets = append(sets, c.name+" = ?")
+		args = append(args, value)
+	}
+	return sets, args, nil
+}
+
+func (s *SQLStore) UpdateRouteBinding(ctx context.Context, routeID string, tunnelID string, target string, enabled bool) (Route, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if tunnelID = strings.TrimSpace(tunnelID); tunnelID != "" {
+		res, err = s.exec(ctx, "UPDATE tunnel_routes SET tunnel_id = ?, target = ?, is_enabled = ?, updated_at = ? WHERE id = ?", tunnelID, target, enabled, sqlNow(), routeID)
+	} else {
+		res, err = s.exec(ctx, "UPDATE tunnel_routes SET target = ?, is_enabled = ?, updated_at = ? WHERE id = ?", target, enabled, sqlNow(), routeID)
+	}
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+func (s *SQLStore) UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error) {
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET hostname = ?, updated_at = ? WHERE id = ?", hostname, sqlNow(), routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+func (s *SQLStore) SetRouteExpiry(ctx context.Context, routeID, expiresAt string) (Route, error) {
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET expires_at = ?, updated_at = ? WHERE id = ?", nullIfEmpty(expiresAt), sqlNow(), routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+func (s *SQLStore) SetRouteVerification(ctx context.Context, routeID, status, token string) (Route, error) {
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET verification = ?, verify_token = ?, updated_at = ? WHERE id = ?", nullIfEmpty(status), nullIfEmpty(token), sqlNow(), routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+func (s *SQLStore) SetRouteDNSStatus(ctx context.Context, routeID, status string) (Route, error) {
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET dns_status = ?, updated_at = ? WHERE id = ?", nullIfEmpty(status), sqlNow(), routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+func (s *SQLStore) GetRouteByID(ctx context.Context, routeID string) (Route, error) {
+	r, err := scanRoute(s.queryRow(ctx, "SELECT "+routeColumns+" FROM tunnel_routes WHERE id = ?", routeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Route{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *SQLStore) GetRouteByHostname(ctx context.Context, hostname string) (Route, error) {
+	r, err := scanRoute(s.queryRow(ctx, "SELECT "+routeColumns+" FROM tunnel_routes WHERE hostname = ?", hostname))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Route{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *SQLStore) ListRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
+	return s.listRoutes(ctx, "SELECT "+routeColumns+" FROM tunnel_routes WHERE tunnel_id = ? ORDER BY hostname", tunnelID)
+}
+
+func (s *SQLStore) ListEnabledProtocolRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
+	return s.listRoutes(ctx, "SELECT "+routeColumns+" FROM tunnel_routes WHERE tunnel_id = ? AND is_enabled = ? ORDER BY hostname", tunnelID, true)
+}
+
+func (s *SQLStore) SearchRoutes(ctx context.Context, opts ListOptions) ([]Route, error) {
+	var where []string
+	var args []any
+	if opts.TunnelID != "" {
+		where = append(where, "tunnel_id = ?")
+		args = append(args, opts.TunnelID)
+	}
+	if opts.OwnerID != "" {
+		where = append(where, "tunnel_id IN (SELECT id FROM tunnel_instances WHERE owner_id = ?)")
+		args = append(args, opts.OwnerID)
+	}
+	if opts.Query != "" {
+		where = append(where, `hostname LIKE ? ESCAPE '\'`)
+		args = append(args, likePattern(opts.Query))
+	}
+	if !opts.ExpiredBy.IsZero() {
+		where = append(where, "expires_at <= ?")
+		args = append(args, formatStoredTime(opts.ExpiredBy))
+	}
+	if opts.GatewayOnly {
+		where = append(where, "(redirect IS NOT NULL OR static_response IS NOT NULL OR maintenance IS NOT NULL OR acme_passthrough)")
+	}
+	query := "SELECT " + routeColumns + " FROM tunnel_routes" + whereClause(where) + " ORDER BY hostname"
+	paging, pageArgs := s.pageClause(opts)
+	return s.listRoutes(ctx, query+paging, append(args, pageArgs...)...)
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// likePattern matches q as a lower-case substring, with LIKE wildcards in q
+// taken literally.
+func likePattern(q string) string {
+	q = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q))
+	return "%" + q + "%"
+}
+
+// pageClause renders LIMIT and OFFSET; SQLite only takes an OFFSET after a
+// LIMIT, where -1 means none.
+func (s *SQLStore) pageClause(opts ListOptions) (string, []any) {
+	switch {
+	case opts.Limit > 0:
+		return " LIMIT ? OFFSET ?", []any{opts.Limit, max(opts.Offset, 0)}
+	case opts.Offset > 0 && s.postgres:
+		return " OFFSET ?", []any{opts.Offset}
+	case opts.Offset > 0:
+		return " LIMIT -1 OFFSET ?", []any{opts.Offset}
+	}
+	return "", nil
+}
+
+func (s *SQLStore) DeleteRouteByID(ctx context.Context, routeID string) error {
+	_, err := s.exec(ctx, "DELETE FROM tunnel_routes WHERE id = ?", routeID)
+	return err
+}
+
+func (s *SQLStore) listRoutes(ctx context.Context, query string, args ...any) ([]Route, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLStore) AppendEvents(ctx context.Context, entries []LogEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, s.rebind("INSERT INTO tunnel_events (id, created_at, level, event, tunnel_id, message) VALUES (?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.ID, e.Time, e.Level, e.Event, nullIfEmpty(e.TunnelID), e.Message); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) QueryEvents(ctx context.Context, q EventQuery) ([]LogEntry, error) {
+	var where []string
+	var args []any
+	if q.TunnelID != "" {
+		where = append(where, "tunnel_id = ?")
+		args = append(args, q.TunnelID)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, formatStoredTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, formatStoredTime(q.Until))
+	}
+	query := "SELECT id, created_at, level, event, COALESCE(tunnel_id, ''), message FROM tunnel_events" + whereClause(where) + " ORDER BY id DESC"
+	paging, pageArgs := s.pageClause(ListOptions{Limit: q.Limit})
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+paging), append(args, pageArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Level, &e.Event, &e.TunnelID, &e.Message); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLStore) PruneEvents(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM tunnel_events WHERE created_at < ?", formatStoredTime(before))
+	return err
+}
+
+func (s *SQLStore) AddUsage(ctx context.Context, rows []Usage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, s.rebind(`INSERT INTO tunnel_usage (tunnel_id, hostname, hour_start, requests, bytes_in, bytes_out) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (tunnel_id, hostname, hour_start) DO UPDATE SET
+    requests = tunnel_usage.requests + excluded.requests,
+    bytes_in = tunnel_usage.bytes_in + excluded.bytes_in,
+    bytes_out = tunnel_usage.bytes_out + excluded.bytes_out`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range rows {
+		if _, err := stmt.ExecContext(ctx, u.TunnelID, u.Hostname, u.HourStart, u.Requests, u.BytesIn, u.BytesOut); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) QueryUsage(ctx context.Context, q UsageQuery) ([]Usage, error) {
+	var where []string
+	var args []any
+	if q.TunnelID != "" {
+		where = append(where, "tunnel_id = ?")
+		args = append(args, q.TunnelID)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "hour_start >= ?")
+		args = append(args, formatStoredTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "hour_start <= ?")
+		args = append(args, formatStoredTime(q.Until))
+	}
+	query := "SELECT tunnel_id, hostname, hour_start, requests, bytes_in, bytes_out FROM tunnel_usage" + whereClause(where) + " ORDER BY hour_start DESC, hostname"
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Usage
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.TunnelID, &u.Hostname, &u.HourStart, &u.Requests, &u.BytesIn, &u.BytesOut); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTunnel(row rowScanner) (Tunnel, error) {
+	var t Tunnel
+	var metadata, agent string
+	if err := row.Scan(&t.ID, &t.Name, &t.Token, &t.OwnerID, &t.ProjectKey, &t.ClientIP, &t.OSType, &metadata, &t.Status, &t.LastSeenAt, &t.ExpiresAt, &t.IdleSince, &agent, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return Tunnel{}, err
+	}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &t.Metadata); err != nil {
+			return Tunnel{}, fmt.Errorf("decode tunnel metadata: %w", err)
+		}
+	}
+	if agent != "" {
+		if err := json.Unmarshal([]byte(agent), &t.Agent); err != nil {
+			return Tunnel{}, fmt.Errorf("decode tunnel agent: %w", err)
+		}
+	}
+	return t, nil
+}
+
+func (s *SQLStore) SetRouteMaintenance(ctx context.Context, routeID string, maintenance *protocol.Maintenance) (Route, error) {
+	encoded, err := encodeJSONColumn(maintenance)
+	if err != nil {
+		return Route{}, err
+	}
+	res, err := s.exec(ctx, "UPDATE tunnel_routes SET maintenance = ?, updated_at = ? WHERE id = ?", encoded, sqlNow(), routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, ErrNotFound
+	}
+	return s.GetRouteByID(ctx, routeID)
+}
+
+// encodeAliases stores no aliases as NULL.
+func encodeAliases(aliases []string) (any, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	return encodeJSONColumn(&aliases)
+}
+
+func scanRoute(row rowScanner) (Route, error) {
+	var r Route
+	var rateLimit, split, ipFilter, auth, rewrite, headerRules, redirect, static, aliases, maintenance, cache, mirror string
+	if err := row.Scan(&r.ID, &r.TunnelID, &r.Hostname, &r.Target, &r.Enabled, &rateLimit, &split, &r.Timeout, &r.MaxBodyBytes, &ipFilter, &auth, &rewrite, &headerRules, &r.ACMEPassthrough, &redirect, &static, &aliases, &maintenance, &cache, &mirror, &r.ExpiresAt, &r.Verification, &r.VerifyToken, &r.DNSStatus, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return Route{}, err
+	}
+	if rateLimit != "" {
+		r.RateLimit = new(protocol.RateLimit)
+		if err := json.Unmarshal([]byte(rateLimit), r.RateLimit); err != nil {
+			return Route{}, fmt.Errorf("decode route rate limit: %w", err)
+		}
+	}
+	if split != "" {
+		r.Split = new(protocol.Split)
+		if err := json.Unmarshal([]byte(split), r.Split); err != nil {
+			return Route{}, fmt.Errorf("decode route split: %w", err)
+		}
+	}
+	if ipFilter != "" {
+		r.IPFilter = new(protocol.IPFilter)
+		if err := json.Unmarshal([]byte(ipFilter), r.IPFilter); err != nil {
+			return Route{}, fmt.Errorf("decode route ip filter: %w", err)
+		}
+	}
+	if auth != "" {
+		r.Auth = new(protocol.RouteAuth)
+		if err := json.Unmarshal([]byte(auth), r.Auth); err != nil {
+			return Route{}, fmt.Errorf("decode route auth: %w", err)
+		}
+	}
+	if rewrite != "" {
+		r.Rewrite = new(protocol.Rewrite)
+		if err := json.Unmarshal([]byte(rewrite), r.Rewrite); err != nil {
+			return Route{}, fmt.Errorf("decode route rewrite: %w", err)
+		}
+	}
+	if headerRules != "" {
+		r.HeaderRules = new(protocol.HeaderRules)
+		if err := json.Unmarshal([]byte(headerRules), r.HeaderRules); err != nil {
+			return Route{}, fmt.Errorf("decode route header rules: %w", err)
+		}
+	}
+	if redirect != "" {
+		r.Redirect = new(protocol.Redirect)
+		if err := json.Unmarshal([]byte(redirect), r.Redirect); err != nil {
+			return Route{}, fmt.Errorf("decode route redirect: %w", err)
+		}
+	}
+	if static != "" {
+		r.Static = new(protocol.StaticResponse)
+		if err := json.Unmarshal([]byte(static), r.Static); err != nil {
+			return Route{}, fmt.Errorf("decode route static response: %w", err)
+		}
+	}
+	if aliases != "" {
+		if err := json.Unmarshal([]byte(aliases), &r.Aliases); err != nil {
+			return Route{}, fmt.Errorf("decode route aliases: %w", err)
+		}
+	}
+	if maintenance != "" {
+		r.Maintenance = new(protocol.Maintenance)
+		if err := json.Unmarshal([]byte(maintenance), r.Maintenance); err != nil {
+			return Route{}, fmt.Errorf("decode route maintenance: %w", err)
+		}
+	}
+	if cache != "" {
+		r.Cache = new(protocol.Cache)
+		if err := json.Unmarshal([]byte(cache), r.Cache); err != nil {
+			return Route{}, fmt.Errorf("decode route cache: %w", err)
+		}
+	}
+	if mirror != "" {
+		r.Mirror = new(protocol.Mirror)
+		if err := json.Unmarshal([]byte(mirror), r.Mirror); err != nil {
+			return Route{}, fmt.Errorf("decode route mirror: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// encodeJSONColumn stores an optional route setting as JSON text, or NULL.
+func encodeJSONColumn[T any](v *T) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// newRowID returns a random UUIDv4 string, matching Supabase's ids.
+func newRowID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+func sqlNow() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func nullIfEmpty(v string) any {
+	if v = strings.TrimSpace(v); v == "" {
+		return nil
+	}
+	return v
+}
+
+func nullIfZero(v int64) any {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
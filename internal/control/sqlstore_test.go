@@ -0,0 +1,313 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"tunneling/internal/protocol"
+)
+
+func openTestSQLStore(t *testing.T) *SQLStore {
+	t.Helper()
+	store, err := OpenSQLStore("sqlite", filepath.Join(t.TempDir(), "control.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestSQLStoreTunnelsAndRoutes(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLStore(t)
+
+	tunnel, err := store.CreateTunnelWithMeta(ctx, "dev", "secret", "u1", "web", "1.2.3.4", "linux", map[string]any{"v": "1"})
+	if err != nil {
+		t.Fatalf("CreateTunnelWithMeta: %v", err)
+	}
+	if tunnel.ID == "" || tunnel.Status != "offline" || tunnel.Metadata["v"] != "1" {
+		t.Fatalf("tunnel = %+v", tunnel)
+	}
+	if _, err := store.ValidateTunnelToken(ctx, tunnel.ID, "wrong"); err == nil {
+		t.Fatalf("ValidateTunnelToken accepted a wrong token")
+	}
+	if got, err := store.GetTunnelByOwnerAndProject(ctx, "u1", "web"); err != nil || got.ID != tunnel.ID {
+		t.Fatalf("GetTunnelByOwnerAndProject = %+v, %v", got, err)
+	}
+	if err := store.UpdateTunnelOnline(ctx, tunnel.ID); err != nil {
+		t.Fatalf("UpdateTunnelOnline: %v", err)
+	}
+	if got, _ := store.ValidateTunnelToken(ctx, tunnel.ID, "secret"); got.Status != "online" {
+		t.Fatalf("status = %q, want online", got.Status)
+	}
+
+	route, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "127.0.0.1:3000", Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: "app.example.com", Target: "x"}); err == nil {
+		t.Fatalf("CreateRoute accepted a duplicate hostname")
+	}
+	patch := func(fields RouteFields, settings Route) (Route, error) {
+		return store.UpdateRoute(ctx, route.ID, RoutePatch{Fields: fields, Route: settings})
+	}
+	if _, err := patch(RouteTarget|RouteEnabled, Route{Target: "127.0.0.1:4000"}); err != nil {
+		t.Fatalf("patching target and enabled: %v", err)
+	}
+	enabled, err := store.ListEnabledProtocolRoutesByTunnel(ctx, tunnel.ID)
+	if err != nil || len(enabled) != 0 {
+		t.Fatalf("enabled routes = %+v, %v", enabled, err)
+	}
+	got, err := store.GetRouteByHostname(ctx, "app.example.com")
+	if err != nil || got.Target != "127.0.0.1:4000" || got.Enabled {
+		t.Fatalf("GetRouteByHostname = %+v, %v", got, err)
+	}
+	limited, err := patch(RouteRateLimit, Route{RateLimit: &protocol.RateLimit{RPS: 5, Burst: 10}})
+	if err != nil || limited.RateLimit == nil || limited.RateLimit.RPS != 5 || limited.RateLimit.Burst != 10 {
+		t.Fatalf("patching ratelimit = %+v, %v", limited, err)
+	}
+	if cleared, err := patch(RouteRateLimit, Route{}); err != nil || cleared.RateLimit != nil {
+		t.Fatalf("clearing rate limit = %+v, %v", cleared, err)
+	}
+	split, err := patch(RouteSplit, Route{Split: &protocol.Split{Target: "127.0.0.1:4001", Weight: 10, Sticky: protocol.SplitStickyIP}})
+	if err != nil || split.Split == nil || split.Split.Target != "127.0.0.1:4001" || split.Split.Weight != 10 || split.Split.Sticky != "ip" {
+		t.Fatalf("patching split = %+v, %v", split, err)
+	}
+	if cleared, err := patch(RouteSplit, Route{}); err != nil || cleared.Split != nil {
+		t.Fatalf("clearing split = %+v, %v", cleared, err)
+	}
+	limited, err = patch(RouteLimits, Route{Timeout: "2m0s", MaxBodyBytes: 50 << 20})
+	if err != nil || limited.Timeout != "2m0s" || limited.MaxBodyBytes != 50<<20 {
+		t.Fatalf("patching limits = %+v, %v", limited, err)
+	}
+	if cleared, err := patch(RouteLimits, Route{}); err != nil || cleared.Timeout != "" || cleared.MaxBodyBytes != 0 {
+		t.Fatalf("clearing limits = %+v, %v", cleared, err)
+	}
+	filtered, err := patch(RouteIPFilter, Route{IPFilter: &protocol.IPFilter{Allow: []string{"10.0.0.0/8"}}})
+	if err != nil || filtered.IPFilter == nil || len(filtered.IPFilter.Allow) != 1 || filtered.IPFilter.Allow[0] != "10.0.0.0/8" {
+		t.Fatalf("patching ipfilter = %+v, %v", filtered, err)
+	}
+	if cleared, err := patch(RouteIPFilter, Route{}); err != nil || cleared.IPFilter != nil {
+		t.Fatalf("clearing ip filter = %+v, %v", cleared, err)
+	}
+	authed, err := patch(RouteAuth, Route{Auth: &protocol.RouteAuth{TokenSecret: "0123456789abcdef"}})
+	if err != nil || authed.Auth == nil || authed.Auth.TokenSecret != "0123456789abcdef" {
+		t.Fatalf("patching auth = %+v, %v", authed, err)
+	}
+	if cleared, err := patch(RouteAuth, Route{}); err != nil || cleared.Auth != nil {
+		t.Fatalf("clearing auth = %+v, %v", cleared, err)
+	}
+	rewritten, err := patch(RouteRewrite, Route{Rewrite: &protocol.Rewrite{StripPrefix: "/app", Host: protocol.RewriteHostTarget}})
+	if err != nil || rewritten.Rewrite == nil || rewritten.Rewrite.StripPrefix != "/app" {
+		t.Fatalf("patching rewrite = %+v, %v", rewritten, err)
+	}
+	if cleared, err := patch(RouteRewrite, Route{}); err != nil || cleared.Rewrite != nil {
+		t.Fatalf("clearing rewrite = %+v, %v", cleared, err)
+	}
+	ruled, err := patch(RouteHeaderRules, Route{HeaderRules: &protocol.HeaderRules{Response: &protocol.HeaderOps{Remove: []string{"Server"}}}})
+	if err != nil || ruled.HeaderRules == nil || ruled.HeaderRules.Response == nil || ruled.HeaderRules.Response.Remove[0] != "Server" {
+		t.Fatalf("patching headerrules = %+v, %v", ruled, err)
+	}
+	if cleared, err := patch(RouteHeaderRules, Route{}); err != nil || cleared.HeaderRules != nil {
+		t.Fatalf("clearing header rules = %+v, %v", cleared, err)
+	}
+	if acme, err := patch(RouteACMEPassthrough, Route{ACMEPassthrough: true}); err != nil || !acme.ACMEPassthrough {
+		t.Fatalf("patching acmepassthrough = %+v, %v", acme, err)
+	}
+	if got, err := store.GetRouteByID(ctx, route.ID); err != nil || !got.ACMEPassthrough {
+		t.Fatalf("GetRouteByID after acme passthrough = %+v, %v", got, err)
+	}
+	if got, err := store.SearchRoutes(ctx, ListOptions{GatewayOnly: true}); err != nil || len(got) != 1 {
+		t.Fatalf("gateway routes with acme passthrough = %+v, %v", got, err)
+	}
+	redirect := &protocol.Redirect{URL: "https://example.org", Status: 301, KeepPath: true}
+	if _, err := patch(RouteType, Route{Redirect: redirect}); err != nil {
+		t.Fatalf("patching type: %v", err)
+	}
+	if got, err := store.SearchRoutes(ctx, ListOptions{GatewayOnly: true}); err != nil || len(got) != 1 || got[0].Redirect == nil || *got[0].Redirect != *redirect || got[0].Static != nil {
+		t.Fatalf("gateway routes = %+v, %v", got, err)
+	}
+	if cleared, err := patch(RouteType, Route{}); err != nil || cleared.gatewayRoute() {
+		t.Fatalf("clearing route type = %+v, %v", cleared, err)
+	}
+	// Still listed, for its ACME passthrough.
+	if got, err := store.SearchRoutes(ctx, ListOptions{GatewayOnly: true}); err != nil || len(got) != 1 || got[0].gatewayRoute() {
+		t.Fatalf("gateway routes after clearing = %+v, %v", got, err)
+	}
+	if aliased, err := patch(RouteAliases, Route{Aliases: []string{"a.example.com", "b.example.com"}}); err != nil || len(aliased.Aliases) != 2 {
+		t.Fatalf("patching aliases = %+v, %v", aliased, err)
+	}
+	if got, err := store.GetRouteByID(ctx, route.ID); err != nil || len(got.Aliases) != 2 || got.Aliases[1] != "b.example.com" {
+		t.Fatalf("GetRouteByID after aliases = %+v, %v", got, err)
+	}
+	if cleared, err := patch(RouteAliases, Route{}); err != nil || cleared.Aliases != nil {
+		t.Fatalf("clearing aliases = %+v, %v", cleared, err)
+	}
+	if down, err := store.SetRouteMaintenance(ctx, route.ID, &protocol.Maintenance{RetryAfter: 60}); err != nil || down.Maintenance == nil || down.Maintenance.RetryAfter != 60 {
+		t.Fatalf("SetRouteMaintenance = %+v, %v", down, err)
+	}
+	if got, err := store.SearchRoutes(ctx, ListOptions{GatewayOnly: true}); err != nil || len(got) != 1 || got[0].Maintenance == nil {
+		t.Fatalf("gateway routes under maintenance = %+v, %v", got, err)
+	}
+	if up, err := store.SetRouteMaintenance(ctx, route.ID, nil); err != nil || up.Maintenance != nil {
+		t.Fatalf("ending maintenance = %+v, %v", up, err)
+	}
+	if cached, err := patch(RouteCache, Route{Cache: &protocol.Cache{MaxTTL: "10m0s"}}); err != nil || cached.Cache == nil || cached.Cache.MaxTTL != "10m0s" {
+		t.Fatalf("patching cache = %+v, %v", cached, err)
+	}
+	if got, err := store.GetRouteByID(ctx, route.ID); err != nil || got.Cache == nil {
+		t.Fatalf("GetRouteByID after cache = %+v, %v", got, err)
+	}
+	if cleared, err := patch(RouteCache, Route{}); err != nil || cleared.Cache != nil {
+		t.Fatalf("clearing cache = %+v, %v", cleared, err)
+	}
+	if mirrored, err := patch(RouteMirror, Route{Mirror: &protocol.Mirror{Target: "127.0.0.1:3001", Percent: 5}}); err != nil || mirrored.Mirror == nil || mirrored.Mirror.Percent != 5 {
+		t.Fatalf("patching mirror = %+v, %v", mirrored, err)
+	}
+	if cleared, err := patch(RouteMirror, Route{}); err != nil || cleared.Mirror != nil {
+		t.Fatalf("clearing mirror = %+v, %v", cleared, err)
+	}
+	combined, err := patch(RouteEnabled|RouteSplit|RouteLimits, Route{Enabled: true, Split: &protocol.Split{Target: "127.0.0.1:4001", Weight: 5}, Timeout: "1m0s"})
+	if err != nil || !combined.Enabled || combined.Split == nil || combined.Timeout != "1m0s" || combined.Target != "127.0.0.1:4000" || !combined.ACMEPassthrough {
+		t.Fatalf("combined patch = %+v, %v", combined, err)
+	}
+	if _, err := store.UpdateRoute(ctx, "missing", RoutePatch{Fields: RouteEnabled}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateRoute(missing) err = %v", err)
+	}
+	if err := store.SetTunnelIdle(ctx, tunnel.ID, "2030-01-02T15:04:05Z"); err != nil {
+		t.Fatalf("SetTunnelIdle: %v", err)
+	}
+	if got, err := store.GetTunnelByID(ctx, tunnel.ID); err != nil || got.IdleSince != "2030-01-02T15:04:05Z" {
+		t.Fatalf("GetTunnelByID after idle = %+v, %v", got, err)
+	}
+	if err := store.SetTunnelIdle(ctx, tunnel.ID, ""); err != nil {
+		t.Fatalf("SetTunnelIdle(clear): %v", err)
+	}
+	if err := store.SetTunnelIdle(ctx, "missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetTunnelIdle(missing) err = %v", err)
+	}
+	if err := store.SetTunnelAgent(ctx, tunnel.ID, &protocol.AgentMeta{Version: "v1", OS: "linux", Labels: map[string]string{"env": "prod"}}); err != nil {
+		t.Fatalf("SetTunnelAgent: %v", err)
+	}
+	if got, err := store.GetTunnelByID(ctx, tunnel.ID); err != nil || got.Agent == nil || got.Agent.OS != "linux" || got.Agent.Labels["env"] != "prod" {
+		t.Fatalf("GetTunnelByID after agent report = %+v, %v", got, err)
+	}
+	if _, err := store.UpdateRouteHostname(ctx, "missing", "x.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateRouteHostname(missing) err = %v", err)
+	}
+
+	if err := store.DeleteTunnelByID(ctx, tunnel.ID); err != nil {
+		t.Fatalf("DeleteTunnelByID: %v", err)
+	}
+	if _, err := store.GetRouteByID(ctx, route.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("route survived tunnel deletion: %v", err)
+	}
+}
+
+func TestSearchTunnelsAndRoutes(t *testing.T) {
+	mem, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	for name, store := range map[string]Store{"memory": mem, "sqlite": openTestSQLStore(t)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var ids []string
+			for _, n := range []struct{ name, owner, host string }{
+				{"api", "u1", "api.example.com"},
+				{"web", "u1", "shop.example.com"},
+				{"docs", "u2", "docs_100%.example.com"},
+			} {
+				tunnel, err := store.CreateTunnelWithMeta(ctx, n.name, "tok", n.owner, n.name, "", "", nil)
+				if err != nil {
+					t.Fatalf("CreateTunnelWithMeta: %v", err)
+				}
+				if _, err := store.CreateRoute(ctx, Route{TunnelID: tunnel.ID, Hostname: n.host, Target: "127.0.0.1:1", Enabled: true}); err != nil {
+					t.Fatalf("CreateRoute: %v", err)
+				}
+				ids = append(ids, tunnel.ID)
+			}
+
+			tunnelIDs := func(opts ListOptions) []string {
+				rows, err := store.SearchTunnels(ctx, opts)
+				if err != nil {
+					t.Fatalf("SearchTunnels(%+v): %v", opts, err)
+				}
+				var out []string
+				for _, r := range rows {
+					out = append(out, r.ID)
+				}
+				sort.Strings(out)
+				return out
+			}
+			for _, tc := range []struct {
+				opts ListOptions
+				want []string
+			}{
+				{ListOptions{OwnerID: "u1"}, []string{ids[0], ids[1]}},
+				{ListOptions{Query: "WE"}, []string{ids[1]}},
+				{ListOptions{Query: "shop"}, []string{ids[1]}},
+				{ListOptions{Query: "100%"}, []string{ids[2]}},
+				{ListOptions{Query: "_1"}, []string{ids[2]}},
+				{ListOptions{Query: "a_i"}, nil},
+			} {
+				sort.Strings(tc.want)
+				if got := tunnelIDs(tc.opts); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+					t.Fatalf("SearchTunnels(%+v) = %v, want %v", tc.opts, got, tc.want)
+				}
+			}
+			first, rest := tunnelIDs(ListOptions{Limit: 2}), tunnelIDs(ListOptions{Limit: 2, Offset: 2})
+			all := append(first, rest...)
+			sort.Strings(all)
+			if want := tunnelIDs(ListOptions{}); len(first) != 2 || fmt.Sprint(all) != fmt.Sprint(want) {
+				t.Fatalf("pages %v + %v, want %v", first, rest, want)
+			}
+			if got := tunnelIDs(ListOptions{Offset: 1}); len(got) != 2 {
+				t.Fatalf("offset without limit = %v", got)
+			}
+
+			routes, err := store.SearchRoutes(ctx, ListOptions{OwnerID: "u1", Query: "example", Limit: 1, Offset: 1})
+			if err != nil || len(routes) != 1 || routes[0].Hostname != "shop.example.com" {
+				t.Fatalf("SearchRoutes = %+v, %v", routes, err)
+			}
+			routes, err = store.SearchRoutes(ctx, ListOptions{TunnelID: ids[0], OwnerID: "u2"})
+			if err != nil || len(routes) != 0 {
+				t.Fatalf("SearchRoutes across owners = %+v, %v", routes, err)
+			}
+
+			now := time.Now()
+			if _, err := store.SetRouteExpiry(ctx, routeIDOf(t, store, "shop.example.com"), formatStoredTime(now.Add(-time.Second))); err != nil {
+				t.Fatalf("SetRouteExpiry: %v", err)
+			}
+			if err := store.SetTunnelExpiry(ctx, ids[2], formatStoredTime(now.Add(time.Hour))); err != nil {
+				t.Fatalf("SetTunnelExpiry: %v", err)
+			}
+			routes, err = store.SearchRoutes(ctx, ListOptions{ExpiredBy: now})
+			if err != nil || len(routes) != 1 || routes[0].Hostname != "shop.example.com" {
+				t.Fatalf("expired routes = %+v, %v", routes, err)
+			}
+			if got := tunnelIDs(ListOptions{ExpiredBy: now}); len(got) != 0 {
+				t.Fatalf("expired tunnels = %v", got)
+			}
+			if got := tunnelIDs(ListOptions{ExpiredBy: now.Add(2 * time.Hour)}); fmt.Sprint(got) != fmt.Sprint([]string{ids[2]}) {
+				t.Fatalf("tunnels expired in two hours = %v", got)
+			}
+		})
+	}
+}
+
+func routeIDOf(t *testing.T, store Store, hostname string) string {
+	t.Helper()
+	r, err := store.GetRouteByHostname(context.Background(), hostname)
+	if err != nil {
+		t.Fatalf("GetRouteByHostname(%s): %v", hostname, err)
+	}
+	return r.ID
+}
@@ -0,0 +1,69 @@
+package control
+
+import (
+	"context"
+
+	"tunneling/internal/protocol"
+)
+
+// Store is the persistence the control API needs for tunnels and routes.
+// SupabaseClient talks to Supabase's REST API; SQLStore runs the same model
+// on SQLite or Postgres for deployments without a Supabase project, and
+// MemoryStore needs nothing at all for local development.
+type Store interface {
+	ListTunnels(ctx context.Context) ([]Tunnel, error)
+	// SearchTunnels lists tunnels newest first.
+	SearchTunnels(ctx context.Context, opts ListOptions) ([]Tunnel, error)
+	CreateTunnel(ctx context.Context, name, token string) (Tunnel, error)
+	CreateTunnelWithMeta(ctx context.Context, name, token, ownerID, projectKey, clientIP, osType string, metadata map[string]any) (Tunnel, error)
+	GetTunnelByID(ctx context.Context, id string) (Tunnel, error)
+	GetTunnelByOwnerAndProject(ctx context.Context, ownerID, projectKey string) (Tunnel, error)
+	ValidateTunnelToken(ctx context.Context, tunnelID, token string) (Tunnel, error)
+	UpdateTunnelOnline(ctx context.Context, tunnelID string) error
+	UpdateTunnelOffline(ctx context.Context, tunnelID string) error
+	DeleteTunnelByID(ctx context.Context, tunnelID string) error
+	DeleteAllTunnels(ctx context.Context) error
+	// SetTunnelExpiry sets or, with "", clears a tunnel's expires_at.
+	SetTunnelExpiry(ctx context.Context, tunnelID, expiresAt string) error
+	// SetTunnelIdle marks a tunnel idle since idleSince or, with "", in use.
+	SetTunnelIdle(ctx context.Context, tunnelID, idleSince string) error
+	// SetTunnelAgent records what the tunnel's agent reported on connect.
+	SetTunnelAgent(ctx context.Context, tunnelID string, agent *protocol.AgentMeta) error
+
+	CreateRoute(ctx context.Context, route Route) (Route, error)
+	// UpdateRoute applies patch to a route in a single write.
+	UpdateRoute(ctx context.Context, routeID string, patch RoutePatch) (Route, error)
+	UpdateRouteBinding(ctx context.Context, routeID string, tunnelID string, target string, enabled bool) (Route, error)
+	UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error)
+	// SetRouteMaintenance puts a route under maintenance, or with nil
+	// takes it out.
+	SetRouteMaintenance(ctx context.Context, routeID string, maintenance *protocol.Maintenance) (Route, error)
+	SetRouteExpiry(ctx context.Context, routeID, expiresAt string) (Route, error)
+	// SetRouteVerification sets a route's verification status and token;
+	// "" clears them.
+	SetRouteVerification(ctx context.Context, routeID, status, token string) (Route, error)
+	// SetRouteDNSStatus records how the DNS record of a route stands.
+	SetRouteDNSStatus(ctx context.Context, routeID, status string) (Route, error)
+	GetRouteByID(ctx context.Context, routeID string) (Route, error)
+	GetRouteByHostname(ctx context.Context, hostname string) (Route, error)
+	ListRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error)
+	// SearchRoutes lists routes ordered by hostname.
+	SearchRoutes(ctx context.Context, opts ListOptions) ([]Route, error)
+	ListEnabledProtocolRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error)
+	DeleteRouteByID(ctx context.Context, routeID string) error
+
+	// AddUsage adds rows onto the counts already stored for the same tunnel,
+	// hostname and hour.
+	AddUsage(ctx context.Context, rows []Usage) error
+	// QueryUsage lists usage newest hour first, then by hostname.
+	QueryUsage(ctx context.Context, q UsageQuery) ([]Usage, error)
+}
+
+var (
+	_ Store = (*SupabaseClient)(nil)
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+
+	_ EventLog = (*SupabaseClient)(nil)
+	_ EventLog = (*SQLStore)(nil)
+)
@@ -9,8 +9,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"tunneling/internal/protocol"
 )
 
 type SupabaseClient struct {
@@ -19,7 +22,12 @@ type SupabaseClient struct {
 	httpClient *http.Client
 }
 
-var ErrNotFound = errors.New("not found")
+const routeSelect = "id,tunnel_id,hostname,target,is_enabled,rate_limit,split,timeout,max_body_bytes,ip_filter,auth,rewrite,header_rules,acme_passthrough,redirect,static_response,aliases,maintenance,cache,mirror,expires_at,verification,verify_token,dns_status,created_at,updated_at"
+
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrInvalidTunnelToken = errors.New("invalid tunnel id or token")
+)
 
 func NewSupabaseClient(baseURL, apiKey string) (*SupabaseClient, error) {
 	baseURL = strings.TrimSpace(strings.TrimRight(baseURL, "/"))
@@ -41,7 +49,7 @@ func NewSupabaseClient(baseURL, apiKey string) (*SupabaseClient, error) {
 
 func (c *SupabaseClient) ListTunnels(ctx context.Context) ([]Tunnel, error) {
 	query := url.Values{}
-	query.Set("select", "id,name,created_at")
+	query.Set("select", "id,name,status,last_seen_at,idle_since,agent,created_at")
 	query.Set("order", "created_at.desc")
 
 	var out []Tunnel
@@ -51,6 +59,45 @@ func (c *SupabaseClient) ListTunnels(ctx context.Context) ([]Tunnel, error) {
 	return out, nil
 }
 
+func (c *SupabaseClient) SearchTunnels(ctx context.Context, opts ListOptions) ([]Tunnel, error) {
+	query := url.Values{}
+	query.Set("select", "id,name,owner_id,project_key,status,last_seen_at,expires_at,idle_since,agent,created_at")
+	if opts.OwnerID != "" {
+		query.Set("owner_id", "eq."+opts.OwnerID)
+	}
+	if !opts.ExpiredBy.IsZero() {
+		query.Set("expires_at", "lte."+formatStoredTime(opts.ExpiredBy))
+	}
+	if opts.Query != "" {
+		// PostgREST cannot filter on a related table inside or=(), so the
+		// tunnels matching through a hostname are looked up first.
+		var hits []Route
+		routeQuery := url.Values{}
+		routeQuery.Set("select", "tunnel_id")
+		routeQuery.Set("hostname", "ilike."+ilikePattern(opts.Query))
+		if err := c.requestJSON(ctx, http.MethodGet, "/rest/v1/tunnel_routes", routeQuery, nil, nil, &hits); err != nil {
+			return nil, err
+		}
+		conds := []string{"name.ilike." + postgrestQuote(ilikePattern(opts.Query))}
+		if len(hits) > 0 {
+			ids := make([]string, 0, len(hits))
+			for _, h := range hits {
+				ids = append(ids, postgrestQuote(h.TunnelID))
+			}
+			conds = append(conds, "id.in.("+strings.Join(ids, ",")+")")
+		}
+		query.Set("or", "("+strings.Join(conds, ",")+")")
+	}
+	query.Set("order", "created_at.desc,id.desc")
+	setPage(query, opts)
+
+	var out []Tunnel
+	if err := c.requestJSON(ctx, http.MethodGet, "/rest/v1/tunnel_instances", query, nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *SupabaseClient) CreateTunnel(ctx context.Context, name, token string) (Tunnel, error) {
 	return c.CreateTunnelWithMeta(ctx, name, token, "", "", "", "", nil)
 }
@@ -112,7 +159,7 @@ func (c *SupabaseClient) CreateTunnelWithMeta(ctx context.Context, name, token,
 
 func (c *SupabaseClient) GetTunnelByID(ctx context.Context, id string) (Tunnel, error) {
 	query := url.Values{}
-	query.Set("select", "id,name,token:token_hash,created_at")
+	query.Set("select", "id,name,token:token_hash,owner_id,idle_since,agent,created_at")
 	query.Set("id", "eq."+id)
 	query.Set("limit", "1")
 
@@ -138,7 +185,7 @@ func (c *SupabaseClient) ValidateTunnelToken(ctx context.Context, tunnelID, toke
 		return Tunnel{}, err
 	}
 	if len(rows) == 0 {
-		return Tunnel{}, errors.New("invalid tunnel id or token")
+		return Tunnel{}, ErrInvalidTunnelToken
 	}
 	return rows[0], nil
 }
@@ -146,7 +193,7 @@ func (c *SupabaseClient) ValidateTunnelToken(ctx context.Context, tunnelID, toke
 func (c *SupabaseClient) UpsertRoute(ctx context.Context, route Route) (Route, error) {
 	query := url.Values{}
 	query.Set("on_conflict", "hostname")
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 
 	headers := map[string]string{
 		"Prefer": "resolution=merge-duplicates,return=representation",
@@ -166,7 +213,7 @@ func (c *SupabaseClient) UpsertRoute(ctx context.Context, route Route) (Route, e
 
 func (c *SupabaseClient) CreateRoute(ctx context.Context, route Route) (Route, error) {
 	query := url.Values{}
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 
 	headers := map[string]string{
 		"Prefer": "return=representation",
@@ -178,6 +225,61 @@ func (c *SupabaseClient) CreateRoute(ctx context.Context, route Route) (Route, e
 		"target":     route.Target,
 		"is_enabled": route.Enabled,
 	}
+	if route.RateLimit != nil {
+		payload["rate_limit"] = route.RateLimit
+	}
+	if route.Split != nil {
+		payload["split"] = route.Split
+	}
+	if route.Timeout != "" {
+		payload["timeout"] = route.Timeout
+	}
+	if route.MaxBodyBytes != 0 {
+		payload["max_body_bytes"] = route.MaxBodyBytes
+	}
+	if route.IPFilter != nil {
+		payload["ip_filter"] = route.IPFilter
+	}
+	if route.Auth != nil {
+		payload["auth"] = route.Auth
+	}
+	if route.Rewrite != nil {
+		payload["rewrite"] = route.Rewrite
+	}
+	if route.HeaderRules != nil {
+		payload["header_rules"] = route.HeaderRules
+	}
+	if route.ACMEPassthrough {
+		payload["acme_passthrough"] = true
+	}
+	if route.Redirect != nil {
+		payload["redirect"] = route.Redirect
+	}
+	if route.Static != nil {
+		payload["static_response"] = route.Static
+	}
+	if len(route.Aliases) > 0 {
+		payload["aliases"] = route.Aliases
+	}
+	if route.Maintenance != nil {
+		payload["maintenance"] = route.Maintenance
+	}
+	if route.Cache != nil {
+		payload["cache"] = route.Cache
+	}
+	if route.Mirror != nil {
+		payload["mirror"] = route.Mirror
+	}
+	if route.ExpiresAt != "" {
+		payload["expires_at"] = route.ExpiresAt
+	}
+	if route.Verification != "" {
+		payload["verification"] = route.Verification
+		payload["verify_token"] = route.VerifyToken
+	}
+	if route.DNSStatus != "" {
+		payload["dns_status"] = route.DNSStatus
+	}
 
 	var rows []Route
 	if err := c.requestJSON(ctx, http.MethodPost, "/rest/v1/tunnel_routes", query, headers, payload, &rows); err != nil {
@@ -189,14 +291,85 @@ func (c *SupabaseClient) CreateRoute(ctx context.Context, route Route) (Route, e
 	return rows[0], nil
 }
 
-func (c *SupabaseClient) UpdateRoute(ctx context.Context, routeID string, target string, enabled bool) (Route, error) {
-	return c.UpdateRouteBinding(ctx, routeID, "", target, enabled)
+func (c *SupabaseClient) UpdateRoute(ctx context.Context, routeID string, patch RoutePatch) (Route, error) {
+	query := url.Values{}
+	query.Set("id", "eq."+routeID)
+	query.Set("select", routeSelect)
+
+	headers := map[string]string{
+		"Prefer": "return=representation",
+	}
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_routes", query, headers, routePatchPayload(patch), &rows); err != nil {
+		return Route{}, err
+	}
+	if len(rows) == 0 {
+		return Route{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+// routePatchPayload is the PostgREST body for the settings patch changes.
+func routePatchPayload(patch RoutePatch) map[string]any {
+	p := patch.Route
+	payload := map[string]any{}
+	if patch.has(RouteTarget) {
+		payload["target"] = p.Target
+	}
+	if patch.has(RouteEnabled) {
+		payload["is_enabled"] = p.Enabled
+	}
+	if patch.has(RouteExpiry) {
+		payload["expires_at"] = nullIfEmpty(p.ExpiresAt)
+	}
+	if patch.has(RouteRateLimit) {
+		payload["rate_limit"] = p.RateLimit
+	}
+	if patch.has(RouteSplit) {
+		payload["split"] = p.Split
+	}
+	if patch.has(RouteLimits) {
+		payload["timeout"] = nullIfEmpty(p.Timeout)
+		payload["max_body_bytes"] = nullIfZero(p.MaxBodyBytes)
+	}
+	if patch.has(RouteIPFilter) {
+		payload["ip_filter"] = p.IPFilter
+	}
+	if patch.has(RouteAuth) {
+		payload["auth"] = p.Auth
+	}
+	if patch.has(RouteRewrite) {
+		payload["rewrite"] = p.Rewrite
+	}
+	if patch.has(RouteHeaderRules) {
+		payload["header_rules"] = p.HeaderRules
+	}
+	if patch.has(RouteACMEPassthrough) {
+		payload["acme_passthrough"] = p.ACMEPassthrough
+	}
+	if patch.has(RouteType) {
+		payload["redirect"], payload["static_response"] = p.Redirect, p.Static
+	}
+	if patch.has(RouteAliases) {
+		payload["aliases"] = nil
+		if len(p.Aliases) > 0 {
+			payload["aliases"] = p.Aliases
+		}
+	}
+	if patch.has(RouteCache) {
+		payload["cache"] = p.Cache
+	}
+	if patch.has(RouteMirror) {
+		payload["mirror"] = p.Mirror
+	}
+	return payload
 }
 
 func (c *SupabaseClient) UpdateRouteBinding(ctx context.Context, routeID string, tunnelID string, target string, enabled bool) (Route, error) {
 	query := url.Values{}
 	query.Set("id", "eq."+routeID)
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 
 	headers := map[string]string{
 		"Prefer": "return=representation",
@@ -219,7 +392,7 @@ func (c *SupabaseClient) UpdateRouteBinding(ctx context.Context, routeID string,
 
 func (c *SupabaseClient) GetRouteByHostname(ctx context.Context, hostname string) (Route, error) {
 	query := url.Values{}
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 	query.Set("hostname", "eq."+hostname)
 	query.Set("limit", "1")
 
@@ -234,13 +407,21 @@ func (c *SupabaseClient) GetRouteByHostname(ctx context.Context, hostname string
 }
 
 func (c *SupabaseClient) UpdateTunnelOnline(ctx context.Context, tunnelID string) error {
+	return c.updateTunnelStatus(ctx, tunnelID, "online")
+}
+
+func (c *SupabaseClient) UpdateTunnelOffline(ctx context.Context, tunnelID string) error {
+	return c.updateTunnelStatus(ctx, tunnelID, "offline")
+}
+
+func (c *SupabaseClient) updateTunnelStatus(ctx context.Context, tunnelID, status string) error {
 	query := url.Values{}
 	query.Set("id", "eq."+tunnelID)
 	headers := map[string]string{
 		"Prefer": "return=minimal",
 	}
 	payload := map[string]any{
-		"status":       "online",
+		"status":       status,
 		"last_seen_at": time.Now().UTC().Format(time.RFC3339),
 	}
 	return c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_instances", query, headers, payload, nil)
@@ -276,7 +457,7 @@ func (c *SupabaseClient) DeleteAllTunnels(ctx context.Context) error {
 
 func (c *SupabaseClient) ListRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
 	query := url.Values{}
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 	query.Set("tunnel_id", "eq."+tunnelID)
 	query.Set("order", "hostname.asc")
 
@@ -287,9 +468,68 @@ func (c *SupabaseClient) ListRoutesByTunnel(ctx context.Context, tunnelID string
 	return rows, nil
 }
 
+func (c *SupabaseClient) SearchRoutes(ctx context.Context, opts ListOptions) ([]Route, error) {
+	query := url.Values{}
+	query.Set("select", routeSelect)
+	if opts.TunnelID != "" {
+		query.Set("tunnel_id", "eq."+opts.TunnelID)
+	}
+	if opts.OwnerID != "" {
+		owned, err := c.SearchTunnels(ctx, ListOptions{OwnerID: opts.OwnerID})
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(owned))
+		for _, t := range owned {
+			if opts.TunnelID == "" || t.ID == opts.TunnelID {
+				ids = append(ids, postgrestQuote(t.ID))
+			}
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		query.Set("tunnel_id", "in.("+strings.Join(ids, ",")+")")
+	}
+	if opts.Query != "" {
+		query.Set("hostname", "ilike."+ilikePattern(opts.Query))
+	}
+	if !opts.ExpiredBy.IsZero() {
+		query.Set("expires_at", "lte."+formatStoredTime(opts.ExpiredBy))
+	}
+	if opts.GatewayOnly {
+		query.Set("or", "(redirect.not.is.null,static_response.not.is.null,maintenance.not.is.null,acme_passthrough.is.true)")
+	}
+	query.Set("order", "hostname.asc")
+	setPage(query, opts)
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodGet, "/rest/v1/tunnel_routes", query, nil, nil, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func ilikePattern(q string) string {
+	return "*" + strings.ReplaceAll(q, "*", "") + "*"
+}
+
+// postgrestQuote quotes v for use inside or=() and in.() lists.
+func postgrestQuote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+func setPage(query url.Values, opts ListOptions) {
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+}
+
 func (c *SupabaseClient) GetRouteByID(ctx context.Context, routeID string) (Route, error) {
 	query := url.Values{}
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 	query.Set("id", "eq."+routeID)
 	query.Set("limit", "1")
 
@@ -306,7 +546,7 @@ func (c *SupabaseClient) GetRouteByID(ctx context.Context, routeID string) (Rout
 func (c *SupabaseClient) UpdateRouteHostname(ctx context.Context, routeID, hostname string) (Route, error) {
 	query := url.Values{}
 	query.Set("id", "eq."+routeID)
-	query.Set("select", "id,tunnel_id,hostname,target,is_enabled,created_at,updated_at")
+	query.Set("select", routeSelect)
 
 	headers := map[string]string{
 		"Prefer": "return=representation",
@@ -323,9 +563,116 @@ func (c *SupabaseClient) UpdateRouteHostname(ctx context.Context, routeID, hostn
 	return rows[0], nil
 }
 
+func (c *SupabaseClient) SetRouteMaintenance(ctx context.Context, routeID string, maintenance *protocol.Maintenance) (Route, error) {
+	query := url.Values{}
+	query.Set("id", "eq."+routeID)
+	query.Set("select", routeSelect)
+
+	headers := map[string]string{
+		"Prefer": "return=representation",
+	}
+	payload := map[string]any{"maintenance": maintenance}
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_routes", query, headers, payload, &rows); err != nil {
+		return Route{}, err
+	}
+	if len(rows) == 0 {
+		return Route{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+func (c *SupabaseClient) SetRouteExpiry(ctx context.Context, routeID, expiresAt string) (Route, error) {
+	query := url.Values{}
+	query.Set("id", "eq."+routeID)
+	query.Set("select", routeSelect)
+	headers := map[string]string{
+		"Prefer": "return=representation",
+	}
+	payload := map[string]any{"expires_at": nullIfEmpty(expiresAt)}
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_routes", query, headers, payload, &rows); err != nil {
+		return Route{}, err
+	}
+	if len(rows) == 0 {
+		return Route{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+func (c *SupabaseClient) SetRouteVerification(ctx context.Context, routeID, status, token string) (Route, error) {
+	query := url.Values{}
+	query.Set("id", "eq."+routeID)
+	query.Set("select", routeSelect)
+	headers := map[string]string{
+		"Prefer": "return=representation",
+	}
+	payload := map[string]any{"verification": nullIfEmpty(status), "verify_token": nullIfEmpty(token)}
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_routes", query, headers, payload, &rows); err != nil {
+		return Route{}, err
+	}
+	if len(rows) == 0 {
+		return Route{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+func (c *SupabaseClient) SetRouteDNSStatus(ctx context.Context, routeID, status string) (Route, error) {
+	query := url.Values{}
+	query.Set("id", "eq."+routeID)
+	query.Set("select", routeSelect)
+	headers := map[string]string{
+		"Prefer": "return=representation",
+	}
+	payload := map[string]any{"dns_status": nullIfEmpty(status)}
+
+	var rows []Route
+	if err := c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_routes", query, headers, payload, &rows); err != nil {
+		return Route{}, err
+	}
+	if len(rows) == 0 {
+		return Route{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+func (c *SupabaseClient) SetTunnelExpiry(ctx context.Context, tunnelID, expiresAt string) error {
+	query := url.Values{}
+	query.Set("id", "eq."+tunnelID)
+	headers := map[string]string{
+		"Prefer": "return=minimal",
+	}
+	payload := map[string]any{"expires_at": nullIfEmpty(expiresAt)}
+	return c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_instances", query, headers, payload, nil)
+}
+
+func (c *SupabaseClient) SetTunnelIdle(ctx context.Context, tunnelID, idleSince string) error {
+	query := url.Values{}
+	query.Set("id", "eq."+tunnelID)
+	headers := map[string]string{
+		"Prefer": "return=minimal",
+	}
+	payload := map[string]any{"idle_since": nullIfEmpty(idleSince)}
+	return c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_instances", query, headers, payload, nil)
+}
+
+func (c *SupabaseClient) SetTunnelAgent(ctx context.Context, tunnelID string, agent *protocol.AgentMeta) error {
+	query := url.Values{}
+	query.Set("id", "eq."+tunnelID)
+	headers := map[string]string{
+		"Prefer": "return=minimal",
+	}
+	payload := map[string]any{"agent": agent}
+	return c.requestJSON(ctx, http.MethodPatch, "/rest/v1/tunnel_instances", query, headers, payload, nil)
+}
+
 func (c *SupabaseClient) ListEnabledProtocolRoutesByTunnel(ctx context.Context, tunnelID string) ([]Route, error) {
 	query := url.Values{}
-	query.Set("select", "hostname,target,is_enabled")
+	query.Set("select", "hostname,target,is_enabled,rate_limit,split,timeout,max_body_bytes,ip_filter,auth,rewrite,header_rules,acme_passthrough,redirect,static_response,aliases,cache,mirror,expires_at,verification")
 	query.Set("tunnel_id", "eq."+tunnelID)
 	query.Set("is_enabled", "eq.true")
 	query.Set("order", "hostname.asc")
@@ -363,6 +710,84 @@ func (c *SupabaseClient) GetTunnelByOwnerAndProject(ctx context.Context, ownerID
 	return rows[0], nil
 }
 
+const eventSelect = "id,time:created_at,level,event,tunnel_id,message"
+
+func (c *SupabaseClient) AppendEvents(ctx context.Context, entries []LogEntry) error {
+	rows := make([]map[string]any, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, map[string]any{
+			"id":         e.ID,
+			"created_at": e.Time,
+			"level":      e.Level,
+			"event":      e.Event,
+			"tunnel_id":  nullIfEmpty(e.TunnelID),
+			"message":    e.Message,
+		})
+	}
+	headers := map[string]string{
+		"Prefer": "return=minimal",
+	}
+	return c.requestJSON(ctx, http.MethodPost, "/rest/v1/tunnel_events", nil, headers, rows, nil)
+}
+
+func (c *SupabaseClient) QueryEvents(ctx context.Context, q EventQuery) ([]LogEntry, error) {
+	query := url.Values{}
+	query.Set("select", eventSelect)
+	if q.TunnelID != "" {
+		query.Set("tunnel_id", "eq."+q.TunnelID)
+	}
+	if !q.Since.IsZero() {
+		query.Add("created_at", "gte."+formatStoredTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query.Add("created_at", "lte."+formatStoredTime(q.Until))
+	}
+	query.Set("order", "id.desc")
+	setPage(query, ListOptions{Limit: q.Limit})
+
+	var out []LogEntry
+	if err := c.requestJSON(ctx, http.MethodGet, "/rest/v1/tunnel_events", query, nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *SupabaseClient) PruneEvents(ctx context.Context, before time.Time) error {
+	query := url.Values{}
+	query.Set("created_at", "lt."+formatStoredTime(before))
+	headers := map[string]string{
+		"Prefer": "return=minimal",
+	}
+	return c.requestJSON(ctx, http.MethodDelete, "/rest/v1/tunnel_events", query, headers, nil, nil)
+}
+
+// AddUsage goes through the add_tunnel_usage function of sql/add_usage.sql:
+// PostgREST upserts replace counts instead of adding to them.
+func (c *SupabaseClient) AddUsage(ctx context.Context, rows []Usage) error {
+	return c.requestJSON(ctx, http.MethodPost, "/rest/v1/rpc/add_tunnel_usage", nil, nil, map[string]any{"usage_rows": rows}, nil)
+}
+
+func (c *SupabaseClient) QueryUsage(ctx context.Context, q UsageQuery) ([]Usage, error) {
+	query := url.Values{}
+	query.Set("select", "tunnel_id,hostname,hour_start,requests,bytes_in,bytes_out")
+	if q.TunnelID != "" {
+		query.Set("tunnel_id", "eq."+q.TunnelID)
+	}
+	if !q.Since.IsZero() {
+		query.Add("hour_start", "gte."+formatStoredTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query.Add("hour_start", "lte."+formatStoredTime(q.Until))
+	}
+	query.Set("order", "hour_start.desc,hostname.asc")
+
+	var out []Usage
+	if err := c.requestJSON(ctx, http.MethodGet, "/rest/v1/tunnel_usage", query, nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *SupabaseClient) requestJSON(ctx context.Context, method, path string, query url.Values, extraHeaders map[string]string, payload any, out any) error {
 	endpoint := c.baseURL + path
 	if len(query) > 0 {
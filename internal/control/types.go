@@ -1,6 +1,10 @@
 package control
 
-import "tunneling/internal/protocol"
+import (
+	"time"
+
+	"tunneling/internal/protocol"
+)
 
 type Tunnel struct {
 	ID         string         `json:"id"`
@@ -12,20 +16,157 @@ type Tunnel struct {
 	OSType     string         `json:"os_type,omitempty"`
 	Metadata   map[string]any `json:"metadata,omitempty"`
 	Status     string         `json:"status,omitempty"`
-	CreatedAt  string         `json:"created_at,omitempty"`
-	UpdatedAt  string         `json:"updated_at,omitempty"`
+	LastSeenAt string         `json:"last_seen_at,omitempty"`
+	Online     bool           `json:"online"`
+	// ExpiresAt, when set, is the RFC 3339 time after which the control
+	// server deletes the tunnel.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// IdleSince is when the tunnel was suspended for lack of traffic;
+	// empty while it is in use.
+	IdleSince string `json:"idle_since,omitempty"`
+	// Agent is what the tunnel's agent reported about itself when it last
+	// connected to a tunnel server.
+	Agent     *protocol.AgentMeta `json:"agent,omitempty"`
+	CreatedAt string              `json:"created_at,omitempty"`
+	UpdatedAt string              `json:"updated_at,omitempty"`
 }
 
 type Route struct {
-	ID        string `json:"id,omitempty"`
-	TunnelID  string `json:"tunnel_id"`
-	Hostname  string `json:"hostname"`
-	Target    string `json:"target"`
-	Enabled   bool   `json:"is_enabled"`
+	ID       string `json:"id,omitempty"`
+	TunnelID string `json:"tunnel_id"`
+	Hostname string `json:"hostname"`
+	Target   string `json:"target"`
+	Enabled  bool   `json:"is_enabled"`
+	// RateLimit is handed to the agent with the route and enforced by the
+	// tunnel server; nil means the server's default.
+	RateLimit *protocol.RateLimit `json:"rate_limit,omitempty"`
+	// Split sends a weighted share of the traffic to a second target; it
+	// travels to the gateway with the route like RateLimit.
+	Split *protocol.Split `json:"split,omitempty"`
+	// Timeout and MaxBodyBytes override the gateway's request timeout and
+	// body cap for this route; they travel with it like RateLimit.
+	Timeout      string `json:"timeout,omitempty"`
+	MaxBodyBytes int64  `json:"max_body_bytes,omitempty"`
+	// IPFilter restricts which client addresses the gateway lets through;
+	// it travels with the route like RateLimit.
+	IPFilter *protocol.IPFilter `json:"ip_filter,omitempty"`
+	// Auth makes the gateway ask for Basic credentials or a signed preview
+	// token; it travels with the route like RateLimit.
+	Auth *protocol.RouteAuth `json:"auth,omitempty"`
+	// Rewrite changes the path and Host the agent sends to the target; it
+	// travels with the route like RateLimit.
+	Rewrite *protocol.Rewrite `json:"rewrite,omitempty"`
+	// HeaderRules add, replace or remove headers on the way to and from
+	// the target; they travel with the route like RateLimit.
+	HeaderRules *protocol.HeaderRules `json:"header_rules,omitempty"`
+	// ACMEPassthrough lets ACME HTTP-01 challenges reach the target past
+	// the route's IP filter, auth and rate limit.
+	ACMEPassthrough bool `json:"acme_passthrough,omitempty"`
+	// Redirect or Static make this a route the tunnel server answers by
+	// itself; such routes are not handed to agents and need no target.
+	Redirect *protocol.Redirect       `json:"redirect,omitempty"`
+	Static   *protocol.StaticResponse `json:"static_response,omitempty"`
+	// Aliases are more hostnames served exactly like Hostname.
+	Aliases []string `json:"aliases,omitempty"`
+	// Maintenance, while set, has the tunnel server answer 503 in place of
+	// the agent, which keeps the route.
+	Maintenance *protocol.Maintenance `json:"maintenance,omitempty"`
+	// Cache keeps GET and HEAD responses at the tunnel server; it travels
+	// with the route like RateLimit.
+	Cache *protocol.Cache `json:"cache,omitempty"`
+	// Mirror copies a share of the route's requests to a second target
+	// through the same agent; it travels with the route like Split.
+	Mirror *protocol.Mirror `json:"mirror,omitempty"`
+	// ExpiresAt, when set, is the RFC 3339 time after which the route is no
+	// longer handed to agents and is deleted.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Verification is "pending" for a route on a custom domain whose
+	// ownership has not been proven with VerifyToken yet, and "verified"
+	// once it has. Pending routes are not handed to agents or servers;
+	// routes on platform domains need no verification and leave it empty.
+	Verification string `json:"verification,omitempty"`
+	VerifyToken  string `json:"verify_token,omitempty"`
+	// DNSStatus is "pending", "active" or "error: ..." for routes whose DNS
+	// record the control plane manages, empty for the others.
+	DNSStatus string `json:"dns_status,omitempty"`
 	CreatedAt string `json:"created_at,omitempty"`
 	UpdatedAt string `json:"updated_at,omitempty"`
 }
 
+// RouteFields names the route settings a RoutePatch changes.
+type RouteFields uint32
+
+const (
+	RouteTarget RouteFields = 1 << iota
+	RouteEnabled
+	RouteExpiry
+	RouteRateLimit
+	RouteSplit
+	// RouteLimits covers Timeout and MaxBodyBytes.
+	RouteLimits
+	RouteIPFilter
+	RouteAuth
+	RouteRewrite
+	RouteHeaderRules
+	RouteACMEPassthrough
+	// RouteType covers Redirect and Static.
+	RouteType
+	RouteAliases
+	RouteCache
+	RouteMirror
+)
+
+// RoutePatch sets the route settings named in Fields to their values in
+// Route and leaves the others alone; a nil or empty value clears the
+// setting. Stores apply a patch in one write, so its fields change together
+// or not at all.
+type RoutePatch struct {
+	Fields RouteFields
+	Route  Route
+}
+
+func (p RoutePatch) has(f RouteFields) bool {
+	return p.Fields&f != 0
+}
+
+// ListOptions filters and pages SearchTunnels and SearchRoutes. Empty fields
+// do not filter and a zero Limit returns every row after Offset.
+type ListOptions struct {
+	OwnerID string
+	// TunnelID only applies to routes.
+	TunnelID string
+	// Query matches route hostnames and, for tunnels, names as a
+	// case-insensitive substring; a tunnel also matches through its routes.
+	Query string
+	// ExpiredBy, when set, keeps only rows whose expiry is at or before it.
+	ExpiredBy time.Time
+	// GatewayOnly keeps only the routes the tunnel server answers itself:
+	// redirects, static responses, routes under maintenance and routes
+	// with ACME passthrough, which the server needs once they are disabled.
+	GatewayOnly bool
+	Limit       int
+	Offset      int
+}
+
+// Usage is the traffic a tunnel served on one hostname during the hour that
+// starts at HourStart, as reported by the tunnel servers.
+type Usage struct {
+	TunnelID  string `json:"tunnel_id"`
+	Hostname  string `json:"hostname"`
+	HourStart string `json:"hour_start"`
+	Requests  int64  `json:"requests"`
+	BytesIn   int64  `json:"bytes_in"`
+	BytesOut  int64  `json:"bytes_out"`
+}
+
+// UsageQuery filters QueryUsage by tunnel and by the hour a row starts in;
+// zero fields do not filter.
+type UsageQuery struct {
+	TunnelID string
+	Since    time.Time
+	Until    time.Time
+}
+
 type RegisterSessionRequest struct {
 	UserID      string         `json:"user_id"`
 	Project     string         `json:"project"`
@@ -39,9 +180,20 @@ type RegisterSessionRequest struct {
 	ClientIP    string         `json:"client_ip,omitempty"`
 	OSType      string         `json:"os_type,omitempty"`
 	Metadata    map[string]any `json:"metadata,omitempty"`
+	// ExpiresAt (RFC 3339) or TTL (a duration such as "72h") limits how long
+	// the tunnel and its route live.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
 }
 
 type AgentRoutesResponse struct {
 	TunnelID string           `json:"tunnel_id"`
+	Version  string           `json:"version,omitempty"`
 	Routes   []protocol.Route `json:"routes"`
+
+	// BaseVersion is set when the response is a delta against the version the
+	// agent reported; Added and Removed then replace Routes.
+	BaseVersion string           `json:"base_version,omitempty"`
+	Added       []protocol.Route `json:"added,omitempty"`
+	Removed     []string         `json:"removed,omitempty"`
 }
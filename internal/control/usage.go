@@ -0,0 +1,130 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// usageReport is what tunnel servers post to /api/usage: the traffic each
+// hostname served since their previous report.
+type usageReport struct {
+	Node  string `json:"node"`
+	Usage []struct {
+		Hostname string `json:"hostname"`
+		TunnelID string `json:"tunnel_id"`
+		Requests int64  `json:"requests"`
+		BytesIn  int64  `json:"bytes_in"`
+		BytesOut int64  `json:"bytes_out"`
+	} `json:"usage"`
+}
+
+type usageTotals struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleQueryUsage(w, r)
+	case http.MethodPost:
+		s.handleReportUsage(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReportUsage adds a tunnel server's report to the current hour.
+// Rows without a tunnel_id, from agents that connect without one, are
+// attributed through the route of their hostname.
+func (s *Server) handleReportUsage(w http.ResponseWriter, r *http.Request) {
+	if !caller(r).Admin {
+		errorJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	var req usageReport
+	if err := decodeJSON(r.Body, &req); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	hour := formatStoredTime(time.Now().UTC().Truncate(time.Hour))
+	merged := make(map[usageKey]*Usage)
+	var rows []Usage
+	unknown := 0
+	for _, u := range req.Usage {
+		hostname := strings.ToLower(strings.TrimSpace(u.Hostname))
+		tunnelID := strings.TrimSpace(u.TunnelID)
+		if tunnelID == "" && hostname != "" {
+			if route, err := s.store.GetRouteByHostname(ctx, hostname); err == nil {
+				tunnelID = route.TunnelID
+			} else if route, ok, _ := s.routeByAlias(ctx, hostname); ok {
+				tunnelID = route.TunnelID
+			}
+		}
+		if hostname == "" || tunnelID == "" {
+			unknown++
+			continue
+		}
+		key := usageKey{tunnelID, hostname, hour}
+		row := merged[key]
+		if row == nil {
+			rows = append(rows, Usage{TunnelID: tunnelID, Hostname: hostname, HourStart: hour})
+			row = &rows[len(rows)-1]
+			merged[key] = row
+		}
+		row.Requests += max(u.Requests, 0)
+		row.BytesIn += max(u.BytesIn, 0)
+		row.BytesOut += max(u.BytesOut, 0)
+	}
+	if len(rows) > 0 {
+		if err := s.store.AddUsage(ctx, rows); err != nil {
+			s.events.Add("error", "usage.report.failed", "", "node="+req.Node+" err="+err.Error())
+			errorJSON(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ok":       true,
+		"recorded": len(rows),
+		"unknown":  unknown,
+	})
+}
+
+func (s *Server) handleQueryUsage(w http.ResponseWriter, r *http.Request) {
+	tunnelID := strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
+	if !s.checkTunnelScope(w, r, tunnelID) {
+		return
+	}
+	q := UsageQuery{TunnelID: tunnelID}
+	var err error
+	if q.Since, q.Until, err = timeRange(r); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	rows, err := s.store.QueryUsage(ctx, q)
+	if err != nil {
+		errorJSON(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	var totals usageTotals
+	for _, u := range rows {
+		totals.Requests += u.Requests
+		totals.BytesIn += u.BytesIn
+		totals.BytesOut += u.BytesOut
+	}
+	if rows == nil {
+		rows = []Usage{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"usage":  rows,
+		"totals": totals,
+	})
+}
@@ -0,0 +1,102 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreAddsUpUsage(t *testing.T) {
+	mem, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	for name, store := range map[string]Store{"memory": mem, "sqlite": openTestSQLStore(t)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			rows := []Usage{
+				{TunnelID: "t1", Hostname: "a.example.com", HourStart: "2030-01-02T10:00:00Z", Requests: 1, BytesIn: 10, BytesOut: 100},
+				{TunnelID: "t1", Hostname: "a.example.com", HourStart: "2030-01-02T11:00:00Z", Requests: 2, BytesIn: 20, BytesOut: 200},
+				{TunnelID: "t2", Hostname: "b.example.com", HourStart: "2030-01-02T11:00:00Z", Requests: 3, BytesIn: 30, BytesOut: 300},
+			}
+			if err := store.AddUsage(ctx, rows); err != nil {
+				t.Fatalf("AddUsage: %v", err)
+			}
+			if err := store.AddUsage(ctx, rows[1:2]); err != nil {
+				t.Fatalf("AddUsage again: %v", err)
+			}
+			got, err := store.QueryUsage(ctx, UsageQuery{TunnelID: "t1"})
+			if err != nil {
+				t.Fatalf("QueryUsage: %v", err)
+			}
+			if len(got) != 2 || got[0].HourStart != "2030-01-02T11:00:00Z" || got[0].Requests != 4 || got[0].BytesOut != 400 || got[1].Requests != 1 {
+				t.Fatalf("usage of t1 = %+v", got)
+			}
+			since, _ := time.Parse(time.RFC3339, "2030-01-02T11:00:00Z")
+			got, err = store.QueryUsage(ctx, UsageQuery{Since: since})
+			if err != nil || len(got) != 2 || got[0].Hostname != "a.example.com" || got[1].Hostname != "b.example.com" {
+				t.Fatalf("usage since 11:00 = %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestUsageAPI(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	bob, _ := store.CreateTunnelWithMeta(ctx, "b", "tb", "bob", "web", "", "", nil)
+	if _, err := store.CreateRoute(ctx, Route{TunnelID: bob.ID, Hostname: "bob.example.com", Target: "127.0.0.1:1", Enabled: true}); err != nil {
+		t.Fatalf("CreateRoute: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+	srv.SetAPIAuth([]string{"k1"}, "jwt-secret")
+	handler := srv.Handler()
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	asBob := signJWT("jwt-secret", `{"sub":"bob","exp":`+exp+`}`)
+
+	do := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	report := `{"node":"n1","usage":[` +
+		`{"hostname":"bob.example.com","requests":2,"bytes_in":10,"bytes_out":20},` +
+		`{"hostname":"Bob.example.com","tunnel_id":"` + bob.ID + `","requests":1,"bytes_in":5,"bytes_out":5},` +
+		`{"hostname":"gone.example.com","requests":7}]}`
+	if rec := do("POST", "/api/usage", asBob, report); rec.Code != http.StatusForbidden {
+		t.Fatalf("user posting usage = %d, want 403", rec.Code)
+	}
+	rec := do("POST", "/api/usage", "k1", report)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"recorded":1`) || !strings.Contains(rec.Body.String(), `"unknown":1`) {
+		t.Fatalf("report = %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do("GET", "/api/usage", asBob, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("user listing all usage = %d, want 403", rec.Code)
+	}
+	rec = do("GET", "/api/usage?tunnel_id="+bob.ID, asBob, "")
+	var resp struct {
+		Usage  []Usage     `json:"usage"`
+		Totals usageTotals `json:"totals"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("usage = %d %s", rec.Code, rec.Body.String())
+	}
+	if len(resp.Usage) != 1 || resp.Totals != (usageTotals{Requests: 3, BytesIn: 15, BytesOut: 25}) {
+		t.Fatalf("usage = %+v", resp)
+	}
+	if rec := do("GET", "/api/usage?since=yesterday", "k1", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad since = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,203 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookQueueSize       = 256
+	webhookAttempts        = 5
+	webhookTimeout         = 10 * time.Second
+	authFailureBurst       = 5
+	authFailureWindow      = 5 * time.Minute
+	authRepeatedEvent      = "auth.failed.repeated"
+	webhookSignatureHeader = "X-Tunneling-Signature-256"
+)
+
+// Webhook is one subscription to control events. Events holds event names
+// or path.Match patterns such as "route.*"; empty means every event.
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Validate checks the URL and the event patterns.
+func (h Webhook) Validate() error {
+	u, err := url.Parse(strings.TrimSpace(h.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url %q must be an http or https url", h.URL)
+	}
+	for _, pattern := range h.Events {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("webhook event pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, pattern := range h.Events {
+		if ok, _ := path.Match(pattern, event); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload carries the entry plus a text line, so Slack incoming
+// webhooks can take it unchanged.
+type webhookPayload struct {
+	Text  string   `json:"text"`
+	Entry LogEntry `json:"event"`
+}
+
+// RunWebhooks posts every event a subscription asks for to its URL until ctx
+// is done. Bodies are signed with HMAC-SHA256 of the subscription secret in
+// the X-Tunneling-Signature-256 header; failed deliveries are retried with
+// exponential backoff. It also records auth.failed.repeated when a tunnel
+// fails authentication authFailureBurst times within authFailureWindow.
+func (s *Server) RunWebhooks(ctx context.Context, hooks []Webhook) {
+	entries, unsubscribe := s.events.Subscribe(webhookQueueSize)
+	defer unsubscribe()
+
+	queues := make([]chan LogEntry, len(hooks))
+	for i, hook := range hooks {
+		queues[i] = make(chan LogEntry, webhookQueueSize)
+		d := &webhookDelivery{hook: hook, client: &http.Client{Timeout: webhookTimeout}, retryDelay: time.Second}
+		go d.run(ctx, queues[i])
+	}
+	failures := make(map[string][]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-entries:
+			for i, hook := range hooks {
+				if !hook.wants(e.Event) {
+					continue
+				}
+				select {
+				case queues[i] <- e:
+				default:
+					slog.Warn("webhook is falling behind, dropped event", "url", hook.URL, "event_id", e.ID)
+				}
+			}
+			if authFailure(e.Event) && e.TunnelID != "" {
+				s.countAuthFailure(failures, e, time.Now())
+			}
+		}
+	}
+}
+
+func authFailure(event string) bool {
+	return strings.HasSuffix(event, "auth_failed") || strings.HasSuffix(event, "auth.failed") || strings.HasSuffix(event, ".unauthorized")
+}
+
+func (s *Server) countAuthFailure(failures map[string][]time.Time, e LogEntry, now time.Time) {
+	recent := failures[e.TunnelID][:0]
+	for _, at := range failures[e.TunnelID] {
+		if now.Sub(at) < authFailureWindow {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < authFailureBurst {
+		failures[e.TunnelID] = recent
+		return
+	}
+	delete(failures, e.TunnelID)
+	s.events.Add("warn", authRepeatedEvent, e.TunnelID, fmt.Sprintf("%d authentication failures within %s, last: %s", len(recent), authFailureWindow, e.Event))
+}
+
+type webhookDelivery struct {
+	hook       Webhook
+	client     *http.Client
+	retryDelay time.Duration
+}
+
+func (d *webhookDelivery) run(ctx context.Context, queue <-chan LogEntry) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-queue:
+			if err := d.deliver(ctx, e); err != nil && ctx.Err() == nil {
+				slog.Warn("webhook delivery failed, giving up on event", "url", d.hook.URL, "event_id", e.ID, "err", err)
+			}
+		}
+	}
+}
+
+// deliver posts e, retrying network errors, 429 and 5xx answers.
+func (d *webhookDelivery) deliver(ctx context.Context, e LogEntry) error {
+	body, err := json.Marshal(webhookPayload{
+		Text:  fmt.Sprintf("[%s] %s %s: %s", e.Level, e.Event, e.TunnelID, e.Message),
+		Entry: e,
+	})
+	if err != nil {
+		return err
+	}
+	delay := d.retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(ctx, e, body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (d *webhookDelivery) post(ctx context.Context, e LogEntry, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tunneling-Event", e.Event)
+	req.Header.Set("X-Tunneling-Delivery", strconv.FormatInt(e.ID, 10))
+	if d.hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(d.hook.Secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = errors.New("unexpected status " + resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body keyed with secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
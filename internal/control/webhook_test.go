@@ -0,0 +1,101 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliversSignedFilteredEvents(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	srv := NewServer(store, "", "", "", "", "")
+
+	type delivery struct {
+		event, signature string
+		body             []byte
+	}
+	got := make(chan delivery, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- delivery{r.Header.Get("X-Tunneling-Event"), r.Header.Get(webhookSignatureHeader), body}
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hooks := []Webhook{{URL: receiver.URL, Secret: "s3cret", Events: []string{"route.*", authRepeatedEvent}}}
+	go srv.RunWebhooks(ctx, hooks)
+	// Wait for the subscription so the first event is not missed.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		srv.events.mu.RLock()
+		n := len(srv.events.subs)
+		srv.events.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhooks never subscribed")
+		}
+	}
+	next := func() delivery {
+		t.Helper()
+		select {
+		case d := <-got:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhook")
+			return delivery{}
+		}
+	}
+
+	srv.events.Add("info", "tunnel.created", "t1", "not subscribed")
+	srv.events.Add("info", "route.added", "t1", "app.example.com")
+	d := next()
+	if d.event != "route.added" || d.signature != "sha256="+webhookSignature("s3cret", d.body) {
+		t.Fatalf("delivery = %q %q", d.event, d.signature)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(d.body, &payload); err != nil || payload.Entry.TunnelID != "t1" || payload.Text == "" {
+		t.Fatalf("payload = %s (%v)", d.body, err)
+	}
+
+	for i := 0; i < authFailureBurst; i++ {
+		srv.events.Add("warn", "agent.auth.failed", "t2", "bad token")
+	}
+	if d := next(); d.event != authRepeatedEvent {
+		t.Fatalf("delivery after repeated auth failures = %q", d.event)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	d := &webhookDelivery{hook: Webhook{URL: receiver.URL}, client: receiver.Client(), retryDelay: time.Millisecond}
+	if err := d.deliver(context.Background(), LogEntry{ID: 1, Event: "route.added"}); err != nil || calls != 3 {
+		t.Fatalf("deliver = %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	d.hook.URL = rejecting.URL
+	if err := d.deliver(context.Background(), LogEntry{ID: 2, Event: "route.added"}); err == nil || calls != 1 {
+		t.Fatalf("deliver to a 400 endpoint = %v after %d calls, want one failed call", err, calls)
+	}
+}
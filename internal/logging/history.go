@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	historyLines   = 1000
+	followerBuffer = 256
+)
+
+// history keeps the last log lines written through Setup for TailHandler.
+var history = &lineRing{max: historyLines}
+
+// lineRing is an io.Writer remembering the last max lines written to it and
+// passing new ones to followers. Followers that fall behind miss lines.
+type lineRing struct {
+	mu        sync.Mutex
+	max       int
+	lines     []string
+	followers map[chan string]struct{}
+}
+
+func (r *lineRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if len(r.lines) == r.max {
+			copy(r.lines, r.lines[1:])
+			r.lines = r.lines[:r.max-1]
+		}
+		r.lines = append(r.lines, line)
+		for ch := range r.followers {
+			select {
+			case ch <- line:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// tail returns up to n of the most recent lines, oldest first.
+func (r *lineRing) tail(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > len(r.lines) {
+		n = len(r.lines)
+	}
+	return append([]string(nil), r.lines[len(r.lines)-n:]...)
+}
+
+// follow returns the last n lines and a channel receiving every later one
+// until stop is called.
+func (r *lineRing) follow(n int) ([]string, <-chan string, func()) {
+	ch := make(chan string, followerBuffer)
+	lines := r.tail(n)
+	r.mu.Lock()
+	if r.followers == nil {
+		r.followers = make(map[chan string]struct{})
+	}
+	r.followers[ch] = struct{}{}
+	r.mu.Unlock()
+	return lines, ch, func() {
+		r.mu.Lock()
+		delete(r.followers, ch)
+		r.mu.Unlock()
+	}
+}
+
+// TailHandler serves the recent log lines as text: ?lines=N picks how many
+// (default 100), and ?follow=1 keeps the response open and streams new lines
+// as they are logged. Callers mount it behind their own authentication.
+func TailHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n := 100
+		if v := r.URL.Query().Get("lines"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				http.Error(w, "lines must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		out := bufio.NewWriter(w)
+		follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+		if !follow {
+			for _, line := range history.tail(n) {
+				_, _ = out.WriteString(line + "\n")
+			}
+			_ = out.Flush()
+			return
+		}
+
+		lines, next, stop := history.follow(n)
+		defer stop()
+		flusher, _ := w.(http.Flusher)
+		flush := func() bool {
+			if err := out.Flush(); err != nil {
+				return false
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return true
+		}
+		for _, line := range lines {
+			_, _ = out.WriteString(line + "\n")
+		}
+		if !flush() {
+			return
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line := <-next:
+				_, _ = out.WriteString(line + "\n")
+				// Batch a burst of lines into one write.
+				if len(next) == 0 && !flush() {
+					return
+				}
+			}
+		}
+	})
+}
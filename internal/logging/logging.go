@@ -0,0 +1,97 @@
+// Package logging sets up the structured logger shared by the server, agent
+// and control binaries.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// level is the minimum level of the process logger; Handler changes it at
+// runtime.
+var level = new(slog.LevelVar)
+
+// Setup makes a text or json logger writing to w at levelName the default
+// for slog and for the standard log package. The last lines are also kept
+// for TailHandler.
+func Setup(levelName, format string, w io.Writer) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	w = io.MultiWriter(w, history)
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log format %q must be text or json", format)
+	}
+	level.Set(l)
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// ParseLevel accepts debug, info, warn and error in any case.
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("log level %q must be debug, info, warn or error", name)
+	}
+	return l, nil
+}
+
+// Level reports the current minimum level.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// Handler serves the log level: GET reports it and PUT {"level":"debug"}
+// changes it until the next restart. Callers mount it behind their own
+// authentication.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var req struct {
+				Level string `json:"level"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil || strings.TrimSpace(req.Level) == "" {
+				writeLevel(w, http.StatusBadRequest, map[string]string{"error": `body must be {"level": "debug|info|warn|error"}`})
+				return
+			}
+			l, err := ParseLevel(req.Level)
+			if err != nil {
+				writeLevel(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if old := level.Level(); old != l {
+				level.Set(l)
+				slog.Warn("log level changed", "from", old.String(), "to", l.String())
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeLevel(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeLevel(w, http.StatusOK, map[string]string{"level": strings.ToLower(level.Level().String())})
+	})
+}
+
+func writeLevel(w http.ResponseWriter, status int, body map[string]string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupFormatsAndLevel(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	if err := Setup("warn", "json", &buf); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	slog.Info("hidden")
+	slog.Warn("shown", "hostname", "app.example.com")
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line["msg"] != "shown" || line["hostname"] != "app.example.com" {
+		t.Fatalf("log output = %q, %v", buf.String(), err)
+	}
+	if err := Setup("loud", "text", &buf); err == nil {
+		t.Fatalf("Setup accepted level loud")
+	}
+	if err := Setup("info", "xml", &buf); err == nil {
+		t.Fatalf("Setup accepted format xml")
+	}
+}
+
+func TestHandlerChangesLevel(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	if err := Setup("info", "text", &bytes.Buffer{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	h := Handler()
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/api/log-level", strings.NewReader(body)))
+		return rec
+	}
+	if rec := do(http.MethodPut, `{"level":"DEBUG"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"debug"`) || Level() != slog.LevelDebug {
+		t.Fatalf("PUT debug = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, `{"level":"verbose"}`); rec.Code != http.StatusBadRequest || Level() != slog.LevelDebug {
+		t.Fatalf("PUT verbose = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"debug"`) {
+		t.Fatalf("GET = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTailHandler(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	if err := Setup("info", "text", &bytes.Buffer{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	slog.Info("first")
+	slog.Info("second")
+	slog.Info("third")
+
+	rec := httptest.NewRecorder()
+	TailHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/logs?lines=2", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 2 || !strings.Contains(lines[0], "msg=second") || !strings.Contains(lines[1], "msg=third") {
+		t.Fatalf("tail = %d %q", rec.Code, rec.Body)
+	}
+
+	srv := httptest.NewServer(TailHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?lines=0&follow=1")
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	defer resp.Body.Close()
+	// The handler has subscribed once the (empty) backlog is flushed.
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		history.mu.Lock()
+		n := len(history.followers)
+		history.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("follower never subscribed")
+		}
+	}
+	slog.Warn("fourth")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.Contains(line, "msg=fourth") {
+		t.Fatalf("followed line = %q, %v", line, err)
+	}
+}
@@ -0,0 +1,307 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a minimal Prometheus-compatible metrics registry. It only
+// supports what the tunnel binaries need: counters, gauges and histograms
+// with string labels, rendered in the text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+	r.register(v)
+	return v
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{metricName: name, help: help, fn: fn})
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	v := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: sorted}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(w)
+	})
+}
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type vec struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{metricName: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+func (v *vec) name() string { return v.metricName }
+
+func (v *vec) get(values []string, buckets int) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if buckets > 0 {
+			s.counts = make([]uint64, buckets)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) sortedSeries() []*series {
+	out := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, "\xff") < strings.Join(out[j].labelValues, "\xff")
+	})
+	return out
+}
+
+// LabelValues lists the label values of every series, sorted.
+func (v *vec) LabelValues() [][]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := make([][]string, 0, len(v.series))
+	for _, s := range v.sortedSeries() {
+		out = append(out, append([]string(nil), s.labelValues...))
+	}
+	return out
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, v.kind)
+}
+
+type CounterVec struct{ vec }
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues, 0).value += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(labelValues, 0).value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, formatLabels(c.labels, s.labelValues, "", ""), formatFloat(s.value))
+	}
+}
+
+type GaugeVec struct{ vec }
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues, 0).value = value
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues, 0).value += delta
+}
+
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.series, strings.Join(labelValues, "\xff"))
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	for _, s := range g.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, formatLabels(g.labels, s.labelValues, "", ""), formatFloat(s.value))
+	}
+}
+
+type gaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.metricName, g.help, g.metricName, g.metricName, formatFloat(g.fn()))
+}
+
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues, len(h.buckets))
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count is the number of observations in a series.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// Quantile estimates the q-quantile (0..1) of a series by linear
+// interpolation inside the bucket that contains it.
+func (h *HistogramVec) Quantile(q float64, labelValues ...string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[strings.Join(labelValues, "\xff")]
+	if !ok || s.count == 0 {
+		return 0
+	}
+	rank := q * float64(s.count)
+	lower, prevCount := 0.0, uint64(0)
+	for i, upper := range h.buckets {
+		if float64(s.counts[i]) >= rank {
+			inBucket := s.counts[i] - prevCount
+			if inBucket == 0 {
+				return upper
+			}
+			return lower + (upper-lower)*(rank-float64(prevCount))/float64(inBucket)
+		}
+		lower, prevCount = upper, s.counts[i]
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, s := range h.sortedSeries() {
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.labelValues, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, s.labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+"="+strconv.Quote(values[i]))
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+"="+strconv.Quote(extraValue))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
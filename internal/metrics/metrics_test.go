@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesPrometheusText(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("tunnel_requests_total", "Requests.", "host")
+	requests.Inc("a.example.com")
+	requests.Add(2, "a.example.com")
+	reg.NewGaugeFunc("tunnel_sessions", "Sessions.", func() float64 { return 3 })
+	latency := reg.NewHistogram("tunnel_latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+
+	var buf bytes.Buffer
+	reg.WritePrometheus(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`tunnel_requests_total{host="a.example.com"} 3`,
+		`tunnel_sessions 3`,
+		`tunnel_latency_seconds_bucket{le="0.1"} 1`,
+		`tunnel_latency_seconds_bucket{le="+Inf"} 2`,
+		`tunnel_latency_seconds_count 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.NewHistogram("latency", "Latency.", []float64{1, 2, 4})
+	for i := 0; i < 10; i++ {
+		h.Observe(0.5)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(3)
+	}
+	if got := h.Quantile(0.5); got > 1 {
+		t.Fatalf("p50 = %v, want <= 1", got)
+	}
+	if got := h.Quantile(0.99); got <= 2 || got > 4 {
+		t.Fatalf("p99 = %v, want in (2,4]", got)
+	}
+	if got := h.Count(); got != 20 {
+		t.Fatalf("count = %d, want 20", got)
+	}
+	if got := h.LabelValues(); len(got) != 1 || len(got[0]) != 0 {
+		t.Fatalf("label values = %v", got)
+	}
+}
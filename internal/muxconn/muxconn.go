@@ -0,0 +1,437 @@
+// Package muxconn carries the agent connection over a multiplexed session
+// instead of a single websocket: envelopes, pings and close frames travel
+// on a control stream opened by the agent, and every proxied request gets
+// a stream of its own, opened by the server when it sends the request.
+// Conn implements wsconn.RequestConn, so the server and agent loops work
+// on it unchanged.
+package muxconn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session is a multiplexed connection between agent and server.
+type Session interface {
+	// OpenStream opens a stream without waiting for the peer to accept it.
+	OpenStream() (Stream, error)
+	AcceptStream(ctx context.Context) (Stream, error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Stream is one stream of a Session. Close ends only the writing side.
+type Stream interface {
+	io.ReadWriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// frameOpen starts a request stream; its payload is the request id. The
+// other frame kinds are the websocket message types.
+const frameOpen = 0x20
+
+// maxControlPayload matches the websocket limit for control frames.
+const maxControlPayload = 125
+
+var errReadLimit = errors.New("muxconn: message exceeds read limit")
+
+type message struct {
+	kind int
+	data []byte
+}
+
+type requestStream struct {
+	mu     sync.Mutex
+	s      Stream
+	closed bool
+}
+
+// Conn is an agent connection over a Session.
+type Conn struct {
+	sess    Session
+	control Stream
+	// opens is set on the server, which opens the request streams; the
+	// agent accepts them.
+	opens bool
+
+	controlMu     sync.Mutex
+	writeDeadline atomic.Pointer[time.Time]
+	readLimit     atomic.Int64
+
+	mu      sync.Mutex
+	streams map[string]*requestStream
+
+	in       chan message
+	done     chan struct{}
+	readErr  error
+	failOnce sync.Once
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	pong         func(string) error
+}
+
+// New runs a Conn on sess with control as its control stream. opens is
+// set on the side that opens request streams.
+func New(sess Session, control Stream, opens bool) *Conn {
+	c := &Conn{
+		sess:    sess,
+		control: control,
+		opens:   opens,
+		streams: make(map[string]*requestStream),
+		in:      make(chan message, 64),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go c.readControl()
+	if !opens {
+		go c.acceptStreams()
+	}
+	return c
+}
+
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.kind, m.data, nil
+	default:
+	}
+	for {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		m, err, ok := c.wait(timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if ok {
+			return m.kind, m.data, err
+		}
+		// Timed out, unless the pong handler moved the deadline meanwhile.
+	}
+}
+
+// wait returns the next message or the error that ended reading, and false
+// once timeout fires first.
+func (c *Conn) wait(timeout <-chan time.Time) (message, error, bool) {
+	select {
+	case m := <-c.in:
+		return m, nil, true
+	case <-c.done:
+		select {
+		case m := <-c.in:
+			return m, nil, true
+		default:
+		}
+		return message{}, c.readErr, true
+	case <-c.closed:
+		return message{}, net.ErrClosed, true
+	case <-timeout:
+		return message{}, nil, false
+	}
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return fmt.Errorf("muxconn: unsupported message type %d", messageType)
+	}
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	c.applyWriteDeadline(c.control)
+	return writeFrame(c.control, messageType, data)
+}
+
+// WriteControl writes a ping, pong or close frame on the control stream.
+func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+	default:
+		return fmt.Errorf("muxconn: unsupported control message type %d", messageType)
+	}
+	if len(data) > maxControlPayload {
+		return errors.New("muxconn: control frame too long")
+	}
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	_ = c.control.SetWriteDeadline(deadline)
+	return writeFrame(c.control, messageType, data)
+}
+
+func (c *Conn) WriteRequestMessage(requestID string, open bool, messageType int, data []byte) error {
+	c.mu.Lock()
+	rs := c.streams[requestID]
+	fresh := false
+	if rs == nil && open && c.opens {
+		// Out of streams, the request goes on the control stream.
+		if s, err := c.sess.OpenStream(); err == nil {
+			rs = &requestStream{s: s}
+			c.streams[requestID] = rs
+			fresh = true
+		}
+	}
+	c.mu.Unlock()
+	if rs == nil {
+		return c.WriteMessage(messageType, data)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return c.WriteMessage(messageType, data)
+	}
+	c.applyWriteDeadline(rs.s)
+	if fresh {
+		if err := writeFrame(rs.s, frameOpen, []byte(requestID)); err != nil {
+			return err
+		}
+		go c.readStream(requestID, rs)
+	}
+	return writeFrame(rs.s, messageType, data)
+}
+
+// Release closes the writing side of the request's stream. Its reader keeps
+// going until the peer closes its side in turn.
+func (c *Conn) Release(requestID string) {
+	c.mu.Lock()
+	rs := c.streams[requestID]
+	delete(c.streams, requestID)
+	c.mu.Unlock()
+	if rs != nil {
+		rs.close()
+	}
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(&t)
+	return nil
+}
+
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	c.deadlineMu.Lock()
+	c.pong = h
+	c.deadlineMu.Unlock()
+}
+
+// SetReadLimit bounds the size of a message; larger ones fail the
+// connection like they do on a websocket.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit.Store(limit)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.sess.RemoteAddr()
+}
+
+// Close tears down the session with every stream on it.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.sess.Close()
+	})
+	return err
+}
+
+func (c *Conn) applyWriteDeadline(s Stream) {
+	if d := c.writeDeadline.Load(); d != nil {
+		_ = s.SetWriteDeadline(*d)
+	}
+}
+
+func (c *Conn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.readErr = err
+		close(c.done)
+	})
+}
+
+func (c *Conn) deliver(m message) bool {
+	select {
+	case c.in <- m:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *Conn) readControl() {
+	for {
+		kind, data, err := readFrame(c.control, c.readLimit.Load())
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch kind {
+		case websocket.TextMessage, websocket.BinaryMessage:
+			if !c.deliver(message{kind: kind, data: data}) {
+				return
+			}
+		case websocket.PingMessage:
+			_ = c.WriteControl(websocket.PongMessage, data, time.Now().Add(time.Second))
+		case websocket.PongMessage:
+			c.deadlineMu.Lock()
+			h := c.pong
+			c.deadlineMu.Unlock()
+			if h != nil {
+				if err := h(string(data)); err != nil {
+					c.fail(err)
+					return
+				}
+			}
+		case websocket.CloseMessage:
+			c.fail(closeError(data))
+			return
+		default:
+			c.fail(fmt.Errorf("muxconn: unexpected frame type %d on the control stream", kind))
+			return
+		}
+	}
+}
+
+func (c *Conn) acceptStreams() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+		case <-c.done:
+		}
+		cancel()
+	}()
+	for {
+		s, err := c.sess.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go c.serveStream(s)
+	}
+}
+
+// serveStream registers a stream the peer opened under the request id of
+// its first frame and reads it.
+func (c *Conn) serveStream(s Stream) {
+	kind, id, err := readFrame(s, maxControlPayload)
+	if err != nil || kind != frameOpen || len(id) == 0 {
+		slog.Debug("drop request stream without a request id", "err", err)
+		_ = s.Close()
+		return
+	}
+	rs := &requestStream{s: s}
+	requestID := string(id)
+	c.mu.Lock()
+	c.streams[requestID] = rs
+	c.mu.Unlock()
+	c.readStream(requestID, rs)
+}
+
+// readStream delivers the messages of a request stream until the peer
+// closes its side, and then closes this side too.
+func (c *Conn) readStream(requestID string, rs *requestStream) {
+	defer func() {
+		c.mu.Lock()
+		if c.streams[requestID] == rs {
+			delete(c.streams, requestID)
+		}
+		c.mu.Unlock()
+		rs.close()
+	}()
+	for {
+		kind, data, err := readFrame(rs.s, c.readLimit.Load())
+		if errors.Is(err, errReadLimit) {
+			c.fail(err)
+			_ = c.Close()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("request stream failed", "request_id", requestID, "err", err)
+			}
+			return
+		}
+		if kind != websocket.TextMessage && kind != websocket.BinaryMessage {
+			slog.Debug("drop request stream with an unexpected frame", "request_id", requestID, "type", kind)
+			return
+		}
+		if !c.deliver(message{kind: kind, data: data}) {
+			return
+		}
+	}
+}
+
+func (rs *requestStream) close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.closed {
+		rs.closed = true
+		_ = rs.s.Close()
+	}
+}
+
+// A frame is its type, the payload length as a big-endian uint32, and the
+// payload.
+func writeFrame(w io.Writer, kind int, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	buf[0] = byte(kind)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(data)))
+	copy(buf[5:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader, limit int64) (int, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if limit > 0 && int64(n) > limit {
+		return 0, nil, errReadLimit
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return int(head[0]), data, nil
+}
+
+// closeError decodes a close frame the way gorilla reports one.
+func closeError(data []byte) error {
+	if len(data) < 2 {
+		return &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+	}
+	return &websocket.CloseError{Code: int(binary.BigEndian.Uint16(data)), Text: string(data[2:])}
+}
@@ -0,0 +1,188 @@
+package muxconn
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/wsconn"
+)
+
+// yamuxPair connects a server and an agent Conn through a websocket.
+func yamuxPair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	served := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn, err := ServeYamux(ws, 5*time.Second)
+		if err != nil {
+			t.Errorf("ServeYamux: %v", err)
+			_ = ws.Close()
+			return
+		}
+		served <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	agent, err := DialYamux(ws)
+	if err != nil {
+		t.Fatalf("DialYamux: %v", err)
+	}
+	t.Cleanup(func() { _ = agent.Close() })
+	select {
+	case server := <-served:
+		t.Cleanup(func() { _ = server.Close() })
+		return server, agent
+	case <-time.After(5 * time.Second):
+		t.Fatal("server side did not come up")
+		return nil, nil
+	}
+}
+
+func readMessage(t *testing.T, c *Conn) string {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if kind != websocket.TextMessage {
+		t.Fatalf("message type = %d, want text", kind)
+	}
+	return string(data)
+}
+
+func streamCount(c *Conn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRequestStreams(t *testing.T) {
+	server, agent := yamuxPair(t)
+	var _ wsconn.RequestConn = server
+
+	if err := agent.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write control message: %v", err)
+	}
+	if got := readMessage(t, server); got != "hello" {
+		t.Fatalf("server read %q, want hello", got)
+	}
+
+	if err := server.WriteRequestMessage("r1", true, websocket.TextMessage, []byte("request")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if got := readMessage(t, agent); got != "request" {
+		t.Fatalf("agent read %q, want request", got)
+	}
+	if n := streamCount(agent); n != 1 {
+		t.Fatalf("agent has %d request streams, want 1", n)
+	}
+	if err := agent.WriteRequestMessage("r1", false, websocket.TextMessage, []byte("response")); err != nil {
+		t.Fatalf("write response: %v", err)
+	}
+	if got := readMessage(t, server); got != "response" {
+		t.Fatalf("server read %q, want response", got)
+	}
+
+	// Only the opening message of a request opens a stream.
+	if err := server.WriteRequestMessage("r2", false, websocket.TextMessage, []byte("cancel")); err != nil {
+		t.Fatalf("write stray message: %v", err)
+	}
+	if got := readMessage(t, agent); got != "cancel" {
+		t.Fatalf("agent read %q, want cancel", got)
+	}
+	if n := streamCount(server); n != 1 {
+		t.Fatalf("server has %d request streams, want 1", n)
+	}
+
+	server.Release("r1")
+	waitFor(t, "the agent to close its side of the stream", func() bool { return streamCount(agent) == 0 })
+	// Late messages of a released request still arrive, on the control
+	// stream.
+	if err := agent.WriteRequestMessage("r1", false, websocket.TextMessage, []byte("late")); err != nil {
+		t.Fatalf("write late message: %v", err)
+	}
+	if got := readMessage(t, server); got != "late" {
+		t.Fatalf("server read %q, want late", got)
+	}
+	if n := streamCount(server); n != 0 {
+		t.Fatalf("server has %d request streams after release, want 0", n)
+	}
+}
+
+func TestCloseFrameEndsReads(t *testing.T) {
+	server, agent := yamuxPair(t)
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "restarting")
+	if err := server.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	_, _, err := agent.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseServiceRestart || closeErr.Text != "restarting" {
+		t.Fatalf("ReadMessage error = %v, want close 1012", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	server, agent := yamuxPair(t)
+	done := make(chan struct{})
+	defer close(done)
+	wsconn.Keepalive(server, 10*time.Millisecond, done)
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("read ended while the agent answered pings: %v", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+	if err := agent.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := <-read; err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	_ = agent.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := agent.ReadMessage(); !wsconn.IsKeepaliveTimeout(err) {
+		t.Fatalf("read past the deadline = %v, want a timeout", err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	server, agent := yamuxPair(t)
+	server.SetReadLimit(16)
+	if err := agent.WriteRequestMessage("r1", false, websocket.TextMessage, []byte(strings.Repeat("x", 64))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := server.ReadMessage(); !errors.Is(err, errReadLimit) {
+		t.Fatalf("ReadMessage error = %v, want the read limit", err)
+	}
+}
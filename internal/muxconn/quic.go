@@ -0,0 +1,165 @@
+package muxconn
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// TransportQUIC is the transport name agents and servers use for QUIC.
+	TransportQUIC = "quic"
+	// QUICProto is the ALPN protocol of agent connections over QUIC.
+	QUICProto = "tunneling-agent"
+)
+
+// quicCloseWait is how long a closing QUIC session waits for the peer to
+// hang up, so a close frame written just before reaches it.
+const quicCloseWait = time.Second
+
+// QUICConfig returns the QUIC settings of agent connections for both ends.
+// Idle detection is left to wsconn.Keepalive; QUIC's own keepalive only
+// holds NAT bindings open.
+func QUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: 10 * time.Second,
+		MaxIdleTimeout:       90 * time.Second,
+		KeepAlivePeriod:      15 * time.Second,
+		// The server opens a stream per in-flight request.
+		MaxIncomingStreams: 4096,
+	}
+}
+
+// DialQUIC sends the agent's connect request req on a new control stream of
+// qc. It returns the server's response, and the connection when the server
+// accepted it with 200.
+func DialQUIC(ctx context.Context, qc quic.Connection, req *http.Request) (*Conn, *http.Response, error) {
+	control, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := req.Write(control); err != nil {
+		return nil, nil, fmt.Errorf("send connect request: %w", err)
+	}
+	br := bufio.NewReader(control)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read connect response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, nil
+	}
+	return New(quicSession{conn: qc}, bufferedStream{Stream: control, r: br}, false), resp, nil
+}
+
+// QUICAgent is an agent connection over QUIC whose connect request has been
+// read but not answered yet.
+type QUICAgent struct {
+	Request *http.Request
+
+	conn    quic.Connection
+	control quic.Stream
+	r       *bufio.Reader
+}
+
+// AcceptQUIC waits up to timeout for the control stream of qc and reads the
+// agent's connect request from it.
+func AcceptQUIC(qc quic.Connection, timeout time.Duration) (*QUICAgent, error) {
+	ctx, cancel := context.WithTimeout(qc.Context(), timeout)
+	defer cancel()
+	control, err := qc.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = control.SetReadDeadline(time.Now().Add(timeout))
+	br := bufio.NewReader(control)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("read connect request: %w", err)
+	}
+	_ = control.SetReadDeadline(time.Time{})
+	req.RemoteAddr = qc.RemoteAddr().String()
+	return &QUICAgent{Request: req.WithContext(qc.Context()), conn: qc, control: control, r: br}, nil
+}
+
+// Accept answers the connect request with 200 and returns the connection.
+func (a *QUICAgent) Accept() (*Conn, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{TransportHeader: {TransportQUIC}},
+	}
+	if err := resp.Write(a.control); err != nil {
+		_ = a.conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return New(quicSession{conn: a.conn}, bufferedStream{Stream: a.control, r: a.r}, true), nil
+}
+
+// Reject answers the connect request with resp and closes the connection
+// once the agent has hung up or quicCloseWait passed.
+func (a *QUICAgent) Reject(resp *http.Response) {
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	_ = resp.Write(a.control)
+	_ = quicSession{conn: a.conn}.Close()
+}
+
+// Close drops the connection without an answer.
+func (a *QUICAgent) Close() {
+	_ = a.conn.CloseWithError(0, "")
+}
+
+type quicSession struct {
+	conn quic.Connection
+}
+
+func (s quicSession) OpenStream() (Stream, error) {
+	st, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s quicSession) AcceptStream(ctx context.Context) (Stream, error) {
+	st, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s quicSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close gives data still in flight, like a close frame, a moment to arrive
+// before the connection goes away; closing it right away would discard it.
+func (s quicSession) Close() error {
+	go func() {
+		select {
+		case <-s.conn.Context().Done():
+		case <-time.After(quicCloseWait):
+		}
+		_ = s.conn.CloseWithError(0, "")
+	}()
+	return nil
+}
+
+// bufferedStream reads what the handshake's bufio.Reader already took off
+// the stream before reading the stream itself.
+type bufferedStream struct {
+	Stream
+	r io.Reader
+}
+
+func (s bufferedStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
@@ -0,0 +1,137 @@
+package muxconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// TransportYamux is what an agent puts in the transport query parameter
+	// of its connect URL to run yamux on the websocket.
+	TransportYamux = "yamux"
+	// TransportHeader in the upgrade response names the transport the server
+	// agreed to. Servers that predate yamux leave it out and the agent stays
+	// on the plain websocket.
+	TransportHeader = "Tunnel-Transport"
+)
+
+// yamuxWriteTimeout bounds a write to the websocket underneath, so a dead
+// network fails the session instead of hanging its send loop.
+const yamuxWriteTimeout = 10 * time.Second
+
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	// wsconn.Keepalive pings on the control stream instead.
+	cfg.EnableKeepAlive = false
+	// Room for a full window of stream frames (protocol.StreamWindow chunks
+	// of protocol.StreamChunkSize) with their envelope overhead.
+	cfg.MaxStreamWindowSize = 1 << 20
+	cfg.LogOutput = io.Discard
+	return cfg
+}
+
+// ServeYamux runs the server end of a yamux session on ws and waits up to
+// timeout for the agent to open the control stream.
+func ServeYamux(ws *websocket.Conn, timeout time.Duration) (*Conn, error) {
+	sess, err := yamux.Server(&wsStream{ws: ws}, yamuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	control, err := sess.AcceptStreamWithContext(ctx)
+	if err != nil {
+		_ = sess.Close()
+		return nil, err
+	}
+	return New(yamuxSession{sess: sess, remote: ws.RemoteAddr()}, control, true), nil
+}
+
+// DialYamux runs the agent end of a yamux session on ws and opens the
+// control stream.
+func DialYamux(ws *websocket.Conn) (*Conn, error) {
+	sess, err := yamux.Client(&wsStream{ws: ws}, yamuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	control, err := sess.OpenStream()
+	if err != nil {
+		_ = sess.Close()
+		return nil, err
+	}
+	return New(yamuxSession{sess: sess, remote: ws.RemoteAddr()}, control, false), nil
+}
+
+type yamuxSession struct {
+	sess   *yamux.Session
+	remote net.Addr
+}
+
+func (s yamuxSession) OpenStream() (Stream, error) {
+	st, err := s.sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s yamuxSession) AcceptStream(ctx context.Context) (Stream, error) {
+	st, err := s.sess.AcceptStreamWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s yamuxSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s yamuxSession) Close() error {
+	return s.sess.Close()
+}
+
+// wsStream turns the binary messages of a websocket into the byte stream
+// yamux runs on.
+type wsStream struct {
+	ws *websocket.Conn
+	r  io.Reader
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			_, r, err := s.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.r = r
+		}
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	_ = s.ws.SetWriteDeadline(time.Now().Add(yamuxWriteTimeout))
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return s.ws.Close()
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxAgentLabels bounds the labels one agent may report.
+	MaxAgentLabels     = 16
+	maxAgentLabelKey   = 63
+	maxAgentLabelValue = 255
+	maxAgentMetaField  = 255
+)
+
+// AgentMeta describes an agent and the machine it runs on. The agent sends
+// it with its hello; the server shows it in its admin API and passes it on
+// to the control plane.
+type AgentMeta struct {
+	Version  string            `json:"version,omitempty"`
+	OS       string            `json:"os,omitempty"`
+	Arch     string            `json:"arch,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// ParseAgentLabels turns key=value items into labels. Keys are letters,
+// digits, '.', '_', '-' and '/'.
+func ParseAgentLabels(items []string) (map[string]string, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	if len(items) > MaxAgentLabels {
+		return nil, fmt.Errorf("at most %d labels", MaxAgentLabels)
+	}
+	labels := make(map[string]string, len(items))
+	for _, item := range items {
+		key, value, ok := strings.Cut(item, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !validLabelKey(key) {
+			return nil, fmt.Errorf("label %q: want key=value with a key of letters, digits, . _ - /", item)
+		}
+		if len(value) > maxAgentLabelValue {
+			return nil, fmt.Errorf("label %q: value longer than %d bytes", key, maxAgentLabelValue)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// SanitizeAgentMeta copies m, cutting over-long fields and dropping labels
+// ParseAgentLabels would refuse, so a peer cannot make the server store
+// arbitrary data. A nil m stays nil.
+func SanitizeAgentMeta(m *AgentMeta) *AgentMeta {
+	if m == nil {
+		return nil
+	}
+	out := &AgentMeta{
+		Version:  clip(m.Version, maxAgentMetaField),
+		OS:       clip(m.OS, maxAgentMetaField),
+		Arch:     clip(m.Arch, maxAgentMetaField),
+		Hostname: clip(m.Hostname, maxAgentMetaField),
+	}
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		if validLabelKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(out.Labels) == MaxAgentLabels {
+			break
+		}
+		if out.Labels == nil {
+			out.Labels = make(map[string]string)
+		}
+		out.Labels[k] = clip(m.Labels[k], maxAgentLabelValue)
+	}
+	return out
+}
+
+func validLabelKey(key string) bool {
+	if key == "" || len(key) > maxAgentLabelKey {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-/", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func clip(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAgentLabels(t *testing.T) {
+	got, err := ParseAgentLabels([]string{"env=staging", " team = web "})
+	if err != nil || len(got) != 2 || got["env"] != "staging" || got["team"] != "web" {
+		t.Fatalf("ParseAgentLabels = %v, %v", got, err)
+	}
+	for _, bad := range [][]string{{"noequals"}, {"bad key=x"}, {"=x"}, {"k=" + strings.Repeat("v", 300)}} {
+		if _, err := ParseAgentLabels(bad); err == nil {
+			t.Fatalf("ParseAgentLabels(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSanitizeAgentMeta(t *testing.T) {
+	labels := map[string]string{"bad key": "x", "env": strings.Repeat("v", 300)}
+	for i := 0; i < 20; i++ {
+		labels["k"+strings.Repeat("x", i)] = "y"
+	}
+	got := SanitizeAgentMeta(&AgentMeta{OS: "linux", Hostname: strings.Repeat("h", 300), Labels: labels})
+	if got.OS != "linux" || len(got.Hostname) != maxAgentMetaField || len(got.Labels) != MaxAgentLabels {
+		t.Fatalf("SanitizeAgentMeta = %+v", got)
+	}
+	if _, ok := got.Labels["bad key"]; ok || len(got.Labels["env"]) != maxAgentLabelValue {
+		t.Fatalf("labels = %v", got.Labels)
+	}
+	if SanitizeAgentMeta(nil) != nil {
+		t.Fatal("nil meta was not kept nil")
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxRouteAliases caps how many extra hostnames one route may carry.
+const MaxRouteAliases = 20
+
+// NormalizeAliases lower-cases and sorts the aliases of the route for
+// hostname, dropping duplicates and hostname itself. Empty means none.
+func NormalizeAliases(hostname string, aliases []string) ([]string, error) {
+	seen := map[string]bool{hostname: true}
+	var out []string
+	for _, alias := range aliases {
+		host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(alias)), ".")
+		switch {
+		case host == "":
+			return nil, errors.New("aliases cannot contain an empty hostname")
+		case strings.ContainsAny(host, " :/"):
+			return nil, fmt.Errorf("alias %q must be a plain hostname", alias)
+		case !strings.Contains(host, "."):
+			return nil, fmt.Errorf("alias %q must be a domain, e.g. www.example.com", alias)
+		}
+		if !seen[host] {
+			seen[host] = true
+			out = append(out, host)
+		}
+	}
+	if len(out) > MaxRouteAliases {
+		return nil, fmt.Errorf("a route can have at most %d aliases", MaxRouteAliases)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Hostnames returns Hostname followed by the route's aliases.
+func (r Route) Hostnames() []string {
+	return append([]string{r.Hostname}, r.Aliases...)
+}
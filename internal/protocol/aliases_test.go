@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeAliases(t *testing.T) {
+	got, err := NormalizeAliases("www.example.com", []string{" Example.com. ", "www.example.com", "example.com", "b.example.com"})
+	if err != nil {
+		t.Fatalf("NormalizeAliases: %v", err)
+	}
+	if want := []string{"b.example.com", "example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("aliases = %v, want %v", got, want)
+	}
+	if got, err := NormalizeAliases("www.example.com", nil); err != nil || got != nil {
+		t.Fatalf("no aliases = %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "example.com:8080", "localhost", "https://example.com"} {
+		if _, err := NormalizeAliases("www.example.com", []string{bad}); err == nil {
+			t.Fatalf("alias %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxCacheTTL bounds how long the gateway keeps a cached response.
+	MaxCacheTTL = 24 * time.Hour
+	// DefaultCacheMaxTTL applies when a route's cache sets no MaxTTL.
+	DefaultCacheMaxTTL = time.Hour
+	// DefaultCacheEntryBytes and MaxCacheEntryBytes bound the body of one
+	// cached response.
+	DefaultCacheEntryBytes = 1 << 20
+	MaxCacheEntryBytes     = 16 << 20
+)
+
+// Cache lets the gateway answer repeated GET and HEAD requests for a route
+// from memory. Responses are kept for as long as their Cache-Control
+// max-age or s-maxage (or Expires) allows, at most MaxTTL; DefaultTTL keeps
+// those that say nothing, which are not cached without it. Responses marked
+// no-store, private or no-cache, and those setting cookies, are never kept.
+type Cache struct {
+	DefaultTTL    string `json:"default_ttl,omitempty"`
+	MaxTTL        string `json:"max_ttl,omitempty"`
+	MaxEntryBytes int64  `json:"max_entry_bytes,omitempty"`
+}
+
+// NormalizeCache validates c and puts its durations in canonical form. A
+// nil c comes back nil.
+func NormalizeCache(c *Cache) (*Cache, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MaxEntryBytes < 0 || c.MaxEntryBytes > MaxCacheEntryBytes {
+		return nil, fmt.Errorf("cache max_entry_bytes must be between 0 and %d", MaxCacheEntryBytes)
+	}
+	out := &Cache{MaxEntryBytes: c.MaxEntryBytes}
+	var defaultTTL, maxTTL time.Duration
+	var err error
+	if out.DefaultTTL, defaultTTL, err = normalizeCacheTTL("default_ttl", c.DefaultTTL); err != nil {
+		return nil, err
+	}
+	if out.MaxTTL, maxTTL, err = normalizeCacheTTL("max_ttl", c.MaxTTL); err != nil {
+		return nil, err
+	}
+	if maxTTL > 0 && defaultTTL > maxTTL {
+		return nil, errors.New("cache default_ttl cannot exceed max_ttl")
+	}
+	return out, nil
+}
+
+func normalizeCacheTTL(field, raw string) (string, time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return "", 0, fmt.Errorf("cache %s: %w", field, err)
+	}
+	if d < time.Second || d > MaxCacheTTL {
+		return "", 0, fmt.Errorf("cache %s must be between 1s and %s", field, MaxCacheTTL)
+	}
+	return d.String(), d, nil
+}
+
+// TTLs returns how long responses without freshness of their own are kept
+// (zero for not at all) and the longest any response is kept. Values that
+// do not validate fall back to the defaults.
+func (c *Cache) TTLs() (defaultTTL, maxTTL time.Duration) {
+	defaultTTL, _ = time.ParseDuration(c.DefaultTTL)
+	maxTTL, _ = time.ParseDuration(c.MaxTTL)
+	if maxTTL <= 0 || maxTTL > MaxCacheTTL {
+		maxTTL = DefaultCacheMaxTTL
+	}
+	if defaultTTL < 0 {
+		defaultTTL = 0
+	}
+	return min(defaultTTL, maxTTL), maxTTL
+}
+
+// EntryLimit is the largest body the route caches.
+func (c *Cache) EntryLimit() int64 {
+	if c.MaxEntryBytes > 0 {
+		return min(c.MaxEntryBytes, MaxCacheEntryBytes)
+	}
+	return DefaultCacheEntryBytes
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeCache(t *testing.T) {
+	got, err := NormalizeCache(&Cache{DefaultTTL: " 90s ", MaxTTL: "10m"})
+	if err != nil || got.DefaultTTL != "1m30s" || got.MaxTTL != "10m0s" {
+		t.Fatalf("NormalizeCache = %+v, %v", got, err)
+	}
+	if def, maxTTL := got.TTLs(); def != 90*time.Second || maxTTL != 10*time.Minute {
+		t.Fatalf("TTLs = %s, %s", def, maxTTL)
+	}
+	if got, err := NormalizeCache(nil); got != nil || err != nil {
+		t.Fatalf("nil cache = %+v, %v", got, err)
+	}
+	empty := &Cache{}
+	if def, maxTTL := empty.TTLs(); def != 0 || maxTTL != DefaultCacheMaxTTL || empty.EntryLimit() != DefaultCacheEntryBytes {
+		t.Fatalf("empty cache TTLs = %s, %s, limit %d", def, maxTTL, empty.EntryLimit())
+	}
+	for _, bad := range []Cache{
+		{DefaultTTL: "soon"},
+		{MaxTTL: "500ms"},
+		{MaxTTL: "48h"},
+		{DefaultTTL: "2h", MaxTTL: "1h"},
+		{MaxEntryBytes: -1},
+		{MaxEntryBytes: MaxCacheEntryBytes + 1},
+	} {
+		if _, err := NormalizeCache(&bad); err == nil {
+			t.Fatalf("NormalizeCache(%+v) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// CapBinary lets the peer send binary frames: a 4-byte big-endian header
+// length, the JSON envelope without Body, then the raw Payload bytes. Readers
+// accept both encodings regardless, so only the sender has to know.
+const CapBinary = "binary"
+
+const maxBinaryHeader = 1 << 20
+
+// EncodeJSON produces the legacy text frame, with Payload base64-encoded into
+// Body.
+func EncodeJSON(env Envelope) ([]byte, error) {
+	if len(env.Payload) > 0 {
+		env.Body = base64.StdEncoding.EncodeToString(env.Payload)
+	}
+	return json.Marshal(env)
+}
+
+func DecodeJSON(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, err
+	}
+	if env.Body != "" {
+		payload, err := base64.StdEncoding.DecodeString(env.Body)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("decode body: %w", err)
+		}
+		env.Payload = payload
+		env.Body = ""
+	}
+	return env, nil
+}
+
+func EncodeBinary(env Envelope) ([]byte, error) {
+	payload := env.Payload
+	env.Body = ""
+	header, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4+len(header)+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(len(header)))
+	copy(out[4:], header)
+	copy(out[4+len(header):], payload)
+	return out, nil
+}
+
+func DecodeBinary(data []byte) (Envelope, error) {
+	if len(data) < 4 {
+		return Envelope{}, errors.New("binary frame too short")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if n > maxBinaryHeader || int(n) > len(data)-4 {
+		return Envelope{}, errors.New("binary frame header length out of range")
+	}
+	var env Envelope
+	if err := json.Unmarshal(data[4:4+n], &env); err != nil {
+		return Envelope{}, err
+	}
+	if rest := data[4+n:]; len(rest) > 0 {
+		env.Payload = rest
+	}
+	env.Body = ""
+	return env, nil
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecsRoundTripPayload(t *testing.T) {
+	env := Envelope{
+		Type:      TypeProxyResponse,
+		RequestID: "7",
+		Status:    200,
+		Headers:   map[string][]string{"Content-Type": {"application/octet-stream"}},
+		Payload:   []byte{0, 1, 2, 0xff, '\n'},
+	}
+
+	data, err := EncodeBinary(env)
+	if err != nil {
+		t.Fatalf("EncodeBinary() error = %v", err)
+	}
+	if !bytes.HasSuffix(data, env.Payload) {
+		t.Fatalf("binary frame does not end with raw payload")
+	}
+	got, err := DecodeBinary(data)
+	if err != nil {
+		t.Fatalf("DecodeBinary() error = %v", err)
+	}
+	if got.RequestID != "7" || got.Status != 200 || !bytes.Equal(got.Payload, env.Payload) {
+		t.Fatalf("binary round trip = %+v", got)
+	}
+
+	data, err = EncodeJSON(env)
+	if err != nil {
+		t.Fatalf("EncodeJSON() error = %v", err)
+	}
+	if !bytes.Contains(data, []byte(`"body":"AAEC/wo="`)) {
+		t.Fatalf("json frame missing base64 body: %s", data)
+	}
+	got, err = DecodeJSON(data)
+	if err != nil {
+		t.Fatalf("DecodeJSON() error = %v", err)
+	}
+	if got.Body != "" || !bytes.Equal(got.Payload, env.Payload) {
+		t.Fatalf("json round trip = %+v", got)
+	}
+}
+
+func TestDecodeBinaryRejectsBadHeaderLength(t *testing.T) {
+	if _, err := DecodeBinary([]byte{0, 0, 0, 9, '{', '}'}); err == nil {
+		t.Fatal("expected error for header length beyond frame")
+	}
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CapCompress lets either peer gzip inline bodies. Encoding on the envelope
+// then names how Payload is compressed; streamed data frames never are.
+const CapCompress = "compress"
+
+// DefaultCompressMinBytes is the smallest body worth compressing.
+const DefaultCompressMinBytes = 1024
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// compressedTypes are content types whose bodies are already compressed.
+var compressedTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2",
+	"application/x-xz", "application/pdf", "application/octet-stream", "application/wasm",
+}
+
+// CompressPayload gzips env's inline Payload when it is at least minBytes,
+// is not compressed already (by Content-Encoding or Content-Type) and
+// actually shrinks. It reports whether it did.
+func CompressPayload(env *Envelope, minBytes int) bool {
+	if minBytes <= 0 || env.Encoding != "" || len(env.Payload) < minBytes || !compressible(env.Headers) {
+		return false
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := zw.Write(env.Payload); err != nil || zw.Close() != nil {
+		return false
+	}
+	if buf.Len() >= len(env.Payload) {
+		return false
+	}
+	env.Payload, env.Encoding = buf.Bytes(), EncodingGzip
+	return true
+}
+
+// DecompressPayload undoes CompressPayload, refusing bodies that inflate
+// beyond maxBytes.
+func DecompressPayload(env *Envelope, maxBytes int64) error {
+	var r io.Reader
+	switch env.Encoding {
+	case "":
+		return nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("decompress body: %w", err)
+		}
+		r = zr
+	case EncodingDeflate:
+		r = flate.NewReader(bytes.NewReader(env.Payload))
+	default:
+		return fmt.Errorf("unknown body encoding %q", env.Encoding)
+	}
+	payload, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return fmt.Errorf("decompress body: %w", err)
+	}
+	if int64(len(payload)) > maxBytes {
+		return fmt.Errorf("decompressed body exceeds %d bytes", maxBytes)
+	}
+	env.Payload, env.Encoding = payload, ""
+	return nil
+}
+
+func compressible(headers map[string][]string) bool {
+	if enc := headerValue(headers, "Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	contentType := strings.ToLower(headerValue(headers, "Content-Type"))
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return strings.HasPrefix(contentType, "image/svg")
+		}
+	}
+	return true
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("<p>hello tunnel</p>"), 200)
+	env := Envelope{Headers: map[string][]string{"Content-Type": {"text/html"}}, Payload: body}
+	if !CompressPayload(&env, DefaultCompressMinBytes) || env.Encoding != EncodingGzip || len(env.Payload) >= len(body) {
+		t.Fatalf("html body not compressed: encoding=%q len=%d", env.Encoding, len(env.Payload))
+	}
+	if err := DecompressPayload(&env, int64(len(body))); err != nil || env.Encoding != "" || !bytes.Equal(env.Payload, body) {
+		t.Fatalf("DecompressPayload = %v, encoding=%q", err, env.Encoding)
+	}
+
+	compressed := env
+	CompressPayload(&compressed, DefaultCompressMinBytes)
+	if err := DecompressPayload(&compressed, int64(len(body))-1); err == nil {
+		t.Fatalf("body inflating past the limit accepted")
+	}
+}
+
+func TestCompressPayloadSkips(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 4096)
+	for name, headers := range map[string]map[string][]string{
+		"image":    {"Content-Type": {"image/png"}},
+		"encoded":  {"content-encoding": {"br"}},
+		"archive":  {"Content-Type": {"application/zip"}},
+		"download": {"Content-Type": {"application/octet-stream"}},
+	} {
+		env := Envelope{Headers: headers, Payload: body}
+		if CompressPayload(&env, DefaultCompressMinBytes) {
+			t.Fatalf("%s body compressed", name)
+		}
+	}
+	small := Envelope{Payload: []byte("tiny")}
+	if CompressPayload(&small, DefaultCompressMinBytes) {
+		t.Fatalf("body under the threshold compressed")
+	}
+	svg := Envelope{Headers: map[string][]string{"Content-Type": {"image/svg+xml"}}, Payload: body}
+	if !CompressPayload(&svg, DefaultCompressMinBytes) {
+		t.Fatalf("svg body not compressed")
+	}
+}
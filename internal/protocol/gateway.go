@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxStaticBody caps the body of a StaticResponse.
+const MaxStaticBody = 64 << 10
+
+// GatewayRoute is a hostname the tunnel server answers by itself, without
+// an agent: with a redirect, with a fixed response, or with a 503 while it
+// is under maintenance. The control plane hands them to servers apart from
+// the routes agents register.
+type GatewayRoute struct {
+	Hostname    string          `json:"hostname"`
+	Redirect    *Redirect       `json:"redirect,omitempty"`
+	Static      *StaticResponse `json:"static_response,omitempty"`
+	Maintenance *Maintenance    `json:"maintenance,omitempty"`
+	// Idle marks the route of a tunnel suspended for lack of traffic. Unlike
+	// the others it only applies while no agent serves the hostname: the
+	// server then shows a "waking up" page and asks the control plane to
+	// get the agent started.
+	Idle bool `json:"idle,omitempty"`
+	// Disabled marks a disabled route with ACME passthrough. Its agent no
+	// longer serves it, so the server forwards the route's HTTP-01
+	// challenges to the agent of TunnelID at Target itself and answers
+	// every other request as if the hostname were unknown.
+	Disabled bool   `json:"disabled,omitempty"`
+	TunnelID string `json:"tunnel_id,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// ACMEPassthrough sends HTTP-01 challenges on to the route's agent
+	// instead of the maintenance page.
+	ACMEPassthrough bool `json:"acme_passthrough,omitempty"`
+}
+
+// Redirect sends every request to URL with Status (302 when zero). With
+// KeepPath the request's path and query are appended to URL.
+type Redirect struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status,omitempty"`
+	KeepPath bool   `json:"keep_path,omitempty"`
+}
+
+// StaticResponse answers every request with Status (200 when zero) and
+// Body, sent as ContentType (HTML when empty).
+type StaticResponse struct {
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Maintenance takes a route offline with a 503 without touching its agent
+// side. Body replaces the server's offline page; RetryAfter (seconds) is
+// sent as Retry-After when set.
+type Maintenance struct {
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	RetryAfter  int    `json:"retry_after,omitempty"`
+}
+
+// NormalizeRedirect validates redirect and fills in its status. A nil
+// redirect comes back nil.
+func NormalizeRedirect(redirect *Redirect) (*Redirect, error) {
+	if redirect == nil {
+		return nil, nil
+	}
+	raw := strings.TrimSpace(redirect.URL)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("redirect url %q must be an absolute http(s) url", redirect.URL)
+	}
+	status := redirect.Status
+	switch status {
+	case 0:
+		status = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("redirect status %d must be 301, 302, 303, 307 or 308", status)
+	}
+	return &Redirect{URL: raw, Status: status, KeepPath: redirect.KeepPath}, nil
+}
+
+// NormalizeStaticResponse validates resp and fills in its status and
+// content type. A nil response comes back nil.
+func NormalizeStaticResponse(resp *StaticResponse) (*StaticResponse, error) {
+	if resp == nil {
+		return nil, nil
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 200 || status > 599 {
+		return nil, fmt.Errorf("static response status %d must be between 200 and 599", status)
+	}
+	if len(resp.Body) > MaxStaticBody {
+		return nil, fmt.Errorf("static response body is %d bytes, at most %d are allowed", len(resp.Body), MaxStaticBody)
+	}
+	contentType := strings.TrimSpace(resp.ContentType)
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	if strings.ContainsAny(contentType, "\r\n") {
+		return nil, errors.New("static response content_type must be a single line")
+	}
+	return &StaticResponse{Status: status, ContentType: contentType, Body: resp.Body}, nil
+}
+
+// NormalizeMaintenance validates m and fills in the content type of a
+// custom page. A nil m comes back nil.
+func NormalizeMaintenance(m *Maintenance) (*Maintenance, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.RetryAfter < 0 || m.RetryAfter > 7*24*3600 {
+		return nil, errors.New("maintenance retry_after must be between 0 and 604800 seconds")
+	}
+	if len(m.Body) > MaxStaticBody {
+		return nil, fmt.Errorf("maintenance body is %d bytes, at most %d are allowed", len(m.Body), MaxStaticBody)
+	}
+	out := &Maintenance{Body: m.Body, RetryAfter: m.RetryAfter}
+	if out.Body != "" {
+		out.ContentType = strings.TrimSpace(m.ContentType)
+		if out.ContentType == "" {
+			out.ContentType = "text/html; charset=utf-8"
+		}
+		if strings.ContainsAny(out.ContentType, "\r\n") {
+			return nil, errors.New("maintenance content_type must be a single line")
+		}
+	}
+	return out, nil
+}
+
+// Location is where a request for path and rawQuery is redirected to.
+func (r *Redirect) Location(path, rawQuery string) string {
+	if !r.KeepPath {
+		return r.URL
+	}
+	loc := strings.TrimRight(r.URL, "/") + path
+	if rawQuery != "" {
+		loc += "?" + rawQuery
+	}
+	return loc
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import "testing"
+
+func TestNormalizeRedirect(t *testing.T) {
+	r, err := NormalizeRedirect(&Redirect{URL: " https://example.com/ ", KeepPath: true})
+	if err != nil || r.Status != 302 || r.URL != "https://example.com/" {
+		t.Fatalf("NormalizeRedirect = %+v, %v", r, err)
+	}
+	if got := r.Location("/a/b", "x=1"); got != "https://example.com/a/b?x=1" {
+		t.Fatalf("Location = %q", got)
+	}
+	if got := (&Redirect{URL: "https://example.com/landing"}).Location("/a", "x=1"); got != "https://example.com/landing" {
+		t.Fatalf("Location without keep_path = %q", got)
+	}
+	for _, bad := range []*Redirect{{URL: "/relative"}, {URL: "ftp://example.com"}, {URL: "https://example.com", Status: 200}} {
+		if _, err := NormalizeRedirect(bad); err == nil {
+			t.Fatalf("NormalizeRedirect(%+v) accepted", bad)
+		}
+	}
+}
+
+func TestNormalizeStaticResponse(t *testing.T) {
+	s, err := NormalizeStaticResponse(&StaticResponse{Body: "<h1>hi</h1>"})
+	if err != nil || s.Status != 200 || s.ContentType != "text/html; charset=utf-8" {
+		t.Fatalf("NormalizeStaticResponse = %+v, %v", s, err)
+	}
+	for _, bad := range []*StaticResponse{{Status: 99}, {Status: 600}, {ContentType: "text/plain\r\nX: y"}, {Body: string(make([]byte, MaxStaticBody+1))}} {
+		if _, err := NormalizeStaticResponse(bad); err == nil {
+			t.Fatalf("NormalizeStaticResponse(%+v) accepted", bad.Status)
+		}
+	}
+}
+
+func TestNormalizeMaintenance(t *testing.T) {
+	if m, err := NormalizeMaintenance(&Maintenance{RetryAfter: 600}); err != nil || m.ContentType != "" || m.RetryAfter != 600 {
+		t.Fatalf("NormalizeMaintenance(default page) = %+v, %v", m, err)
+	}
+	if m, err := NormalizeMaintenance(&Maintenance{Body: "back soon"}); err != nil || m.ContentType != "text/html; charset=utf-8" {
+		t.Fatalf("NormalizeMaintenance(custom page) = %+v, %v", m, err)
+	}
+	for _, bad := range []*Maintenance{{RetryAfter: -1}, {Body: "x", ContentType: "a\nb"}, {Body: string(make([]byte, MaxStaticBody+1))}} {
+		if _, err := NormalizeMaintenance(bad); err == nil {
+			t.Fatalf("NormalizeMaintenance(%+v) accepted", bad.RetryAfter)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"fmt"
+	"maps"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// Headers a rule may not touch: framing and hop-by-hop headers are the
+// tunnel's business, and Host has Rewrite.
+var protectedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Upgrade":           true,
+	"Trailer":           true,
+}
+
+// NormalizeHeaderRules validates rules and canonicalises the header names.
+// Nil rules, or rules that change nothing, come back nil.
+func NormalizeHeaderRules(rules *HeaderRules) (*HeaderRules, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	req, err := normalizeHeaderOps(rules.Request)
+	if err != nil {
+		return nil, fmt.Errorf("header_rules request: %w", err)
+	}
+	resp, err := normalizeHeaderOps(rules.Response)
+	if err != nil {
+		return nil, fmt.Errorf("header_rules response: %w", err)
+	}
+	if req == nil && resp == nil {
+		return nil, nil
+	}
+	return &HeaderRules{Request: req, Response: resp}, nil
+}
+
+func normalizeHeaderOps(ops *HeaderOps) (*HeaderOps, error) {
+	if ops == nil {
+		return nil, nil
+	}
+	out := &HeaderOps{}
+	for _, values := range []struct {
+		in  map[string]string
+		out *map[string]string
+	}{{ops.Set, &out.Set}, {ops.Add, &out.Add}} {
+		for name, value := range values.in {
+			key, err := headerKey(name)
+			if err != nil {
+				return nil, err
+			}
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return nil, fmt.Errorf("header %s: value must be a single line", key)
+			}
+			if *values.out == nil {
+				*values.out = make(map[string]string)
+			}
+			(*values.out)[key] = value
+		}
+	}
+	for _, name := range ops.Remove {
+		key, err := headerKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(out.Remove, key) {
+			out.Remove = append(out.Remove, key)
+		}
+	}
+	if len(out.Set) == 0 && len(out.Add) == 0 && len(out.Remove) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func headerKey(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) {
+		return "", fmt.Errorf("invalid header name %q", name)
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	if protectedHeaders[key] {
+		return "", fmt.Errorf("header %s cannot be changed by a rule", key)
+	}
+	return key, nil
+}
+
+// Apply changes h, whose keys are canonical: Remove first, then Set, then
+// Add.
+func (o *HeaderOps) Apply(h map[string][]string) {
+	if o == nil {
+		return
+	}
+	for _, key := range o.Remove {
+		delete(h, key)
+	}
+	for key, value := range o.Set {
+		h[key] = []string{value}
+	}
+	for key, value := range o.Add {
+		h[key] = append(h[key], value)
+	}
+}
+
+// Clone returns a deep copy of r.
+func (r *HeaderRules) Clone() *HeaderRules {
+	if r == nil {
+		return nil
+	}
+	return &HeaderRules{Request: r.Request.clone(), Response: r.Response.clone()}
+}
+
+func (o *HeaderOps) clone() *HeaderOps {
+	if o == nil {
+		return nil
+	}
+	return &HeaderOps{Set: maps.Clone(o.Set), Add: maps.Clone(o.Add), Remove: slices.Clone(o.Remove)}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeHeaderRules(t *testing.T) {
+	got, err := NormalizeHeaderRules(&HeaderRules{
+		Request:  &HeaderOps{Set: map[string]string{"x-env": "preview"}},
+		Response: &HeaderOps{Remove: []string{"server", "Server"}, Set: map[string]string{"access-control-allow-origin": "*"}},
+	})
+	if err != nil {
+		t.Fatalf("NormalizeHeaderRules: %v", err)
+	}
+	if got.Request.Set["X-Env"] != "preview" || !slices.Equal(got.Response.Remove, []string{"Server"}) || got.Response.Set["Access-Control-Allow-Origin"] != "*" {
+		t.Fatalf("normalized = %+v %+v", got.Request, got.Response)
+	}
+	if got, err := NormalizeHeaderRules(&HeaderRules{Request: &HeaderOps{}}); got != nil || err != nil {
+		t.Fatalf("empty rules = %+v, %v", got, err)
+	}
+	for _, bad := range []*HeaderOps{
+		{Set: map[string]string{"Bad Name": "x"}},
+		{Add: map[string]string{"X-A": "line\r\nInjected: 1"}},
+		{Remove: []string{"Content-Length"}},
+		{Set: map[string]string{"host": "evil.test"}},
+	} {
+		if _, err := NormalizeHeaderRules(&HeaderRules{Request: bad}); err == nil {
+			t.Fatalf("NormalizeHeaderRules(%+v) accepted", bad)
+		}
+	}
+}
+
+func TestHeaderOpsApply(t *testing.T) {
+	h := map[string][]string{"Server": {"nginx"}, "Vary": {"Accept"}, "X-Env": {"prod"}}
+	ops := &HeaderOps{Remove: []string{"Server"}, Set: map[string]string{"X-Env": "preview"}, Add: map[string]string{"Vary": "Origin"}}
+	ops.Apply(h)
+	if _, ok := h["Server"]; ok || !slices.Equal(h["X-Env"], []string{"preview"}) || !slices.Equal(h["Vary"], []string{"Accept", "Origin"}) {
+		t.Fatalf("applied = %v", h)
+	}
+	var none *HeaderOps
+	none.Apply(h)
+}
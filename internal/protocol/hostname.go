@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ReservedHostnames decides which hostnames no route may claim: localhost,
+// IP literals, and whatever the operator reserves. Entries are exact
+// hostnames or "*.example.com", which covers every subdomain of
+// example.com. A nil *ReservedHostnames applies only the built-in rules.
+type ReservedHostnames struct {
+	exact    map[string]bool
+	suffixes []string
+	pattern  *regexp.Regexp
+}
+
+// NewReservedHostnames builds the blocklist from entries and an optional
+// regular expression matched against the whole hostname.
+func NewReservedHostnames(entries []string, pattern string) (*ReservedHostnames, error) {
+	r := &ReservedHostnames{exact: make(map[string]bool)}
+	r.Add(entries...)
+	if pattern = strings.TrimSpace(pattern); pattern != "" {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("reserved hostname pattern: %w", err)
+		}
+		r.pattern = re
+	}
+	return r, nil
+}
+
+// Add reserves more hostnames; blank entries are ignored.
+func (r *ReservedHostnames) Add(entries ...string) {
+	for _, e := range entries {
+		e = strings.Trim(strings.ToLower(strings.TrimSpace(e)), ".")
+		if suffix, ok := strings.CutPrefix(e, "*."); ok && suffix != "" {
+			r.suffixes = append(r.suffixes, "."+suffix)
+		} else if e != "" {
+			r.exact[e] = true
+		}
+	}
+}
+
+// Check returns why hostname, already lower-cased and without a port, is
+// reserved, or nil when a route may use it.
+func (r *ReservedHostnames) Check(hostname string) error {
+	if hostname == "localhost" || hostname == "localhost.localdomain" {
+		return fmt.Errorf("hostname %s is reserved", hostname)
+	}
+	if net.ParseIP(strings.Trim(hostname, "[]")) != nil {
+		return fmt.Errorf("hostname %s is an IP address, use a domain name", hostname)
+	}
+	if r == nil {
+		return nil
+	}
+	if r.exact[hostname] {
+		return fmt.Errorf("hostname %s is reserved", hostname)
+	}
+	for _, suffix := range r.suffixes {
+		if strings.HasSuffix(hostname, suffix) {
+			return fmt.Errorf("hostname %s is reserved", hostname)
+		}
+	}
+	if r.pattern != nil && r.pattern.MatchString(hostname) {
+		return fmt.Errorf("hostname %s is reserved", hostname)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package protocol
+
+import "testing"
+
+func TestReservedHostnames(t *testing.T) {
+	r, err := NewReservedHostnames([]string{" Tunnel.Example.com ", "*.internal.example.com", ""}, `admin-.*`)
+	if err != nil {
+		t.Fatalf("NewReservedHostnames: %v", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "tunnel.example.com", "db.internal.example.com", "admin-x.example.com"} {
+		if r.Check(host) == nil {
+			t.Fatalf("Check(%q) = nil, want reserved", host)
+		}
+	}
+	for _, host := range []string{"app.example.com", "internal.example.com", "myadmin-x.example.com", "app.localhost"} {
+		if err := r.Check(host); err != nil {
+			t.Fatalf("Check(%q) = %v", host, err)
+		}
+	}
+	var none *ReservedHostnames
+	if none.Check("10.0.0.1") == nil || none.Check("tunnel.example.com") != nil {
+		t.Fatal("nil list should apply only the built-in rules")
+	}
+	if _, err := NewReservedHostnames(nil, "("); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+}
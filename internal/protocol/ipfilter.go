@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// NormalizeIPFilter validates every entry and writes it as a CIDR. A nil
+// filter, or one with both lists empty, comes back nil.
+func NormalizeIPFilter(filter *IPFilter) (*IPFilter, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	allow, err := normalizePrefixes(filter.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("ip_filter allow: %w", err)
+	}
+	deny, err := normalizePrefixes(filter.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("ip_filter deny: %w", err)
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &IPFilter{Allow: allow, Deny: deny}, nil
+}
+
+func normalizePrefixes(items []string) ([]string, error) {
+	var out []string
+	for _, item := range items {
+		prefix, err := parsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix.String())
+	}
+	return out, nil
+}
+
+func parsePrefix(item string) (netip.Prefix, error) {
+	item = strings.TrimSpace(item)
+	if !strings.Contains(item, "/") {
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", item)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(item)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", item)
+	}
+	return prefix.Masked(), nil
+}
+
+// Permits reports whether the filter lets ip through. A nil filter lets
+// everything through; an address that does not parse only gets through a
+// filter without an allow list. Malformed entries never match.
+func (f *IPFilter) Permits(ip string) bool {
+	if f == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return len(f.Allow) == 0
+	}
+	addr = addr.Unmap()
+	if matchesAny(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesAny(f.Allow, addr)
+}
+
+func matchesAny(items []string, addr netip.Addr) bool {
+	for _, item := range items {
+		if prefix, err := parsePrefix(item); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
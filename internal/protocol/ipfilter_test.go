@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeIPFilter(t *testing.T) {
+	got, err := NormalizeIPFilter(&IPFilter{Allow: []string{" 10.1.2.3/8", "::ffff:192.0.2.7"}, Deny: []string{"2001:db8::/32"}})
+	if err != nil {
+		t.Fatalf("NormalizeIPFilter: %v", err)
+	}
+	if !slices.Equal(got.Allow, []string{"10.0.0.0/8", "192.0.2.7/32"}) || !slices.Equal(got.Deny, []string{"2001:db8::/32"}) {
+		t.Fatalf("normalized = %+v", got)
+	}
+	if got, err := NormalizeIPFilter(&IPFilter{}); got != nil || err != nil {
+		t.Fatalf("empty filter = %+v, %v", got, err)
+	}
+	if _, err := NormalizeIPFilter(&IPFilter{Deny: []string{"10.0.0.0/40"}}); err == nil {
+		t.Fatalf("bad CIDR accepted")
+	}
+}
+
+func TestIPFilterPermits(t *testing.T) {
+	f := &IPFilter{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.9/32"}}
+	for ip, want := range map[string]bool{
+		"10.1.1.1":        true,
+		"10.0.0.9":        false,
+		"::ffff:10.1.1.1": true,
+		"192.0.2.1":       false,
+		"not-an-ip":       false,
+	} {
+		if got := f.Permits(ip); got != want {
+			t.Fatalf("Permits(%q) = %v, want %v", ip, got, want)
+		}
+	}
+	if !(*IPFilter)(nil).Permits("192.0.2.1") {
+		t.Fatalf("nil filter refused a client")
+	}
+	if (&IPFilter{Deny: []string{"192.0.2.0/24"}}).Permits("192.0.2.1") || !(&IPFilter{Deny: []string{"192.0.2.0/24"}}).Permits("198.51.100.1") {
+		t.Fatalf("deny-only filter misbehaved")
+	}
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Mirror copies a share of a route's requests to a second target, e.g. a
+// new build of the local service, through the same agent. Copies are
+// fire-and-forget: their responses are discarded and never reach the
+// client.
+type Mirror struct {
+	Target  string `json:"target"`
+	Percent int    `json:"percent"`
+}
+
+// NormalizeMirror validates mirror and canonicalises its target. A nil
+// mirror stays nil.
+func NormalizeMirror(mirror *Mirror) (*Mirror, error) {
+	if mirror == nil {
+		return nil, nil
+	}
+	target, err := NormalizeTarget(mirror.Target)
+	if err != nil {
+		return nil, fmt.Errorf("mirror target: %w", err)
+	}
+	if mirror.Percent < 1 || mirror.Percent > 100 {
+		return nil, errors.New("mirror percent must be between 1 and 100")
+	}
+	return &Mirror{Target: target, Percent: mirror.Percent}, nil
+}
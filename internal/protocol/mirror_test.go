@@ -0,0 +1,22 @@
+package protocol
+
+import "testing"
+
+func TestNormalizeMirror(t *testing.T) {
+	got, err := NormalizeMirror(&Mirror{Target: "http://127.0.0.1:3001", Percent: 10})
+	if err != nil || got.Target != "127.0.0.1:3001" || got.Percent != 10 {
+		t.Fatalf("NormalizeMirror = %+v, %v", got, err)
+	}
+	for _, bad := range []*Mirror{
+		{Target: "", Percent: 10},
+		{Target: "127.0.0.1:3001", Percent: 0},
+		{Target: "127.0.0.1:3001", Percent: 101},
+	} {
+		if _, err := NormalizeMirror(bad); err == nil {
+			t.Fatalf("NormalizeMirror(%+v) accepted", bad)
+		}
+	}
+	if got, err := NormalizeMirror(nil); got != nil || err != nil {
+		t.Fatalf("NormalizeMirror(nil) = %+v, %v", got, err)
+	}
+}
@@ -1,15 +1,196 @@
 package protocol
 
+import "strings"
+
 const (
 	TypeRegisterRoutes = "register_routes"
 	TypeProxyRequest   = "proxy_request"
 	TypeProxyResponse  = "proxy_response"
 	TypeError          = "error"
+	TypeSession        = "session"
+	TypeRouteDelta     = "route_delta"
+	TypeRouteResync    = "route_resync"
+
+	TypeProxyRequestData  = "proxy_request_data"
+	TypeProxyResponseData = "proxy_response_data"
+	TypeProxyWindow       = "proxy_window"
+	// TypeProxyCancel tells the agent the public client is gone, so it can
+	// abandon the upstream call for RequestID.
+	TypeProxyCancel = "proxy_cancel"
+	// TypeHello is the agent's first message, announcing ProtocolVersion,
+	// Version and Caps; the server answers with a hello carrying what it
+	// accepted.
+	TypeHello = "hello"
+	// TypeRouteHealth lists in UnhealthyHosts every hostname whose local
+	// service fails the agent's health check; an empty list clears them.
+	TypeRouteHealth = "route_health"
+	// TypeProxyInterim carries an informational (1xx) response head for
+	// RequestID in Status and Headers, e.g. 100 Continue or 103 Early
+	// Hints. Any number may precede the proxy_response.
+	TypeProxyInterim = "proxy_interim"
+	// TypeDraining tells the server the agent is shutting down: it finishes
+	// the requests it has but should not be sent new ones.
+	TypeDraining = "draining"
+)
+
+// ProtocolVersion is the envelope protocol this build speaks. Peers settle on
+// the lower of their two versions; the server refuses agents older than
+// MinProtocolVersion.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Capabilities an agent can ask for with the caps query parameter on
+// /connect; the server echoes the ones it accepted in the session message.
+const (
+	CapStream = "stream"
+	CapCancel = "cancel"
+	// CapHealth lets the agent send route_health, so the server can answer
+	// for a dead local service without a round trip.
+	CapHealth = "health"
+	// CapInterim lets the agent relay 1xx responses with proxy_interim. The
+	// server then holds back the body of an Expect: 100-continue request
+	// until the local service asks for it.
+	CapInterim = "interim"
+	// CapDrain lets the agent announce a shutdown with draining.
+	CapDrain = "drain"
+)
+
+// SupportedCaps lists every capability this build implements.
+var SupportedCaps = []string{CapStream, CapBinary, CapCancel, CapHealth, CapCompress, CapInterim, CapDrain}
+
+const (
+	// Bodies up to InlineBodyLimit travel inside the request/response
+	// envelope; larger or unknown-length ones are streamed when both sides
+	// support CapStream.
+	InlineBodyLimit = 64 << 10
+	StreamChunkSize = 32 << 10
+	// StreamWindow is the number of unacknowledged data frames a sender may
+	// have in flight per stream; each proxy_window grants one more.
+	StreamWindow = 16
 )
 
 type Route struct {
-	Hostname string `json:"hostname"`
-	Target   string `json:"target"`
+	Hostname  string     `json:"hostname"`
+	Target    string     `json:"target"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	Split     *Split     `json:"split,omitempty"`
+	// Timeout (a Go duration) and MaxBodyBytes override the gateway's
+	// request timeout and body cap for this route; zero keeps the defaults.
+	Timeout      string       `json:"timeout,omitempty"`
+	MaxBodyBytes int64        `json:"max_body_bytes,omitempty"`
+	IPFilter     *IPFilter    `json:"ip_filter,omitempty"`
+	Auth         *RouteAuth   `json:"auth,omitempty"`
+	Rewrite      *Rewrite     `json:"rewrite,omitempty"`
+	HeaderRules  *HeaderRules `json:"header_rules,omitempty"`
+	// ACMEPassthrough sends ACME HTTP-01 challenges (GET
+	// /.well-known/acme-challenge/...) to the target ahead of IPFilter,
+	// Auth, RateLimit and the gateway's own ACME client, for services that
+	// get their certificates themselves.
+	ACMEPassthrough bool `json:"acme_passthrough,omitempty"`
+	// Aliases are more hostnames served exactly like Hostname, e.g. the
+	// bare domain next to www. Route sets stay keyed by Hostname.
+	Aliases []string `json:"aliases,omitempty"`
+	// Cache keeps GET and HEAD responses at the gateway; nil sends every
+	// request to the agent.
+	Cache *Cache `json:"cache,omitempty"`
+	// Mirror sends copies of a share of requests to a second target and
+	// discards their responses.
+	Mirror *Mirror `json:"mirror,omitempty"`
+}
+
+// RateLimit is a token bucket the gateway applies to a route's public
+// traffic: RPS requests per second on average, bursts of up to Burst. With
+// PerClientIP every client address gets its own bucket.
+type RateLimit struct {
+	RPS         float64 `json:"rps"`
+	Burst       int     `json:"burst,omitempty"`
+	PerClientIP bool    `json:"per_client_ip,omitempty"`
+}
+
+// Split sends Weight percent of a route's requests to a second Target, e.g.
+// a canary build, and the rest to the route's own target. Sticky keeps a
+// client on the side it first landed on: SplitStickyIP by client address,
+// SplitStickyCookie by a cookie the gateway sets. Without it every request
+// is assigned on its own.
+type Split struct {
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+	Sticky string `json:"sticky,omitempty"`
+}
+
+const (
+	SplitStickyIP     = "ip"
+	SplitStickyCookie = "cookie"
+)
+
+// IPFilter limits which client addresses the gateway lets through to a
+// route. Entries are CIDRs or single addresses. Deny wins over Allow; with
+// a non-empty Allow every address outside it is refused too.
+type IPFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Rewrite changes a request before the agent sends it to the local target:
+// StripPrefix is removed from the path, then AddPrefix is put in front, so
+// an app that lives at / can be served under /app and the other way round.
+// Host replaces the Host header, or RewriteHostTarget sends the target's
+// address; empty keeps the public hostname. Redirects points Location
+// headers that name the local service (e.g. http://127.0.0.1:3000/login)
+// at the public hostname instead, and HTML does the same for those origins
+// inside HTML response bodies.
+type Rewrite struct {
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	AddPrefix   string `json:"add_prefix,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Redirects   bool   `json:"redirects,omitempty"`
+	HTML        bool   `json:"html,omitempty"`
+}
+
+// HeaderRules change the request headers the agent sends to the local
+// target and the response headers it sends back.
+type HeaderRules struct {
+	Request  *HeaderOps `json:"request,omitempty"`
+	Response *HeaderOps `json:"response,omitempty"`
+}
+
+// HeaderOps removes, sets (replacing any value) and adds headers, in that
+// order.
+type HeaderOps struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// RouteAuth makes the gateway ask for credentials before a request reaches
+// the route. Basic holds "user:bcrypt-hash" entries checked against HTTP
+// Basic Auth; TokenSecret signs preview links carrying RouteTokenParam (see
+// SignRouteToken); Login sends browsers through the gateway's single sign-on
+// provider; JWT accepts bearer tokens signed by an identity provider. A
+// request passes when it satisfies any of them.
+type RouteAuth struct {
+	Basic       []string     `json:"basic,omitempty"`
+	TokenSecret string       `json:"token_secret,omitempty"`
+	Login       *LoginPolicy `json:"login,omitempty"`
+	JWT         *JWTPolicy   `json:"jwt,omitempty"`
+}
+
+// LoginPolicy says who may pass after signing in. Allow entries are email
+// addresses, "@domain" for a whole email domain, or provider user names; an
+// empty list admits everyone the provider signs in.
+type LoginPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+}
+
+// JWTPolicy accepts "Authorization: Bearer" tokens signed by a key
+// published at JWKSURL whose aud claim names Audience and, when Issuer is
+// set, whose iss claim matches it.
+type JWTPolicy struct {
+	JWKSURL  string `json:"jwks_url"`
+	Audience string `json:"audience"`
+	Issuer   string `json:"issuer,omitempty"`
 }
 
 type Envelope struct {
@@ -25,6 +206,42 @@ type Envelope struct {
 	Target    string              `json:"target,omitempty"`
 	Routes    []Route             `json:"routes,omitempty"`
 	Message   string              `json:"message,omitempty"`
+	Trailers  map[string][]string `json:"trailers,omitempty"`
+	Stream    bool                `json:"stream,omitempty"`
+	End       bool                `json:"end,omitempty"`
+	Caps      []string            `json:"caps,omitempty"`
+
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	Version         string `json:"version,omitempty"`
+	// Agent on the agent's hello describes it and its machine.
+	Agent *AgentMeta `json:"agent,omitempty"`
+
+	SessionID    string `json:"session_id,omitempty"`
+	SessionToken string `json:"session_token,omitempty"`
+
+	RoutesVersion string   `json:"routes_version,omitempty"`
+	BaseVersion   string   `json:"base_version,omitempty"`
+	RemovedHosts  []string `json:"removed_hosts,omitempty"`
+
+	UnhealthyHosts []string `json:"unhealthy_hosts,omitempty"`
+
+	// Timeout on a proxy_request is the route's own timeout, so the agent
+	// gives up on the local service when the gateway does.
+	Timeout string `json:"timeout,omitempty"`
+	// Rewrite and HeaderRules on a proxy_request are the route's, applied
+	// by the agent.
+	Rewrite     *Rewrite     `json:"rewrite,omitempty"`
+	HeaderRules *HeaderRules `json:"header_rules,omitempty"`
+
+	// Encoding is set when Payload is compressed (see CapCompress).
+	Encoding string `json:"encoding,omitempty"`
+
+	// Timing on a proxy_response is where the agent spent the request.
+	Timing *Timing `json:"timing,omitempty"`
+
+	// Payload is the raw body. Body is only its base64 form on the JSON
+	// wire encoding; everything outside the codecs uses Payload.
+	Payload []byte `json:"-"`
 }
 
 func CloneHeaders(h map[string][]string) map[string][]string {
@@ -39,3 +256,34 @@ func CloneHeaders(h map[string][]string) map[string][]string {
 	}
 	return out
 }
+
+func ParseCaps(raw string) []string {
+	var caps []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			caps = append(caps, item)
+		}
+	}
+	return caps
+}
+
+// IntersectCaps keeps the offered capabilities that are also supported, in
+// offered order.
+func IntersectCaps(offered, supported []string) []string {
+	var out []string
+	for _, c := range offered {
+		if HasCap(supported, c) && !HasCap(out, c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func HasCap(caps []string, want string) bool {
+	for _, c := range caps {
+		if c == want {
+			return true
+		}
+	}
+	return false
+}
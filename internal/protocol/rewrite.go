@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// RewriteHostTarget as Rewrite.Host sends the target's own host:port
+// instead of the public hostname.
+const RewriteHostTarget = "target"
+
+// NormalizeRewrite validates rewrite and trims its prefixes to a leading
+// slash and no trailing one. A nil rewrite, or one that changes nothing,
+// comes back nil.
+func NormalizeRewrite(rewrite *Rewrite) (*Rewrite, error) {
+	if rewrite == nil {
+		return nil, nil
+	}
+	strip, err := normalizePrefix(rewrite.StripPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("rewrite strip_prefix: %w", err)
+	}
+	add, err := normalizePrefix(rewrite.AddPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("rewrite add_prefix: %w", err)
+	}
+	host := strings.TrimSpace(rewrite.Host)
+	if strings.ContainsAny(host, "/ \t\r\n") {
+		return nil, fmt.Errorf("rewrite host %q must be a host[:port] or %q", rewrite.Host, RewriteHostTarget)
+	}
+	if strip == "" && add == "" && host == "" && !rewrite.Redirects && !rewrite.HTML {
+		return nil, nil
+	}
+	return &Rewrite{StripPrefix: strip, AddPrefix: add, Host: host, Redirects: rewrite.Redirects, HTML: rewrite.HTML}, nil
+}
+
+func normalizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+		return "", errors.New("must be a path starting with /")
+	}
+	return prefix, nil
+}
+
+// Path maps a public request path to the one sent to the target.
+func (r *Rewrite) Path(p string) string {
+	if r == nil {
+		return p
+	}
+	if r.StripPrefix != "" {
+		if rest, ok := cutPathPrefix(p, r.StripPrefix); ok {
+			p = rest
+		}
+	}
+	return r.AddPrefix + p
+}
+
+// Location maps a path-absolute Location header from the target back to
+// the public path space, so redirects keep working under a rewrite. Other
+// values are returned unchanged.
+func (r *Rewrite) Location(loc string) string {
+	if r == nil || !strings.HasPrefix(loc, "/") || strings.HasPrefix(loc, "//") {
+		return loc
+	}
+	if r.AddPrefix != "" {
+		rest, ok := cutPathPrefix(loc, r.AddPrefix)
+		if !ok {
+			return loc
+		}
+		loc = rest
+	}
+	if r.StripPrefix != "" {
+		loc = r.StripPrefix + loc
+	}
+	return loc
+}
+
+// PublicLocation is Location for a target that writes absolute redirects:
+// a URL on one of the local origins is moved to the public origin as well.
+func (r *Rewrite) PublicLocation(loc string, local []string, public string) string {
+	for _, origin := range local {
+		rest, ok := strings.CutPrefix(loc, origin)
+		if !ok {
+			continue
+		}
+		switch {
+		case rest == "":
+			rest = "/"
+		case rest[0] == '?', rest[0] == '#':
+			rest = "/" + rest
+		case rest[0] != '/':
+			continue
+		}
+		return public + r.Location(rest)
+	}
+	return r.Location(loc)
+}
+
+// LocalOrigins lists the origins a local service may name itself by in the
+// URLs it writes: the target's address, with every loopback alias when it
+// is a loopback one, and the Host header it was sent, over plain http.
+func LocalOrigins(target Target, host string) []string {
+	var origins []string
+	add := func(scheme, hostport string) {
+		for _, o := range []string{scheme + "://" + hostport, scheme + "://" + strings.TrimSuffix(hostport, defaultPort(scheme))} {
+			if !slices.Contains(origins, o) {
+				origins = append(origins, o)
+			}
+		}
+	}
+	if target.Scheme != "unix" {
+		name, port, err := net.SplitHostPort(target.Addr)
+		if err == nil && isLoopbackName(name) {
+			for _, alias := range []string{"localhost", "127.0.0.1", "::1", "0.0.0.0"} {
+				add(target.Scheme, net.JoinHostPort(alias, port))
+			}
+		} else {
+			add(target.Scheme, target.Addr)
+		}
+	}
+	if host != "" {
+		add("http", host)
+	}
+	return origins
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return ":443"
+	}
+	return ":80"
+}
+
+func isLoopbackName(name string) bool {
+	if strings.EqualFold(name, "localhost") || name == "0.0.0.0" {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ReplaceOrigins swaps every occurrence of a local origin in s for public.
+// An origin only matches where its host ends, so 127.0.0.1:3000 is not
+// found inside 127.0.0.1:30001.
+func ReplaceOrigins(s string, local []string, public string) string {
+	for _, origin := range local {
+		if !strings.Contains(s, origin) {
+			continue
+		}
+		var b strings.Builder
+		for {
+			i := strings.Index(s, origin)
+			if i < 0 {
+				break
+			}
+			end := i + len(origin)
+			b.WriteString(s[:i])
+			if end < len(s) && isHostByte(s[end]) {
+				b.WriteString(origin)
+			} else {
+				b.WriteString(public)
+			}
+			s = s[end:]
+		}
+		b.WriteString(s)
+		s = b.String()
+	}
+	return s
+}
+
+func isHostByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':' || c == '_'
+}
+
+// cutPathPrefix removes prefix from p when it matches whole path segments;
+// what is left always starts with a slash.
+func cutPathPrefix(p, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, prefix)
+	if !ok {
+		return p, false
+	}
+	switch {
+	case rest == "":
+		return "/", true
+	case rest[0] == '/':
+		return rest, true
+	case rest[0] == '?', rest[0] == '#':
+		return "/" + rest, true
+	}
+	return p, false
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeRewrite(t *testing.T) {
+	got, err := NormalizeRewrite(&Rewrite{StripPrefix: " /app/ ", Host: " internal.local:8080 "})
+	if err != nil || got.StripPrefix != "/app" || got.Host != "internal.local:8080" {
+		t.Fatalf("NormalizeRewrite = %+v, %v", got, err)
+	}
+	if got, err := NormalizeRewrite(&Rewrite{StripPrefix: "/"}); got != nil || err != nil {
+		t.Fatalf("no-op rewrite = %+v, %v", got, err)
+	}
+	if got, err := NormalizeRewrite(&Rewrite{Redirects: true}); err != nil || got == nil || !got.Redirects {
+		t.Fatalf("redirects-only rewrite = %+v, %v", got, err)
+	}
+	for _, bad := range []*Rewrite{{StripPrefix: "app"}, {AddPrefix: "/a?b"}, {Host: "a b"}} {
+		if _, err := NormalizeRewrite(bad); err == nil {
+			t.Fatalf("NormalizeRewrite(%+v) accepted", bad)
+		}
+	}
+}
+
+func TestRewritePathAndLocation(t *testing.T) {
+	strip := &Rewrite{StripPrefix: "/app"}
+	add := &Rewrite{AddPrefix: "/v2"}
+	both := &Rewrite{StripPrefix: "/app", AddPrefix: "/v2"}
+	for _, tc := range []struct {
+		rw         *Rewrite
+		path, want string
+	}{
+		{strip, "/app/users", "/users"},
+		{strip, "/app", "/"},
+		{strip, "/apple", "/apple"},
+		{add, "/users", "/v2/users"},
+		{both, "/app/users", "/v2/users"},
+		{nil, "/x", "/x"},
+	} {
+		if got := tc.rw.Path(tc.path); got != tc.want {
+			t.Fatalf("%+v Path(%q) = %q, want %q", tc.rw, tc.path, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		rw        *Rewrite
+		loc, want string
+	}{
+		{strip, "/login?next=/", "/app/login?next=/"},
+		{both, "/v2/login", "/app/login"},
+		{both, "/other", "/other"},
+		{strip, "https://example.com/login", "https://example.com/login"},
+		{strip, "//cdn.test/x", "//cdn.test/x"},
+	} {
+		if got := tc.rw.Location(tc.loc); got != tc.want {
+			t.Fatalf("%+v Location(%q) = %q, want %q", tc.rw, tc.loc, got, tc.want)
+		}
+	}
+}
+
+func TestRewritePublicOrigins(t *testing.T) {
+	local := LocalOrigins(Target{Scheme: "http", Addr: "127.0.0.1:3000"}, "app.example.com")
+	for _, want := range []string{"http://127.0.0.1:3000", "http://localhost:3000", "http://[::1]:3000", "http://app.example.com"} {
+		if !slices.Contains(local, want) {
+			t.Fatalf("LocalOrigins = %v, missing %s", local, want)
+		}
+	}
+	public := "https://app.example.com"
+
+	rw := &Rewrite{StripPrefix: "/app", Redirects: true}
+	for loc, want := range map[string]string{
+		"http://localhost:3000/login?next=/": "https://app.example.com/app/login?next=/",
+		"http://127.0.0.1:3000":              "https://app.example.com/app/",
+		"http://app.example.com/home":        "https://app.example.com/app/home",
+		"http://127.0.0.1:30001/x":           "http://127.0.0.1:30001/x",
+		"https://other.test/x":               "https://other.test/x",
+		"/dash":                              "/app/dash",
+	} {
+		if got := rw.PublicLocation(loc, local, public); got != want {
+			t.Fatalf("PublicLocation(%q) = %q, want %q", loc, got, want)
+		}
+	}
+
+	body := `<a href="http://127.0.0.1:3000/a">a</a> <img src="http://localhost:3000"> http://127.0.0.1:30001/b`
+	want := `<a href="https://app.example.com/a">a</a> <img src="https://app.example.com"> http://127.0.0.1:30001/b`
+	if got := ReplaceOrigins(body, local, public); got != want {
+		t.Fatalf("ReplaceOrigins = %s", got)
+	}
+}
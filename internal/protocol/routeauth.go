@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RouteTokenParam is the query parameter, and the cookie, carrying a signed
+// preview token.
+const RouteTokenParam = "tunnel_token"
+
+// MinRouteTokenSecret is the shortest accepted token secret.
+const MinRouteTokenSecret = 16
+
+// NormalizeRouteAuth validates auth. A nil auth, or one with nothing set,
+// comes back nil.
+func NormalizeRouteAuth(auth *RouteAuth) (*RouteAuth, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	out := &RouteAuth{TokenSecret: strings.TrimSpace(auth.TokenSecret)}
+	for _, entry := range auth.Basic {
+		user, hash, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || user == "" {
+			return nil, errors.New(`auth basic entries must look like "user:bcrypt-hash"`)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("auth basic password for %q is not a bcrypt hash", user)
+		}
+		out.Basic = append(out.Basic, user+":"+hash)
+	}
+	if out.TokenSecret != "" && len(out.TokenSecret) < MinRouteTokenSecret {
+		return nil, fmt.Errorf("auth token_secret must be at least %d characters", MinRouteTokenSecret)
+	}
+	if auth.Login != nil {
+		out.Login = &LoginPolicy{}
+		for _, item := range auth.Login.Allow {
+			item = strings.ToLower(strings.TrimSpace(item))
+			if item == "" || item == "@" || strings.ContainsAny(item, " ,") {
+				return nil, fmt.Errorf("auth login allow entry %q is not an email, @domain or user name", item)
+			}
+			out.Login.Allow = append(out.Login.Allow, item)
+		}
+	}
+	if auth.JWT != nil {
+		out.JWT = &JWTPolicy{JWKSURL: strings.TrimSpace(auth.JWT.JWKSURL), Audience: strings.TrimSpace(auth.JWT.Audience), Issuer: strings.TrimSpace(auth.JWT.Issuer)}
+		u, err := url.Parse(out.JWT.JWKSURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, errors.New("auth jwt jwks_url must be an https URL")
+		}
+		if out.JWT.Audience == "" {
+			return nil, errors.New("auth jwt needs an audience")
+		}
+	}
+	if len(out.Basic) == 0 && out.TokenSecret == "" && out.Login == nil && out.JWT == nil {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// Permits reports whether a signed-in user, known by provider user name and
+// email, may pass.
+func (p *LoginPolicy) Permits(user, email string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	user, email = strings.ToLower(user), strings.ToLower(email)
+	for _, item := range p.Allow {
+		switch {
+		case strings.HasPrefix(item, "@"):
+			if email != "" && strings.HasSuffix(email, item) {
+				return true
+			}
+		case strings.Contains(item, "@"):
+			if email == item {
+				return true
+			}
+		default:
+			if user == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckBasic reports whether user and password match one of the Basic
+// entries.
+func (a *RouteAuth) CheckBasic(user, password string) bool {
+	if a == nil {
+		return false
+	}
+	for _, entry := range a.Basic {
+		name, hash, _ := strings.Cut(entry, ":")
+		if name == user && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SignRouteToken returns a token for hostname valid until expires, in the
+// form "<unix expiry>.<hex HMAC-SHA256>".
+func SignRouteToken(secret, hostname string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + routeTokenMAC(secret, hostname, exp)
+}
+
+// VerifyRouteToken checks a token made by SignRouteToken and returns when it
+// expires.
+func VerifyRouteToken(secret, hostname, token string, now time.Time) (time.Time, bool) {
+	if secret == "" {
+		return time.Time{}, false
+	}
+	exp, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !now.Before(time.Unix(unix, 0)) {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(mac), []byte(routeTokenMAC(secret, hostname, exp))) {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+func routeTokenMAC(secret, hostname, exp string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(hostname + "\n" + exp))
+	return hex.EncodeToString(h.Sum(nil))
+}
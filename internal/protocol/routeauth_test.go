@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRouteAuthBasic(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	auth, err := NormalizeRouteAuth(&RouteAuth{Basic: []string{" alice:" + string(hash) + " "}})
+	if err != nil {
+		t.Fatalf("NormalizeRouteAuth: %v", err)
+	}
+	if !auth.CheckBasic("alice", "s3cret") || auth.CheckBasic("alice", "wrong") || auth.CheckBasic("bob", "s3cret") {
+		t.Fatalf("CheckBasic misjudged credentials")
+	}
+	for _, bad := range []*RouteAuth{
+		{Basic: []string{"alice:plaintext"}},
+		{Basic: []string{":" + string(hash)}},
+		{TokenSecret: "short"},
+		{JWT: &JWTPolicy{JWKSURL: "https://idp.example.com/jwks.json"}},
+		{JWT: &JWTPolicy{JWKSURL: "file:///etc/jwks.json", Audience: "api"}},
+		{JWT: &JWTPolicy{JWKSURL: "http://10.0.0.1/jwks.json", Audience: "api"}},
+	} {
+		if _, err := NormalizeRouteAuth(bad); err == nil {
+			t.Fatalf("NormalizeRouteAuth(%+v) accepted", bad)
+		}
+	}
+	if got, err := NormalizeRouteAuth(&RouteAuth{}); got != nil || err != nil {
+		t.Fatalf("empty auth = %+v, %v", got, err)
+	}
+}
+
+func TestRouteToken(t *testing.T) {
+	const secret = "0123456789abcdef"
+	now := time.Unix(1_700_000_000, 0)
+	token := SignRouteToken(secret, "app.example.com", now.Add(time.Hour))
+	if exp, ok := VerifyRouteToken(secret, "app.example.com", token, now); !ok || !exp.Equal(now.Add(time.Hour)) {
+		t.Fatalf("VerifyRouteToken = %v, %v", exp, ok)
+	}
+	for name, check := range map[string]func() bool{
+		"expired": func() bool {
+			_, ok := VerifyRouteToken(secret, "app.example.com", token, now.Add(2*time.Hour))
+			return ok
+		},
+		"other host":   func() bool { _, ok := VerifyRouteToken(secret, "evil.example.com", token, now); return ok },
+		"other secret": func() bool { _, ok := VerifyRouteToken(secret+"x", "app.example.com", token, now); return ok },
+		"garbage":      func() bool { _, ok := VerifyRouteToken(secret, "app.example.com", "nope", now); return ok },
+	} {
+		if check() {
+			t.Fatalf("%s token accepted", name)
+		}
+	}
+}
+
+func TestLoginPolicyPermits(t *testing.T) {
+	auth, err := NormalizeRouteAuth(&RouteAuth{Login: &LoginPolicy{Allow: []string{" Bob@Corp.com", "@example.com", "octocat"}}})
+	if err != nil {
+		t.Fatalf("NormalizeRouteAuth: %v", err)
+	}
+	for _, tc := range []struct {
+		user, email string
+		want        bool
+	}{
+		{"bob", "bob@corp.com", true},
+		{"x", "Ann@Example.com", true},
+		{"x", "ann@evil-example.com", false},
+		{"OctoCat", "", true},
+		{"mallory", "mallory@corp.com", false},
+	} {
+		if got := auth.Login.Permits(tc.user, tc.email); got != tc.want {
+			t.Fatalf("Permits(%q, %q) = %v, want %v", tc.user, tc.email, got, tc.want)
+		}
+	}
+	if !(&LoginPolicy{}).Permits("anyone", "") {
+		t.Fatalf("empty allow list should admit everyone")
+	}
+	if _, err := NormalizeRouteAuth(&RouteAuth{Login: &LoginPolicy{Allow: []string{"a, b"}}}); err == nil {
+		t.Fatalf("allow entry with a comma accepted")
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxRouteTimeout bounds a route's own request timeout.
+const MaxRouteTimeout = time.Hour
+
+// NormalizeRouteLimits validates a route's timeout and body cap and returns
+// the timeout in canonical form. An empty timeout and a zero cap keep the
+// gateway defaults.
+func NormalizeRouteLimits(timeout string, maxBodyBytes int64) (string, error) {
+	if maxBodyBytes < 0 {
+		return "", errors.New("max_body_bytes cannot be negative")
+	}
+	timeout = strings.TrimSpace(timeout)
+	if timeout == "" {
+		return "", nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return "", fmt.Errorf("timeout: %w", err)
+	}
+	if d < time.Second || d > MaxRouteTimeout {
+		return "", fmt.Errorf("timeout must be between 1s and %s", MaxRouteTimeout)
+	}
+	return d.String(), nil
+}
+
+// RequestTimeout is the route's own timeout, zero when it has none or it
+// does not parse.
+func (r Route) RequestTimeout() time.Duration {
+	if r.Timeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(r.Timeout)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeRouteLimits(t *testing.T) {
+	got, err := NormalizeRouteLimits(" 90s ", 50<<20)
+	if err != nil || got != "1m30s" {
+		t.Fatalf("NormalizeRouteLimits = %q, %v", got, err)
+	}
+	if got, err := NormalizeRouteLimits("", 0); got != "" || err != nil {
+		t.Fatalf("empty limits = %q, %v", got, err)
+	}
+	for _, bad := range []struct {
+		timeout string
+		max     int64
+	}{{"soon", 0}, {"500ms", 0}, {"2h", 0}, {"", -1}} {
+		if _, err := NormalizeRouteLimits(bad.timeout, bad.max); err == nil {
+			t.Fatalf("NormalizeRouteLimits(%q, %d) accepted", bad.timeout, bad.max)
+		}
+	}
+	if d := (Route{Timeout: "1m30s"}).RequestTimeout(); d != 90*time.Second {
+		t.Fatalf("RequestTimeout = %s", d)
+	}
+	if d := (Route{Timeout: "bogus"}).RequestTimeout(); d != 0 {
+		t.Fatalf("bogus RequestTimeout = %s", d)
+	}
+}
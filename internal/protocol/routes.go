@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// RoutesVersion returns a stable fingerprint of a route set, independent of
+// ordering, used to detect whether two peers hold the same routes.
+func RoutesVersion(routes []Route) string {
+	sorted := SortRoutes(routes)
+	h := sha256.New()
+	for _, route := range sorted {
+		line, _ := json.Marshal(route)
+		h.Write(line)
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// DiffRoutes returns the routes that must be added (new or changed) and the
+// hostnames that must be removed to turn prev into next.
+func DiffRoutes(prev, next []Route) ([]Route, []string) {
+	prevByHost := make(map[string]Route, len(prev))
+	for _, route := range prev {
+		prevByHost[route.Hostname] = route
+	}
+	nextHosts := make(map[string]struct{}, len(next))
+
+	var added []Route
+	for _, route := range next {
+		nextHosts[route.Hostname] = struct{}{}
+		if current, ok := prevByHost[route.Hostname]; ok && RouteEqual(current, route) {
+			continue
+		}
+		added = append(added, route)
+	}
+	var removed []string
+	for host := range prevByHost {
+		if _, ok := nextHosts[host]; !ok {
+			removed = append(removed, host)
+		}
+	}
+	sort.Strings(removed)
+	return SortRoutes(added), removed
+}
+
+// ApplyRouteDelta returns a new route set with removed hostnames dropped and
+// added routes inserted or replaced.
+func ApplyRouteDelta(current []Route, added []Route, removed []string) []Route {
+	byHost := make(map[string]Route, len(current)+len(added))
+	for _, route := range current {
+		byHost[route.Hostname] = route
+	}
+	for _, host := range removed {
+		delete(byHost, host)
+	}
+	for _, route := range added {
+		byHost[route.Hostname] = route
+	}
+	out := make([]Route, 0, len(byHost))
+	for _, route := range byHost {
+		out = append(out, route)
+	}
+	return SortRoutes(out)
+}
+
+func RouteEqual(a, b Route) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func SortRoutes(routes []Route) []Route {
+	out := make([]Route, len(routes))
+	copy(out, routes)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutesVersionIgnoresOrder(t *testing.T) {
+	a := []Route{{Hostname: "a.example.com", Target: "127.0.0.1:1"}, {Hostname: "b.example.com", Target: "127.0.0.1:2"}}
+	b := []Route{a[1], a[0]}
+	if RoutesVersion(a) != RoutesVersion(b) {
+		t.Fatal("version should not depend on order")
+	}
+	c := []Route{a[0], {Hostname: "b.example.com", Target: "127.0.0.1:3"}}
+	if RoutesVersion(a) == RoutesVersion(c) {
+		t.Fatal("version should change when a target changes")
+	}
+}
+
+func TestDiffAndApplyRouteDelta(t *testing.T) {
+	prev := []Route{
+		{Hostname: "a.example.com", Target: "127.0.0.1:1"},
+		{Hostname: "b.example.com", Target: "127.0.0.1:2"},
+		{Hostname: "c.example.com", Target: "127.0.0.1:3"},
+	}
+	next := []Route{
+		{Hostname: "a.example.com", Target: "127.0.0.1:1"},
+		{Hostname: "b.example.com", Target: "127.0.0.1:20"},
+		{Hostname: "d.example.com", Target: "127.0.0.1:4"},
+	}
+
+	added, removed := DiffRoutes(prev, next)
+	wantAdded := []Route{next[1], next[2]}
+	if !reflect.DeepEqual(added, wantAdded) {
+		t.Fatalf("added = %#v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"c.example.com"}) {
+		t.Fatalf("removed = %#v", removed)
+	}
+
+	got := ApplyRouteDelta(prev, added, removed)
+	if RoutesVersion(got) != RoutesVersion(next) {
+		t.Fatalf("applied delta = %#v", got)
+	}
+}
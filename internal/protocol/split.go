@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// NormalizeSplit validates split and canonicalises its target. A nil split
+// stays nil.
+func NormalizeSplit(split *Split) (*Split, error) {
+	if split == nil {
+		return nil, nil
+	}
+	target, err := NormalizeTarget(split.Target)
+	if err != nil {
+		return nil, fmt.Errorf("split target: %w", err)
+	}
+	if split.Weight < 0 || split.Weight > 100 {
+		return nil, errors.New("split weight must be between 0 and 100")
+	}
+	sticky := strings.ToLower(strings.TrimSpace(split.Sticky))
+	switch sticky {
+	case "", SplitStickyIP, SplitStickyCookie:
+	default:
+		return nil, fmt.Errorf("unknown split sticky mode %q (want %s or %s)", split.Sticky, SplitStickyIP, SplitStickyCookie)
+	}
+	return &Split{Target: target, Weight: split.Weight, Sticky: sticky}, nil
+}
+
+// SplitBucket maps a sticky key to one of 100 buckets; buckets below the
+// weight go to the split target, so raising the weight only moves clients
+// towards it.
+func SplitBucket(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
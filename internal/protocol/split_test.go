@@ -0,0 +1,40 @@
+package protocol
+
+import "testing"
+
+func TestNormalizeSplit(t *testing.T) {
+	got, err := NormalizeSplit(&Split{Target: "http://127.0.0.1:3001", Weight: 10, Sticky: " Cookie "})
+	if err != nil || got.Target != "127.0.0.1:3001" || got.Weight != 10 || got.Sticky != SplitStickyCookie {
+		t.Fatalf("NormalizeSplit = %+v, %v", got, err)
+	}
+	for _, bad := range []*Split{
+		{Target: "", Weight: 10},
+		{Target: "127.0.0.1:3001", Weight: 101},
+		{Target: "127.0.0.1:3001", Weight: -1},
+		{Target: "127.0.0.1:3001", Weight: 10, Sticky: "header"},
+	} {
+		if _, err := NormalizeSplit(bad); err == nil {
+			t.Fatalf("NormalizeSplit(%+v) accepted", bad)
+		}
+	}
+	if got, err := NormalizeSplit(nil); got != nil || err != nil {
+		t.Fatalf("NormalizeSplit(nil) = %+v, %v", got, err)
+	}
+}
+
+func TestSplitBucketIsStable(t *testing.T) {
+	if SplitBucket("203.0.113.7") != SplitBucket("203.0.113.7") {
+		t.Fatalf("bucket changed between calls")
+	}
+	seen := make(map[int]bool)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		b := SplitBucket(key)
+		if b < 0 || b >= 100 {
+			t.Fatalf("bucket %d out of range", b)
+		}
+		seen[b] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("buckets do not spread: %v", seen)
+	}
+}
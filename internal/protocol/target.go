@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Target is where an agent sends a route's traffic. A route's target string
+// is a plain host:port (HTTP), https://host:port, or unix:///path/to.sock.
+type Target struct {
+	Scheme string // "http", "https" or "unix"
+	// Addr is host:port, or the socket path for unix targets.
+	Addr string
+}
+
+func ParseTarget(raw string) (Target, error) {
+	t := strings.TrimSpace(raw)
+	if t == "" {
+		return Target{}, errors.New("target is required")
+	}
+	scheme, rest, hasScheme := strings.Cut(t, "://")
+	if !hasScheme {
+		scheme, rest = "http", t
+	}
+	switch strings.ToLower(scheme) {
+	case "unix":
+		if !strings.HasPrefix(rest, "/") {
+			return Target{}, errors.New("unix target needs an absolute socket path, e.g. unix:///run/app.sock")
+		}
+		return Target{Scheme: "unix", Addr: path.Clean(rest)}, nil
+	case "http", "https":
+		u, err := url.Parse(strings.ToLower(scheme) + "://" + rest)
+		if err != nil || u.Host == "" {
+			return Target{}, errors.New("target should be host:port, e.g. 127.0.0.1:3000")
+		}
+		if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			return Target{}, errors.New("target cannot include a path, query or credentials")
+		}
+		host := u.Host
+		if u.Port() == "" {
+			if u.Scheme != "https" {
+				return Target{}, errors.New("target must include port, e.g. 127.0.0.1:3000")
+			}
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		return Target{Scheme: u.Scheme, Addr: host}, nil
+	default:
+		return Target{}, errors.New("target scheme must be http, https or unix")
+	}
+}
+
+// String is the canonical form stored in configs: HTTP targets stay a bare
+// host:port so existing routes compare equal.
+func (t Target) String() string {
+	if t.Scheme == "http" {
+		return t.Addr
+	}
+	return t.Scheme + "://" + t.Addr
+}
+
+func NormalizeTarget(raw string) (string, error) {
+	t, err := ParseTarget(raw)
+	if err != nil {
+		return "", err
+	}
+	return t.String(), nil
+}
@@ -0,0 +1,23 @@
+package protocol
+
+import "testing"
+
+func TestNormalizeTarget(t *testing.T) {
+	for in, want := range map[string]string{
+		"127.0.0.1:3000":              "127.0.0.1:3000",
+		" http://localhost:3000/":     "localhost:3000",
+		"HTTPS://127.0.0.1:8443":      "https://127.0.0.1:8443",
+		"https://internal.lan":        "https://internal.lan:443",
+		"unix:///run/app/../app.sock": "unix:///run/app.sock",
+	} {
+		got, err := NormalizeTarget(in)
+		if err != nil || got != want {
+			t.Fatalf("NormalizeTarget(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "localhost", "http://localhost", "unix://run/app.sock", "ftp://host:21", "http://host:80/path"} {
+		if got, err := NormalizeTarget(bad); err == nil {
+			t.Fatalf("NormalizeTarget(%q) = %q, want error", bad, got)
+		}
+	}
+}
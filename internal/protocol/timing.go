@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"strconv"
+	"time"
+)
+
+// StatusError is the Timing status of a request the agent answered itself
+// because the local service could not be reached or failed.
+const StatusError = "error"
+
+// Timing is the agent's account of one request, sent on proxy_response so
+// the server can tell a slow tunnel from a slow local service.
+type Timing struct {
+	// DialMS is how long connecting to the local service took; zero when a
+	// pooled connection was reused.
+	DialMS float64 `json:"dial_ms,omitempty"`
+	// TTFBMS runs from starting the local request, dial included, to the
+	// first byte of its response.
+	TTFBMS float64 `json:"ttfb_ms,omitempty"`
+	// TotalMS runs from the agent receiving the request to sending the
+	// response; for a streamed response, to sending its head.
+	TotalMS float64 `json:"total_ms"`
+	// Status is the local response's class, "2xx" to "5xx", or StatusError.
+	Status string `json:"status,omitempty"`
+}
+
+// Millis converts d to the fractional milliseconds Timing uses.
+func Millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// StatusClass returns "2xx" for 200-299 and so on.
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return StatusError
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingHelpers(t *testing.T) {
+	if got := Millis(1500 * time.Microsecond); got != 1.5 {
+		t.Fatalf("Millis = %v, want 1.5", got)
+	}
+	for code, want := range map[int]string{200: "2xx", 304: "3xx", 404: "4xx", 503: "5xx", 0: StatusError} {
+		if got := StatusClass(code); got != want {
+			t.Fatalf("StatusClass(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"tunneling/internal/agent"
+	"tunneling/internal/server"
+)
+
+const (
+	selftestHost  = "selftest.tunneling.local"
+	selftestToken = "selftest-token"
+)
+
+type Result struct {
+	Name     string
+	OK       bool
+	Detail   string
+	Duration time.Duration
+}
+
+type testCase struct {
+	method string
+	size   int
+}
+
+var defaultCases = []testCase{
+	{method: http.MethodGet, size: 0},
+	{method: http.MethodHead, size: 0},
+	{method: http.MethodDelete, size: 0},
+	{method: http.MethodPost, size: 1 << 10},
+	{method: http.MethodPut, size: 64 << 10},
+	{method: http.MethodPatch, size: 1 << 20},
+	{method: http.MethodPost, size: 8 << 20},
+	{method: http.MethodPut, size: 24 << 20},
+}
+
+// Run starts a loopback server, agent and local target, pushes a set of
+// requests through the tunnel and writes a pass/fail report to out.
+func Run(ctx context.Context, out io.Writer) ([]Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "tunneling-selftest-")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targetAddr, stopTarget, err := startEchoTarget()
+	if err != nil {
+		return nil, err
+	}
+	defer stopTarget()
+
+	ts := server.New(server.Options{RequestTimeout: 30 * time.Second})
+	controlMux := http.NewServeMux()
+	controlMux.HandleFunc("/connect", ts.HandleConnect)
+	controlAddr, stopControl, err := serve(controlMux)
+	if err != nil {
+		return nil, err
+	}
+	defer stopControl()
+
+	publicAddr, stopPublic, err := serve(http.HandlerFunc(ts.HandlePublicHTTP))
+	if err != nil {
+		return nil, err
+	}
+	defer stopPublic()
+
+	store, err := agent.NewConfigStore(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("create agent config: %w", err)
+	}
+	if err := store.Upsert(selftestHost, targetAddr); err != nil {
+		return nil, fmt.Errorf("register route: %w", err)
+	}
+	svc, err := agent.NewService("ws://"+controlAddr+"/connect", selftestToken, "127.0.0.1:0", "", "", "", 0, store)
+	if err != nil {
+		return nil, fmt.Errorf("create agent: %w", err)
+	}
+	agentDone := make(chan struct{})
+	go func() {
+		defer close(agentDone)
+		_ = svc.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-agentDone
+	}()
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	publicURL := "http://" + publicAddr
+
+	fmt.Fprintf(out, "selftest: server=%s public=%s target=%s\n", controlAddr, publicAddr, targetAddr)
+	if err := waitForRoute(ctx, client, publicURL); err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(defaultCases))
+	failed := 0
+	for _, tc := range defaultCases {
+		res := runCase(ctx, client, publicURL, tc)
+		if !res.OK {
+			failed++
+		}
+		status := "PASS"
+		if !res.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(out, "%s %-20s %8s %s\n", status, res.Name, res.Duration.Round(time.Millisecond), res.Detail)
+		results = append(results, res)
+	}
+	fmt.Fprintf(out, "selftest: %d passed, %d failed\n", len(results)-failed, failed)
+	if failed > 0 {
+		return results, fmt.Errorf("%d selftest cases failed", failed)
+	}
+	return results, nil
+}
+
+func runCase(ctx context.Context, client *http.Client, publicURL string, tc testCase) Result {
+	res := Result{Name: fmt.Sprintf("%s %s", tc.method, formatSize(tc.size))}
+	payload := make([]byte, tc.size)
+	if _, err := rand.Read(payload); err != nil {
+		res.Detail = "generate payload: " + err.Error()
+		return res
+	}
+	sum := sha256.Sum256(payload)
+	want := hex.EncodeToString(sum[:])
+
+	req, err := http.NewRequestWithContext(ctx, tc.method, publicURL+"/echo?size="+fmt.Sprint(tc.size), bytes.NewReader(payload))
+	if err != nil {
+		res.Detail = "build request: " + err.Error()
+		return res
+	}
+	req.Host = selftestHost
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Duration = time.Since(start)
+		res.Detail = "request failed: " + err.Error()
+		return res
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Detail = "read response: " + err.Error()
+		return res
+	}
+
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		res.Detail = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	case resp.Header.Get("X-Selftest-Method") != tc.method:
+		res.Detail = fmt.Sprintf("method mismatch: got %q", resp.Header.Get("X-Selftest-Method"))
+	case resp.Header.Get("X-Selftest-Sha256") != want:
+		res.Detail = "request body checksum mismatch"
+	case tc.method != http.MethodHead && !bytes.Equal(body, payload):
+		res.Detail = fmt.Sprintf("response body mismatch: got %d bytes", len(body))
+	case tc.method != http.MethodHead && resp.Trailer.Get("X-Selftest-Length") != strconv.Itoa(len(payload)):
+		res.Detail = fmt.Sprintf("trailer mismatch: got %q", resp.Trailer.Get("X-Selftest-Length"))
+	default:
+		res.OK = true
+	}
+	return res
+}
+
+func waitForRoute(ctx context.Context, client *http.Client, publicURL string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicURL+"/echo", nil)
+		if err != nil {
+			return err
+		}
+		req.Host = selftestHost
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return errors.New("agent did not register the selftest route in time")
+}
+
+func startEchoTarget() (string, func(), error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Selftest-Method", r.Method)
+		w.Header().Set("X-Selftest-Sha256", hex.EncodeToString(sum[:]))
+		w.Header().Set("Trailer", "X-Selftest-Length")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+		w.Header().Set("X-Selftest-Length", strconv.Itoa(len(body)))
+	})
+	return serve(mux)
+}
+
+func serve(handler http.Handler) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("listen: %w", err)
+	}
+	srv := &http.Server{Handler: handler}
+	go func() { _ = srv.Serve(ln) }()
+	return ln.Addr().String(), func() { _ = srv.Close() }, nil
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%dKiB", n>>10)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
@@ -0,0 +1,26 @@
+package selftest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRunPassesAllCases(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	results, err := Run(ctx, io.Discard)
+	if err != nil {
+		for _, res := range results {
+			if !res.OK {
+				t.Logf("%s: %s", res.Name, res.Detail)
+			}
+		}
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(results) != len(defaultCases) {
+		t.Fatalf("results = %d, want %d", len(results), len(defaultCases))
+	}
+}
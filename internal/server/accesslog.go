@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func init() {
+	RegisterMiddleware("accesslog", func(string) (Middleware, error) {
+		return MiddlewareFuncs{Response: logAccess}, nil
+	})
+}
+
+func logAccess(req *Request, resp *Response) {
+	slog.Info("access", "hostname", req.Hostname, "method", req.Method, "path", req.Path, "status", resp.Status,
+		"bytes", len(resp.Body), "client_ip", req.ClientIP, "duration", time.Since(req.Start).Round(time.Millisecond))
+}
+
+// accessEntry is one line of the JSON access log. Unlike the accesslog
+// middleware it also covers requests the gateway answers itself (unknown
+// hosts, limits, timeouts).
+type accessEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Host       string  `json:"host"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	ClientIP   string  `json:"client_ip"`
+	TokenHash  string  `json:"token_hash,omitempty"`
+
+	start   time.Time
+	token   string
+	session *AgentSession
+	// sent is when the request went to the agent, answered when its
+	// response head came back.
+	sent     time.Time
+	answered time.Time
+	// timing is the agent's own account, when it sent one.
+	timing *protocol.Timing
+}
+
+type accessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAccessLogger(w io.Writer) *accessLogger {
+	if w == nil {
+		return nil
+	}
+	return &accessLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *accessLogger) record(r *http.Request, rec *accessRecorder, entry *accessEntry) {
+	entry.Time = entry.start.UTC().Format(time.RFC3339Nano)
+	entry.Host = normalizeHost(r.Host)
+	entry.Method = r.Method
+	entry.Path = r.URL.Path
+	entry.Status = rec.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	entry.Bytes = rec.bytes
+	entry.DurationMS = float64(time.Since(entry.start).Microseconds()) / 1000
+	if entry.token != "" {
+		entry.TokenHash = tokenHash(entry.token)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		slog.Warn("write access log failed", "err", err)
+	}
+}
+
+// accessRecorder captures the status and body size of a public response.
+// Unwrap keeps http.ResponseController (flushing streamed bodies) working.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestAccessLogWritesJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	ts := New(Options{RequestTimeout: 5 * time.Second, AccessLog: &out})
+	startFakeAgent(t, ts, "secret-token", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, replyWith("hello"))
+
+	for _, host := range []string{"app.test", "missing.test"} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/path?q=1", nil)
+		req.RemoteAddr = "10.0.0.9:5000"
+		ts.HandlePublicHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines: %q", len(lines), out.String())
+	}
+	var served, missing accessEntry
+	if err := json.Unmarshal([]byte(lines[0]), &served); err != nil {
+		t.Fatalf("decode %q: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &missing); err != nil {
+		t.Fatalf("decode %q: %v", lines[1], err)
+	}
+	if served.Host != "app.test" || served.Path != "/path" || served.Method != http.MethodGet || served.Status != http.StatusOK ||
+		served.Bytes != int64(len("hello")) || served.ClientIP != "10.0.0.9" || served.RequestID == "" || served.TokenHash != tokenHash("secret-token") {
+		t.Fatalf("served entry = %+v", served)
+	}
+	if strings.Contains(lines[0], "secret-token") {
+		t.Fatalf("log line leaks the token: %s", lines[0])
+	}
+	if missing.Status != http.StatusNotFound || missing.TokenHash != "" || missing.RequestID == served.RequestID {
+		t.Fatalf("missing entry = %+v", missing)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"tunneling/internal/protocol"
+)
+
+// acmeChallengePrefix is where ACME HTTP-01 validation requests arrive.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// acmeChallenge reports whether r is an HTTP-01 challenge that route lets
+// through to its target untouched by the route's policies.
+func acmeChallenge(route protocol.Route, r *http.Request) bool {
+	return route.ACMEPassthrough && isACMEChallenge(r)
+}
+
+func isACMEChallenge(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, acmeChallengePrefix)
+}
+
+// ACMEHandler puts the gateway's own ACME client, acme, in front of next
+// but hands the HTTP-01 challenges of hostnames whose route passes them
+// through straight to next, so they reach the local service.
+func (s *TunnelServer) ACMEHandler(acme, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) && s.acmePassthrough(normalizeHost(r.Host)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		acme.ServeHTTP(w, r)
+	})
+}
+
+func (s *TunnelServer) acmePassthrough(host string) bool {
+	if _, ok := s.gateway.getDisabled(host); ok {
+		return true
+	}
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	hr, ok := s.routes[host]
+	if !ok {
+		return false
+	}
+	for _, binding := range hr.bindings {
+		if binding.Route.ACMEPassthrough {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestACMEChallengePassesRoutePolicies(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	locked := protocol.Route{
+		Target:    "127.0.0.1:3000",
+		IPFilter:  &protocol.IPFilter{Allow: []string{"10.0.0.0/8"}},
+		Auth:      &protocol.RouteAuth{TokenSecret: "0123456789abcdef"},
+		RateLimit: &protocol.RateLimit{RPS: 0.001, Burst: 1},
+	}
+	open, closed := locked, locked
+	open.Hostname, open.ACMEPassthrough = "tls.test", true
+	closed.Hostname = "plain.test"
+	startFakeAgent(t, ts, "tok", []protocol.Route{open, closed}, func(env protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(method, target string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "203.0.113.5:1000"
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := do(http.MethodGet, "http://tls.test/.well-known/acme-challenge/abc"); code != http.StatusOK {
+			t.Fatalf("challenge %d = %d", i, code)
+		}
+	}
+	if code := do(http.MethodGet, "http://tls.test/"); code != http.StatusForbidden {
+		t.Fatalf("other path = %d", code)
+	}
+	if code := do(http.MethodPost, "http://tls.test/.well-known/acme-challenge/abc"); code != http.StatusForbidden {
+		t.Fatalf("challenge POST = %d", code)
+	}
+	if code := do(http.MethodGet, "http://plain.test/.well-known/acme-challenge/abc"); code != http.StatusForbidden {
+		t.Fatalf("challenge without passthrough = %d", code)
+	}
+
+	gateway := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := ts.ACMEHandler(gateway, http.HandlerFunc(ts.HandlePublicHTTP))
+	for target, want := range map[string]int{
+		"http://tls.test/.well-known/acme-challenge/abc":   http.StatusOK,
+		"http://plain.test/.well-known/acme-challenge/abc": http.StatusTeapot,
+		"http://tls.test/": http.StatusTeapot,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Fatalf("%s = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestACMEChallengeOfDisabledRoute(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	var targets []string
+	startFakeTunnelAgent(t, ts, "tok", "t1", []protocol.Route{{Hostname: "other.test", Target: "127.0.0.1:4000"}}, func(env protocol.Envelope) protocol.Envelope {
+		targets = append(targets, env.Hostname+" "+env.Target+" "+env.Path)
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+	ts.SetGatewayRoutes([]protocol.GatewayRoute{
+		{Hostname: "off.test", Disabled: true, TunnelID: "t1", Target: "127.0.0.1:3000"},
+		{Hostname: "gone.test", Disabled: true, TunnelID: "t2", Target: "127.0.0.1:3000"},
+		{Hostname: "bad.test", Disabled: true, TunnelID: "t1"},
+	})
+
+	do := func(method, target string) int {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code
+	}
+	if code := do(http.MethodGet, "http://off.test/.well-known/acme-challenge/abc"); code != http.StatusOK {
+		t.Fatalf("challenge of disabled route = %d", code)
+	}
+	if len(targets) != 1 || targets[0] != "off.test 127.0.0.1:3000 /.well-known/acme-challenge/abc" {
+		t.Fatalf("agent saw %q", targets)
+	}
+	for _, target := range []string{"http://off.test/", "http://gone.test/.well-known/acme-challenge/abc", "http://bad.test/.well-known/acme-challenge/abc"} {
+		if code := do(http.MethodGet, target); code != http.StatusNotFound {
+			t.Fatalf("%s = %d, want 404", target, code)
+		}
+	}
+	if code := do(http.MethodPost, "http://off.test/.well-known/acme-challenge/abc"); code != http.StatusNotFound {
+		t.Fatalf("challenge POST = %d", code)
+	}
+
+	gateway := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	rec := httptest.NewRecorder()
+	ts.ACMEHandler(gateway, http.HandlerFunc(ts.HandlePublicHTTP)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://off.test/.well-known/acme-challenge/abc", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("challenge behind the server's ACME client = %d", rec.Code)
+	}
+}
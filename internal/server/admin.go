@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/logging"
+	"tunneling/internal/protocol"
+)
+
+// AgentInfo describes one connected agent session for the admin API.
+type AgentInfo struct {
+	SessionID         string              `json:"session_id"`
+	TokenHint         string              `json:"token_hint"`
+	RemoteAddr        string              `json:"remote_addr"`
+	ConnectedAt       time.Time           `json:"connected_at"`
+	Resumed           bool                `json:"resumed"`
+	Streaming         bool                `json:"streaming"`
+	Binary            bool                `json:"binary"`
+	Caps              []string            `json:"caps"`
+	ProtocolVersion   int                 `json:"protocol_version,omitempty"`
+	AgentVersion      string              `json:"agent_version,omitempty"`
+	Agent             *protocol.AgentMeta `json:"agent,omitempty"`
+	InFlight          int64               `json:"in_flight"`
+	WriteQueueDepth   int                 `json:"write_queue_depth"`
+	WriteQueueDropped uint64              `json:"write_queue_dropped"`
+	Routes            int                 `json:"routes"`
+	Unhealthy         []string            `json:"unhealthy,omitempty"`
+	Draining          bool                `json:"draining,omitempty"`
+}
+
+// RouteInfo is one entry of the live routing table. A hostname served by
+// several tokens under the balance policy appears once per token; an alias
+// names the route's own hostname in AliasOf.
+type RouteInfo struct {
+	Hostname  string `json:"hostname"`
+	AliasOf   string `json:"alias_of,omitempty"`
+	Target    string `json:"target"`
+	TokenHint string `json:"token_hint"`
+	Sessions  int    `json:"sessions"`
+}
+
+// Agents lists connected sessions, oldest first.
+func (s *TunnelServer) Agents() []AgentInfo {
+	sessions := s.allSessions()
+	routesPerToken := make(map[string]int)
+	s.routesMu.RLock()
+	for host, hr := range s.routes {
+		for _, binding := range hr.bindings {
+			if binding.Route.Hostname == host {
+				routesPerToken[binding.Token]++
+			}
+		}
+	}
+	s.routesMu.RUnlock()
+
+	out := make([]AgentInfo, 0, len(sessions))
+	for _, session := range sessions {
+		protocolVersion, agentVersion := session.Versions()
+		out = append(out, AgentInfo{
+			SessionID:         session.ID,
+			TokenHint:         tokenHint(session.Token),
+			RemoteAddr:        session.RemoteAddr,
+			ConnectedAt:       session.ConnectedAt,
+			Resumed:           session.Resumed,
+			Streaming:         session.HasCap(protocol.CapStream),
+			Binary:            session.HasCap(protocol.CapBinary),
+			Caps:              session.Caps(),
+			ProtocolVersion:   protocolVersion,
+			AgentVersion:      agentVersion,
+			Agent:             session.Agent(),
+			InFlight:          session.inFlight.Load(),
+			WriteQueueDepth:   session.writer.Depth(),
+			WriteQueueDropped: session.writer.Dropped(),
+			Routes:            routesPerToken[session.Token],
+			Unhealthy:         session.UnhealthyHosts(),
+			Draining:          session.draining.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Routes lists the live routing table sorted by hostname.
+func (s *TunnelServer) Routes() []RouteInfo {
+	s.routesMu.RLock()
+	var hosts []string
+	var bindings []routeBinding
+	for host, hr := range s.routes {
+		for _, binding := range hr.bindings {
+			hosts = append(hosts, host)
+			bindings = append(bindings, binding)
+		}
+	}
+	s.routesMu.RUnlock()
+
+	s.agentsMu.RLock()
+	out := make([]RouteInfo, 0, len(bindings))
+	for i, binding := range bindings {
+		info := RouteInfo{
+			Hostname:  hosts[i],
+			Target:    binding.Target,
+			TokenHint: tokenHint(binding.Token),
+			Sessions:  len(s.agents[binding.Token]),
+		}
+		if info.Hostname != binding.Route.Hostname {
+			info.AliasOf = binding.Route.Hostname
+		}
+		out = append(out, info)
+	}
+	s.agentsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		return out[i].TokenHint < out[j].TokenHint
+	})
+	return out
+}
+
+// DisconnectAgent closes the session with the given id. The agent will
+// reconnect on its own unless its token is revoked meanwhile.
+func (s *TunnelServer) DisconnectAgent(sessionID string) bool {
+	for _, session := range s.allSessions() {
+		if session.ID != sessionID {
+			continue
+		}
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by admin")
+		_ = session.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = session.Conn.Close()
+		slog.Info("agent disconnected by admin", "token", tokenHint(session.Token), "session_id", session.ID)
+		return true
+	}
+	return false
+}
+
+// EvictRoute drops hostname from the routing table. The owning agent adds it
+// back the next time it publishes its full route set.
+func (s *TunnelServer) EvictRoute(hostname string) bool {
+	host := normalizeHost(hostname)
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	hr, ok := s.routes[host]
+	if !ok {
+		return false
+	}
+	delete(s.routes, host)
+	// The owners' next delta no longer applies; they send their full set.
+	for _, binding := range hr.bindings {
+		delete(s.routeVersions, binding.Token)
+	}
+	s.routesChanged()
+	slog.Info("route evicted by admin", "hostname", host)
+	return true
+}
+
+// AdminHandler serves the admin API. With a non-empty token every request
+// must carry "Authorization: Bearer <token>".
+//
+//	GET    /api/agents          connected sessions
+//	DELETE /api/agents/{id}     disconnect a session
+//	GET    /api/routes          live routing table
+//	DELETE /api/routes/{host}   evict a hostname
+//	GET    /api/cluster         cluster peers
+//	GET    /api/latency         request latency per hostname
+//	GET    /api/log-level       current log level
+//	PUT    /api/log-level       change it, {"level": "debug"}
+func (s *TunnelServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"agents": s.Agents()})
+	})
+	mux.HandleFunc("/api/agents/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/agents/")
+		if !s.DisconnectAgent(id) {
+			writeAdminJSON(w, http.StatusNotFound, map[string]any{"error": "session not found"})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	mux.HandleFunc("/api/routes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"routes": s.Routes()})
+	})
+	mux.HandleFunc("/api/routes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.EvictRoute(strings.TrimPrefix(r.URL.Path, "/api/routes/")) {
+			writeAdminJSON(w, http.StatusNotFound, map[string]any{"error": "route not found"})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+
+	mux.HandleFunc("/api/cluster", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"enabled": s.cluster != nil, "nodes": s.ClusterNodes()})
+	})
+	mux.HandleFunc("/api/latency", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"hosts": s.Latency()})
+	})
+	mux.Handle("/api/log-level", logging.Handler())
+
+	if token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func tokenHint(token string) string {
+	if len(token) <= 8 {
+		return token
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
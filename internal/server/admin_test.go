@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestAdminAPIListsAndEvicts(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	startFakeAgent(t, ts, "agent-token-1234", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, replyWith("a"))
+	admin := ts.AdminHandler("secret")
+
+	do := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/api/agents", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d", rec.Code)
+	}
+
+	var agents struct {
+		Agents []AgentInfo `json:"agents"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/agents", "secret").Body.Bytes(), &agents); err != nil {
+		t.Fatalf("decode agents: %v", err)
+	}
+	if len(agents.Agents) != 1 || agents.Agents[0].TokenHint != "agen...1234" || agents.Agents[0].RemoteAddr == "" || agents.Agents[0].Routes != 1 {
+		t.Fatalf("agents = %+v", agents.Agents)
+	}
+
+	var routes struct {
+		Routes []RouteInfo `json:"routes"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/routes", "secret").Body.Bytes(), &routes); err != nil {
+		t.Fatalf("decode routes: %v", err)
+	}
+	if len(routes.Routes) != 1 || routes.Routes[0].Hostname != "app.test" || routes.Routes[0].Sessions != 1 {
+		t.Fatalf("routes = %+v", routes.Routes)
+	}
+
+	if rec := do(http.MethodDelete, "/api/routes/app.test", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("evict status = %d", rec.Code)
+	}
+	if ts.HasRoute("app.test") {
+		t.Fatalf("route still present after eviction")
+	}
+
+	if rec := do(http.MethodDelete, "/api/agents/"+agents.Agents[0].SessionID, "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("disconnect status = %d", rec.Code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ts.Agents()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("agent still connected after disconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
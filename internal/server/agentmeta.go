@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// agentReport is what ReportAgents posts to the control plane for one
+// connected agent.
+type agentReport struct {
+	TunnelID  string              `json:"tunnel_id"`
+	SessionID string              `json:"session_id"`
+	Agent     *protocol.AgentMeta `json:"agent"`
+}
+
+// agentReporter queues agent descriptions until ReportAgents sends them.
+// Only agents whose tunnel_id was checked at connect are queued, so an
+// agent cannot write onto someone else's tunnel.
+type agentReporter struct {
+	verified bool
+	pending  chan agentReport
+}
+
+func newAgentReporter(verified bool) *agentReporter {
+	return &agentReporter{verified: verified, pending: make(chan agentReport, 64)}
+}
+
+func (r *agentReporter) add(session *AgentSession) {
+	agent := session.Agent()
+	if !r.verified || session.TunnelID == "" || agent == nil {
+		return
+	}
+	select {
+	case r.pending <- agentReport{TunnelID: session.TunnelID, SessionID: session.ID, Agent: agent}:
+	default:
+	}
+}
+
+// helloAgentMeta returns the agent description of a hello; agents that
+// send none still get one carrying their version.
+func helloAgentMeta(env protocol.Envelope) *protocol.AgentMeta {
+	if env.Agent == nil && env.Version == "" {
+		return nil
+	}
+	meta := protocol.AgentMeta{Version: env.Version}
+	if env.Agent != nil {
+		meta = *env.Agent
+		if meta.Version == "" {
+			meta.Version = env.Version
+		}
+	}
+	return protocol.SanitizeAgentMeta(&meta)
+}
+
+// Agent returns what the agent reported about itself in its hello, nil
+// before the hello.
+func (s *AgentSession) Agent() *protocol.AgentMeta {
+	s.helloMu.RLock()
+	defer s.helloMu.RUnlock()
+	return s.agent
+}
+
+// ReportAgents posts the description of each agent that connects with a
+// verified tunnel_id to endpoint, the control plane's /api/gateway/agents,
+// until ctx is done.
+func (s *TunnelServer) ReportAgents(ctx context.Context, endpoint, apiKey string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case report := <-s.agentReports.pending:
+			if err := postControl(ctx, client, endpoint, apiKey, report); err != nil {
+				slog.Warn("agent report failed", "tunnel_id", report.TunnelID, "session_id", report.SessionID, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestHelloAgentMetaIsShownAndReported(t *testing.T) {
+	reports := make(chan agentReport, 1)
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report agentReport
+		if r.Header.Get("Authorization") != "Bearer key" || json.NewDecoder(r.Body).Decode(&report) != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reports <- report
+	}))
+	defer control.Close()
+
+	ts := New(Options{RequestTimeout: 5 * time.Second, TokenValidator: TokenValidatorFunc(func(context.Context, string, string) error { return nil })})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.ReportAgents(ctx, control.URL, "key")
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&tunnel_id=t1", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var env protocol.Envelope
+	_ = conn.ReadJSON(&env)
+	meta := &protocol.AgentMeta{OS: "darwin", Arch: "arm64", Hostname: "mac-mini", Labels: map[string]string{"env": "staging", "bad key": "x"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeHello, ProtocolVersion: protocol.ProtocolVersion, Version: "v0.4.2", Agent: meta}); err != nil {
+		t.Fatalf("send hello: %v", err)
+	}
+	_ = conn.ReadJSON(&env)
+
+	agents := ts.Agents()
+	if len(agents) != 1 || agents[0].Agent == nil {
+		t.Fatalf("agents = %+v", agents)
+	}
+	got := agents[0].Agent
+	if got.Version != "v0.4.2" || got.Hostname != "mac-mini" || got.OS != "darwin" || len(got.Labels) != 1 || got.Labels["env"] != "staging" {
+		t.Fatalf("agent = %+v", got)
+	}
+	select {
+	case report := <-reports:
+		if report.TunnelID != "t1" || report.SessionID != agents[0].SessionID || report.Agent.Hostname != "mac-mini" {
+			t.Fatalf("report = %+v", report)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent was not reported")
+	}
+}
+
+func TestAgentReporterNeedsVerifiedTunnel(t *testing.T) {
+	session := &AgentSession{ID: "s1", TunnelID: "t1", agent: &protocol.AgentMeta{Version: "v1"}}
+	unverified := newAgentReporter(false)
+	unverified.add(session)
+	if len(unverified.pending) != 0 {
+		t.Fatal("unverified tunnel_id was reported")
+	}
+	verified := newAgentReporter(true)
+	verified.add(&AgentSession{ID: "s2", agent: session.agent})
+	verified.add(session)
+	if len(verified.pending) != 1 {
+		t.Fatalf("pending = %d, want only the session with a tunnel_id", len(verified.pending))
+	}
+}
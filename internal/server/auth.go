@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// ErrAgentUnauthorized is returned by a TokenValidator for credentials that
+// must be rejected; any other error is treated as temporary.
+var ErrAgentUnauthorized = errors.New("agent unauthorized")
+
+// agentToken reads the agent's token from "Authorization: Bearer", falling
+// back to the ?token= query parameter of older agents. Tokens in the URL end
+// up in proxy logs, so fromQuery lets the caller flag them.
+func agentToken(r *http.Request) (token string, fromQuery bool) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if token = strings.TrimSpace(bearer); token != "" {
+			return token, false
+		}
+	}
+	token = strings.TrimSpace(r.URL.Query().Get("token"))
+	return token, token != ""
+}
+
+// TokenValidator checks agent credentials before HandleConnect upgrades the
+// connection. tunnelID is empty for agents that do not send one.
+type TokenValidator interface {
+	ValidateAgent(ctx context.Context, token, tunnelID string) error
+}
+
+// TokenValidatorFunc adapts a function to TokenValidator.
+type TokenValidatorFunc func(ctx context.Context, token, tunnelID string) error
+
+func (f TokenValidatorFunc) ValidateAgent(ctx context.Context, token, tunnelID string) error {
+	return f(ctx, token, tunnelID)
+}
+
+// HostnameAuthorizer reports the hostnames a tunnel owns, so that an agent
+// with valid credentials cannot register someone else's domain.
+type HostnameAuthorizer interface {
+	AuthorizedHostnames(ctx context.Context, token, tunnelID string) (map[string]bool, error)
+}
+
+const (
+	controlAuthTTL = time.Minute
+	// controlAuthCacheSize bounds the cache of accepted credentials.
+	controlAuthCacheSize = 10000
+)
+
+type authResult struct {
+	err     error
+	expires time.Time
+}
+
+// ControlValidator asks the control API's /agent/auth endpoint, caching
+// accepted credentials briefly so a reconnect storm does not turn into a
+// request storm. Rejections are not cached: the keys would be whatever
+// strangers send, and the connect lockout already slows them down.
+type ControlValidator struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]authResult
+}
+
+// NewControlValidator asks controlAPI with apiKey, the control API key
+// that /agent/auth requires once the control plane has API auth turned on.
+func NewControlValidator(controlAPI, apiKey string) *ControlValidator {
+	return &ControlValidator{
+		endpoint: strings.TrimRight(controlAPI, "/") + "/agent/auth",
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    make(map[string]authResult),
+	}
+}
+
+func (v *ControlValidator) ValidateAgent(ctx context.Context, token, tunnelID string) error {
+	if tunnelID == "" {
+		return fmt.Errorf("%w: tunnel_id is required", ErrAgentUnauthorized)
+	}
+	key := tunnelID + "\x00" + token
+	now := time.Now()
+	v.mu.Lock()
+	cached, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.err
+	}
+
+	_, err := v.ask(ctx, token, tunnelID)
+	if err == nil {
+		v.remember(key, authResult{expires: now.Add(controlAuthTTL)})
+	}
+	return err
+}
+
+// AuthorizedHostnames always asks the control API: registrations are rare and
+// a route created a moment ago must be accepted right away.
+func (v *ControlValidator) AuthorizedHostnames(ctx context.Context, token, tunnelID string) (map[string]bool, error) {
+	if tunnelID == "" {
+		return nil, fmt.Errorf("%w: tunnel_id is required", ErrAgentUnauthorized)
+	}
+	hostnames, err := v.ask(ctx, token, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		allowed[normalizeHost(hostname)] = true
+	}
+	return allowed, nil
+}
+
+func (v *ControlValidator) remember(key string, result authResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for k, r := range v.cache {
+		if now.After(r.expires) {
+			delete(v.cache, k)
+		}
+	}
+	if len(v.cache) >= controlAuthCacheSize {
+		// Every entry is live; skipping the cache only costs a request.
+		return
+	}
+	v.cache[key] = result
+}
+
+func (v *ControlValidator) ask(ctx context.Context, token, tunnelID string) ([]string, error) {
+	body, err := json.Marshal(map[string]string{"tunnel_id": tunnelID, "token": token})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if v.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+v.apiKey)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("control auth: %w", err)
+	}
+	defer resp.Body.Close()
+	// A challenge or a 403 is about our API key, not the agent's token.
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "" {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("control auth: control api refused the server's -control-api-key (status %d)", resp.StatusCode)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return nil, ErrAgentUnauthorized
+	default:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("control auth: unexpected status %d", resp.StatusCode)
+	}
+	var payload struct {
+		Hostnames []string `json:"hostnames"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("control auth: decode response: %w", err)
+	}
+	return payload.Hostnames, nil
+}
+
+// authorizedRoutes drops routes for hostnames the session's tunnel does not
+// own. While the authorizer is unreachable only hostnames already bound to
+// the token are kept, so a control outage neither takes live routes down nor
+// lets new ones through.
+func (s *TunnelServer) authorizedRoutes(session *AgentSession, routes []protocol.Route) []protocol.Route {
+	if s.hostAuthorizer == nil || len(routes) == 0 {
+		return routes
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	allowed, err := s.hostAuthorizer.AuthorizedHostnames(ctx, session.Token, session.TunnelID)
+	if err != nil && !errors.Is(err, ErrAgentUnauthorized) {
+		slog.Warn("hostname authorization unavailable, keeping known routes only", "token", tokenHint(session.Token), "err", err)
+		allowed = s.boundHostnames(session.Token)
+	}
+
+	kept := make([]protocol.Route, 0, len(routes))
+	var dropped []string
+	for _, route := range routes {
+		if !allowed[normalizeHost(route.Hostname)] {
+			dropped = append(dropped, route.Hostname)
+			continue
+		}
+		var aliases []string
+		for _, alias := range route.Aliases {
+			if allowed[normalizeHost(alias)] {
+				aliases = append(aliases, alias)
+			} else {
+				dropped = append(dropped, alias)
+			}
+		}
+		route.Aliases = aliases
+		kept = append(kept, route)
+	}
+	if len(dropped) > 0 {
+		slog.Warn("dropped unauthorized routes", "token", tokenHint(session.Token), "tunnel_id", session.TunnelID, "hosts", strings.Join(dropped, ","))
+	}
+	return kept
+}
+
+func (s *TunnelServer) boundHostnames(token string) map[string]bool {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	out := make(map[string]bool)
+	for host, hr := range s.routes {
+		for _, binding := range hr.bindings {
+			if binding.Token == token {
+				out[host] = true
+			}
+		}
+	}
+	return out
+}
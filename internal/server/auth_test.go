@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestHandleConnectRejectsUnknownAgents(t *testing.T) {
+	var calls atomic.Int32
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Authorization") != "Bearer server-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/agent/auth" || req["tunnel_id"] != "tun-1" || req["token"] != "good-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"tunnel_id": "tun-1", "hostnames": []string{"app.test"}})
+	}))
+	defer control.Close()
+
+	ts := New(Options{RequestTimeout: 5 * time.Second, TokenValidator: NewControlValidator(control.URL, "server-key")})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+	wsURL := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect"
+
+	for _, query := range []string{"?token=bad-token&tunnel_id=tun-1", "?token=good-token"} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("dial %s: resp=%v err=%v, want 401", query, resp, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=good-token&tunnel_id=tun-1", nil)
+		if err != nil {
+			t.Fatalf("dial valid agent: %v", err)
+		}
+		_ = conn.Close()
+	}
+	// The missing tunnel_id is refused locally and the second valid dial is
+	// served from the cache.
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("control auth calls = %d, want 2", got)
+	}
+}
+
+func TestHandleConnectTakesBearerToken(t *testing.T) {
+	seen := make(chan string, 2)
+	ts := New(Options{TokenValidator: TokenValidatorFunc(func(_ context.Context, token, _ string) error {
+		seen <- token
+		return nil
+	})})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+	wsURL := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=ignored", http.Header{"Authorization": {"Bearer header-token"}})
+	if err != nil {
+		t.Fatalf("dial with bearer token: %v", err)
+	}
+	_ = conn.Close()
+	if got := ts.queryTokenAgents.Value(); got != 0 {
+		t.Fatalf("bearer dial counted as query token: %v", got)
+	}
+	// Older agents still get in, but are counted.
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL+"?token=query-token", nil)
+	if err != nil {
+		t.Fatalf("dial with query token: %v", err)
+	}
+	_ = conn.Close()
+	if got := ts.queryTokenAgents.Value(); got != 1 {
+		t.Fatalf("query token agents = %v", got)
+	}
+	if first, second := <-seen, <-seen; first != "header-token" || second != "query-token" {
+		t.Fatalf("validated tokens = %q, %q", first, second)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("dial without token: %v %v", resp, err)
+	}
+}
+
+type staticHostnames map[string]bool
+
+func (h staticHostnames) AuthorizedHostnames(_ context.Context, _, tunnelID string) (map[string]bool, error) {
+	if tunnelID != "tun-1" {
+		return nil, ErrAgentUnauthorized
+	}
+	return h, nil
+}
+
+func TestRegisterRoutesDropsForeignHostnames(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, HostnameAuthorizer: staticHostnames{"mine.test": true}})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&tunnel_id=tun-1", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatalf("read session envelope: %v", err)
+	}
+	routes := []protocol.Route{{Hostname: "mine.test", Target: "127.0.0.1:1"}, {Hostname: "victim.test", Target: "127.0.0.1:2"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("mine.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("owned route was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ts.HasRoute("victim.test") {
+		t.Fatalf("foreign hostname was registered")
+	}
+}
+
+func TestReservedHostnamesAreNeverBound(t *testing.T) {
+	reserved, err := protocol.NewReservedHostnames([]string{"control.example.com"}, "")
+	if err != nil {
+		t.Fatalf("NewReservedHostnames: %v", err)
+	}
+	ts := New(Options{ReservedHostnames: reserved})
+	ok := protocol.Route{Hostname: "app.example.com", Target: "127.0.0.1:3000"}
+	ts.applyRoutes("tok", []protocol.Route{
+		ok,
+		{Hostname: "control.example.com", Target: "127.0.0.1:3000"},
+		{Hostname: "10.0.0.1", Target: "127.0.0.1:3000"},
+	}, "")
+	if got, want := ts.routesVersion("tok"), protocol.RoutesVersion([]protocol.Route{ok}); got != want {
+		t.Fatalf("routes version = %s, want only %s bound", got, ok.Hostname)
+	}
+	env := protocol.Envelope{
+		BaseVersion: ts.routesVersion("tok"),
+		Routes:      []protocol.Route{{Hostname: "localhost", Target: "127.0.0.1:3000"}},
+	}
+	ts.applyRouteDelta("tok", env)
+	if got, want := ts.routesVersion("tok"), protocol.RoutesVersion([]protocol.Route{ok}); got != want {
+		t.Fatal("a route delta bound localhost")
+	}
+}
+
+func TestRouteDeltaAfterRefusedRoute(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, HostnameAuthorizer: staticHostnames{"mine.test": true, "new.test": true}})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&tunnel_id=tun-1", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatalf("read session envelope: %v", err)
+	}
+	// The agent versions everything it sends, victim.test included.
+	routes := []protocol.Route{{Hostname: "mine.test", Target: "127.0.0.1:1"}, {Hostname: "victim.test", Target: "127.0.0.1:2"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes, RoutesVersion: protocol.RoutesVersion(routes)}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	added := protocol.Route{Hostname: "new.test", Target: "127.0.0.1:3"}
+	delta := protocol.Envelope{
+		Type:          protocol.TypeRouteDelta,
+		Routes:        []protocol.Route{added},
+		BaseVersion:   protocol.RoutesVersion(routes),
+		RoutesVersion: protocol.RoutesVersion(append(routes, added)),
+	}
+	if err := conn.WriteJSON(delta); err != nil {
+		t.Fatalf("route delta: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("new.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("delta after a refused route was not applied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ts.HasRoute("victim.test") {
+		t.Fatalf("foreign hostname was registered")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var env protocol.Envelope
+	if err := conn.ReadJSON(&env); err == nil {
+		t.Fatalf("server sent %s after the delta, want nothing", env.Type)
+	}
+}
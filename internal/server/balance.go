@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"tunneling/internal/protocol"
+)
+
+// Session policies decide what happens when an agent connects with a token
+// that already has a session, or registers a hostname another token serves.
+const (
+	// SessionPolicyReplace keeps one session per token and one token per
+	// hostname; the newcomer takes over.
+	SessionPolicyReplace = "replace"
+	// SessionPolicyBalance keeps all of them and spreads requests across the
+	// sessions that serve a hostname.
+	SessionPolicyBalance = "balance"
+)
+
+const (
+	BalanceRoundRobin    = "round-robin"
+	BalanceLeastInFlight = "least-in-flight"
+)
+
+// ParseSessionPolicy validates a -session-policy value.
+func ParseSessionPolicy(v string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(v)); p {
+	case "", SessionPolicyReplace:
+		return SessionPolicyReplace, nil
+	case SessionPolicyBalance:
+		return SessionPolicyBalance, nil
+	default:
+		return "", fmt.Errorf("unknown session policy %q (want %s or %s)", v, SessionPolicyReplace, SessionPolicyBalance)
+	}
+}
+
+// ParseBalance validates a -balance value.
+func ParseBalance(v string) (string, error) {
+	switch b := strings.ToLower(strings.TrimSpace(v)); b {
+	case "", BalanceRoundRobin:
+		return BalanceRoundRobin, nil
+	case BalanceLeastInFlight:
+		return BalanceLeastInFlight, nil
+	default:
+		return "", fmt.Errorf("unknown balance strategy %q (want %s or %s)", v, BalanceRoundRobin, BalanceLeastInFlight)
+	}
+}
+
+// hostRoute is everything bound to one public hostname: one binding per
+// agent token, plus the round-robin cursor shared by requests for the host.
+type hostRoute struct {
+	bindings []routeBinding
+	next     atomic.Uint64
+}
+
+// bindRouteLocked binds route to token under its hostname and each alias.
+// Under the replace policy it evicts any other token; under balance it sits
+// next to them.
+func (s *TunnelServer) bindRouteLocked(token string, route protocol.Route) {
+	host := normalizeHost(route.Hostname)
+	target := strings.TrimSpace(route.Target)
+	if host == "" || target == "" {
+		return
+	}
+	route.Hostname = host
+	route.Target = target
+	binding := routeBinding{Token: token, Target: target, Route: route}
+
+	// Aliases the route no longer has go first.
+	if previous, ok := s.bindingLocked(token, host); ok && previous.Route.Hostname == host {
+		for _, alias := range previous.Route.Aliases {
+			if !slices.Contains(route.Aliases, alias) {
+				s.unbindHostLocked(token, alias)
+			}
+		}
+	}
+	for _, name := range route.Hostnames() {
+		s.bindHostLocked(token, name, binding)
+	}
+}
+
+func (s *TunnelServer) bindHostLocked(token, host string, binding routeBinding) {
+	hr := s.routes[host]
+	if hr == nil {
+		hr = &hostRoute{}
+		s.routes[host] = hr
+	}
+	for i, existing := range hr.bindings {
+		if existing.Token == token {
+			hr.bindings[i] = binding
+			return
+		}
+	}
+	if s.sessionPolicy == SessionPolicyReplace && len(hr.bindings) > 0 {
+		slog.Info("route moved to another token", "hostname", host, "from", tokenHint(hr.bindings[0].Token), "token", tokenHint(token))
+		hr.bindings = hr.bindings[:0]
+	}
+	hr.bindings = append(hr.bindings, binding)
+}
+
+// unbindRouteLocked removes token's route for host, together with its
+// aliases when host is the route's own hostname.
+func (s *TunnelServer) unbindRouteLocked(token, host string) {
+	if binding, ok := s.bindingLocked(token, host); ok && binding.Route.Hostname == host {
+		for _, alias := range binding.Route.Aliases {
+			s.unbindHostLocked(token, alias)
+		}
+	}
+	s.unbindHostLocked(token, host)
+}
+
+func (s *TunnelServer) bindingLocked(token, host string) (routeBinding, bool) {
+	if hr := s.routes[host]; hr != nil {
+		for _, binding := range hr.bindings {
+			if binding.Token == token {
+				return binding, true
+			}
+		}
+	}
+	return routeBinding{}, false
+}
+
+func (s *TunnelServer) unbindHostLocked(token, host string) {
+	hr := s.routes[host]
+	if hr == nil {
+		return
+	}
+	kept := hr.bindings[:0]
+	for _, binding := range hr.bindings {
+		if binding.Token != token {
+			kept = append(kept, binding)
+		}
+	}
+	hr.bindings = kept
+	if len(kept) == 0 {
+		delete(s.routes, host)
+	}
+}
+
+// addAgent registers a new session for its token and returns the sessions it
+// displaces: the previous one under the replace policy, or an older
+// connection of the same resumed session under balance.
+func (s *TunnelServer) addAgent(next *AgentSession) []*AgentSession {
+	s.agentsMu.Lock()
+	defer s.agentsMu.Unlock()
+	current := s.agents[next.Token]
+	if s.sessionPolicy == SessionPolicyReplace {
+		s.agents[next.Token] = []*AgentSession{next}
+		return current
+	}
+	var displaced []*AgentSession
+	kept := make([]*AgentSession, 0, len(current)+1)
+	for _, session := range current {
+		if session.ID == next.ID {
+			displaced = append(displaced, session)
+			continue
+		}
+		kept = append(kept, session)
+	}
+	s.agents[next.Token] = append(kept, next)
+	return displaced
+}
+
+// removeAgent drops session and reports whether its token has no sessions
+// left.
+func (s *TunnelServer) removeAgent(session *AgentSession) (removed, last bool) {
+	s.agentsMu.Lock()
+	defer s.agentsMu.Unlock()
+	current := s.agents[session.Token]
+	kept := make([]*AgentSession, 0, len(current))
+	for _, candidate := range current {
+		if candidate == session {
+			removed = true
+			continue
+		}
+		kept = append(kept, candidate)
+	}
+	if !removed {
+		return false, false
+	}
+	if len(kept) == 0 {
+		delete(s.agents, session.Token)
+		return true, true
+	}
+	s.agents[session.Token] = kept
+	return true, false
+}
+
+type candidate struct {
+	binding routeBinding
+	session *AgentSession
+}
+
+// pickSession chooses the binding and live session that serve host, keeping
+// the session whose affinity key is pinned if it is still a candidate. ok is
+// false when host is not routed at all; session is nil when it is routed but
+// no agent behind it is connected (e.g. during the resume window) or every
+// one is draining.
+func (s *TunnelServer) pickSession(host, pinned string) (routeBinding, *AgentSession, bool) {
+	s.routesMu.RLock()
+	hr := s.routes[host]
+	if hr == nil || len(hr.bindings) == 0 {
+		s.routesMu.RUnlock()
+		return routeBinding{}, nil, false
+	}
+	bindings := append([]routeBinding(nil), hr.bindings...)
+	s.routesMu.RUnlock()
+
+	var candidates []candidate
+	s.agentsMu.RLock()
+	for _, binding := range bindings {
+		for _, session := range s.agents[binding.Token] {
+			if !session.draining.Load() {
+				candidates = append(candidates, candidate{binding, session})
+			}
+		}
+	}
+	s.agentsMu.RUnlock()
+	if len(candidates) > 1 {
+		candidates = healthyCandidates(candidates)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return bindings[0], nil, true
+	case 1:
+		return candidates[0].binding, candidates[0].session, true
+	}
+	if pinned != "" {
+		for _, c := range candidates {
+			if s.affinityKey(c.session) == pinned {
+				return c.binding, c.session, true
+			}
+		}
+	}
+
+	start := int((hr.next.Add(1) - 1) % uint64(len(candidates)))
+	chosen := candidates[start]
+	if s.balance == BalanceLeastInFlight {
+		// Scan from the round-robin cursor so ties still rotate.
+		for i := 1; i < len(candidates); i++ {
+			c := candidates[(start+i)%len(candidates)]
+			if c.session.inFlight.Load() < chosen.session.inFlight.Load() {
+				chosen = c
+			}
+		}
+	}
+	return chosen.binding, chosen.session, true
+}
+
+// affinityKey identifies session in the affinity cookie without revealing
+// its id. A resumed session keeps its id, so browsers stay pinned across a
+// reconnect.
+func (s *TunnelServer) affinityKey(session *AgentSession) string {
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte("affinity:" + session.ID))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// affinityFrom returns the affinity key the client was pinned to, if any.
+func (s *TunnelServer) affinityFrom(r *http.Request) string {
+	if s.affinityCookie == "" {
+		return ""
+	}
+	c, err := r.Cookie(s.affinityCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// setAffinity pins the client to session unless it already is.
+func (s *TunnelServer) setAffinity(w http.ResponseWriter, session *AgentSession, pinned string) {
+	if s.affinityCookie == "" {
+		return
+	}
+	key := s.affinityKey(session)
+	if key == pinned {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.affinityCookie,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
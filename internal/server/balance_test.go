@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func replyWith(name string) func(protocol.Envelope) protocol.Envelope {
+	return func(protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte(name))}
+	}
+}
+
+func countResponders(t *testing.T, ts *TunnelServer, host string, n int) map[string]int {
+	t.Helper()
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d body=%q", i, rec.Code, rec.Body.String())
+		}
+		seen[rec.Body.String()]++
+	}
+	return seen
+}
+
+func TestReplacePolicyHandsHostnameToNewestAgent(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	startFakeAgent(t, ts, "tok-a", routes, replyWith("a"))
+	startFakeAgent(t, ts, "tok-b", routes, replyWith("b"))
+
+	if seen := countResponders(t, ts, "app.test", 4); seen["b"] != 4 {
+		t.Fatalf("responders = %v, want only b", seen)
+	}
+}
+
+func TestBalancePolicyRoundRobinsAcrossAgents(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, SessionPolicy: SessionPolicyBalance})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	startFakeAgent(t, ts, "tok-a", routes, replyWith("a"))
+	startFakeAgent(t, ts, "tok-b", routes, replyWith("b"))
+	// A second session with the same token is balanced too.
+	startFakeAgent(t, ts, "tok-b", routes, replyWith("b2"))
+
+	seen := countResponders(t, ts, "app.test", 6)
+	if seen["a"] != 2 || seen["b"] != 2 || seen["b2"] != 2 {
+		t.Fatalf("responders = %v, want 2 each", seen)
+	}
+}
+
+func TestAffinityCookiePinsClientToSession(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, SessionPolicy: SessionPolicyBalance, AffinityCookie: "tunnel_affinity"})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	startFakeAgent(t, ts, "tok-a", routes, replyWith("a"))
+	startFakeAgent(t, ts, "tok-b", routes, replyWith("b"))
+
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/", nil))
+	first := rec.Body.String()
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "tunnel_affinity" || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		if rec.Body.String() != first || len(rec.Result().Cookies()) != 0 {
+			t.Fatalf("pinned request %d went to %q (cookies %v), want %q", i, rec.Body.String(), rec.Result().Cookies(), first)
+		}
+	}
+
+	// A cookie for a session that is gone is replaced.
+	req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	req.AddCookie(&http.Cookie{Name: "tunnel_affinity", Value: "stale"})
+	rec = httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, req)
+	if got := rec.Result().Cookies(); len(got) != 1 || got[0].Value == "stale" {
+		t.Fatalf("stale cookie not replaced: %v", got)
+	}
+}
+
+func TestDrainingSessionGetsNoNewRequests(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, SessionPolicy: SessionPolicyBalance})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	startFakeAgent(t, ts, "tok-a", routes, replyWith("a"))
+	startFakeAgent(t, ts, "tok-b", routes, replyWith("b"))
+	for _, session := range ts.allSessions() {
+		if session.Token == "tok-a" {
+			session.draining.Store(true)
+		}
+	}
+
+	if seen := countResponders(t, ts, "app.test", 4); seen["b"] != 4 {
+		t.Fatalf("responders = %v, want only b", seen)
+	}
+}
+
+func TestRouteAliasesShareTheRoute(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{{Hostname: "www.app.test", Target: "127.0.0.1:3000", Aliases: []string{"app.test"}}}
+	startFakeAgent(t, ts, "tok-a", routes, replyWith("a"))
+
+	if seen := countResponders(t, ts, "app.test", 2); seen["a"] != 2 {
+		t.Fatalf("alias responders = %v", seen)
+	}
+
+	moved := protocol.Route{Hostname: "www.app.test", Target: "127.0.0.1:3000", Aliases: []string{"old.app.test", "localhost"}}
+	if !ts.applyRouteDelta("tok-a", protocol.Envelope{BaseVersion: ts.routesVersion("tok-a"), Routes: []protocol.Route{moved}}) {
+		t.Fatal("alias change rejected")
+	}
+	if ts.HasRoute("app.test") || !ts.HasRoute("old.app.test") {
+		t.Fatal("alias change not applied to the routing table")
+	}
+	if ts.HasRoute("localhost") {
+		t.Fatal("reserved alias was bound")
+	}
+	if !ts.applyRouteDelta("tok-a", protocol.Envelope{BaseVersion: ts.routesVersion("tok-a"), RemovedHosts: []string{"www.app.test"}}) {
+		t.Fatal("route removal rejected")
+	}
+	if ts.HasRoute("old.app.test") || ts.HasRoute("www.app.test") {
+		t.Fatal("removing the route left its alias bound")
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// cacheableStatus lists the response codes the gateway may cache.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// responseCache keeps the GET responses of routes with a cache in memory,
+// evicting the least recently used once maxBytes is reached.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	headers map[string][]string
+	body    []byte
+	// vary holds the request headers the response varies on, as they were
+	// when it was stored.
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+	size    int64
+}
+
+func newResponseCache(maxBytes int64) *responseCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &responseCache{maxBytes: maxBytes, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func cacheKey(host, path, query string) string {
+	return host + " " + path + "?" + query
+}
+
+func (c *responseCache) get(key string, r *http.Request, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return nil, false
+		}
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	if e.size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *responseCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// cacheable reports whether r may be answered from, or fill, the cache of
+// route. Routes with auth are never cached: what the agent answers may
+// depend on who signed in. Neither are routes with a split or a mirror,
+// whose answer depends on the target picked for the request.
+func (s *TunnelServer) cacheable(r *http.Request, route protocol.Route) bool {
+	if s.cache == nil || route.Cache == nil || route.Auth != nil || route.Split != nil || route.Mirror != nil {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Range") == "" && !hasDirective(r.Header.Values("Cache-Control"), "no-store")
+}
+
+// serveCached answers req, bound for route, from the cache when it holds a
+// fresh response. The cache holds what the agent answered, so chain's
+// response hooks run on every hit as they do on a miss.
+func (s *TunnelServer) serveCached(w http.ResponseWriter, r *http.Request, req *Request, route protocol.Route, chain []Middleware) bool {
+	if !s.cacheable(r, route) {
+		return false
+	}
+	cc := r.Header.Values("Cache-Control")
+	if hasDirective(cc, "no-cache") || directiveSeconds(cc, "max-age") == 0 || r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	now := time.Now()
+	e, ok := s.cache.get(cacheKey(normalizeHost(req.Hostname), req.Path, req.Query), r, now)
+	if !ok {
+		s.cacheLookups.Inc("miss")
+		return false
+	}
+	s.cacheLookups.Inc("hit")
+	out := &Response{Status: e.status, Headers: http.Header(e.headers).Clone(), Body: e.body}
+	h := http.Header(out.Headers)
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	h.Set("X-Tunnel-Cache", "HIT")
+	runResponseHooks(chain, req, out)
+	if len(out.Body) != len(e.body) {
+		delete(out.Headers, "Content-Length")
+	}
+	h = http.Header(out.Headers)
+	if etag := h.Get("Etag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		out.Status, out.Body = http.StatusNotModified, nil
+	}
+	s.edgeCompress.compress(r, out)
+	if r.Method == http.MethodHead {
+		out.Body = nil
+	}
+	writeResponse(w, out)
+	return true
+}
+
+// cacheResponse stores resp, the agent's answer to a GET for req on route,
+// when its headers allow a shared cache to keep it. It is called before the
+// response hooks, which may still change resp; the entry keeps its own copy.
+func (s *TunnelServer) cacheResponse(r *http.Request, req *Request, route protocol.Route, resp *Response) {
+	if r.Method != http.MethodGet || !s.cacheable(r, route) || !cacheableStatus[resp.Status] || len(resp.Trailers) > 0 {
+		return
+	}
+	if int64(len(resp.Body)) > route.Cache.EntryLimit() {
+		return
+	}
+	h := http.Header(resp.Headers)
+	cc := h.Values("Cache-Control")
+	if h.Get("Set-Cookie") != "" || hasDirective(cc, "no-store") || hasDirective(cc, "private") || hasDirective(cc, "no-cache") {
+		return
+	}
+	// A shared cache only keeps answers to authorized requests it is told
+	// it may.
+	if r.Header.Get("Authorization") != "" && !hasDirective(cc, "public") && directiveSeconds(cc, "s-maxage") < 0 {
+		return
+	}
+	now := time.Now()
+	defaultTTL, maxTTL := route.Cache.TTLs()
+	ttl := freshness(h, now, defaultTTL)
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	vary := make(map[string]string)
+	for _, field := range h.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = r.Header.Get(name)
+			}
+		}
+	}
+	key := cacheKey(normalizeHost(req.Hostname), req.Path, req.Query)
+	e := &cacheEntry{key: key, status: resp.Status, headers: make(map[string][]string, len(resp.Headers)), body: bytes.Clone(resp.Body), vary: vary, stored: now, expires: now.Add(ttl)}
+	e.size = int64(len(key) + len(e.body))
+	for k, v := range resp.Headers {
+		e.headers[k] = append([]string(nil), v...)
+		for _, item := range v {
+			e.size += int64(len(k) + len(item))
+		}
+	}
+	s.cache.put(e)
+}
+
+// freshness is how long a response stays fresh by its own headers, or
+// fallback when it does not say.
+func freshness(h http.Header, now time.Time, fallback time.Duration) time.Duration {
+	cc := h.Values("Cache-Control")
+	if secs := directiveSeconds(cc, "s-maxage"); secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if secs := directiveSeconds(cc, "max-age"); secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if raw := h.Get("Expires"); raw != "" {
+		expires, err := http.ParseTime(raw)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return expires.Sub(date)
+	}
+	return fallback
+}
+
+// hasDirective reports whether the Cache-Control values carry name.
+func hasDirective(values []string, name string) bool {
+	for _, field := range values {
+		for _, d := range strings.Split(field, ",") {
+			d, _, _ = strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(d, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// directiveSeconds returns the value of a delta-seconds directive such as
+// max-age, -1 when it is missing or malformed.
+func directiveSeconds(values []string, name string) int {
+	for _, field := range values {
+		for _, d := range strings.Split(field, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+			if !ok || !strings.EqualFold(key, name) {
+				continue
+			}
+			secs, err := strconv.Atoi(strings.Trim(strings.TrimSpace(value), `"`))
+			if err != nil || secs < 0 {
+				return -1
+			}
+			return secs
+		}
+	}
+	return -1
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRouteCacheServesRepeatGets(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second, CacheMaxBytes: 1 << 20})
+	var calls atomic.Int64
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000", Cache: &protocol.Cache{}}}, func(env protocol.Envelope) protocol.Envelope {
+		calls.Add(1)
+		headers := map[string][]string{"Content-Type": {"text/plain"}}
+		switch env.Path {
+		case "/app.js":
+			headers["Cache-Control"] = []string{"public, max-age=60"}
+			headers["Etag"] = []string{`"v1"`}
+		case "/private":
+			headers["Cache-Control"] = []string{"private, max-age=60"}
+		}
+		return protocol.Envelope{Status: http.StatusOK, Headers: headers, Body: base64.StdEncoding.EncodeToString([]byte("body " + env.Path))}
+	})
+	do := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://app.test"+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		if rec.Code != http.StatusOK && rec.Code != http.StatusNotModified {
+			t.Fatalf("%s %s = %d %q", method, path, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	do(http.MethodGet, "/app.js", nil)
+	rec := do(http.MethodGet, "/app.js", nil)
+	if calls.Load() != 1 || rec.Body.String() != "body /app.js" || rec.Header().Get("X-Tunnel-Cache") != "HIT" || rec.Header().Get("Age") == "" {
+		t.Fatalf("second GET: calls=%d body=%q headers=%v", calls.Load(), rec.Body.String(), rec.Header())
+	}
+	if rec := do(http.MethodHead, "/app.js", nil); calls.Load() != 1 || rec.Body.Len() != 0 {
+		t.Fatalf("HEAD: calls=%d body=%q", calls.Load(), rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/app.js", http.Header{"If-None-Match": {`"v1"`}}); rec.Code != http.StatusNotModified || calls.Load() != 1 {
+		t.Fatalf("conditional GET = %d, calls=%d", rec.Code, calls.Load())
+	}
+	do(http.MethodGet, "/app.js", http.Header{"Cache-Control": {"no-cache"}})
+	if calls.Load() != 2 {
+		t.Fatalf("no-cache request was served from the cache, calls=%d", calls.Load())
+	}
+
+	// Private responses and those without a lifetime are not kept.
+	for _, path := range []string{"/private", "/plain"} {
+		do(http.MethodGet, path, nil)
+		do(http.MethodGet, path, nil)
+	}
+	if calls.Load() != 6 {
+		t.Fatalf("uncacheable responses were cached, calls=%d", calls.Load())
+	}
+}
+
+func TestRouteCacheRunsResponseHooksOnHits(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second, CacheMaxBytes: 1 << 20})
+	var calls, hooks atomic.Int64
+	ts.Use(MiddlewareFuncs{Response: func(req *Request, resp *Response) {
+		hooks.Add(1)
+		resp.Headers["X-Hook"] = []string{"on"}
+		resp.Body = append(resp.Body, " +hook"...)
+	}})
+	cached := protocol.Cache{}
+	startFakeAgent(t, ts, "tok", []protocol.Route{
+		{Hostname: "app.test", Target: "127.0.0.1:3000", Cache: &cached},
+		{Hostname: "split.test", Target: "127.0.0.1:3000", Cache: &cached, Split: &protocol.Split{Target: "127.0.0.1:3001", Weight: 50}},
+		{Hostname: "mirror.test", Target: "127.0.0.1:3000", Cache: &cached, Mirror: &protocol.Mirror{Target: "127.0.0.1:3002", Percent: 10}},
+	}, func(env protocol.Envelope) protocol.Envelope {
+		if env.Target == "127.0.0.1:3002" {
+			return protocol.Envelope{Status: http.StatusOK}
+		}
+		calls.Add(1)
+		headers := map[string][]string{"Content-Type": {"text/plain"}, "Cache-Control": {"public, max-age=60"}}
+		return protocol.Envelope{Status: http.StatusOK, Headers: headers, Body: base64.StdEncoding.EncodeToString([]byte(env.Target))}
+	})
+	get := func(host string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := get("app.test")
+		if rec.Body.String() != "127.0.0.1:3000 +hook" || rec.Header().Get("X-Hook") != "on" {
+			t.Fatalf("GET %d: body=%q headers=%v", i, rec.Body.String(), rec.Header())
+		}
+	}
+	if calls.Load() != 1 || hooks.Load() != 2 {
+		t.Fatalf("calls=%d hooks=%d, want 1 agent call and the hooks on both responses", calls.Load(), hooks.Load())
+	}
+
+	for _, host := range []string{"split.test", "mirror.test"} {
+		before := calls.Load()
+		get(host)
+		if rec := get(host); rec.Header().Get("X-Tunnel-Cache") != "" || calls.Load() != before+2 {
+			t.Fatalf("%s was served from the cache, calls=%d", host, calls.Load()-before)
+		}
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(100)
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		c.put(&cacheEntry{key: key, body: make([]byte, 40), expires: now.Add(time.Minute), size: 40})
+		if key == "b" {
+			c.get("a", httptest.NewRequest(http.MethodGet, "/", nil), now)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, ok := c.get("b", r, now); ok {
+		t.Fatal("least recently used entry was kept")
+	}
+	if _, ok := c.get("a", r, now); !ok {
+		t.Fatal("recently used entry was evicted")
+	}
+	if _, ok := c.get("c", r, now.Add(time.Hour)); ok || c.size != 40 {
+		t.Fatalf("expired entry was served, size=%d", c.size)
+	}
+}
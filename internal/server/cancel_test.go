@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestClientDisconnectSendsProxyCancel(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+protocol.CapCancel, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil || !protocol.HasCap(hello.Caps, protocol.CapCancel) {
+		t.Fatalf("session envelope = %+v, %v", hello, err)
+	}
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	for !ts.HasRoute("app.test") {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, public.URL+"/slow", nil)
+	req.Host = "app.test"
+	go func() { _, _ = http.DefaultClient.Do(req) }()
+
+	// The agent never answers; the client gives up once the request arrived.
+	var proxied protocol.Envelope
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&proxied); err != nil || proxied.Type != protocol.TypeProxyRequest {
+		t.Fatalf("proxy request = %+v, %v", proxied, err)
+	}
+	cancel()
+	var canceled protocol.Envelope
+	if err := conn.ReadJSON(&canceled); err != nil {
+		t.Fatalf("read proxy cancel: %v", err)
+	}
+	if canceled.Type != protocol.TypeProxyCancel || canceled.RequestID != proxied.RequestID {
+		t.Fatalf("got %+v, want proxy_cancel for %s", canceled, proxied.RequestID)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrustedProxies trusts a reverse proxy on the same machine, such as
+// nginx terminating TLS in front of the public gateway.
+const DefaultTrustedProxies = "127.0.0.0/8,::1/128"
+
+// ParseTrustedProxies parses a comma separated list of CIDRs and bare IP
+// addresses.
+func ParseTrustedProxies(v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", item, err)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", item, err)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func (s *TunnelServer) trusted(ip string) bool {
+	return inPrefixes(s.trustedProxies, ip)
+}
+
+func inPrefixes(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the visitor's address. Forwarding headers only count when the
+// connection comes from a trusted proxy: X-Forwarded-For is read from the
+// right, skipping further trusted hops. CF-Connecting-IP is believed only
+// when the hop that reached us, or the first untrusted one found in
+// X-Forwarded-For, is in the Cloudflare list; a proxy such as nginx passes
+// the header on unchanged, so anyone could set it otherwise.
+func (s *TunnelServer) clientIP(r *http.Request) string {
+	peer := extractClientIP(r.RemoteAddr)
+	ip := peer
+	if s.trusted(peer) {
+		hops := forwardedFor(r.Header)
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !validIP(hops[i]) {
+				ip = peer
+				break
+			}
+			ip = hops[i]
+			if !s.trusted(ip) {
+				break
+			}
+		}
+	}
+	if inPrefixes(s.cfProxies, ip) {
+		if cf := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); validIP(cf) {
+			return cf
+		}
+	}
+	return ip
+}
+
+// forwardedFor flattens every X-Forwarded-For value into its hops.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+func validIP(ip string) bool {
+	_, err := netip.ParseAddr(ip)
+	return err == nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestClientIPHonorsOnlyTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatalf("bad CIDR accepted")
+	}
+	cloudflare, _ := ParseTrustedProxies("173.245.48.0/20")
+	ts := New(Options{TrustedProxies: trusted, CloudflareProxies: cloudflare})
+	cases := []struct {
+		name, peer, xff, cf, want string
+	}{
+		{"untrusted peer", "203.0.113.5:1000", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"trusted peer", "10.1.2.3:1000", "198.51.100.1", "", "198.51.100.1"},
+		{"cloudflare header ignored from a trusted proxy", "192.0.2.1:1000", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"cloudflare peer", "173.245.48.7:1000", "", "198.51.100.2", "198.51.100.2"},
+		{"cloudflare behind a trusted proxy", "10.1.2.3:1000", "198.51.100.1, 173.245.48.7", "198.51.100.2", "198.51.100.2"},
+		{"bad cloudflare header", "173.245.48.7:1000", "", "junk", "173.245.48.7"},
+		{"skip trusted hops", "10.1.2.3:1000", "6.6.6.6, 198.51.100.1, 10.9.9.9", "", "198.51.100.1"},
+		{"all hops trusted", "10.1.2.3:1000", "10.3.3.3, 10.9.9.9", "", "10.3.3.3"},
+		{"garbage stops the walk", "10.1.2.3:1000", "198.51.100.1, junk", "", "10.1.2.3"},
+		{"no headers", "10.1.2.3:1000", "", "", "10.1.2.3"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.cf != "" {
+			r.Header.Set("CF-Connecting-IP", tc.cf)
+		}
+		if got := ts.clientIP(r); got != tc.want {
+			t.Fatalf("%s: client ip = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForgedCloudflareHeaderThroughLoopbackProxy(t *testing.T) {
+	trusted, _ := ParseTrustedProxies(DefaultTrustedProxies)
+	filter := &protocol.IPFilter{Deny: []string{"203.0.113.0/24"}}
+	ts := New(Options{RequestTimeout: 2 * time.Second, TrustedProxies: trusted})
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000", IPFilter: filter}}, func(env protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("ok"))}
+	})
+
+	// nginx on the same host appends the visitor to X-Forwarded-For and
+	// passes the visitor's own CF-Connecting-IP through untouched.
+	r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("CF-Connecting-IP", "198.51.100.1")
+	if got := ts.clientIP(r); got != "203.0.113.9" {
+		t.Fatalf("client ip = %q, want the X-Forwarded-For hop", got)
+	}
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("denied visitor with a forged CF-Connecting-IP: status %d, want 403", rec.Code)
+	}
+}
+
+func TestForwardedHeadersFromUntrustedPeerAreReplaced(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	ts := New(Options{RequestTimeout: 2 * time.Second, TrustedProxies: trusted})
+	seen := make(chan map[string][]string, 2)
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env.Headers
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("ok"))}
+	})
+
+	for _, tc := range []struct {
+		peer      string
+		wantXFF   []string
+		wantProto string
+		wantCF    bool
+	}{
+		{"203.0.113.5:1000", []string{"203.0.113.5"}, "http", false},
+		{"10.0.0.2:1000", []string{"198.51.100.1", "10.0.0.2"}, "https", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		r.RemoteAddr = tc.peer
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("CF-Connecting-IP", "198.51.100.1")
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("peer %s: status %d", tc.peer, rec.Code)
+		}
+		headers := <-seen
+		if got := headers["X-Forwarded-For"]; !slices.Equal(got, tc.wantXFF) {
+			t.Fatalf("peer %s: X-Forwarded-For = %v, want %v", tc.peer, got, tc.wantXFF)
+		}
+		if got := headers["X-Forwarded-Proto"]; len(got) != 1 || got[0] != tc.wantProto {
+			t.Fatalf("peer %s: X-Forwarded-Proto = %v", tc.peer, got)
+		}
+		if _, ok := headers["Cf-Connecting-Ip"]; ok != tc.wantCF {
+			t.Fatalf("peer %s: CF-Connecting-IP passed = %v", tc.peer, ok)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultClusterSyncInterval = 2 * time.Second
+
+// Headers a node adds when it forwards a public request to a peer. The peer
+// trusts them only together with the cluster secret.
+const (
+	clusterSecretHeader     = "X-Tunnel-Cluster-Secret"
+	clusterClientAddrHeader = "X-Tunnel-Cluster-Client-Addr"
+	clusterClientTLSHeader  = "X-Tunnel-Cluster-Client-Tls"
+	clusterProxyPrefix      = "/_cluster/proxy"
+)
+
+// ClusterOptions lets several servers behind one load balancer act as one
+// gateway. Every node tells its peers which hostnames it has live agents for,
+// and forwards public requests for hostnames served elsewhere to the node
+// that holds the agent connection.
+type ClusterOptions struct {
+	// NodeID names this node; it must be unique within the cluster.
+	NodeID string
+	// URL is where peers reach this node's cluster endpoints, i.e. the
+	// control listener, e.g. http://10.0.0.1:9000.
+	URL string
+	// Peers are the URLs of the other nodes. Listing this node too is fine.
+	Peers []string
+	// Secret authenticates traffic between nodes; all nodes share it.
+	Secret string
+	// SyncInterval is how often a node announces its hostnames. A node that
+	// has not been heard from for three intervals is forgotten.
+	SyncInterval time.Duration
+}
+
+// ClusterNode is a peer as seen by this node, for the admin API.
+type ClusterNode struct {
+	NodeID string    `json:"node_id"`
+	URL    string    `json:"url"`
+	Hosts  int       `json:"hosts"`
+	SeenAt time.Time `json:"seen_at"`
+	Live   bool      `json:"live"`
+}
+
+type clusterAnnounce struct {
+	NodeID string   `json:"node_id"`
+	URL    string   `json:"url"`
+	Hosts  []string `json:"hosts"`
+}
+
+type peerNode struct {
+	url    string
+	hosts  map[string]bool
+	seenAt time.Time
+}
+
+type cluster struct {
+	opts    ClusterOptions
+	client  *http.Client
+	proxy   *httputil.ReverseProxy
+	changed chan struct{}
+
+	mu    sync.RWMutex
+	nodes map[string]*peerNode
+}
+
+type clusterHopKey struct{}
+type clusterTargetKey struct{}
+
+func newCluster(opts ClusterOptions) *cluster {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultClusterSyncInterval
+	}
+	opts.URL = strings.TrimRight(opts.URL, "/")
+	c := &cluster{
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.SyncInterval},
+		changed: make(chan struct{}, 1),
+		nodes:   make(map[string]*peerNode),
+	}
+	c.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			target := pr.In.Context().Value(clusterTargetKey{}).(*url.URL)
+			pr.SetURL(target)
+			pr.Out.URL.Path = clusterProxyPrefix + pr.In.URL.Path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = pr.In.Host
+			// Rewrite drops X-Forwarded-*; keep the client's chain intact so
+			// the peer appends to it exactly as we would have.
+			if xff, ok := pr.In.Header["X-Forwarded-For"]; ok {
+				pr.Out.Header["X-Forwarded-For"] = xff
+			}
+			pr.Out.Header.Set(clusterSecretHeader, opts.Secret)
+			pr.Out.Header.Set(clusterClientAddrHeader, pr.In.RemoteAddr)
+			pr.Out.Header.Del(clusterClientTLSHeader)
+			if pr.In.TLS != nil {
+				pr.Out.Header.Set(clusterClientTLSHeader, "1")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("cluster forward failed", "hostname", r.Host, "err", err)
+			http.Error(w, "cluster peer unavailable", http.StatusBadGateway)
+		},
+	}
+	return c
+}
+
+func (c *cluster) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cluster) authorized(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(c.opts.Secret)) == 1
+}
+
+func (c *cluster) record(msg clusterAnnounce) {
+	if msg.NodeID == "" || msg.NodeID == c.opts.NodeID {
+		return
+	}
+	hosts := make(map[string]bool, len(msg.Hosts))
+	for _, h := range msg.Hosts {
+		if h = normalizeHost(h); h != "" {
+			hosts[h] = true
+		}
+	}
+	c.mu.Lock()
+	c.nodes[msg.NodeID] = &peerNode{url: strings.TrimRight(msg.URL, "/"), hosts: hosts, seenAt: time.Now()}
+	c.mu.Unlock()
+}
+
+func (c *cluster) live(n *peerNode, now time.Time) bool {
+	return now.Sub(n.seenAt) < 3*c.opts.SyncInterval
+}
+
+// owner returns the URL of the live peer serving host, preferring the one
+// heard from most recently when an agent has just moved between nodes.
+func (c *cluster) owner(host string) string {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var best *peerNode
+	for _, n := range c.nodes {
+		if n.hosts[host] && c.live(n, now) && (best == nil || n.seenAt.After(best.seenAt)) {
+			best = n
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.url
+}
+
+func (c *cluster) snapshot() []ClusterNode {
+	now := time.Now()
+	c.mu.RLock()
+	out := make([]ClusterNode, 0, len(c.nodes))
+	for id, n := range c.nodes {
+		out = append(out, ClusterNode{NodeID: id, URL: n.url, Hosts: len(n.hosts), SeenAt: n.seenAt, Live: c.live(n, now)})
+	}
+	c.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	return out
+}
+
+// RunCluster announces this node's hostnames to its peers whenever they
+// change and every sync interval, until ctx is done. It returns at once when
+// clustering is off.
+func (s *TunnelServer) RunCluster(ctx context.Context) {
+	c := s.cluster
+	if c == nil {
+		return
+	}
+	ticker := time.NewTicker(c.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		s.announce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.changed:
+		}
+	}
+}
+
+func (s *TunnelServer) announce(ctx context.Context) {
+	c := s.cluster
+	body, err := json.Marshal(s.clusterAnnounce())
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range c.opts.Peers {
+		peer = strings.TrimRight(peer, "/")
+		if peer == "" || peer == c.opts.URL {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.push(ctx, peer, body); err != nil && ctx.Err() == nil {
+				slog.Warn("cluster announce failed", "peer", peer, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// push sends our hostnames to peer and records the peer's, which come back
+// in the response, so one reachable direction is enough to learn both.
+func (c *cluster) push(ctx context.Context, peer string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/_cluster/announce", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSecretHeader, c.opts.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	var msg clusterAnnounce
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&msg); err != nil {
+		return err
+	}
+	c.record(msg)
+	return nil
+}
+
+// clusterAnnounce lists the hostnames this node can serve right now, i.e.
+// those with a connected agent; routes held for the resume window are left
+// out so a peer the agent reconnected to wins.
+func (s *TunnelServer) clusterAnnounce() clusterAnnounce {
+	s.routesMu.RLock()
+	tokens := make(map[string][]string)
+	for host, hr := range s.routes {
+		for _, binding := range hr.bindings {
+			tokens[binding.Token] = append(tokens[binding.Token], host)
+		}
+	}
+	s.routesMu.RUnlock()
+
+	msg := clusterAnnounce{NodeID: s.cluster.opts.NodeID, URL: s.cluster.opts.URL, Hosts: []string{}}
+	s.agentsMu.RLock()
+	for token, hosts := range tokens {
+		if len(s.agents[token]) > 0 {
+			msg.Hosts = append(msg.Hosts, hosts...)
+		}
+	}
+	s.agentsMu.RUnlock()
+	sort.Strings(msg.Hosts)
+	return msg
+}
+
+func (s *TunnelServer) routesChanged() {
+	s.hold.wake()
+	if s.cluster != nil {
+		s.cluster.notify()
+	}
+}
+
+// ClusterNodes lists the peers this node has heard from; nil when clustering
+// is off.
+func (s *TunnelServer) ClusterNodes() []ClusterNode {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.snapshot()
+}
+
+// ClusterHandler serves the endpoints peers call, to be mounted at
+// /_cluster/ on the control listener:
+//
+//	POST /_cluster/announce     a peer's hostnames; answered with ours
+//	*    /_cluster/proxy/...    a public request forwarded by a peer
+func (s *TunnelServer) ClusterHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.cluster
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !c.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/_cluster/announce":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var msg clusterAnnounce
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&msg); err != nil {
+				http.Error(w, "invalid announce", http.StatusBadRequest)
+				return
+			}
+			c.record(msg)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(s.clusterAnnounce())
+		case strings.HasPrefix(r.URL.Path, clusterProxyPrefix+"/"):
+			s.serveForwarded(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// serveForwarded handles a public request relayed by a peer as if it had
+// arrived here directly. It is never forwarded again, so two nodes that
+// disagree about a hostname cannot bounce a request between them.
+func (s *TunnelServer) serveForwarded(w http.ResponseWriter, r *http.Request) {
+	r = r.Clone(context.WithValue(r.Context(), clusterHopKey{}, true))
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, clusterProxyPrefix)
+	r.URL.RawPath = ""
+	if addr := r.Header.Get(clusterClientAddrHeader); addr != "" {
+		r.RemoteAddr = addr
+	}
+	if r.Header.Get(clusterClientTLSHeader) != "" && r.TLS == nil {
+		r.TLS = &tls.ConnectionState{}
+	}
+	for _, h := range []string{clusterSecretHeader, clusterClientAddrHeader, clusterClientTLSHeader} {
+		r.Header.Del(h)
+	}
+	s.HandlePublicHTTP(w, r)
+}
+
+// forwardToPeer hands a request for a hostname without a local agent to the
+// peer that has one. It returns false when no peer claims host.
+func (s *TunnelServer) forwardToPeer(w http.ResponseWriter, r *http.Request, host string) bool {
+	c := s.cluster
+	if c == nil || r.Context().Value(clusterHopKey{}) != nil {
+		return false
+	}
+	peer := c.owner(host)
+	if peer == "" {
+		return false
+	}
+	target, err := url.Parse(peer)
+	if err != nil {
+		return false
+	}
+	s.clusterForwarded.Inc()
+	c.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clusterTargetKey{}, target)))
+	return true
+}
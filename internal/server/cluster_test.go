@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestClusterForwardsToNodeHoldingAgent(t *testing.T) {
+	nodes := make([]*TunnelServer, 2)
+	peers := make([]*httptest.Server, 2)
+	for i := range peers {
+		i := i
+		peers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].ClusterHandler().ServeHTTP(w, r)
+		}))
+		defer peers[i].Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, id := range []string{"a", "b"} {
+		nodes[i] = New(Options{RequestTimeout: 5 * time.Second, Cluster: &ClusterOptions{
+			NodeID:       id,
+			URL:          peers[i].URL,
+			Peers:        []string{peers[0].URL, peers[1].URL},
+			Secret:       "s3cret",
+			SyncInterval: 50 * time.Millisecond,
+		}})
+		go nodes[i].RunCluster(ctx)
+	}
+
+	var seenXFF []string
+	startFakeAgent(t, nodes[0], "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(env protocol.Envelope) protocol.Envelope {
+		seenXFF = env.Headers["X-Forwarded-For"]
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("from a " + env.Path))}
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for !nodes[1].HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("node b never learned app.test from node a")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.test/x?y=1", nil)
+	req.RemoteAddr = "203.0.113.9:5555"
+	rec := httptest.NewRecorder()
+	nodes[1].HandlePublicHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "from a /x" {
+		t.Fatalf("forwarded response = %d %q", rec.Code, rec.Body.String())
+	}
+	if len(seenXFF) == 0 || seenXFF[len(seenXFF)-1] != "203.0.113.9" {
+		t.Fatalf("agent saw X-Forwarded-For %v, want the public client last", seenXFF)
+	}
+	if got := nodes[1].clusterForwarded.Value(); got != 1 {
+		t.Fatalf("forwarded counter = %v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	nodes[1].HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://other.test/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown host status = %d, want 404", rec.Code)
+	}
+
+	forged, _ := http.NewRequest(http.MethodPost, peers[0].URL+"/_cluster/announce", strings.NewReader(`{"node_id":"x","hosts":["app.test"]}`))
+	resp, err := http.DefaultClient.Do(forged)
+	if err != nil {
+		t.Fatalf("announce without secret: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("announce without secret status = %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestCompressedBodiesInsideTunnel(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second, CompressMinBytes: protocol.DefaultCompressMinBytes})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+protocol.CapCompress, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil || !protocol.HasCap(hello.Caps, protocol.CapCompress) {
+		t.Fatalf("session envelope = %+v, %v", hello, err)
+	}
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("route not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	text := bytes.Repeat([]byte(`{"message":"hello tunnel"}`), 100)
+	seen := make(chan protocol.Envelope, 1)
+	go func() {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		env, err := protocol.DecodeJSON(data)
+		if err != nil {
+			return
+		}
+		seen <- env
+		resp := protocol.Envelope{Type: protocol.TypeProxyResponse, RequestID: env.RequestID, Status: http.StatusOK,
+			Headers: map[string][]string{"Content-Type": {"application/json"}}, Payload: text}
+		protocol.CompressPayload(&resp, protocol.DefaultCompressMinBytes)
+		frame, _ := protocol.EncodeJSON(resp)
+		_ = conn.WriteMessage(websocket.TextMessage, frame)
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.test/", bytes.NewReader(text))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, req)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), text) {
+		t.Fatalf("response = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	env := <-seen
+	if env.Encoding != protocol.EncodingGzip || len(env.Payload) >= len(text) {
+		t.Fatalf("request body sent with encoding %q, %d bytes", env.Encoding, len(env.Payload))
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultEdgeCompressTypes are the content types compressed for public
+// clients unless -edge-compress-types says otherwise.
+const DefaultEdgeCompressTypes = "text/html,text/css,text/plain,text/javascript,application/javascript,application/json,application/xml,image/svg+xml"
+
+// edgeCompressor compresses responses to public clients with brotli or
+// gzip, whichever they prefer.
+type edgeCompressor struct {
+	minBytes int
+	// types are media types, or prefixes such as "text/" given as text/*.
+	types []string
+}
+
+func newEdgeCompressor(minBytes int, types []string) *edgeCompressor {
+	if minBytes <= 0 {
+		return nil
+	}
+	c := &edgeCompressor{minBytes: minBytes}
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			c.types = append(c.types, strings.TrimSuffix(t, "*"))
+		}
+	}
+	return c
+}
+
+// encoding picks the coding, "br" or "gzip", for a response with headers
+// and status, of size bytes (negative when unknown), to r; "" leaves it
+// alone.
+func (c *edgeCompressor) encoding(r *http.Request, status int, headers http.Header, size int) string {
+	if c == nil || r.Method == http.MethodHead {
+		return ""
+	}
+	if status < 200 || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return ""
+	}
+	if size >= 0 && size < c.minBytes {
+		return ""
+	}
+	if headers.Get("Content-Encoding") != "" || headers.Get("Content-Range") != "" || hasDirective(headers.Values("Cache-Control"), "no-transform") {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	for _, t := range c.types {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return edgeEncoding(r.Header.Values("Accept-Encoding"))
+		}
+	}
+	return ""
+}
+
+// compress encodes resp's body in place when it is worth it for r.
+func (c *edgeCompressor) compress(r *http.Request, resp *Response) {
+	headers := http.Header(resp.Headers)
+	if len(resp.Trailers) > 0 {
+		return
+	}
+	enc := c.encoding(r, resp.Status, headers, len(resp.Body))
+	if enc == "" {
+		return
+	}
+	var buf bytes.Buffer
+	zw := newEncoder(&buf, enc)
+	if _, err := zw.Write(resp.Body); err != nil || zw.Close() != nil || buf.Len() >= len(resp.Body) {
+		return
+	}
+	resp.Headers = markEncoded(headers, enc)
+	resp.Headers["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	resp.Body = buf.Bytes()
+}
+
+// wrap returns w encoding a streamed response, and a func to finish the
+// stream with; w itself when the response is left alone.
+func (c *edgeCompressor) wrap(w http.ResponseWriter, r *http.Request, resp *Response) (http.ResponseWriter, func()) {
+	headers := http.Header(resp.Headers)
+	size := -1
+	if n, err := strconv.Atoi(headers.Get("Content-Length")); err == nil {
+		size = n
+	}
+	if isEventStream(resp.Headers) {
+		return w, func() {}
+	}
+	enc := c.encoding(r, resp.Status, headers, size)
+	if enc == "" {
+		return w, func() {}
+	}
+	resp.Headers = markEncoded(headers, enc)
+	cw := &compressResponseWriter{ResponseWriter: w, zw: newEncoder(w, enc)}
+	return cw, func() { _ = cw.zw.Close() }
+}
+
+// encoder is what gzip.Writer and brotli.Writer have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(w io.Writer, enc string) encoder {
+	if enc == "br" {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+	zw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	return zw
+}
+
+// markEncoded returns a copy of headers for the body encoded with enc.
+func markEncoded(headers http.Header, enc string) map[string][]string {
+	out := headers.Clone()
+	out.Del("Content-Length")
+	out.Set("Content-Encoding", enc)
+	out.Add("Vary", "Accept-Encoding")
+	// The bytes differ now, so a strong validator would be a lie.
+	if etag := out.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		out.Set("Etag", "W/"+etag)
+	}
+	return out
+}
+
+// edgeEncoding picks from Accept-Encoding values the coding the client
+// rates highest among br and gzip, "" when it accepts neither. An explicit
+// entry decides over "*", q=0 refuses, and br wins a tie for its smaller
+// output.
+func edgeEncoding(values []string) string {
+	brQ, gzipQ, anyQ := -1.0, -1.0, -1.0
+	for _, field := range values {
+		for _, part := range strings.Split(field, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(k), "q") {
+					if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+						q = f
+					}
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "br":
+				brQ = max(brQ, q)
+			case "gzip", "x-gzip":
+				gzipQ = max(gzipQ, q)
+			case "*":
+				anyQ = max(anyQ, q)
+			}
+		}
+	}
+	if brQ < 0 {
+		brQ = anyQ
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	switch {
+	case brQ > 0 && brQ >= gzipQ:
+		return "br"
+	case gzipQ > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressResponseWriter encodes a streamed body, flushing the encoder
+// along with the connection so chunks still reach the client as they come.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	zw encoder
+}
+
+func (c *compressResponseWriter) Write(p []byte) (int, error) {
+	return c.zw.Write(p)
+}
+
+func (c *compressResponseWriter) FlushError() error {
+	if err := c.zw.Flush(); err != nil {
+		return err
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"tunneling/internal/protocol"
+)
+
+func TestEdgeCompressGzipsForClientsThatAcceptIt(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second, EdgeCompressMinBytes: 100, EdgeCompressTypes: strings.Split(DefaultEdgeCompressTypes, ",")})
+	page := strings.Repeat("<p>hello</p>", 50)
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(env protocol.Envelope) protocol.Envelope {
+		headers := map[string][]string{"Content-Type": {"text/html; charset=utf-8"}, "Etag": {`"v1"`}}
+		body := page
+		switch env.Path {
+		case "/small":
+			body = "<p>hi</p>"
+		case "/logo.png":
+			headers["Content-Type"] = []string{"image/png"}
+		case "/encoded":
+			headers["Content-Encoding"] = []string{"br"}
+		}
+		return protocol.Envelope{Status: http.StatusOK, Headers: headers, Body: base64.StdEncoding.EncodeToString([]byte(body))}
+	})
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://app.test"+path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %q", path, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	rec := get("/", "br;q=0.5, gzip;q=0.8")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("Etag") != `W/"v1"` {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != page {
+		t.Fatalf("decompressed body = %q", got)
+	}
+	rec = get("/", "gzip, deflate, br")
+	if rec.Header().Get("Content-Encoding") != "br" || rec.Header().Get("Etag") != `W/"v1"` {
+		t.Fatalf("brotli headers = %v", rec.Header())
+	}
+	if got, _ := io.ReadAll(brotli.NewReader(rec.Body)); string(got) != page {
+		t.Fatalf("brotli body = %q", got)
+	}
+
+	for _, tc := range []struct{ path, accept string }{
+		{"/", ""},
+		{"/", "gzip;q=0, br;q=0"},
+		{"/small", "gzip"},
+		{"/logo.png", "gzip"},
+		{"/encoded", "gzip"},
+	} {
+		if rec := get(tc.path, tc.accept); rec.Header().Get("Content-Encoding") != "" && tc.path != "/encoded" {
+			t.Fatalf("%s with Accept-Encoding %q was compressed", tc.path, tc.accept)
+		}
+	}
+}
+
+func TestEdgeEncoding(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"gzip"}, "gzip"},
+		{[]string{"GZIP;Q=0.5"}, "gzip"},
+		{[]string{"x-gzip"}, "gzip"},
+		{[]string{"br"}, "br"},
+		{[]string{"gzip, deflate, br"}, "br"},
+		{[]string{"br;q=1.0, gzip;q=0.1"}, "br"},
+		{[]string{"br;q=0.5, gzip"}, "gzip"},
+		{[]string{"br;q=0.2", "gzip; q=0.3"}, "gzip"},
+		{[]string{"br;q=0, gzip;q=0.1"}, "gzip"},
+		{[]string{"gzip;q=0"}, ""},
+		{[]string{"gzip; q=0.000, br"}, "br"},
+		{[]string{"*"}, "br"},
+		{[]string{"*;q=0"}, ""},
+		{[]string{"br;q=0, *"}, "gzip"},
+		{[]string{"gzip;q=0, br;q=0, *"}, ""},
+		{[]string{"*;q=0.5, gzip"}, "gzip"},
+		{[]string{"*;q=0, gzip;q=0.2"}, "gzip"},
+		{[]string{"identity"}, ""},
+	}
+	for _, tt := range tests {
+		if got := edgeEncoding(tt.accept); got != tt.want {
+			t.Errorf("edgeEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEdgeCompressStreams(t *testing.T) {
+	c := newEdgeCompressor(1, []string{"text/*"})
+	req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &Response{Status: http.StatusOK, Headers: map[string][]string{"Content-Type": {"text/plain"}}, Streamed: true}
+	rec := httptest.NewRecorder()
+	w, finish := c.wrap(rec, req, resp)
+	if w == http.ResponseWriter(rec) || resp.Headers["Content-Encoding"][0] != "gzip" {
+		t.Fatalf("streamed text was not gzipped: %v", resp.Headers)
+	}
+	_, _ = w.Write([]byte("first chunk"))
+	if err := http.NewResponseController(w).Flush(); err != nil || !rec.Flushed || rec.Body.Len() == 0 {
+		t.Fatalf("flush: err=%v flushed=%v len=%d", err, rec.Flushed, rec.Body.Len())
+	}
+	_, _ = w.Write([]byte(", second"))
+	finish()
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != "first chunk, second" {
+		t.Fatalf("decompressed stream = %q", got)
+	}
+
+	req.Header.Set("Accept-Encoding", "br")
+	rec = httptest.NewRecorder()
+	resp = &Response{Status: http.StatusOK, Headers: map[string][]string{"Content-Type": {"text/plain"}}, Streamed: true}
+	w, finish = c.wrap(rec, req, resp)
+	if resp.Headers["Content-Encoding"][0] != "br" {
+		t.Fatalf("streamed text was not brotli encoded: %v", resp.Headers)
+	}
+	_, _ = w.Write([]byte("first chunk"))
+	if err := http.NewResponseController(w).Flush(); err != nil || rec.Body.Len() == 0 {
+		t.Fatalf("brotli flush: err=%v len=%d", err, rec.Body.Len())
+	}
+	_, _ = w.Write([]byte(", second"))
+	finish()
+	if got, _ := io.ReadAll(brotli.NewReader(rec.Body)); string(got) != "first chunk, second" {
+		t.Fatalf("decompressed brotli stream = %q", got)
+	}
+
+	events := &Response{Status: http.StatusOK, Headers: map[string][]string{"Content-Type": {"text/event-stream"}}, Streamed: true}
+	if w, _ := c.wrap(rec, req, events); w != http.ResponseWriter(rec) {
+		t.Fatal("event stream was gzipped")
+	}
+}
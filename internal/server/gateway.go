@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// gatewayTable holds the hostnames the server answers itself, as set by
+// the control plane.
+type gatewayTable struct {
+	mu     sync.RWMutex
+	routes map[string]protocol.GatewayRoute
+	// idle holds the hostnames of idle tunnels.
+	idle map[string]bool
+	// disabled holds the disabled routes whose ACME challenges still go
+	// through.
+	disabled map[string]protocol.GatewayRoute
+}
+
+func (t *gatewayTable) get(host string) (protocol.GatewayRoute, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	route, ok := t.routes[host]
+	return route, ok
+}
+
+func (t *gatewayTable) isIdle(host string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.idle[host]
+}
+
+func (t *gatewayTable) getDisabled(host string) (protocol.GatewayRoute, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	route, ok := t.disabled[host]
+	return route, ok
+}
+
+// SetGatewayRoutes replaces the redirects, fixed responses and maintenance
+// pages the server serves without an agent. They take precedence over
+// agent routes for the same hostname. Idle entries only apply while no
+// agent serves the hostname, disabled ones only to ACME challenges.
+// Invalid entries are dropped with a warning.
+func (s *TunnelServer) SetGatewayRoutes(routes []protocol.GatewayRoute) {
+	table := make(map[string]protocol.GatewayRoute, len(routes))
+	idle := make(map[string]bool)
+	disabled := make(map[string]protocol.GatewayRoute)
+	for _, route := range routes {
+		host := normalizeHost(route.Hostname)
+		if route.Idle && host != "" {
+			idle[host] = true
+			continue
+		}
+		if route.Disabled {
+			_, err := protocol.ParseTarget(route.Target)
+			if err == nil && strings.TrimSpace(route.TunnelID) == "" {
+				err = errors.New("needs the tunnel id")
+			}
+			if host == "" || err != nil {
+				slog.Warn("gateway route dropped", "hostname", route.Hostname, "err", err)
+				continue
+			}
+			route.Hostname = host
+			disabled[host] = route
+			continue
+		}
+		redirect, err := protocol.NormalizeRedirect(route.Redirect)
+		if err == nil {
+			route.Static, err = protocol.NormalizeStaticResponse(route.Static)
+		}
+		if err == nil {
+			route.Maintenance, err = protocol.NormalizeMaintenance(route.Maintenance)
+		}
+		set := 0
+		for _, ok := range []bool{redirect != nil, route.Static != nil, route.Maintenance != nil} {
+			if ok {
+				set++
+			}
+		}
+		if err == nil && set != 1 {
+			err = errors.New("needs exactly one of redirect, static_response and maintenance")
+		}
+		if host == "" || err != nil {
+			slog.Warn("gateway route dropped", "hostname", route.Hostname, "err", err)
+			continue
+		}
+		route.Hostname, route.Redirect = host, redirect
+		table[host] = route
+	}
+	s.gateway.mu.Lock()
+	s.gateway.routes = table
+	s.gateway.idle = idle
+	s.gateway.disabled = disabled
+	s.gateway.mu.Unlock()
+}
+
+// serveGatewayRoute answers r when host is a gateway route.
+func (s *TunnelServer) serveGatewayRoute(w http.ResponseWriter, r *http.Request, host string) bool {
+	route, ok := s.gateway.get(host)
+	if !ok {
+		return false
+	}
+	// The agent keeps a route under maintenance, so its challenges can
+	// still be answered there.
+	if route.ACMEPassthrough && route.Maintenance != nil && isACMEChallenge(r) {
+		return false
+	}
+	if route.Redirect != nil {
+		http.Redirect(w, r, route.Redirect.Location(r.URL.Path, r.URL.RawQuery), route.Redirect.Status)
+		return true
+	}
+	if m := route.Maintenance; m != nil {
+		s.rejectedRequests.Inc("maintenance")
+		if m.Body == "" {
+			s.writeUnavailable(w, r, host, "under maintenance", m.RetryAfter)
+			return true
+		}
+		if m.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+		}
+		writeFixed(w, r, http.StatusServiceUnavailable, m.ContentType, m.Body)
+		return true
+	}
+	writeFixed(w, r, route.Static.Status, route.Static.ContentType, route.Static.Body)
+	return true
+}
+
+// disabledChallenge finds where r goes when it is an ACME challenge for a
+// disabled route: the route's target, on any agent of its tunnel. It
+// reports false while none is connected.
+func (s *TunnelServer) disabledChallenge(r *http.Request, host string) (routeBinding, *AgentSession, bool) {
+	route, ok := s.gateway.getDisabled(host)
+	if !ok || !isACMEChallenge(r) {
+		return routeBinding{}, nil, false
+	}
+	binding := routeBinding{
+		Target: route.Target,
+		Route:  protocol.Route{Hostname: host, Target: route.Target, ACMEPassthrough: true},
+	}
+	s.agentsMu.RLock()
+	defer s.agentsMu.RUnlock()
+	for token, sessions := range s.agents {
+		for _, session := range sessions {
+			if session.TunnelID == route.TunnelID && !session.draining.Load() {
+				binding.Token = token
+				return binding, session, true
+			}
+		}
+	}
+	return routeBinding{}, nil, false
+}
+
+func writeFixed(w http.ResponseWriter, r *http.Request, status int, contentType, body string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+// gatewayRoutesResponse is what the control plane answers on
+// /api/gateway/routes.
+type gatewayRoutesResponse struct {
+	Routes  []protocol.GatewayRoute `json:"routes"`
+	Version string                  `json:"version"`
+}
+
+// SyncGatewayRoutes fetches the gateway routes from endpoint every interval
+// until ctx is done. When the control plane cannot be reached the last set
+// stays in place.
+func (s *TunnelServer) SyncGatewayRoutes(ctx context.Context, endpoint, apiKey string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	version := ""
+	refresh := func() {
+		resp, err := fetchGatewayRoutes(ctx, client, endpoint, apiKey)
+		if err != nil {
+			slog.Warn("fetch gateway routes failed, keeping the current ones", "err", err)
+			return
+		}
+		if resp.Version != "" && resp.Version == version {
+			return
+		}
+		s.SetGatewayRoutes(resp.Routes)
+		version = resp.Version
+		slog.Info("gateway routes updated", "routes", len(resp.Routes))
+	}
+	refresh()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+func fetchGatewayRoutes(ctx context.Context, client *http.Client, endpoint, apiKey string) (gatewayRoutesResponse, error) {
+	var out gatewayRoutesResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return out, err
+	}
+	if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return out, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("control answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&out); err != nil {
+		return out, fmt.Errorf("decode gateway routes: %w", err)
+	}
+	return out, nil
+}
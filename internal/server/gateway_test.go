@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestGatewayRoutesAnswerWithoutAgent(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	ts.SetGatewayRoutes([]protocol.GatewayRoute{
+		{Hostname: "old.test", Redirect: &protocol.Redirect{URL: "https://new.test", Status: 301, KeepPath: true}},
+		{Hostname: "down.test", Static: &protocol.StaticResponse{Status: 503, Body: "<h1>maintenance</h1>"}},
+		{Hostname: "bad.test", Redirect: &protocol.Redirect{URL: "/nowhere"}},
+	})
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	if rec := do(http.MethodGet, "http://old.test/a?b=1"); rec.Code != 301 || rec.Header().Get("Location") != "https://new.test/a?b=1" {
+		t.Fatalf("redirect = %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec := do(http.MethodGet, "http://down.test/")
+	if rec.Code != 503 || rec.Body.String() != "<h1>maintenance</h1>" || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("static = %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if rec := do(http.MethodHead, "http://down.test/"); rec.Code != 503 || rec.Body.Len() != 0 {
+		t.Fatalf("static HEAD = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "http://bad.test/"); rec.Code != http.StatusNotFound {
+		t.Fatalf("invalid gateway route = %d", rec.Code)
+	}
+	if !ts.HasRoute("old.test") || ts.HasRoute("bad.test") {
+		t.Fatal("HasRoute does not follow gateway routes")
+	}
+}
+
+func TestMaintenanceKeepsAgentRouteBound(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, replyWith("app"))
+	ts.SetGatewayRoutes([]protocol.GatewayRoute{
+		{Hostname: "app.test", Maintenance: &protocol.Maintenance{RetryAfter: 120}},
+		{Hostname: "custom.test", Maintenance: &protocol.Maintenance{Body: "back at 10:00", ContentType: "text/plain"}},
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, req)
+	if rec.Code != 503 || rec.Header().Get("Retry-After") != "120" || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("maintenance = %d %v", rec.Code, rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://custom.test/", nil))
+	if rec.Code != 503 || rec.Body.String() != "back at 10:00" || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("custom maintenance page = %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	ts.SetGatewayRoutes(nil)
+	if seen := countResponders(t, ts, "app.test", 1); seen["app"] != 1 {
+		t.Fatalf("after maintenance responders = %v", seen)
+	}
+}
+
+func TestMaintenanceLetsACMEChallengesThrough(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	startFakeAgent(t, ts, "tok", []protocol.Route{
+		{Hostname: "tls.test", Target: "127.0.0.1:3000", ACMEPassthrough: true},
+		{Hostname: "plain.test", Target: "127.0.0.1:3001"},
+	}, replyWith("app"))
+	ts.SetGatewayRoutes([]protocol.GatewayRoute{
+		{Hostname: "tls.test", Maintenance: &protocol.Maintenance{}, ACMEPassthrough: true},
+		{Hostname: "plain.test", Maintenance: &protocol.Maintenance{}},
+	})
+	for target, want := range map[string]int{
+		"http://tls.test/.well-known/acme-challenge/abc": http.StatusOK,
+		"http://tls.test/": http.StatusServiceUnavailable,
+		"http://plain.test/.well-known/acme-challenge/abc": http.StatusServiceUnavailable,
+	} {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Fatalf("%s = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestIdleTunnelShowsWakingPage(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	ts.SetGatewayRoutes([]protocol.GatewayRoute{{Hostname: "app.test", Idle: true}})
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/", nil))
+		if rec.Code != 503 || rec.Header().Get("Retry-After") != "15" {
+			t.Fatalf("idle tunnel = %d %v", rec.Code, rec.Header())
+		}
+	}
+	if got := len(ts.wakes.pending); got != 1 {
+		t.Fatalf("queued wakes = %d, want 1", got)
+	}
+	if !ts.HasRoute("app.test") {
+		t.Fatal("HasRoute ignores idle hostnames")
+	}
+
+	// Once the agent is back it serves the hostname again.
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, replyWith("app"))
+	if seen := countResponders(t, ts, "app.test", 1); seen["app"] != 1 {
+		t.Fatalf("woken tunnel responders = %v", seen)
+	}
+}
+
+func TestSignalWakes(t *testing.T) {
+	woken := make(chan string, 1)
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Hostname string `json:"hostname"`
+		}
+		if r.Header.Get("Authorization") != "Bearer key" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		woken <- req.Hostname
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer control.Close()
+
+	ts := New(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.SignalWakes(ctx, control.URL, "key")
+	ts.wakes.request("app.test", time.Now())
+	select {
+	case host := <-woken:
+		if host != "app.test" {
+			t.Fatalf("woken hostname = %q", host)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wake was not signalled")
+	}
+}
+
+func TestSyncGatewayRoutes(t *testing.T) {
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(gatewayRoutesResponse{Version: "v1", Routes: []protocol.GatewayRoute{
+			{Hostname: "old.test", Redirect: &protocol.Redirect{URL: "https://new.test"}},
+		}})
+	}))
+	defer control.Close()
+
+	ts := New(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.SyncGatewayRoutes(ctx, control.URL, "key", time.Hour)
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("old.test") {
+		if time.Now().After(deadline) {
+			t.Fatal("gateway routes were not fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import "sort"
+
+// setUnhealthy replaces the hostnames the agent reports as failing their
+// health check.
+func (s *AgentSession) setUnhealthy(hosts []string) {
+	unhealthy := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if host = normalizeHost(host); host != "" {
+			unhealthy[host] = true
+		}
+	}
+	s.healthMu.Lock()
+	s.unhealthy = unhealthy
+	s.healthMu.Unlock()
+}
+
+func (s *AgentSession) unhealthyHost(host string) bool {
+	s.healthMu.RLock()
+	defer s.healthMu.RUnlock()
+	return s.unhealthy[host]
+}
+
+// UnhealthyHosts returns the reported hostnames, sorted.
+func (s *AgentSession) UnhealthyHosts() []string {
+	s.healthMu.RLock()
+	out := make([]string, 0, len(s.unhealthy))
+	for host := range s.unhealthy {
+		out = append(out, host)
+	}
+	s.healthMu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// healthyCandidates drops the sessions whose local service for the route is
+// down. Agents report routes by their own hostname, not aliases. When every
+// session reports it down they are all kept, and the request is answered
+// with the unhealthy page.
+func healthyCandidates(candidates []candidate) []candidate {
+	var healthy []candidate
+	for _, c := range candidates {
+		if !c.session.unhealthyHost(c.binding.Route.Hostname) {
+			healthy = append(healthy, c)
+		}
+	}
+	if len(healthy) == 0 {
+		return candidates
+	}
+	return healthy
+}
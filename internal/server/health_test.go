@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestUnhealthyRouteGets503Page(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+protocol.CapHealth, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil || !protocol.HasCap(hello.Caps, protocol.CapHealth) {
+		t.Fatalf("session envelope = %+v, %v", hello, err)
+	}
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRouteHealth, UnhealthyHosts: []string{"App.Test"}}); err != nil {
+		t.Fatalf("report health: %v", err)
+	}
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("condition not reached")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(func() bool {
+		agents := ts.Agents()
+		return ts.HasRoute("app.test") && len(agents) == 1 && len(agents[0].Unhealthy) == 1
+	})
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	req, _ := http.NewRequest(http.MethodGet, public.URL+"/", nil)
+	req.Host = "app.test"
+	req.Header.Set("Accept", "text/html")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !strings.Contains(string(body), "app.test") {
+		t.Fatalf("status=%d retry-after=%q body=%s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+
+	// An empty report clears the state and requests reach the agent again.
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRouteHealth}); err != nil {
+		t.Fatalf("report health: %v", err)
+	}
+	waitFor(func() bool { return len(ts.Agents()[0].Unhealthy) == 0 })
+	go func() {
+		var env protocol.Envelope
+		if err := conn.ReadJSON(&env); err != nil || env.Type != protocol.TypeProxyRequest {
+			return
+		}
+		_ = conn.WriteJSON(protocol.Envelope{Type: protocol.TypeProxyResponse, RequestID: env.RequestID, Status: http.StatusOK})
+	}()
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after recovery = %d", resp.StatusCode)
+	}
+}
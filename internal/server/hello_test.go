@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestHelloNegotiatesVersionAndCaps(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+	wsURL := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect?token=tok"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var session protocol.Envelope
+	if err := conn.ReadJSON(&session); err != nil || session.Type != protocol.TypeSession || len(session.Caps) != 0 {
+		t.Fatalf("session envelope = %+v, %v", session, err)
+	}
+	hello := protocol.Envelope{Type: protocol.TypeHello, ProtocolVersion: protocol.ProtocolVersion + 5, Version: "v9", Caps: []string{"tcp", protocol.CapStream}}
+	if err := conn.WriteJSON(hello); err != nil {
+		t.Fatalf("send hello: %v", err)
+	}
+	var reply protocol.Envelope
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("read hello reply: %v", err)
+	}
+	if reply.Type != protocol.TypeHello || reply.ProtocolVersion != protocol.ProtocolVersion || strings.Join(reply.Caps, ",") != protocol.CapStream {
+		t.Fatalf("hello reply = %+v", reply)
+	}
+	agents := ts.Agents()
+	if len(agents) != 1 || agents[0].AgentVersion != "v9" || !agents[0].Streaming {
+		t.Fatalf("agents = %+v", agents)
+	}
+
+	old, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer old.Close()
+	_ = old.ReadJSON(&session)
+	if err := old.WriteJSON(protocol.Envelope{Type: protocol.TypeHello, ProtocolVersion: protocol.MinProtocolVersion - 1}); err != nil {
+		t.Fatalf("send hello: %v", err)
+	}
+	_ = old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = old.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("read after outdated hello = %v, want protocol error close", err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// holdQueue parks public requests for a hostname whose agent is briefly
+// gone (the resume window, or a restart's startup window) until the agent
+// registers again. At most depth requests wait per hostname, each for at
+// most wait.
+type holdQueue struct {
+	depth int
+	wait  time.Duration
+
+	mu      sync.Mutex
+	parked  map[string]int
+	changed chan struct{}
+}
+
+func newHoldQueue(depth int, wait time.Duration) *holdQueue {
+	if depth <= 0 || wait <= 0 {
+		return nil
+	}
+	return &holdQueue{depth: depth, wait: wait, parked: make(map[string]int), changed: make(chan struct{})}
+}
+
+// wake lets every parked request look at the routing table again.
+func (q *holdQueue) wake() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// hold waits until ready reports true, the wait runs out or ctx is done. It
+// returns false straight away when the hostname's queue is full; full is
+// true in that case.
+func (q *holdQueue) hold(ctx context.Context, host string, ready func() bool) (ok, full bool) {
+	if q == nil {
+		return false, false
+	}
+	q.mu.Lock()
+	if q.parked[host] >= q.depth {
+		q.mu.Unlock()
+		return false, true
+	}
+	q.parked[host]++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		if q.parked[host]--; q.parked[host] <= 0 {
+			delete(q.parked, host)
+		}
+		q.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(q.wait)
+	defer timer.Stop()
+	for {
+		// Take the channel before looking so a change in between still
+		// wakes us.
+		q.mu.Lock()
+		changed := q.changed
+		q.mu.Unlock()
+		if ready() {
+			return true, false
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false, false
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+}
+
+// held reports how many requests are parked across all hostnames.
+func (q *holdQueue) held() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, c := range q.parked {
+		n += c
+	}
+	return n
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestHoldQueueDispatchesAfterReconnect(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second, HoldQueueDepth: 1, HoldQueueWait: 5 * time.Second})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	// Routes without a session are what the resume window leaves behind.
+	ts.applyRoutes("tok", routes, "")
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/", nil))
+		done <- rec
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.hold.held() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request not parked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request over the queue depth = %d, want 503", rec.Code)
+	}
+
+	startFakeAgent(t, ts, "tok", routes, func(protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("back"))}
+	})
+	select {
+	case rec := <-done:
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != http.StatusOK || string(body) != "back" {
+			t.Fatalf("held request = %d %q", rec.Code, body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("held request not dispatched")
+	}
+}
+
+func TestHoldQueueGivesUpAfterWait(t *testing.T) {
+	q := newHoldQueue(2, 30*time.Millisecond)
+	start := time.Now()
+	if ok, full := q.hold(context.Background(), "app.test", func() bool { return false }); ok || full {
+		t.Fatalf("hold() = %v, %v", ok, full)
+	}
+	if time.Since(start) < 30*time.Millisecond || q.held() != 0 {
+		t.Fatalf("hold returned early or left %d parked", q.held())
+	}
+	if ok, _ := newHoldQueue(0, time.Second).hold(context.Background(), "app.test", func() bool { return true }); ok {
+		t.Fatalf("disabled queue held a request")
+	}
+}
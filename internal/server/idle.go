@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wakeEvery limits how often the server asks the control plane to wake the
+// tunnel behind one hostname.
+const wakeEvery = time.Minute
+
+// waker queues wake requests for idle hostnames until SignalWakes sends
+// them to the control plane.
+type waker struct {
+	mu      sync.Mutex
+	last    map[string]time.Time
+	pending chan string
+}
+
+func newWaker() *waker {
+	return &waker{last: make(map[string]time.Time), pending: make(chan string, 64)}
+}
+
+// request queues host unless it was queued within wakeEvery or the queue
+// is full.
+func (w *waker) request(host string, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if last, ok := w.last[host]; ok && now.Sub(last) < wakeEvery {
+		return
+	}
+	if len(w.last) >= 1024 {
+		for h, last := range w.last {
+			if now.Sub(last) >= wakeEvery {
+				delete(w.last, h)
+			}
+		}
+	}
+	select {
+	case w.pending <- host:
+		w.last[host] = now
+	default:
+	}
+}
+
+// serveWaking answers a request for an idle tunnel whose agent is offline
+// with a "waking up" page and asks the control plane to wake it.
+func (s *TunnelServer) serveWaking(w http.ResponseWriter, r *http.Request, host string) bool {
+	if !s.gateway.isIdle(host) {
+		return false
+	}
+	s.wakes.request(host, time.Now())
+	s.rejectedRequests.Inc("idle")
+	s.writeUnavailable(w, r, host, "waking up", 15)
+	return true
+}
+
+// SignalWakes posts the hostnames of idle tunnels visitors asked for to
+// endpoint, the control plane's /api/gateway/wake, until ctx is done.
+func (s *TunnelServer) SignalWakes(ctx context.Context, endpoint, apiKey string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case host := <-s.wakes.pending:
+			if err := postControl(ctx, client, endpoint, apiKey, map[string]string{"hostname": host}); err != nil {
+				slog.Warn("wake request failed", "hostname", host, "err", err)
+			}
+		}
+	}
+}
+
+// postControl posts payload as JSON to a control plane endpoint.
+func postControl(ctx context.Context, client *http.Client, endpoint, apiKey string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("control answered %s", resp.Status)
+	}
+	return nil
+}
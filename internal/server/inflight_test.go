@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestInFlightLimits(t *testing.T) {
+	for _, tc := range []struct {
+		opts Options
+		want int
+	}{
+		{Options{RequestTimeout: 5 * time.Second, MaxInFlightPerSession: 1}, http.StatusTooManyRequests},
+		{Options{RequestTimeout: 5 * time.Second, MaxInFlight: 1}, http.StatusServiceUnavailable},
+	} {
+		ts := New(tc.opts)
+		release := make(chan struct{})
+		routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+		startFakeAgent(t, ts, "tok", routes, func(protocol.Envelope) protocol.Envelope {
+			<-release
+			return protocol.Envelope{Status: http.StatusOK}
+		})
+
+		first := make(chan int)
+		go func() {
+			rec := httptest.NewRecorder()
+			ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/slow", nil))
+			first <- rec.Code
+		}()
+		session := ts.allSessions()[0]
+		deadline := time.Now().Add(2 * time.Second)
+		for session.inFlight.Load() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("first request never reached the tunnel")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/", nil))
+		if rec.Code != tc.want || rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("over-limit status = %d retry-after=%q, want %d", rec.Code, rec.Header().Get("Retry-After"), tc.want)
+		}
+		close(release)
+		if code := <-first; code != http.StatusOK {
+			t.Fatalf("first request status = %d", code)
+		}
+		if ts.inFlight.Load() != 0 {
+			t.Fatalf("in-flight count leaked: %d", ts.inFlight.Load())
+		}
+	}
+}
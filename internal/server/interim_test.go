@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+// dialInterimAgent connects a raw agent offering streaming and interim
+// responses and serves app.test with handle.
+func dialInterimAgent(t *testing.T, ts *TunnelServer, handle func(conn *websocket.Conn, req protocol.Envelope)) {
+	t.Helper()
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	t.Cleanup(gateway.Close)
+	caps := protocol.CapStream + "," + protocol.CapInterim
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+caps, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatalf("read session envelope: %v", err)
+	}
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("route not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	go func() {
+		var env protocol.Envelope
+		for env.Type != protocol.TypeProxyRequest {
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+		}
+		handle(conn, env)
+	}()
+}
+
+func sendEnvelope(conn *websocket.Conn, requestID string, env protocol.Envelope) {
+	env.RequestID = requestID
+	frame, _ := protocol.EncodeJSON(env)
+	_ = conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+func TestInterimResponsesReachClient(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	dialInterimAgent(t, ts, func(conn *websocket.Conn, req protocol.Envelope) {
+		sendEnvelope(conn, req.RequestID, protocol.Envelope{Type: protocol.TypeProxyInterim, Status: http.StatusEarlyHints,
+			Headers: map[string][]string{"Link": {"</app.css>; rel=preload"}}})
+		sendEnvelope(conn, req.RequestID, protocol.Envelope{Type: protocol.TypeProxyInterim, Status: http.StatusContinue})
+		var body []byte
+		for {
+			var env protocol.Envelope
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if env, err = protocol.DecodeJSON(frame); err != nil || env.Type != protocol.TypeProxyRequestData {
+				continue
+			}
+			body = append(body, env.Payload...)
+			if env.End {
+				break
+			}
+		}
+		sendEnvelope(conn, req.RequestID, protocol.Envelope{Type: protocol.TypeProxyResponse, Status: http.StatusOK, Payload: body})
+	})
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	var hints []string
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		if code == http.StatusEarlyHints {
+			hints = append(hints, header.Get("Link"))
+		}
+		return nil
+	}}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, public.URL+"/upload", strings.NewReader("payload"))
+	req.Host = "app.test"
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "payload" {
+		t.Fatalf("response = %d %q", resp.StatusCode, got)
+	}
+	if len(hints) != 1 || hints[0] != "</app.css>; rel=preload" {
+		t.Fatalf("early hints = %q", hints)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Fatalf("early hint header leaked into final response: %v", resp.Header)
+	}
+}
+
+func TestExpectContinueRejectedWithoutBody(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	gotData := make(chan bool, 1)
+	dialInterimAgent(t, ts, func(conn *websocket.Conn, req protocol.Envelope) {
+		sendEnvelope(conn, req.RequestID, protocol.Envelope{Type: protocol.TypeProxyResponse, Status: http.StatusRequestEntityTooLarge})
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				gotData <- false
+				return
+			}
+			if env, err := protocol.DecodeJSON(frame); err == nil && env.Type == protocol.TypeProxyRequestData {
+				gotData <- true
+				return
+			}
+		}
+	})
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	req, _ := http.NewRequest(http.MethodPut, public.URL+"/big", strings.NewReader(strings.Repeat("x", 1<<20)))
+	req.Host = "app.test"
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	if <-gotData {
+		t.Fatalf("request body was forwarded although the agent refused it")
+	}
+}
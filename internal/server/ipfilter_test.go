@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRouteIPFilterRefusesOutsiders(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("127.0.0.1")
+	ts := New(Options{RequestTimeout: 2 * time.Second, TrustedProxies: trusted})
+	filter := &protocol.IPFilter{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.6.6.6/32"}}
+	routes := []protocol.Route{{Hostname: "admin.test", Target: "127.0.0.1:3000", IPFilter: filter}}
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(remote, xff string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://admin.test/", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec.Code
+	}
+	if code := do("10.1.2.3:1000", ""); code != http.StatusOK {
+		t.Fatalf("allowed client = %d", code)
+	}
+	if code := do("10.6.6.6:1000", ""); code != http.StatusForbidden {
+		t.Fatalf("denied client = %d", code)
+	}
+	if code := do("203.0.113.5:1000", "10.1.2.3"); code != http.StatusForbidden {
+		t.Fatalf("spoofed X-Forwarded-For from an untrusted peer = %d", code)
+	}
+	if code := do("127.0.0.1:1000", "10.1.2.3"); code != http.StatusOK {
+		t.Fatalf("client behind a trusted proxy = %d", code)
+	}
+	if got := ts.rejectedRequests.Value("ip denied"); got != 2 {
+		t.Fatalf("ip denied counter = %v", got)
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	jwksRefresh      = 10 * time.Minute
+	jwksRetry        = 30 * time.Second
+	jwksFetchTimeout = 5 * time.Second
+	jwtLeeway        = 30 * time.Second
+)
+
+type jwksEntry struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	err     error
+	// refreshing is closed when the fetch in progress ends, nil when there
+	// is none.
+	refreshing chan struct{}
+}
+
+// jwksCache keeps the signing keys of every JWKS URL routes point at. Keys
+// are fetched again after jwksRefresh, or sooner when a token names a key
+// id the cache has not seen, so provider key rotation is picked up. Fetches
+// run outside the lock, one at a time per URL, so a slow provider only
+// holds up tokens that need its keys.
+type jwksCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*jwksEntry
+}
+
+func (c *jwksCache) key(ctx context.Context, jwksURL, kid string) (crypto.PublicKey, error) {
+	for {
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = make(map[string]*jwksEntry)
+		}
+		e := c.entries[jwksURL]
+		if e == nil {
+			e = &jwksEntry{}
+			c.entries[jwksURL] = e
+		}
+		age := time.Since(e.fetched)
+		stale := e.fetched.IsZero() || age > jwksRefresh || e.keys[kid] == nil && age > jwksRetry
+		if !stale {
+			key, err := e.lookup(jwksURL, kid)
+			c.mu.Unlock()
+			return key, err
+		}
+		if e.refreshing == nil {
+			e.refreshing = make(chan struct{})
+			go c.refresh(jwksURL, e)
+		}
+		done, key := e.refreshing, e.keys[kid]
+		c.mu.Unlock()
+		if key != nil {
+			// Known keys keep working while they are fetched again.
+			return key, nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// refresh fetches the keys of jwksURL for everyone waiting on e. On
+// failure the keys already held stay in use.
+func (c *jwksCache) refresh(jwksURL string, e *jwksEntry) {
+	keys, err := c.fetch(context.Background(), jwksURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		e.keys = keys
+	}
+	e.fetched, e.err = time.Now(), err
+	close(e.refreshing)
+	e.refreshing = nil
+}
+
+func (e *jwksEntry) lookup(jwksURL, kid string) (crypto.PublicKey, error) {
+	if key := e.keys[kid]; key != nil {
+		return key, nil
+	}
+	if e.err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", jwksURL, e.err)
+	}
+	return nil, fmt.Errorf("no key %q in jwks", kid)
+}
+
+func (c *jwksCache) fetch(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, error) {
+	// Routes come from agents as well as the control plane; only https
+	// keeps a route from pointing the server at plain internal endpoints.
+	if !strings.HasPrefix(jwksURL, "https://") {
+		return nil, errors.New("jwks_url must be https")
+	}
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys we cannot use are skipped rather than failing the set.
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64(k.N)
+		e, err2 := b64(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("bad ec key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec point not on curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := b64(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad okp key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (c jwtClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, a := range many {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWT checks token against policy: an asymmetric signature by a key
+// from the policy's JWKS, an unexpired exp, and matching aud and iss.
+func (c *jwksCache) verifyJWT(ctx context.Context, policy *protocol.JWTPolicy, token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(raw, &header) != nil {
+		return claims, errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed token signature")
+	}
+	key, err := c.key(ctx, policy.JWKSURL, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return claims, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errors.New("malformed token payload")
+	}
+	if claims.ExpiresAt == 0 || now.Add(-jwtLeeway).Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Unix() < claims.NotBefore {
+		return claims, errors.New("token not yet valid")
+	}
+	if !claims.hasAudience(policy.Audience) {
+		return claims, errors.New("token audience mismatch")
+	}
+	if policy.Issuer != "" && claims.Issuer != policy.Issuer {
+		return claims, errors.New("token issuer mismatch")
+	}
+	return claims, nil
+}
+
+// verifySignature checks sig over signed with key, refusing an algorithm
+// that does not fit the key so a token cannot pick a weaker one.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "512":
+		h, ch = sha512.New(), crypto.SHA512
+	}
+	bad := errors.New("bad token signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if h == nil || (!strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS")) {
+			break
+		}
+		h.Write(signed)
+		if strings.HasPrefix(alg, "PS") {
+			if rsa.VerifyPSS(k, ch, h.Sum(nil), sig, nil) != nil {
+				return bad
+			}
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(k, ch, h.Sum(nil), sig) != nil {
+			return bad
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if h == nil || !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			break
+		}
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return bad
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return bad
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm %q", alg)
+}
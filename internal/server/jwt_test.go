@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestRouteAuthJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "r1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	}))
+	defer jwks.Close()
+
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	ts.jwks.client = jwks.Client()
+	policy := &protocol.JWTPolicy{JWKSURL: jwks.URL, Audience: "api", Issuer: "https://idp.test/"}
+	routes := []protocol.Route{{Hostname: "api.test", Target: "127.0.0.1:3000", Auth: &protocol.RouteAuth{JWT: policy}}}
+	seen := make(chan protocol.Envelope, 4)
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://api.test/v1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{"sub": "svc-1", "aud": []string{"other", "api"}, "iss": "https://idp.test/", "exp": time.Now().Add(time.Hour).Unix()}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	if rec := do(""); rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Fatalf("no token = %d %v", rec.Code, rec.Header())
+	}
+	if rec := do(signTestJWT(t, "RS256", "r1", rsaKey, claims(nil))); rec.Code != http.StatusOK {
+		t.Fatalf("RS256 token = %d", rec.Code)
+	}
+	env := <-seen
+	if got := env.Headers[oidcUserHeader]; len(got) != 1 || got[0] != "svc-1" {
+		t.Fatalf("agent saw user %v", got)
+	}
+	if len(env.Headers["Authorization"]) != 1 {
+		t.Fatalf("bearer token not forwarded: %v", env.Headers)
+	}
+	if rec := do(signTestJWT(t, "ES256", "e1", ecKey, claims(nil))); rec.Code != http.StatusOK {
+		t.Fatalf("ES256 token = %d", rec.Code)
+	}
+	<-seen
+
+	for name, token := range map[string]string{
+		"expired":      signTestJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"no exp":       signTestJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })),
+		"audience":     signTestJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["aud"] = "web" })),
+		"issuer":       signTestJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://evil.test/" })),
+		"wrong key":    signTestJWT(t, "RS256", "e1", rsaKey, claims(nil)),
+		"alg mismatch": signTestJWT(t, "ES256", "r1", ecKey, claims(nil)),
+		"unknown kid":  signTestJWT(t, "RS256", "r9", rsaKey, claims(nil)),
+		"garbage":      "a.b.c",
+	} {
+		rec := do(token)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "invalid_token") {
+			t.Fatalf("%s token = %d %v", name, rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestJWKSFetchDoesNotBlockOtherProviders(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	release := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))},
+		}})
+	}))
+	defer fast.Close()
+
+	// httptest TLS servers all use the same certificate.
+	cache := &jwksCache{client: fast.Client()}
+	go func() { _, _ = cache.key(context.Background(), slow.URL, "e1") }()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.key(context.Background(), fast.URL, "e1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("fast provider: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a slow JWKS fetch held up another provider")
+	}
+
+	if _, err := cache.key(context.Background(), "http://127.0.0.1:1/jwks", "e1"); err == nil || !strings.Contains(err.Error(), "https") {
+		t.Fatalf("plain http jwks_url = %v, want refused", err)
+	}
+}
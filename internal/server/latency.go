@@ -0,0 +1,79 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LatencyInfo summarises the requests one hostname handed to its agent,
+// for the admin API. Percentiles are estimated from the
+// tunnel_request_duration_seconds buckets.
+type LatencyInfo struct {
+	Hostname string  `json:"hostname"`
+	Requests uint64  `json:"requests"`
+	P50MS    float64 `json:"p50_ms"`
+	P95MS    float64 `json:"p95_ms"`
+	P99MS    float64 `json:"p99_ms"`
+}
+
+// Latency lists the request latency of every hostname served so far,
+// sorted by hostname.
+func (s *TunnelServer) Latency() []LatencyInfo {
+	var out []LatencyInfo
+	for _, labels := range s.requestDuration.LabelValues() {
+		host := labels[0]
+		out = append(out, LatencyInfo{
+			Hostname: host,
+			Requests: s.requestDuration.Count(host),
+			P50MS:    quantileMS(s.requestDuration.Quantile(0.5, host)),
+			P95MS:    quantileMS(s.requestDuration.Quantile(0.95, host)),
+			P99MS:    quantileMS(s.requestDuration.Quantile(0.99, host)),
+		})
+	}
+	return out
+}
+
+func msDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Millisecond)
+}
+
+func quantileMS(seconds float64) float64 {
+	return float64(time.Duration(seconds*float64(time.Second)).Microseconds()) / 1000
+}
+
+// observeLatency records a request that reached an agent and logs it when
+// it took longer than the slow request threshold, broken down into the
+// time before it was sent to the agent, the round trip to the response
+// head and the time writing the response to the client.
+func (s *TunnelServer) observeLatency(r *http.Request, rec *accessRecorder, entry *accessEntry) {
+	now := time.Now()
+	total := now.Sub(entry.start)
+	host := normalizeHost(r.Host)
+	s.requestDuration.Observe(total.Seconds(), host)
+	if t := entry.timing; t != nil {
+		s.localDuration.Observe(t.TotalMS/1000, host)
+		s.localResponses.Inc(t.Status)
+	}
+	if s.slowRequest <= 0 || total < s.slowRequest {
+		return
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	attrs := []any{"request_id", entry.RequestID, "hostname", host, "method", r.Method, "path", r.URL.Path, "status", status, "duration", total.Round(time.Millisecond)}
+	if !entry.sent.IsZero() {
+		attrs = append(attrs, "queue_wait", entry.sent.Sub(entry.start).Round(time.Millisecond))
+		if !entry.answered.IsZero() {
+			attrs = append(attrs, "tunnel", entry.answered.Sub(entry.sent).Round(time.Millisecond), "response", now.Sub(entry.answered).Round(time.Millisecond))
+		}
+	}
+	// With the agent's timing the tunnel round trip splits into the local
+	// service's part and the rest.
+	if t := entry.timing; t != nil {
+		attrs = append(attrs, "agent_total", msDuration(t.TotalMS), "local_dial", msDuration(t.DialMS), "local_ttfb", msDuration(t.TTFBMS), "local_status", t.Status)
+	}
+	s.slowRequests.Inc()
+	slog.Warn("slow request", attrs...)
+}
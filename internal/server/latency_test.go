@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestLatencyPerHostnameAndSlowRequests(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second, SlowRequest: 20 * time.Millisecond})
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(env protocol.Envelope) protocol.Envelope {
+		if env.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+			return protocol.Envelope{Status: http.StatusOK, Timing: &protocol.Timing{TTFBMS: 29, TotalMS: 30, Status: "2xx"}}
+		}
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+	for _, path := range []string{"/", "/", "/slow"} {
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test"+path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, rec.Code)
+		}
+	}
+	if got := ts.slowRequests.Value(); got != 1 {
+		t.Fatalf("slow requests = %v, want 1", got)
+	}
+	if got := ts.localResponses.Value("2xx"); got != 1 || ts.localDuration.Count("app.test") != 1 {
+		t.Fatalf("agent timing not recorded: 2xx=%v observations=%d", got, ts.localDuration.Count("app.test"))
+	}
+
+	rec := httptest.NewRecorder()
+	ts.AdminHandler("").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/latency", nil))
+	var body struct {
+		Hosts []LatencyInfo `json:"hosts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/latency = %d, %v", rec.Code, err)
+	}
+	if len(body.Hosts) != 1 || body.Hosts[0].Hostname != "app.test" || body.Hosts[0].Requests != 3 {
+		t.Fatalf("latency = %+v", body.Hosts)
+	}
+	if h := body.Hosts[0]; h.P50MS <= 0 || h.P99MS < 25 || h.P99MS < h.P50MS {
+		t.Fatalf("percentiles = %+v", h)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits are the sanity checks applied to public requests before they are
+// tunneled. Zero fields fall back to DefaultLimits.
+type Limits struct {
+	// MaxHeaderBytes caps the summed size of header names and values.
+	MaxHeaderBytes      int
+	MaxHeaderCount      int
+	MaxHeaderValueBytes int
+	AllowedMethods      []string
+}
+
+var DefaultLimits = Limits{
+	MaxHeaderBytes:      64 << 10,
+	MaxHeaderCount:      100,
+	MaxHeaderValueBytes: 16 << 10,
+	AllowedMethods: []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodOptions,
+	},
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxHeaderValueBytes <= 0 {
+		l.MaxHeaderValueBytes = DefaultLimits.MaxHeaderValueBytes
+	}
+	if len(l.AllowedMethods) == 0 {
+		l.AllowedMethods = DefaultLimits.AllowedMethods
+	}
+	return l
+}
+
+type limitViolation struct {
+	status int
+	reason string
+}
+
+// check rejects requests that an upstream could parse differently from us
+// (framing ambiguities) or that are unreasonably large.
+func (l Limits) check(r *http.Request) *limitViolation {
+	if !l.methodAllowed(r.Method) {
+		return &limitViolation{http.StatusMethodNotAllowed, "method not allowed"}
+	}
+
+	if len(r.TransferEncoding) > 0 {
+		if _, ok := r.Header["Content-Length"]; ok {
+			return &limitViolation{http.StatusBadRequest, "both content-length and transfer-encoding"}
+		}
+		if len(r.TransferEncoding) != 1 || !strings.EqualFold(r.TransferEncoding[0], "chunked") {
+			return &limitViolation{http.StatusNotImplemented, "unsupported transfer-encoding"}
+		}
+	}
+	if values := r.Header.Values("Content-Length"); len(values) > 0 {
+		if len(values) > 1 {
+			return &limitViolation{http.StatusBadRequest, "multiple content-length headers"}
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64); err != nil || n < 0 {
+			return &limitViolation{http.StatusBadRequest, "invalid content-length"}
+		}
+	}
+
+	count, total := 0, 0
+	for name, values := range r.Header {
+		if !validHeaderName(name) {
+			return &limitViolation{http.StatusBadRequest, "invalid header name"}
+		}
+		for _, v := range values {
+			count++
+			total += len(name) + len(v)
+			if len(v) > l.MaxHeaderValueBytes {
+				return &limitViolation{http.StatusRequestHeaderFieldsTooLarge, "header value too large"}
+			}
+			if !validHeaderValue(v) {
+				return &limitViolation{http.StatusBadRequest, "invalid header value"}
+			}
+		}
+	}
+	if count > l.MaxHeaderCount {
+		return &limitViolation{http.StatusRequestHeaderFieldsTooLarge, "too many headers"}
+	}
+	if total > l.MaxHeaderBytes {
+		return &limitViolation{http.StatusRequestHeaderFieldsTooLarge, "headers too large"}
+	}
+	return nil
+}
+
+func (l Limits) methodAllowed(method string) bool {
+	for _, m := range l.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
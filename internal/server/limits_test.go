@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitsRejectAmbiguousAndOversizedRequests(t *testing.T) {
+	limits := Limits{MaxHeaderCount: 5, MaxHeaderValueBytes: 32}.withDefaults()
+	expect := func(name string, r *http.Request, status int) {
+		t.Helper()
+		v := limits.check(r)
+		if status == 0 {
+			if v != nil {
+				t.Fatalf("%s: unexpected rejection %+v", name, v)
+			}
+			return
+		}
+		if v == nil || v.status != status {
+			t.Fatalf("%s: got %+v, want status %d", name, v, status)
+		}
+	}
+	newReq := func(method string) *http.Request {
+		return httptest.NewRequest(method, "http://app.test/", nil)
+	}
+
+	expect("get", newReq(http.MethodGet), 0)
+	expect("trace", newReq(http.MethodTrace), http.StatusMethodNotAllowed)
+
+	r := newReq(http.MethodPost)
+	r.TransferEncoding = []string{"chunked"}
+	r.Header.Set("Content-Length", "5")
+	expect("cl+te", r, http.StatusBadRequest)
+
+	r = newReq(http.MethodPost)
+	r.Header["Content-Length"] = []string{"5", "6"}
+	expect("double cl", r, http.StatusBadRequest)
+
+	r = newReq(http.MethodGet)
+	r.Header.Set("X-Big", strings.Repeat("a", 33))
+	expect("big value", r, http.StatusRequestHeaderFieldsTooLarge)
+
+	r = newReq(http.MethodGet)
+	for i := 0; i < 6; i++ {
+		r.Header.Add("X-Many", "1")
+	}
+	expect("many", r, http.StatusRequestHeaderFieldsTooLarge)
+
+	r = newReq(http.MethodGet)
+	r.Header["X-Bad"] = []string{"a\x00b"}
+	expect("nul", r, http.StatusBadRequest)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// lockoutWindow forgets failures this long after the last one.
+	lockoutWindow   = 15 * time.Minute
+	lockoutMaxKeys  = 100_000
+	lockoutScopeIP  = "ip"
+	lockoutScopeKey = "credential"
+)
+
+type lockoutEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// connectLockout slows down credential guessing on /connect. Failures are
+// counted per client IP and per tunnel id and token; from the limit-th
+// failure on, that key is refused for base, doubling with every further
+// failure up to max. A good login clears its credential key but not the IP,
+// so a valid token cannot be used to keep guessing others.
+type connectLockout struct {
+	limit int
+	base  time.Duration
+	max   time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+func newConnectLockout(limit int, base, max time.Duration) *connectLockout {
+	if limit <= 0 || base <= 0 {
+		return nil
+	}
+	if max < base {
+		max = base
+	}
+	return &connectLockout{limit: limit, base: base, max: max, entries: make(map[string]*lockoutEntry)}
+}
+
+func credentialLockoutKey(tunnelID, token string) string {
+	sum := sha256.Sum256([]byte(tunnelID + "\x00" + token))
+	return hex.EncodeToString(sum[:12])
+}
+
+// locked returns how long the first locked key still has to wait.
+func (l *connectLockout) locked(now time.Time, keys ...string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if e := l.entries[key]; e != nil && now.Before(e.until) {
+			wait = max(wait, e.until.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failure for key and returns the lockout it started, or
+// zero while the key is still under the limit.
+func (l *connectLockout) fail(now time.Time, key string) (time.Duration, int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[key]
+	if e == nil || now.Sub(e.last) > lockoutWindow {
+		if len(l.entries) >= lockoutMaxKeys {
+			l.pruneLocked(now)
+		}
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	over := e.failures - l.limit
+	if over < 0 {
+		return 0, e.failures
+	}
+	d := l.max
+	if over < 32 && l.base<<over > 0 && l.base<<over < l.max {
+		d = l.base << over
+	}
+	e.until = now.Add(d)
+	return d, e.failures
+}
+
+func (l *connectLockout) reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.entries, key)
+	l.mu.Unlock()
+}
+
+func (l *connectLockout) pruneLocked(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.last) > lockoutWindow && !now.Before(e.until) {
+			delete(l.entries, key)
+		}
+	}
+	// Under a flood of distinct keys start over rather than grow without
+	// bound.
+	if len(l.entries) >= lockoutMaxKeys {
+		l.entries = make(map[string]*lockoutEntry)
+	}
+}
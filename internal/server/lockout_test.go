@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectLockoutBacksOff(t *testing.T) {
+	l := newConnectLockout(2, time.Second, 5*time.Second)
+	now := time.Unix(1_700_000_000, 0)
+	for i, want := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d, _ := l.fail(now, "k"); d != want {
+			t.Fatalf("failure %d locked for %s, want %s", i+1, d, want)
+		}
+	}
+	if l.locked(now, "other", "k") != 5*time.Second || l.locked(now.Add(5*time.Second), "k") != 0 {
+		t.Fatalf("locked misreports the wait")
+	}
+	if d, _ := l.fail(now.Add(lockoutWindow+time.Minute), "k"); d != 0 {
+		t.Fatalf("failures outlived the window")
+	}
+}
+
+func TestHandleConnectLocksOutRepeatedFailures(t *testing.T) {
+	validator := TokenValidatorFunc(func(_ context.Context, token, _ string) error {
+		if token != "good" {
+			return ErrAgentUnauthorized
+		}
+		return nil
+	})
+	ts := New(Options{TokenValidator: validator, ConnectFailures: 3, ConnectLockout: time.Minute, ConnectLockoutMax: time.Hour})
+	connect := func(ip, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/connect?tunnel_id=tun-1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		ts.HandleConnect(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := connect("203.0.113.1", fmt.Sprint("guess-", i)); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d = %d", i, rec.Code)
+		}
+	}
+	rec := connect("203.0.113.1", "good")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("locked out ip = %d %v", rec.Code, rec.Header())
+	}
+	if got := ts.agentLockouts.Value(lockoutScopeIP); got != 1 {
+		t.Fatalf("ip lockouts = %v", got)
+	}
+
+	// A leaked token retried from many addresses locks out the credential,
+	// not the tunnel: its real token still connects.
+	for i := 0; i < 3; i++ {
+		connect(fmt.Sprint("198.51.100.", i), "stale")
+	}
+	if rec := connect("198.51.100.99", "stale"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out credential = %d", rec.Code)
+	}
+	if rec := connect("198.51.100.99", "good"); rec.Code == http.StatusTooManyRequests || rec.Code == http.StatusUnauthorized {
+		t.Fatalf("valid token from a clean ip = %d", rec.Code)
+	}
+	if got := ts.rejectedAgents.Value("locked out"); got != 2 {
+		t.Fatalf("locked out rejections = %v", got)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// Request is the view of a public request that middlewares get before it is
+// tunneled. Method, Path, Query, Headers, Body and Target may be mutated; a
+// changed Hostname re-resolves the route (and agent) it is sent to, and the
+// new route's IP filter, credentials and rate limit are checked again. Streamed
+// bodies are piped straight to the agent, so Body is nil when Streamed is set.
+type Request struct {
+	HTTP     *http.Request
+	ClientIP string
+	Start    time.Time
+
+	Hostname string
+	Route    protocol.Route
+	Target   string
+	Method   string
+	Path     string
+	Query    string
+	Headers  map[string][]string
+	Body     []byte
+	Trailers map[string][]string
+	Streamed bool
+}
+
+// Response is the agent's answer as seen by OnResponse hooks, which may
+// rewrite any field before it is written to the client. For streamed
+// responses only Status and Headers are available and Body is ignored.
+type Response struct {
+	Status   int
+	Headers  map[string][]string
+	Body     []byte
+	Trailers map[string][]string
+	Streamed bool
+}
+
+// Rejection short-circuits a request: it is written to the client as-is and
+// nothing is sent through the tunnel.
+type Rejection struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected with status %d", r.Status)
+}
+
+func (r *Rejection) write(w http.ResponseWriter) {
+	for k, v := range r.Headers {
+		for _, item := range v {
+			w.Header().Add(k, item)
+		}
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if r.Body == "" {
+		w.WriteHeader(status)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(r.Body))
+}
+
+// Middleware hooks into HandlePublicHTTP. OnRequest runs in registration
+// order after the route is resolved and may mutate req or reject it.
+// OnResponse runs in reverse order for responses that came back through the
+// tunnel; gateway-generated errors (timeouts, offline agents) skip it.
+type Middleware interface {
+	OnRequest(req *Request) *Rejection
+	OnResponse(req *Request, resp *Response)
+}
+
+// MiddlewareFuncs adapts plain functions to Middleware; nil hooks are skipped.
+type MiddlewareFuncs struct {
+	Request  func(req *Request) *Rejection
+	Response func(req *Request, resp *Response)
+}
+
+func (m MiddlewareFuncs) OnRequest(req *Request) *Rejection {
+	if m.Request == nil {
+		return nil
+	}
+	return m.Request(req)
+}
+
+func (m MiddlewareFuncs) OnResponse(req *Request, resp *Response) {
+	if m.Response != nil {
+		m.Response(req, resp)
+	}
+}
+
+// Use appends middlewares to the public request pipeline.
+func (s *TunnelServer) Use(mws ...Middleware) {
+	s.middlewareMu.Lock()
+	defer s.middlewareMu.Unlock()
+	s.middlewares = append(s.middlewares, mws...)
+}
+
+func (s *TunnelServer) middlewareChain() []Middleware {
+	s.middlewareMu.RLock()
+	defer s.middlewareMu.RUnlock()
+	return s.middlewares
+}
+
+func runRequestHooks(chain []Middleware, req *Request) *Rejection {
+	for _, mw := range chain {
+		if rej := mw.OnRequest(req); rej != nil {
+			return rej
+		}
+	}
+	return nil
+}
+
+func runResponseHooks(chain []Middleware, req *Request, resp *Response) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].OnResponse(req, resp)
+	}
+}
+
+// MiddlewareFactory builds a named middleware; config is the raw value given
+// after "=" in the -middleware flag (empty if none).
+type MiddlewareFactory func(config string) (Middleware, error)
+
+var (
+	middlewareRegistryMu sync.RWMutex
+	middlewareRegistry   = map[string]MiddlewareFactory{}
+)
+
+// RegisterMiddleware makes a compiled-in middleware selectable by name, usually
+// from an init function in a package blank-imported by cmd/server.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareRegistryMu.Lock()
+	defer middlewareRegistryMu.Unlock()
+	if _, exists := middlewareRegistry[name]; exists {
+		panic("server: middleware registered twice: " + name)
+	}
+	middlewareRegistry[name] = factory
+}
+
+func NewMiddleware(name, config string) (Middleware, error) {
+	middlewareRegistryMu.RLock()
+	factory, ok := middlewareRegistry[name]
+	middlewareRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware %q (available: %v)", name, RegisteredMiddlewares())
+	}
+	return factory(config)
+}
+
+func RegisteredMiddlewares() []string {
+	middlewareRegistryMu.RLock()
+	defer middlewareRegistryMu.RUnlock()
+	names := make([]string, 0, len(middlewareRegistry))
+	for name := range middlewareRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
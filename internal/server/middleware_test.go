@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"tunneling/internal/protocol"
+)
+
+func TestMiddlewareRejectMutateAndRespond(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(req protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{
+			Status:  http.StatusOK,
+			Headers: map[string][]string{"X-Seen-Path": {req.Path}, "X-Seen-Added": req.Headers["X-Added"]},
+			Body:    base64.StdEncoding.EncodeToString([]byte("hello")),
+		}
+	})
+
+	ts.Use(MiddlewareFuncs{
+		Request: func(req *Request) *Rejection {
+			if req.Path == "/blocked" {
+				return &Rejection{Status: http.StatusForbidden, Body: "nope"}
+			}
+			req.Path = "/rewritten" + req.Path
+			req.Headers["X-Added"] = []string{"1"}
+			return nil
+		},
+		Response: func(_ *Request, resp *Response) {
+			resp.Headers["X-Outer"] = []string{"yes"}
+			resp.Body = append(resp.Body, '!')
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/blocked", nil))
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "nope" {
+		t.Fatalf("blocked request got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/x", strings.NewReader("")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d body=%q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Seen-Path"); got != "/rewritten/x" {
+		t.Fatalf("agent saw path %q", got)
+	}
+	if got := rec.Header().Get("X-Seen-Added"); got != "1" {
+		t.Fatalf("agent saw X-Added %q", got)
+	}
+	if rec.Header().Get("X-Outer") != "yes" || rec.Body.String() != "hello!" {
+		t.Fatalf("response hook not applied: headers=%v body=%q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestMiddlewareRerouteAppliesTargetRoutePolicies(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{
+		{Hostname: "open.test", Target: "127.0.0.1:3000"},
+		{Hostname: "admin.test", Target: "127.0.0.1:4000", Auth: &protocol.RouteAuth{Basic: []string{"alice:" + string(hash)}}},
+		{Hostname: "internal.test", Target: "127.0.0.1:5000", IPFilter: &protocol.IPFilter{Allow: []string{"10.0.0.0/8"}}},
+	}
+	seen := make(chan protocol.Envelope, 4)
+	startFakeAgent(t, ts, "tok", routes, func(req protocol.Envelope) protocol.Envelope {
+		seen <- req
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+	ts.Use(MiddlewareFuncs{
+		Request: func(req *Request) *Rejection {
+			req.Hostname = strings.TrimPrefix(req.Path, "/")
+			return nil
+		},
+	})
+
+	do := func(path string, prepare func(*http.Request)) int {
+		r := httptest.NewRequest(http.MethodGet, "http://open.test"+path, nil)
+		if prepare != nil {
+			prepare(r)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := do("/admin.test", nil); code != http.StatusUnauthorized {
+		t.Fatalf("reroute without credentials = %d, want 401", code)
+	}
+	if code := do("/internal.test", nil); code != http.StatusForbidden {
+		t.Fatalf("reroute from a denied address = %d, want 403", code)
+	}
+	select {
+	case env := <-seen:
+		t.Fatalf("refused reroute reached the agent: %+v", env)
+	default:
+	}
+
+	if code := do("/admin.test", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }); code != http.StatusOK {
+		t.Fatalf("reroute with credentials = %d", code)
+	}
+	env := <-seen
+	if env.Hostname != "admin.test" || len(env.Headers["Authorization"]) != 0 {
+		t.Fatalf("agent saw hostname %q authorization %v", env.Hostname, env.Headers["Authorization"])
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+// maxMirrorsInFlight caps the mirrored requests the server waits on at a
+// time; copies beyond it are dropped rather than queued.
+const maxMirrorsInFlight = 64
+
+// mirrorHeader marks mirrored requests so the target can tell them apart.
+const mirrorHeader = "X-Tunnel-Mirror"
+
+// mirror sends a copy of env, a request already on its way to session, to
+// the route's mirror target for the share of requests it asks for. The
+// copy's response is discarded; requests with a streamed body are not
+// mirrored.
+func (s *TunnelServer) mirror(session *AgentSession, route protocol.Route, env protocol.Envelope, timeout time.Duration) {
+	m := route.Mirror
+	if m == nil || m.Target == "" || m.Percent <= 0 || env.Stream {
+		return
+	}
+	if m.Percent < 100 && rand.IntN(100) >= m.Percent {
+		return
+	}
+	if s.mirrorsInFlight.Add(1) > maxMirrorsInFlight {
+		s.mirrorsInFlight.Add(-1)
+		s.mirroredRequests.Inc("dropped")
+		return
+	}
+	env.RequestID = strconv.FormatUint(s.requestSeq.Add(1), 10)
+	env.Target = m.Target
+	headers := http.Header(env.Headers).Clone()
+	headers.Set(mirrorHeader, "1")
+	env.Headers = headers
+	respCh := make(chan protocol.Envelope, 1)
+	session.AddPending(env.RequestID, respCh)
+	if err := s.write(session, env); err != nil {
+		session.RemovePending(env.RequestID)
+		s.mirrorsInFlight.Add(-1)
+		s.mirroredRequests.Inc("dropped")
+		return
+	}
+	s.mirroredRequests.Inc("sent")
+	go func() {
+		defer s.mirrorsInFlight.Add(-1)
+		defer session.RemovePending(env.RequestID)
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		select {
+		case resp := <-respCh:
+			// Nobody reads a streamed body, so stop the agent sending it.
+			if resp.Stream {
+				s.cancelOnAgent(session, env.RequestID, "mirror")
+			}
+		case <-deadline.C:
+			s.cancelOnAgent(session, env.RequestID, "timeout")
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestMirrorCopiesRequestsToSecondTarget(t *testing.T) {
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	seen := make(chan protocol.Envelope, 4)
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000", Mirror: &protocol.Mirror{Target: "127.0.0.1:3001", Percent: 100}}}, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("from " + env.Target))}
+	})
+
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, httptest.NewRequest(http.MethodPost, "http://app.test/orders", strings.NewReader("payload")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "from 127.0.0.1:3000" {
+		t.Fatalf("response = %d %q", rec.Code, rec.Body.String())
+	}
+	var primary, copied protocol.Envelope
+	for i := range 2 {
+		select {
+		case env := <-seen:
+			if env.Target == "127.0.0.1:3001" {
+				copied = env
+			} else {
+				primary = env
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("agent saw %d requests, want 2", i)
+		}
+	}
+	if primary.Target != "127.0.0.1:3000" || http.Header(primary.Headers).Get(mirrorHeader) != "" {
+		t.Fatalf("primary request = %+v", primary)
+	}
+	if copied.RequestID == primary.RequestID || copied.Path != "/orders" || copied.Body != base64.StdEncoding.EncodeToString([]byte("payload")) || http.Header(copied.Headers).Get(mirrorHeader) != "1" {
+		t.Fatalf("mirrored request = %+v", copied)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.mirrorsInFlight.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("mirrored response was not collected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
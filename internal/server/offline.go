@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultOfflinePage is shown to browsers when a hostname is routed but
+// cannot be served right now. Custom pages get the same fields.
+const defaultOfflinePage = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<title>Temporarily unavailable</title>
+</head>
+<body style="font-family: sans-serif; max-width: 560px; margin: 80px auto; color: #0f172a">
+<h1>Temporarily unavailable</h1>
+<p>The service behind <strong>{{.Hostname}}</strong> cannot be reached right now ({{.Reason}}). Please try again in a moment.</p>
+{{if .Refresh}}<p style="color: #64748b">This page reloads every {{.Refresh}} seconds.</p>{{end}}
+</body>
+</html>
+`
+
+// OfflinePageData is what an offline page template is rendered with.
+type OfflinePageData struct {
+	Hostname   string
+	Reason     string
+	RetryAfter int
+	// Refresh is the auto-refresh interval in seconds, 0 for none.
+	Refresh int
+}
+
+// ParseOfflinePage compiles an html/template offline page; an empty source
+// gives the built-in one.
+func ParseOfflinePage(source string) (*template.Template, error) {
+	if strings.TrimSpace(source) == "" {
+		source = defaultOfflinePage
+	}
+	tmpl, err := template.New("offline").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("offline page: %w", err)
+	}
+	return tmpl, nil
+}
+
+// writeUnavailable answers 503 for a routed hostname that cannot be served:
+// the offline page for browsers, msg as plain text for everyone else.
+func (s *TunnelServer) writeUnavailable(w http.ResponseWriter, r *http.Request, host, msg string, retryAfter int) {
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	var page bytes.Buffer
+	data := OfflinePageData{Hostname: host, Reason: msg, RetryAfter: retryAfter, Refresh: int(s.offlineRefresh / time.Second)}
+	if err := s.offlinePage.Execute(&page, data); err != nil {
+		slog.Warn("render offline page failed", "hostname", host, "err", err)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(page.Bytes())
+}
+
+// breaker trips a hostname's circuit after Failures agent timeouts in a
+// row. While it is open requests for the hostname are refused at once
+// instead of piling up behind a stuck agent; after Cooldown they are let
+// through again, and the next timeout trips it straight back.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(failures int, cooldown time.Duration) *breaker {
+	if failures <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &breaker{failures: failures, cooldown: cooldown, hosts: make(map[string]*circuit)}
+}
+
+// open reports how long the circuit of host stays open, zero when requests
+// may pass. A nil breaker never opens.
+func (b *breaker) open(host string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil {
+		return 0
+	}
+	return max(time.Until(c.openUntil), 0)
+}
+
+func (b *breaker) success(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.hosts, host)
+	b.mu.Unlock()
+}
+
+// failure records a timeout and reports whether it tripped the circuit.
+func (b *breaker) failure(host string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	if c.failures < b.failures || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestBreakerServesOfflinePageAfterTimeouts(t *testing.T) {
+	page, err := ParseOfflinePage(`down {{.Hostname}} refresh={{.Refresh}}`)
+	if err != nil {
+		t.Fatalf("parse offline page: %v", err)
+	}
+	ts := New(Options{
+		RequestTimeout:  30 * time.Millisecond,
+		BreakerFailures: 2,
+		BreakerCooldown: time.Minute,
+		OfflinePage:     page,
+		OfflineRefresh:  5 * time.Second,
+	})
+	var calls atomic.Int32
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(protocol.Envelope) protocol.Envelope {
+		calls.Add(1)
+		time.Sleep(60 * time.Millisecond)
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		req.Header.Set("Accept", "text/html")
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := get(); rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("request %d status = %d, want 504", i, rec.Code)
+		}
+	}
+	rec := get()
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusServiceUnavailable || string(body) != "down app.test refresh=5" {
+		t.Fatalf("open circuit = %d %q", rec.Code, body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("open circuit headers = %v", rec.Header())
+	}
+	// The fake agent handles requests one at a time, so let it catch up.
+	time.Sleep(150 * time.Millisecond)
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("agent saw %d requests, want 2", got)
+	}
+}
+
+func TestBreakerResetsOnSuccess(t *testing.T) {
+	b := newBreaker(2, time.Minute)
+	b.failure("a.test")
+	b.success("a.test")
+	if b.failure("a.test") || b.open("a.test") > 0 {
+		t.Fatalf("circuit opened after a success in between")
+	}
+	if !b.failure("a.test") || b.open("a.test") <= 0 {
+		t.Fatalf("circuit not opened after two failures in a row")
+	}
+	var disabled *breaker
+	if disabled.failure("a.test") || disabled.open("a.test") > 0 {
+		t.Fatalf("nil breaker tripped")
+	}
+}
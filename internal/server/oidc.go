@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDCProviderGeneric = "oidc"
+	OIDCProviderGitHub  = "github"
+
+	// oidcPathPrefix holds the gateway's own login endpoints on every
+	// hostname.
+	oidcPathPrefix      = "/_tunnel/oidc/"
+	oidcSessionCookie   = "tunnel_session"
+	oidcNonceCookie     = "tunnel_oidc_nonce"
+	oidcLoginTimeout    = 10 * time.Minute
+	oidcTicketTTL       = 2 * time.Minute
+	defaultOIDCSessTTL  = 12 * time.Hour
+	defaultOIDCIssuer   = "https://accounts.google.com"
+	githubAuthorizeURL  = "https://github.com/login/oauth/authorize"
+	githubTokenURL      = "https://github.com/login/oauth/access_token"
+	githubAPIURL        = "https://api.github.com"
+	oidcUserHeader      = "X-Auth-User"
+	oidcEmailHeader     = "X-Auth-Email"
+	oidcIdentityTimeout = 10 * time.Second
+)
+
+// OIDCOptions configures single sign-on for routes with an auth login
+// policy. The provider redirects back to RedirectURL, a fixed URL on one
+// hostname that points at the gateway (its path must be
+// /_tunnel/oidc/callback); the gateway then hands the identity to the
+// route's own hostname, which keeps it in a session cookie.
+type OIDCOptions struct {
+	// Provider is OIDCProviderGeneric (the default, any OpenID Connect
+	// issuer with discovery) or OIDCProviderGitHub.
+	Provider     string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// SessionTTL is how long a sign-in lasts; zero means 12h.
+	SessionTTL time.Duration
+	HTTPClient *http.Client
+}
+
+type oidcIdentity struct {
+	User  string `json:"u"`
+	Email string `json:"e,omitempty"`
+}
+
+type oidcEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+}
+
+type oidcGate struct {
+	opts     OIDCOptions
+	secret   []byte
+	redirect *url.URL
+	client   *http.Client
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+// Validate reports whether the options can run a login.
+func (o OIDCOptions) Validate() error {
+	_, err := o.withDefaults()
+	return err
+}
+
+func (o OIDCOptions) withDefaults() (OIDCOptions, error) {
+	if o.Provider == "" {
+		o.Provider = OIDCProviderGeneric
+	}
+	if o.Provider != OIDCProviderGeneric && o.Provider != OIDCProviderGitHub {
+		return o, fmt.Errorf("unknown oidc provider %q (want %s or %s)", o.Provider, OIDCProviderGeneric, OIDCProviderGitHub)
+	}
+	if o.Provider == OIDCProviderGeneric && o.Issuer == "" {
+		o.Issuer = defaultOIDCIssuer
+	}
+	if o.ClientID == "" || o.ClientSecret == "" {
+		return o, errors.New("oidc needs a client id and secret")
+	}
+	redirect, err := url.Parse(o.RedirectURL)
+	if err != nil || redirect.Host == "" || redirect.Path != oidcPathPrefix+"callback" {
+		return o, fmt.Errorf("oidc redirect url must look like https://login.example.com%scallback", oidcPathPrefix)
+	}
+	if o.SessionTTL <= 0 {
+		o.SessionTTL = defaultOIDCSessTTL
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = &http.Client{Timeout: oidcIdentityTimeout}
+	}
+	return o, nil
+}
+
+// newOIDCGate returns nil when opts is nil or invalid; routes with a login
+// policy then turn every request away.
+func newOIDCGate(opts *OIDCOptions, secret []byte) *oidcGate {
+	if opts == nil {
+		return nil
+	}
+	o, err := opts.withDefaults()
+	if err != nil {
+		slog.Warn("oidc login disabled", "err", err)
+		return nil
+	}
+	redirect, _ := url.Parse(o.RedirectURL)
+	return &oidcGate{opts: o, secret: secret, redirect: redirect, client: o.HTTPClient}
+}
+
+// serve answers the gateway's login endpoints.
+func (g *oidcGate) serve(w http.ResponseWriter, r *http.Request, host string) {
+	switch strings.TrimPrefix(r.URL.Path, oidcPathPrefix) {
+	case "callback":
+		g.callback(w, r, host)
+	case "session":
+		g.startSession(w, r, host)
+	case "logout":
+		http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil})
+		_, _ = io.WriteString(w, "signed out\n")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// identity returns who the request's session cookie belongs to.
+func (g *oidcGate) identity(r *http.Request, host string) (oidcIdentity, bool) {
+	c, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return oidcIdentity{}, false
+	}
+	var session struct {
+		oidcIdentity
+		Host string `json:"h"`
+	}
+	if !g.open("session", c.Value, &session) || session.Host != host {
+		return oidcIdentity{}, false
+	}
+	return session.oidcIdentity, true
+}
+
+// begin sends a browser to the provider, remembering in a cookie on this
+// hostname that it was this browser that started the login.
+func (g *oidcGate) begin(w http.ResponseWriter, r *http.Request, host string) {
+	endpoints, err := g.discover(r.Context())
+	if err != nil {
+		slog.Warn("oidc discovery failed", "issuer", g.opts.Issuer, "err", err)
+		http.Error(w, "login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	nonce := randomToken()
+	http.SetCookie(w, &http.Cookie{Name: oidcNonceCookie, Value: nonce, Path: oidcPathPrefix, MaxAge: int(oidcLoginTimeout / time.Second), HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	state := g.sign("state", map[string]string{"h": host, "n": nonce, "r": r.URL.RequestURI(), "s": requestScheme(r)}, oidcLoginTimeout)
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {g.opts.ClientID},
+		"redirect_uri":  {g.opts.RedirectURL},
+		"scope":         {g.scope()},
+		"state":         {state},
+	}
+	http.Redirect(w, r, endpoints.Authorization+"?"+q.Encode(), http.StatusFound)
+}
+
+func (g *oidcGate) callback(w http.ResponseWriter, r *http.Request, host string) {
+	if host != normalizeHost(g.redirect.Host) {
+		http.NotFound(w, r)
+		return
+	}
+	var state map[string]string
+	if !g.open("state", r.URL.Query().Get("state"), &state) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "login was not completed", http.StatusUnauthorized)
+		return
+	}
+	id, err := g.exchange(r.Context(), code)
+	if err != nil {
+		slog.Warn("oidc login failed", "hostname", state["h"], "err", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	ticket := g.sign("ticket", map[string]string{"h": state["h"], "n": state["n"], "r": state["r"], "u": id.User, "e": id.Email}, oidcTicketTTL)
+	scheme := state["s"]
+	if scheme == "" {
+		scheme = "https"
+	}
+	http.Redirect(w, r, scheme+"://"+state["h"]+oidcPathPrefix+"session?"+url.Values{"ticket": {ticket}}.Encode(), http.StatusFound)
+}
+
+// startSession turns a ticket from the callback into a session cookie for
+// this hostname, provided this browser started the login here.
+func (g *oidcGate) startSession(w http.ResponseWriter, r *http.Request, host string) {
+	var ticket map[string]string
+	nonce, err := r.Cookie(oidcNonceCookie)
+	if !g.open("ticket", r.URL.Query().Get("ticket"), &ticket) || ticket["h"] != host || err != nil || !hmac.Equal([]byte(nonce.Value), []byte(ticket["n"])) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	session := g.sign("session", map[string]string{"h": host, "u": ticket["u"], "e": ticket["e"]}, g.opts.SessionTTL)
+	http.SetCookie(w, &http.Cookie{Name: oidcNonceCookie, Value: "", Path: oidcPathPrefix, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: session, Path: "/", MaxAge: int(g.opts.SessionTTL / time.Second), HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	back := ticket["r"]
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		back = "/"
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+func (g *oidcGate) scope() string {
+	if g.opts.Provider == OIDCProviderGitHub {
+		return "read:user user:email"
+	}
+	return "openid email profile"
+}
+
+func (g *oidcGate) discover(ctx context.Context) (*oidcEndpoints, error) {
+	if g.opts.Provider == OIDCProviderGitHub {
+		return &oidcEndpoints{Authorization: githubAuthorizeURL, Token: githubTokenURL, UserInfo: githubAPIURL + "/user"}, nil
+	}
+	g.mu.Lock()
+	cached := g.endpoints
+	g.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	// Fetched without the lock, so a slow issuer only holds up the logins
+	// waiting on it; concurrent first logins may each fetch.
+	var endpoints oidcEndpoints
+	if err := g.getJSON(ctx, strings.TrimRight(g.opts.Issuer, "/")+"/.well-known/openid-configuration", "", &endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.Authorization == "" || endpoints.Token == "" || endpoints.UserInfo == "" {
+		return nil, errors.New("discovery document lacks authorization, token or userinfo endpoint")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.endpoints == nil {
+		g.endpoints = &endpoints
+	}
+	return g.endpoints, nil
+}
+
+// exchange trades the authorization code for an access token and asks the
+// provider who it belongs to.
+func (g *oidcGate) exchange(ctx context.Context, code string) (oidcIdentity, error) {
+	endpoints, err := g.discover(ctx)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {g.opts.RedirectURL},
+		"client_id":     {g.opts.ClientID},
+		"client_secret": {g.opts.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := g.doJSON(req, &token); err != nil {
+		return oidcIdentity{}, fmt.Errorf("token endpoint: %w", err)
+	}
+	if token.AccessToken == "" {
+		return oidcIdentity{}, fmt.Errorf("token endpoint returned no access token: %s", token.Error)
+	}
+
+	if g.opts.Provider == OIDCProviderGitHub {
+		return g.githubIdentity(ctx, token.AccessToken)
+	}
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+		Username      string `json:"preferred_username"`
+	}
+	if err := g.getJSON(ctx, endpoints.UserInfo, token.AccessToken, &info); err != nil {
+		return oidcIdentity{}, fmt.Errorf("userinfo endpoint: %w", err)
+	}
+	// preferred_username can be changed by the user at most providers, so
+	// it never names anyone here: bare names in allow lists match the
+	// stable sub, and emails count only once the provider verified them.
+	if info.EmailVerified == nil || !*info.EmailVerified {
+		info.Email = ""
+	}
+	if info.Subject == "" {
+		return oidcIdentity{}, errors.New("userinfo names no subject")
+	}
+	return oidcIdentity{User: info.Subject, Email: info.Email}, nil
+}
+
+func (g *oidcGate) githubIdentity(ctx context.Context, accessToken string) (oidcIdentity, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := g.getJSON(ctx, githubAPIURL+"/user", accessToken, &user); err != nil || user.Login == "" {
+		return oidcIdentity{}, fmt.Errorf("github user: %v", err)
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	id := oidcIdentity{User: user.Login}
+	if err := g.getJSON(ctx, githubAPIURL+"/user/emails", accessToken, &emails); err == nil {
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				id.Email = e.Email
+			}
+		}
+	}
+	return id, nil
+}
+
+func (g *oidcGate) getJSON(ctx context.Context, target, accessToken string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return g.doJSON(req, out)
+}
+
+func (g *oidcGate) doJSON(req *http.Request, out any) error {
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// sign seals v with an expiry under the given purpose, so a value made for
+// one step cannot be replayed at another.
+func (g *oidcGate) sign(purpose string, v map[string]string, ttl time.Duration) string {
+	v["x"] = fmt.Sprint(time.Now().Add(ttl).Unix())
+	payload, _ := json.Marshal(v)
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + g.mac(purpose, body)
+}
+
+func (g *oidcGate) open(purpose, value string, out any) bool {
+	body, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(g.mac(purpose, body))) {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return false
+	}
+	var expiry struct {
+		X string `json:"x"`
+	}
+	if json.Unmarshal(payload, &expiry) != nil {
+		return false
+	}
+	var unix int64
+	if _, err := fmt.Sscan(expiry.X, &unix); err != nil || time.Now().Unix() >= unix {
+		return false
+	}
+	return json.Unmarshal(payload, out) == nil
+}
+
+func (g *oidcGate) mac(purpose, body string) string {
+	h := hmac.New(sha256.New, g.secret)
+	h.Write([]byte("oidc " + purpose + "\n" + body))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// wantsLogin reports whether the request looks like a browser navigation
+// that can follow a redirect to the login page.
+func wantsLogin(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func startFakeIssuer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var issuer *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"userinfo_endpoint":      issuer.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_secret") != "shh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The code doubles as the access token and names the user.
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": r.PostFormValue("code")})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("Authorization")[len("Bearer "):]
+		_ = json.NewEncoder(w).Encode(map[string]any{"sub": "id-" + user, "preferred_username": user, "email": user + "@example.com", "email_verified": user != "unverified"})
+	})
+	issuer = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := startFakeIssuer(t)
+	ts := New(Options{RequestTimeout: 2 * time.Second, OIDC: &OIDCOptions{
+		Issuer:       issuer.URL,
+		ClientID:     "tunnel",
+		ClientSecret: "shh",
+		RedirectURL:  "http://login.test/_tunnel/oidc/callback",
+	}})
+	routes := []protocol.Route{
+		{Hostname: "app.test", Target: "127.0.0.1:3000", Auth: &protocol.RouteAuth{Login: &protocol.LoginPolicy{Allow: []string{"@example.com"}}}},
+		{Hostname: "team.test", Target: "127.0.0.1:3000", Auth: &protocol.RouteAuth{Login: &protocol.LoginPolicy{Allow: []string{"alice", "id-bob"}}}},
+	}
+	seen := make(chan protocol.Envelope, 4)
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(target string, cookies []*http.Cookie, html bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if html {
+			req.Header.Set("Accept", "text/html")
+		}
+		req.Header.Set(oidcUserHeader, "forged")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+	login := func(host, user string) []*http.Cookie {
+		t.Helper()
+		rec := do("http://"+host+"/dash?x=1", nil, true)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("anonymous browser = %d", rec.Code)
+		}
+		nonce := rec.Result().Cookies()
+		authorize, _ := url.Parse(rec.Header().Get("Location"))
+		if authorize.Path != "/authorize" || authorize.Query().Get("redirect_uri") != "http://login.test/_tunnel/oidc/callback" {
+			t.Fatalf("authorize url = %s", authorize)
+		}
+
+		rec = do("http://login.test/_tunnel/oidc/callback?code="+user+"&state="+url.QueryEscape(authorize.Query().Get("state")), nil, true)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("callback = %d %s", rec.Code, rec.Body)
+		}
+		ticketURL := rec.Header().Get("Location")
+		if rec := do(ticketURL, nil, true); rec.Code != http.StatusBadRequest {
+			t.Fatalf("ticket without the login's nonce = %d", rec.Code)
+		}
+		rec = do(ticketURL, nonce, true)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/dash?x=1" {
+			t.Fatalf("session = %d %s", rec.Code, rec.Header().Get("Location"))
+		}
+		var session []*http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == oidcSessionCookie {
+				session = append(session, c)
+			}
+		}
+		return session
+	}
+
+	if rec := do("http://app.test/api", nil, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous api call = %d", rec.Code)
+	}
+
+	session := login("app.test", "alice")
+	if rec := do("http://app.test/dash", session, true); rec.Code != http.StatusOK {
+		t.Fatalf("signed in = %d", rec.Code)
+	}
+	env := <-seen
+	if got := env.Headers[oidcUserHeader]; len(got) != 1 || got[0] != "id-alice" {
+		t.Fatalf("agent saw user %v", got)
+	}
+	if got := env.Headers[oidcEmailHeader]; len(got) != 1 || got[0] != "alice@example.com" {
+		t.Fatalf("agent saw email %v", got)
+	}
+	if len(env.Headers["Cookie"]) != 0 {
+		t.Fatalf("session cookie reached the agent: %v", env.Headers["Cookie"])
+	}
+
+	if rec := do("http://other.test/dash", session, true); rec.Code != http.StatusNotFound {
+		t.Fatalf("session on an unknown host = %d", rec.Code)
+	}
+	if rec := do("http://app.test/dash", login("app.test", "unverified"), true); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified email = %d", rec.Code)
+	}
+	// Bare names match the provider's subject, never the username a user
+	// picks for themselves.
+	if rec := do("http://team.test/dash", login("team.test", "alice"), true); rec.Code != http.StatusForbidden {
+		t.Fatalf("preferred_username on the allow list = %d", rec.Code)
+	}
+	if rec := do("http://team.test/dash", login("team.test", "bob"), true); rec.Code != http.StatusOK {
+		t.Fatalf("subject on the allow list = %d", rec.Code)
+	}
+}
+
+func TestOIDCDiscoveryDoesNotHoldTheLock(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+	g := newOIDCGate(&OIDCOptions{Issuer: slow.URL, ClientID: "tunnel", ClientSecret: "shh", RedirectURL: "http://login.test/_tunnel/oidc/callback"}, []byte("secret"))
+	if g == nil {
+		t.Fatal("gate not created")
+	}
+
+	go func() { _, _ = g.discover(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := g.discover(ctx); err == nil {
+		t.Fatal("discovery against a hanging issuer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("second discovery waited %s behind the first", elapsed)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"tunneling/internal/muxconn"
+)
+
+// quicConnectTimeout bounds the wait for a QUIC agent's connect request.
+const quicConnectTimeout = 10 * time.Second
+
+// ListenQUIC listens for agents on the UDP address addr. tlsConf holds the
+// server certificate; the agent ALPN protocol is added to a copy of it.
+func ListenQUIC(addr string, tlsConf *tls.Config) (*quic.Listener, error) {
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{muxconn.QUICProto}
+	return quic.ListenAddr(addr, conf, muxconn.QUICConfig())
+}
+
+// ServeQUIC accepts agents on ln until ctx is done. An agent sends the same
+// connect request it would send to /connect on the first stream and, once
+// accepted, the session runs like a yamux one, with a stream per request.
+// QUIC recovers from packet loss per stream, so on lossy networks one lost
+// packet no longer stalls every request of the agent.
+func (s *TunnelServer) ServeQUIC(ctx context.Context, ln *quic.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	for {
+		qc, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveQUICConn(qc)
+	}
+}
+
+func (s *TunnelServer) serveQUICConn(qc quic.Connection) {
+	agent, err := muxconn.AcceptQUIC(qc, quicConnectTimeout)
+	if err != nil {
+		slog.Warn("read quic connect request failed", "remote", qc.RemoteAddr(), "err", err)
+		_ = qc.CloseWithError(0, "")
+		return
+	}
+	r := agent.Request
+	if r.URL.Path != "/connect" {
+		agent.Reject(&http.Response{StatusCode: http.StatusNotFound})
+		return
+	}
+	rec := &quicResponse{header: make(http.Header)}
+	token, sessionID, resumed, ok := s.authorizeAgent(rec, r)
+	if !ok {
+		agent.Reject(rec.response())
+		return
+	}
+	conn, err := agent.Accept()
+	if err != nil {
+		slog.Warn("answer quic connect request failed", "token", tokenHint(token), "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	s.serveAgent(conn, r, token, sessionID, resumed)
+}
+
+// quicResponse collects what authorizeAgent answers a rejected agent with.
+type quicResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *quicResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *quicResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+func (r *quicResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *quicResponse) response() *http.Response {
+	return &http.Response{
+		StatusCode:    r.status,
+		Header:        r.header,
+		Body:          io.NopCloser(&r.body),
+		ContentLength: int64(r.body.Len()),
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter holds token buckets for public traffic, keyed by hostname and,
+// for per-client limits, by client IP as well.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	limit  protocol.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func burstOf(limit protocol.RateLimit) float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.RPS))
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// how long until the next token is available.
+func (l *rateLimiter) allow(key string, limit protocol.RateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweepLocked(now)
+	}
+
+	burst := burstOf(limit)
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		// A changed limit starts over with a full bucket.
+		b = &tokenBucket{limit: limit, tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.RPS)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.RPS * float64(time.Second))
+}
+
+// sweepLocked forgets buckets that have refilled completely; recreating one
+// later gives the same answer.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.RPS >= burstOf(b.limit) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// checkRateLimit applies the route's limit, or the server default, to a
+// public request and writes a 429 when it is exceeded.
+func (s *TunnelServer) checkRateLimit(w http.ResponseWriter, host string, route protocol.Route, clientIP string) bool {
+	limit := s.rateLimit
+	if route.RateLimit != nil {
+		limit = route.RateLimit
+	}
+	if limit == nil || limit.RPS <= 0 {
+		return true
+	}
+	key := host
+	if limit.PerClientIP {
+		key += "|" + clientIP
+	}
+	ok, wait := s.limiter.allow(key, *limit, time.Now())
+	if ok {
+		return true
+	}
+	s.rejectedRequests.Inc("rate limited")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
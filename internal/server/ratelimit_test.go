@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter()
+	limit := protocol.RateLimit{RPS: 2, Burst: 2}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("app.test", limit, now); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, wait := l.allow("app.test", limit, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("third request: ok=%v wait=%s, want limited for 500ms", ok, wait)
+	}
+	if ok, _ := l.allow("app.test", limit, now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("request after refill was limited")
+	}
+}
+
+func TestRouteRateLimitRejectsWith429(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000", RateLimit: &protocol.RateLimit{RPS: 0.01, Burst: 1, PerClientIP: true}}}
+	startFakeAgent(t, ts, "tok", routes, replyWith("a"))
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+	if rec := get("10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d", rec.Code)
+	}
+	rec := get("10.0.0.1:1001")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("second request status = %d retry-after=%q, want 429", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := get("10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("other client status = %d, want its own bucket", rec.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const resumeTokenTTL = 24 * time.Hour
+
+type resumeClaims struct {
+	SessionID string `json:"sid"`
+	TokenHash string `json:"th"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// issueResumeToken signs the session id for the given agent token so that a
+// restarted server holding the same secret can recognise a reconnecting agent.
+func issueResumeToken(secret []byte, sessionID, agentToken string, now time.Time) (string, error) {
+	payload, err := json.Marshal(resumeClaims{
+		SessionID: sessionID,
+		TokenHash: tokenHash(agentToken),
+		IssuedAt:  now.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + signResume(secret, body), nil
+}
+
+func verifyResumeToken(secret []byte, raw, agentToken string, now time.Time) (resumeClaims, error) {
+	body, sig, ok := strings.Cut(strings.TrimSpace(raw), ".")
+	if !ok || body == "" || sig == "" {
+		return resumeClaims{}, errors.New("malformed resume token")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signResume(secret, body))) {
+		return resumeClaims{}, errors.New("invalid resume token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return resumeClaims{}, errors.New("malformed resume token")
+	}
+	var claims resumeClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return resumeClaims{}, errors.New("malformed resume token")
+	}
+	if claims.SessionID == "" || claims.TokenHash != tokenHash(agentToken) {
+		return resumeClaims{}, errors.New("resume token does not match agent token")
+	}
+	if now.Sub(time.Unix(claims.IssuedAt, 0)) > resumeTokenTTL {
+		return resumeClaims{}, errors.New("resume token expired")
+	}
+	return claims, nil
+}
+
+func signResume(secret []byte, body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenHash identifies an agent token without revealing it. Access logs
+// and resume tokens share it, so the same token has one fingerprint.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newSessionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strings.ReplaceAll(time.Now().UTC().Format("150405.000000000"), ".", "")
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	raw, err := issueResumeToken(secret, "sess-1", "agent-token", now)
+	if err != nil {
+		t.Fatalf("issueResumeToken() error = %v", err)
+	}
+	claims, err := verifyResumeToken(secret, raw, "agent-token", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("verifyResumeToken() error = %v", err)
+	}
+	if claims.SessionID != "sess-1" {
+		t.Fatalf("SessionID = %q", claims.SessionID)
+	}
+}
+
+func TestResumeTokenRejectsMismatches(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	raw, err := issueResumeToken(secret, "sess-1", "agent-token", now)
+	if err != nil {
+		t.Fatalf("issueResumeToken() error = %v", err)
+	}
+
+	if _, err := verifyResumeToken([]byte("other"), raw, "agent-token", now); err == nil {
+		t.Fatal("expected signature error with a different secret")
+	}
+	if _, err := verifyResumeToken(secret, raw, "another-token", now); err == nil {
+		t.Fatal("expected error for a different agent token")
+	}
+	if _, err := verifyResumeToken(secret, raw, "agent-token", now.Add(resumeTokenTTL+time.Minute)); err == nil {
+		t.Fatal("expected expiry error")
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	basicAuthCacheTTL  = 5 * time.Minute
+	basicAuthCacheSize = 4096
+)
+
+// basicAuthCache remembers recently accepted Basic credentials so bcrypt
+// does not run on every request of a page load.
+type basicAuthCache struct {
+	mu     sync.Mutex
+	passed map[[32]byte]time.Time
+}
+
+func credentialKey(auth *protocol.RouteAuth, user, password string) [32]byte {
+	return sha256.Sum256([]byte(strings.Join(auth.Basic, "\n") + "\x00" + user + "\x00" + password))
+}
+
+func (c *basicAuthCache) check(auth *protocol.RouteAuth, user, password string) bool {
+	key := credentialKey(auth, user, password)
+	now := time.Now()
+	c.mu.Lock()
+	until, ok := c.passed[key]
+	c.mu.Unlock()
+	if ok && now.Before(until) {
+		return true
+	}
+	if !auth.CheckBasic(user, password) {
+		return false
+	}
+	c.mu.Lock()
+	if c.passed == nil || len(c.passed) >= basicAuthCacheSize {
+		c.passed = make(map[[32]byte]time.Time)
+	}
+	c.passed[key] = now.Add(basicAuthCacheTTL)
+	c.mu.Unlock()
+	return true
+}
+
+// checkRouteAuth lets a request through when the route asks for no
+// credentials or the request brings valid ones, and answers 401 otherwise.
+// The credentials are the gateway's, so they are removed before the request
+// goes to the agent. A signed-in user is named to the service in
+// X-Auth-User and X-Auth-Email, a bearer token's subject in X-Auth-User;
+// browsers without a session are sent to the login page.
+func (s *TunnelServer) checkRouteAuth(w http.ResponseWriter, r *http.Request, host string, auth *protocol.RouteAuth) bool {
+	if auth == nil {
+		return true
+	}
+	r.Header.Del(oidcUserHeader)
+	r.Header.Del(oidcEmailHeader)
+	if auth.Login != nil && s.oidc != nil {
+		if id, ok := s.oidc.identity(r, host); ok {
+			if !auth.Login.Permits(id.User, id.Email) {
+				s.rejectedRequests.Inc("login denied")
+				slog.Info("login denied", "hostname", host, "user", id.User, "email", id.Email)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return false
+			}
+			dropCookie(r, oidcSessionCookie)
+			r.Header.Set(oidcUserHeader, id.User)
+			if id.Email != "" {
+				r.Header.Set(oidcEmailHeader, id.Email)
+			}
+			return true
+		}
+	}
+	var jwtErr error
+	if auth.JWT != nil {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			claims, err := s.jwks.verifyJWT(r.Context(), auth.JWT, strings.TrimSpace(token), time.Now())
+			if err == nil {
+				// The token is the caller's own, so the service gets it too.
+				if claims.Subject != "" {
+					r.Header.Set(oidcUserHeader, claims.Subject)
+				}
+				return true
+			}
+			jwtErr = err
+			slog.Info("jwt rejected", "hostname", host, "err", err)
+		}
+	}
+	if auth.TokenSecret != "" {
+		query := r.URL.Query()
+		if token := query.Get(protocol.RouteTokenParam); token != "" {
+			if expires, ok := protocol.VerifyRouteToken(auth.TokenSecret, host, token, time.Now()); ok {
+				// The cookie carries the page's own assets and links.
+				http.SetCookie(w, &http.Cookie{Name: protocol.RouteTokenParam, Value: token, Path: "/", Expires: expires, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+				query.Del(protocol.RouteTokenParam)
+				r.URL.RawQuery = query.Encode()
+				dropCookie(r, protocol.RouteTokenParam)
+				return true
+			}
+		}
+		if c, err := r.Cookie(protocol.RouteTokenParam); err == nil {
+			if _, ok := protocol.VerifyRouteToken(auth.TokenSecret, host, c.Value, time.Now()); ok {
+				dropCookie(r, protocol.RouteTokenParam)
+				return true
+			}
+		}
+	}
+	if len(auth.Basic) > 0 {
+		if user, password, ok := r.BasicAuth(); ok && s.basicAuth.check(auth, user, password) {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+	// Browsers go to the login page; scripts get a 401, with a Basic
+	// challenge when the route takes one.
+	if auth.Login != nil && s.oidc != nil && wantsLogin(r) {
+		s.oidc.begin(w, r, host)
+		return false
+	}
+	if len(auth.Basic) > 0 {
+		w.Header().Add("WWW-Authenticate", "Basic realm="+strconv.Quote(host)+", charset=\"UTF-8\"")
+	}
+	if auth.JWT != nil {
+		challenge := "Bearer realm=" + strconv.Quote(host)
+		if jwtErr != nil {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+	s.rejectedRequests.Inc("unauthorized")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// dropCookie removes one cookie from the request's Cookie header.
+func dropCookie(r *http.Request, name string) {
+	var kept []string
+	for _, c := range r.Cookies() {
+		if c.Name != name {
+			kept = append(kept, c.String())
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// syncGatewayCredentials carries what checkRouteAuth removed from or added
+// to r over to req, whose headers and query were copied from r before a
+// middleware rerouted it to another route.
+func syncGatewayCredentials(req *Request, r *http.Request) {
+	for _, name := range []string{"Authorization", "Cookie", oidcUserHeader, oidcEmailHeader} {
+		name = http.CanonicalHeaderKey(name)
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Headers[name] = append([]string(nil), values...)
+		} else {
+			delete(req.Headers, name)
+		}
+	}
+	if r.URL.Query().Has(protocol.RouteTokenParam) {
+		return
+	}
+	if query, err := url.ParseQuery(req.Query); err == nil && query.Has(protocol.RouteTokenParam) {
+		query.Del(protocol.RouteTokenParam)
+		req.Query = query.Encode()
+	}
+}
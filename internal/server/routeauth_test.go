@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRouteAuthBasicAndToken(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	const secret = "0123456789abcdef"
+	ts := New(Options{RequestTimeout: 2 * time.Second})
+	routes := []protocol.Route{{Hostname: "preview.test", Target: "127.0.0.1:3000", Auth: &protocol.RouteAuth{Basic: []string{"alice:" + string(hash)}, TokenSecret: secret}}}
+	seen := make(chan protocol.Envelope, 4)
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(target string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if prepare != nil {
+			prepare(req)
+		}
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("http://preview.test/", nil)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("anonymous = %d %v", rec.Code, rec.Header())
+	}
+	if rec := do("http://preview.test/", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password = %d", rec.Code)
+	}
+	if rec := do("http://preview.test/", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }); rec.Code != http.StatusOK {
+		t.Fatalf("basic auth = %d", rec.Code)
+	}
+	if env := <-seen; len(env.Headers["Authorization"]) != 0 {
+		t.Fatalf("gateway credentials reached the agent: %v", env.Headers["Authorization"])
+	}
+
+	token := protocol.SignRouteToken(secret, "preview.test", time.Now().Add(time.Hour))
+	rec = do("http://preview.test/page?a=1&"+protocol.RouteTokenParam+"="+token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("signed link = %d", rec.Code)
+	}
+	if env := <-seen; env.Query != "a=1" {
+		t.Fatalf("agent saw query %q", env.Query)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != protocol.RouteTokenParam {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	rec = do("http://preview.test/app.css", func(r *http.Request) {
+		r.AddCookie(cookies[0])
+		r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token cookie = %d", rec.Code)
+	}
+	if env := <-seen; len(env.Headers["Cookie"]) != 1 || env.Headers["Cookie"][0] != "app=1" {
+		t.Fatalf("agent saw cookies %v", env.Headers["Cookie"])
+	}
+
+	expired := protocol.SignRouteToken(secret, "preview.test", time.Now().Add(-time.Minute))
+	if rec := do("http://preview.test/?"+protocol.RouteTokenParam+"="+expired, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expired link = %d", rec.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestRouteTimeoutAndBodyLimit(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{
+		{Hostname: "hook.test", Target: "127.0.0.1:3000", Timeout: "50ms", MaxBodyBytes: 8},
+		{Hostname: "upload.test", Target: "127.0.0.1:3001"},
+	}
+	echoed := make(chan string, 4)
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		echoed <- env.Timeout
+		if env.Hostname == "hook.test" && env.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return protocol.Envelope{Status: http.StatusOK}
+	})
+
+	do := func(host, path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://"+host+path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		ts.HandlePublicHTTP(rec, req)
+		return rec.Code
+	}
+	if code := do("hook.test", "/", "small"); code != http.StatusOK {
+		t.Fatalf("small body = %d", code)
+	}
+	if got := <-echoed; got != "50ms" {
+		t.Fatalf("agent saw timeout %q, want 50ms", got)
+	}
+	if code := do("hook.test", "/", "far too large"); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body = %d, want 413", code)
+	}
+	if code := do("upload.test", "/", "far too large"); code != http.StatusOK {
+		t.Fatalf("large body on a route without a limit = %d", code)
+	}
+	if got := <-echoed; got != "" {
+		t.Fatalf("route without timeout echoed %q", got)
+	}
+	start := time.Now()
+	if code := do("hook.test", "/slow", ""); code != http.StatusGatewayTimeout {
+		t.Fatalf("slow request = %d, want 504", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("route timeout took %s", elapsed)
+	}
+}
+
+func TestStreamedResponseUsesRouteTimeout(t *testing.T) {
+	ts := New(Options{RequestTimeout: 100 * time.Millisecond})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+protocol.CapStream, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatalf("read session envelope: %v", err)
+	}
+	routes := []protocol.Route{{Hostname: "slow.test", Target: "127.0.0.1:3000", Timeout: "2s"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("slow.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("route not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	go func() {
+		var env protocol.Envelope
+		for env.Type != protocol.TypeProxyRequest {
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+		}
+		send := func(e protocol.Envelope) {
+			e.RequestID = env.RequestID
+			frame, _ := protocol.EncodeJSON(e)
+			_ = conn.WriteMessage(websocket.TextMessage, frame)
+		}
+		send(protocol.Envelope{Type: protocol.TypeProxyResponse, Status: http.StatusOK, Stream: true,
+			Headers: map[string][]string{"Content-Type": {"application/octet-stream"}}})
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, Payload: []byte("first,")})
+		// Pause past -request-timeout but well inside the route's own timeout.
+		time.Sleep(300 * time.Millisecond)
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, Payload: []byte("second")})
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, End: true})
+	}()
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	req, _ := http.NewRequest(http.MethodGet, public.URL+"/download", nil)
+	req.Host = "slow.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "first,second" {
+		t.Fatalf("body = %q, err = %v", body, err)
+	}
+}
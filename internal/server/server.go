@@ -1,13 +1,15 @@
 package server
 
 import (
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,37 +18,222 @@ import (
 
 	"github.com/gorilla/websocket"
 
+	"tunneling/internal/metrics"
+	"tunneling/internal/muxconn"
 	"tunneling/internal/protocol"
+	"tunneling/internal/tracing"
+	"tunneling/internal/version"
+	"tunneling/internal/wsconn"
 )
 
+// maxBodySize caps bodies that have to be buffered, i.e. when the agent does
+// not support streaming.
 const maxBodySize = 10 << 20 // 10MB
 
+const DefaultResumeWindow = 15 * time.Second
+
+// yamuxAcceptTimeout bounds the wait for a yamux agent's control stream.
+const yamuxAcceptTimeout = 10 * time.Second
+
+type Options struct {
+	RequestTimeout time.Duration
+
+	// SessionSecret signs the resume tokens handed to agents. Keep it stable
+	// across deploys so reconnecting agents are recognised after a restart.
+	SessionSecret []byte
+	// ResumeWindow is how long routes of a disconnected agent (and unknown
+	// hosts right after startup) answer 503 with Retry-After instead of 404.
+	ResumeWindow time.Duration
+
+	// WriteQueueSize bounds the outbound envelopes buffered per agent session.
+	WriteQueueSize int
+	// PingInterval is how often agents are pinged; a session that stays
+	// silent for three intervals is dropped. Zero disables keepalive.
+	PingInterval time.Duration
+
+	// MaxInFlightPerSession caps the requests one agent session handles at a
+	// time; the excess gets 429. MaxInFlight caps the whole server, answering
+	// 503 beyond it. Zero means no limit.
+	MaxInFlightPerSession int
+	MaxInFlight           int
+
+	// SessionPolicy is SessionPolicyReplace (default) or SessionPolicyBalance;
+	// Balance picks the session for a request under the latter.
+	SessionPolicy string
+	Balance       string
+	// AffinityCookie, if set, names a cookie that pins a browser to the
+	// agent session that first served it, for as long as that session stays
+	// connected.
+	AffinityCookie string
+
+	// TokenValidator, if set, must accept an agent's credentials before its
+	// websocket is upgraded.
+	TokenValidator TokenValidator
+	// HostnameAuthorizer, if set, filters every route registration down to
+	// the hostnames the agent's tunnel owns.
+	HostnameAuthorizer HostnameAuthorizer
+
+	// RateLimit applies to every hostname whose route carries no limit of
+	// its own; nil disables it.
+	RateLimit *protocol.RateLimit
+	// AccessLog, if set, receives one JSON line per public request.
+	AccessLog io.Writer
+	// Tracer, if set, records a span per public request and passes its
+	// traceparent on to the agent.
+	Tracer *tracing.Tracer
+
+	Limits Limits
+
+	// Cluster, if set, shares hostnames with peer servers and forwards
+	// requests for hostnames whose agent is connected to another node.
+	Cluster *ClusterOptions
+
+	// ReservedHostnames are never bound, whoever registers them. Localhost
+	// and IP literals are refused even when it is nil.
+	ReservedHostnames *protocol.ReservedHostnames
+
+	// BreakerFailures trips a hostname's circuit for BreakerCooldown after
+	// that many agent timeouts in a row; zero disables the breaker.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// OfflinePage is shown to browsers when a routed hostname cannot be
+	// served (see ParseOfflinePage); nil uses the built-in page.
+	// OfflineRefresh makes it reload itself.
+	OfflinePage    *template.Template
+	OfflineRefresh time.Duration
+
+	// HoldQueueDepth requests per hostname may wait up to HoldQueueWait
+	// for a briefly disconnected agent to come back instead of getting
+	// 503 at once; zero for either disables holding.
+	HoldQueueDepth int
+	HoldQueueWait  time.Duration
+
+	// CompressMinBytes gzips inline request bodies of at least that size
+	// for agents with the compress capability; zero sends them as they are.
+	// Compressed responses are accepted either way.
+	CompressMinBytes int
+
+	// TrustedProxies are the upstreams whose X-Forwarded-For names the
+	// real client. Forwarding headers from any other peer are dropped and
+	// the peer itself is the client.
+	TrustedProxies []netip.Prefix
+	// CloudflareProxies are Cloudflare's edge addresses. CF-Connecting-IP
+	// is only believed when the request came through one of them.
+	CloudflareProxies []netip.Prefix
+
+	// OIDC signs browsers in for routes whose auth has a login policy.
+	OIDC *OIDCOptions
+
+	// After ConnectFailures rejected agent logins from one client IP, or
+	// with one tunnel id and token, /connect refuses that IP or credential
+	// for ConnectLockout, doubling with each further failure up to
+	// ConnectLockoutMax. Zero ConnectFailures disables the lockout.
+	ConnectFailures   int
+	ConnectLockout    time.Duration
+	ConnectLockoutMax time.Duration
+
+	// CacheMaxBytes is the memory shared by the response caches of routes
+	// that have one; zero disables caching.
+	CacheMaxBytes int64
+
+	// EdgeCompressMinBytes compresses responses of at least that size to
+	// public clients that accept brotli or gzip, when the agent sent them uncompressed and
+	// their content type is in EdgeCompressTypes (see
+	// DefaultEdgeCompressTypes); zero disables it.
+	EdgeCompressMinBytes int
+	EdgeCompressTypes    []string
+
+	// SlowRequest logs every request handed to an agent that takes at least
+	// this long, with where the time went; zero disables the log.
+	SlowRequest time.Duration
+}
+
 type routeBinding struct {
 	Token  string
 	Target string
+	Route  protocol.Route
 }
 
 type AgentSession struct {
+	ID    string
 	Token string
-	Conn  *websocket.Conn
+	// TunnelID is the control-plane tunnel the agent claimed at connect
+	// time; empty for agents that do not send one.
+	TunnelID string
+	Conn     wsconn.Conn
+	Resumed  bool
+
+	RemoteAddr  string
+	ConnectedAt time.Time
 
-	writeMu   sync.Mutex
+	// helloMu guards what was negotiated with the agent: the capabilities
+	// from the caps query parameter, replaced by those of its hello, and the
+	// versions the hello announced (zero for agents that send none).
+	helloMu         sync.RWMutex
+	caps            []string
+	protocolVersion int
+	agentVersion    string
+	agent           *protocol.AgentMeta
+
+	writer    *wsconn.Writer
+	inFlight  atomic.Int64
 	pendingMu sync.Mutex
 	pending   map[string]chan protocol.Envelope
+	streams   map[string]*sessionStream
+
+	// unhealthy holds the hostnames the agent reported in its last
+	// route_health.
+	healthMu  sync.RWMutex
+	unhealthy map[string]bool
+
+	// draining is set once the agent announced it is shutting down; it
+	// gets no new requests.
+	draining atomic.Bool
 }
 
-func newAgentSession(token string, conn *websocket.Conn) *AgentSession {
+func newAgentSession(id, token string, conn wsconn.Conn, resumed bool, queueSize int) *AgentSession {
 	return &AgentSession{
+		ID:      id,
 		Token:   token,
 		Conn:    conn,
+		Resumed: resumed,
+		writer:  wsconn.NewWriter(conn, queueSize, wsconn.DefaultWriteTimeout),
 		pending: make(map[string]chan protocol.Envelope),
+		streams: make(map[string]*sessionStream),
 	}
 }
 
+// HasCap reports whether the agent negotiated capability c.
+func (s *AgentSession) HasCap(c string) bool {
+	s.helloMu.RLock()
+	defer s.helloMu.RUnlock()
+	return protocol.HasCap(s.caps, c)
+}
+
+func (s *AgentSession) Caps() []string {
+	s.helloMu.RLock()
+	defer s.helloMu.RUnlock()
+	return append([]string(nil), s.caps...)
+}
+
+// Versions returns the protocol and agent versions from the hello.
+func (s *AgentSession) Versions() (int, string) {
+	s.helloMu.RLock()
+	defer s.helloMu.RUnlock()
+	return s.protocolVersion, s.agentVersion
+}
+
+func (s *AgentSession) setCaps(caps []string) {
+	s.helloMu.Lock()
+	s.caps = caps
+	s.helloMu.Unlock()
+	s.writer.SetBinary(protocol.HasCap(caps, protocol.CapBinary))
+}
+
+// Write queues env for the session's writer goroutine. It never blocks: a
+// full queue means the agent is not keeping up and the envelope is dropped.
 func (s *AgentSession) Write(env protocol.Envelope) error {
-	s.writeMu.Lock()
-	defer s.writeMu.Unlock()
-	return s.Conn.WriteJSON(env)
+	return s.writer.Send(env, 0)
 }
 
 func (s *AgentSession) AddPending(requestID string, ch chan protocol.Envelope) {
@@ -65,81 +252,477 @@ func (s *AgentSession) PopPending(requestID string) (chan protocol.Envelope, boo
 	return ch, ok
 }
 
+// RemovePending forgets requestID once its handler is done and releases
+// the request's stream on multiplexed transports.
 func (s *AgentSession) RemovePending(requestID string) {
 	s.pendingMu.Lock()
-	defer s.pendingMu.Unlock()
 	delete(s.pending, requestID)
+	s.pendingMu.Unlock()
+	s.writer.Release(requestID)
+}
+
+// FailPending answers every in-flight request of the session with an error
+// envelope so public clients are released immediately instead of timing out.
+func (s *AgentSession) FailPending(msg string) {
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]chan protocol.Envelope)
+	streams := s.streams
+	s.streams = make(map[string]*sessionStream)
+	s.pendingMu.Unlock()
+
+	for _, st := range streams {
+		st.inbound.Abort(errors.New(msg))
+	}
+
+	for requestID, ch := range pending {
+		select {
+		case ch <- protocol.Envelope{Type: protocol.TypeError, RequestID: requestID, Message: msg}:
+		default:
+		}
+	}
 }
 
 type TunnelServer struct {
 	upgrader websocket.Upgrader
 
 	agentsMu sync.RWMutex
-	agents   map[string]*AgentSession
+	agents   map[string][]*AgentSession
+
+	routesMu      sync.RWMutex
+	routes        map[string]*hostRoute
+	routeVersions map[string]string
 
-	routesMu sync.RWMutex
-	routes   map[string]routeBinding
+	sessionPolicy  string
+	balance        string
+	affinityCookie string
 
-	requestSeq     atomic.Uint64
-	requestTimeout time.Duration
+	requestSeq      atomic.Uint64
+	requestTimeout  time.Duration
+	slowRequest     time.Duration
+	mirrorsInFlight atomic.Int64
+
+	sessionSecret  []byte
+	resumeWindow   time.Duration
+	startedAt      time.Time
+	writeQueueSize int
+	pingInterval   time.Duration
+	maxSessionIn   int
+	maxInFlight    int
+	inFlight       atomic.Int64
+	limits         Limits
+	validator      TokenValidator
+	hostAuthorizer HostnameAuthorizer
+	reserved       *protocol.ReservedHostnames
+	breaker        *breaker
+	lockout        *connectLockout
+	hold           *holdQueue
+	compressMin    int
+	trustedProxies []netip.Prefix
+	cfProxies      []netip.Prefix
+	offlinePage    *template.Template
+	offlineRefresh time.Duration
+	rateLimit      *protocol.RateLimit
+	limiter        *rateLimiter
+	basicAuth      basicAuthCache
+	oidc           *oidcGate
+	jwks           jwksCache
+	accessLog      *accessLogger
+	tracer         *tracing.Tracer
+	usage          *usageMeter
+	cluster        *cluster
+	gateway        gatewayTable
+	wakes          *waker
+	agentReports   *agentReporter
+	cache          *responseCache
+	edgeCompress   *edgeCompressor
+
+	middlewareMu sync.RWMutex
+	middlewares  []Middleware
+
+	metrics           *metrics.Registry
+	writeQueueDropped *metrics.CounterVec
+	rejectedRequests  *metrics.CounterVec
+	rejectedAgents    *metrics.CounterVec
+	agentLockouts     *metrics.CounterVec
+	queryTokenAgents  *metrics.CounterVec
+	canceledRequests  *metrics.CounterVec
+	keepaliveTimeouts *metrics.CounterVec
+	clusterForwarded  *metrics.CounterVec
+	cacheLookups      *metrics.CounterVec
+	mirroredRequests  *metrics.CounterVec
+	slowRequests      *metrics.CounterVec
+	requestDuration   *metrics.HistogramVec
+	localDuration     *metrics.HistogramVec
+	localResponses    *metrics.CounterVec
 }
 
-func New(requestTimeout time.Duration) *TunnelServer {
-	return &TunnelServer{
+func New(opts Options) *TunnelServer {
+	secret := opts.SessionSecret
+	if len(secret) == 0 {
+		secret = []byte(newSessionID() + newSessionID())
+	}
+	resumeWindow := opts.ResumeWindow
+	if resumeWindow < 0 {
+		resumeWindow = 0
+	}
+	policy, err := ParseSessionPolicy(opts.SessionPolicy)
+	if err != nil {
+		policy = SessionPolicyReplace
+	}
+	balance, err := ParseBalance(opts.Balance)
+	if err != nil {
+		balance = BalanceRoundRobin
+	}
+	s := &TunnelServer{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(_ *http.Request) bool { return true },
 		},
-		agents:         make(map[string]*AgentSession),
-		routes:         make(map[string]routeBinding),
-		requestTimeout: requestTimeout,
+		agents:         make(map[string][]*AgentSession),
+		routes:         make(map[string]*hostRoute),
+		routeVersions:  make(map[string]string),
+		sessionPolicy:  policy,
+		balance:        balance,
+		affinityCookie: strings.TrimSpace(opts.AffinityCookie),
+		requestTimeout: opts.RequestTimeout,
+		sessionSecret:  secret,
+		resumeWindow:   resumeWindow,
+		startedAt:      time.Now(),
+		writeQueueSize: opts.WriteQueueSize,
+		pingInterval:   opts.PingInterval,
+		maxSessionIn:   opts.MaxInFlightPerSession,
+		maxInFlight:    opts.MaxInFlight,
+		limits:         opts.Limits.withDefaults(),
+		validator:      opts.TokenValidator,
+		hostAuthorizer: opts.HostnameAuthorizer,
+		reserved:       opts.ReservedHostnames,
+		breaker:        newBreaker(opts.BreakerFailures, opts.BreakerCooldown),
+		lockout:        newConnectLockout(opts.ConnectFailures, opts.ConnectLockout, opts.ConnectLockoutMax),
+		hold:           newHoldQueue(opts.HoldQueueDepth, opts.HoldQueueWait),
+		compressMin:    opts.CompressMinBytes,
+		trustedProxies: opts.TrustedProxies,
+		cfProxies:      opts.CloudflareProxies,
+		offlinePage:    opts.OfflinePage,
+		offlineRefresh: opts.OfflineRefresh,
+		rateLimit:      opts.RateLimit,
+		limiter:        newRateLimiter(),
+		oidc:           newOIDCGate(opts.OIDC, secret),
+		accessLog:      newAccessLogger(opts.AccessLog),
+		tracer:         opts.Tracer,
+		usage:          newUsageMeter(),
+		wakes:          newWaker(),
+		agentReports:   newAgentReporter(opts.TokenValidator != nil),
+		cache:          newResponseCache(opts.CacheMaxBytes),
+		edgeCompress:   newEdgeCompressor(opts.EdgeCompressMinBytes, opts.EdgeCompressTypes),
+		slowRequest:    opts.SlowRequest,
+		metrics:        metrics.NewRegistry(),
+	}
+	if s.offlinePage == nil {
+		s.offlinePage, _ = ParseOfflinePage("")
 	}
+	if opts.Cluster != nil {
+		s.cluster = newCluster(*opts.Cluster)
+	}
+	s.registerMetrics()
+	return s
+}
+
+func (s *TunnelServer) registerMetrics() {
+	s.metrics.NewGaugeFunc("tunnel_agent_sessions", "Connected agent sessions.", func() float64 {
+		return float64(len(s.allSessions()))
+	})
+	s.metrics.NewGaugeFunc("tunnel_routes", "Hostnames in the routing table.", func() float64 {
+		s.routesMu.RLock()
+		defer s.routesMu.RUnlock()
+		return float64(len(s.routes))
+	})
+	s.metrics.NewGaugeFunc("tunnel_write_queue_depth", "Envelopes waiting in agent session write queues.", func() float64 {
+		depth, _ := s.writeQueueStats()
+		return float64(depth)
+	})
+	s.metrics.NewGaugeFunc("tunnel_inflight_requests", "Public requests currently waiting on an agent.", func() float64 {
+		return float64(s.inFlight.Load())
+	})
+	s.metrics.NewGaugeFunc("tunnel_held_requests", "Public requests parked waiting for a reconnecting agent.", func() float64 {
+		return float64(s.hold.held())
+	})
+	s.writeQueueDropped = s.metrics.NewCounter("tunnel_write_queue_dropped_total", "Envelopes dropped because an agent session write queue was full.", "type")
+	s.rejectedRequests = s.metrics.NewCounter("tunnel_rejected_requests_total", "Public requests refused by gateway limits before tunneling.", "reason")
+	s.rejectedAgents = s.metrics.NewCounter("tunnel_rejected_agents_total", "Agent connections refused, by reason.", "reason")
+	s.queryTokenAgents = s.metrics.NewCounter("tunnel_agent_query_token_total", "Agent connections that sent their token in the deprecated ?token= query parameter.")
+	s.agentLockouts = s.metrics.NewCounter("tunnel_agent_lockouts_total", "Agent login lockouts started after repeated credential failures, by scope.", "scope")
+	s.canceledRequests = s.metrics.NewCounter("tunnel_canceled_requests_total", "Tunneled requests the agent was told to abandon.", "reason")
+	s.keepaliveTimeouts = s.metrics.NewCounter("tunnel_agent_keepalive_timeouts_total", "Agent sessions dropped because they stopped answering pings.")
+	s.clusterForwarded = s.metrics.NewCounter("tunnel_cluster_forwarded_requests_total", "Public requests forwarded to the cluster peer holding the agent.")
+	s.cacheLookups = s.metrics.NewCounter("tunnel_cache_lookups_total", "Gateway cache lookups for routes with a cache, by result.", "result")
+	s.slowRequests = s.metrics.NewCounter("tunnel_slow_requests_total", "Requests that took longer than the slow request threshold.")
+	s.requestDuration = s.metrics.NewHistogram("tunnel_request_duration_seconds", "Time to serve public requests handed to an agent, by hostname.", nil, "hostname")
+	s.localDuration = s.metrics.NewHistogram("tunnel_local_duration_seconds", "Time agents report spending on public requests, local service included, by hostname.", nil, "hostname")
+	s.localResponses = s.metrics.NewCounter("tunnel_local_responses_total", "Responses agents got from local services, by status class; error when the local service could not be reached.", "class")
+	s.mirroredRequests = s.metrics.NewCounter("tunnel_mirrored_requests_total", "Copies of requests sent to route mirror targets, or dropped with too many in flight.", "result")
+	s.metrics.NewGaugeFunc("tunnel_cluster_peers", "Cluster peers heard from recently.", func() float64 {
+		live := 0
+		for _, n := range s.ClusterNodes() {
+			if n.Live {
+				live++
+			}
+		}
+		return float64(live)
+	})
+}
+
+// Metrics exposes the server's metrics registry, e.g. for a /metrics handler.
+func (s *TunnelServer) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+func (s *TunnelServer) allSessions() []*AgentSession {
+	s.agentsMu.RLock()
+	defer s.agentsMu.RUnlock()
+	var out []*AgentSession
+	for _, sessions := range s.agents {
+		out = append(out, sessions...)
+	}
+	return out
+}
+
+func (s *TunnelServer) writeQueueStats() (int, uint64) {
+	depth := 0
+	var dropped uint64
+	for _, session := range s.allSessions() {
+		depth += session.writer.Depth()
+		dropped += session.writer.Dropped()
+	}
+	return depth, dropped
+}
+
+func (s *TunnelServer) write(session *AgentSession, env protocol.Envelope) error {
+	err := session.Write(env)
+	if errors.Is(err, wsconn.ErrQueueFull) {
+		s.writeQueueDropped.Inc(env.Type)
+	}
+	return err
 }
 
 func (s *TunnelServer) HandleConnect(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimSpace(r.URL.Query().Get("token"))
-	if token == "" {
-		http.Error(w, "missing token", http.StatusBadRequest)
+	token, sessionID, resumed, ok := s.authorizeAgent(w, r)
+	if !ok {
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	var respHeader http.Header
+	useYamux := r.URL.Query().Get("transport") == muxconn.TransportYamux
+	if useYamux {
+		respHeader = http.Header{muxconn.TransportHeader: {muxconn.TransportYamux}}
+	}
+	ws, err := s.upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
-		log.Printf("upgrade failed: %v", err)
+		slog.Warn("upgrade failed", "remote", r.RemoteAddr, "err", err)
 		return
 	}
+	var conn wsconn.Conn = ws
+	if useYamux {
+		mc, err := muxconn.ServeYamux(ws, yamuxAcceptTimeout)
+		if err != nil {
+			slog.Warn("start yamux session failed", "token", tokenHint(token), "remote", r.RemoteAddr, "err", err)
+			_ = ws.Close()
+			return
+		}
+		conn = mc
+	}
+	s.serveAgent(conn, r, token, sessionID, resumed)
+}
+
+// authorizeAgent checks the credentials of a connect request r and settles
+// the session it resumes or starts. When the agent is turned away it
+// answers on w and returns false.
+func (s *TunnelServer) authorizeAgent(w http.ResponseWriter, r *http.Request) (token, sessionID string, resumed, ok bool) {
+	token, fromQuery := agentToken(r)
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return "", "", false, false
+	}
+	if fromQuery {
+		s.queryTokenAgents.Inc()
+		slog.Warn("agent sent its token in the url, which is deprecated; upgrade the agent", "token", tokenHint(token), "remote", r.RemoteAddr)
+	}
+	if s.validator != nil {
+		tunnelID := strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
+		ipKey, credKey := lockoutScopeIP+":"+s.clientIP(r), lockoutScopeKey+":"+credentialLockoutKey(tunnelID, token)
+		if wait := s.lockout.locked(time.Now(), ipKey, credKey); wait > 0 {
+			s.rejectedAgents.Inc("locked out")
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			return "", "", false, false
+		}
+		if err := s.validator.ValidateAgent(r.Context(), token, tunnelID); err != nil {
+			if errors.Is(err, ErrAgentUnauthorized) {
+				s.rejectedAgents.Inc("unauthorized")
+				slog.Warn("reject agent", "token", tokenHint(token), "tunnel_id", tunnelID, "remote", r.RemoteAddr, "err", err)
+				s.connectFailed(ipKey, credKey, token, tunnelID)
+				http.Error(w, "invalid agent credentials", http.StatusUnauthorized)
+				return "", "", false, false
+			}
+			s.rejectedAgents.Inc("validator error")
+			slog.Warn("agent validation failed", "token", tokenHint(token), "tunnel_id", tunnelID, "err", err)
+			s.writeRetryLater(w, "agent validation unavailable")
+			return "", "", false, false
+		}
+		s.lockout.reset(credKey)
+	}
+
+	sessionID = newSessionID()
+	if raw := strings.TrimSpace(r.URL.Query().Get("resume")); raw != "" {
+		claims, err := verifyResumeToken(s.sessionSecret, raw, token, time.Now())
+		if err != nil {
+			slog.Warn("ignore resume token", "token", tokenHint(token), "err", err)
+		} else {
+			sessionID = claims.SessionID
+			resumed = true
+		}
+	}
+	return token, sessionID, resumed, true
+}
+
+// serveAgent runs the session of an authorized agent on conn until it
+// disconnects.
+func (s *TunnelServer) serveAgent(conn wsconn.Conn, r *http.Request, token, sessionID string, resumed bool) {
 	conn.SetReadLimit(maxBodySize + (2 << 20))
 
-	session := newAgentSession(token, conn)
-	previous := s.swapAgent(token, session)
-	if previous != nil {
-		_ = previous.Conn.Close()
+	session := newAgentSession(sessionID, token, conn, resumed, s.writeQueueSize)
+	session.TunnelID = strings.TrimSpace(r.URL.Query().Get("tunnel_id"))
+	session.RemoteAddr = r.RemoteAddr
+	session.ConnectedAt = time.Now()
+	session.setCaps(protocol.IntersectCaps(protocol.ParseCaps(r.URL.Query().Get("caps")), protocol.SupportedCaps))
+	wsconn.Keepalive(conn, s.pingInterval, session.writer.Done())
+	for _, displaced := range s.addAgent(session) {
+		_ = displaced.Conn.Close()
 	}
+	s.routesChanged()
 
-	log.Printf("agent connected token=%s remote=%s", token, r.RemoteAddr)
+	if resumed {
+		slog.Info("agent resumed", "token", tokenHint(token), "tunnel_id", session.TunnelID, "session_id", sessionID, "remote", r.RemoteAddr)
+	} else {
+		slog.Info("agent connected", "token", tokenHint(token), "tunnel_id", session.TunnelID, "session_id", sessionID, "remote", r.RemoteAddr)
+	}
+
+	if err := s.sendSessionToken(session); err != nil {
+		slog.Warn("send session token failed", "token", tokenHint(token), "err", err)
+	}
 
 	s.readLoop(session)
 }
 
+// connectFailed counts a rejected agent login against its IP and
+// credential and reports the lockouts it starts.
+func (s *TunnelServer) connectFailed(ipKey, credKey, token, tunnelID string) {
+	now := time.Now()
+	for _, key := range []string{ipKey, credKey} {
+		d, failures := s.lockout.fail(now, key)
+		if d <= 0 {
+			continue
+		}
+		scope, subject, _ := strings.Cut(key, ":")
+		s.agentLockouts.Inc(scope)
+		attrs := []any{"event", "agent.connect.locked_out", "scope", scope, "failures", failures, "lockout", d}
+		if scope == lockoutScopeKey {
+			attrs = append(attrs, "token", tokenHint(token), "tunnel_id", tunnelID)
+		} else {
+			attrs = append(attrs, "ip", subject)
+		}
+		slog.Warn("agent connect locked out", attrs...)
+	}
+}
+
+func (s *TunnelServer) sendSessionToken(session *AgentSession) error {
+	resumeToken, err := issueResumeToken(s.sessionSecret, session.ID, session.Token, time.Now())
+	if err != nil {
+		return err
+	}
+	return s.write(session, protocol.Envelope{
+		Type:         protocol.TypeSession,
+		SessionID:    session.ID,
+		SessionToken: resumeToken,
+		Caps:         session.Caps(),
+	})
+}
+
+// handleHello settles the protocol version and capabilities with the agent.
+// It returns false when the agent is too old and has been disconnected.
+func (s *TunnelServer) handleHello(session *AgentSession, env protocol.Envelope) bool {
+	if env.ProtocolVersion < protocol.MinProtocolVersion {
+		msg := fmt.Sprintf("agent protocol %d is older than the minimum %d, please upgrade the agent", env.ProtocolVersion, protocol.MinProtocolVersion)
+		slog.Warn("rejecting agent", "token", tokenHint(session.Token), "session_id", session.ID, "version", env.Version, "reason", msg)
+		s.rejectedAgents.Inc("protocol too old")
+		_ = session.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, msg), time.Now().Add(time.Second))
+		return false
+	}
+	negotiated := min(env.ProtocolVersion, protocol.ProtocolVersion)
+	caps := protocol.IntersectCaps(env.Caps, protocol.SupportedCaps)
+	session.helloMu.Lock()
+	session.protocolVersion = negotiated
+	session.agentVersion = env.Version
+	session.agent = helloAgentMeta(env)
+	session.helloMu.Unlock()
+	s.agentReports.add(session)
+	session.setCaps(caps)
+	slog.Info("agent hello", "token", tokenHint(session.Token), "session_id", session.ID, "protocol", negotiated, "version", env.Version, "caps", caps)
+
+	if err := s.write(session, protocol.Envelope{
+		Type:            protocol.TypeHello,
+		ProtocolVersion: negotiated,
+		Version:         version.Version,
+		Caps:            caps,
+	}); err != nil {
+		slog.Warn("send hello failed", "token", tokenHint(session.Token), "err", err)
+	}
+	return true
+}
+
 func (s *TunnelServer) readLoop(session *AgentSession) {
 	defer func() {
+		session.writer.Close()
 		s.cleanupAgent(session)
 		_ = session.Conn.Close()
-		log.Printf("agent disconnected token=%s", session.Token)
+		slog.Info("agent disconnected", "token", tokenHint(session.Token), "session_id", session.ID)
 	}()
 
 	for {
-		var env protocol.Envelope
-		if err := session.Conn.ReadJSON(&env); err != nil {
+		env, err := wsconn.ReadEnvelope(session.Conn)
+		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) || errors.Is(err, io.EOF) {
 				return
 			}
-			log.Printf("read agent message failed token=%s err=%v", session.Token, err)
+			if wsconn.IsKeepaliveTimeout(err) {
+				slog.Warn("agent stopped answering pings", "token", tokenHint(session.Token), "session_id", session.ID)
+				s.keepaliveTimeouts.Inc()
+				return
+			}
+			slog.Warn("read agent message failed", "token", tokenHint(session.Token), "err", err)
 			return
 		}
 
 		switch env.Type {
+		case protocol.TypeHello:
+			if !s.handleHello(session, env) {
+				return
+			}
 		case protocol.TypeRegisterRoutes:
-			s.applyRoutes(session.Token, env.Routes)
+			s.applyRoutes(session.Token, s.authorizedRoutes(session, env.Routes), env.RoutesVersion)
+		case protocol.TypeRouteDelta:
+			env.Routes = s.authorizedRoutes(session, env.Routes)
+			if !s.applyRouteDelta(session.Token, env) {
+				if err := s.write(session, protocol.Envelope{Type: protocol.TypeRouteResync, RoutesVersion: s.routesVersion(session.Token)}); err != nil {
+					slog.Warn("request route resync failed", "token", tokenHint(session.Token), "err", err)
+				}
+			}
+		case protocol.TypeDraining:
+			session.draining.Store(true)
+			slog.Info("agent draining", "token", tokenHint(session.Token), "session_id", session.ID, "in_flight", session.inFlight.Load())
+		case protocol.TypeRouteHealth:
+			session.setUnhealthy(env.UnhealthyHosts)
+			slog.Info("agent route health", "token", tokenHint(session.Token), "session_id", session.ID, "unhealthy", env.UnhealthyHosts)
 		case protocol.TypeProxyResponse:
 			if env.RequestID == "" {
 				continue
@@ -147,152 +730,660 @@ func (s *TunnelServer) readLoop(session *AgentSession) {
 			if ch, ok := session.PopPending(env.RequestID); ok {
 				ch <- env
 			}
+		case protocol.TypeProxyInterim:
+			if st := session.stream(env.RequestID); st != nil {
+				select {
+				case st.interim <- env:
+				default:
+					slog.Debug("dropping interim response", "token", tokenHint(session.Token), "request_id", env.RequestID, "status", env.Status)
+				}
+			}
+		case protocol.TypeProxyResponseData:
+			if st := session.stream(env.RequestID); st != nil && !st.inbound.Push(env) {
+				slog.Warn("agent overran stream window", "token", tokenHint(session.Token), "request_id", env.RequestID)
+				st.inbound.Abort(errors.New("stream window exceeded"))
+			}
+		case protocol.TypeProxyWindow:
+			if st := session.stream(env.RequestID); st != nil {
+				st.credit.Release()
+			}
 		case protocol.TypeError:
-			log.Printf("agent error token=%s msg=%s", session.Token, env.Message)
+			slog.Warn("agent error", "token", tokenHint(session.Token), "message", env.Message)
 		default:
-			log.Printf("unknown agent message token=%s type=%s", session.Token, env.Type)
+			slog.Warn("unknown agent message", "token", tokenHint(session.Token), "type", env.Type)
 		}
 	}
 }
 
 func (s *TunnelServer) cleanupAgent(session *AgentSession) {
-	shouldClearRoutes := false
+	session.FailPending("tunnel disconnected")
+	defer s.routesChanged()
 
-	s.agentsMu.Lock()
-	current, ok := s.agents[session.Token]
-	if ok && current == session {
-		delete(s.agents, session.Token)
-		shouldClearRoutes = true
+	// Routes belong to the token; they only go once its last session does.
+	if removed, last := s.removeAgent(session); !removed || !last {
+		return
 	}
-	s.agentsMu.Unlock()
 
-	if !shouldClearRoutes {
+	if s.resumeWindow <= 0 {
+		s.clearRoutes(session.Token)
 		return
 	}
+	// Keep the routes detached for a short while so a reconnecting agent
+	// picks them up again and public clients see 503 + Retry-After meanwhile.
+	time.AfterFunc(s.resumeWindow, func() {
+		s.agentsMu.RLock()
+		back := len(s.agents[session.Token]) > 0
+		s.agentsMu.RUnlock()
+		if !back {
+			s.clearRoutes(session.Token)
+		}
+	})
+}
 
+func (s *TunnelServer) clearRoutes(token string) {
 	s.routesMu.Lock()
-	for host, binding := range s.routes {
-		if binding.Token == session.Token {
-			delete(s.routes, host)
-		}
+	defer s.routesMu.Unlock()
+	for host := range s.routes {
+		s.unbindRouteLocked(token, host)
 	}
-	s.routesMu.Unlock()
+	delete(s.routeVersions, token)
+	s.routesChanged()
 }
 
-func (s *TunnelServer) swapAgent(token string, next *AgentSession) *AgentSession {
-	s.agentsMu.Lock()
-	defer s.agentsMu.Unlock()
-	prev := s.agents[token]
-	s.agents[token] = next
-	return prev
+// Shutdown asks every connected agent to reconnect with a service-restart
+// close frame, so they come back quickly and resume against the next process.
+func (s *TunnelServer) Shutdown() {
+	sessions := s.allSessions()
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	for _, session := range sessions {
+		_ = session.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		session.FailPending("server restarting")
+	}
 }
 
-func (s *TunnelServer) applyRoutes(token string, routes []protocol.Route) {
+// applyRoutes binds the permitted part of an agent's full route set. The
+// version kept for the token is the agent's own (version), which covers the
+// routes the agent sent, not just the ones bound here, so its next delta
+// matches even when some of them were refused.
+func (s *TunnelServer) applyRoutes(token string, routes []protocol.Route, version string) {
 	s.routesMu.Lock()
 	defer s.routesMu.Unlock()
 
-	for host, binding := range s.routes {
-		if binding.Token == token {
-			delete(s.routes, host)
-		}
+	for host := range s.routes {
+		s.unbindRouteLocked(token, host)
 	}
 
 	for _, route := range routes {
-		host := normalizeHost(route.Hostname)
-		target := strings.TrimSpace(route.Target)
-		if host == "" || target == "" {
+		if route, ok := s.permitted(token, route); ok {
+			s.bindRouteLocked(token, route)
+		}
+	}
+	if version == "" {
+		version = protocol.RoutesVersion(s.tokenRoutesLocked(token))
+	}
+	s.routeVersions[token] = version
+	s.routesChanged()
+
+	slog.Info("routes updated", "token", tokenHint(token), "count", len(routes))
+}
+
+// applyRouteDelta applies an incremental route update. It returns false when
+// the agent's base version does not match what the server holds, in which
+// case the agent has to resend its full route set.
+func (s *TunnelServer) applyRouteDelta(token string, env protocol.Envelope) bool {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	if env.BaseVersion == "" || s.routeVersions[token] != env.BaseVersion {
+		slog.Warn("route delta rejected", "token", tokenHint(token), "base", env.BaseVersion, "current", s.routeVersions[token])
+		return false
+	}
+	for _, hostname := range env.RemovedHosts {
+		s.unbindRouteLocked(token, normalizeHost(hostname))
+	}
+	for _, route := range env.Routes {
+		if route, ok := s.permitted(token, route); ok {
+			s.bindRouteLocked(token, route)
+		}
+	}
+	version := env.RoutesVersion
+	if version == "" {
+		version = protocol.RoutesVersion(s.tokenRoutesLocked(token))
+	}
+	s.routeVersions[token] = version
+	s.routesChanged()
+
+	slog.Info("routes patched", "token", tokenHint(token), "added", len(env.Routes), "removed", len(env.RemovedHosts))
+	return true
+}
+
+// permitted reports whether route may be bound: reserved hostnames are
+// dropped whatever the agent or the control plane says. Invalid or reserved
+// aliases are dropped from the route returned.
+func (s *TunnelServer) permitted(token string, route protocol.Route) (protocol.Route, bool) {
+	host := normalizeHost(route.Hostname)
+	if err := s.reserved.Check(host); err != nil {
+		slog.Warn("dropped reserved route", "token", tokenHint(token), "err", err)
+		return route, false
+	}
+	var kept []string
+	for _, alias := range route.Aliases {
+		normalized, err := protocol.NormalizeAliases(host, []string{alias})
+		if err == nil && len(normalized) > 0 {
+			err = s.reserved.Check(normalized[0])
+		}
+		if err != nil {
+			slog.Warn("dropped route alias", "token", tokenHint(token), "hostname", host, "err", err)
 			continue
 		}
-		s.routes[host] = routeBinding{Token: token, Target: target}
+		kept = append(kept, normalized...)
 	}
+	aliases, err := protocol.NormalizeAliases(host, kept)
+	if err != nil {
+		slog.Warn("dropped route aliases", "token", tokenHint(token), "hostname", host, "err", err)
+	}
+	route.Aliases = aliases
+	return route, true
+}
 
-	log.Printf("routes updated token=%s count=%d", token, len(routes))
+func (s *TunnelServer) tokenRoutesLocked(token string) []protocol.Route {
+	var out []protocol.Route
+	for host, hr := range s.routes {
+		for _, binding := range hr.bindings {
+			// Alias entries repeat the route bound under its hostname.
+			if binding.Token == token && binding.Route.Hostname == host {
+				out = append(out, binding.Route)
+			}
+		}
+	}
+	return out
+}
+
+func (s *TunnelServer) routesVersion(token string) string {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	return s.routeVersions[token]
 }
 
 func (s *TunnelServer) HandlePublicHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := &accessEntry{start: time.Now(), RequestID: strconv.FormatUint(s.requestSeq.Add(1), 10), ClientIP: s.clientIP(r)}
+	rec := &accessRecorder{ResponseWriter: w}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	span := s.startSpan(r, entry)
+	s.servePublic(rec, r, entry)
+	endSpan(span, rec, entry)
+	// Only requests handed to an agent count as usage.
+	if entry.session != nil {
+		s.observeLatency(r, rec, entry)
+		s.usage.add(HostUsage{Hostname: normalizeHost(r.Host), TunnelID: entry.session.TunnelID, token: entry.token, Requests: 1, BytesIn: body.n, BytesOut: rec.bytes})
+	}
+	if s.accessLog != nil {
+		s.accessLog.record(r, rec, entry)
+	}
+}
+
+// admitRoute applies route's edge policies to r: the IP filter, the
+// route's credentials, the circuit breaker and the rate limit. It answers
+// the client itself and reports false when the request may not go on.
+func (s *TunnelServer) admitRoute(w http.ResponseWriter, r *http.Request, host string, route protocol.Route, clientIP string) bool {
+	// The CA validates from addresses of its own and without credentials.
+	challenge := acmeChallenge(route, r)
+	if !challenge && !route.IPFilter.Permits(clientIP) {
+		s.rejectedRequests.Inc("ip denied")
+		slog.Info("ip denied", "hostname", host, "client_ip", clientIP)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	if !challenge && !s.checkRouteAuth(w, r, host, route.Auth) {
+		return false
+	}
+	if wait := s.breaker.open(host); wait > 0 {
+		s.rejectedRequests.Inc("circuit open")
+		s.writeUnavailable(w, r, host, "tunnel not responding", int((wait+time.Second-1)/time.Second))
+		return false
+	}
+	return challenge || s.checkRateLimit(w, host, route, clientIP)
+}
+
+func (s *TunnelServer) servePublic(w http.ResponseWriter, r *http.Request, entry *accessEntry) {
 	host := normalizeHost(r.Host)
 	if host == "" {
 		http.Error(w, "invalid host", http.StatusBadRequest)
 		return
 	}
+	if s.oidc != nil && strings.HasPrefix(r.URL.Path, oidcPathPrefix) {
+		s.oidc.serve(w, r, host)
+		return
+	}
+	if v := s.limits.check(r); v != nil {
+		s.rejectedRequests.Inc(v.reason)
+		http.Error(w, v.reason, v.status)
+		return
+	}
+	if s.serveGatewayRoute(w, r, host) {
+		return
+	}
+	if !tryAcquire(&s.inFlight, s.maxInFlight) {
+		s.rejectedRequests.Inc("server in-flight limit")
+		writeBusy(w, http.StatusServiceUnavailable, "server busy")
+		return
+	}
+	defer s.inFlight.Add(-1)
 
-	s.routesMu.RLock()
-	binding, ok := s.routes[host]
-	s.routesMu.RUnlock()
+	pinned := s.affinityFrom(r)
+	binding, session, ok := s.pickSession(host, pinned)
 	if !ok {
+		binding, session, ok = s.disabledChallenge(r, host)
+	}
+	if (!ok || session == nil) && s.forwardToPeer(w, r, host) {
+		return
+	}
+	if session == nil && (ok || s.inStartupWindow()) {
+		// Park the request while the agent reconnects; whatever pickSession
+		// last said decides below when it does not make it in time.
+		if _, full := s.hold.hold(r.Context(), host, func() bool {
+			binding, session, ok = s.pickSession(host, pinned)
+			return session != nil
+		}); full {
+			s.rejectedRequests.Inc("hold queue full")
+		}
+	}
+	if !ok {
+		if s.serveWaking(w, r, host) {
+			return
+		}
+		if s.inStartupWindow() {
+			s.writeRetryLater(w, "tunnel reconnecting")
+			return
+		}
 		http.NotFound(w, r)
 		return
 	}
+	if !s.admitRoute(w, r, host, binding.Route, entry.ClientIP) {
+		return
+	}
+	streamBody := wantsStreaming(session, r)
+	maxBody := binding.Route.MaxBodyBytes
+	var body []byte
+	if !streamBody {
+		if body, ok = s.readBody(w, r, maxBody); !ok {
+			return
+		}
+	} else if maxBody > 0 {
+		if r.ContentLength > maxBody {
+			s.rejectedRequests.Inc("request body too large")
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
 
-	s.agentsMu.RLock()
-	session := s.agents[binding.Token]
-	s.agentsMu.RUnlock()
-	if session == nil {
-		http.Error(w, "tunnel offline", http.StatusServiceUnavailable)
+	headers := protocol.CloneHeaders(r.Header)
+	stripHopHeaders(headers)
+	appendXForwarded(headers, r, s.trusted(extractClientIP(r.RemoteAddr)))
+
+	target := splitTarget(w, r, binding.Route, binding.Target, entry.ClientIP)
+	req := &Request{
+		HTTP:     r,
+		ClientIP: entry.ClientIP,
+		Start:    entry.start,
+		Hostname: host,
+		Route:    binding.Route,
+		Target:   target,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Headers:  headers,
+		Body:     body,
+		Streamed: streamBody,
+	}
+	if !streamBody {
+		req.Trailers = presentTrailers(r.Trailer)
+	}
+	chain := s.middlewareChain()
+	if rej := runRequestHooks(chain, req); rej != nil {
+		rej.write(w)
+		return
+	}
+	if req.Hostname != host {
+		newHost := normalizeHost(req.Hostname)
+		rerouted, reroutedSession, ok := s.pickSession(newHost, pinned)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// The client has to pass the new route's policies as if it had
+		// asked for newHost itself.
+		if newHost != host {
+			if !s.admitRoute(w, r, newHost, rerouted.Route, entry.ClientIP) {
+				return
+			}
+			syncGatewayCredentials(req, r)
+		}
+		if req.Target == target {
+			req.Target = rerouted.Target
+		}
+		binding, session = rerouted, reroutedSession
+	}
+	if s.serveCached(w, r, req, binding.Route, chain) {
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
-	if err != nil {
-		http.Error(w, "read request failed", http.StatusBadRequest)
+	entry.token = binding.Token
+	if session == nil {
+		s.writeUnavailable(w, r, host, "tunnel offline", s.retryAfter())
 		return
 	}
+	if session.unhealthyHost(binding.Route.Hostname) {
+		s.rejectedRequests.Inc("local service unhealthy")
+		s.writeUnavailable(w, r, normalizeHost(req.Hostname), "local service unhealthy", 10)
+		return
+	}
+	entry.session = session
+	s.setAffinity(w, session, pinned)
+	if streamBody && !session.HasCap(protocol.CapStream) {
+		if req.Body, ok = s.readBody(w, r, maxBody); !ok {
+			return
+		}
+		req.Trailers = presentTrailers(r.Trailer)
+		streamBody = false
+	}
 
-	headers := protocol.CloneHeaders(r.Header)
-	stripHopHeaders(headers)
-	appendXForwarded(headers, r)
+	if !tryAcquire(&session.inFlight, s.maxSessionIn) {
+		s.rejectedRequests.Inc("tunnel in-flight limit")
+		writeBusy(w, http.StatusTooManyRequests, "tunnel busy")
+		return
+	}
+	defer session.inFlight.Add(-1)
 
-	requestID := strconv.FormatUint(s.requestSeq.Add(1), 10)
+	timeout := s.requestTimeout
+	if d := binding.Route.RequestTimeout(); d > 0 {
+		timeout = d
+	}
+	requestID := entry.RequestID
 	respCh := make(chan protocol.Envelope, 1)
 	session.AddPending(requestID, respCh)
 	defer session.RemovePending(requestID)
 
+	var st *sessionStream
+	if session.HasCap(protocol.CapStream) {
+		st = &sessionStream{
+			credit: wsconn.NewCredit(),
+			inbound: wsconn.NewInbound(timeout, func() {
+				_ = session.writer.Send(protocol.Envelope{Type: protocol.TypeProxyWindow, RequestID: requestID}, timeout)
+			}),
+			interim: make(chan protocol.Envelope, 4),
+		}
+		session.openStream(requestID, st)
+		defer session.closeStream(requestID)
+	}
+
 	env := protocol.Envelope{
-		Type:      protocol.TypeProxyRequest,
-		RequestID: requestID,
-		Method:    r.Method,
-		Path:      r.URL.Path,
-		Query:     r.URL.RawQuery,
-		Headers:   headers,
-		Body:      base64.StdEncoding.EncodeToString(body),
-		Hostname:  host,
-		Target:    binding.Target,
-	}
-
-	if err := session.Write(env); err != nil {
+		Type:        protocol.TypeProxyRequest,
+		RequestID:   requestID,
+		Method:      req.Method,
+		Path:        req.Path,
+		Query:       req.Query,
+		Headers:     req.Headers,
+		Hostname:    req.Hostname,
+		Target:      req.Target,
+		Trailers:    req.Trailers,
+		Stream:      streamBody,
+		Timeout:     binding.Route.Timeout,
+		Rewrite:     binding.Route.Rewrite,
+		HeaderRules: binding.Route.HeaderRules,
+	}
+	if !streamBody {
+		env.Payload = req.Body
+		if s.compressMin > 0 && session.HasCap(protocol.CapCompress) {
+			protocol.CompressPayload(&env, s.compressMin)
+		}
+	}
+
+	if err := s.write(session, env); err != nil {
+		if errors.Is(err, wsconn.ErrQueueFull) {
+			s.writeRetryLater(w, "tunnel busy")
+			return
+		}
 		http.Error(w, "send to tunnel failed", http.StatusBadGateway)
 		return
 	}
+	entry.sent = time.Now()
+	s.mirror(session, binding.Route, env, timeout)
+	// Once the request is on the wire a client disconnect cancels it on the
+	// agent too; stopCancel runs before the handler's own context ends.
+	stopCancel := context.AfterFunc(r.Context(), func() { s.cancelOnAgent(session, requestID, "client gone") })
+	defer stopCancel()
+
+	var resp protocol.Envelope
+	answered := false
+	if streamBody && expectsContinue(r) && session.HasCap(protocol.CapInterim) {
+		early, err := s.awaitContinue(w, r, st, respCh, timeout)
+		if early != nil {
+			resp, answered = *early, true
+		} else if errors.Is(err, errContinueTimeout) {
+			s.cancelOnAgent(session, requestID, "timeout")
+			http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+			return
+		} else if err != nil {
+			return
+		}
+	}
+	if streamBody && !answered {
+		early, err := s.uploadBody(session, requestID, r, st.credit, respCh, timeout)
+		if early != nil {
+			resp, answered = *early, true
+		} else if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				s.rejectedRequests.Inc("request body too large")
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "send request body failed", http.StatusBadGateway)
+			return
+		}
+	}
+	var interim chan protocol.Envelope
+	if st != nil {
+		interim = st.interim
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for !answered {
+		select {
+		case resp = <-respCh:
+			answered = true
+		case env := <-interim:
+			writeInterim(w, env)
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			s.cancelOnAgent(session, requestID, "timeout")
+			if s.breaker.failure(host) {
+				slog.Warn("circuit opened", "hostname", host, "agent_timeouts", s.breaker.failures)
+			}
+			http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+			return
+		}
+	}
+	entry.answered, entry.timing = time.Now(), resp.Timing
+	s.breaker.success(host)
+	if err := protocol.DecompressPayload(&resp, maxBodySize); err != nil {
+		slog.Warn("bad tunnel response", "hostname", host, "request_id", requestID, "err", err)
+		http.Error(w, "bad tunnel response", http.StatusBadGateway)
+		return
+	}
+
+	if resp.Type == protocol.TypeError {
+		s.writeUnavailable(w, r, host, resp.Message, s.retryAfter())
+		return
+	}
+	if resp.Stream {
+		if st == nil {
+			http.Error(w, "unexpected streamed response", http.StatusBadGateway)
+			return
+		}
+		out := &Response{Status: resp.Status, Headers: resp.Headers, Streamed: true}
+		if out.Status == 0 {
+			out.Status = http.StatusBadGateway
+		}
+		runResponseHooks(chain, req, out)
+		if isEventStream(out.Headers) {
+			// Event streams may stay quiet far longer than any request
+			// timeout; they end with the client or the agent instead.
+			st.inbound.SetIdle(0)
+			stopAbort := context.AfterFunc(r.Context(), func() { st.inbound.Abort(context.Canceled) })
+			defer stopAbort()
+		}
+		gw, finish := s.edgeCompress.wrap(w, r, out)
+		writeStreamedResponse(gw, out, st.inbound)
+		finish()
+		return
+	}
+	out := decodeResponse(resp)
+	s.cacheResponse(r, req, binding.Route, out)
+	bodyLen := len(out.Body)
+	runResponseHooks(chain, req, out)
+	if len(out.Body) != bodyLen {
+		delete(out.Headers, "Content-Length")
+	}
+	s.edgeCompress.compress(r, out)
+	writeResponse(w, out)
+}
+
+// cancelOnAgent asks the agent to abandon requestID. It is best effort: the
+// pending response is discarded on our side either way.
+func (s *TunnelServer) cancelOnAgent(session *AgentSession, requestID, reason string) {
+	if !session.HasCap(protocol.CapCancel) {
+		return
+	}
+	s.canceledRequests.Inc(reason)
+	if err := s.write(session, protocol.Envelope{Type: protocol.TypeProxyCancel, RequestID: requestID}); err != nil {
+		slog.Warn("send proxy cancel failed", "token", tokenHint(session.Token), "request_id", requestID, "err", err)
+	}
+}
+
+// readBody buffers a request body that is sent inline in the envelope, up to
+// the route's own limit if it has a lower one than maxBodySize.
+func (s *TunnelServer) readBody(w http.ResponseWriter, r *http.Request, routeLimit int64) ([]byte, bool) {
+	limit := int64(maxBodySize)
+	if routeLimit > 0 {
+		limit = min(limit, routeLimit)
+	}
+	if r.ContentLength > limit {
+		s.rejectedRequests.Inc("request body too large")
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	// A body already wrapped in the route's MaxBytesReader fails rather
+	// than running past the limit.
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || err == nil && int64(len(body)) > limit {
+		s.rejectedRequests.Inc("request body too large")
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "read request failed", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// HasRoute reports whether host is currently routed to an agent, including
+// routes held during the resume window and hostnames served by cluster peers.
+func (s *TunnelServer) HasRoute(host string) bool {
+	host = normalizeHost(host)
+	s.routesMu.RLock()
+	_, ok := s.routes[host]
+	s.routesMu.RUnlock()
+	if _, gw := s.gateway.get(host); gw || s.gateway.isIdle(host) {
+		return true
+	}
+	return ok || s.cluster != nil && s.cluster.owner(host) != ""
+}
+
+func (s *TunnelServer) inStartupWindow() bool {
+	return s.resumeWindow > 0 && time.Since(s.startedAt) < s.resumeWindow
+}
 
-	select {
-	case resp := <-respCh:
-		writeResponse(w, resp)
-	case <-time.After(s.requestTimeout):
-		http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+func (s *TunnelServer) writeRetryLater(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(s.retryAfter()))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// retryAfter is how long clients should wait for a reconnecting agent: the
+// resume window, between 1 and 5 seconds.
+func (s *TunnelServer) retryAfter() int {
+	return min(max(int(s.resumeWindow/time.Second), 1), 5)
+}
+
+// tryAcquire takes one of limit slots on counter; limit <= 0 is unbounded.
+func tryAcquire(counter *atomic.Int64, limit int) bool {
+	if n := counter.Add(1); limit > 0 && n > int64(limit) {
+		counter.Add(-1)
+		return false
 	}
+	return true
+}
+
+// writeBusy refuses a request over an in-flight limit. Slots free up as soon
+// as a response returns, so clients may retry right away.
+func writeBusy(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, msg, status)
 }
 
-func writeResponse(w http.ResponseWriter, resp protocol.Envelope) {
-	status := resp.Status
-	if status == 0 {
-		status = http.StatusBadGateway
+func decodeResponse(resp protocol.Envelope) *Response {
+	out := &Response{Status: resp.Status, Headers: resp.Headers, Body: resp.Payload, Trailers: resp.Trailers}
+	if out.Status == 0 {
+		out.Status = http.StatusBadGateway
 	}
+	return out
+}
+
+func writeResponse(w http.ResponseWriter, resp *Response) {
 	for k, v := range resp.Headers {
 		for _, item := range v {
 			w.Header().Add(k, item)
 		}
 	}
-	w.WriteHeader(status)
-
-	if resp.Body == "" {
-		return
+	if len(resp.Trailers) > 0 {
+		// Declared trailers force a chunked response, so a fixed length from
+		// the agent would be wrong.
+		w.Header().Del("Content-Length")
+		for k := range resp.Trailers {
+			w.Header().Add("Trailer", k)
+		}
 	}
-	body, err := base64.StdEncoding.DecodeString(resp.Body)
-	if err != nil {
-		_, _ = w.Write([]byte("decode response body failed"))
-		return
+	w.WriteHeader(resp.Status)
+	if len(resp.Body) > 0 {
+		_, _ = w.Write(resp.Body)
 	}
-	_, _ = w.Write(body)
+	for k, v := range resp.Trailers {
+		for _, item := range v {
+			w.Header().Add(k, item)
+		}
+	}
+}
+
+// presentTrailers keeps the trailers that actually arrived; net/http pre-fills
+// declared keys with nil values.
+func presentTrailers(trailer http.Header) map[string][]string {
+	var out map[string][]string
+	for k, v := range trailer {
+		if len(v) == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string][]string, len(trailer))
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
 }
 
 func normalizeHost(host string) string {
@@ -313,12 +1404,23 @@ func normalizeHost(host string) string {
 	return host
 }
 
-func appendXForwarded(headers map[string][]string, r *http.Request) {
-	clientIP := extractClientIP(r.RemoteAddr)
-	if clientIP != "" {
-		headers["X-Forwarded-For"] = append(headers["X-Forwarded-For"], clientIP)
+// appendXForwarded adds the connection's peer to X-Forwarded-For. Only a
+// trusted proxy's forwarding headers are passed on; anyone else starts a
+// fresh chain.
+func appendXForwarded(headers map[string][]string, r *http.Request, trustedPeer bool) {
+	if !trustedPeer {
+		for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Real-Ip", "Cf-Connecting-Ip"} {
+			delete(headers, key)
+		}
+	}
+	if peer := extractClientIP(r.RemoteAddr); peer != "" {
+		headers["X-Forwarded-For"] = append(headers["X-Forwarded-For"], peer)
 	}
 	headers["X-Forwarded-Host"] = []string{normalizeHost(r.Host)}
+	// A trusted proxy that terminated TLS has already said https.
+	if len(headers["X-Forwarded-Proto"]) > 0 {
+		return
+	}
 	if r.TLS != nil {
 		headers["X-Forwarded-Proto"] = []string{"https"}
 	} else {
@@ -335,6 +1437,7 @@ func extractClientIP(remoteAddr string) string {
 }
 
 func stripHopHeaders(headers map[string][]string) {
+	keepTE := wantsTrailers(headers["Te"]) || wantsTrailers(headers["te"])
 	for _, key := range []string{
 		"Connection",
 		"Proxy-Connection",
@@ -349,16 +1452,30 @@ func stripHopHeaders(headers map[string][]string) {
 		delete(headers, key)
 		delete(headers, strings.ToLower(key))
 	}
+	// "TE: trailers" is hop-by-hop on paper but gRPC servers require it.
+	if keepTE {
+		headers["Te"] = []string{"trailers"}
+	}
+}
+
+func wantsTrailers(values []string) bool {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (s *TunnelServer) DebugState() string {
-	s.agentsMu.RLock()
-	agents := len(s.agents)
-	s.agentsMu.RUnlock()
+	agents := len(s.allSessions())
 
 	s.routesMu.RLock()
 	routes := len(s.routes)
 	s.routesMu.RUnlock()
 
-	return fmt.Sprintf("agents=%d routes=%d", agents, routes)
+	depth, dropped := s.writeQueueStats()
+	return fmt.Sprintf("agents=%d routes=%d write_queue_depth=%d write_queue_dropped=%d", agents, routes, depth, dropped)
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+
+	"tunneling/internal/protocol"
+)
+
+// splitCookie holds the client's bucket for routes split with sticky
+// "cookie", so the same browser keeps landing on the same target.
+const splitCookie = "tunnel_split"
+
+// splitTarget picks the target for one request to route: target, or the
+// split target for the share of clients its weight asks for. The agent
+// validated the split; a malformed one at worst sends nothing its way.
+func splitTarget(w http.ResponseWriter, r *http.Request, route protocol.Route, target, clientIP string) string {
+	split := route.Split
+	if split == nil || split.Target == "" || split.Weight <= 0 {
+		return target
+	}
+	var bucket int
+	switch split.Sticky {
+	case protocol.SplitStickyIP:
+		bucket = protocol.SplitBucket(clientIP)
+	case protocol.SplitStickyCookie:
+		bucket = -1
+		if c, err := r.Cookie(splitCookie); err == nil {
+			if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < 100 {
+				bucket = n
+			}
+		}
+		if bucket < 0 {
+			bucket = rand.IntN(100)
+			http.SetCookie(w, &http.Cookie{
+				Name:     splitCookie,
+				Value:    strconv.Itoa(bucket),
+				Path:     "/",
+				MaxAge:   30 * 24 * 3600,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	default:
+		bucket = rand.IntN(100)
+	}
+	if bucket < split.Weight {
+		return split.Target
+	}
+	return target
+}
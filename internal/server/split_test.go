@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestSplitRoutesShareOfRequestsToSecondTarget(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	routes := []protocol.Route{
+		{Hostname: "all.test", Target: "127.0.0.1:3000", Split: &protocol.Split{Target: "127.0.0.1:3001", Weight: 100, Sticky: protocol.SplitStickyCookie}},
+		{Hostname: "none.test", Target: "127.0.0.1:3000", Split: &protocol.Split{Target: "127.0.0.1:3001", Weight: 0}},
+		{Hostname: "ip.test", Target: "127.0.0.1:3000", Split: &protocol.Split{Target: "127.0.0.1:3001", Weight: 50, Sticky: protocol.SplitStickyIP}},
+	}
+	startFakeAgent(t, ts, "tok", routes, func(env protocol.Envelope) protocol.Envelope {
+		return protocol.Envelope{Status: http.StatusOK, Headers: map[string][]string{"X-Target": {env.Target}}}
+	})
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+
+	get := func(host string, cookie *http.Cookie) (string, *http.Response) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, public.URL+"/", nil)
+		req.Host = host
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", host, err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Target"), resp
+	}
+
+	target, resp := get("all.test", nil)
+	cookies := resp.Cookies()
+	if target != "127.0.0.1:3001" || len(cookies) != 1 || cookies[0].Name != splitCookie {
+		t.Fatalf("all.test went to %q with cookies %v", target, cookies)
+	}
+	if _, resp := get("all.test", cookies[0]); len(resp.Cookies()) != 0 {
+		t.Fatalf("cookie set again for a client that sent one")
+	}
+	if target, _ := get("none.test", nil); target != "127.0.0.1:3000" {
+		t.Fatalf("none.test went to %q", target)
+	}
+	first, _ := get("ip.test", nil)
+	for i := 0; i < 5; i++ {
+		if next, _ := get("ip.test", nil); next != first {
+			t.Fatalf("ip-sticky split moved the client from %q to %q", first, next)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestEventStreamOutlivesRequestTimeout(t *testing.T) {
+	ts := New(Options{RequestTimeout: 100 * time.Millisecond})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/connect?token=tok&caps="+protocol.CapStream, nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatalf("read session envelope: %v", err)
+	}
+	routes := []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("app.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("route not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	go func() {
+		var env protocol.Envelope
+		for env.Type != protocol.TypeProxyRequest {
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+		}
+		send := func(e protocol.Envelope) {
+			e.RequestID = env.RequestID
+			frame, _ := protocol.EncodeJSON(e)
+			_ = conn.WriteMessage(websocket.TextMessage, frame)
+		}
+		send(protocol.Envelope{Type: protocol.TypeProxyResponse, Status: http.StatusOK, Stream: true,
+			Headers: map[string][]string{"Content-Type": {"text/event-stream"}}})
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, Payload: []byte("data: one\n\n")})
+		// Stay quiet for longer than the request timeout.
+		time.Sleep(300 * time.Millisecond)
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, Payload: []byte("data: two\n\n")})
+		send(protocol.Envelope{Type: protocol.TypeProxyResponseData, End: true})
+	}()
+
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+	req, _ := http.NewRequest(http.MethodGet, public.URL+"/events", nil)
+	req.Host = "app.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	var events []string
+	for lines.Scan() {
+		if line := lines.Text(); line != "" {
+			events = append(events, line)
+		}
+	}
+	if err := lines.Err(); err != nil || strings.Join(events, ",") != "data: one,data: two" {
+		t.Fatalf("events = %q, err = %v", events, err)
+	}
+}
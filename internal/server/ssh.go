@@ -0,0 +1,594 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+// SSHOptions configure ServeSSH.
+type SSHOptions struct {
+	HostKey ssh.Signer
+	// ControlAPI, when set, lets a forward without a hostname ("ssh -R
+	// 3000:localhost:3000") serve the tunnel's routes whose target port is
+	// the forwarded port.
+	ControlAPI string
+}
+
+// SSHHostKey reads a PEM private key from path. With an empty path it makes
+// a throwaway ed25519 key, so clients see a new fingerprint every restart.
+func SSHHostKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("ssh listener uses a generated host key, set -ssh-host-key to keep its fingerprint across restarts")
+		return ssh.NewSignerFromKey(key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// ServeSSH accepts "ssh -R" reverse forwards on ln until ctx is done, for
+// users without the agent. The SSH user name is the agent token, or
+// "<tunnel_id>:<token>" where agents are checked against the control plane.
+// Each connection becomes an agent session of its own, so forwarded
+// hostnames go through the same checks, limits and routing as any other.
+func (s *TunnelServer) ServeSSH(ctx context.Context, ln net.Listener, opts SSHOptions) error {
+	config := &ssh.ServerConfig{
+		// The token is checked when the connection's agent session is
+		// opened; there is nothing to check it against before that.
+		NoClientAuth:  true,
+		ServerVersion: "SSH-2.0-tunneling",
+	}
+	config.AddHostKey(opts.HostKey)
+
+	pipe := newPipeListener()
+	connectSrv := &http.Server{Handler: http.HandlerFunc(s.HandleConnect)}
+	go func() { _ = connectSrv.Serve(pipe) }()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+		_ = connectSrv.Close()
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveSSHConn(nc, config, pipe, opts)
+	}
+}
+
+// sshBridge plays the agent for one SSH connection: it holds an agent
+// session on the server and answers its requests through channels opened
+// back to the SSH client.
+type sshBridge struct {
+	s        *TunnelServer
+	conn     *ssh.ServerConn
+	opts     SSHOptions
+	tunnelID string
+	token    string
+	writer   *wsconn.Writer
+	// origin is the address forwarded channels say they come from: the SSH
+	// listener's own (clients reject a zero port).
+	originAddr string
+	originPort uint32
+
+	mu       sync.Mutex
+	forwards map[string]*sshForward
+	requests map[string]context.CancelFunc
+}
+
+// sshForward is one "ssh -R" forward and the routes it serves.
+type sshForward struct {
+	bindAddr string
+	bindPort uint32
+	routes   []protocol.Route
+	client   *http.Client
+}
+
+func (s *TunnelServer) serveSSHConn(nc net.Conn, config *ssh.ServerConfig, pipe *pipeListener, opts SSHOptions) {
+	_ = nc.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		slog.Debug("ssh handshake failed", "remote", nc.RemoteAddr().String(), "err", err)
+		_ = nc.Close()
+		return
+	}
+	_ = nc.SetDeadline(time.Time{})
+	defer conn.Close()
+
+	b := &sshBridge{s: s, conn: conn, opts: opts, forwards: make(map[string]*sshForward), requests: make(map[string]context.CancelFunc)}
+	b.token = conn.User()
+	if addr, ok := nc.LocalAddr().(*net.TCPAddr); ok {
+		b.originAddr, b.originPort = addr.IP.String(), uint32(addr.Port)
+	}
+	if id, token, ok := strings.Cut(conn.User(), ":"); ok {
+		b.tunnelID, b.token = id, token
+	}
+	ws, err := b.connect(pipe, nc.RemoteAddr())
+	if err != nil {
+		slog.Warn("ssh tunnel rejected", "token", tokenHint(b.token), "tunnel_id", b.tunnelID, "remote", nc.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer ws.Close()
+	b.writer = wsconn.NewWriter(ws, 0, 0)
+	defer b.writer.Close()
+	_ = b.writer.Send(protocol.Envelope{
+		Type:            protocol.TypeHello,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Agent: &protocol.AgentMeta{
+			Version: string(conn.ClientVersion()),
+			Labels:  map[string]string{"transport": "ssh"},
+		},
+	}, wsconn.DefaultWriteTimeout)
+	slog.Info("ssh tunnel connected", "token", tokenHint(b.token), "tunnel_id", b.tunnelID, "remote", nc.RemoteAddr().String())
+
+	go func() {
+		b.readLoop(ws)
+		_ = conn.Close()
+	}()
+	go b.globalRequests(reqs)
+	for ch := range chans {
+		if ch.ChannelType() != "session" {
+			_ = ch.Reject(ssh.Prohibited, "only remote forwarding (-R) is supported")
+			continue
+		}
+		go b.session(ch)
+	}
+
+	b.mu.Lock()
+	for _, cancel := range b.requests {
+		cancel()
+	}
+	for _, f := range b.forwards {
+		f.client.CloseIdleConnections()
+	}
+	b.mu.Unlock()
+	slog.Info("ssh tunnel disconnected", "token", tokenHint(b.token), "tunnel_id", b.tunnelID)
+}
+
+// connect opens the bridge's agent session.
+func (b *sshBridge) connect(pipe *pipeListener, remote net.Addr) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		NetDialContext:   func(context.Context, string, string) (net.Conn, error) { return pipe.dial(remote) },
+		HandshakeTimeout: 10 * time.Second,
+	}
+	query := url.Values{}
+	if b.tunnelID != "" {
+		query.Set("tunnel_id", b.tunnelID)
+	}
+	header := http.Header{"Authorization": {"Bearer " + b.token}}
+	ws, resp, err := dialer.Dial("ws://ssh/connect?"+query.Encode(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("server answered %s", resp.Status)
+		}
+		return nil, err
+	}
+	ws.SetReadLimit(maxBodySize + (2 << 20))
+	return ws, nil
+}
+
+func (b *sshBridge) readLoop(ws *websocket.Conn) {
+	for {
+		env, err := wsconn.ReadEnvelope(ws)
+		if err != nil {
+			return
+		}
+		switch env.Type {
+		case protocol.TypeProxyRequest:
+			ctx, cancel := context.WithCancel(context.Background())
+			b.mu.Lock()
+			b.requests[env.RequestID] = cancel
+			b.mu.Unlock()
+			go b.proxy(ctx, env)
+		case protocol.TypeProxyCancel:
+			b.mu.Lock()
+			if cancel := b.requests[env.RequestID]; cancel != nil {
+				cancel()
+			}
+			b.mu.Unlock()
+		case protocol.TypeRouteResync:
+			_ = b.publish()
+		}
+	}
+}
+
+func (b *sshBridge) globalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var fwd struct {
+				Addr string
+				Port uint32
+			}
+			if ssh.Unmarshal(req.Payload, &fwd) != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			if err := b.addForward(fwd.Addr, fwd.Port); err != nil {
+				slog.Warn("ssh forward refused", "token", tokenHint(b.token), "bind", net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port))), "err", err)
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{fwd.Port}))
+		case "cancel-tcpip-forward":
+			var fwd struct {
+				Addr string
+				Port uint32
+			}
+			if ssh.Unmarshal(req.Payload, &fwd) == nil {
+				b.removeForward(fwd.Addr, fwd.Port)
+			}
+			_ = req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// addForward works out the hostnames bindAddr:port serves and publishes
+// them. A bind address that is a hostname names it; otherwise the control
+// plane's routes for the tunnel whose target port is port are used.
+func (b *sshBridge) addForward(bindAddr string, port uint32) error {
+	if port == 0 {
+		return errors.New("a port is required")
+	}
+	host := strings.ToLower(strings.TrimSuffix(bindAddr, "."))
+	var controlRoutes []protocol.Route
+	if b.opts.ControlAPI != "" && b.tunnelID != "" {
+		var err error
+		if controlRoutes, err = b.controlRoutes(); err != nil {
+			return err
+		}
+	}
+
+	var routes []protocol.Route
+	if isForwardHostname(host) {
+		route := protocol.Route{Hostname: host}
+		for _, r := range controlRoutes {
+			if normalizeHost(r.Hostname) == host {
+				route = r
+			}
+		}
+		routes = append(routes, route)
+	} else {
+		for _, r := range controlRoutes {
+			if target, err := protocol.ParseTarget(r.Target); err == nil && target.Scheme != "unix" && strings.HasSuffix(target.Addr, ":"+strconv.Itoa(int(port))) {
+				routes = append(routes, r)
+			}
+		}
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("no route of the tunnel targets port %d; use -R <hostname>:%d:... to name one", port, port)
+	}
+
+	f := &sshForward{bindAddr: bindAddr, bindPort: port}
+	target := "ssh://" + net.JoinHostPort(bindAddr, strconv.Itoa(int(port)))
+	for i := range routes {
+		routes[i].Target = target
+		routes[i].Split = nil
+		routes[i].Mirror = nil
+	}
+	f.routes = routes
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         func(context.Context, string, string) (net.Conn, error) { return b.dial(f) },
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	b.mu.Lock()
+	if old := b.forwards[target]; old != nil {
+		old.client.CloseIdleConnections()
+	}
+	b.forwards[target] = f
+	b.mu.Unlock()
+	return b.publish()
+}
+
+func (b *sshBridge) removeForward(bindAddr string, port uint32) {
+	target := "ssh://" + net.JoinHostPort(bindAddr, strconv.Itoa(int(port)))
+	b.mu.Lock()
+	f := b.forwards[target]
+	delete(b.forwards, target)
+	b.mu.Unlock()
+	if f != nil {
+		f.client.CloseIdleConnections()
+		_ = b.publish()
+	}
+}
+
+// isForwardHostname reports whether an ssh -R bind address names a public
+// hostname rather than an interface.
+func isForwardHostname(addr string) bool {
+	return strings.Contains(addr, ".") && net.ParseIP(addr) == nil
+}
+
+// sshControlClient fetches routes for ssh forwards from the control plane.
+var sshControlClient = &http.Client{Timeout: 10 * time.Second}
+
+// controlRoutes fetches the tunnel's routes the way an agent does, with
+// the token in a header so it stays out of access logs.
+func (b *sshBridge) controlRoutes() ([]protocol.Route, error) {
+	query := url.Values{"tunnel_id": {b.tunnelID}}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(b.opts.ControlAPI, "/")+"/agent/routes?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	resp, err := sshControlClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("control routes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control routes: %s", resp.Status)
+	}
+	var payload struct {
+		Routes []protocol.Route `json:"routes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("control routes: %w", err)
+	}
+	return payload.Routes, nil
+}
+
+func (b *sshBridge) publish() error {
+	b.mu.Lock()
+	var routes []protocol.Route
+	for _, f := range b.forwards {
+		routes = append(routes, f.routes...)
+	}
+	b.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Hostname < routes[j].Hostname })
+	return b.writer.Send(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes, RoutesVersion: protocol.RoutesVersion(routes)}, wsconn.DefaultWriteTimeout)
+}
+
+func (b *sshBridge) hostnames() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for _, f := range b.forwards {
+		for _, r := range f.routes {
+			out = append(out, r.Hostname)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// session answers an interactive "ssh -R" with the published hostnames and
+// closes the connection on Ctrl-C, Ctrl-D or end of input.
+func (b *sshBridge) session(newCh ssh.NewChannel) {
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req", "shell", "env", "window-change":
+				_ = req.Reply(true, nil)
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+	if hosts := b.hostnames(); len(hosts) > 0 {
+		fmt.Fprintf(ch, "Forwarding %s\r\nPress Ctrl-C to close the tunnel.\r\n", strings.Join(hosts, ", "))
+	} else {
+		fmt.Fprint(ch, "No forward is active; connect with -R <hostname>:80:localhost:<port>.\r\n")
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := ch.Read(buf)
+		if bytes.ContainsAny(buf[:n], "\x03\x04") || err != nil {
+			_ = b.conn.Close()
+			return
+		}
+	}
+}
+
+// dial opens a channel to f's local service through the SSH client.
+func (b *sshBridge) dial(f *sshForward) (net.Conn, error) {
+	payload := ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{f.bindAddr, f.bindPort, b.originAddr, b.originPort})
+	ch, reqs, err := b.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return &sshChannelConn{Channel: ch}, nil
+}
+
+// proxy sends a request to the forward it is routed to and returns the
+// response to the server.
+func (b *sshBridge) proxy(ctx context.Context, env protocol.Envelope) {
+	defer func() {
+		b.mu.Lock()
+		if cancel := b.requests[env.RequestID]; cancel != nil {
+			cancel()
+			delete(b.requests, env.RequestID)
+		}
+		b.mu.Unlock()
+	}()
+	resp := b.forwardRequest(ctx, env)
+	if ctx.Err() != nil {
+		return
+	}
+	resp.Type = protocol.TypeProxyResponse
+	resp.RequestID = env.RequestID
+	if err := b.writer.Send(*resp, wsconn.DefaultWriteTimeout); err != nil {
+		slog.Warn("ssh tunnel response dropped", "request_id", env.RequestID, "err", err)
+	}
+}
+
+func (b *sshBridge) forwardRequest(ctx context.Context, env protocol.Envelope) *protocol.Envelope {
+	b.mu.Lock()
+	f := b.forwards[env.Target]
+	b.mu.Unlock()
+	if f == nil {
+		return sshError(http.StatusBadGateway, "the ssh forward for this hostname is gone")
+	}
+	timeout := b.s.requestTimeout
+	if d, err := time.ParseDuration(env.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rawURL := "http://" + env.Hostname + env.Rewrite.Path(env.Path)
+	if env.Query != "" {
+		rawURL += "?" + env.Query
+	}
+	req, err := http.NewRequestWithContext(ctx, env.Method, rawURL, bytes.NewReader(env.Payload))
+	if err != nil {
+		return sshError(http.StatusBadGateway, "build request failed")
+	}
+	for k, v := range env.Headers {
+		for _, item := range v {
+			req.Header.Add(k, item)
+		}
+	}
+	stripHopHeaders(req.Header)
+	if env.HeaderRules != nil {
+		env.HeaderRules.Request.Apply(req.Header)
+	}
+	if rw := env.Rewrite; rw != nil && rw.Host != "" && rw.Host != protocol.RewriteHostTarget {
+		req.Host = rw.Host
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return sshError(http.StatusBadGateway, "ssh forward failed: "+err.Error())
+	}
+	defer resp.Body.Close()
+	// The body is relayed in one message; cutting it short would leave
+	// the client with a body that does not match its Content-Length.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return sshError(http.StatusBadGateway, "read response failed")
+	}
+	if len(body) > maxBodySize {
+		return sshError(http.StatusBadGateway, "response body exceeds the 10MB limit of ssh forwards")
+	}
+	headers := protocol.CloneHeaders(resp.Header)
+	stripHopHeaders(headers)
+	if env.HeaderRules != nil {
+		env.HeaderRules.Response.Apply(headers)
+	}
+	return &protocol.Envelope{Status: resp.StatusCode, Headers: headers, Payload: body}
+}
+
+func sshError(status int, msg string) *protocol.Envelope {
+	return &protocol.Envelope{
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Payload: []byte(msg),
+	}
+}
+
+// sshChannelConn lets an http.Transport use an SSH channel. Requests are
+// bounded by their contexts, so deadlines are not needed.
+type sshChannelConn struct {
+	ssh.Channel
+}
+
+func (c *sshChannelConn) LocalAddr() net.Addr              { return pipeAddr("ssh") }
+func (c *sshChannelConn) RemoteAddr() net.Addr             { return pipeAddr("ssh") }
+func (c *sshChannelConn) SetDeadline(time.Time) error      { return nil }
+func (c *sshChannelConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *sshChannelConn) SetWriteDeadline(time.Time) error { return nil }
+
+// pipeListener hands in-memory connections to an http.Server, so SSH
+// connections can open agent sessions without a network round trip.
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// dial returns the client end of a new connection whose server end reports
+// remote as its peer, so limits and logs see the SSH client's address.
+func (l *pipeListener) dial(remote net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &remoteConn{Conn: server, remote: remote}:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr("ssh") }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunneling/internal/protocol"
+)
+
+// channelListener serves the forwarded-tcpip channels an SSH client is
+// offered as plain connections.
+type channelListener struct {
+	conns chan net.Conn
+}
+
+func (l *channelListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *channelListener) Close() error   { return nil }
+func (l *channelListener) Addr() net.Addr { return pipeAddr("test") }
+
+func TestSSHReverseForward(t *testing.T) {
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/agent/routes" || r.URL.Query().Get("tunnel_id") != "t1" || r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"routes": []protocol.Route{
+			{Hostname: "port.test", Target: "127.0.0.1:3000"},
+			{Hostname: "other.test", Target: "127.0.0.1:4000"},
+		}})
+	}))
+	defer control.Close()
+
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	key, err := SSHHostKey("")
+	if err != nil {
+		t.Fatalf("SSHHostKey: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ts.ServeSSH(ctx, ln, SSHOptions{HostKey: key, ControlAPI: control.URL}) }()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{User: "t1:tok", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+	local := &channelListener{conns: make(chan net.Conn)}
+	go func() {
+		for newCh := range client.HandleChannelOpen("forwarded-tcpip") {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			local.conns <- &sshChannelConn{Channel: ch}
+		}
+	}()
+	go func() {
+		_ = http.Serve(local, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/big" {
+				_, _ = w.Write(make([]byte, maxBodySize+1))
+				return
+			}
+			_, _ = io.WriteString(w, "hello "+r.Host)
+		}))
+	}()
+
+	forward := func(addr string, port uint32) bool {
+		ok, _, err := client.SendRequest("tcpip-forward", true, ssh.Marshal(struct {
+			Addr string
+			Port uint32
+		}{addr, port}))
+		if err != nil {
+			t.Fatalf("tcpip-forward: %v", err)
+		}
+		return ok
+	}
+	if !forward("app.test", 80) || !forward("127.0.0.1", 3000) {
+		t.Fatal("forward refused")
+	}
+	if forward("127.0.0.1", 5000) {
+		t.Fatal("forward of a port no route targets was accepted")
+	}
+
+	get := func(host string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		ts.HandlePublicHTTP(rec, req)
+		return rec
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for get("port.test").Code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, host := range []string{"app.test", "port.test"} {
+		if rec := get(host); rec.Code != http.StatusOK || rec.Body.String() != "hello "+host {
+			t.Fatalf("GET %s = %d %q", host, rec.Code, rec.Body)
+		}
+	}
+	big := httptest.NewRecorder()
+	ts.HandlePublicHTTP(big, httptest.NewRequest(http.MethodGet, "http://app.test/big", nil))
+	if big.Code != http.StatusBadGateway {
+		t.Fatalf("GET /big = %d, want 502 instead of a truncated body", big.Code)
+	}
+	if rec := get("other.test"); rec.Code == http.StatusOK {
+		t.Fatalf("GET other.test = %d, want it unrouted", rec.Code)
+	}
+	if agents := ts.Agents(); len(agents) != 1 || agents[0].Agent == nil || agents[0].Agent.Labels["transport"] != "ssh" {
+		t.Fatalf("agents = %+v", agents)
+	}
+
+	client.Close()
+	deadline = time.Now().Add(3 * time.Second)
+	for len(ts.Agents()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := len(ts.Agents()); n != 0 {
+		t.Fatalf("%d agent sessions left after the ssh client went away", n)
+	}
+}
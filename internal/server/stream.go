@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/wsconn"
+)
+
+// sessionStream is the per-request state of a streamed exchange: credit for
+// the request body we upload and the inbound side of the response body.
+type sessionStream struct {
+	credit  wsconn.Credit
+	inbound *wsconn.Inbound
+	// interim receives the 1xx responses relayed before the final one.
+	interim chan protocol.Envelope
+}
+
+func (s *AgentSession) openStream(requestID string, st *sessionStream) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.streams[requestID] = st
+}
+
+func (s *AgentSession) stream(requestID string) *sessionStream {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return s.streams[requestID]
+}
+
+func (s *AgentSession) closeStream(requestID string) {
+	s.pendingMu.Lock()
+	st := s.streams[requestID]
+	delete(s.streams, requestID)
+	s.pendingMu.Unlock()
+	if st != nil {
+		st.inbound.Abort(nil)
+	}
+}
+
+// wantsStreaming reports whether a request body should be streamed instead of
+// buffered: the agent must support it and the body must be large or of
+// unknown length.
+func wantsStreaming(session *AgentSession, r *http.Request) bool {
+	if session == nil || !session.HasCap(protocol.CapStream) {
+		return false
+	}
+	if expectsContinue(r) && session.HasCap(protocol.CapInterim) {
+		return true
+	}
+	return r.ContentLength < 0 || r.ContentLength > protocol.InlineBodyLimit
+}
+
+func expectsContinue(r *http.Request) bool {
+	return r.ContentLength != 0 && strings.EqualFold(strings.TrimSpace(r.Header.Get("Expect")), "100-continue")
+}
+
+// awaitContinue holds back the body of an Expect: 100-continue request until
+// the agent relays a 100 Continue, passing other 1xx responses on to the
+// client meanwhile. A final response from the agent means the body is not
+// wanted; it is returned so the caller can answer without reading it.
+func (s *TunnelServer) awaitContinue(w http.ResponseWriter, r *http.Request, st *sessionStream, respCh chan protocol.Envelope, timeout time.Duration) (*protocol.Envelope, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case env := <-st.interim:
+			if env.Status == http.StatusContinue {
+				// net/http sends the client its 100 Continue on the
+				// first body read.
+				return nil, nil
+			}
+			writeInterim(w, env)
+		case resp := <-respCh:
+			return &resp, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-timer.C:
+			return nil, errContinueTimeout
+		}
+	}
+}
+
+var errContinueTimeout = errors.New("agent did not ask for the request body in time")
+
+// writeInterim sends a 1xx response head to the client. Its headers are
+// dropped again so they do not leak into the final response. 100 Continue is
+// left to net/http, which sends it when the body is first read.
+func writeInterim(w http.ResponseWriter, env protocol.Envelope) {
+	if env.Status <= http.StatusContinue || env.Status > 199 || env.Status == http.StatusSwitchingProtocols {
+		return
+	}
+	for k, v := range env.Headers {
+		for _, item := range v {
+			w.Header().Add(k, item)
+		}
+	}
+	w.WriteHeader(env.Status)
+	for k := range env.Headers {
+		w.Header().Del(k)
+	}
+}
+
+// uploadBody streams the public request body to the agent. It gives up early
+// when the agent answers before consuming the whole body, returning that
+// response head so the caller does not lose it. timeout bounds each wait for
+// credit or a frame write, and is the route's own timeout when it has one.
+func (s *TunnelServer) uploadBody(session *AgentSession, requestID string, r *http.Request, credit wsconn.Credit, respCh chan protocol.Envelope, timeout time.Duration) (*protocol.Envelope, error) {
+	var early *protocol.Envelope
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case resp := <-respCh:
+			early = &resp
+		case <-session.writer.Done():
+		case <-stop:
+			return
+		}
+		close(done)
+	}()
+
+	err := wsconn.SendBody(r.Body, credit, timeout, done,
+		func(end bool) protocol.Envelope {
+			return protocol.Envelope{Type: protocol.TypeProxyRequestData, RequestID: requestID, End: end}
+		},
+		func(env protocol.Envelope) error { return session.writer.Send(env, timeout) },
+		func() map[string][]string { return presentTrailers(r.Trailer) },
+	)
+	close(stop)
+	<-exited
+	if early != nil {
+		return early, nil
+	}
+	return nil, err
+}
+
+// isEventStream reports whether a response is Server-Sent Events.
+func isEventStream(headers map[string][]string) bool {
+	for k, v := range headers {
+		if strings.EqualFold(k, "Content-Type") && len(v) > 0 {
+			return strings.HasPrefix(strings.ToLower(strings.TrimSpace(v[0])), "text/event-stream")
+		}
+	}
+	return false
+}
+
+// writeStreamedResponse copies the response body frames to the client as they
+// arrive, flushing after each chunk.
+func writeStreamedResponse(w http.ResponseWriter, resp *Response, inbound *wsconn.Inbound) {
+	for k, v := range resp.Headers {
+		for _, item := range v {
+			w.Header().Add(k, item)
+		}
+	}
+	w.WriteHeader(resp.Status)
+	// Send headers right away: the body may take a while, and an unflushed
+	// empty response would get a Content-Length that drops trailers.
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+	buf := make([]byte, protocol.StreamChunkSize)
+	for {
+		n, err := inbound.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, context.Canceled) {
+			// The client went away; there is nobody left to tell.
+			return
+		}
+		if err != nil {
+			slog.Warn("stream response failed", "err", err)
+			// Abort the connection so the client sees a truncated body.
+			panic(http.ErrAbortHandler)
+		}
+	}
+	// Undeclared trailers still go out on chunked responses via TrailerPrefix.
+	for k, v := range inbound.Trailers() {
+		for _, item := range v {
+			w.Header().Add(http.TrailerPrefix+k, item)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+// startFakeAgent connects a minimal agent to ts that registers routes and
+// answers every proxy_request with handle.
+func startFakeAgent(t *testing.T, ts *TunnelServer, token string, routes []protocol.Route, handle func(protocol.Envelope) protocol.Envelope) {
+	t.Helper()
+	startFakeTunnelAgent(t, ts, token, "", routes, handle)
+}
+
+// startFakeTunnelAgent is startFakeAgent for an agent that claims tunnelID.
+func startFakeTunnelAgent(t *testing.T, ts *TunnelServer, token, tunnelID string, routes []protocol.Route, handle func(protocol.Envelope) protocol.Envelope) {
+	t.Helper()
+	control := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	t.Cleanup(control.Close)
+
+	connectURL := "ws" + strings.TrimPrefix(control.URL, "http") + "/connect"
+	if tunnelID != "" {
+		connectURL += "?tunnel_id=" + url.QueryEscape(tunnelID)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(connectURL, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	// The session envelope arrives once the server has registered the session.
+	var hello protocol.Envelope
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != protocol.TypeSession {
+		t.Fatalf("read session envelope: %+v, %v", hello, err)
+	}
+	if err := conn.WriteJSON(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+
+	go func() {
+		for {
+			var env protocol.Envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+			if env.Type != protocol.TypeProxyRequest {
+				continue
+			}
+			resp := handle(env)
+			resp.Type = protocol.TypeProxyResponse
+			resp.RequestID = env.RequestID
+			if err := conn.WriteJSON(resp); err != nil {
+				return
+			}
+		}
+	}()
+
+	want := protocol.RoutesVersion(routes)
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.routesVersion(token) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("routes of token %s were not registered", token)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+
+	"tunneling/internal/tracing"
+)
+
+// startSpan opens the server span for a public request, continuing the
+// client's trace when it sent a traceparent, and rewrites the header so the
+// agent (or the peer node a request is forwarded to) continues ours.
+func (s *TunnelServer) startSpan(r *http.Request, entry *accessEntry) *tracing.Span {
+	if s.tracer == nil {
+		return nil
+	}
+	parent, _ := tracing.ParseTraceparent(r.Header.Get("Traceparent"))
+	span := s.tracer.Start(parent, r.Method, tracing.KindServer)
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	span.SetAttr("server.address", normalizeHost(r.Host))
+	span.SetAttr("client.address", entry.ClientIP)
+	span.SetAttr("tunnel.request_id", entry.RequestID)
+	r.Header.Set("Traceparent", span.Context().Traceparent())
+	return span
+}
+
+func endSpan(span *tracing.Span, rec *accessRecorder, entry *accessEntry) {
+	if span == nil {
+		return
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttr("http.response.status_code", status)
+	span.SetAttr("http.response.body.size", rec.bytes)
+	if entry.session != nil {
+		span.SetAttr("tunnel.id", entry.session.TunnelID)
+		span.SetAttr("tunnel.session_id", entry.session.ID)
+	}
+	if status >= 500 {
+		span.SetError(http.StatusText(status))
+	}
+	span.End()
+}
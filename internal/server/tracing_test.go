@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/tracing"
+)
+
+func TestPublicRequestPropagatesTraceparent(t *testing.T) {
+	tracer, err := tracing.New("http://127.0.0.1:4318", "tunnel-server", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := New(Options{RequestTimeout: 2 * time.Second, Tracer: tracer})
+	seen := make(chan map[string][]string, 1)
+	startFakeAgent(t, ts, "tok", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, func(env protocol.Envelope) protocol.Envelope {
+		seen <- env.Headers
+		return protocol.Envelope{Status: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte("ok"))}
+	})
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	r.Header.Set("Traceparent", incoming)
+	rec := httptest.NewRecorder()
+	ts.HandlePublicHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	headers := <-seen
+	if len(headers["Traceparent"]) != 1 {
+		t.Fatalf("traceparent = %v", headers["Traceparent"])
+	}
+	got, ok := tracing.ParseTraceparent(headers["Traceparent"][0])
+	parent, _ := tracing.ParseTraceparent(incoming)
+	if !ok || got.TraceID != parent.TraceID || got.SpanID == parent.SpanID || !got.Sampled {
+		t.Fatalf("agent got %q, want a child of %q", headers["Traceparent"][0], incoming)
+	}
+}
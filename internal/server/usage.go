@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostUsage is the traffic one hostname of one agent token served since the
+// last report.
+type HostUsage struct {
+	Hostname string `json:"hostname"`
+	TunnelID string `json:"tunnel_id,omitempty"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+
+	token string
+}
+
+type usageKey struct {
+	hostname string
+	token    string
+}
+
+// usageMeter adds up tunneled traffic per hostname and token until it is
+// drained by a report.
+type usageMeter struct {
+	mu     sync.Mutex
+	counts map[usageKey]*HostUsage
+}
+
+func newUsageMeter() *usageMeter {
+	return &usageMeter{counts: make(map[usageKey]*HostUsage)}
+}
+
+func (m *usageMeter) add(u HostUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := usageKey{u.Hostname, u.token}
+	c := m.counts[key]
+	if c == nil {
+		c = &HostUsage{Hostname: u.Hostname, token: u.token}
+		m.counts[key] = c
+	}
+	if u.TunnelID != "" {
+		c.TunnelID = u.TunnelID
+	}
+	c.Requests += u.Requests
+	c.BytesIn += u.BytesIn
+	c.BytesOut += u.BytesOut
+}
+
+// drain returns the counts so far, sorted by hostname, and starts over.
+func (m *usageMeter) drain() []HostUsage {
+	m.mu.Lock()
+	counts := m.counts
+	m.counts = make(map[usageKey]*HostUsage)
+	m.mu.Unlock()
+	out := make([]HostUsage, 0, len(counts))
+	for _, c := range counts {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+// UsageReport is the body posted to the control plane's /api/usage.
+type UsageReport struct {
+	Node  string      `json:"node,omitempty"`
+	Usage []HostUsage `json:"usage"`
+}
+
+// ReportUsage posts the traffic metered since the previous report to
+// endpoint every interval until ctx is done, plus once more on the way out.
+// A failed report is kept and sent with the next one. apiKey, if set, goes
+// out as a bearer token.
+func (s *TunnelServer) ReportUsage(ctx context.Context, endpoint, apiKey string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	node := ""
+	if s.cluster != nil {
+		node = s.cluster.opts.NodeID
+	}
+	report := func(ctx context.Context) {
+		usage := s.usage.drain()
+		if len(usage) == 0 {
+			return
+		}
+		if err := postUsage(ctx, client, endpoint, apiKey, UsageReport{Node: node, Usage: usage}); err != nil {
+			slog.Warn("usage report failed, retrying with the next one", "err", err)
+			for _, u := range usage {
+				s.usage.add(u)
+			}
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			report(final)
+			cancel()
+			return
+		case <-ticker.C:
+			report(ctx)
+		}
+	}
+}
+
+func postUsage(ctx context.Context, client *http.Client, endpoint, apiKey string, report UsageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("control answered %s", resp.Status)
+	}
+	return nil
+}
+
+// countingBody counts the request body bytes read by the gateway.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestUsageIsMeteredAndReported(t *testing.T) {
+	ts := New(Options{RequestTimeout: 5 * time.Second})
+	startFakeAgent(t, ts, "secret-token", []protocol.Route{{Hostname: "app.test", Target: "127.0.0.1:3000"}}, replyWith("hello"))
+
+	for _, host := range []string{"app.test", "app.test", "missing.test"} {
+		req := httptest.NewRequest(http.MethodPost, "http://"+host+"/", strings.NewReader("ping"))
+		ts.HandlePublicHTTP(httptest.NewRecorder(), req)
+	}
+
+	reports := make(chan UsageReport, 4)
+	status := http.StatusServiceUnavailable
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report UsageReport
+		if r.Header.Get("Authorization") != "Bearer k1" || json.NewDecoder(r.Body).Decode(&report) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		reports <- report
+		status = http.StatusOK
+	}))
+	defer control.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.ReportUsage(ctx, control.URL, "k1", 10*time.Millisecond)
+	next := func() UsageReport {
+		t.Helper()
+		select {
+		case report := <-reports:
+			return report
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a usage report")
+			return UsageReport{}
+		}
+	}
+
+	// The first report is refused, so the second carries the same counts.
+	first, second := next(), next()
+	for _, report := range []UsageReport{first, second} {
+		if len(report.Usage) != 1 {
+			t.Fatalf("report = %+v, want only app.test", report)
+		}
+		u := report.Usage[0]
+		if u.Hostname != "app.test" || u.Requests != 2 || u.BytesIn != 2*int64(len("ping")) || u.BytesOut != 2*int64(len("hello")) {
+			t.Fatalf("usage = %+v", u)
+		}
+	}
+	select {
+	case report := <-reports:
+		t.Fatalf("unexpected report after a successful one: %+v", report)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
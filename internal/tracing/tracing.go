@@ -0,0 +1,366 @@
+// Package tracing records request spans, propagates them with W3C
+// traceparent headers and exports them to an OTLP/HTTP collector (the
+// OpenTelemetry Collector, Jaeger, Tempo) in the JSON encoding. It covers
+// only what the tunnel needs: one span per hop, no SDK.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	exportInterval = 5 * time.Second
+	exportBatch    = 512
+	queueSize      = 4096
+)
+
+// SpanKind values as defined by OTLP.
+type SpanKind int
+
+const (
+	KindServer SpanKind = 2
+	KindClient SpanKind = 3
+)
+
+// Tracer starts spans and exports the sampled ones from Run. A nil *Tracer
+// starts nil spans, which record nothing.
+type Tracer struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+	queue    chan *Span
+	dropped  atomic.Uint64
+}
+
+// New returns a tracer exporting to endpoint, a collector base URL such as
+// http://127.0.0.1:4318 (/v1/traces is added when it has no path). ratio is
+// the share of new traces that are sampled; a trace started upstream keeps
+// the upstream decision.
+func New(endpoint, service string, ratio float64) (*Tracer, error) {
+	u, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp endpoint %q must be an http(s) url", endpoint)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, errors.New("trace sample ratio must be between 0 and 1")
+	}
+	return &Tracer{
+		endpoint: u.String(),
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, queueSize),
+	}, nil
+}
+
+// SpanContext identifies a span across hops.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent formats c as a W3C traceparent header value.
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent reads a W3C traceparent header value.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return c, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return c, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+// Span is one timed operation. Its methods are safe on a nil span.
+type Span struct {
+	tracer *Tracer
+	ctx    SpanContext
+	parent [8]byte
+	name   string
+	kind   SpanKind
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	ended  bool
+}
+
+// Start begins a span as the child of parent, or as the root of a new
+// trace when parent is not valid.
+func (t *Tracer) Start(parent SpanContext, name string, kind SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = t.sample()
+	}
+	_, _ = rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+func (t *Tracer) sample() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.ratio
+}
+
+// Context is what to send downstream so the next hop continues the trace.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttr records a string, bool, integer or float attribute.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{Key: key, Value: attrValue(value)})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Spans are dropped rather
+// than block when the collector cannot keep up.
+func (s *Span) End() {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		s.tracer.dropped.Add(1)
+	}
+}
+
+// Run exports queued spans until ctx is done, then flushes what is left.
+func (t *Tracer) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			slog.Warn("export spans failed", "spans", len(batch), "err", err)
+		}
+		batch = nil
+		if n := t.dropped.Swap(0); n > 0 {
+			slog.Warn("spans dropped, the trace collector is not keeping up", "spans", n)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+		drain:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					break drain
+				}
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			flush(flushCtx)
+			cancel()
+			return
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= exportBatch {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.payload(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON request body, trimmed to the fields used here.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []attribute `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []spanJSON `json:"spans"`
+	}
+	spanJSON struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		Name              string      `json:"name"`
+		Kind              SpanKind    `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []attribute `json:"attributes,omitempty"`
+		Status            *status     `json:"status,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	attribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+// statusError is STATUS_CODE_ERROR.
+const statusError = 2
+
+func (t *Tracer) payload(spans []*Span) exportRequest {
+	scope := scopeSpans{}
+	scope.Scope.Name = "tunneling"
+	for _, s := range spans {
+		s.mu.Lock()
+		out := spanJSON{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parent != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.errMsg != "" {
+			out.Status = &status{Code: statusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []attribute{{Key: "service.name", Value: attrValue(t.service)}}},
+		ScopeSpans: []scopeSpans{scope},
+	}}}
+}
+
+func attrValue(v any) map[string]any {
+	switch v := v.(type) {
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	case string:
+		return map[string]any{"stringValue": v}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
@@ -0,0 +1,115 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	const v = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := ParseTraceparent(v)
+	if !ok || !c.Sampled {
+		t.Fatalf("parse %q = %+v, %v", v, c, ok)
+	}
+	if got := c.Traceparent(); got != v {
+		t.Fatalf("Traceparent() = %q, want %q", got, v)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Fatalf("ParseTraceparent(%q) accepted", bad)
+		}
+	}
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); !ok {
+		t.Fatal("a later version with extra fields should parse")
+	}
+}
+
+func TestStartContinuesParent(t *testing.T) {
+	tr, err := New("http://127.0.0.1:4318", "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := tr.Start(parent, "GET", KindServer)
+	if span.Context().TraceID != parent.TraceID || !span.Context().Sampled {
+		t.Fatalf("child should keep the trace and the sampling decision: %+v", span.Context())
+	}
+	if span.Context().SpanID == parent.SpanID {
+		t.Fatal("child needs its own span id")
+	}
+	if root := tr.Start(SpanContext{}, "GET", KindServer); root.Context().Sampled || !root.Context().IsValid() {
+		t.Fatalf("ratio 0 root = %+v, want valid and unsampled", root.Context())
+	}
+
+	var nilTracer *Tracer
+	nilSpan := nilTracer.Start(parent, "GET", KindServer)
+	nilSpan.SetAttr("k", "v")
+	nilSpan.End()
+	if nilSpan.Context().IsValid() {
+		t.Fatal("a nil tracer must not produce spans")
+	}
+}
+
+func TestRunExportsOTLPJSON(t *testing.T) {
+	got := make(chan exportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode export: %v", err)
+		}
+		got <- req
+	}))
+	defer collector.Close()
+
+	tr, err := New(collector.URL, "tunnel-server", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { tr.Run(ctx); close(done) }()
+
+	span := tr.Start(SpanContext{}, "GET", KindServer)
+	span.SetAttr("http.response.status_code", 502)
+	span.SetError("bad gateway")
+	span.End()
+	span.End()
+	cancel()
+
+	select {
+	case req := <-got:
+		spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+		if len(spans) != 1 {
+			t.Fatalf("exported %d spans, want 1", len(spans))
+		}
+		s := spans[0]
+		if s.Name != "GET" || s.Kind != KindServer || s.Status == nil || s.Status.Code != statusError {
+			t.Fatalf("unexpected span %+v", s)
+		}
+		if s.Attributes[0].Value["intValue"] != "502" {
+			t.Fatalf("attributes = %+v", s.Attributes)
+		}
+		if svc := req.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"]; svc != "tunnel-server" {
+			t.Fatalf("service.name = %v", svc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export on shutdown")
+	}
+	<-done
+}
@@ -0,0 +1,7 @@
+// Package version holds the build version the agent and server report to
+// each other in the hello handshake.
+package version
+
+// Version is set at build time with
+// -ldflags "-X tunneling/internal/version.Version=v1.2.3".
+var Version = "dev"
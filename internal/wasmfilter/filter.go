@@ -0,0 +1,296 @@
+// Package wasmfilter runs WebAssembly modules as gateway middleware.
+//
+// A filter module exports "memory" and optionally "on_request" and
+// "on_response" (no parameters, results ignored). It talks to the gateway
+// through host functions in the "tunnel" import module; all strings are
+// (ptr, len) pairs in the filter's memory:
+//
+//	get_header(name, name_len, buf, buf_cap) i32   value length, -1 if absent
+//	set_header(name, name_len, value, value_len)
+//	remove_header(name, name_len)
+//	get_body(buf, buf_cap) i32                     body length
+//	set_body(buf, len)
+//	get_property(name, name_len, buf, buf_cap) i32 value length, -1 if unknown
+//	set_property(name, name_len, value, value_len)
+//	send_response(status, body, body_len)
+//	log(msg, msg_len)
+//
+// Getters only copy when the value fits in buf_cap, so a filter can call once
+// with a small buffer and retry with the returned length. Headers and body
+// refer to the request in on_request and to the response in on_response.
+// Properties are method, path, query, host, client_ip, target and, for
+// responses, status; all but host and client_ip are writable. send_response
+// in on_request rejects the request without tunneling it; in on_response it
+// replaces the upstream answer.
+package wasmfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"tunneling/internal/server"
+)
+
+const (
+	callTimeout = time.Second
+	// 512 pages of 64KiB leaves room for a copy of a 10MB body.
+	memoryLimitPages = 512
+)
+
+func init() {
+	server.RegisterMiddleware("wasm", func(config string) (server.Middleware, error) {
+		host, path, ok := strings.Cut(config, "=")
+		if !ok || strings.TrimSpace(host) == "" || strings.TrimSpace(path) == "" {
+			return nil, errors.New("expected host=/path/to/filter.wasm")
+		}
+		return Load(context.Background(), strings.TrimSpace(host), strings.TrimSpace(path))
+	})
+}
+
+// Filter is a compiled WASM module applied to requests whose hostname matches
+// its host pattern ("*", "*.example.com" or an exact hostname). Every call
+// gets a fresh instance, so filters cannot leak state between requests.
+type Filter struct {
+	host     string
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+func Load(ctx context.Context, host, path string) (*Filter, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(ctx, host, path, code)
+}
+
+func New(ctx context.Context, host, name string, code []byte) (*Filter, error) {
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(memoryLimitPages))
+	if err := instantiateHostModule(ctx, rt); err != nil {
+		_ = rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, code)
+	if err != nil {
+		_ = rt.Close(ctx)
+		return nil, fmt.Errorf("compile wasm filter %s: %w", name, err)
+	}
+	return &Filter{
+		host:     strings.ToLower(host),
+		name:     name,
+		runtime:  rt,
+		compiled: compiled,
+	}, nil
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	return f.runtime.Close(ctx)
+}
+
+func (f *Filter) Matches(hostname string) bool {
+	switch {
+	case f.host == "*":
+		return true
+	case strings.HasPrefix(f.host, "*."):
+		return strings.HasSuffix(hostname, f.host[1:])
+	default:
+		return hostname == f.host
+	}
+}
+
+func (f *Filter) OnRequest(req *server.Request) *server.Rejection {
+	if !f.Matches(req.Hostname) {
+		return nil
+	}
+	state := &callState{req: req}
+	if err := f.call("on_request", state); err != nil {
+		slog.Warn("wasm filter on_request failed", "filter", f.name, "hostname", req.Hostname, "err", err)
+		return &server.Rejection{Status: http.StatusBadGateway, Body: "filter error"}
+	}
+	if state.local != nil {
+		return &server.Rejection{Status: state.local.Status, Headers: state.local.Headers, Body: string(state.local.Body)}
+	}
+	return nil
+}
+
+func (f *Filter) OnResponse(req *server.Request, resp *server.Response) {
+	if !f.Matches(req.Hostname) {
+		return
+	}
+	state := &callState{req: req, resp: resp}
+	if err := f.call("on_response", state); err != nil {
+		slog.Warn("wasm filter on_response failed", "filter", f.name, "hostname", req.Hostname, "err", err)
+		*resp = server.Response{Status: http.StatusBadGateway, Body: []byte("filter error")}
+		return
+	}
+	if state.local != nil {
+		*resp = *state.local
+	}
+}
+
+func (f *Filter) call(export string, state *callState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, callStateKey{}, state)
+
+	// Anonymous instances may coexist, which lets requests run concurrently.
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return err
+	}
+	defer mod.Close(ctx)
+
+	fn := mod.ExportedFunction(export)
+	if fn == nil {
+		return nil
+	}
+	_, err = fn.Call(ctx)
+	return err
+}
+
+type callStateKey struct{}
+
+type callState struct {
+	req   *server.Request
+	resp  *server.Response
+	local *server.Response
+}
+
+func (c *callState) headers() map[string][]string {
+	if c.resp != nil {
+		if c.resp.Headers == nil {
+			c.resp.Headers = map[string][]string{}
+		}
+		return c.resp.Headers
+	}
+	if c.req.Headers == nil {
+		c.req.Headers = map[string][]string{}
+	}
+	return c.req.Headers
+}
+
+func (c *callState) body() *[]byte {
+	if c.resp != nil {
+		return &c.resp.Body
+	}
+	return &c.req.Body
+}
+
+func (c *callState) property(name string) (string, bool) {
+	switch name {
+	case "method":
+		return c.req.Method, true
+	case "path":
+		return c.req.Path, true
+	case "query":
+		return c.req.Query, true
+	case "host":
+		return c.req.Hostname, true
+	case "client_ip":
+		return c.req.ClientIP, true
+	case "target":
+		return c.req.Target, true
+	case "status":
+		if c.resp != nil {
+			return strconv.Itoa(c.resp.Status), true
+		}
+	}
+	return "", false
+}
+
+func (c *callState) setProperty(name, value string) {
+	switch name {
+	case "method":
+		c.req.Method = value
+	case "path":
+		c.req.Path = value
+	case "query":
+		c.req.Query = value
+	case "target":
+		c.req.Target = value
+	case "status":
+		if n, err := strconv.Atoi(value); err == nil && c.resp != nil {
+			c.resp.Status = n
+		}
+	}
+}
+
+func stateFrom(ctx context.Context) *callState {
+	state, _ := ctx.Value(callStateKey{}).(*callState)
+	return state
+}
+
+func readString(m api.Module, ptr, length uint32) string {
+	b, ok := m.Memory().Read(ptr, length)
+	if !ok {
+		panic(fmt.Sprintf("out of bounds memory access ptr=%d len=%d", ptr, length))
+	}
+	return string(b)
+}
+
+func writeValue(m api.Module, value []byte, buf, bufCap uint32) int32 {
+	if uint32(len(value)) <= bufCap && len(value) > 0 {
+		if !m.Memory().Write(buf, value) {
+			panic(fmt.Sprintf("out of bounds memory access ptr=%d len=%d", buf, len(value)))
+		}
+	}
+	return int32(len(value))
+}
+
+func instantiateHostModule(ctx context.Context, rt wazero.Runtime) error {
+	_, err := rt.NewHostModuleBuilder("tunnel").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen, buf, bufCap uint32) int32 {
+		values, ok := stateFrom(ctx).headers()[http.CanonicalHeaderKey(readString(m, name, nameLen))]
+		if !ok || len(values) == 0 {
+			return -1
+		}
+		return writeValue(m, []byte(strings.Join(values, ", ")), buf, bufCap)
+	}).Export("get_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen, value, valueLen uint32) {
+		stateFrom(ctx).headers()[http.CanonicalHeaderKey(readString(m, name, nameLen))] = []string{readString(m, value, valueLen)}
+	}).Export("set_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen uint32) {
+		delete(stateFrom(ctx).headers(), http.CanonicalHeaderKey(readString(m, name, nameLen)))
+	}).Export("remove_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, buf, bufCap uint32) int32 {
+		return writeValue(m, *stateFrom(ctx).body(), buf, bufCap)
+	}).Export("get_body").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, buf, length uint32) {
+		*stateFrom(ctx).body() = []byte(readString(m, buf, length))
+	}).Export("set_body").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen, buf, bufCap uint32) int32 {
+		value, ok := stateFrom(ctx).property(readString(m, name, nameLen))
+		if !ok {
+			return -1
+		}
+		return writeValue(m, []byte(value), buf, bufCap)
+	}).Export("get_property").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen, value, valueLen uint32) {
+		stateFrom(ctx).setProperty(readString(m, name, nameLen), readString(m, value, valueLen))
+	}).Export("set_property").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, status, body, bodyLen uint32) {
+		stateFrom(ctx).local = &server.Response{
+			Status:  int(status),
+			Headers: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:    []byte(readString(m, body, bodyLen)),
+		}
+	}).Export("send_response").
+		NewFunctionBuilder().WithFunc(func(_ context.Context, m api.Module, msg, msgLen uint32) {
+		slog.Info("wasm filter", "message", readString(m, msg, msgLen))
+	}).Export("log").
+		Instantiate(ctx)
+	return err
+}
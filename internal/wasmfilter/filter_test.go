@@ -0,0 +1,162 @@
+package wasmfilter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"tunneling/internal/server"
+)
+
+// hostCall is one call to an imported "tunnel" function with i32 constant args.
+type hostCall struct {
+	name string
+	args []int32
+}
+
+// buildModule assembles a minimal filter whose on_request performs calls in
+// order, with data copied into memory at the given offsets.
+func buildModule(data map[int32]string, calls []hostCall) []byte {
+	var imports []string
+	index := map[string]int{}
+	arity := map[string]int{}
+	for _, c := range calls {
+		if _, ok := index[c.name]; !ok {
+			index[c.name] = len(imports)
+			arity[c.name] = len(c.args)
+			imports = append(imports, c.name)
+		}
+	}
+
+	var types, importSec []byte
+	types = append(types, uleb(uint32(len(imports)+1))...)
+	for _, name := range imports {
+		types = append(types, 0x60, byte(arity[name]))
+		for i := 0; i < arity[name]; i++ {
+			types = append(types, 0x7f)
+		}
+		types = append(types, 0x00)
+	}
+	types = append(types, 0x60, 0x00, 0x00)
+
+	importSec = append(importSec, uleb(uint32(len(imports)))...)
+	for i, name := range imports {
+		importSec = append(importSec, str("tunnel")...)
+		importSec = append(importSec, str(name)...)
+		importSec = append(importSec, 0x00, byte(i))
+	}
+
+	funcs := []byte{0x01, byte(len(imports))}
+	memory := []byte{0x01, 0x00, 0x01}
+
+	var exports []byte
+	exports = append(exports, 0x02)
+	exports = append(exports, str("memory")...)
+	exports = append(exports, 0x02, 0x00)
+	exports = append(exports, str("on_request")...)
+	exports = append(exports, 0x00, byte(len(imports)))
+
+	body := []byte{0x00}
+	for _, c := range calls {
+		for _, arg := range c.args {
+			body = append(body, 0x41)
+			body = append(body, sleb(arg)...)
+		}
+		body = append(body, 0x10, byte(index[c.name]))
+	}
+	body = append(body, 0x0b)
+	code := append([]byte{0x01}, uleb(uint32(len(body)))...)
+	code = append(code, body...)
+
+	dataSec := uleb(uint32(len(data)))
+	for offset, value := range data {
+		dataSec = append(dataSec, 0x00, 0x41)
+		dataSec = append(dataSec, sleb(offset)...)
+		dataSec = append(dataSec, 0x0b)
+		dataSec = append(dataSec, str(value)...)
+	}
+
+	out := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	for _, sec := range []struct {
+		id      byte
+		payload []byte
+	}{{1, types}, {2, importSec}, {3, funcs}, {5, memory}, {7, exports}, {10, code}, {11, dataSec}} {
+		out = append(out, sec.id)
+		out = append(out, uleb(uint32(len(sec.payload)))...)
+		out = append(out, sec.payload...)
+	}
+	return out
+}
+
+func uleb(v uint32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func sleb(v int32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func str(s string) []byte {
+	return append(uleb(uint32(len(s))), s...)
+}
+
+func TestFilterMutatesRequest(t *testing.T) {
+	code := buildModule(map[int32]string{0: "X-Wasm", 16: "on", 32: "path", 48: "/filtered"}, []hostCall{
+		{name: "set_header", args: []int32{0, 6, 16, 2}},
+		{name: "set_property", args: []int32{32, 4, 48, 9}},
+	})
+	f, err := New(context.Background(), "*.example.com", "test", code)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer f.Close(context.Background())
+
+	req := &server.Request{Hostname: "app.example.com", Path: "/", Headers: map[string][]string{}}
+	if rej := f.OnRequest(req); rej != nil {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+	if got := req.Headers["X-Wasm"]; len(got) != 1 || got[0] != "on" {
+		t.Fatalf("X-Wasm = %v", got)
+	}
+	if req.Path != "/filtered" {
+		t.Fatalf("Path = %q", req.Path)
+	}
+
+	other := &server.Request{Hostname: "other.test", Path: "/", Headers: map[string][]string{}}
+	if f.OnRequest(other); other.Path != "/" {
+		t.Fatalf("filter applied to non-matching host")
+	}
+}
+
+func TestFilterSendResponseRejects(t *testing.T) {
+	code := buildModule(map[int32]string{0: "denied"}, []hostCall{
+		{name: "send_response", args: []int32{http.StatusForbidden, 0, 6}},
+	})
+	f, err := New(context.Background(), "*", "test", code)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer f.Close(context.Background())
+
+	rej := f.OnRequest(&server.Request{Hostname: "a.test"})
+	if rej == nil || rej.Status != http.StatusForbidden || rej.Body != "denied" {
+		t.Fatalf("rejection = %+v", rej)
+	}
+}
@@ -0,0 +1,35 @@
+package wsconn
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+// ReadEnvelope reads one frame, decoding text frames as JSON and binary
+// frames with protocol.DecodeBinary.
+func ReadEnvelope(conn Conn) (protocol.Envelope, error) {
+	kind, data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Envelope{}, err
+	}
+	switch kind {
+	case websocket.TextMessage:
+		return protocol.DecodeJSON(data)
+	case websocket.BinaryMessage:
+		return protocol.DecodeBinary(data)
+	default:
+		return protocol.Envelope{}, fmt.Errorf("unexpected websocket message type %d", kind)
+	}
+}
+
+func encodeEnvelope(env protocol.Envelope, binary bool) (int, []byte, error) {
+	if binary {
+		data, err := protocol.EncodeBinary(env)
+		return websocket.BinaryMessage, data, err
+	}
+	data, err := protocol.EncodeJSON(env)
+	return websocket.TextMessage, data, err
+}
@@ -0,0 +1,35 @@
+package wsconn
+
+import (
+	"net"
+	"time"
+)
+
+// Conn is the message connection between an agent and the server: a
+// *websocket.Conn, or a transport that carries the same messages and
+// control frames some other way (see internal/muxconn).
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	SetReadLimit(limit int64)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// RequestConn is a Conn that gives every proxied request a stream of its
+// own, so a request whose peer is slow to read holds up only itself.
+type RequestConn interface {
+	Conn
+	// WriteRequestMessage writes a message of request requestID on the
+	// request's stream. open is set for the message that starts the request;
+	// the side that opens streams does so then. Messages of requests without
+	// a stream go on the main one.
+	WriteRequestMessage(requestID string, open bool, messageType int, data []byte) error
+	// Release ends this side of the request's stream once nothing more is
+	// expected on it.
+	Release(requestID string)
+}
@@ -0,0 +1,51 @@
+package wsconn
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultPingInterval stays well under the idle timeout of common NATs and
+// load balancers.
+const DefaultPingInterval = 20 * time.Second
+
+// Keepalive pings the peer every interval until done is closed and makes
+// reads on conn fail once nothing but silence has come back for three
+// intervals, so a connection dropped by the network is noticed instead of
+// hanging forever. Peers answer pings on their own (gorilla replies from
+// its read loop), so only one side needs to support it. Call it before the
+// read loop starts.
+func Keepalive(conn Conn, interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	wait := 3 * interval
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// IsKeepaliveTimeout reports whether a read failed because the peer stopped
+// answering pings.
+func IsKeepaliveTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
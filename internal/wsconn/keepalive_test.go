@@ -0,0 +1,67 @@
+package wsconn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKeepaliveDetectsSilentPeer(t *testing.T) {
+	readPeer := make(chan bool, 2)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if <-readPeer {
+			// Reading is what makes gorilla answer pings.
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	dial := func(answer bool) *websocket.Conn {
+		readPeer <- answer
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		done := make(chan struct{})
+		t.Cleanup(func() { close(done); _ = conn.Close() })
+		Keepalive(conn, 20*time.Millisecond, done)
+		return conn
+	}
+
+	alive := dial(true)
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := alive.ReadMessage()
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		t.Fatalf("answering peer was dropped: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	silent := dial(false)
+	start := time.Now()
+	_, _, err := silent.ReadMessage()
+	if !IsKeepaliveTimeout(err) {
+		t.Fatalf("read from silent peer = %v, want keepalive timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("silent peer noticed after %s", elapsed)
+	}
+}
@@ -0,0 +1,201 @@
+package wsconn
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+var (
+	ErrStreamAborted = errors.New("stream aborted")
+	ErrStreamIdle    = errors.New("stream idle timeout")
+)
+
+// Inbound turns the data frames of one streamed body back into an io.Reader.
+// The sender may only have protocol.StreamWindow data frames in flight, so
+// Push never has to block the connection's read loop; ack is called for each
+// data frame handed to the reader and should grant the sender one more.
+type Inbound struct {
+	frames chan protocol.Envelope
+	ack    func()
+	idle   time.Duration
+
+	cur      []byte
+	err      error
+	trailers map[string][]string
+
+	abortOnce sync.Once
+	aborted   chan struct{}
+	abortErr  error
+}
+
+func NewInbound(idle time.Duration, ack func()) *Inbound {
+	return &Inbound{
+		frames:  make(chan protocol.Envelope, protocol.StreamWindow+1),
+		ack:     ack,
+		idle:    idle,
+		aborted: make(chan struct{}),
+	}
+}
+
+// Push hands a frame to the reader. It returns false if the sender overran
+// its window, in which case the frame is dropped.
+func (in *Inbound) Push(env protocol.Envelope) bool {
+	select {
+	case in.frames <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetIdle changes how long Read waits for the next frame; zero waits until
+// the stream ends or is aborted. Call it from the reading goroutine.
+func (in *Inbound) SetIdle(d time.Duration) {
+	in.idle = d
+}
+
+// Abort unblocks a pending Read with err (ErrStreamAborted if nil).
+func (in *Inbound) Abort(err error) {
+	in.abortOnce.Do(func() {
+		if err == nil {
+			err = ErrStreamAborted
+		}
+		in.abortErr = err
+		close(in.aborted)
+	})
+}
+
+func (in *Inbound) Read(p []byte) (int, error) {
+	for len(in.cur) == 0 {
+		if in.err != nil {
+			return 0, in.err
+		}
+		if err := in.next(); err != nil {
+			in.err = err
+		}
+	}
+	n := copy(p, in.cur)
+	in.cur = in.cur[n:]
+	return n, nil
+}
+
+func (in *Inbound) next() error {
+	var timeout <-chan time.Time
+	if in.idle > 0 {
+		timer := time.NewTimer(in.idle)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case env := <-in.frames:
+		if env.End {
+			in.trailers = env.Trailers
+			if env.Message != "" {
+				return errors.New(env.Message)
+			}
+			return io.EOF
+		}
+		in.cur = env.Payload
+		if in.ack != nil {
+			in.ack()
+		}
+		return nil
+	case <-in.aborted:
+		return in.abortErr
+	case <-timeout:
+		return ErrStreamIdle
+	}
+}
+
+// Trailers returns the trailers sent with the end frame, once Read has
+// returned io.EOF.
+func (in *Inbound) Trailers() map[string][]string {
+	return in.trailers
+}
+
+// Credit limits the data frames a sender has in flight for one stream.
+type Credit chan struct{}
+
+func NewCredit() Credit {
+	c := make(Credit, protocol.StreamWindow)
+	for i := 0; i < protocol.StreamWindow; i++ {
+		c <- struct{}{}
+	}
+	return c
+}
+
+// Acquire waits for the receiver to grant room for one more data frame.
+func (c Credit) Acquire(timeout time.Duration, done <-chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c:
+		return nil
+	case <-done:
+		return ErrStreamAborted
+	case <-timer.C:
+		return ErrStreamIdle
+	}
+}
+
+func (c Credit) Release() {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// SendBody streams r as data frames built by frame, waiting for credit before
+// each one, and finishes with an end frame carrying trailers(). The end frame
+// carries the read error message if r fails midway.
+func SendBody(r io.Reader, credit Credit, timeout time.Duration, done <-chan struct{}, frame func(end bool) protocol.Envelope, send func(protocol.Envelope) error, trailers func() map[string][]string) error {
+	return sendBody(r, false, credit, timeout, done, frame, send, trailers)
+}
+
+// SendBodyLive is SendBody for bodies written a bit at a time, such as
+// Server-Sent Events: whatever a read returns goes out at once instead of
+// waiting for a whole chunk.
+func SendBodyLive(r io.Reader, credit Credit, timeout time.Duration, done <-chan struct{}, frame func(end bool) protocol.Envelope, send func(protocol.Envelope) error, trailers func() map[string][]string) error {
+	return sendBody(r, true, credit, timeout, done, frame, send, trailers)
+}
+
+func sendBody(r io.Reader, live bool, credit Credit, timeout time.Duration, done <-chan struct{}, frame func(end bool) protocol.Envelope, send func(protocol.Envelope) error, trailers func() map[string][]string) error {
+	buf := make([]byte, protocol.StreamChunkSize)
+	for {
+		var n int
+		var readErr error
+		if live {
+			n, readErr = r.Read(buf)
+		} else {
+			n, readErr = io.ReadFull(r, buf)
+		}
+		if n > 0 {
+			if err := credit.Acquire(timeout, done); err != nil {
+				return err
+			}
+			env := frame(false)
+			env.Payload = append([]byte(nil), buf[:n]...)
+			if err := send(env); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF || !live && readErr == io.ErrUnexpectedEOF {
+			env := frame(true)
+			if trailers != nil {
+				env.Trailers = trailers()
+			}
+			return send(env)
+		}
+		if readErr != nil {
+			env := frame(true)
+			env.Message = "read body failed: " + readErr.Error()
+			_ = send(env)
+			return readErr
+		}
+	}
+}
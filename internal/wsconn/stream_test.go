@@ -0,0 +1,88 @@
+package wsconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+func TestSendBodyThroughInbound(t *testing.T) {
+	payload := make([]byte, 10*protocol.StreamChunkSize*protocol.StreamWindow+123)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+
+	credit := NewCredit()
+	in := NewInbound(5*time.Second, credit.Release)
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- SendBody(bytes.NewReader(payload), credit, 5*time.Second, done,
+			func(end bool) protocol.Envelope {
+				return protocol.Envelope{Type: protocol.TypeProxyResponseData, End: end}
+			},
+			func(env protocol.Envelope) error {
+				if !in.Push(env) {
+					t.Errorf("sender overran the window")
+				}
+				return nil
+			},
+			func() map[string][]string { return map[string][]string{"X-Sum": {"ok"}} },
+		)
+	}()
+
+	got, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("SendBody() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("body mismatch: got %d bytes, want %d", len(got), len(payload))
+	}
+	if in.Trailers()["X-Sum"][0] != "ok" {
+		t.Fatalf("trailers = %v", in.Trailers())
+	}
+}
+
+func TestInboundAbortUnblocksRead(t *testing.T) {
+	in := NewInbound(0, nil)
+	go in.Abort(nil)
+	if _, err := in.Read(make([]byte, 1)); err != ErrStreamAborted {
+		t.Fatalf("Read() error = %v, want ErrStreamAborted", err)
+	}
+}
+
+func TestSendBodyLiveForwardsEachWrite(t *testing.T) {
+	pr, pw := io.Pipe()
+	frames := make(chan protocol.Envelope, protocol.StreamWindow)
+	go func() {
+		_ = SendBodyLive(pr, NewCredit(), 5*time.Second, nil,
+			func(end bool) protocol.Envelope { return protocol.Envelope{End: end} },
+			func(env protocol.Envelope) error { frames <- env; return nil },
+			nil,
+		)
+	}()
+	for _, event := range []string{"data: one\n\n", "data: two\n\n"} {
+		if _, err := pw.Write([]byte(event)); err != nil {
+			t.Fatalf("write event: %v", err)
+		}
+		select {
+		case env := <-frames:
+			if string(env.Payload) != event {
+				t.Fatalf("frame = %q, want %q", env.Payload, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %q not sent before the chunk filled up", event)
+		}
+	}
+	_ = pw.Close()
+	if env := <-frames; !env.End {
+		t.Fatalf("last frame = %+v, want end", env)
+	}
+}
@@ -0,0 +1,186 @@
+package wsconn
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunneling/internal/protocol"
+)
+
+const (
+	DefaultQueueSize    = 256
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var (
+	ErrQueueFull = errors.New("write queue full")
+	ErrClosed    = errors.New("connection closed")
+)
+
+// Writer owns all data writes to a connection. Envelopes are put on
+// a bounded queue and written by a single goroutine, so a slow peer blocks
+// only that goroutine instead of every caller.
+//
+// Stream data frames wait on a queue of their own that is only served while
+// the main one is empty. Per-stream windows keep one stream from queueing
+// more than protocol.StreamWindow frames, but without the second queue a few
+// large transfers would still hold every small request and response head
+// behind up to a window of 32KB chunks each.
+type Writer struct {
+	conn         Conn
+	queue        chan protocol.Envelope
+	bulk         chan protocol.Envelope
+	done         chan struct{}
+	closeOnce    sync.Once
+	writeTimeout time.Duration
+
+	binary  atomic.Bool
+	dropped atomic.Uint64
+	written atomic.Uint64
+}
+
+func NewWriter(conn Conn, queueSize int, writeTimeout time.Duration) *Writer {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	w := &Writer{
+		conn:         conn,
+		queue:        make(chan protocol.Envelope, queueSize),
+		bulk:         make(chan protocol.Envelope, queueSize),
+		done:         make(chan struct{}),
+		writeTimeout: writeTimeout,
+	}
+	go w.loop()
+	return w
+}
+
+// Send queues env for writing. When the queue is full it waits up to wait for
+// room and then drops the envelope with ErrQueueFull.
+func (w *Writer) Send(env protocol.Envelope, wait time.Duration) error {
+	select {
+	case <-w.done:
+		return ErrClosed
+	default:
+	}
+
+	queue := w.queue
+	if isBulk(env.Type) {
+		queue = w.bulk
+	}
+	select {
+	case queue <- env:
+		return nil
+	default:
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case queue <- env:
+			return nil
+		case <-w.done:
+			return ErrClosed
+		case <-timer.C:
+		}
+	}
+	w.dropped.Add(1)
+	return ErrQueueFull
+}
+
+// isBulk reports whether envelopes of type t go on the stream data queue.
+// A stream's head is queued before its first data frame, so serving the
+// main queue first never reorders a stream.
+func isBulk(t string) bool {
+	return t == protocol.TypeProxyRequestData || t == protocol.TypeProxyResponseData
+}
+
+func (w *Writer) loop() {
+	for {
+		var env protocol.Envelope
+		select {
+		case <-w.done:
+			return
+		case env = <-w.queue:
+		default:
+			select {
+			case <-w.done:
+				return
+			case env = <-w.queue:
+			case env = <-w.bulk:
+			}
+		}
+		if env.Type == "" {
+			// Queued by Release.
+			w.conn.(RequestConn).Release(env.RequestID)
+			continue
+		}
+		kind, data, err := encodeEnvelope(env, w.binary.Load())
+		if err != nil {
+			slog.Error("encode envelope failed", "type", env.Type, "err", err)
+			continue
+		}
+		_ = w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		if err := w.write(env, kind, data); err != nil {
+			// A failed write leaves the stream in an unknown state; closing
+			// the socket makes the reader side notice and reconnect.
+			w.Close()
+			_ = w.conn.Close()
+			return
+		}
+		w.written.Add(1)
+	}
+}
+
+func (w *Writer) write(env protocol.Envelope, kind int, data []byte) error {
+	if rc, ok := w.conn.(RequestConn); ok && env.RequestID != "" {
+		return rc.WriteRequestMessage(env.RequestID, env.Type == protocol.TypeProxyRequest, kind, data)
+	}
+	return w.conn.WriteMessage(kind, data)
+}
+
+// Release ends the stream of requestID on a RequestConn once everything
+// queued for the request before it has been written. Without one it does
+// nothing. A release that finds the queue full for a second leaves the
+// stream open until the connection closes.
+func (w *Writer) Release(requestID string) {
+	if _, ok := w.conn.(RequestConn); !ok {
+		return
+	}
+	_ = w.Send(protocol.Envelope{RequestID: requestID}, time.Second)
+}
+
+// SetBinary switches subsequent frames to the binary encoding once the peer
+// has advertised protocol.CapBinary.
+func (w *Writer) SetBinary(v bool) {
+	w.binary.Store(v)
+}
+
+func (w *Writer) Close() {
+	w.closeOnce.Do(func() { close(w.done) })
+}
+
+func (w *Writer) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *Writer) Depth() int {
+	return len(w.queue) + len(w.bulk)
+}
+
+func (w *Writer) Capacity() int {
+	return cap(w.queue) + cap(w.bulk)
+}
+
+func (w *Writer) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+func (w *Writer) Written() uint64 {
+	return w.written.Load()
+}
@@ -0,0 +1,188 @@
+package wsconn
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+)
+
+func TestWriterDropsWhenPeerStalls(t *testing.T) {
+	release := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-release // never read, so the client's socket buffers fill up
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	w := NewWriter(conn, 2, 5*time.Second)
+	defer w.Close()
+
+	body := strings.Repeat("x", 1<<20)
+	var full bool
+	for i := 0; i < 200 && !full; i++ {
+		err := w.Send(protocol.Envelope{Type: protocol.TypeProxyResponse, Body: body}, 0)
+		switch {
+		case errors.Is(err, ErrQueueFull):
+			full = true
+		case err != nil:
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if !full {
+		t.Fatalf("expected queue to fill while peer is stalled")
+	}
+	if w.Dropped() == 0 {
+		t.Fatalf("expected dropped counter to be incremented")
+	}
+
+	w.Close()
+	if err := w.Send(protocol.Envelope{Type: protocol.TypeError}, 0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("send after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestWriterSendsHeadsBeforeQueuedStreamData(t *testing.T) {
+	got := make(chan string, 8)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			env, err := ReadEnvelope(conn)
+			if err != nil {
+				return
+			}
+			got <- env.Type
+		}
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Fill both queues before the write loop starts, as a busy download would.
+	w := &Writer{
+		conn:         conn,
+		queue:        make(chan protocol.Envelope, 4),
+		bulk:         make(chan protocol.Envelope, 4),
+		done:         make(chan struct{}),
+		writeTimeout: DefaultWriteTimeout,
+	}
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		if err := w.Send(protocol.Envelope{Type: protocol.TypeProxyResponseData, RequestID: "big"}, 0); err != nil {
+			t.Fatalf("send data: %v", err)
+		}
+	}
+	if err := w.Send(protocol.Envelope{Type: protocol.TypeProxyResponse, RequestID: "small"}, 0); err != nil {
+		t.Fatalf("send response: %v", err)
+	}
+	if w.Depth() != 4 {
+		t.Fatalf("depth = %d, want 4", w.Depth())
+	}
+	go w.loop()
+
+	want := []string{protocol.TypeProxyResponse, protocol.TypeProxyResponseData, protocol.TypeProxyResponseData, protocol.TypeProxyResponseData}
+	for i, typ := range want {
+		select {
+		case sent := <-got:
+			if sent != typ {
+				t.Fatalf("message %d = %s, want %s", i, sent, typ)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d not written", i)
+		}
+	}
+}
+
+// requestConn records how the Writer hands it messages.
+type requestConn struct {
+	Conn
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *requestConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *requestConn) WriteMessage(int, []byte) error {
+	c.record("main")
+	return nil
+}
+
+func (c *requestConn) WriteRequestMessage(requestID string, open bool, _ int, _ []byte) error {
+	c.record(fmt.Sprintf("%s open=%v", requestID, open))
+	return nil
+}
+
+func (c *requestConn) Release(requestID string) {
+	c.record("release " + requestID)
+}
+
+func (c *requestConn) record(e string) {
+	c.mu.Lock()
+	c.events = append(c.events, e)
+	c.mu.Unlock()
+}
+
+func TestWriterRoutesRequestMessages(t *testing.T) {
+	conn := &requestConn{}
+	w := NewWriter(conn, 8, time.Second)
+	defer w.Close()
+
+	for _, env := range []protocol.Envelope{
+		{Type: protocol.TypeHello},
+		{Type: protocol.TypeProxyRequest, RequestID: "r1"},
+		{Type: protocol.TypeProxyCancel, RequestID: "r1"},
+	} {
+		if err := w.Send(env, 0); err != nil {
+			t.Fatalf("send %s: %v", env.Type, err)
+		}
+	}
+	w.Release("r1")
+
+	want := []string{"main", "r1 open=true", "r1 open=false", "release r1"}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn.mu.Lock()
+		got := append([]string(nil), conn.events...)
+		conn.mu.Unlock()
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("writes = %q, want %q", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := w.Written(); n != 3 {
+		t.Fatalf("written = %d, want 3", n)
+	}
+}
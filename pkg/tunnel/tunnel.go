@@ -0,0 +1,360 @@
+// Package tunnel embeds a tunneling agent in a Go program. Listen registers a
+// public hostname with the tunnel server and hands every request that arrives
+// for it to the caller as a net.Conn, so any http.Server can serve it without
+// running the separate agent binary.
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunneling/internal/protocol"
+	"tunneling/internal/version"
+	"tunneling/internal/wsconn"
+)
+
+const (
+	maxBodySize = 10 << 20
+	sendWait    = 2 * time.Second
+)
+
+// sdkCaps leaves out streaming: bodies are buffered on both sides.
+var sdkCaps = []string{protocol.CapBinary, protocol.CapCancel}
+
+// Options selects the tunnel server and the hostname to serve.
+type Options struct {
+	// Server is the agent endpoint, e.g. ws://your-server:9000/connect.
+	Server string
+	Token  string
+	// TunnelID is required when the server verifies agent tokens.
+	TunnelID string
+	Hostname string
+}
+
+// Listener is a net.Listener whose connections each carry one public HTTP
+// request. It reconnects to the server until closed.
+type Listener struct {
+	opts   Options
+	conns  chan net.Conn
+	done   chan struct{}
+	cancel context.CancelFunc
+	once   sync.Once
+
+	mu       sync.Mutex
+	writer   *wsconn.Writer
+	resume   string
+	inflight map[string]net.Conn
+}
+
+// Listen connects to the tunnel server and registers opts.Hostname. It fails
+// if the first connection cannot be established.
+func Listen(ctx context.Context, opts Options) (*Listener, error) {
+	opts.Server = strings.TrimSpace(opts.Server)
+	opts.Hostname = strings.ToLower(strings.TrimSpace(opts.Hostname))
+	if opts.Server == "" || opts.Token == "" || opts.Hostname == "" {
+		return nil, errors.New("tunnel: Server, Token and Hostname are required")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Listener{
+		opts:     opts,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+		inflight: make(map[string]net.Conn),
+	}
+	conn, err := l.dial(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go l.run(ctx, conn)
+	context.AfterFunc(ctx, func() { _ = l.Close() })
+	return l, nil
+}
+
+// Serve exposes h on opts.Hostname until ctx is done.
+func Serve(ctx context.Context, opts Options, h http.Handler) error {
+	l, err := Listen(ctx, opts)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h}
+	stop := context.AfterFunc(ctx, func() { _ = srv.Close() })
+	defer stop()
+	err = srv.Serve(l)
+	if ctx.Err() != nil || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.cancel()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return addr(l.opts.Hostname) }
+
+func (l *Listener) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(l.opts.Server)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: parse server url: %w", err)
+	}
+	q := u.Query()
+	if l.opts.TunnelID != "" {
+		q.Set("tunnel_id", l.opts.TunnelID)
+	}
+	q.Set("caps", strings.Join(sdkCaps, ","))
+	l.mu.Lock()
+	if l.resume != "" {
+		q.Set("resume", l.resume)
+	}
+	l.mu.Unlock()
+	u.RawQuery = q.Encode()
+
+	// The token goes in a header so it stays out of proxy access logs.
+	header := http.Header{"Authorization": {"Bearer " + l.opts.Token}}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("tunnel: connect server: %s: %w", resp.Status, err)
+		}
+		return nil, fmt.Errorf("tunnel: connect server: %w", err)
+	}
+	conn.SetReadLimit(maxBodySize + (2 << 20))
+	return conn, nil
+}
+
+func (l *Listener) run(ctx context.Context, conn *websocket.Conn) {
+	backoff := time.Second
+	for {
+		l.serve(ctx, conn)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > 10*time.Second {
+				backoff = 10 * time.Second
+			}
+			var err error
+			if conn, err = l.dial(ctx); err == nil {
+				backoff = time.Second
+				break
+			}
+		}
+	}
+}
+
+func (l *Listener) serve(ctx context.Context, conn *websocket.Conn) {
+	writer := wsconn.NewWriter(conn, wsconn.DefaultQueueSize, wsconn.DefaultWriteTimeout)
+	wsconn.Keepalive(conn, wsconn.DefaultPingInterval, writer.Done())
+	l.mu.Lock()
+	l.writer = writer
+	l.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer func() {
+		stop()
+		l.mu.Lock()
+		if l.writer == writer {
+			l.writer = nil
+		}
+		l.mu.Unlock()
+		writer.Close()
+		_ = conn.Close()
+	}()
+
+	hello := protocol.Envelope{
+		Type:            protocol.TypeHello,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Version:         version.Version,
+		Caps:            sdkCaps,
+	}
+	if l.send(hello) != nil || l.register() != nil {
+		return
+	}
+	for {
+		env, err := wsconn.ReadEnvelope(conn)
+		if err != nil {
+			return
+		}
+		switch env.Type {
+		case protocol.TypeSession:
+			l.mu.Lock()
+			l.resume = env.SessionToken
+			l.mu.Unlock()
+			writer.SetBinary(protocol.HasCap(env.Caps, protocol.CapBinary))
+		case protocol.TypeHello:
+			writer.SetBinary(protocol.HasCap(env.Caps, protocol.CapBinary))
+		case protocol.TypeProxyRequest:
+			go l.handle(env)
+		case protocol.TypeProxyCancel:
+			l.mu.Lock()
+			c := l.inflight[env.RequestID]
+			l.mu.Unlock()
+			if c != nil {
+				_ = c.Close()
+			}
+		case protocol.TypeRouteResync:
+			_ = l.register()
+		}
+	}
+}
+
+func (l *Listener) register() error {
+	routes := []protocol.Route{{Hostname: l.opts.Hostname, Target: "embedded"}}
+	return l.send(protocol.Envelope{Type: protocol.TypeRegisterRoutes, Routes: routes, RoutesVersion: protocol.RoutesVersion(routes)})
+}
+
+func (l *Listener) send(env protocol.Envelope) error {
+	l.mu.Lock()
+	writer := l.writer
+	l.mu.Unlock()
+	if writer == nil {
+		return errors.New("tunnel is offline")
+	}
+	return writer.Send(env, sendWait)
+}
+
+// handle replays one proxied request as HTTP/1.1 over an in-memory pipe whose
+// other end was handed out by Accept, then relays the response.
+func (l *Listener) handle(env protocol.Envelope) {
+	req, err := newRequest(env)
+	if err != nil {
+		l.reply(env.RequestID, errorResponse(http.StatusBadGateway, "bad proxied request"))
+		return
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	l.mu.Lock()
+	l.inflight[env.RequestID] = client
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.inflight, env.RequestID)
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.conns <- &conn{Conn: server, remote: remoteAddr(env.Headers)}:
+	case <-l.done:
+		_ = server.Close()
+		l.reply(env.RequestID, errorResponse(http.StatusServiceUnavailable, "listener closed"))
+		return
+	}
+	go func() { _ = req.Write(client) }()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		l.reply(env.RequestID, errorResponse(http.StatusBadGateway, "handler failed: "+err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	// The body is relayed in one message; cutting it short would leave
+	// the client with a body that does not match its Content-Length.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		l.reply(env.RequestID, errorResponse(http.StatusBadGateway, "read response failed: "+err.Error()))
+		return
+	}
+	if len(body) > maxBodySize {
+		l.reply(env.RequestID, errorResponse(http.StatusBadGateway, "response body exceeds the 10MB limit"))
+		return
+	}
+	headers := protocol.CloneHeaders(resp.Header)
+	for _, key := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer"} {
+		delete(headers, key)
+	}
+	var trailers map[string][]string
+	if len(resp.Trailer) > 0 {
+		trailers = protocol.CloneHeaders(resp.Trailer)
+	}
+	l.reply(env.RequestID, protocol.Envelope{Status: resp.StatusCode, Headers: headers, Payload: body, Trailers: trailers})
+}
+
+func (l *Listener) reply(requestID string, env protocol.Envelope) {
+	env.Type = protocol.TypeProxyResponse
+	env.RequestID = requestID
+	_ = l.send(env)
+}
+
+func newRequest(env protocol.Envelope) (*http.Request, error) {
+	target := "http://" + env.Hostname + env.Path
+	if env.Query != "" {
+		target += "?" + env.Query
+	}
+	req, err := http.NewRequest(env.Method, target, bytes.NewReader(env.Payload))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range env.Headers {
+		for _, item := range v {
+			req.Header.Add(k, item)
+		}
+	}
+	req.Header.Del("Connection")
+	if len(env.Trailers) > 0 {
+		req.Trailer = http.Header(protocol.CloneHeaders(env.Trailers))
+	}
+	req.Close = true
+	return req, nil
+}
+
+func errorResponse(status int, msg string) protocol.Envelope {
+	return protocol.Envelope{
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Payload: []byte(msg),
+	}
+}
+
+// remoteAddr reports the public client the gateway saw, so handlers get a
+// meaningful r.RemoteAddr.
+func remoteAddr(headers map[string][]string) net.Addr {
+	// The gateway appends the address it saw last; earlier entries come from
+	// the client and cannot be trusted.
+	if v := headers["X-Forwarded-For"]; len(v) > 0 {
+		parts := strings.Split(v[len(v)-1], ",")
+		if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+			return addr(ip)
+		}
+	}
+	return addr("tunnel")
+}
+
+type addr string
+
+func (a addr) Network() string { return "tunnel" }
+func (a addr) String() string  { return string(a) }
+
+type conn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunneling/internal/server"
+)
+
+func TestServeHandlesPublicRequests(t *testing.T) {
+	ts := server.New(server.Options{RequestTimeout: 5 * time.Second})
+	connects := make(chan *http.Request, 4)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connects <- r.Clone(context.Background())
+		ts.HandleConnect(w, r)
+	}))
+	defer gateway.Close()
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := Options{Server: "ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect", Token: "tok", Hostname: "sdk.test"}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s %s", r.Method, r.Host, r.URL.RequestURI(), body)
+		}))
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("sdk.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("hostname was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	connect := <-connects
+	if got := connect.Header.Get("Authorization"); got != "Bearer tok" {
+		t.Fatalf("Authorization = %q, want the bearer token", got)
+	}
+	if connect.URL.Query().Has("token") {
+		t.Fatalf("token sent in the connect url: %s", connect.URL.RawQuery)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, public.URL+"/echo?x=1", strings.NewReader("ping"))
+	req.Host = "sdk.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "POST sdk.test /echo?x=1 ping" {
+		t.Fatalf("response = %d %q", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after cancel")
+	}
+}
+
+func TestListenFailsWhenServerRefuses(t *testing.T) {
+	refuse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer refuse.Close()
+	_, err := Listen(context.Background(), Options{Server: "ws" + strings.TrimPrefix(refuse.URL, "http"), Token: "bad", Hostname: "sdk.test"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Listen() error = %v, want 401", err)
+	}
+}
+
+func TestOversizedResponseIsRefused(t *testing.T) {
+	ts := server.New(server.Options{RequestTimeout: 30 * time.Second})
+	gateway := httptest.NewServer(http.HandlerFunc(ts.HandleConnect))
+	defer gateway.Close()
+	public := httptest.NewServer(http.HandlerFunc(ts.HandlePublicHTTP))
+	defer public.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := Options{Server: "ws" + strings.TrimPrefix(gateway.URL, "http") + "/connect", Token: "tok", Hostname: "big.test"}
+	go func() {
+		_ = Serve(ctx, opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(make([]byte, maxBodySize+1))
+		}))
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for !ts.HasRoute("big.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("hostname was not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, public.URL+"/", nil)
+	req.Host = "big.test"
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("public request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("refusal took %s; the gateway waited for its timeout", elapsed)
+	}
+}
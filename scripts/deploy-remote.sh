@@ -48,8 +48,9 @@ echo "==> sync public agent binaries from local source"
 "${ROOT_DIR}/scripts/sync-public-agents.sh"
 
 echo "==> build linux binaries locally"
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o "${TMP_DIR}/control" "${ROOT_DIR}/cmd/control"
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o "${TMP_DIR}/server" "${ROOT_DIR}/cmd/server"
+VERSION_LDFLAGS="-X tunneling/internal/version.Version=$(git -C "${ROOT_DIR}" describe --tags --always --dirty 2>/dev/null || echo dev)"
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "${VERSION_LDFLAGS}" -o "${TMP_DIR}/control" "${ROOT_DIR}/cmd/control"
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "${VERSION_LDFLAGS}" -o "${TMP_DIR}/server" "${ROOT_DIR}/cmd/server"
 
 echo "==> sync workspace to ${REMOTE_USER}@${REMOTE_HOST}:${REMOTE_DIR}"
 rsync_cmd -az --delete \
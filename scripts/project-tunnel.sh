@@ -280,6 +280,12 @@ with open(state_file, "w", encoding="utf-8") as f:
 PY
 }
 
+# CONTROL_API_KEY is sent to control planes that run with -api-keys.
+CONTROL_AUTH_ARGS=()
+if [[ -n "${CONTROL_API_KEY:-}" ]]; then
+  CONTROL_AUTH_ARGS=(-H "Authorization: Bearer ${CONTROL_API_KEY}")
+fi
+
 api_post() {
   local url="$1"
   local payload="$2"
@@ -288,6 +294,7 @@ api_post() {
   local status
   status="$(curl -sS -o "${body_file}" -w "%{http_code}" -X POST "${url}" \
     -H "Content-Type: application/json" \
+    ${CONTROL_AUTH_ARGS[@]+"${CONTROL_AUTH_ARGS[@]}"} \
     --data "${payload}")"
   if ((status < 200 || status >= 300)); then
     echo "ERROR: POST ${url} status=${status}" >&2
@@ -304,7 +311,7 @@ api_delete() {
   local body_file
   body_file="$(mktemp)"
   local status
-  status="$(curl -sS -o "${body_file}" -w "%{http_code}" -X DELETE "${url}")"
+  status="$(curl -sS -o "${body_file}" -w "%{http_code}" -X DELETE "${url}" ${CONTROL_AUTH_ARGS[@]+"${CONTROL_AUTH_ARGS[@]}"})"
   if ((status < 200 || status >= 300)); then
     rm -f "${body_file}"
     return 1
@@ -179,8 +179,16 @@ start_component() {
     control)
       require_cmd go
       source_control_env
-      : "${SUPABASE_URL:?SUPABASE_URL is required. Put it in .env.control or export it.}"
-      : "${SUPABASE_SERVICE_ROLE_KEY:?SUPABASE_SERVICE_ROLE_KEY is required. Put it in .env.control or export it.}"
+      case "${CONTROL_STORE:-supabase}" in
+        supabase)
+          : "${SUPABASE_URL:?SUPABASE_URL is required. Put it in .env.control or export it.}"
+          : "${SUPABASE_SERVICE_ROLE_KEY:?SUPABASE_SERVICE_ROLE_KEY is required. Put it in .env.control or export it.}"
+          ;;
+        memory) ;;
+        *)
+          : "${CONTROL_STORE_DSN:?CONTROL_STORE_DSN is required when CONTROL_STORE=${CONTROL_STORE}.}"
+          ;;
+      esac
       release_port "control" "${CONTROL_ADDR#:}" "${pid}"
       (
         cd "${ROOT_DIR}"
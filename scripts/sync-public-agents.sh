@@ -7,6 +7,8 @@ OUT_DIR="${ROOT_DIR}/console/public/releases/latest/download"
 
 mkdir -p "${OUT_DIR}"
 
+VERSION="$(git -C "${ROOT_DIR}" describe --tags --always --dirty 2>/dev/null || echo dev)"
+
 build_agent() {
   local goos="$1"
   local goarch="$2"
@@ -15,7 +17,7 @@ build_agent() {
 
   echo "building: ${out}"
   GOOS="${goos}" GOARCH="${goarch}" CGO_ENABLED=0 \
-    go build -o "${out}" "${ROOT_DIR}/cmd/agent"
+    go build -ldflags "-X tunneling/internal/version.Version=${VERSION}" -o "${out}" "${ROOT_DIR}/cmd/agent"
   chmod 0755 "${out}" || true
 }
 
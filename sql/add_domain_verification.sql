@@ -0,0 +1,9 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加自定义域名验证状态
+-- control 带 -platform-domains 时，平台域名之外的路由创建后为 pending，
+-- 通过 DNS TXT 或 HTTP 验证后变为 verified，pending 路由不下发给 agent
+-- verification 为 NULL 表示无需验证
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS verification TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS verify_token TEXT;
@@ -0,0 +1,19 @@
+-- ==============================================================
+-- control 事件持久化（control 带 -persist-events 启动时写入）
+-- /api/logs 可以查询重启前的历史，按 -event-retention 定期清理
+-- ==============================================================
+
+CREATE TABLE IF NOT EXISTS public.tunnel_events (
+    id          BIGINT PRIMARY KEY,
+    created_at  TIMESTAMPTZ NOT NULL,
+    level       TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    tunnel_id   TEXT,
+    message     TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tunnel_events_created_at ON public.tunnel_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_tunnel_events_tunnel_id  ON public.tunnel_events(tunnel_id, created_at);
+
+-- 只允许 service_role（control）访问
+ALTER TABLE public.tunnel_events ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,11 @@
+-- ==============================================================
+-- 给 tunnel_instances / tunnel_routes 添加过期时间
+-- control 定期删除 expires_at 已过的 tunnel 和路由，过期路由不再下发给 agent
+-- NULL 表示永不过期
+-- ==============================================================
+
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE public.tunnel_routes    ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_tunnel_instances_expires_at ON public.tunnel_instances(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_tunnel_routes_expires_at    ON public.tunnel_routes(expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加 ACME HTTP-01 验证放行开关
+-- 开启后 server 把 /.well-known/acme-challenge/ 的 GET 请求直接转给本地服务，
+-- 不经过该路由的 IP 白名单、访问认证和限流，供自己申请证书的本地服务使用
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS acme_passthrough BOOLEAN NOT NULL DEFAULT FALSE;
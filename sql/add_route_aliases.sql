@@ -0,0 +1,6 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加域名别名
+-- aliases 为 JSON 字符串数组，别名与路由的 hostname 走同一个目标和同一套策略
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS aliases JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加边缘访问保护（Basic Auth / 签名预览链接）
+-- 由 control 随路由下发给 agent，再由 server 在转发前校验
+-- auth 形如 {"basic": ["alice:$2a$10$..."], "token_secret": "..."}，NULL 表示不校验
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS auth JSONB;
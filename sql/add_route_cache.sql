@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加按路由的响应缓存
+-- 由 control 随路由下发，server 在内存中缓存 GET/HEAD 响应
+-- cache 形如 {"default_ttl": "5m", "max_ttl": "1h", "max_entry_bytes": 1048576}，NULL 表示不缓存
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS cache JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加 DNS 记录状态
+-- control 带 -dns-provider 时为平台域名下的路由自动创建 / 删除 DNS 记录
+-- dns_status：pending / active / error: ...，NULL 表示不由 control 管理
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS dns_status TEXT;
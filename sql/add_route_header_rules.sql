@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加按路由的请求头/响应头改写规则
+-- 由 control 随路由下发给 agent，agent 转发到本地服务前后执行
+-- header_rules 形如 {"request": {"set": {"X-Env": "preview"}}, "response": {"remove": ["Server"]}}，NULL 表示不改写
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS header_rules JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加按路由的 IP 白名单/黑名单
+-- 由 control 随路由下发给 agent，再由 server 在转发前执行
+-- ip_filter 形如 {"allow": ["10.0.0.0/8"], "deny": ["10.0.0.9/32"]}，NULL 表示不限制
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS ip_filter JSONB;
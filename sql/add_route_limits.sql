@@ -0,0 +1,9 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加按路由的请求超时和请求体上限
+-- 由 control 随路由下发给 agent，再由 server 执行
+-- timeout 为 Go 时长（如 "2m0s"），NULL 表示用 server 的 -request-timeout
+-- max_body_bytes 为字节数，NULL 表示用 server 默认上限
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS timeout TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS max_body_bytes BIGINT;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加维护模式
+-- maintenance 为 JSON（body、content_type、retry_after），设置期间
+-- server 直接返回 503 维护页，agent 上的路由保持不变
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS maintenance JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加请求镜像
+-- 由 control 随路由下发，server 把一部分请求复制给第二个目标并丢弃其响应
+-- mirror 形如 {"target": "127.0.0.1:3001", "percent": 10}，NULL 表示不镜像
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS mirror JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加限流配置
+-- 由 control 随路由下发给 agent，再由 server 在公网入口执行
+-- 格式：{"rps": 10, "burst": 20, "per_client_ip": true}，NULL 表示使用 server 默认值
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS rate_limit JSONB;
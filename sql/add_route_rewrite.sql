@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加按路由的路径改写和 Host 头改写
+-- 由 control 随路由下发给 agent，agent 转发到本地服务前执行
+-- rewrite 形如 {"strip_prefix": "/app", "add_prefix": "/v2", "host": "target"}，NULL 表示不改写
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS rewrite JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加灰度分流配置
+-- 由 control 随路由下发给 agent，再由 server 按权重选择目标
+-- 格式：{"target": "127.0.0.1:3001", "weight": 10, "sticky": "cookie"}，NULL 表示不分流
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS split JSONB;
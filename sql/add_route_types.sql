@@ -0,0 +1,8 @@
+-- ==============================================================
+-- 给 tunnel_routes 添加跳转和固定响应两种路由类型
+-- redirect / static_response 为 JSON，设置后由 server 直接应答，
+-- 不再下发给 agent
+-- ==============================================================
+
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS redirect JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS static_response JSONB;
@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_instances 添加 agent 信息
+-- agent 为 server 转发的 agent 版本、系统/架构、主机名和标签，
+-- 每次 agent 连接时更新
+-- ==============================================================
+
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS agent JSONB;
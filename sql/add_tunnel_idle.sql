@@ -0,0 +1,7 @@
+-- ==============================================================
+-- 给 tunnel_instances 添加闲置挂起
+-- idle_since 为 control 开启 -idle-after 后标记闲置的时间，
+-- 隧道重新有流量时清空
+-- ==============================================================
+
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS idle_since TIMESTAMPTZ;
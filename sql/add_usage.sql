@@ -0,0 +1,34 @@
+-- ==============================================================
+-- 流量统计（server 带 -usage-report-interval 时定期上报到 /api/usage）
+-- 每个 tunnel、域名、小时一行，上报的增量累加到对应行
+-- ==============================================================
+
+CREATE TABLE IF NOT EXISTS public.tunnel_usage (
+    tunnel_id   TEXT NOT NULL,
+    hostname    TEXT NOT NULL,
+    hour_start  TIMESTAMPTZ NOT NULL,
+    requests    BIGINT NOT NULL DEFAULT 0,
+    bytes_in    BIGINT NOT NULL DEFAULT 0,
+    bytes_out   BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (tunnel_id, hostname, hour_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tunnel_usage_hour_start ON public.tunnel_usage(hour_start);
+
+-- PostgREST 的 upsert 只能覆盖，累加通过这个函数完成
+CREATE OR REPLACE FUNCTION public.add_tunnel_usage(usage_rows JSONB)
+RETURNS VOID
+LANGUAGE sql
+AS $$
+    INSERT INTO public.tunnel_usage AS u (tunnel_id, hostname, hour_start, requests, bytes_in, bytes_out)
+    SELECT r.tunnel_id, r.hostname, r.hour_start, r.requests, r.bytes_in, r.bytes_out
+    FROM jsonb_to_recordset(usage_rows) AS r(tunnel_id TEXT, hostname TEXT, hour_start TIMESTAMPTZ, requests BIGINT, bytes_in BIGINT, bytes_out BIGINT)
+    ON CONFLICT (tunnel_id, hostname, hour_start) DO UPDATE SET
+        requests  = u.requests  + excluded.requests,
+        bytes_in  = u.bytes_in  + excluded.bytes_in,
+        bytes_out = u.bytes_out + excluded.bytes_out;
+$$;
+
+-- 只允许 service_role（control）访问
+ALTER TABLE public.tunnel_usage ENABLE ROW LEVEL SECURITY;
+REVOKE EXECUTE ON FUNCTION public.add_tunnel_usage(JSONB) FROM PUBLIC, anon, authenticated;
@@ -32,6 +32,9 @@ CREATE TABLE IF NOT EXISTS public.tunnel_instances (
     token_hash  TEXT NOT NULL,
     status      TEXT DEFAULT 'offline' CHECK (status IN ('offline', 'online')),
     last_seen_at TIMESTAMPTZ,
+    expires_at  TIMESTAMPTZ,
+    idle_since  TIMESTAMPTZ,  -- 闲置挂起的时间，活跃时为空
+    agent       JSONB,        -- agent 上次连接时上报的版本、系统、主机名和标签
     created_at  TIMESTAMPTZ DEFAULT NOW(),
     updated_at  TIMESTAMPTZ DEFAULT NOW()
 );
@@ -42,6 +45,9 @@ ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS owner_id    TEXT;
 ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS project_key TEXT;
 ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS status      TEXT DEFAULT 'offline';
 ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS expires_at  TIMESTAMPTZ;
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS idle_since  TIMESTAMPTZ;
+ALTER TABLE public.tunnel_instances ADD COLUMN IF NOT EXISTS agent       JSONB;
 
 CREATE INDEX IF NOT EXISTS idx_tunnel_instances_owner ON public.tunnel_instances(owner_id);
 
@@ -54,12 +60,49 @@ CREATE TABLE IF NOT EXISTS public.tunnel_routes (
     hostname    TEXT NOT NULL UNIQUE,
     target      TEXT NOT NULL,
     is_enabled  BOOLEAN DEFAULT TRUE,
+    rate_limit  JSONB,
+    split       JSONB,
+    timeout     TEXT,
+    max_body_bytes BIGINT,
+    ip_filter   JSONB,
+    auth        JSONB,
+    rewrite     JSONB,
+    header_rules JSONB,
+    acme_passthrough BOOLEAN NOT NULL DEFAULT FALSE,
+    redirect JSONB,
+    static_response JSONB,
+    aliases JSONB,
+    maintenance JSONB,
+    cache JSONB,
+    mirror JSONB,
+    expires_at  TIMESTAMPTZ,
+    verification TEXT,
+    verify_token TEXT,
+    dns_status  TEXT,
     created_at  TIMESTAMPTZ DEFAULT NOW(),
     updated_at  TIMESTAMPTZ DEFAULT NOW()
 );
 
 CREATE INDEX IF NOT EXISTS idx_tunnel_routes_tunnel_id ON public.tunnel_routes(tunnel_id);
 CREATE INDEX IF NOT EXISTS idx_tunnel_routes_hostname  ON public.tunnel_routes(hostname);
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS verification TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS verify_token TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS dns_status TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS split JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS timeout TEXT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS max_body_bytes BIGINT;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS ip_filter JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS auth JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS rewrite JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS header_rules JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS acme_passthrough BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS redirect JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS static_response JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS aliases JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS maintenance JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS cache JSONB;
+ALTER TABLE public.tunnel_routes ADD COLUMN IF NOT EXISTS mirror JSONB;
 
 -- ---------------------------------------------------------------
 -- 5. RLS 策略（已登录用户可读写所有数据）